@@ -0,0 +1,267 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Abuse heuristics a member can trip
+const (
+	abuseUploadRatio = "upload-ratio"
+	abuseSaturation  = "saturation"
+	abuseAllHours    = "all-hours"
+	abuseDNSVolume   = "dns-volume"
+	abuseScanning    = "scanning"
+)
+
+// AbuseSuspect is a member's usage over a window measured against the abuse
+// heuristics, with the ones it trips in Flags. Residential use downloads
+// far more than it uploads, rarely fills the plan for long, rests at night,
+// makes a modest number of DNS queries and opens connections in proportion
+// to what it downloads, unlike a compromised router or a server on a
+// residential plan
+type AbuseSuspect struct {
+	Network  string
+	MemberID string `json:",omitempty"`
+	Name     string
+	Up       float64
+	Down     float64
+	Total    float64
+	// UploadRatio is Up over Down, 0 without downloads
+	UploadRatio float64
+	// PeakMbps is the highest average rate of any period
+	PeakMbps float64
+	// SaturatedHours is the time spent above ABUSE_SATURATION of the plan
+	SaturatedHours float64
+	// ActiveHours is the percentage of the window's hours with traffic
+	ActiveHours float64
+	// DNSPerHour is the rate of DNS queries over the window, nil unless
+	// they were collected with GRAYLOG_DNS_QUERY
+	DNSPerHour *float64 `json:",omitempty"`
+	// ConnectionsPerGB is the number of connections opened per GB of
+	// traffic, counting less than a GB as one, nil unless they were
+	// collected with GRAYLOG_CONNECTIONS_QUERY. A few large downloads keep it low,
+	// thousands of scanning connections drive it up
+	ConnectionsPerGB *float64 `json:",omitempty"`
+	Flags            []string
+	Score            int
+}
+
+// periodMbps is a period's average rate in megabits per second
+func periodMbps(total float64, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return total * 8000 / duration.Seconds()
+}
+
+// assessAbuse measures each member's periods over the window against the
+// heuristics, ranking the members tripping the most first. DNS queries and
+// connections collected on a schedule of their own come in samples.
+// planMbps gives the plan speed of a member's ID, 0 when unknown, which
+// skips saturation
+func assessAbuse(settings Settings, periods []BandwidthUsagePeriod, samples []MemberMetricSample, from time.Time, to time.Time, planMbps func(memberID string) float64) []AbuseSuspect {
+	type memberPeriods struct {
+		suspect     AbuseSuspect
+		hours       map[int64]bool
+		dnsQueries  *float64
+		connections *float64
+	}
+
+	byMember := map[string]*memberPeriods{}
+	keys := []string{}
+	for _, period := range periods {
+		if period.Status != usageStatusOK {
+			continue
+		}
+
+		key := period.MemberID
+		if key == "" {
+			key = period.Name
+		}
+		member, ok := byMember[key]
+		if !ok {
+			member = &memberPeriods{
+				suspect: AbuseSuspect{Network: settings.Network, MemberID: period.MemberID, Flags: []string{}},
+				hours:   map[int64]bool{},
+			}
+			byMember[key] = member
+			keys = append(keys, key)
+		}
+		member.suspect.Name = period.Name
+
+		up, down, total := usageValue(&period)
+		member.suspect.Up += up
+		member.suspect.Down += down
+		member.suspect.Total += total
+
+		mbps := periodMbps(total, period.To.Sub(period.From))
+		if mbps > member.suspect.PeakMbps {
+			member.suspect.PeakMbps = mbps
+		}
+		if plan := planMbps(period.MemberID); plan > 0 && mbps >= plan*settings.AbuseSaturation {
+			member.suspect.SaturatedHours += period.To.Sub(period.From).Hours()
+		}
+
+		member.dnsQueries = addSums(member.dnsQueries, period.Metrics[metricDNSQueries])
+		member.connections = addSums(member.connections, period.Metrics[metricConnections])
+
+		// Only periods of up to an hour tell which hours had traffic
+		if total > 0 && period.To.Sub(period.From) <= time.Hour {
+			member.hours[period.From.Unix()/3600] = true
+		}
+	}
+
+	for _, sample := range samples {
+		key := sample.MemberID
+		if key == "" {
+			key = sample.Name
+		}
+		member, ok := byMember[key]
+		if !ok {
+			continue
+		}
+		switch sample.Metric {
+		case metricDNSQueries:
+			member.dnsQueries = addSums(member.dnsQueries, sample.Value)
+		case metricConnections:
+			member.connections = addSums(member.connections, sample.Value)
+		}
+	}
+
+	windowHours := to.Sub(from).Hours()
+	suspects := []AbuseSuspect{}
+	for _, key := range keys {
+		member := byMember[key]
+		suspect := member.suspect
+
+		if suspect.Down > 0 {
+			suspect.UploadRatio = suspect.Up / suspect.Down
+		}
+		if windowHours > 0 {
+			suspect.ActiveHours = float64(len(member.hours)) / windowHours * 100
+			if member.dnsQueries != nil {
+				perHour := *member.dnsQueries / windowHours
+				suspect.DNSPerHour = &perHour
+			}
+		}
+		if member.connections != nil {
+			// Below a GB the connections themselves are measured, so a
+			// member who barely used the network isn't flagged for a few
+			perGB := *member.connections / math.Max(suspect.Total, 1)
+			suspect.ConnectionsPerGB = &perGB
+		}
+
+		if suspect.UploadRatio >= settings.AbuseUploadRatio {
+			suspect.Flags = append(suspect.Flags, abuseUploadRatio)
+		}
+		if suspect.SaturatedHours >= settings.AbuseSaturatedHours.Hours() {
+			suspect.Flags = append(suspect.Flags, abuseSaturation)
+		}
+		if suspect.ActiveHours >= settings.AbuseActiveHours {
+			suspect.Flags = append(suspect.Flags, abuseAllHours)
+		}
+		if suspect.DNSPerHour != nil && settings.AbuseDNSPerHour > 0 && *suspect.DNSPerHour >= settings.AbuseDNSPerHour {
+			suspect.Flags = append(suspect.Flags, abuseDNSVolume)
+		}
+		if suspect.ConnectionsPerGB != nil && settings.AbuseConnectionsPerGB > 0 && *suspect.ConnectionsPerGB >= settings.AbuseConnectionsPerGB {
+			suspect.Flags = append(suspect.Flags, abuseScanning)
+		}
+		suspect.Score = len(suspect.Flags)
+
+		suspects = append(suspects, suspect)
+	}
+
+	sort.SliceStable(suspects, func(i, j int) bool {
+		if suspects[i].Score != suspects[j].Score {
+			return suspects[i].Score > suspects[j].Score
+		}
+		return suspects[i].Total > suspects[j].Total
+	})
+	return suspects
+}
+
+func (s AbuseSuspect) reportColumns() []string {
+	return []string{"NETWORK", "NAME", "SCORE", "FLAGS", "TOTAL (GB)", "UPLOAD RATIO", "PEAK (MBPS)", "SATURATED (H)", "ACTIVE HOURS (%)", "DNS (/H)", "CONNECTIONS (/GB)"}
+}
+
+func (s AbuseSuspect) reportValues(number func(*float64) string) []string {
+	return []string{
+		s.Network,
+		s.Name,
+		strconv.Itoa(s.Score),
+		strings.Join(s.Flags, " "),
+		number(&s.Total),
+		number(&s.UploadRatio),
+		number(&s.PeakMbps),
+		number(&s.SaturatedHours),
+		number(&s.ActiveHours),
+		number(s.DNSPerHour),
+		number(s.ConnectionsPerGB),
+	}
+}
+
+// abuseCommand ranks the members of every network by the abuse heuristics
+// they trip over the window, from the usage stored for it. With -all
+// members tripping none are listed too
+func abuseCommand(args []string) {
+	flags := flag.NewFlagSet("abuse", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	all := flags.Bool("all", false, "list members which trip no heuristic too")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		members, err := getMeshMembers(settings)
+		if err != nil {
+			fatal(err)
+		}
+		plans := map[string]float64{}
+		for _, member := range members {
+			plans[member.ID] = member.Fields.PlanMbps
+		}
+		planMbps := func(memberID string) float64 {
+			if plan := plans[memberID]; plan > 0 {
+				return plan
+			}
+			return settings.AbusePlanMbps
+		}
+
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, "", "", from, to)
+		if err != nil {
+			fatal(err)
+		}
+		samples, err := getMetricSamples(bwupCollection.Database().Collection(settings.MongoMemberMetricsCollection), settings.Network, from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, suspect := range assessAbuse(settings, periods, samples, from, to, planMbps) {
+			if suspect.Score == 0 && !*all {
+				continue
+			}
+			if err := report.Write(suspect); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAssessAbuse(t *testing.T) {
+	settings := Settings{
+		Network:             "test",
+		AbuseUploadRatio:    2,
+		AbuseSaturation:     0.9,
+		AbuseSaturatedHours: 2 * time.Hour,
+		AbuseActiveHours:    95,
+	}
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	hourly := func(memberID string, name string, hours int, up float64, down float64) []BandwidthUsagePeriod {
+		periods := []BandwidthUsagePeriod{}
+		for i := 0; i < hours; i++ {
+			period := usage(up, down)
+			period.MemberID = memberID
+			period.Name = name
+			period.From = from.Add(time.Duration(i) * time.Hour)
+			period.To = period.From.Add(time.Hour)
+			periods = append(periods, period)
+		}
+		return periods
+	}
+
+	periods := []BandwidthUsagePeriod{}
+	// Uploads around the clock at 45 Mbps, saturating a 50 Mbps plan
+	periods = append(periods, hourly("server", "Server", 24, 20, 0.25)...)
+	// Downloads in the evening
+	periods = append(periods, hourly("home", "Home", 6, 0.1, 2)...)
+	// Uploads more than downloading, but only for a few hours
+	periods = append(periods, hourly("backup", "Backup", 3, 3, 1)...)
+	failed := failedUsage()
+	failed.MemberID = "home"
+	periods = append(periods, failed)
+
+	plans := map[string]float64{"server": 50, "home": 50}
+	suspects := assessAbuse(settings, periods, nil, from, to, func(memberID string) float64 { return plans[memberID] })
+
+	if len(suspects) != 3 {
+		t.Fatalf("expected 3 members, got %d", len(suspects))
+	}
+
+	server := suspects[0]
+	if server.MemberID != "server" || server.Score != 3 {
+		t.Errorf("expected the server ranked first with every heuristic, got %+v", server)
+	}
+	if !reflect.DeepEqual(server.Flags, []string{abuseUploadRatio, abuseSaturation, abuseAllHours}) {
+		t.Errorf("unexpected flags %v", server.Flags)
+	}
+	if server.SaturatedHours != 24 || server.ActiveHours != 100 || server.UploadRatio != 80 {
+		t.Errorf("unexpected supporting numbers %+v", server)
+	}
+
+	backup := suspects[1]
+	if backup.MemberID != "backup" || !reflect.DeepEqual(backup.Flags, []string{abuseUploadRatio}) {
+		t.Errorf("expected the backup ranked second for its upload ratio, got %+v", backup)
+	}
+	if backup.SaturatedHours != 0 {
+		t.Errorf("members without a plan speed shouldn't be saturated, got %v hours", backup.SaturatedHours)
+	}
+
+	home := suspects[2]
+	if home.MemberID != "home" || home.Score != 0 || home.ActiveHours != 25 {
+		t.Errorf("expected the home ranked last without flags, got %+v", home)
+	}
+}
+
+func TestPeriodMbps(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    float64
+		duration time.Duration
+		expected float64
+	}{
+		{"an hour", 45, time.Hour, 100},
+		{"a day", 1.08, 24 * time.Hour, 0.1},
+		{"no duration", 1, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mbps := periodMbps(tt.total, tt.duration); mbps < tt.expected-1e-9 || mbps > tt.expected+1e-9 {
+				t.Errorf("expected %v Mbps, got %v", tt.expected, mbps)
+			}
+		})
+	}
+}
+
+func TestAssessAbuseDNS(t *testing.T) {
+	settings := Settings{Network: "test", AbuseUploadRatio: 2, AbuseSaturatedHours: time.Hour, AbuseActiveHours: 95, AbuseDNSPerHour: 3000}
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	daily := func(memberID string, dnsQueries *float64) BandwidthUsagePeriod {
+		period := usage(0.5, 4)
+		period.MemberID, period.Name = memberID, memberID
+		period.From, period.To = from, to
+		if dnsQueries != nil {
+			period.Metrics = map[string]*float64{metricDNSQueries: dnsQueries}
+		}
+		return period
+	}
+
+	// A little traffic but a resolver hammered at 5000 queries an hour
+	suspects := assessAbuse(settings, []BandwidthUsagePeriod{
+		daily("infected", floatPointer(120000)),
+		daily("home", floatPointer(4800)),
+		daily("unknown", nil),
+	}, nil, from, to, func(string) float64 { return 0 })
+
+	if len(suspects) != 3 {
+		t.Fatalf("expected 3 members, got %d", len(suspects))
+	}
+	infected := suspects[0]
+	if infected.MemberID != "infected" || !reflect.DeepEqual(infected.Flags, []string{abuseDNSVolume}) || *infected.DNSPerHour != 5000 {
+		t.Errorf("expected the infected router flagged for its DNS volume, got %+v", infected)
+	}
+	for _, suspect := range suspects[1:] {
+		if suspect.Score != 0 {
+			t.Errorf("expected %s unflagged, got %v", suspect.MemberID, suspect.Flags)
+		}
+	}
+	if home := suspects[1]; home.MemberID != "home" || *home.DNSPerHour != 200 {
+		t.Errorf("expected home's DNS rate, got %+v", home)
+	}
+	if unknown := suspects[2]; unknown.DNSPerHour != nil {
+		t.Errorf("expected no DNS rate without DNS queries collected, got %v", *unknown.DNSPerHour)
+	}
+
+	// DNS queries collected daily on their own schedule count too
+	samples := []MemberMetricSample{
+		{MemberID: "unknown", Metric: metricDNSQueries, From: from, To: to, Value: floatPointer(96000)},
+		{MemberID: "unknown", Metric: "heartbeats", From: from, To: to, Value: floatPointer(288)},
+		{MemberID: "gone", Metric: metricDNSQueries, From: from, To: to, Value: floatPointer(96000)},
+	}
+	suspects = assessAbuse(settings, []BandwidthUsagePeriod{daily("unknown", nil)}, samples, from, to, func(string) float64 { return 0 })
+	if len(suspects) != 1 || suspects[0].DNSPerHour == nil || *suspects[0].DNSPerHour != 4000 || !reflect.DeepEqual(suspects[0].Flags, []string{abuseDNSVolume}) {
+		t.Errorf("got %+v, want the sampled DNS queries flagged", suspects)
+	}
+}
+
+func TestAssessAbuseScanning(t *testing.T) {
+	settings := Settings{Network: "test", AbuseUploadRatio: 2, AbuseSaturatedHours: time.Hour, AbuseActiveHours: 95, AbuseConnectionsPerGB: 20000}
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	daily := func(memberID string, up float64, down float64, connections float64) BandwidthUsagePeriod {
+		period := usage(up, down)
+		period.MemberID, period.Name = memberID, memberID
+		period.From, period.To = from, to
+		period.Metrics = map[string]*float64{metricConnections: &connections}
+		return period
+	}
+
+	tests := []struct {
+		name    string
+		period  BandwidthUsagePeriod
+		perGB   float64
+		flagged bool
+	}{
+		{"a few large downloads", daily("movies", 1, 49, 3000), 60, false},
+		{"browsing", daily("browsing", 0.5, 1.5, 8000), 4000, false},
+		{"scanning", daily("scanner", 0.3, 0.2, 250000), 250000, true},
+		// Measured against a GB, so a quiet member isn't flagged
+		{"barely used", daily("quiet", 0.001, 0.001, 40), 40, false},
+	}
+
+	for _, test := range tests {
+		suspects := assessAbuse(settings, []BandwidthUsagePeriod{test.period}, nil, from, to, func(string) float64 { return 0 })
+		if len(suspects) != 1 {
+			t.Errorf("%s: got %d members, want 1", test.name, len(suspects))
+			continue
+		}
+		suspect := suspects[0]
+		if suspect.ConnectionsPerGB == nil || math.Abs(*suspect.ConnectionsPerGB-test.perGB) > 1e-6 {
+			t.Errorf("%s: got %v connections per GB, want %v", test.name, suspect.ConnectionsPerGB, test.perGB)
+		}
+		if flagged := reflect.DeepEqual(suspect.Flags, []string{abuseScanning}); flagged != test.flagged {
+			t.Errorf("%s: got flags %v", test.name, suspect.Flags)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxPendingSamples bounds how many samples an agent holds on to while the
+// collector is unreachable
+const maxPendingSamples = 100000
+
+// pushBatchSize is how many samples are pushed at once, keeping each push
+// well below the collector's maxIngestBodySize
+const pushBatchSize = 5000
+
+// UsageSample is the traffic of one WireGuard peer between two readings of
+// its kernel counters, as pushed by an agent. Up and Down are in bytes, and
+// ID is the sample's idempotency key. A peer can be on several interfaces,
+// each with its own counters
+type UsageSample struct {
+	ID        string
+	Network   string `json:",omitempty"`
+	Agent     string
+	Interface string `json:",omitempty"`
+	WGKey     string
+	From      time.Time
+	To        time.Time
+	Up        uint64
+	Down      uint64
+}
+
+// IngestRequest is the body pushed to the collector's ingestion endpoint.
+// Network is the network the samples belong to
+type IngestRequest struct {
+	Network string
+	Samples []UsageSample
+}
+
+// wgTransfer is a reading of a peer's counters. From the exit's point of
+// view received bytes were uploaded by the peer and sent bytes downloaded
+type wgTransfer struct {
+	Received uint64
+	Sent     uint64
+}
+
+// readWGTransfer runs `wg show <iface> transfer` and parses its
+// "<public key>\t<received>\t<sent>" lines
+func readWGTransfer(iface string) (map[string]wgTransfer, error) {
+	output, err := exec.Command("wg", "show", iface, "transfer").Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show %s transfer: %v", iface, err)
+	}
+
+	transfers := map[string]wgTransfer{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+
+		received, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sent, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		transfers[fields[0]] = wgTransfer{Received: received, Sent: sent}
+	}
+
+	return transfers, scanner.Err()
+}
+
+// TransferTracker turns successive counter readings into usage samples
+type TransferTracker struct {
+	agent    string
+	iface    string
+	previous map[string]wgTransfer
+	readAt   time.Time
+}
+
+// Update takes a new reading and returns the samples since the last one.
+// Peers seen for the first time only set a baseline, since we can't know
+// when their counters started
+func (t *TransferTracker) Update(current map[string]wgTransfer, now time.Time) []UsageSample {
+	samples := []UsageSample{}
+
+	for key, transfer := range current {
+		previous, ok := t.previous[key]
+		if !ok {
+			continue
+		}
+
+		up := counterDelta(previous.Received, transfer.Received)
+		down := counterDelta(previous.Sent, transfer.Sent)
+		if up == 0 && down == 0 {
+			continue
+		}
+
+		sample := UsageSample{
+			Agent:     t.agent,
+			Interface: t.iface,
+			WGKey:     key,
+			From:      t.readAt,
+			To:        now,
+			Up:        up,
+			Down:      down,
+		}
+		sample.ID = sampleID(sample)
+		samples = append(samples, sample)
+	}
+
+	t.previous = current
+	t.readAt = now
+
+	return samples
+}
+
+func pushSamples(settings Settings, samples []UsageSample) error {
+	client := http.Client{
+		Timeout: time.Second * 30,
+	}
+
+	body, err := json.Marshal(IngestRequest{Network: settings.Network, Samples: samples})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, settings.AgentPushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	if settings.AgentToken != "" {
+		req.Header.Add("Authorization", "Bearer "+settings.AgentToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+
+	return nil
+}
+
+// agentCommand runs on an exit node, reading the WireGuard counters of the
+// configured interfaces and pushing the deltas to the central collector
+func agentCommand(args []string) {
+	settings := loadSettings()
+
+	if settings.AgentPushURL == "" {
+		fatal("AGENT_PUSH_URL must be set to the collector's ingestion endpoint")
+	}
+
+	trackers := map[string]*TransferTracker{}
+	for _, iface := range settings.AgentInterfaces {
+		trackers[iface] = &TransferTracker{agent: settings.AgentName, iface: iface}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(settings.AgentInterval)
+	defer ticker.Stop()
+
+	pending := []UsageSample{}
+
+	for {
+		now := time.Now()
+		for iface, tracker := range trackers {
+			transfers, err := readWGTransfer(iface)
+			if err != nil {
+				log.Printf("Error reading counters: %v", err)
+				continue
+			}
+			pending = append(pending, tracker.Update(transfers, now)...)
+		}
+
+		if len(pending) > maxPendingSamples {
+			log.Printf("Dropping %d samples the collector hasn't accepted", len(pending)-maxPendingSamples)
+			pending = pending[len(pending)-maxPendingSamples:]
+		}
+
+		// Samples stay pending until the collector accepts them, oldest first
+		for len(pending) > 0 {
+			batch := pending
+			if len(batch) > pushBatchSize {
+				batch = batch[:pushBatchSize]
+			}
+			if err := pushSamples(settings, batch); err != nil {
+				log.Printf("Error pushing %d of %d pending samples: %v", len(batch), len(pending), err)
+				break
+			}
+			pending = pending[len(batch):]
+		}
+
+		select {
+		case <-ticker.C:
+		case <-signals:
+			return
+		}
+	}
+}
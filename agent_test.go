@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushBatchFitsIngestLimit(t *testing.T) {
+	now := time.Now()
+
+	// The largest samples an agent sends, with long names and counters
+	samples := make([]UsageSample, pushBatchSize)
+	for i := range samples {
+		samples[i] = UsageSample{
+			Agent:     strings.Repeat("a", 64),
+			Interface: strings.Repeat("i", 15),
+			WGKey:     strings.Repeat("k", 44),
+			From:      now,
+			To:        now,
+			Up:        1<<64 - 1,
+			Down:      1<<64 - 1,
+		}
+		samples[i].ID = sampleID(samples[i])
+	}
+
+	body, err := json.Marshal(IngestRequest{Network: strings.Repeat("n", 64), Samples: samples})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) >= maxIngestBodySize {
+		t.Errorf("a batch of %d samples takes %d bytes, the collector accepts %d", pushBatchSize, len(body), maxIngestBodySize)
+	}
+}
+
+func TestTransferTrackerUpdate(t *testing.T) {
+	tracker := &TransferTracker{agent: "exit1", iface: "wg_exit"}
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	// The first reading only sets the baseline
+	if samples := tracker.Update(map[string]wgTransfer{"key1": {Received: 100, Sent: 1000}}, start); len(samples) != 0 {
+		t.Fatalf("got samples %+v from the first reading", samples)
+	}
+
+	samples := tracker.Update(map[string]wgTransfer{
+		"key1": {Received: 150, Sent: 1000},
+		"key2": {Received: 5, Sent: 5},
+	}, start.Add(time.Minute))
+	if len(samples) != 1 {
+		t.Fatalf("got samples %+v, want one for key1", samples)
+	}
+
+	sample := samples[0]
+	if sample.WGKey != "key1" || sample.Interface != "wg_exit" || sample.Up != 50 || sample.Down != 0 ||
+		!sample.From.Equal(start) || !sample.To.Equal(start.Add(time.Minute)) || sample.ID == "" {
+		t.Errorf("got sample %+v", sample)
+	}
+
+	// Counters reset when the interface is recreated
+	samples = tracker.Update(map[string]wgTransfer{"key1": {Received: 20, Sent: 30}}, start.Add(2*time.Minute))
+	if len(samples) != 1 || samples[0].Up != 20 || samples[0].Down != 30 {
+		t.Errorf("got samples %+v after a reset", samples)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fabioberger/airtable-go"
+)
+
+// The Airtable API, and its OAuth endpoints
+const (
+	airtableAPIURL   = "https://api.airtable.com/v0"
+	airtableOAuthURL = "https://airtable.com/oauth2/v1"
+)
+
+// airtableScopes are the scopes a personal access token or OAuth grant
+// needs to read the members table
+var airtableScopes = []string{"data.records:read"}
+
+// airtablePlaceholderKey passes the client's check that it was given a
+// legacy API key, the credential then being sent by airtableTransport
+const airtablePlaceholderKey = "keyPlaceholder000"
+
+// AirtableCredential gives the bearer token of Airtable requests. refused is
+// a token Airtable refused, for a credential which can get another
+type AirtableCredential interface {
+	Token(refused string) (string, error)
+}
+
+// airtableKey is a personal access token, or a legacy API key, sent as is
+type airtableKey string
+
+func (k airtableKey) Token(refused string) (string, error) {
+	return string(k), nil
+}
+
+// airtableToken is an OAuth grant, as saved in AIRTABLE_TOKEN_FILE
+type airtableToken struct {
+	AccessToken  string
+	RefreshToken string
+	Expires      time.Time
+	Scopes       []string
+}
+
+// airtableOAuth is an OAuth grant, refreshed when its access token is about
+// to expire or is refused. Airtable refresh tokens can be used only once, so
+// each refreshed grant replaces the last in AIRTABLE_TOKEN_FILE, locked
+// meanwhile so the daemon and commands run alongside it don't both refresh
+// it. The daemon reading the members each run keeps the grant in use, which
+// it must be at least every 60 days for the refresh token not to expire
+type airtableOAuth struct {
+	clientID     string
+	clientSecret string
+	tokenURL     string
+	path         string
+	client       http.Client
+}
+
+func (o airtableOAuth) Token(refused string) (string, error) {
+	file, err := lockFile(o.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return "", fmt.Errorf("no Airtable OAuth grant in %s, run stat-collector airtable-auth", o.path)
+	}
+	var token airtableToken
+	if err := json.Unmarshal(contents, &token); err != nil {
+		return "", fmt.Errorf("%s is corrupt: %v", o.path, err)
+	}
+
+	// A refused token may have been refreshed meanwhile by another process
+	if token.AccessToken != refused && time.Now().Add(time.Minute).Before(token.Expires) {
+		return token.AccessToken, nil
+	}
+
+	refreshed, err := o.grant(url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{token.RefreshToken},
+	})
+	if err != nil {
+		return "", fmt.Errorf("refreshing the Airtable OAuth grant: %v", err)
+	}
+	if err := writeAirtableToken(o.path, refreshed); err != nil {
+		return "", err
+	}
+	return refreshed.AccessToken, nil
+}
+
+// grant requests a grant from the OAuth token endpoint, authenticating with
+// the client secret if there is one
+func (o airtableOAuth) grant(values url.Values) (airtableToken, error) {
+	if o.clientSecret == "" {
+		values.Set("client_id", o.clientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, o.tokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return airtableToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.clientSecret != "" {
+		req.SetBasicAuth(o.clientID, o.clientSecret)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return airtableToken{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return airtableToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return airtableToken{}, fmt.Errorf("Airtable returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var grant struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+	}
+	if err := json.Unmarshal(body, &grant); err != nil || grant.AccessToken == "" {
+		return airtableToken{}, fmt.Errorf("Airtable returned no access token: %s", bytes.TrimSpace(body))
+	}
+
+	return airtableToken{
+		AccessToken:  grant.AccessToken,
+		RefreshToken: grant.RefreshToken,
+		Expires:      time.Now().Add(time.Duration(grant.ExpiresIn) * time.Second),
+		Scopes:       strings.Fields(grant.Scope),
+	}, nil
+}
+
+// writeAirtableToken replaces the grant in a locked token file
+func writeAirtableToken(path string, token airtableToken) error {
+	contents, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, append(contents, '\n'))
+}
+
+// saveAirtableToken saves a new grant to the token file
+func saveAirtableToken(path string, token airtableToken) error {
+	file, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeAirtableToken(path, token)
+}
+
+// newAirtableCredential is the OAuth grant of AIRTABLE_OAUTH_CLIENT_ID if
+// set, or else AIRTABLE_API_KEY, a personal access token or a legacy API key
+func newAirtableCredential(settings Settings) (AirtableCredential, error) {
+	if settings.AirtableOAuthClientID != "" {
+		return airtableOAuth{
+			clientID:     settings.AirtableOAuthClientID,
+			clientSecret: settings.AirtableOAuthClientSecret,
+			tokenURL:     airtableOAuthURL + "/token",
+			path:         settings.AirtableTokenFile,
+			client:       http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	if settings.AirtableAPIKey == "" {
+		return nil, fmt.Errorf("reading members from Airtable needs AIRTABLE_API_KEY or AIRTABLE_OAUTH_CLIENT_ID")
+	}
+	return airtableKey(settings.AirtableAPIKey), nil
+}
+
+// airtableTransport authorizes Airtable requests with the credential,
+// retrying a request without a body once if its token is refused and the
+// credential has another
+type airtableTransport struct {
+	credential AirtableCredential
+	base       http.RoundTripper
+}
+
+func (t airtableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.credential.Token("")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authorizeRequest(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+
+	refreshed, err := t.credential.Token(token)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if refreshed == token {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(authorizeRequest(req, refreshed))
+}
+
+// authorizeRequest copies a request with a bearer token, as round trippers
+// mustn't change the requests they are given
+func authorizeRequest(req *http.Request, token string) *http.Request {
+	authorized := *req
+	authorized.Header = http.Header{}
+	for name, values := range req.Header {
+		authorized.Header[name] = values
+	}
+	authorized.Header.Set("Authorization", "Bearer "+token)
+	return &authorized
+}
+
+// newAirtableClient is an Airtable client for the members base, sending the
+// configured credential
+func newAirtableClient(settings Settings) (*airtable.Client, error) {
+	// Recorded responses need no credential
+	var credential AirtableCredential = airtableKey("")
+	if settings.Replay == "" {
+		var err error
+		if credential, err = newAirtableCredential(settings); err != nil {
+			return nil, err
+		}
+	}
+	client, err := airtable.New(airtablePlaceholderKey, settings.AirtableBaseID)
+	if err != nil {
+		return nil, err
+	}
+	client.HTTPClient = &http.Client{Transport: airtableTransport{credential: credential, base: upstreamTransport(settings, http.DefaultTransport)}}
+	return client, nil
+}
+
+// airtableTokenScopes reads the scopes of the credential's token. Legacy API
+// keys have none, reading whatever their account can
+func airtableTokenScopes(client *http.Client, apiURL string) ([]string, error) {
+	resp, err := client.Get(apiURL + "/meta/whoami")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Airtable returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var whoami struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.Unmarshal(body, &whoami); err != nil {
+		return nil, err
+	}
+	return whoami.Scopes, nil
+}
+
+// missingAirtableScopes are the scopes needed which a token lacks
+func missingAirtableScopes(scopes []string) []string {
+	has := map[string]bool{}
+	for _, scope := range scopes {
+		has[scope] = true
+	}
+	missing := []string{}
+	for _, scope := range airtableScopes {
+		if !has[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// randomURLString is a random string safe in URLs, for OAuth states and
+// PKCE verifiers
+func randomURLString(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// authorizeAirtable runs the OAuth authorization code flow with PKCE: the
+// URL granting access is printed to out, and the code Airtable redirects to
+// AIRTABLE_OAUTH_REDIRECT_URL with, served here, is exchanged for a grant
+func authorizeAirtable(settings Settings, out io.Writer) (airtableToken, error) {
+	redirect, err := url.Parse(settings.AirtableOAuthRedirectURL)
+	if err != nil || redirect.Host == "" {
+		return airtableToken{}, fmt.Errorf("invalid AIRTABLE_OAUTH_REDIRECT_URL %q", settings.AirtableOAuthRedirectURL)
+	}
+	verifier, err := randomURLString(48)
+	if err != nil {
+		return airtableToken{}, err
+	}
+	state, err := randomURLString(16)
+	if err != nil {
+		return airtableToken{}, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"client_id":             []string{settings.AirtableOAuthClientID},
+		"redirect_uri":          []string{settings.AirtableOAuthRedirectURL},
+		"response_type":         []string{"code"},
+		"scope":                 []string{strings.Join(airtableScopes, " ")},
+		"state":                 []string{state},
+		"code_challenge":        []string{base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": []string{"S256"},
+	}
+	fmt.Fprintf(out, "Grant the collector access to the members base at:\n\n%s/authorize?%s\n\n", airtableOAuthURL, query.Encode())
+
+	codes := make(chan string, 1)
+	refusals := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(redirect.Path, func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		if values.Get("state") != state {
+			http.Error(w, "unknown authorization", http.StatusBadRequest)
+			return
+		}
+		if refusal := values.Get("error"); refusal != "" {
+			fmt.Fprintln(w, "Access was not granted, you can close this page")
+			select {
+			case refusals <- fmt.Errorf("Airtable didn't grant access: %s %s", refusal, values.Get("error_description")):
+			default:
+			}
+			return
+		}
+		fmt.Fprintln(w, "Access granted, you can close this page")
+		select {
+		case codes <- values.Get("code"):
+		default:
+		}
+	})
+
+	listener, err := net.Listen("tcp", redirect.Host)
+	if err != nil {
+		return airtableToken{}, err
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-refusals:
+		return airtableToken{}, err
+	case <-time.After(10 * time.Minute):
+		return airtableToken{}, fmt.Errorf("access wasn't granted within 10 minutes")
+	}
+
+	oauth, err := newAirtableCredential(settings)
+	if err != nil {
+		return airtableToken{}, err
+	}
+	return oauth.(airtableOAuth).grant(url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+		"redirect_uri":  []string{settings.AirtableOAuthRedirectURL},
+		"code_verifier": []string{verifier},
+	})
+}
+
+// airtableAuthCommand authorizes the collector to read the members base.
+// With AIRTABLE_OAUTH_CLIENT_ID set it runs the OAuth flow and saves the
+// grant to AIRTABLE_TOKEN_FILE. It then checks the token has the scopes
+// needed, personal access tokens too, and with -check does only that
+func airtableAuthCommand(args []string) {
+	flags := flag.NewFlagSet("airtable-auth", flag.ExitOnError)
+	check := flags.Bool("check", false, "only check the scopes of the current token")
+	flags.Parse(args)
+
+	settings := loadSettings()
+
+	if settings.AirtableOAuthClientID != "" && !*check {
+		token, err := authorizeAirtable(settings, os.Stdout)
+		if err != nil {
+			fatal(err)
+		}
+		if err := saveAirtableToken(settings.AirtableTokenFile, token); err != nil {
+			fatal(err)
+		}
+		log.Printf("Saved the Airtable OAuth grant to %s", settings.AirtableTokenFile)
+	}
+
+	credential, err := newAirtableCredential(settings)
+	if err != nil {
+		fatal(err)
+	}
+	if key, ok := credential.(airtableKey); ok && strings.HasPrefix(string(key), "key") {
+		log.Printf("WARNING: AIRTABLE_API_KEY is a legacy API key, which Airtable is retiring, use a personal access token with the scopes %s", strings.Join(airtableScopes, ", "))
+		return
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: airtableTransport{credential: credential, base: http.DefaultTransport}}
+	scopes, err := airtableTokenScopes(client, airtableAPIURL)
+	if err != nil {
+		fatal(err)
+	}
+	if missing := missingAirtableScopes(scopes); len(missing) > 0 {
+		fatal(fmt.Sprintf("the Airtable token lacks the scopes %s", strings.Join(missing, ", ")))
+	}
+	log.Printf("The Airtable token has the scopes needed: %s", strings.Join(scopes, ", "))
+}
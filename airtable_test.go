@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeAirtable accepts the current access token, and refreshes the grant
+// with the current refresh token, rotating both
+type fakeAirtable struct {
+	access    string
+	refresh   string
+	refreshes int
+}
+
+func (f *fakeAirtable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/oauth2/v1/token" {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != f.refresh || r.FormValue("client_id") != "client" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		f.refreshes++
+		f.access = fmt.Sprintf("access%d", f.refreshes)
+		f.refresh = fmt.Sprintf("refresh%d", f.refreshes)
+		fmt.Fprintf(w, `{"access_token": %q, "refresh_token": %q, "expires_in": 3600, "scope": "data.records:read schema.bases:read"}`, f.access, f.refresh)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+f.access {
+		http.Error(w, `{"error": "AUTHENTICATION_REQUIRED"}`, http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprint(w, `{"id": "usr1", "scopes": ["data.records:read"]}`)
+}
+
+func TestAirtableOAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "airtable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "airtable-token.json")
+
+	airtable := &fakeAirtable{access: "stale", refresh: "refresh0"}
+	server := httptest.NewServer(airtable)
+	defer server.Close()
+
+	oauth := airtableOAuth{clientID: "client", tokenURL: server.URL + "/oauth2/v1/token", path: path}
+	client := &http.Client{Transport: airtableTransport{credential: oauth, base: http.DefaultTransport}}
+
+	if _, err := airtableTokenScopes(client, server.URL); err == nil {
+		t.Error("no grant saved: should have failed")
+	}
+
+	// Expired, so refreshed before the request
+	if err := saveAirtableToken(path, airtableToken{AccessToken: "stale", RefreshToken: "refresh0", Expires: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	scopes, err := airtableTokenScopes(client, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 1 || len(missingAirtableScopes(scopes)) != 0 {
+		t.Errorf("got scopes %v", scopes)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved airtableToken
+	if err := json.Unmarshal(contents, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "access1" || saved.RefreshToken != "refresh1" || len(saved.Scopes) != 2 {
+		t.Errorf("got %+v saved, want the refreshed grant", saved)
+	}
+
+	// Revoked early, so refreshed once refused
+	airtable.access = "revoked"
+	if _, err := airtableTokenScopes(client, server.URL); err != nil || airtable.refreshes != 2 {
+		t.Errorf("got %d refreshes and error %v, want the refused token refreshed", airtable.refreshes, err)
+	}
+	if _, err := airtableTokenScopes(client, server.URL); err != nil || airtable.refreshes != 2 {
+		t.Errorf("got %d refreshes and error %v, want the valid token kept", airtable.refreshes, err)
+	}
+
+	airtable.access = "revoked"
+	airtable.refresh = "revoked"
+	if _, err := airtableTokenScopes(client, server.URL); err == nil {
+		t.Error("grant revoked: should have failed")
+	}
+}
+
+func TestAirtableKey(t *testing.T) {
+	airtable := &fakeAirtable{access: "patABC.123"}
+	server := httptest.NewServer(airtable)
+	defer server.Close()
+
+	credential, err := newAirtableCredential(Settings{AirtableAPIKey: "patABC.123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: airtableTransport{credential: credential, base: http.DefaultTransport}}
+	if _, err := airtableTokenScopes(client, server.URL); err != nil {
+		t.Error(err)
+	}
+
+	airtable.access = "revoked"
+	if _, err := airtableTokenScopes(client, server.URL); err == nil {
+		t.Error("revoked: should have failed")
+	}
+
+	if _, err := newAirtableCredential(Settings{}); err == nil {
+		t.Error("no credential: should have failed")
+	}
+	if credential, err := newAirtableCredential(Settings{AirtableAPIKey: "patABC.123", AirtableOAuthClientID: "client"}); err != nil {
+		t.Error(err)
+	} else if _, ok := credential.(airtableOAuth); !ok {
+		t.Errorf("got %T, want the OAuth grant preferred", credential)
+	}
+}
+
+func TestMissingAirtableScopes(t *testing.T) {
+	if missing := missingAirtableScopes([]string{"schema.bases:read"}); len(missing) != 1 || missing[0] != "data.records:read" {
+		t.Errorf("got %v", missing)
+	}
+	if missing := missingAirtableScopes(nil); len(missing) != 1 {
+		t.Errorf("got %v for no scopes", missing)
+	}
+}
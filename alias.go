@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemberAlias maps a name usage was stored under to the ID of the member it
+// belongs to
+type MemberAlias struct {
+	Network   string
+	Name      string
+	MemberID  string
+	CreatedAt time.Time
+}
+
+// applyAlias records the alias and gives the usage periods and rollups stored
+// under its name without a member ID the alias's member ID, tagging those
+// stored before networks were configured with its network. It returns how
+// many documents were updated
+func applyAlias(settings Settings, db *mongo.Database, alias MemberAlias) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	_, err := db.Collection(settings.MongoAliasCollection).UpdateOne(ctx,
+		bson.M{"network": alias.Network, "name": encryptName(alias.Network, alias.Name)},
+		bson.M{"$set": alias},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, err
+	}
+
+	filter := bson.M{"network": networkMatch(alias.Network), "name": encryptName(alias.Network, alias.Name), "memberid": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"memberid": alias.MemberID, "network": alias.Network}}
+
+	var updated int64
+	for _, name := range []string{settings.MongoCollection, settings.MongoRollupCollection} {
+		collection := db.Collection(name)
+		err := mutateDocuments(ctx, db.Collection(settings.MongoMutationsCollection), collection, mutationAlias, alias.Network, filter, func() error {
+			result, err := collection.UpdateMany(ctx, filter, update)
+			if err == nil {
+				updated += result.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			return updated, err
+		}
+	}
+
+	return updated, nil
+}
+
+// aliasRenamedMembers keeps the history of renamed members together by
+// aliasing their previous name to their ID
+func aliasRenamedMembers(settings Settings, db *mongo.Database, changes []MemberChange) error {
+	for _, change := range changes {
+		if change.Kind != "modified" || change.PreviousName == "" {
+			continue
+		}
+
+		updated, err := applyAlias(settings, db, MemberAlias{
+			Network:   settings.Network,
+			Name:      change.PreviousName,
+			MemberID:  change.MemberID,
+			CreatedAt: change.DetectedAt,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Aliased %d documents of %s to %s (%s)", updated, change.PreviousName, change.Name, change.MemberID)
+	}
+	return nil
+}
+
+// aliasCommand merges the usage stored under the given names, and the
+// member's current name, under the ID of a member
+func aliasCommand(args []string) {
+	settings := loadSettings()
+
+	if len(args) < 1 {
+		fatal("usage: stat-collector alias <member record id> [name...]")
+	}
+	memberID := args[0]
+
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	names := []string{}
+	for _, member := range members {
+		if member.ID == memberID {
+			names = append(names, strings.TrimSpace(member.Fields.Name))
+		}
+	}
+	if len(names) == 0 {
+		fatal(fmt.Sprintf("no member with record ID %s", memberID))
+	}
+
+	for _, name := range args[1:] {
+		names = append(names, strings.TrimSpace(name))
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, name := range names {
+		alias := MemberAlias{
+			Network:   settings.Network,
+			Name:      name,
+			MemberID:  memberID,
+			CreatedAt: time.Now(),
+		}
+
+		updated, err := applyAlias(settings, db, alias)
+		if err != nil {
+			fatal(err)
+		}
+
+		printJSON(os.Stdout, alias)
+		log.Printf("Aliased %d documents of %s", updated, name)
+	}
+}
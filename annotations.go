@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Annotation is an operator's note giving usage context, like a replaced
+// router or a billing dispute. It is about a member, or the whole network
+// without MemberID, and about the period from From to To, or all time
+// without either. Without To the period is open. Maintenance windows are
+// annotations whose hours aren't counted in uptime
+type Annotation struct {
+	ID          string `bson:"_id"`
+	Network     string
+	MemberID    string     `json:",omitempty" bson:",omitempty"`
+	From        *time.Time `json:",omitempty"`
+	To          *time.Time `json:",omitempty"`
+	Text        string
+	Author      string
+	Maintenance bool `json:",omitempty" bson:",omitempty"`
+	CreatedAt   time.Time
+}
+
+// newRecordID makes a random ID for records the collector keeps
+func newRecordID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validate checks the annotation can be stored
+func (a Annotation) validate() error {
+	if strings.TrimSpace(a.Text) == "" {
+		return fmt.Errorf("an annotation needs text")
+	}
+	if a.From != nil && a.To != nil && a.To.Before(*a.From) {
+		return fmt.Errorf("an annotation can't end before it starts")
+	}
+	if a.Maintenance && (a.From == nil || a.To == nil) {
+		return fmt.Errorf("a maintenance window needs a start and an end")
+	}
+	return nil
+}
+
+// overlaps checks the annotation is about some of the window
+func (a Annotation) overlaps(from time.Time, to time.Time) bool {
+	if a.From != nil && !a.From.Before(to) {
+		return false
+	}
+	if a.To != nil && !a.To.After(from) {
+		return false
+	}
+	return true
+}
+
+// parseAnnotationTime reads a day written as 2026-03-12 or a time written as
+// RFC 3339, nil if empty
+func parseAnnotationTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// addAnnotation stores a new annotation, giving it its ID and time
+func addAnnotation(collection *mongo.Collection, annotation Annotation) (Annotation, error) {
+	if err := annotation.validate(); err != nil {
+		return annotation, err
+	}
+	annotation.ID = newRecordID()
+	annotation.Text = strings.TrimSpace(annotation.Text)
+	annotation.CreatedAt = time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, annotation)
+	return annotation, err
+}
+
+// getAnnotations reads the annotations of a network about the window, those
+// about the member and the whole network if memberID isn't empty. A zero
+// window reads them all
+func getAnnotations(collection *mongo.Collection, network string, memberID string, from time.Time, to time.Time) ([]Annotation, error) {
+	all := []Annotation{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"network": network}
+	if memberID != "" {
+		filter["memberid"] = bson.M{"$in": []interface{}{memberID, nil}}
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "from", Value: 1}, {Key: "createdat", Value: 1}}))
+	if err != nil {
+		return all, err
+	}
+
+	found := []Annotation{}
+	if err := cursor.All(ctx, &found); err != nil {
+		return all, err
+	}
+	for _, annotation := range found {
+		if (from.IsZero() && to.IsZero()) || annotation.overlaps(from, to) {
+			all = append(all, annotation)
+		}
+	}
+	return all, nil
+}
+
+// deleteAnnotation removes an annotation of a network, reporting whether it
+// existed
+func deleteAnnotation(collection *mongo.Collection, network string, id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id, "network": network})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (a Annotation) reportColumns() []string {
+	return []string{"ID", "NETWORK", "MEMBER", "FROM", "TO", "MAINTENANCE", "AUTHOR", "TEXT"}
+}
+
+func (a Annotation) reportValues(number func(*float64) string) []string {
+	day := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	return []string{a.ID, a.Network, a.MemberID, day(a.From), day(a.To), strconv.FormatBool(a.Maintenance), a.Author, a.Text}
+}
+
+// annotateCommand adds, lists or deletes annotations of the network. With
+// -maintenance it adds or lists maintenance windows
+func annotateCommand(args []string) {
+	usage := "usage: stat-collector annotate add|list|delete ..."
+	if len(args) == 0 {
+		fatal(usage)
+	}
+
+	flags := flag.NewFlagSet("annotate "+args[0], flag.ExitOnError)
+	memberID := flags.String("member", "", "Airtable record ID of the member, the whole network if empty")
+	fromFlag := flags.String("from", "", "start of the period, like 2026-03-12")
+	toFlag := flags.String("to", "", "end of the period, like 2026-03-13")
+	author := flags.String("author", os.Getenv("USER"), "who is adding the annotation")
+	maintenance := flags.Bool("maintenance", false, "the annotation is a maintenance window, left out of uptime")
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args[1:])
+
+	settings := loadSettings()
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	collection := db.Collection(settings.MongoAnnotationsCollection)
+
+	from, err := parseAnnotationTime(*fromFlag)
+	if err != nil {
+		fatal(fmt.Sprintf("invalid -from %q, expected a day like 2026-03-12", *fromFlag))
+	}
+	to, err := parseAnnotationTime(*toFlag)
+	if err != nil {
+		fatal(fmt.Sprintf("invalid -to %q, expected a day like 2026-03-12", *toFlag))
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	switch args[0] {
+	case "add":
+		annotation, err := addAnnotation(collection, Annotation{
+			Network:     settings.Network,
+			MemberID:    *memberID,
+			From:        from,
+			To:          to,
+			Text:        strings.Join(flags.Args(), " "),
+			Author:      *author,
+			Maintenance: *maintenance,
+		})
+		if err != nil {
+			fatal(err)
+		}
+		report.Write(annotation)
+
+	case "list":
+		window := [2]time.Time{}
+		if from != nil {
+			window[0] = *from
+		}
+		if to != nil {
+			window[1] = *to
+		} else if from != nil {
+			window[1] = time.Now()
+		}
+		annotations, err := getAnnotations(collection, settings.Network, *memberID, window[0], window[1])
+		if err != nil {
+			fatal(err)
+		}
+		for _, annotation := range annotations {
+			if *maintenance && !annotation.Maintenance {
+				continue
+			}
+			report.Write(annotation)
+		}
+
+	case "delete":
+		if flags.NArg() != 1 {
+			fatal("usage: stat-collector annotate delete <id>")
+		}
+		deleted, err := deleteAnnotation(collection, settings.Network, flags.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		if !deleted {
+			fatal(fmt.Sprintf("no annotation with ID %s", flags.Arg(0)))
+		}
+		fmt.Fprintf(os.Stderr, "Deleted annotation %s\n", flags.Arg(0))
+
+	default:
+		fatal(usage)
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// handleAnnotations lists a network's annotations to viewers, optionally
+// about one member or a window given by from and to, or only maintenance
+// windows with maintenance=true. Operators add them with POST and delete
+// them with DELETE and id
+func (s *Server) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	role := roleOperator
+	if r.Method == http.MethodGet {
+		role = roleViewer
+	}
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), role)
+	if !ok {
+		return
+	}
+	collection := tenant.usage.Database().Collection(tenant.settings.MongoAnnotationsCollection)
+
+	switch r.Method {
+	case http.MethodGet:
+		collection = tenant.reads.Database().Collection(tenant.settings.MongoAnnotationsCollection)
+
+		var window [2]time.Time
+		for i, param := range []string{"from", "to"} {
+			t, err := parseAnnotationTime(query.Get(param))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, param+" must be a day like 2026-03-12 or an RFC 3339 time")
+				return
+			}
+			if t != nil {
+				window[i] = *t
+			}
+		}
+		if window[1].IsZero() && !window[0].IsZero() {
+			window[1] = time.Now()
+		}
+
+		annotations, err := getAnnotations(collection, tenant.settings.Network, query.Get("member"), window[0], window[1])
+		if err != nil {
+			log.Printf("Error reading annotations: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error reading annotations")
+			return
+		}
+		if query.Get("maintenance") == "true" {
+			windows := []Annotation{}
+			for _, annotation := range annotations {
+				if annotation.Maintenance {
+					windows = append(windows, annotation)
+				}
+			}
+			annotations = windows
+		}
+		writeJSON(w, annotations)
+
+	case http.MethodPost:
+		var annotation Annotation
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&annotation); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid annotation: "+err.Error())
+			return
+		}
+		annotation.Network = tenant.settings.Network
+		if annotation.Author == "" {
+			annotation.Author = token.Role
+		}
+		if err := annotation.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		annotation, err := addAnnotation(collection, annotation)
+		if err != nil {
+			log.Printf("Error storing annotation: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error storing annotation")
+			return
+		}
+		tenant.results.Invalidate()
+		writeJSON(w, annotation)
+
+	case http.MethodDelete:
+		deleted, err := deleteAnnotation(collection, tenant.settings.Network, query.Get("id"))
+		tenant.results.Invalidate()
+		if err != nil {
+			log.Printf("Error deleting annotation: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error deleting annotation")
+			return
+		}
+		if !deleted {
+			writeJSONError(w, http.StatusNotFound, "no annotation with that id")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "annotations require GET, POST or DELETE")
+	}
+}
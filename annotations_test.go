@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotationOverlaps(t *testing.T) {
+	day := func(d int) *time.Time {
+		t := time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC)
+		return &t
+	}
+	from, to := *day(10), *day(20)
+
+	tests := []struct {
+		name       string
+		annotation Annotation
+		valid      bool
+	}{
+		{"all time", Annotation{}, true},
+		{"inside", Annotation{From: day(12), To: day(13)}, true},
+		{"straddling the start", Annotation{From: day(5), To: day(11)}, true},
+		{"open since before", Annotation{From: day(1)}, true},
+		{"until during", Annotation{To: day(15)}, true},
+		{"before", Annotation{From: day(1), To: day(10)}, false},
+		{"after", Annotation{From: day(20)}, false},
+		{"until before", Annotation{To: day(9)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if overlaps := tt.annotation.overlaps(from, to); overlaps != tt.valid {
+				t.Errorf("expected overlap %v, got %v", tt.valid, overlaps)
+			}
+		})
+	}
+}
+
+func TestParseAnnotationTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+		valid    bool
+	}{
+		{"empty", "", "", true},
+		{"day", "2026-03-12", "2026-03-12T00:00:00Z", true},
+		{"time", "2026-03-12T15:04:05-05:00", "2026-03-12T20:04:05Z", true},
+		{"american day", "3/12/2026", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parseAnnotationTime(tt.value)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if parsed != nil {
+				got = parsed.UTC().Format(time.RFC3339)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAnnotationValidate(t *testing.T) {
+	march := func(d int) *time.Time {
+		t := time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC)
+		return &t
+	}
+
+	tests := []struct {
+		name       string
+		annotation Annotation
+		valid      bool
+	}{
+		{"note", Annotation{Text: "router replaced"}, true},
+		{"period", Annotation{Text: "billing dispute", From: march(1), To: march(31)}, true},
+		{"blank", Annotation{Text: "  "}, false},
+		{"backwards", Annotation{Text: "outage", From: march(2), To: march(1)}, false},
+		{"maintenance", Annotation{Text: "tower work", From: march(2), To: march(3), Maintenance: true}, true},
+		{"open maintenance", Annotation{Text: "tower work", From: march(2), Maintenance: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.annotation.validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("should have failed")
+			}
+		})
+	}
+}
+
+func TestAnnotationRoutes(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens}}, nil)
+	routes := server.routes()
+
+	tests := []struct {
+		method string
+		token  string
+		status int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "mine", http.StatusForbidden},
+		{"POST", "view", http.StatusForbidden},
+		{"DELETE", "view", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/annotations", strings.NewReader(`{"Text": "router replaced"}`))
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.token, w.Code, test.status)
+		}
+	}
+}
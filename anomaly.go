@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Anomaly detection methods, selected with ANOMALY_METHOD
+const (
+	anomalyZScore = "zscore"
+	anomalyMAD    = "mad"
+)
+
+// anomalyMinHistory is the fewest earlier periods a member needs before
+// their usage is judged against them
+const anomalyMinHistory = 7
+
+// UsageAnomaly flags a usage period far out of line with the member's
+// trailing history. Score is how many deviations from the Baseline it is,
+// standard ones for zscore and scaled median absolute ones for mad
+type UsageAnomaly struct {
+	Method    string
+	Score     float64
+	Baseline  float64
+	Threshold float64
+}
+
+func validAnomalyMethod(method string) bool {
+	switch method {
+	case "", anomalyZScore, anomalyMAD:
+		return true
+	}
+	return false
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// detectAnomaly scores a total against the member's earlier totals,
+// returning nil unless it is beyond the threshold. History which doesn't
+// vary at all can't tell how far out of line a total is, so flags nothing
+func detectAnomaly(method string, threshold float64, history []float64, total float64) *UsageAnomaly {
+	if len(history) < anomalyMinHistory {
+		return nil
+	}
+
+	var baseline, score float64
+	switch method {
+	case anomalyZScore:
+		for _, value := range history {
+			baseline += value
+		}
+		baseline /= float64(len(history))
+
+		var variance float64
+		for _, value := range history {
+			variance += (value - baseline) * (value - baseline)
+		}
+		deviation := math.Sqrt(variance / float64(len(history)))
+		if deviation == 0 {
+			return nil
+		}
+		score = (total - baseline) / deviation
+
+	case anomalyMAD:
+		baseline = median(history)
+
+		deviations := make([]float64, len(history))
+		for i, value := range history {
+			deviations[i] = math.Abs(value - baseline)
+		}
+		mad := median(deviations)
+		if mad == 0 {
+			return nil
+		}
+		// Scaled so scores are comparable to z-scores for normal usage
+		score = 0.6745 * (total - baseline) / mad
+
+	default:
+		return nil
+	}
+
+	if math.Abs(score) <= threshold {
+		return nil
+	}
+	return &UsageAnomaly{Method: method, Score: score, Baseline: baseline, Threshold: threshold}
+}
+
+// getTrailingTotals reads the totals of a member's latest periods of the
+// same length stored before a period, periods without usage counting zero
+func getTrailingTotals(collection *mongo.Collection, bwup BandwidthUsagePeriod, limit int64) ([]float64, error) {
+	totals := []float64{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"network":  networkMatch(bwup.Network),
+		"duration": bwup.Duration,
+		"to":       bson.M{"$lte": bwup.From},
+		"status":   bson.M{"$ne": usageStatusFailed},
+	}
+	if bwup.MemberID != "" {
+		filter["memberid"] = bwup.MemberID
+	} else {
+		filter["name"] = encryptName(bwup.Network, bwup.Name)
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"from": -1}).SetLimit(limit))
+	if err != nil {
+		return totals, err
+	}
+
+	periods := []BandwidthUsagePeriod{}
+	if err := cursor.All(ctx, &periods); err != nil {
+		return totals, err
+	}
+	for i := range periods {
+		_, _, total := usageValue(&periods[i])
+		totals = append(totals, total)
+	}
+	return totals, nil
+}
+
+// flagAnomaly sets the anomaly of a collected period if ANOMALY_METHOD is
+// set and its usage is out of line with the member's history, warning and
+// alerting about it
+func flagAnomaly(settings Settings, collection *mongo.Collection, bwup *BandwidthUsagePeriod) {
+	if settings.AnomalyMethod == "" || bwup.Status == usageStatusFailed {
+		return
+	}
+
+	history, err := getTrailingTotals(collection, *bwup, int64(settings.AnomalyHistory))
+	if err != nil {
+		log.Printf("Error reading the usage history of %s: %v", bwup.Name, err)
+		return
+	}
+
+	_, _, total := usageValue(bwup)
+	bwup.Anomaly = detectAnomaly(settings.AnomalyMethod, settings.AnomalyThreshold, history, total)
+	if bwup.Anomaly == nil {
+		return
+	}
+
+	message := fmt.Sprintf("usage of %s is %.3f GB, %.1f deviations from the usual %.3f GB",
+		bwup.Name, total, bwup.Anomaly.Score, bwup.Anomaly.Baseline)
+	log.Printf("WARNING: %s", message)
+	publishAlert(settings, Alert{Kind: alertUsageAnomaly, Message: message, MemberID: bwup.MemberID, Name: bwup.Name})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	if got := median([]float64{5, 1, 3}); got != 3 {
+		t.Errorf("got %v, want 3", got)
+	}
+	values := []float64{4, 1, 3, 2}
+	if got := median(values); got != 2.5 {
+		t.Errorf("got %v, want 2.5", got)
+	}
+	if values[0] != 4 {
+		t.Errorf("median sorted its argument: %v", values)
+	}
+}
+
+func TestDetectAnomaly(t *testing.T) {
+	usual := []float64{10, 12, 11, 9, 10, 11, 12, 10}
+
+	tests := []struct {
+		name    string
+		method  string
+		history []float64
+		total   float64
+		score   float64
+	}{
+		{"zscore usual", anomalyZScore, usual, 12, 0},
+		{"zscore spike", anomalyZScore, usual, 40, 29.6},
+		{"zscore drop", anomalyZScore, usual, 0, -10.7},
+		{"mad usual", anomalyMAD, usual, 12, 0},
+		{"mad spike", anomalyMAD, usual, 40, 39.8},
+		// A single huge period in the history hides spikes from the z-score,
+		// but not from the median absolute deviation
+		{"zscore outlier in history", anomalyZScore, append([]float64{500}, usual...), 40, 0},
+		{"mad outlier in history", anomalyMAD, append([]float64{500}, usual...), 40, 19.6},
+		{"too little history", anomalyZScore, usual[:anomalyMinHistory-1], 40, 0},
+		{"constant history", anomalyMAD, []float64{0, 0, 0, 0, 0, 0, 0}, 40, 0},
+		{"no method", "", usual, 40, 0},
+	}
+
+	for _, test := range tests {
+		anomaly := detectAnomaly(test.method, 3.5, test.history, test.total)
+		if test.score == 0 {
+			if anomaly != nil {
+				t.Errorf("%s: flagged %+v", test.name, anomaly)
+			}
+			continue
+		}
+		if anomaly == nil {
+			t.Errorf("%s: not flagged", test.name)
+			continue
+		}
+		if anomaly.Method != test.method || anomaly.Threshold != 3.5 || math.Abs(anomaly.Score-test.score) > 0.1 {
+			t.Errorf("%s: got %+v, want a score of %v", test.name, anomaly, test.score)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// atomFeed is an Atom feed of a network's public stats, an entry per week
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string `xml:"id"`
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Summary string `xml:"summary"`
+}
+
+// publicFeedURL is where serve mode serves the network's Atom feed, which
+// is also its ID. LINK_BASE_URL is required with the feed, so it is a URL
+func publicFeedURL(settings Settings) string {
+	return strings.TrimSuffix(settings.LinkBaseURL, "/") + "/feed.atom?network=" + url.QueryEscape(settings.Network)
+}
+
+// formatGrowth reads like +12.5%, or "unknown" without a week before
+func formatGrowth(growth *float64) string {
+	if growth == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%+.1f%%", *growth)
+}
+
+// weekStart is the Monday starting the UTC week of a time
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// atomFeedSince is the start of the oldest week the feed needs, the one
+// before its first entry, for its growth
+func atomFeedSince(settings Settings, now time.Time) time.Time {
+	return weekStart(now).AddDate(0, 0, -7*settings.AtomFeedWeeks)
+}
+
+// PublicWeek sums the public stats of the runs starting in a week. Members
+// aren't added up across runs, the same members are active in most, so the
+// peak of a run is given instead. Only published numbers are used, so it
+// gives nothing away they don't
+type PublicWeek struct {
+	Start       time.Time
+	Runs        int
+	PeakMembers int
+	TotalGB     float64
+	Updated     time.Time
+}
+
+// publicWeeks sums the stats by week, newest first
+func publicWeeks(stats []PublicStats) []PublicWeek {
+	byStart := map[time.Time]*PublicWeek{}
+	weeks := []*PublicWeek{}
+	for _, s := range stats {
+		start := weekStart(s.From)
+		week, ok := byStart[start]
+		if !ok {
+			week = &PublicWeek{Start: start}
+			byStart[start] = week
+			weeks = append(weeks, week)
+		}
+		week.Runs++
+		week.TotalGB += s.TotalGB
+		if s.ActiveMembers > week.PeakMembers {
+			week.PeakMembers = s.ActiveMembers
+		}
+		if s.GeneratedAt.After(week.Updated) {
+			week.Updated = s.GeneratedAt
+		}
+	}
+
+	sorted := []PublicWeek{}
+	for _, week := range weeks {
+		sorted = append(sorted, *week)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.After(sorted[j].Start) })
+	return sorted
+}
+
+// newAtomFeed makes the feed of the latest ATOM_FEED_WEEKS weeks of the
+// stats, newest first, each with its growth over the week before
+func newAtomFeed(settings Settings, stats []PublicStats) atomFeed {
+	feedURL := publicFeedURL(settings)
+	feed := atomFeed{
+		ID:      feedURL,
+		Title:   settings.Network + " network stats",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    atomLink{Rel: "self", Href: feedURL},
+		Author:  atomAuthor{Name: settings.Network},
+		Entries: []atomEntry{},
+	}
+
+	weeks := publicWeeks(stats)
+	if len(weeks) > 0 {
+		feed.Updated = weeks[0].Updated.UTC().Format(time.RFC3339)
+	}
+
+	for i, week := range weeks {
+		if i == settings.AtomFeedWeeks {
+			break
+		}
+		var memberGrowth, usageGrowth *float64
+		if i+1 < len(weeks) && weeks[i+1].Start.Equal(week.Start.AddDate(0, 0, -7)) {
+			memberGrowth = growth(float64(week.PeakMembers), float64(weeks[i+1].PeakMembers))
+			usageGrowth = growth(week.TotalGB, weeks[i+1].TotalGB)
+		}
+
+		start := week.Start.Format("2006-01-02")
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      feedURL + "#week-" + start,
+			Title:   fmt.Sprintf("Week of %s: %d active members, %.0f GB", start, week.PeakMembers, week.TotalGB),
+			Updated: week.Updated.UTC().Format(time.RFC3339),
+			Summary: fmt.Sprintf("In the week from %s, up to %d members of %s were active and used %.0f GB over %d collection periods. Members changed by %s and usage by %s over the week before.",
+				start, week.PeakMembers, settings.Network, week.TotalGB, week.Runs, formatGrowth(memberGrowth), formatGrowth(usageGrowth)),
+		})
+	}
+	return feed
+}
+
+// marshalAtomFeed encodes the feed as an XML document
+func marshalAtomFeed(feed atomFeed) ([]byte, error) {
+	contents, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), contents...), nil
+}
+
+// savePublicStats records published stats, once per window, so the feed
+// and growth use every number as it was published rather than drawing new
+// noise for it
+func savePublicStats(collection *mongo.Collection, stats PublicStats) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"network": stats.Network, "from": stats.From, "to": stats.To}, bson.M{"$setOnInsert": stats}, options.Update().SetUpsert(true))
+	return err
+}
+
+// getPublicStats reads the network's recorded stats of the runs starting
+// since a time
+func getPublicStats(collection *mongo.Collection, network string, since time.Time) ([]PublicStats, error) {
+	stats := []PublicStats{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"network": network, "from": bson.M{"$gte": since}})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &stats)
+	return stats, err
+}
+
+// handlePublicFeed serves the Atom feed of a network's public stats. It
+// needs no token, as the stats are published anyway, but only networks
+// with PUBLIC_STATS set have one
+func (s *Server) handlePublicFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "the feed requires GET")
+		return
+	}
+
+	tenant, ok := s.tenant(r.URL.Query().Get("network"))
+	if !ok || !tenant.settings.PublicStats {
+		http.NotFound(w, r)
+		return
+	}
+
+	stats, err := getPublicStats(tenant.reads.Database().Collection(tenant.settings.MongoPublicStatsCollection), tenant.settings.Network, atomFeedSince(tenant.settings, time.Now()))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	contents, err := marshalAtomFeed(newAtomFeed(tenant.settings, stats))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write(contents)
+}
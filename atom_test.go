@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAtomFeed(t *testing.T) {
+	settings, _ := readSettings("casa", settingsEnv{"LINK_BASE_URL": "https://stats.example.org/", "ATOM_FEED_WEEKS": "2"})
+	run := func(day int, members int, total float64) PublicStats {
+		from := time.Date(2026, 10, day, 10, 0, 0, 0, time.UTC)
+		return PublicStats{Network: "casa", From: from, To: from.Add(24 * time.Hour), GeneratedAt: from.Add(25 * time.Hour), ActiveMembers: members, TotalGB: total}
+	}
+	// Weeks start on Monday, October 5 and 12
+	feed := newAtomFeed(settings, []PublicStats{
+		run(1, 30, 100),
+		run(6, 40, 150),
+		run(9, 38, 150),
+		run(12, 42, 200),
+		run(13, 45, 160),
+	})
+
+	if feed.ID != "https://stats.example.org/feed.atom?network=casa" || feed.Updated != "2026-10-14T11:00:00Z" || len(feed.Entries) != 2 {
+		t.Fatalf("got %+v", feed)
+	}
+	entry := feed.Entries[0]
+	if entry.ID != feed.ID+"#week-2026-10-12" || entry.Title != "Week of 2026-10-12: 45 active members, 360 GB" {
+		t.Errorf("got %+v", entry)
+	}
+	if !strings.Contains(entry.Summary, "over 2 collection periods. Members changed by +12.5% and usage by +20.0%") {
+		t.Errorf("got summary %q", entry.Summary)
+	}
+	// The week of September 28 is only read for growth
+	if !strings.Contains(feed.Entries[1].Summary, "Members changed by +33.3% and usage by +200.0%") {
+		t.Errorf("got summary %q", feed.Entries[1].Summary)
+	}
+
+	contents, err := marshalAtomFeed(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read atomFeed
+	if err := xml.Unmarshal(contents, &read); err != nil || read.XMLName.Space != "http://www.w3.org/2005/Atom" || read.Entries[0].Title != entry.Title {
+		t.Errorf("read back %+v, %v from %s", read, err, contents)
+	}
+}
+
+func TestWeekStart(t *testing.T) {
+	for _, day := range []time.Time{
+		time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 15, 23, 59, 0, 0, time.UTC),
+		time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+	} {
+		if start := weekStart(day); !start.Equal(time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("%v: got %v", day, start)
+		}
+	}
+}
+
+func TestPublishAtomFeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without Mongo the feed only has the run
+	settings, _ := readSettings("casa", settingsEnv{"ATOM_FEED": filepath.Join(dir, "{network}.atom")})
+	settings.From = time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+	settings.To = settings.From.Add(time.Hour)
+	if err := publishPublicFeed(settings, activePeriods(5, 50, settings.From), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "casa.atom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(contents, &feed); err != nil || len(feed.Entries) != 1 || !strings.Contains(feed.Entries[0].Title, "Week of 2026-10-12: 5 active members, 50 GB") {
+		t.Errorf("wrote %s", contents)
+	}
+}
+
+func TestHandlePublicFeedDisabled(t *testing.T) {
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {settings: Settings{Network: "casa"}}}, nil)
+	httpServer := httptest.NewServer(server.routes())
+	defer httpServer.Close()
+
+	// Networks which didn't set PUBLIC_STATS have no feed, like unknown ones
+	for _, network := range []string{"casa", "other"} {
+		response, err := http.Get(httpServer.URL + "/feed.atom?network=" + network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got %s", network, response.Status)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// UsageAudit compares the stored member usage for a window against the
+// total seen at the exits. Traffic the exits carried that no member accounts
+// for points at unregistered members or broken key attribution
+type UsageAudit struct {
+	Network             string
+	Reference           string
+	From                time.Time
+	To                  time.Time
+	Members             int
+	MemberTotal         float64
+	ExitTotal           float64
+	Unattributed        float64
+	UnattributedPercent float64
+	Flagged             bool
+	AuditedAt           time.Time
+}
+
+type memberUsageSum struct {
+	Members int
+	Up      float64
+	Down    float64
+	Total   float64
+}
+
+// getMemberUsageSum adds up the usage periods stored for the window
+func getMemberUsageSum(collection *mongo.Collection, network string, from time.Time, to time.Time) (memberUsageSum, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"network": networkMatch(network),
+		"from":    bson.M{"$gte": from},
+		"to":      bson.M{"$lte": to},
+		"status":  bson.M{"$ne": usageStatusFailed},
+	}
+
+	periods := []BandwidthUsagePeriod{}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return memberUsageSum{}, err
+	}
+	if err := cursor.All(ctx, &periods); err != nil {
+		return memberUsageSum{}, err
+	}
+
+	return sumMemberUsage(periods), nil
+}
+
+// sumMemberUsage adds up usage periods counting each member's traffic once.
+// The same time can be stored at several lengths, say by a daily and a
+// monthly run, so of overlapping periods only the earliest is counted, the
+// longest one when several start together
+func sumMemberUsage(periods []BandwidthUsagePeriod) memberUsageSum {
+	members := map[string]bool{}
+	byMember := map[string][]BandwidthUsagePeriod{}
+	for _, period := range periods {
+		member := period.MemberID
+		if member == "" {
+			member = period.Name
+		}
+		members[member] = true
+
+		// Usage pushed from each interface is separate traffic
+		key := member + "|" + period.Interface
+		byMember[key] = append(byMember[key], period)
+	}
+
+	sum := memberUsageSum{Members: len(members)}
+	for _, periods := range byMember {
+		sort.Slice(periods, func(i, j int) bool {
+			if periods[i].From.Equal(periods[j].From) {
+				return periods[i].To.After(periods[j].To)
+			}
+			return periods[i].From.Before(periods[j].From)
+		})
+
+		var counted time.Time
+		for _, period := range periods {
+			if period.From.Before(counted) {
+				continue
+			}
+			counted = period.To
+
+			if period.Up != nil {
+				sum.Up += *period.Up
+			}
+			if period.Down != nil {
+				sum.Down += *period.Down
+			}
+			if period.Total != nil {
+				sum.Total += *period.Total
+			}
+		}
+	}
+
+	return sum
+}
+
+func newUsageAudit(settings Settings, reference string, members memberUsageSum, exitTotal float64) UsageAudit {
+	audit := UsageAudit{
+		Network:      settings.Network,
+		Reference:    reference,
+		From:         settings.From,
+		To:           settings.To,
+		Members:      members.Members,
+		MemberTotal:  members.Total,
+		ExitTotal:    exitTotal,
+		Unattributed: exitTotal - members.Total,
+		AuditedAt:    time.Now(),
+	}
+
+	if exitTotal > 0 {
+		audit.UnattributedPercent = audit.Unattributed / exitTotal * 100
+	}
+
+	// Members adding up to more than the exits carried is just as wrong as
+	// less, so we flag discrepancies either way
+	audit.Flagged = math.Abs(audit.UnattributedPercent) > settings.AuditThreshold
+
+	return audit
+}
+
+// auditCommand compares stored member usage against the exit totals for a
+// window, for every network served, printing the audits in the format
+// chosen with -output
+func auditCommand(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, duration := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		settings.From = from
+		settings.To = to
+		settings.Duration = duration
+
+		auditNetwork(settings, report)
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// auditNetwork audits a network against its exit totals from the SNMP
+// samples and from the stat source if it supports it
+func auditNetwork(settings Settings, report *ReportWriter) {
+	from, to := settings.From, settings.To
+
+	bwupCollection, err := getBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+	db := bwupCollection.Database()
+
+	members, err := getMemberUsageSum(bwupCollection, settings.Network, from, to)
+	if err != nil {
+		fatal(err)
+	}
+
+	audits := []UsageAudit{}
+
+	if len(settings.SNMPTargets) > 0 {
+		targets, err := parseSNMPTargets(settings.SNMPTargets)
+		if err != nil {
+			fatal(err)
+		}
+
+		var exitTotal *float64
+		for _, target := range targets {
+			usage, err := getExitUsage(db.Collection(settings.SNMPCollection), settings.Network, target.Name, from, to)
+			if err != nil {
+				fatal(err)
+			}
+			if usage.Total == nil {
+				log.Printf("Not enough SNMP samples for %s to audit against", target.Name)
+				continue
+			}
+			exitTotal = addSums(exitTotal, usage.Total)
+		}
+
+		if exitTotal != nil {
+			audits = append(audits, newUsageAudit(settings, "snmp", members, *exitTotal))
+		}
+	}
+
+	source, err := newStatSource(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	if exitSource, ok := source.(ExitTotalSource); ok {
+		exitUp, err := exitSum(settings, exitSource, "up")
+		if err != nil {
+			fatal(err)
+		}
+		exitDown, err := exitSum(settings, exitSource, "down")
+		if err != nil {
+			fatal(err)
+		}
+
+		exitTotal := addSums(exitUp, exitDown)
+		if exitTotal != nil {
+			audits = append(audits, newUsageAudit(settings, settings.StatSource, members, *exitTotal))
+		}
+	}
+
+	if len(audits) == 0 {
+		fatal("no exit totals to audit against, configure SNMP_TARGETS or a stat source with exit totals")
+	}
+
+	auditCollection := db.Collection(settings.MongoAuditCollection)
+	for _, audit := range audits {
+		if err := report.Write(audit); err != nil {
+			fatal(err)
+		}
+
+		if audit.Flagged {
+			message := fmt.Sprintf("%.2f GB (%.1f%%) of %s exit traffic is not attributed to any member",
+				audit.Unattributed, audit.UnattributedPercent, audit.Reference)
+			log.Printf("WARNING: %s", message)
+			publishAlert(settings, Alert{Kind: alertAuditFlagged, Message: message})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := auditCollection.InsertOne(ctx, audit)
+		cancel()
+		if err != nil {
+			fatal(err)
+		}
+	}
+}
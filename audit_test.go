@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSumMemberUsage(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	period := func(member string, iface string, from int, to int, up float64, down float64) BandwidthUsagePeriod {
+		total := up + down
+		return BandwidthUsagePeriod{
+			MemberID:  member,
+			Interface: iface,
+			From:      start.AddDate(0, 0, from),
+			To:        start.AddDate(0, 0, to),
+			Up:        &up,
+			Down:      &down,
+			Total:     &total,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		periods []BandwidthUsagePeriod
+		members int
+		total   float64
+	}{
+		{"nothing stored", nil, 0, 0},
+		{"consecutive days", []BandwidthUsagePeriod{
+			period("recA", "", 0, 1, 1, 1),
+			period("recA", "", 1, 2, 2, 2),
+		}, 1, 6},
+		{"month over its days", []BandwidthUsagePeriod{
+			period("recA", "", 1, 2, 2, 2),
+			period("recA", "", 0, 31, 10, 10),
+			period("recA", "", 0, 1, 1, 1),
+		}, 1, 20},
+		{"day after an overlapping week", []BandwidthUsagePeriod{
+			period("recA", "", 0, 7, 5, 5),
+			period("recA", "", 3, 4, 1, 1),
+			period("recA", "", 7, 8, 1, 0),
+		}, 1, 11},
+		{"same days of two members", []BandwidthUsagePeriod{
+			period("recA", "", 0, 1, 1, 1),
+			period("recB", "", 0, 1, 3, 3),
+		}, 2, 8},
+		{"same days on two interfaces", []BandwidthUsagePeriod{
+			period("recA", "wg_exit", 0, 1, 1, 1),
+			period("recA", "wg_exit2", 0, 1, 3, 3),
+		}, 1, 8},
+	}
+
+	for _, test := range tests {
+		sum := sumMemberUsage(test.periods)
+		if sum.Members != test.members || sum.Total != test.total || sum.Up+sum.Down != test.total {
+			t.Errorf("%s: got %+v, want %d members and a total of %v", test.name, sum, test.members, test.total)
+		}
+	}
+}
+
+func TestNewUsageAudit(t *testing.T) {
+	settings := Settings{AuditThreshold: 5}
+
+	tests := []struct {
+		members float64
+		exit    float64
+		percent float64
+		flagged bool
+	}{
+		{95, 100, 5, false},
+		{90, 100, 10, true},
+		{110, 100, -10, true},
+		{0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		audit := newUsageAudit(settings, "snmp", memberUsageSum{Total: test.members}, test.exit)
+		if audit.UnattributedPercent != test.percent || audit.Flagged != test.flagged {
+			t.Errorf("%v of %v: got %v%% flagged %v", test.members, test.exit, audit.UnattributedPercent, audit.Flagged)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API roles, from least to most privileged. Members can only read their
+// own usage, viewers read everyone's, operators can also push samples and
+// admins can do anything
+const (
+	roleMember   = "member"
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{
+	roleMember:   0,
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+// APIToken is a bearer token allowed on a network's API. MemberID is the
+// Airtable record ID of the member a member token belongs to
+type APIToken struct {
+	Role     string
+	MemberID string
+	Token    string
+}
+
+// Allows checks the token's role is at least the required one
+func (t APIToken) Allows(role string) bool {
+	return roleRanks[t.Role] >= roleRanks[role]
+}
+
+// parseAPITokens reads API_TOKENS entries, which are "role:token" or
+// "member:<record id>:token". Bare tokens are admin tokens, as they were
+// before roles existed
+func parseAPITokens(entries []string) ([]APIToken, error) {
+	tokens := []APIToken{}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+
+		var token APIToken
+		switch {
+		case len(parts) == 1:
+			token = APIToken{Role: roleAdmin, Token: parts[0]}
+		case parts[0] == roleMember && len(parts) == 3 && parts[1] != "":
+			token = APIToken{Role: roleMember, MemberID: parts[1], Token: parts[2]}
+		case parts[0] != roleMember && len(parts) == 2:
+			if _, ok := roleRanks[parts[0]]; !ok {
+				return nil, fmt.Errorf("invalid role %q in API_TOKENS", parts[0])
+			}
+			token = APIToken{Role: parts[0], Token: parts[1]}
+		default:
+			return nil, fmt.Errorf("invalid API_TOKENS entry for role %q, expected role:token or member:<record id>:token", parts[0])
+		}
+
+		if token.Token == "" {
+			return nil, fmt.Errorf("empty token for role %q in API_TOKENS", token.Role)
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// authenticate finds the tenant token the request's bearer token matches
+func authenticate(r *http.Request, tokens []APIToken) (APIToken, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return APIToken{}, false
+	}
+
+	bearer := strings.TrimPrefix(header, "Bearer ")
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token.Token)) == 1 {
+			return token, true
+		}
+	}
+	return APIToken{}, false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseAPITokens(t *testing.T) {
+	tests := []struct {
+		entries []string
+		tokens  []APIToken
+		valid   bool
+	}{
+		{[]string{}, []APIToken{}, true},
+		{[]string{"secret"}, []APIToken{{Role: roleAdmin, Token: "secret"}}, true},
+		{[]string{"viewer:v", "operator:o", "admin:a"}, []APIToken{
+			{Role: roleViewer, Token: "v"}, {Role: roleOperator, Token: "o"}, {Role: roleAdmin, Token: "a"},
+		}, true},
+		{[]string{"member:rec1:m"}, []APIToken{{Role: roleMember, MemberID: "rec1", Token: "m"}}, true},
+		{[]string{"member:m"}, nil, false},
+		{[]string{"member::m"}, nil, false},
+		{[]string{"member:rec1:"}, nil, false},
+		{[]string{"root:r"}, nil, false},
+		{[]string{"viewer:"}, nil, false},
+		{[]string{"viewer:rec1:v"}, nil, false},
+	}
+
+	for _, test := range tests {
+		tokens, err := parseAPITokens(test.entries)
+		if test.valid && err != nil {
+			t.Errorf("%v: %v", test.entries, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%v: should have failed", test.entries)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%v: got %+v, want %+v", test.entries, tokens, test.tokens)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tokens := []APIToken{{Role: roleViewer, Token: "viewer-token"}, {Role: roleMember, MemberID: "rec1", Token: "member-token"}}
+
+	tests := []struct {
+		header string
+		role   string
+		ok     bool
+	}{
+		{"Bearer viewer-token", roleViewer, true},
+		{"Bearer member-token", roleMember, true},
+		{"Bearer viewer-toke", "", false},
+		{"Bearer viewer-token2", "", false},
+		{"Bearer ", "", false},
+		{"viewer-token", "", false},
+		{"Basic dmlld2VyLXRva2Vu", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/usage", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+
+		token, ok := authenticate(r, tokens)
+		if ok != test.ok || token.Role != test.role {
+			t.Errorf("%q: got %+v, %v", test.header, token, ok)
+		}
+	}
+}
+
+func TestAPITokenAllows(t *testing.T) {
+	member := APIToken{Role: roleMember}
+	if member.Allows(roleViewer) || !member.Allows(roleMember) {
+		t.Error("member tokens must only allow member access")
+	}
+
+	operator := APIToken{Role: roleOperator}
+	if !operator.Allows(roleViewer) || operator.Allows(roleAdmin) {
+		t.Error("operator tokens allow the wrong roles")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// backfillTask is a member's usage over one period which isn't stored yet
+type backfillTask struct {
+	Member MeshMember
+	Window timeWindow
+}
+
+// storedPeriods are the windows of usage stored for each member, by member
+// ID and by name
+type storedPeriods map[string][]timeWindow
+
+func (s storedPeriods) add(member string, window timeWindow) {
+	s[member] = append(s[member], window)
+}
+
+// covers tells if the stored windows of the member, by ID or by name, cover
+// the whole window between them. Periods stored at another length, or
+// shifted by a timezone, count for the time they cover
+func (s storedPeriods) covers(member MeshMember, window timeWindow) bool {
+	periods := append(append([]timeWindow{}, s[member.ID]...), s[strings.TrimSpace(member.Fields.Name)]...)
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].From.Before(periods[j].From)
+	})
+
+	covered := window.From
+	for _, period := range periods {
+		if period.From.After(covered) {
+			break
+		}
+		if period.To.After(covered) {
+			covered = period.To
+		}
+	}
+	return !covered.Before(window.To)
+}
+
+// getStoredPeriods returns the usage periods of a network stored overlapping
+// a window. Failed periods aren't counted as stored, so they are retried
+func getStoredPeriods(collection *mongo.Collection, network string, from time.Time, to time.Time) (storedPeriods, error) {
+	stored := storedPeriods{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	filter := bson.M{
+		"network": networkMatch(network),
+		"from":    bson.M{"$lt": to},
+		"to":      bson.M{"$gt": from},
+		"status":  bson.M{"$ne": usageStatusFailed},
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return stored, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var bwup BandwidthUsagePeriod
+		if err := cursor.Decode(&bwup); err != nil {
+			return stored, err
+		}
+		window := timeWindow{From: bwup.From, To: bwup.To}
+		if bwup.MemberID != "" {
+			stored.add(bwup.MemberID, window)
+		}
+		stored.add(bwup.Name, window)
+	}
+
+	return stored, cursor.Err()
+}
+
+// planBackfill lists the member periods missing from the window, the most
+// recent first since those are the ones anyone is waiting on
+func planBackfill(members []MeshMember, windows []timeWindow, stored storedPeriods) []backfillTask {
+	tasks := []backfillTask{}
+
+	for _, window := range windows {
+		for _, member := range members {
+			if stored.covers(member, window) {
+				continue
+			}
+			tasks = append(tasks, backfillTask{Member: member, Window: window})
+		}
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Window.From.After(tasks[j].Window.From)
+	})
+
+	return tasks
+}
+
+// backfillProgress counts finished tasks and logs progress now and then
+type backfillProgress struct {
+	mutex    sync.Mutex
+	total    int
+	done     int
+	failed   int
+	started  time.Time
+	reported time.Time
+}
+
+func (p *backfillProgress) finish(failed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.done++
+	if failed {
+		p.failed++
+	}
+
+	if p.done == p.total || time.Since(p.reported) >= 10*time.Second {
+		p.reported = time.Now()
+
+		elapsed := time.Since(p.started)
+		remaining := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+		log.Printf("Backfill: %d/%d periods (%.1f%%), %d failed, about %s left",
+			p.done, p.total, float64(p.done)/float64(p.total)*100, p.failed, remaining.Round(time.Second))
+	}
+}
+
+// windowSettings narrows the settings to a backfill window
+func windowSettings(settings Settings, window timeWindow) Settings {
+	settings.From = window.From
+	settings.To = window.To
+	settings.Duration = window.To.Sub(window.From)
+	return settings
+}
+
+// runBackfill works through the tasks with at most concurrency at once and
+// starting at most rate per second. Each window is preflighted before its
+// tasks start, and under PREFLIGHT_ACTION=abort the tasks of a window which
+// fails it are skipped, to be retried by the next run
+func runBackfill(settings Settings, source StatSource, store UsageStore, tasks []backfillTask, concurrency int, rate float64) {
+	queue := make(chan backfillTask)
+	progress := &backfillProgress{total: len(tasks), started: time.Now(), reported: time.Now()}
+
+	var limiter <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for task := range queue {
+				bwup, keep := applyConsent(settings, collectMember(windowSettings(settings, task.Window), source, task.Member), task.Member)
+				if !keep {
+					progress.finish(false)
+					continue
+				}
+
+				printJSON(os.Stdout, bwup)
+
+				failed := bwup.Status == usageStatusFailed
+				if err := store.Insert(bwup); err != nil {
+					log.Printf("Error saving usage of %s: %v", bwup.Name, err)
+					failed = true
+				}
+				progress.finish(failed)
+			}
+		}()
+	}
+
+	preflighted := map[int64]error{}
+	for _, task := range tasks {
+		err, checked := preflighted[task.Window.From.Unix()]
+		if !checked {
+			err = preflight(windowSettings(settings, task.Window), source)
+			preflighted[task.Window.From.Unix()] = err
+			if err != nil {
+				publishAlert(settings, Alert{Kind: alertPreflight, Message: err.Error()})
+			}
+			if err != nil && settings.PreflightAction == preflightWarn {
+				log.Printf("WARNING: %v", err)
+			} else if err != nil {
+				log.Printf("Skipping the window starting %s: %v", task.Window.From, err)
+			}
+		}
+		if err != nil && settings.PreflightAction != preflightWarn {
+			progress.finish(true)
+			continue
+		}
+
+		if limiter != nil {
+			<-limiter
+		}
+		queue <- task
+	}
+	close(queue)
+
+	wg.Wait()
+}
+
+// backfillCommand collects the usage missing from a window, a period at a
+// time, for every network. Periods already stored are skipped, so an
+// interrupted backfill can simply be run again
+func backfillCommand(args []string) {
+	settings := loadProcessSettings()
+
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	period := flags.Duration("period", settings.BackfillPeriod, "length of the periods to collect")
+	concurrency := flags.Int("concurrency", settings.BackfillConcurrency, "periods collected at once")
+	rate := flags.Float64("rate", settings.BackfillRate, "periods started per second at most, 0 for no limit")
+	dryRun := flags.Bool("dry-run", false, "only report the missing periods")
+	flags.Parse(args)
+
+	if *period <= 0 || *concurrency <= 0 {
+		fatal("the backfill period and concurrency must be positive")
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	// Periods are aligned on the period length so reruns see the same ones
+	from = from.Truncate(*period)
+	windows := []timeWindow{}
+	for _, window := range splitWindow(from, to, *period) {
+		// A period still in progress is left for the next run
+		if window.To.Sub(window.From) == *period {
+			windows = append(windows, window)
+		}
+	}
+
+	// A dry run only reads the members and what is stored
+	networks := loadAllNetworkSettings()
+	for _, settings := range networks {
+		if !*dryRun {
+			checkCollectionSettings(settings)
+		}
+	}
+
+	for _, settings := range networks {
+		members, err := getMeshMembers(settings)
+		if err != nil {
+			fatal(err)
+		}
+		members = collectedMembers(members)
+
+		bwupCollection, err := getBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		stored, err := getStoredPeriods(bwupCollection, settings.Network, from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		pauses, err := getMemberPauses(bwupCollection.Database().Collection(settings.MongoPausesCollection), settings.Network, "", false)
+		if err != nil {
+			fatal(err)
+		}
+		tasks := unpausedTasks(planBackfill(members, windows, stored), pauses)
+		log.Printf("Backfill of network %s: %d of %d member periods missing", settings.Network, len(tasks), len(members)*len(windows))
+
+		if *dryRun || len(tasks) == 0 {
+			continue
+		}
+
+		source, err := newStatSource(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		store, err := newUsageStore(settings, bwupCollection)
+		if err != nil {
+			fatal(err)
+		}
+		balances, err := newBalanceStore(settings, bwupCollection.Database(), members)
+		if err != nil {
+			fatal(err)
+		}
+		store = MultiStore{store, balances}
+
+		runBackfill(settings, source, store, tasks, *concurrency, *rate)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanBackfill(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	day := func(n int) timeWindow {
+		return timeWindow{From: start.AddDate(0, 0, n), To: start.AddDate(0, 0, n+1)}
+	}
+	hours := func(from int, to int) timeWindow {
+		return timeWindow{From: start.Add(time.Duration(from) * time.Hour), To: start.Add(time.Duration(to) * time.Hour)}
+	}
+
+	alice := MeshMember{ID: "recA"}
+	alice.Fields.Name = "Alice"
+	bob := MeshMember{ID: "recB"}
+	bob.Fields.Name = " Bob "
+
+	stored := storedPeriods{}
+	// Alice's first day stored whole, her second by name in two halves
+	stored.add("recA", day(0))
+	stored.add("Alice", hours(36, 48))
+	stored.add("Alice", hours(24, 36))
+	// Bob's first day stored shifted by a timezone, leaving an hour out,
+	// and the rest covered by a longer period
+	stored.add("recB", hours(1, 25))
+	stored.add("Bob", hours(24, 72))
+
+	tasks := planBackfill([]MeshMember{alice, bob}, []timeWindow{day(0), day(1), day(2)}, stored)
+
+	want := []struct {
+		member string
+		window timeWindow
+	}{
+		{"recA", day(2)},
+		{"recB", day(0)},
+	}
+	if len(tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d: %+v", len(tasks), len(want), tasks)
+	}
+	for i := range want {
+		if tasks[i].Member.ID != want[i].member || !tasks[i].Window.From.Equal(want[i].window.From) {
+			t.Errorf("task %d is %s from %s, want %s from %s", i, tasks[i].Member.ID, tasks[i].Window.From, want[i].member, want[i].window.From)
+		}
+	}
+}
+
+func TestStoredPeriodsCovers(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	hours := func(from int, to int) timeWindow {
+		return timeWindow{From: start.Add(time.Duration(from) * time.Hour), To: start.Add(time.Duration(to) * time.Hour)}
+	}
+
+	member := MeshMember{ID: "recA"}
+	member.Fields.Name = "Alice"
+
+	tests := []struct {
+		name    string
+		periods []timeWindow
+		covered bool
+	}{
+		{"nothing stored", nil, false},
+		{"exact", []timeWindow{hours(0, 24)}, true},
+		{"starts late", []timeWindow{hours(1, 25)}, false},
+		{"ends early", []timeWindow{hours(-1, 23)}, false},
+		{"halves", []timeWindow{hours(12, 24), hours(0, 12)}, true},
+		{"gap between", []timeWindow{hours(0, 11), hours(12, 24)}, false},
+		{"overlapping", []timeWindow{hours(0, 14), hours(10, 20), hours(18, 30)}, true},
+	}
+
+	for _, test := range tests {
+		stored := storedPeriods{}
+		for _, period := range test.periods {
+			stored.add("recA", period)
+		}
+		if got := stored.covers(member, hours(0, 24)); got != test.covered {
+			t.Errorf("%s: got covered %v", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of balance entries
+const (
+	balancePurchase = "purchase"
+	balanceUsage    = "usage"
+)
+
+// BalanceEntry is a change to a prepaid member's balance of GB: GB bought,
+// or the usage of a period charged against them. Purchases are the member's
+// Prepaid GB column, kept in a single entry, and the top-ups added with the
+// balance command or the API. A period's charge is replaced when the period
+// is collected again, so reruns and backfills don't charge twice
+type BalanceEntry struct {
+	ID       string `bson:"_id"`
+	Network  string
+	MemberID string
+	Kind     string
+	GB       float64
+	From     *time.Time `json:",omitempty" bson:",omitempty"`
+	To       *time.Time `json:",omitempty" bson:",omitempty"`
+	Note     string     `json:",omitempty" bson:",omitempty"`
+	Author   string     `json:",omitempty" bson:",omitempty"`
+	At       time.Time
+}
+
+// MemberBalance is what is left of a prepaid member's balance. Low is set
+// once less than BALANCE_LOW_GB is left
+type MemberBalance struct {
+	Network     string
+	MemberID    string
+	PurchasedGB float64
+	UsedGB      float64
+	RemainingGB float64
+	Low         bool
+}
+
+// columnEntryID is the ID of the entry holding a member's Prepaid GB column
+func columnEntryID(network string, memberID string) string {
+	return "column:" + network + ":" + memberID
+}
+
+// usageEntryID is the ID of the entry charging a period's usage
+func usageEntryID(bwup BandwidthUsagePeriod) string {
+	return "usage:" + bwup.Network + ":" + bwup.MemberID + ":" + bwup.From.UTC().Format(time.RFC3339) + ":" + bwup.To.UTC().Format(time.RFC3339)
+}
+
+// sumBalance adds up the entries of a member. Usage is summed like the
+// audit does, so a window stored at several lengths is only charged once
+func sumBalance(network string, memberID string, entries []BalanceEntry, low float64) MemberBalance {
+	balance := MemberBalance{Network: network, MemberID: memberID}
+
+	periods := []BandwidthUsagePeriod{}
+	for _, entry := range entries {
+		if entry.Kind != balanceUsage {
+			balance.PurchasedGB += entry.GB
+			continue
+		}
+		if entry.From != nil && entry.To != nil {
+			gb := entry.GB
+			periods = append(periods, BandwidthUsagePeriod{MemberID: memberID, From: *entry.From, To: *entry.To, Total: &gb})
+		}
+	}
+
+	balance.UsedGB = sumMemberUsage(periods).Total
+	balance.RemainingGB = balance.PurchasedGB - balance.UsedGB
+	balance.Low = balance.RemainingGB < low
+	return balance
+}
+
+// balanceAlert is the alert to send when a period's charge takes a balance
+// below BALANCE_LOW_GB, or uses it up, empty if it did neither
+func balanceAlert(name string, before MemberBalance, after MemberBalance) string {
+	switch {
+	case before.RemainingGB > 0 && after.RemainingGB <= 0:
+		return fmt.Sprintf("%s has used up their prepaid %.1f GB", name, after.PurchasedGB)
+	case !before.Low && after.Low:
+		return fmt.Sprintf("%s has %.1f GB of their prepaid %.1f GB left", name, after.RemainingGB, after.PurchasedGB)
+	}
+	return ""
+}
+
+// setBalanceEntry stores an entry, replacing the one with its ID
+func setBalanceEntry(collection *mongo.Collection, entry BalanceEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": entry.ID}, entry, options.Replace().SetUpsert(true))
+	return err
+}
+
+// topUpBalance stores GB bought by a member
+func topUpBalance(collection *mongo.Collection, entry BalanceEntry) (BalanceEntry, error) {
+	if entry.MemberID == "" {
+		return entry, fmt.Errorf("a top-up needs a member")
+	}
+	if entry.GB <= 0 {
+		return entry, fmt.Errorf("a top-up needs a positive number of GB")
+	}
+
+	entry.ID = newRecordID()
+	entry.Kind = balancePurchase
+	entry.Note = strings.TrimSpace(entry.Note)
+	entry.From = nil
+	entry.To = nil
+	entry.At = time.Now().UTC()
+	return entry, setBalanceEntry(collection, entry)
+}
+
+// getBalanceEntries reads the balance entries of a network, those of the
+// member if memberID isn't empty
+func getBalanceEntries(collection *mongo.Collection, network string, memberID string) ([]BalanceEntry, error) {
+	entries := []BalanceEntry{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"network": network}
+	if memberID != "" {
+		filter["memberid"] = memberID
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return entries, err
+	}
+	err = cursor.All(ctx, &entries)
+	return entries, err
+}
+
+// groupBalanceEntries groups entries by member
+func groupBalanceEntries(entries []BalanceEntry) map[string][]BalanceEntry {
+	byMember := map[string][]BalanceEntry{}
+	for _, entry := range entries {
+		byMember[entry.MemberID] = append(byMember[entry.MemberID], entry)
+	}
+	return byMember
+}
+
+// getMemberBalances reads the balances of a network's prepaid members, or
+// of the member if memberID isn't empty, ordered by member
+func getMemberBalances(collection *mongo.Collection, settings Settings, memberID string) ([]MemberBalance, error) {
+	entries, err := getBalanceEntries(collection, settings.Network, memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := []MemberBalance{}
+	for id, entries := range groupBalanceEntries(entries) {
+		balances = append(balances, sumBalance(settings.Network, id, entries, settings.BalanceLowGB))
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].MemberID < balances[j].MemberID })
+	return balances, nil
+}
+
+// BalanceStore charges the usage stored of prepaid members against their
+// balance, alerting when one runs low. Members are prepaid once they have a
+// Prepaid GB column or a top-up
+type BalanceStore struct {
+	settings   Settings
+	collection *mongo.Collection
+
+	mutex   sync.Mutex
+	entries map[string][]BalanceEntry
+}
+
+// newBalanceStore reads the balances of the network, first updating the
+// purchases of the members' Prepaid GB columns which changed
+func newBalanceStore(settings Settings, db *mongo.Database, members []MeshMember) (*BalanceStore, error) {
+	collection := db.Collection(settings.MongoBalancesCollection)
+	entries, err := getBalanceEntries(collection, settings.Network, "")
+	if err != nil {
+		return nil, err
+	}
+	store := &BalanceStore{settings: settings, collection: collection, entries: groupBalanceEntries(entries)}
+
+	for _, member := range members {
+		if member.Fields.PrepaidGB == nil {
+			continue
+		}
+		column := BalanceEntry{
+			ID:       columnEntryID(settings.Network, member.ID),
+			Network:  settings.Network,
+			MemberID: member.ID,
+			Kind:     balancePurchase,
+			GB:       *member.Fields.PrepaidGB,
+			Note:     "Prepaid GB",
+			At:       time.Now().UTC(),
+		}
+		if store.update(column) {
+			if err := setBalanceEntry(collection, column); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return store, nil
+}
+
+// update sets an entry of a member's, reporting whether it changed
+func (s *BalanceStore) update(entry BalanceEntry) bool {
+	entries := s.entries[entry.MemberID]
+	for i, existing := range entries {
+		if existing.ID == entry.ID {
+			if existing.GB == entry.GB {
+				return false
+			}
+			entries[i] = entry
+			return true
+		}
+	}
+	s.entries[entry.MemberID] = append(entries, entry)
+	return true
+}
+
+func (s *BalanceStore) Insert(bwup BandwidthUsagePeriod) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, prepaid := s.entries[bwup.MemberID]
+	if !prepaid || bwup.Total == nil {
+		return nil
+	}
+	before := sumBalance(s.settings.Network, bwup.MemberID, entries, s.settings.BalanceLowGB)
+
+	from, to := bwup.From.UTC(), bwup.To.UTC()
+	charge := BalanceEntry{
+		ID:       usageEntryID(bwup),
+		Network:  s.settings.Network,
+		MemberID: bwup.MemberID,
+		Kind:     balanceUsage,
+		GB:       *bwup.Total,
+		From:     &from,
+		To:       &to,
+		At:       time.Now().UTC(),
+	}
+	if !s.update(charge) {
+		return nil
+	}
+	if err := setBalanceEntry(s.collection, charge); err != nil {
+		return err
+	}
+
+	after := sumBalance(s.settings.Network, bwup.MemberID, s.entries[bwup.MemberID], s.settings.BalanceLowGB)
+	if message := balanceAlert(bwup.Name, before, after); message != "" {
+		log.Printf("WARNING: %s", message)
+		publishAlert(s.settings, Alert{Kind: alertBalanceLow, Message: message, MemberID: bwup.MemberID, Name: bwup.Name})
+	}
+	return nil
+}
+
+func (b MemberBalance) reportColumns() []string {
+	return []string{"NETWORK", "MEMBER", "PURCHASED GB", "USED GB", "REMAINING GB", "LOW"}
+}
+
+func (b MemberBalance) reportValues(number func(*float64) string) []string {
+	return []string{b.Network, b.MemberID, number(&b.PurchasedGB), number(&b.UsedGB), number(&b.RemainingGB), strconv.FormatBool(b.Low)}
+}
+
+// balanceCommand lists the balances of prepaid members, or of the member
+// given, or with -top-up adds GB bought by the member to their balance
+func balanceCommand(args []string) {
+	flags := flag.NewFlagSet("balance", flag.ExitOnError)
+	topUp := flags.Float64("top-up", 0, "GB bought by the member, to add to their balance")
+	author := flags.String("author", os.Getenv("USER"), "who is adding the top-up")
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	settings := loadSettings()
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	collection := db.Collection(settings.MongoBalancesCollection)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *topUp != 0 {
+		if flags.NArg() == 0 {
+			fatal("usage: stat-collector balance -top-up <GB> <member record id> [note]")
+		}
+		_, err := topUpBalance(collection, BalanceEntry{
+			Network:  settings.Network,
+			MemberID: flags.Arg(0),
+			GB:       *topUp,
+			Note:     strings.Join(flags.Args()[1:], " "),
+			Author:   *author,
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	balances, err := getMemberBalances(collection, settings, flags.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	for _, balance := range balances {
+		report.Write(balance)
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// handleBalances lists the balances of a network's prepaid members to
+// viewers, that of the member param if given, and members their own.
+// Operators add a top-up with POST
+func (s *Server) handleBalances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	role := roleOperator
+	if r.Method == http.MethodGet {
+		role = roleMember
+	}
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), role)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		memberID := query.Get("member")
+		if !token.Allows(roleViewer) {
+			memberID = token.MemberID
+		}
+
+		balances, err := getMemberBalances(tenant.reads.Database().Collection(tenant.settings.MongoBalancesCollection), tenant.settings, memberID)
+		if err != nil {
+			log.Printf("Error reading balances: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error reading balances")
+			return
+		}
+		writeJSON(w, balances)
+
+	case http.MethodPost:
+		var entry BalanceEntry
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&entry); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid top-up: "+err.Error())
+			return
+		}
+		entry.Network = tenant.settings.Network
+		if entry.Author == "" {
+			entry.Author = token.Role
+		}
+		if entry.MemberID == "" || entry.GB <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "a top-up needs a MemberID and a positive GB")
+			return
+		}
+
+		entry, err := topUpBalance(tenant.usage.Database().Collection(tenant.settings.MongoBalancesCollection), entry)
+		if err != nil {
+			log.Printf("Error adding top-up: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error adding top-up")
+			return
+		}
+		writeJSON(w, entry)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "balances require GET or POST")
+	}
+}
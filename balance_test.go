@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSumBalance(t *testing.T) {
+	hour := func(h int) *time.Time {
+		at := time.Date(2026, 10, 1, h, 0, 0, 0, time.UTC)
+		return &at
+	}
+	entries := []BalanceEntry{
+		{Kind: balancePurchase, GB: 10},
+		{Kind: balancePurchase, GB: 5},
+		{Kind: balanceUsage, GB: 2, From: hour(0), To: hour(1)},
+		{Kind: balanceUsage, GB: 3, From: hour(1), To: hour(2)},
+		// The same hours collected again by a longer run are charged once
+		{Kind: balanceUsage, GB: 5, From: hour(0), To: hour(2)},
+		{Kind: balanceUsage, GB: 1, From: hour(2), To: hour(3)},
+	}
+
+	balance := sumBalance("casa", "rec1", entries, 10)
+	if balance.PurchasedGB != 15 || balance.UsedGB != 6 || balance.RemainingGB != 9 || !balance.Low {
+		t.Errorf("got %+v", balance)
+	}
+}
+
+func TestBalanceAlert(t *testing.T) {
+	tests := []struct {
+		before, after MemberBalance
+		alert         string
+	}{
+		{MemberBalance{RemainingGB: 5}, MemberBalance{RemainingGB: 4}, ""},
+		{MemberBalance{RemainingGB: 5}, MemberBalance{RemainingGB: 0.5, PurchasedGB: 10, Low: true}, "Ana has 0.5 GB of their prepaid 10.0 GB left"},
+		{MemberBalance{RemainingGB: 0.5, Low: true}, MemberBalance{RemainingGB: 0.2, Low: true}, ""},
+		{MemberBalance{RemainingGB: 0.5, Low: true}, MemberBalance{RemainingGB: -1, PurchasedGB: 10, Low: true}, "Ana has used up their prepaid 10.0 GB"},
+		{MemberBalance{RemainingGB: -1, Low: true}, MemberBalance{RemainingGB: -2, Low: true}, ""},
+	}
+
+	for _, test := range tests {
+		if alert := balanceAlert("Ana", test.before, test.after); alert != test.alert {
+			t.Errorf("%+v to %+v: got %q, want %q", test.before, test.after, alert, test.alert)
+		}
+	}
+}
+
+func TestBalanceStoreUpdate(t *testing.T) {
+	store := &BalanceStore{entries: map[string][]BalanceEntry{}}
+	period := BalanceEntry{ID: "usage:1", MemberID: "rec1", Kind: balanceUsage, GB: 2}
+
+	if !store.update(period) || store.update(period) {
+		t.Error("expected only the first charge to change the balance")
+	}
+	period.GB = 3
+	if !store.update(period) || len(store.entries["rec1"]) != 1 || store.entries["rec1"][0].GB != 3 {
+		t.Errorf("got %+v, want the period's charge replaced", store.entries["rec1"])
+	}
+}
+
+func TestBalanceRoutes(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens}}, nil)
+	routes := server.routes()
+
+	tests := []struct {
+		method string
+		token  string
+		status int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"POST", "mine", http.StatusForbidden},
+		{"POST", "view", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/balances", strings.NewReader(`{"MemberID": "rec1", "GB": 10}`))
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.token, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bigQueryScope is the OAuth scope the sink asks service accounts for
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery"
+
+// bigQueryField is a column of a BigQuery table schema
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// bigQuerySchema is the schema of the usage table. Tables created by older
+// collectors get the columns added since, and columns are only ever added,
+// which BigQuery allows without rewriting the table
+var bigQuerySchema = []bigQueryField{
+	{"Network", "STRING", "REQUIRED"},
+	{"MemberID", "STRING", "NULLABLE"},
+	{"Name", "STRING", "REQUIRED"},
+	{"Interface", "STRING", "NULLABLE"},
+	{"From", "TIMESTAMP", "REQUIRED"},
+	{"To", "TIMESTAMP", "REQUIRED"},
+	{"DurationSeconds", "INTEGER", "REQUIRED"},
+	{"Up", "FLOAT", "NULLABLE"},
+	{"Down", "FLOAT", "NULLABLE"},
+	{"Total", "FLOAT", "NULLABLE"},
+	{"Status", "STRING", "REQUIRED"},
+	{"Error", "STRING", "NULLABLE"},
+	{"CollectedAt", "TIMESTAMP", "REQUIRED"},
+}
+
+// missingBigQueryFields returns the fields of the schema a table lacks
+func missingBigQueryFields(existing []bigQueryField) []bigQueryField {
+	has := map[string]bool{}
+	for _, field := range existing {
+		has[strings.ToLower(field.Name)] = true
+	}
+
+	missing := []bigQueryField{}
+	for _, field := range bigQuerySchema {
+		if !has[strings.ToLower(field.Name)] {
+			// Columns added to a table holding rows can't be required
+			field.Mode = "NULLABLE"
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+// serviceAccount is the part of a Google service account key file the sink
+// signs in with
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// bigQueryToken gets access tokens for a service account, keeping each
+// until shortly before it expires
+type bigQueryToken struct {
+	account   serviceAccount
+	key       *rsa.PrivateKey
+	mutex     sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newBigQueryToken(keyFile []byte) (*bigQueryToken, error) {
+	account := serviceAccount{}
+	if err := json.Unmarshal(keyFile, &account); err != nil {
+		return nil, fmt.Errorf("invalid BIGQUERY_CREDENTIALS: %v", err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("invalid BIGQUERY_CREDENTIALS, expected a service account key with client_email, private_key and token_uri")
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid BIGQUERY_CREDENTIALS, the private key isn't PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BIGQUERY_CREDENTIALS private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid BIGQUERY_CREDENTIALS, the private key isn't RSA")
+	}
+
+	return &bigQueryToken{account: account, key: key}, nil
+}
+
+// assertion is the signed JWT exchanged for an access token
+func (t *bigQueryToken) assertion(now time.Time) (string, error) {
+	encode := func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(encoded), err
+	}
+
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encode(map[string]interface{}{
+		"iss":   t.account.ClientEmail,
+		"scope": bigQueryScope,
+		"aud":   t.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := header + "." + claims
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Get returns an access token, signing in again if the last one is about
+// to expire
+func (t *bigQueryToken) Get() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if t.token != "" && now.Add(time.Minute).Before(t.expiresAt) {
+		return t.token, nil
+	}
+
+	assertion, err := t.assertion(now)
+	if err != nil {
+		return "", err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(t.account.TokenURI, url.Values{
+		"grant_type": []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  []string{assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("signing in to BigQuery returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("signing in to BigQuery returned no access token: %s", bytes.TrimSpace(body))
+	}
+
+	t.token = token.AccessToken
+	t.expiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// BigQueryStore streams usage periods into a BigQuery table, creating it,
+// partitioned by day of From, or adding the columns it lacks when it
+// starts. Streamed rows can't be replaced, so the table keeps every period
+// collected, with CollectedAt telling versions of a window apart, and
+// queries wanting the latest should pick it
+type BigQueryStore struct {
+	settings Settings
+	token    *bigQueryToken
+	client   http.Client
+}
+
+func newBigQueryStore(settings Settings) (BigQueryStore, error) {
+	if settings.BigQueryProject == "" || settings.BigQueryDataset == "" || settings.BigQueryCredentials == "" {
+		return BigQueryStore{}, fmt.Errorf("the bigquery store needs BIGQUERY_PROJECT, BIGQUERY_DATASET and BIGQUERY_CREDENTIALS")
+	}
+
+	keyFile, err := ioutil.ReadFile(settings.BigQueryCredentials)
+	if err != nil {
+		return BigQueryStore{}, err
+	}
+	token, err := newBigQueryToken(keyFile)
+	if err != nil {
+		return BigQueryStore{}, err
+	}
+
+	store := BigQueryStore{settings: settings, token: token, client: http.Client{Timeout: 60 * time.Second}}
+	if err := store.ensureTable(); err != nil {
+		return BigQueryStore{}, err
+	}
+	return store, nil
+}
+
+// request calls the BigQuery API, decoding the response into result. It
+// returns the status, so callers can tell a missing table from a failure
+func (s BigQueryStore) request(method string, path string, body interface{}, result interface{}) (int, error) {
+	token, err := s.token.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, s.settings.BigQueryURL+"projects/"+url.PathEscape(s.settings.BigQueryProject)+"/datasets/"+url.PathEscape(s.settings.BigQueryDataset)+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("bigquery returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	if result != nil {
+		return resp.StatusCode, json.Unmarshal(respBody, result)
+	}
+	return resp.StatusCode, nil
+}
+
+// ensureTable creates the usage table, or adds the columns it lacks
+func (s BigQueryStore) ensureTable() error {
+	tablePath := "/tables/" + url.PathEscape(s.settings.BigQueryTable)
+
+	var table struct {
+		Schema struct {
+			Fields []bigQueryField `json:"fields"`
+		} `json:"schema"`
+	}
+	status, err := s.request(http.MethodGet, tablePath, nil, &table)
+	if status == http.StatusNotFound {
+		_, err := s.request(http.MethodPost, "/tables", map[string]interface{}{
+			"tableReference": map[string]string{
+				"projectId": s.settings.BigQueryProject,
+				"datasetId": s.settings.BigQueryDataset,
+				"tableId":   s.settings.BigQueryTable,
+			},
+			"schema":           map[string]interface{}{"fields": bigQuerySchema},
+			"timePartitioning": map[string]string{"type": "DAY", "field": "From"},
+		}, nil)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	missing := missingBigQueryFields(table.Schema.Fields)
+	if len(missing) == 0 {
+		return nil
+	}
+	fields := append(table.Schema.Fields, missing...)
+	_, err = s.request(http.MethodPatch, tablePath, map[string]interface{}{"schema": map[string]interface{}{"fields": fields}}, nil)
+	return err
+}
+
+// bigQueryRow is a usage period as a row of the table, with the insert ID
+// BigQuery drops retried inserts by
+func bigQueryRow(bwup BandwidthUsagePeriod, collectedAt time.Time) map[string]interface{} {
+	timestamp := func(t time.Time) string { return t.UTC().Format(time.RFC3339Nano) }
+
+	return map[string]interface{}{
+		"insertId": strings.Join([]string{bwup.Network, bwup.MemberID, bwup.Name, bwup.Interface, timestamp(bwup.From), timestamp(bwup.To), timestamp(collectedAt)}, "|"),
+		"json": map[string]interface{}{
+			"Network":         bwup.Network,
+			"MemberID":        bwup.MemberID,
+			"Name":            bwup.Name,
+			"Interface":       bwup.Interface,
+			"From":            timestamp(bwup.From),
+			"To":              timestamp(bwup.To),
+			"DurationSeconds": int64(bwup.Duration / time.Second),
+			"Up":              bwup.Up,
+			"Down":            bwup.Down,
+			"Total":           bwup.Total,
+			"Status":          bwup.Status,
+			"Error":           bwup.Error,
+			"CollectedAt":     timestamp(collectedAt),
+		},
+	}
+}
+
+func (s BigQueryStore) Insert(bwup BandwidthUsagePeriod) error {
+	var response struct {
+		InsertErrors []struct {
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+
+	_, err := s.request(http.MethodPost, "/tables/"+url.PathEscape(s.settings.BigQueryTable)+"/insertAll", map[string]interface{}{
+		"rows": []interface{}{bigQueryRow(bwup, time.Now())},
+	}, &response)
+	if err != nil {
+		return err
+	}
+
+	for _, insertError := range response.InsertErrors {
+		for _, e := range insertError.Errors {
+			return fmt.Errorf("bigquery refused the usage of %s: %s: %s", bwup.Name, e.Reason, e.Message)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMissingBigQueryFields(t *testing.T) {
+	if missing := missingBigQueryFields(bigQuerySchema); len(missing) != 0 {
+		t.Errorf("complete table: got %v missing", missing)
+	}
+
+	// A table from before Interface and CollectedAt were collected
+	existing := []bigQueryField{}
+	for _, field := range bigQuerySchema {
+		if field.Name != "Interface" && field.Name != "CollectedAt" {
+			existing = append(existing, bigQueryField{Name: strings.ToLower(field.Name), Type: field.Type})
+		}
+	}
+	missing := missingBigQueryFields(existing)
+	if len(missing) != 2 || missing[0].Name != "Interface" || missing[1].Name != "CollectedAt" {
+		t.Fatalf("got %v, want Interface and CollectedAt", missing)
+	}
+	if missing[1].Mode != "NULLABLE" {
+		t.Errorf("got mode %q, added columns can't be required", missing[1].Mode)
+	}
+}
+
+// fakeBigQuery serves the token and table endpoints the sink calls,
+// recording the requests made
+type fakeBigQuery struct {
+	table    []bigQueryField
+	requests []string
+	rows     []map[string]interface{}
+	signIns  int
+}
+
+func (f *fakeBigQuery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		f.signIns++
+		if r.FormValue("assertion") == "" {
+			http.Error(w, "no assertion", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	var body struct {
+		Schema struct {
+			Fields []bigQueryField `json:"fields"`
+		} `json:"schema"`
+		Rows []map[string]interface{} `json:"rows"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch r.Method + " " + r.URL.Path {
+	case "GET /projects/analytics/datasets/mesh/tables/usage_periods":
+		if f.table == nil {
+			http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"schema": map[string]interface{}{"fields": f.table}})
+	case "POST /projects/analytics/datasets/mesh/tables", "PATCH /projects/analytics/datasets/mesh/tables/usage_periods":
+		f.table = body.Schema.Fields
+		w.Write([]byte(`{}`))
+	case "POST /projects/analytics/datasets/mesh/tables/usage_periods/insertAll":
+		f.rows = append(f.rows, body.Rows...)
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// bigQuerySettings writes a service account key signing in at server and
+// returns settings streaming to it
+func bigQuerySettings(t *testing.T, dir string, server *httptest.Server) Settings {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(serviceAccount{
+		ClientEmail: "collector@analytics.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL + "/token",
+	})
+	path := filepath.Join(dir, "account.json")
+	if err := ioutil.WriteFile(path, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return Settings{
+		BigQueryURL:         server.URL + "/",
+		BigQueryProject:     "analytics",
+		BigQueryDataset:     "mesh",
+		BigQueryTable:       "usage_periods",
+		BigQueryCredentials: path,
+	}
+}
+
+func TestBigQueryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bigquery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeBigQuery{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	settings := bigQuerySettings(t, dir, server)
+
+	store, err := newBigQueryStore(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.table) != len(bigQuerySchema) {
+		t.Errorf("created a table of %d columns, want %d", len(fake.table), len(bigQuerySchema))
+	}
+
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	bwup := usage(3, 12)
+	bwup.Network, bwup.Name, bwup.From, bwup.To, bwup.Duration = "casa", "Ana", from, from.Add(24*time.Hour), 24*time.Hour
+	for i := 0; i < 2; i++ {
+		if err := store.Insert(bwup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(fake.rows))
+	}
+	row := fake.rows[0]["json"].(map[string]interface{})
+	if row["Name"] != "Ana" || row["From"] != "2026-09-01T00:00:00Z" || row["DurationSeconds"] != float64(86400) || row["Down"] != float64(12) {
+		t.Errorf("got row %v", row)
+	}
+	if fake.rows[0]["insertId"] == "" {
+		t.Error("rows should have an insert ID")
+	}
+	if fake.signIns != 1 {
+		t.Errorf("signed in %d times, want the token kept", fake.signIns)
+	}
+
+	// Starting again against a table missing a column adds it
+	fake.table = fake.table[:len(fake.table)-1]
+	fake.requests = nil
+	if _, err := newBigQueryStore(settings); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) != 2 || fake.requests[1] != "PATCH /projects/analytics/datasets/mesh/tables/usage_periods" {
+		t.Errorf("got requests %v, want the table patched", fake.requests)
+	}
+	if len(fake.table) != len(bigQuerySchema) {
+		t.Errorf("patched a table of %d columns, want %d", len(fake.table), len(bigQuerySchema))
+	}
+}
+
+func TestNewBigQueryTokenErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyFile string
+	}{
+		{"not JSON", "project=analytics"},
+		{"no private key", `{"client_email": "collector@analytics", "token_uri": "https://oauth2.googleapis.com/token"}`},
+		{"not PEM", `{"client_email": "collector@analytics", "private_key": "secret", "token_uri": "https://oauth2.googleapis.com/token"}`},
+	}
+
+	for _, test := range tests {
+		if _, err := newBigQueryToken([]byte(test.keyFile)); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blackout is a time of day during which scheduled jobs don't start, like
+// the nightly index optimization of Graylog. It may run past midnight
+type Blackout struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("invalid hour in %q", value)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid minute in %q", value)
+	}
+
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// parseBlackouts parses a list of HH:MM-HH:MM times of day
+func parseBlackouts(list []string) ([]Blackout, error) {
+	blackouts := []Blackout{}
+	for _, item := range list {
+		bounds := strings.Split(item, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid blackout %q, expected HH:MM-HH:MM", item)
+		}
+
+		start, err := parseTimeOfDay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("blackout %q is empty", item)
+		}
+
+		blackouts = append(blackouts, Blackout{start: start, end: end})
+	}
+	return blackouts, nil
+}
+
+// atDay returns the time of day offset on the day of t in its location
+func atDay(t time.Time, days int, offset time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+days, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+// endAfter returns the end of the blackout t falls in, or the zero time if
+// it falls in none. A blackout running past midnight may have started the
+// day before
+func (b Blackout) endAfter(t time.Time) time.Time {
+	for days := -1; days <= 0; days++ {
+		start := atDay(t, days, b.start)
+		end := atDay(t, days, b.end)
+		if b.end < b.start {
+			end = atDay(t, days+1, b.end)
+		}
+
+		if !t.Before(start) && t.Before(end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
+
+// afterBlackouts delays t, in the location the blackouts are set in, until
+// it falls in none of them
+func afterBlackouts(t time.Time, blackouts []Blackout, location *time.Location) time.Time {
+	t = t.In(location)
+	for moved := true; moved; {
+		moved = false
+		for _, blackout := range blackouts {
+			if end := blackout.endAfter(t); !end.IsZero() {
+				t, moved = end, true
+			}
+		}
+	}
+	return t
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBlackouts(t *testing.T) {
+	tests := []struct {
+		list  []string
+		valid bool
+	}{
+		{[]string{"02:00-03:30"}, true},
+		{[]string{"23:30-00:45", "12:00-12:05"}, true},
+		{[]string{"02:00"}, false},
+		{[]string{"2-3"}, false},
+		{[]string{"24:00-01:00"}, false},
+		{[]string{"02:60-03:00"}, false},
+		{[]string{"02:00-02:00"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := parseBlackouts(test.list)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: got error %v", test.list, err)
+		}
+	}
+}
+
+func TestAfterBlackouts(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	blackouts, err := parseBlackouts([]string{"02:00-03:30", "03:30-04:00", "23:30-00:45"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, newYork)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{"outside", at(16, 1, 59), at(16, 1, 59)},
+		{"start", at(16, 2, 0), at(16, 4, 0)},
+		{"adjoining blackouts", at(16, 3, 0), at(16, 4, 0)},
+		{"end", at(16, 4, 0), at(16, 4, 0)},
+		{"before midnight", at(16, 23, 45), at(17, 0, 45)},
+		{"after midnight", at(17, 0, 15), at(17, 0, 45)},
+		{"in UTC", at(16, 2, 15).UTC(), at(16, 4, 0)},
+	}
+
+	for _, test := range tests {
+		if got := afterBlackouts(test.t, blackouts, newYork); !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ResultCache keeps the results of a tenant's frequent API reads, like the
+// dashboard summary and members' totals, in memory for RESULT_CACHE_TTL so
+// a small Mongo server isn't asked for them on every request. Writes made
+// by the server empty it, and writes made by other processes show once the
+// TTL runs out
+type ResultCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]cachedResult
+	// generation counts invalidations, so a read which started before one
+	// isn't cached after it
+	generation uint64
+}
+
+type cachedResult struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// newResultCache returns a cache keeping results for ttl, or nil, which
+// caches nothing, if ttl isn't positive
+func newResultCache(ttl time.Duration) *ResultCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &ResultCache{ttl: ttl, entries: map[string]cachedResult{}}
+}
+
+// Get returns the cached result for key, or loads and caches it. Failed
+// loads aren't cached. Results are shared between requests, so callers
+// must not modify them
+func (c *ResultCache) Get(key string, load func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return load()
+	}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mutex.Unlock()
+
+	now := time.Now()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generation != generation {
+		return value, nil
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[key] = cachedResult{value: value, expiresAt: now.Add(c.ttl)}
+	return value, nil
+}
+
+// Invalidate drops every cached result, after a write
+func (c *ResultCache) Invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = map[string]cachedResult{}
+	c.generation++
+}
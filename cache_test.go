@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	cache := newResultCache(time.Minute)
+
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		value, err := cache.Get("summary", load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != 1 {
+			t.Errorf("got %v, want the first load", value)
+		}
+	}
+
+	if value, _ := cache.Get("totals", load); value != 2 {
+		t.Errorf("other key: got %v, want a new load", value)
+	}
+
+	cache.Invalidate()
+	if value, _ := cache.Get("summary", load); value != 3 {
+		t.Errorf("invalidated: got %v, want a new load", value)
+	}
+
+	cache.entries["summary"] = cachedResult{value: 3, expiresAt: time.Now().Add(-time.Second)}
+	if value, _ := cache.Get("summary", load); value != 4 {
+		t.Errorf("expired: got %v, want a new load", value)
+	}
+}
+
+func TestResultCacheErrors(t *testing.T) {
+	cache := newResultCache(time.Minute)
+
+	if _, err := cache.Get("summary", func() (interface{}, error) { return nil, fmt.Errorf("mongo is down") }); err == nil {
+		t.Error("should have failed")
+	}
+	if value, _ := cache.Get("summary", func() (interface{}, error) { return "read", nil }); value != "read" {
+		t.Errorf("got %v, failed loads shouldn't be cached", value)
+	}
+}
+
+func TestResultCacheInvalidatedDuringLoad(t *testing.T) {
+	cache := newResultCache(time.Minute)
+
+	// A write landing while the result is read makes it stale already
+	value, _ := cache.Get("summary", func() (interface{}, error) {
+		cache.Invalidate()
+		return "stale", nil
+	})
+	if value != "stale" {
+		t.Errorf("got %v, want the result read", value)
+	}
+	if value, _ := cache.Get("summary", func() (interface{}, error) { return "fresh", nil }); value != "fresh" {
+		t.Errorf("got %v, the stale result shouldn't be cached", value)
+	}
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+	cache := newResultCache(0)
+	if cache != nil {
+		t.Fatal("a TTL of 0 should disable the cache")
+	}
+
+	loads := 0
+	for i := 0; i < 2; i++ {
+		cache.Get("summary", func() (interface{}, error) {
+			loads++
+			return loads, nil
+		})
+	}
+	cache.Invalidate()
+	if loads != 2 {
+		t.Errorf("got %d loads, want every read loaded", loads)
+	}
+}
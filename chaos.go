@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosFlagPrefix starts the names of the failure injection flags, which
+// are left out of the usage so nobody turns them on in production by
+// reading -h
+const chaosFlagPrefix = "chaos-"
+
+// ChaosSettings inject failures at random, so alerting, retries and the
+// handling of partial failures can be tried in staging. Rates are the
+// chance, from 0 to 1, of each call failing or being slowed down
+type ChaosSettings struct {
+	GraylogErrorRate float64
+	MongoErrorRate   float64
+	SlowRate         float64
+	SlowDelay        time.Duration
+}
+
+// Enabled tells whether any failure is injected
+func (c ChaosSettings) Enabled() bool {
+	return c.GraylogErrorRate > 0 || c.MongoErrorRate > 0 || (c.SlowRate > 0 && c.SlowDelay > 0)
+}
+
+var (
+	chaosMutex  sync.Mutex
+	chaosRandom = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// chaosRoll returns true with the chance rate
+func chaosRoll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	chaosMutex.Lock()
+	defer chaosMutex.Unlock()
+	return chaosRandom.Float64() < rate
+}
+
+// slowDown sleeps for SlowDelay at SlowRate, as a slow response would
+func (c ChaosSettings) slowDown() {
+	if c.SlowDelay > 0 && chaosRoll(c.SlowRate) {
+		time.Sleep(c.SlowDelay)
+	}
+}
+
+// graylogFailure is a 500 from Graylog at GraylogErrorRate, or nil
+func (c ChaosSettings) graylogFailure() error {
+	if !chaosRoll(c.GraylogErrorRate) {
+		return nil
+	}
+	return GraylogError{Kind: graylogErrorServer, Status: http.StatusInternalServerError, Message: "chaos: injected server error"}
+}
+
+// chaosFlags adds the failure injection flags to a command's flags, hiding
+// them from its usage. The settings are filled in once flags are parsed
+func chaosFlags(flags *flag.FlagSet) *ChaosSettings {
+	chaos := &ChaosSettings{}
+	flags.Float64Var(&chaos.GraylogErrorRate, chaosFlagPrefix+"graylog-errors", 0, "rate of Graylog queries failing with a 500")
+	flags.Float64Var(&chaos.MongoErrorRate, chaosFlagPrefix+"mongo-errors", 0, "rate of Mongo usage writes failing")
+	flags.Float64Var(&chaos.SlowRate, chaosFlagPrefix+"slow", 0, "rate of Graylog queries and Mongo writes slowed down")
+	flags.DurationVar(&chaos.SlowDelay, chaosFlagPrefix+"slow-delay", 5*time.Second, "how long slowed down calls take")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n", flags.Name())
+		visible := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+		visible.SetOutput(flags.Output())
+		flags.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, chaosFlagPrefix) {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		visible.PrintDefaults()
+	}
+
+	return chaos
+}
+
+// checkChaos validates the parsed failure injection flags, warning when any
+// failure is injected
+func checkChaos(chaos ChaosSettings) error {
+	for name, rate := range map[string]float64{
+		"graylog-errors": chaos.GraylogErrorRate,
+		"mongo-errors":   chaos.MongoErrorRate,
+		"slow":           chaos.SlowRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("-%s%s must be a rate between 0 and 1, got %v", chaosFlagPrefix, name, rate)
+		}
+	}
+
+	if chaos.Enabled() {
+		log.Printf("WARNING: injecting failures: %+v", chaos)
+	}
+	return nil
+}
+
+// chaosStore fails writes to a store at MongoErrorRate, and slows them
+// down at SlowRate
+type chaosStore struct {
+	store UsageStore
+	chaos ChaosSettings
+}
+
+func (s chaosStore) Insert(bwup BandwidthUsagePeriod) error {
+	s.chaos.slowDown()
+	if chaosRoll(s.chaos.MongoErrorRate) {
+		return fmt.Errorf("chaos: injected write error for the usage of %s", bwup.Name)
+	}
+	return s.store.Insert(bwup)
+}
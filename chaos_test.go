@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckChaos(t *testing.T) {
+	tests := []struct {
+		name  string
+		chaos ChaosSettings
+		valid bool
+	}{
+		{"off", ChaosSettings{}, true},
+		{"some Graylog errors", ChaosSettings{GraylogErrorRate: 0.1}, true},
+		{"every write fails", ChaosSettings{MongoErrorRate: 1}, true},
+		{"negative", ChaosSettings{SlowRate: -0.5}, false},
+		{"percent", ChaosSettings{GraylogErrorRate: 10}, false},
+	}
+
+	for _, test := range tests {
+		err := checkChaos(test.chaos)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
+
+func TestChaosFlagsHidden(t *testing.T) {
+	flags := flag.NewFlagSet("collect", flag.ContinueOnError)
+	flags.Bool("quiet", false, "print neither the usage nor the summary")
+	chaos := chaosFlags(flags)
+
+	var usage bytes.Buffer
+	flags.SetOutput(&usage)
+	flags.Usage()
+	if !strings.Contains(usage.String(), "-quiet") || strings.Contains(usage.String(), chaosFlagPrefix) {
+		t.Errorf("got usage %q, want the chaos flags hidden", usage.String())
+	}
+
+	if err := flags.Parse([]string{"-chaos-graylog-errors", "0.25", "-chaos-slow-delay", "1s"}); err != nil {
+		t.Fatal(err)
+	}
+	if chaos.GraylogErrorRate != 0.25 || chaos.SlowDelay != time.Second || !chaos.Enabled() {
+		t.Errorf("got %+v", *chaos)
+	}
+}
+
+func TestChaosStore(t *testing.T) {
+	store := &flakyStore{}
+
+	failing := chaosStore{store: store, chaos: ChaosSettings{MongoErrorRate: 1}}
+	if err := failing.Insert(usage(1, 2)); err == nil {
+		t.Error("should have failed")
+	}
+
+	passing := chaosStore{store: store, chaos: ChaosSettings{SlowRate: 1, SlowDelay: time.Millisecond}}
+	if err := passing.Insert(usage(1, 2)); err != nil {
+		t.Error(err)
+	}
+	if len(store.inserted) != 1 {
+		t.Errorf("got %d inserted, want the write which didn't fail", len(store.inserted))
+	}
+}
+
+func TestGraylogChaos(t *testing.T) {
+	server := newGraylogFixtureServer(t)
+	defer server.Close()
+
+	settings := Settings{GraylogURL: server.URL + "/", Chaos: ChaosSettings{GraylogErrorRate: 1}}
+	_, err := getGraylog(settings, "api/search/universal/absolute/stats?query=bobKey")
+	if e, ok := err.(GraylogError); !ok || e.Kind != graylogErrorServer || e.Status != 500 {
+		t.Errorf("got %v, want an injected server error", err)
+	}
+}
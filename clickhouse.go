@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// clickHouseRequest runs a statement over the ClickHouse HTTP interface and
+// returns the response body. params are passed as query parameters, so
+// bound values can be given as param_<name>
+func clickHouseRequest(settings Settings, query string, params url.Values, body io.Reader) ([]byte, error) {
+	clickHouseClient := http.Client{
+		Timeout: time.Second * 60,
+	}
+
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("query", query)
+	if settings.ClickHouseDatabase != "" {
+		params.Set("database", settings.ClickHouseDatabase)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, settings.ClickHouseURL+"?"+params.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.ClickHouseUser != "" {
+		req.SetBasicAuth(settings.ClickHouseUser, settings.ClickHousePass)
+	}
+
+	resp, err := clickHouseClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("clickhouse returned %s: %s", resp.Status, bytes.TrimSpace(bodyText))
+	}
+
+	return bodyText, nil
+}
+
+// ClickHouseSource sums per-peer byte counts from the netflow tables. The
+// configured query is run with the {key:String}, {direction:String},
+// {from:UInt32} and {to:UInt32} parameters bound, and must return a single
+// value which is null when there was no traffic
+type ClickHouseSource struct {
+	settings Settings
+}
+
+func (s ClickHouseSource) Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error) {
+	if direction != "up" && direction != "down" {
+		return nil, fmt.Errorf("invalid direction argument %q", direction)
+	}
+
+	key, err := memberIdentity(s.settings, member)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{
+		"default_format": []string{"JSONCompact"},
+		"output_format_json_quote_64bit_integers": []string{"0"},
+		"param_key":       []string{key},
+		"param_direction": []string{direction},
+		"param_from":      []string{strconv.FormatInt(from.Unix(), 10)},
+		"param_to":        []string{strconv.FormatInt(to.Unix(), 10)},
+	}
+
+	bodyText, err := clickHouseRequest(s.settings, s.settings.ClickHouseFlowsQuery, params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	type ClickHouseRes struct {
+		Data [][]*float64 `json:"data"`
+	}
+
+	var clickHouseRes ClickHouseRes
+	if err := json.Unmarshal(bodyText, &clickHouseRes); err != nil {
+		return nil, err
+	}
+
+	if len(clickHouseRes.Data) == 0 || len(clickHouseRes.Data[0]) == 0 || clickHouseRes.Data[0][0] == nil {
+		return nil, nil
+	}
+
+	sum := bytesToGb(*clickHouseRes.Data[0][0])
+	return &sum, nil
+}
+
+// ClickHouseStore saves usage periods into a ClickHouse table, creating it
+// if it doesn't exist yet
+type ClickHouseStore struct {
+	settings Settings
+}
+
+func newClickHouseStore(settings Settings) (ClickHouseStore, error) {
+	store := ClickHouseStore{settings: settings}
+
+	createTable := "CREATE TABLE IF NOT EXISTS " + settings.ClickHouseTable + ` (
+		Network String,
+		MemberID String,
+		Name String,
+		Interface String,
+		From DateTime,
+		To DateTime,
+		Duration Int64,
+		Up Nullable(Float64),
+		Down Nullable(Float64),
+		Total Nullable(Float64),
+		Status String,
+		Error String
+	) ENGINE = MergeTree ORDER BY (Name, From)`
+
+	if _, err := clickHouseRequest(settings, createTable, nil, nil); err != nil {
+		return store, err
+	}
+
+	// Tables created before usage was tagged by network or member ID lack
+	// the columns
+	for _, alter := range []string{
+		"ADD COLUMN IF NOT EXISTS Network String FIRST",
+		"ADD COLUMN IF NOT EXISTS MemberID String AFTER Network",
+		"ADD COLUMN IF NOT EXISTS Interface String AFTER Name",
+		"ADD COLUMN IF NOT EXISTS Status String",
+		"ADD COLUMN IF NOT EXISTS Error String",
+	} {
+		if _, err := clickHouseRequest(settings, "ALTER TABLE "+settings.ClickHouseTable+" "+alter, nil, nil); err != nil {
+			return store, err
+		}
+	}
+	return store, nil
+}
+
+// windowCondition matches the stored rows of the usage period's member and
+// window, with parameters to bind
+func (s ClickHouseStore) windowCondition(bwup BandwidthUsagePeriod) (string, url.Values) {
+	// Rows stored before there were networks have an empty one, and belong
+	// to the default network
+	network := "Network = {network:String}"
+	if bwup.Network == defaultNetwork {
+		network = "Network IN ({network:String}, '')"
+	}
+
+	member := "Name = {name:String}"
+	if bwup.MemberID != "" {
+		member = "MemberID = {member:String}"
+	}
+
+	return network + " AND " + member + " AND Interface = {interface:String} AND From = toDateTime({from:UInt32}) AND To = toDateTime({to:UInt32})",
+		url.Values{
+			"param_network":   []string{bwup.Network},
+			"param_member":    []string{bwup.MemberID},
+			"param_name":      []string{bwup.Name},
+			"param_interface": []string{bwup.Interface},
+			"param_from":      []string{strconv.FormatInt(bwup.From.Unix(), 10)},
+			"param_to":        []string{strconv.FormatInt(bwup.To.Unix(), 10)},
+		}
+}
+
+// existing returns the usage already stored for the period's member and
+// window, if any
+func (s ClickHouseStore) existing(bwup BandwidthUsagePeriod) (*BandwidthUsagePeriod, error) {
+	condition, params := s.windowCondition(bwup)
+
+	body, err := clickHouseRequest(s.settings, "SELECT Up, Down, Total, Status FROM "+s.settings.ClickHouseTable+" WHERE "+condition+" LIMIT 1 FORMAT JSONEachRow", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+
+	existing := bwup
+	if err := json.Unmarshal(body, &existing); err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// Insert applies the duplicate policy before inserting. Replacing a stored
+// period deletes it with a synchronous mutation, which is slow but rare
+func (s ClickHouseStore) Insert(bwup BandwidthUsagePeriod) error {
+	existing, err := s.existing(bwup)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		replacement, err := resolveDuplicate(s.settings.DuplicatePolicy, *existing, bwup)
+		if replacement == nil {
+			return err
+		}
+
+		condition, params := s.windowCondition(bwup)
+		params.Set("mutations_sync", "1")
+		if _, err := clickHouseRequest(s.settings, "ALTER TABLE "+s.settings.ClickHouseTable+" DELETE WHERE "+condition, params, nil); err != nil {
+			return err
+		}
+		bwup = *replacement
+	}
+
+	row, err := json.Marshal(bwup)
+	if err != nil {
+		return err
+	}
+
+	// The table only has columns for the usage itself, the message counts
+	// and warnings are left out
+	params := url.Values{
+		"date_time_input_format":           []string{"best_effort"},
+		"input_format_skip_unknown_fields": []string{"1"},
+	}
+
+	_, err = clickHouseRequest(s.settings, "INSERT INTO "+s.settings.ClickHouseTable+" FORMAT JSONEachRow", params, bytes.NewReader(row))
+	return err
+}
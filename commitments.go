@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransitCommitment is the traffic a network committed to buy from a
+// transit provider each month. Its usage is the traffic of the SNMP
+// targets listed, or of all the members without any
+type TransitCommitment struct {
+	Name    string
+	GB      float64
+	Targets []string
+}
+
+// CommitmentStatus is a commitment's usage so far in a month, and the usage
+// projected for the whole month at the rate so far
+type CommitmentStatus struct {
+	Network          string
+	Name             string
+	Month            time.Time
+	At               time.Time
+	Committed        float64
+	Used             float64
+	Projected        float64
+	ProjectedPercent float64
+	Overage          bool
+}
+
+// commitmentUnits are the units commitments may be written in, in GB
+var commitmentUnits = map[string]float64{"GB": 1, "TB": 1000, "PB": 1000000}
+
+// parseCommitments reads TRANSIT_COMMITMENTS entries written like
+// provider-x=50TB, or provider-x=50TB@uplink1+uplink2 to measure the
+// commitment on those SNMP targets
+func parseCommitments(entries []string) ([]TransitCommitment, error) {
+	commitments := []TransitCommitment{}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid TRANSIT_COMMITMENTS entry %q, expected name=amount[@target+target]", entry)
+		}
+
+		commitment := TransitCommitment{Name: parts[0]}
+		amount := parts[1]
+		if at := strings.Index(amount, "@"); at >= 0 {
+			commitment.Targets = strings.Split(amount[at+1:], "+")
+			amount = amount[:at]
+		}
+
+		unit := 1.0
+		for suffix, gb := range commitmentUnits {
+			if strings.HasSuffix(strings.ToUpper(amount), suffix) {
+				unit = gb
+				amount = amount[:len(amount)-len(suffix)]
+				break
+			}
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("invalid amount in TRANSIT_COMMITMENTS entry %q, expected a positive number of GB, TB or PB", entry)
+		}
+		commitment.GB = value * unit
+
+		commitments = append(commitments, commitment)
+	}
+
+	return commitments, nil
+}
+
+// projectCommitment projects the usage of a month from the usage between
+// its start and at, assuming the same rate for the rest of the month
+func projectCommitment(network string, commitment TransitCommitment, month time.Time, at time.Time, used float64) CommitmentStatus {
+	status := CommitmentStatus{
+		Network:   network,
+		Name:      commitment.Name,
+		Month:     month,
+		At:        at,
+		Committed: commitment.GB,
+		Used:      used,
+		Projected: used,
+	}
+
+	length := month.AddDate(0, 1, 0).Sub(month)
+	if elapsed := at.Sub(month); elapsed > 0 && elapsed < length {
+		status.Projected = used * float64(length) / float64(elapsed)
+	}
+
+	status.ProjectedPercent = status.Projected / status.Committed * 100
+	status.Overage = status.Projected > status.Committed
+	return status
+}
+
+func (s CommitmentStatus) reportColumns() []string {
+	return []string{"NETWORK", "COMMITMENT", "MONTH", "AT", "COMMITTED (GB)", "USED (GB)", "PROJECTED (GB)", "PROJECTED (%)", "OVERAGE"}
+}
+
+func (s CommitmentStatus) reportValues(number func(*float64) string) []string {
+	return []string{
+		s.Network,
+		s.Name,
+		s.Month.Format("2006-01"),
+		s.At.UTC().Format(time.RFC3339),
+		number(&s.Committed),
+		number(&s.Used),
+		number(&s.Projected),
+		number(&s.ProjectedPercent),
+		strconv.FormatBool(s.Overage),
+	}
+}
+
+// commitmentsCommand reports every network's usage against its transit
+// commitments this month, or the month given with -month, alerting on
+// projected overages
+func commitmentsCommand(args []string) {
+	flags := flag.NewFlagSet("commitments", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	monthFlag := flags.String("month", "", "month to report, like 2026-09, this month if empty")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	month, err := parseMonth(*monthFlag, time.Now())
+	if err != nil {
+		fatal(fmt.Sprintf("invalid -month %q, expected a month like 2026-09", *monthFlag))
+	}
+
+	for _, settings := range loadAllNetworkSettings() {
+		checkCommitments(settings, month, report)
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// commitmentsJob checks the commitments of the month of the scheduled run
+func commitmentsJob(scheduled time.Time, previous time.Time) {
+	report, _ := newReportWriter(os.Stdout, outputJSON)
+	month, _ := parseMonth("", scheduled)
+
+	for _, settings := range loadAllNetworkSettings() {
+		checkCommitments(settings, month, report)
+	}
+}
+
+// checkCommitments measures a network's commitments over the month so far
+func checkCommitments(settings Settings, month time.Time, report *ReportWriter) {
+	commitments, err := parseCommitments(settings.TransitCommitments)
+	if err != nil {
+		fatal(err)
+	}
+	if len(commitments) == 0 {
+		return
+	}
+
+	at := time.Now()
+	if end := month.AddDate(0, 1, 0); at.After(end) {
+		at = end
+	}
+
+	bwupCollection, err := getReadBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+	snmpCollection := bwupCollection.Database().Collection(settings.SNMPCollection)
+
+	for _, commitment := range commitments {
+		var used float64
+		if len(commitment.Targets) == 0 {
+			members, err := getMemberUsageSum(bwupCollection, settings.Network, month, at)
+			if err != nil {
+				fatal(err)
+			}
+			used = members.Total
+		}
+		for _, target := range commitment.Targets {
+			usage, err := getExitUsage(snmpCollection, settings.Network, target, month, at)
+			if err != nil {
+				fatal(err)
+			}
+			if usage.Total == nil {
+				log.Printf("Not enough SNMP samples for %s to measure commitment %s", target, commitment.Name)
+				continue
+			}
+			used += *usage.Total
+		}
+
+		status := projectCommitment(settings.Network, commitment, month, at, used)
+		if err := report.Write(status); err != nil {
+			fatal(err)
+		}
+
+		if status.Overage {
+			message := fmt.Sprintf("%s is projected to carry %.0f GB this month, %.0f%% of its %.0f GB commitment",
+				commitment.Name, status.Projected, status.ProjectedPercent, status.Committed)
+			log.Printf("WARNING: %s", message)
+			publishAlert(settings, Alert{Kind: alertCommitmentOverage, Message: message})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCommitments(t *testing.T) {
+	tests := []struct {
+		entry      string
+		commitment TransitCommitment
+		valid      bool
+	}{
+		{"provider-x=50TB", TransitCommitment{Name: "provider-x", GB: 50000}, true},
+		{"provider-y=750gb@uplink1+uplink2", TransitCommitment{Name: "provider-y", GB: 750, Targets: []string{"uplink1", "uplink2"}}, true},
+		{"provider-z=1.5PB", TransitCommitment{Name: "provider-z", GB: 1500000}, true},
+		{"ix=200", TransitCommitment{Name: "ix", GB: 200}, true},
+		{"provider-x", TransitCommitment{}, false},
+		{"=50TB", TransitCommitment{}, false},
+		{"provider-x=lots", TransitCommitment{}, false},
+		{"provider-x=-5TB", TransitCommitment{}, false},
+		{"provider-x=0", TransitCommitment{}, false},
+	}
+
+	for _, test := range tests {
+		commitments, err := parseCommitments([]string{test.entry})
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.entry, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.entry)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(commitments, []TransitCommitment{test.commitment}) {
+			t.Errorf("%s: got %+v, want %+v", test.entry, commitments, test.commitment)
+		}
+	}
+}
+
+func TestProjectCommitment(t *testing.T) {
+	commitment := TransitCommitment{Name: "provider-x", GB: 3000}
+	month := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		at        time.Time
+		used      float64
+		projected float64
+		overage   bool
+	}{
+		// September has 30 days, so a third of the way through
+		{"on track", month.AddDate(0, 0, 10), 900, 2700, false},
+		{"projected over", month.AddDate(0, 0, 10), 1200, 3600, true},
+		{"month over", month.AddDate(0, 1, 0), 2900, 2900, false},
+		{"month just started", month, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		status := projectCommitment("casa", commitment, month, test.at, test.used)
+		if status.Projected != test.projected || status.Overage != test.overage || status.Used != test.used || status.Committed != 3000 {
+			t.Errorf("%s: got %+v", test.name, status)
+		}
+	}
+
+	if status := projectCommitment("casa", commitment, month, month.AddDate(0, 0, 10), 1500); status.ProjectedPercent != 150 {
+		t.Errorf("got %v%% of the commitment, want 150%%", status.ProjectedPercent)
+	}
+}
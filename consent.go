@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// What CONSENT_OPT_OUT stores of the usage of members who opted out of
+// detailed tracking
+const (
+	// consentPseudonymize stores their usage under a pseudonym of its own
+	// for each period, so it adds to the network's totals without the
+	// periods being traced back to the member or linked to each other
+	consentPseudonymize = "pseudonymize"
+	// consentExclude stores nothing of their usage
+	consentExclude = "exclude"
+)
+
+// usagePseudonym names a period of a member who opted out. Collecting the
+// same window again gives the same pseudonym, so the period is replaced
+// rather than stored twice
+func usagePseudonym(secret string, network string, memberID string, from time.Time) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(network + "\n" + memberID + "\n" + from.UTC().Format(time.RFC3339Nano)))
+	return "anonymous-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// optedOutName stands for a member who opted out in what is sent out about
+// their usage before applyConsent, like alerts
+const optedOutName = "a member who opted out of tracking"
+
+// applyConsent enforces the member's consent on a collected period, after
+// the transforms of the pipeline so none of them can undo it. It returns
+// false if nothing of the period may be stored
+func applyConsent(settings Settings, bwup BandwidthUsagePeriod, member MeshMember) (BandwidthUsagePeriod, bool) {
+	if !member.Fields.TrackingOptOut {
+		return bwup, true
+	}
+	if settings.ConsentOptOut == consentExclude {
+		return bwup, false
+	}
+	if settings.PseudonymSecret == "" {
+		log.Printf("WARNING: not storing the usage of a member who opted out of tracking, as PSEUDONYM_SECRET isn't set to pseudonymize it")
+		return bwup, false
+	}
+
+	pseudonym := usagePseudonym(settings.PseudonymSecret, bwup.Network, member.ID, bwup.From)
+	return BandwidthUsagePeriod{
+		Network:  bwup.Network,
+		MemberID: pseudonym,
+		Name:     pseudonym,
+		From:     bwup.From,
+		To:       bwup.To,
+		Duration: bwup.Duration,
+		Up:       bwup.Up,
+		Down:     bwup.Down,
+		Total:    bwup.Total,
+		Status:   bwup.Status,
+	}, true
+}
+
+// applyMetricConsent enforces the member's consent on a metric sample, as
+// applyConsent does on usage. The pseudonym is the metric's own, so the
+// sample isn't linked to the usage of the window
+func applyMetricConsent(settings Settings, sample MemberMetricSample, member MeshMember) (MemberMetricSample, bool) {
+	if !member.Fields.TrackingOptOut {
+		return sample, true
+	}
+	if settings.ConsentOptOut == consentExclude {
+		return sample, false
+	}
+	if settings.PseudonymSecret == "" {
+		log.Printf("WARNING: not storing the %s metric of a member who opted out of tracking, as PSEUDONYM_SECRET isn't set to pseudonymize it", sample.Metric)
+		return sample, false
+	}
+
+	pseudonym := usagePseudonym(settings.PseudonymSecret, sample.Network, member.ID+"\n"+sample.Metric, sample.From)
+	sample.MemberID = pseudonym
+	sample.Name = pseudonym
+	sample.Error = ""
+	return sample, true
+}
+
+// consentChanges keeps the names and keys of members who opted out out of
+// the member changes, leaving only that a member was added, modified or
+// removed
+func consentChanges(changes []MemberChange, optedOut map[string]bool) []MemberChange {
+	for i, change := range changes {
+		if optedOut[change.MemberID] {
+			changes[i].Name, changes[i].WGKey, changes[i].PreviousName, changes[i].PreviousWGKey = "", "", "", ""
+		}
+	}
+	return changes
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyConsent(t *testing.T) {
+	member := MeshMember{ID: "rec1"}
+	member.Fields.Name = "Ana"
+	bwup := usage(3, 12)
+	bwup.Network, bwup.MemberID, bwup.Name = "casa", "rec1", "Ana"
+	bwup.From = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	bwup.Labels = map[string]string{"site": "Water Tower"}
+
+	settings, _ := readSettings("casa", settingsEnv{"PSEUDONYM_SECRET": "secret"})
+	if got, keep := applyConsent(settings, bwup, member); !keep || got.Name != "Ana" {
+		t.Errorf("the usage of a member who didn't opt out was changed to %+v", got)
+	}
+
+	member.Fields.TrackingOptOut = true
+	got, keep := applyConsent(settings, bwup, member)
+	if !keep || !strings.HasPrefix(got.MemberID, "anonymous-") || got.Name != got.MemberID || got.Labels != nil || *got.Down != 12 {
+		t.Errorf("got %+v pseudonymized", got)
+	}
+	// The same period gets the same pseudonym, another period another one
+	if again, _ := applyConsent(settings, bwup, member); again.MemberID != got.MemberID {
+		t.Errorf("got %s then %s for the same period", got.MemberID, again.MemberID)
+	}
+	bwup.From = bwup.From.Add(time.Hour)
+	if next, _ := applyConsent(settings, bwup, member); next.MemberID == got.MemberID {
+		t.Error("periods of a member who opted out can be linked by their pseudonym")
+	}
+
+	settings.PseudonymSecret = ""
+	if _, keep := applyConsent(settings, bwup, member); keep {
+		t.Error("usage can't be pseudonymized without PSEUDONYM_SECRET, so it should be excluded")
+	}
+	settings.PseudonymSecret = "secret"
+	settings.ConsentOptOut = consentExclude
+	if _, keep := applyConsent(settings, bwup, member); keep {
+		t.Error("usage should be excluded")
+	}
+}
+
+func TestApplyMetricConsent(t *testing.T) {
+	member := MeshMember{ID: "rec1"}
+	member.Fields.TrackingOptOut = true
+	sample := MemberMetricSample{Network: "casa", MemberID: "rec1", Name: "Ana", Metric: metricDNSQueries, From: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)}
+
+	settings, _ := readSettings("casa", settingsEnv{"PSEUDONYM_SECRET": "secret"})
+	got, keep := applyMetricConsent(settings, sample, member)
+	if !keep || !strings.HasPrefix(got.MemberID, "anonymous-") || got.Name != got.MemberID {
+		t.Errorf("got %+v pseudonymized", got)
+	}
+	// The sample can't be linked to the usage of the same window
+	if usage := usagePseudonym("secret", "casa", "rec1", sample.From); got.MemberID == usage {
+		t.Error("the metric sample has the pseudonym of the usage")
+	}
+
+	settings.ConsentOptOut = consentExclude
+	if _, keep := applyMetricConsent(settings, sample, member); keep {
+		t.Error("the sample should be excluded")
+	}
+}
+
+func TestConsentMemberChanges(t *testing.T) {
+	ana := MeshMember{ID: "rec1"}
+	ana.Fields.Name, ana.Fields.WGKey = "Ana", "wgkey-ana"
+	previous := []CachedMember{cacheMember("casa", ana)}
+
+	// Opting out leaves only the member's ID in the cache and changes
+	ana.Fields.TrackingOptOut = true
+	current := []CachedMember{cacheMember("casa", ana)}
+	if current[0].Name != "" || current[0].WGKey != "" {
+		t.Errorf("cached %+v", current[0])
+	}
+	changes := consentChanges(diffMembers(previous, current, time.Now()), map[string]bool{"rec1": true})
+	if len(changes) != 1 || changes[0].MemberID != "rec1" || changes[0].PreviousName != "" || changes[0].PreviousWGKey != "" {
+		t.Errorf("got %+v", changes)
+	}
+}
+
+func TestPushedSampleConsent(t *testing.T) {
+	ana := MeshMember{ID: "rec1"}
+	ana.Fields.Name, ana.Fields.WGKey, ana.Fields.TrackingOptOut = "Ana", "wgkey-ana", true
+	settings, _ := readSettings("casa", settingsEnv{"PSEUDONYM_SECRET": "secret"})
+	members := newMemberCache(settings)
+	members.byKey[ana.Fields.WGKey] = ana
+	members.byID[ana.ID] = ana
+	members.fetchedAt = time.Now()
+	tenant := &Tenant{settings: settings, members: members}
+
+	sample := UsageSample{Network: "casa", Agent: "gw", Interface: "wg0", WGKey: "wgkey-ana", From: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2026, 10, 1, 0, 5, 0, 0, time.UTC), Down: 1000}
+	bwup, keep := tenant.sampleToUsagePeriod(sample)
+	if !keep || !strings.HasPrefix(bwup.MemberID, "anonymous-") || bwup.Name != bwup.MemberID || bwup.Interface != "wg0" {
+		t.Errorf("got %+v stored", bwup)
+	}
+
+	tenant.settings.ConsentOptOut = consentExclude
+	if _, keep := tenant.sampleToUsagePeriod(sample); keep {
+		t.Error("the pushed sample should be excluded")
+	}
+}
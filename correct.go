@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// UsageCorrection is a manual correction of a stored usage period, kept in
+// MONGO_CORRECTIONS_COLLECTION with the period as it was before
+type UsageCorrection struct {
+	ID        string `bson:"_id"`
+	Network   string
+	MemberID  string `json:",omitempty" bson:",omitempty"`
+	Name      string
+	From      time.Time
+	To        time.Time
+	Original  BandwidthUsagePeriod
+	Up        *float64
+	Down      *float64
+	Total     *float64
+	Reason    string
+	Actor     string
+	CreatedAt time.Time
+}
+
+// parsePeriod reads a period written as two RFC 3339 times separated by a
+// slash, like 2026-09-01T00:00:00Z/2026-09-02T00:00:00Z
+func parsePeriod(value string) (time.Time, time.Time, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q, expected from/to", value)
+	}
+	from, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period start %q, expected an RFC 3339 time", parts[0])
+	}
+	to, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period end %q, expected an RFC 3339 time", parts[1])
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q, it must end after it starts", value)
+	}
+	return from.UTC(), to.UTC(), nil
+}
+
+// correctedUsage works out a period's corrected usage. Either the total or
+// both directions must be given. With both directions the total is their
+// sum, and must match the total if that is given too. With only the total
+// the split between directions is unknown, so they are cleared
+func correctedUsage(up *float64, down *float64, total *float64) (*float64, *float64, *float64, error) {
+	for _, value := range []*float64{up, down, total} {
+		if value != nil && (*value < 0 || math.IsNaN(*value) || math.IsInf(*value, 0)) {
+			return nil, nil, nil, fmt.Errorf("corrected usage must be a number of GB, not negative")
+		}
+	}
+
+	if up != nil && down != nil {
+		sum := addSums(up, down)
+		if total != nil && math.Abs(*total-*sum) > 1e-9 {
+			return nil, nil, nil, fmt.Errorf("the total %v doesn't match the sum of up and down %v", *total, *sum)
+		}
+		return up, down, sum, nil
+	}
+	if up != nil || down != nil {
+		return nil, nil, nil, fmt.Errorf("correct both directions, or only the total")
+	}
+	if total == nil {
+		return nil, nil, nil, fmt.Errorf("the corrected total, or both directions, are required")
+	}
+	return nil, nil, total, nil
+}
+
+// applyCorrection replaces a stored period's usage with the correction,
+// marking it as manually adjusted, and stores the correction with the
+// original. Members' totals follow, and the change is recorded in mutations,
+// all in a transaction when totals are kept
+func applyCorrection(settings Settings, db *mongo.Database, correction UsageCorrection) (UsageCorrection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	usage := db.Collection(settings.MongoCollection)
+	filter := usageKey(BandwidthUsagePeriod{
+		Network:  correction.Network,
+		MemberID: correction.MemberID,
+		Name:     correction.Name,
+		From:     correction.From,
+		To:       correction.To,
+	})
+
+	signingKey, err := parseSigningKey(settings.SigningKey)
+	if err != nil {
+		return correction, err
+	}
+
+	correct := func(ctx context.Context) error {
+		var original BandwidthUsagePeriod
+		err := usage.FindOne(ctx, filter).Decode(&original)
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("no usage stored for that member and period, it may be pruned into its month's rollup")
+		}
+		if err != nil {
+			return err
+		}
+
+		correction.Original = original
+		correction.Name = original.Name
+
+		corrected := original
+		corrected.Up, corrected.Down, corrected.Total = correction.Up, correction.Down, correction.Total
+		corrected.Status = usageStatusOK
+		corrected.Error = ""
+		corrected.Anomaly = nil
+		corrected.CorrectionID = correction.ID
+		if err := signUsage(signingKey, &corrected); err != nil {
+			return err
+		}
+
+		if _, err := usage.ReplaceOne(ctx, filter, corrected); err != nil {
+			return err
+		}
+		if _, err := db.Collection(settings.MongoCorrectionsCollection).InsertOne(ctx, correction); err != nil {
+			return err
+		}
+
+		err = recordMutation(ctx, db.Collection(settings.MongoMutationsCollection), Mutation{
+			Kind:       mutationCorrect,
+			Collection: usage.Name(),
+			Network:    correction.Network,
+			Filter:     filterJSON(filter),
+			Documents:  1,
+			Before:     hashPeriod(&original),
+			After:      hashPeriod(&corrected),
+		})
+		if err != nil {
+			return err
+		}
+
+		if settings.MongoTotalsCollection == "" {
+			return nil
+		}
+		return addToTotals(ctx, db.Collection(settings.MongoTotalsCollection), &original, corrected)
+	}
+
+	if settings.MongoTotalsCollection == "" {
+		return correction, correct(ctx)
+	}
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return correction, err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, correct(sessCtx)
+	})
+	return correction, err
+}
+
+// correctCommand corrects the usage stored for a member's period by hand,
+// keeping the original. Corrected periods aren't replaced by later runs
+func correctCommand(args []string) {
+	flags := flag.NewFlagSet("correct", flag.ExitOnError)
+	memberID := flags.String("member", "", "Airtable record ID of the member")
+	name := flags.String("name", "", "name of the member, for usage stored without a record ID")
+	period := flags.String("period", "", "period to correct, like 2026-09-01T00:00:00Z/2026-09-02T00:00:00Z")
+	reason := flags.String("reason", "", "why the usage is corrected")
+	var upFlag, downFlag, totalFlag *float64
+	flags.Var(optionalFloat{&upFlag}, "up", "corrected upload in GB")
+	flags.Var(optionalFloat{&downFlag}, "down", "corrected download in GB")
+	flags.Var(optionalFloat{&totalFlag}, "total", "corrected total in GB")
+	flags.Parse(args)
+
+	if (*memberID == "") == (*name == "") {
+		fatal("one of -member or -name is required")
+	}
+	if strings.TrimSpace(*reason) == "" {
+		fatal("-reason is required, corrections must say why")
+	}
+
+	from, to, err := parsePeriod(*period)
+	if err != nil {
+		fatal(err)
+	}
+	up, down, total, err := correctedUsage(upFlag, downFlag, totalFlag)
+	if err != nil {
+		fatal(err)
+	}
+
+	settings := loadSettings()
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	correction, err := applyCorrection(settings, db, UsageCorrection{
+		ID:        newRecordID(),
+		Network:   settings.Network,
+		MemberID:  *memberID,
+		Name:      *name,
+		From:      from,
+		To:        to,
+		Up:        up,
+		Down:      down,
+		Total:     total,
+		Reason:    strings.TrimSpace(*reason),
+		Actor:     mutationActor(),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	printJSON(os.Stdout, correction)
+}
+
+// optionalFloat is a float flag which stays nil unless given
+type optionalFloat struct {
+	value **float64
+}
+
+func (f optionalFloat) String() string {
+	if f.value == nil || *f.value == nil {
+		return ""
+	}
+	return fmt.Sprint(**f.value)
+}
+
+func (f optionalFloat) Set(s string) error {
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*f.value = &value
+	return nil
+}
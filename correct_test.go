@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"day", "2026-09-01T00:00:00Z/2026-09-02T00:00:00Z", true},
+		{"offset", "2026-09-01T00:00:00-05:00/2026-09-01T01:00:00-05:00", true},
+		{"one time", "2026-09-01T00:00:00Z", false},
+		{"days only", "2026-09-01/2026-09-02", false},
+		{"backwards", "2026-09-02T00:00:00Z/2026-09-01T00:00:00Z", false},
+		{"empty", "2026-09-01T00:00:00Z/2026-09-01T00:00:00Z", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := parsePeriod(tt.value)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from.Location() != time.UTC || !to.After(from) {
+				t.Errorf("got %v to %v", from, to)
+			}
+		})
+	}
+
+	from, _, _ := parsePeriod("2026-09-01T00:00:00-05:00/2026-09-01T01:00:00-05:00")
+	if !from.Equal(time.Date(2026, 9, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the period in UTC, got %v", from)
+	}
+}
+
+func TestCorrectedUsage(t *testing.T) {
+	gb := func(n float64) *float64 { return &n }
+
+	tests := []struct {
+		name  string
+		up    *float64
+		down  *float64
+		total *float64
+		want  *float64
+		valid bool
+	}{
+		{"both directions", gb(1), gb(2), nil, gb(3), true},
+		{"matching total", gb(1), gb(2), gb(3), gb(3), true},
+		{"only the total", nil, nil, gb(4), gb(4), true},
+		{"zero", nil, nil, gb(0), gb(0), true},
+		{"mismatched total", gb(1), gb(2), gb(4), nil, false},
+		{"one direction", gb(1), nil, gb(4), nil, false},
+		{"nothing", nil, nil, nil, nil, false},
+		{"negative", nil, nil, gb(-1), nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, down, total, err := correctedUsage(tt.up, tt.down, tt.total)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *total != *tt.want {
+				t.Errorf("expected a total of %v, got %v", *tt.want, *total)
+			}
+			if tt.up == nil && (up != nil || down != nil) {
+				t.Errorf("directions should be cleared when only the total is corrected")
+			}
+		})
+	}
+}
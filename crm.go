@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CRMs, selected with CRM_PROVIDER
+const (
+	crmHubSpot = "hubspot"
+	crmOdoo    = "odoo"
+)
+
+// Activity of a member over a CRM sync window
+const (
+	activityActive   = "active"
+	activityInactive = "inactive"
+	activityUnknown  = "unknown"
+)
+
+// CRMUpdate is the usage context written to a member's CRM record
+type CRMUpdate struct {
+	From     time.Time
+	To       time.Time
+	Up       float64
+	Down     float64
+	Total    float64
+	Activity string
+}
+
+// CRM updates member records in a CRM
+type CRM interface {
+	UpdateMember(crmID string, update CRMUpdate) error
+}
+
+func newCRM(settings Settings) (CRM, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+
+	switch settings.CRMProvider {
+	case crmHubSpot:
+		if settings.CRMToken == "" {
+			return nil, fmt.Errorf("the HubSpot CRM needs CRM_TOKEN")
+		}
+		url := settings.CRMURL
+		if url == "" {
+			url = "https://api.hubapi.com"
+		}
+		return HubSpotCRM{url: strings.TrimSuffix(url, "/"), token: settings.CRMToken, client: client}, nil
+	case crmOdoo:
+		if settings.CRMURL == "" || settings.CRMDatabase == "" || settings.CRMUser == "" {
+			return nil, fmt.Errorf("the Odoo CRM needs CRM_URL, CRM_DATABASE, CRM_USER and CRM_TOKEN")
+		}
+		return &OdooCRM{url: strings.TrimSuffix(settings.CRMURL, "/"), database: settings.CRMDatabase, user: settings.CRMUser, password: settings.CRMToken, client: client}, nil
+	}
+	return nil, fmt.Errorf("invalid CRM_PROVIDER %q, expected %s or %s", settings.CRMProvider, crmHubSpot, crmOdoo)
+}
+
+// crmRequest posts a JSON body and decodes the JSON response into result,
+// if it isn't nil
+func crmRequest(client http.Client, method string, url string, token string, body interface{}, result interface{}) error {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(jsonBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("CRM returned %s: %s", resp.Status, bytes.TrimSpace(bodyText))
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(bodyText, result)
+}
+
+// HubSpotCRM updates contacts through the CRM objects API. The contacts need
+// the mesh_usage_* custom properties
+type HubSpotCRM struct {
+	url    string
+	token  string
+	client http.Client
+}
+
+func (c HubSpotCRM) UpdateMember(crmID string, update CRMUpdate) error {
+	body := map[string]interface{}{
+		"properties": map[string]string{
+			"mesh_usage_from":     update.From.UTC().Format("2006-01-02"),
+			"mesh_usage_to":       update.To.UTC().Format("2006-01-02"),
+			"mesh_usage_up_gb":    fmt.Sprintf("%.3f", update.Up),
+			"mesh_usage_down_gb":  fmt.Sprintf("%.3f", update.Down),
+			"mesh_usage_total_gb": fmt.Sprintf("%.3f", update.Total),
+			"mesh_usage_activity": update.Activity,
+		},
+	}
+	return crmRequest(c.client, http.MethodPatch, c.url+"/crm/v3/objects/contacts/"+crmID, c.token, body, nil)
+}
+
+// OdooCRM updates partners through the JSON-RPC API. The partners need the
+// x_mesh_usage_* custom fields
+type OdooCRM struct {
+	url      string
+	database string
+	user     string
+	password string
+	client   http.Client
+	uid      int
+}
+
+// call runs a JSON-RPC call of a service, decoding its result
+func (c *OdooCRM) call(service string, method string, args []interface{}, result interface{}) error {
+	body := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "call",
+		"params":  map[string]interface{}{"service": service, "method": method, "args": args},
+	}
+
+	var response struct {
+		Result json.RawMessage
+		Error  *struct {
+			Message string
+			Data    struct {
+				Message string
+			}
+		}
+	}
+	if err := crmRequest(c.client, http.MethodPost, c.url+"/jsonrpc", "", body, &response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return fmt.Errorf("odoo %s.%s failed: %s: %s", service, method, response.Error.Message, response.Error.Data.Message)
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+func (c *OdooCRM) UpdateMember(crmID string, update CRMUpdate) error {
+	if c.uid == 0 {
+		// Logging in returns false rather than an error for bad credentials
+		var uid interface{}
+		if err := c.call("common", "login", []interface{}{c.database, c.user, c.password}, &uid); err != nil {
+			return err
+		}
+		id, ok := uid.(float64)
+		if !ok {
+			return fmt.Errorf("odoo refused the login of %s", c.user)
+		}
+		c.uid = int(id)
+	}
+
+	var id int
+	if _, err := fmt.Sscan(crmID, &id); err != nil {
+		return fmt.Errorf("odoo CRM ID %q is not a number", crmID)
+	}
+
+	fields := map[string]interface{}{
+		"x_mesh_usage_from":     update.From.UTC().Format("2006-01-02"),
+		"x_mesh_usage_to":       update.To.UTC().Format("2006-01-02"),
+		"x_mesh_usage_up_gb":    update.Up,
+		"x_mesh_usage_down_gb":  update.Down,
+		"x_mesh_usage_total_gb": update.Total,
+		"x_mesh_usage_activity": update.Activity,
+	}
+
+	var written bool
+	args := []interface{}{c.database, c.uid, c.password, "res.partner", "write", []interface{}{[]int{id}, fields}}
+	return c.call("object", "execute_kw", args, &written)
+}
+
+// memberActivity sums a member's stored periods into a CRM update. Members
+// with usage are active and those with only periods without any inactive,
+// while a member with nothing but failed periods, or none, is unknown
+func memberActivity(periods []BandwidthUsagePeriod, from time.Time, to time.Time) CRMUpdate {
+	update := CRMUpdate{From: from, To: to, Activity: activityUnknown}
+
+	collected := []BandwidthUsagePeriod{}
+	for _, period := range periods {
+		if period.Status != usageStatusFailed {
+			collected = append(collected, period)
+		}
+	}
+	if len(collected) == 0 {
+		return update
+	}
+
+	sum := sumMemberUsage(collected)
+	update.Up, update.Down, update.Total = sum.Up, sum.Down, sum.Total
+
+	update.Activity = activityInactive
+	if sum.Total > 0 {
+		update.Activity = activityActive
+	}
+	return update
+}
+
+// crmSyncCommand writes the usage each member stored over the window to
+// their CRM record, found through the CRM ID column in Airtable
+func crmSyncCommand(args []string) {
+	from, to, _ := parseWindow(args)
+
+	for _, settings := range loadAllNetworkSettings() {
+		syncNetworkCRM(settings, from, to)
+	}
+}
+
+func syncNetworkCRM(settings Settings, from time.Time, to time.Time) {
+	crm, err := newCRM(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	bwupCollection, err := getReadBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	synced, failed := 0, 0
+	for _, member := range members {
+		crmID := strings.TrimSpace(member.Fields.CRMID)
+		if crmID == "" {
+			continue
+		}
+
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, member.ID, strings.TrimSpace(member.Fields.Name), from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		// One record the CRM refuses shouldn't hold the others back
+		if err := crm.UpdateMember(crmID, memberActivity(periods, from, to)); err != nil {
+			log.Printf("Error updating the CRM record of %s: %v", member.Fields.Name, err)
+			failed++
+			continue
+		}
+		synced++
+	}
+
+	log.Printf("Updated %d CRM records of network %s, %d failed", synced, settings.Network, failed)
+}
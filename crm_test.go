@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemberActivity(t *testing.T) {
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	active := usage(1, 2)
+	active.From, active.To = from, from.AddDate(0, 0, 1)
+	inactive := noUsage()
+	inactive.From, inactive.To = from.AddDate(0, 0, 1), from.AddDate(0, 0, 2)
+
+	tests := []struct {
+		name     string
+		periods  []BandwidthUsagePeriod
+		activity string
+		total    float64
+	}{
+		{"nothing stored", nil, activityUnknown, 0},
+		{"only failures", []BandwidthUsagePeriod{failedUsage()}, activityUnknown, 0},
+		{"no traffic", []BandwidthUsagePeriod{inactive, failedUsage()}, activityInactive, 0},
+		{"traffic", []BandwidthUsagePeriod{active, inactive}, activityActive, 3},
+	}
+
+	for _, test := range tests {
+		update := memberActivity(test.periods, from, to)
+		if update.Activity != test.activity || update.Total != test.total || !update.From.Equal(from) || !update.To.Equal(to) {
+			t.Errorf("%s: got %+v", test.name, update)
+		}
+	}
+}
+
+func TestHubSpotCRM(t *testing.T) {
+	var method, path, auth string
+	var body struct {
+		Properties map[string]string
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, auth = r.Method, r.URL.Path, r.Header.Get("Authorization")
+		contents, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(contents, &body)
+		w.Write([]byte(`{"id": "501"}`))
+	}))
+	defer server.Close()
+
+	crm, err := newCRM(Settings{CRMProvider: crmHubSpot, CRMURL: server.URL, CRMToken: "pat-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := CRMUpdate{From: time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), Up: 1.5, Down: 10, Total: 11.5, Activity: activityActive}
+	if err := crm.UpdateMember("501", update); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPatch || path != "/crm/v3/objects/contacts/501" || auth != "Bearer pat-token" {
+		t.Errorf("got %s %s with %q", method, path, auth)
+	}
+	if body.Properties["mesh_usage_total_gb"] != "11.500" || body.Properties["mesh_usage_activity"] != activityActive || body.Properties["mesh_usage_to"] != "2026-10-01" {
+		t.Errorf("got properties %v", body.Properties)
+	}
+}
+
+func TestOdooCRM(t *testing.T) {
+	calls := []string{}
+	var written map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Params struct {
+				Service string
+				Method  string
+				Args    []json.RawMessage
+			}
+		}
+		contents, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(contents, &request)
+		calls = append(calls, request.Params.Service+"."+request.Params.Method)
+
+		switch request.Params.Method {
+		case "login":
+			var password string
+			json.Unmarshal(request.Params.Args[2], &password)
+			if password != "api-key" {
+				w.Write([]byte(`{"jsonrpc": "2.0", "id": null, "result": false}`))
+				return
+			}
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": null, "result": 7}`))
+		case "execute_kw":
+			var values []json.RawMessage
+			json.Unmarshal(request.Params.Args[5], &values)
+			json.Unmarshal(values[1], &written)
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": null, "result": true}`))
+		}
+	}))
+	defer server.Close()
+
+	settings := Settings{CRMProvider: crmOdoo, CRMURL: server.URL, CRMDatabase: "mesh", CRMUser: "collector", CRMToken: "api-key"}
+	crm, err := newCRM(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"42", "43"} {
+		if err := crm.UpdateMember(id, CRMUpdate{Total: 2, Activity: activityActive}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(calls) != 3 || calls[0] != "common.login" || calls[2] != "object.execute_kw" {
+		t.Errorf("got calls %v, want a single login", calls)
+	}
+	if written["x_mesh_usage_total_gb"] != 2.0 || written["x_mesh_usage_activity"] != activityActive {
+		t.Errorf("wrote %v", written)
+	}
+
+	if err := crm.UpdateMember("not a number", CRMUpdate{}); err == nil {
+		t.Error("a CRM ID which isn't a number should fail")
+	}
+
+	settings.CRMToken = "wrong"
+	crm, _ = newCRM(settings)
+	if err := crm.UpdateMember("42", CRMUpdate{}); err == nil {
+		t.Error("a refused login should fail")
+	}
+}
+
+func TestNewCRM(t *testing.T) {
+	for _, settings := range []Settings{
+		{},
+		{CRMProvider: "salesforce"},
+		{CRMProvider: crmHubSpot},
+		{CRMProvider: crmOdoo, CRMURL: "https://odoo", CRMUser: "collector"},
+	} {
+		if _, err := newCRM(settings); err == nil {
+			t.Errorf("%+v should fail", settings)
+		}
+	}
+}
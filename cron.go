@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week, evaluated in its location
+type CronSchedule struct {
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	domStar  bool
+	dowStar  bool
+	location *time.Location
+}
+
+var cronMonthNames = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var cronDayNames = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}
+
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToUpper(value)]; ok {
+		return n, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and
+// steps into a bitset of the allowed values
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if start, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end in steps of 15
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseCron parses a cron expression like "0 1 * * MON", or one of the
+// @daily style aliases. Days of week run from 0 (Sunday) to 7 (Sunday again)
+func parseCron(expression string, location *time.Location) (*CronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	if alias, ok := cronAliases[expression]; ok {
+		expression = alias
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+
+	schedule := &CronSchedule{
+		domStar:  fields[2] == "*" || fields[2] == "?",
+		dowStar:  fields[4] == "*" || fields[4] == "?",
+		location: location,
+	}
+
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron minute: %v", err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron hour: %v", err)
+	}
+	if schedule.dom, err = parseCronField(strings.Replace(fields[2], "?", "*", 1), 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron day of month: %v", err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("cron month: %v", err)
+	}
+	if schedule.dow, err = parseCronField(strings.Replace(fields[4], "?", "*", 1), 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("cron day of week: %v", err)
+	}
+
+	// 7 is another way of writing Sunday
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+
+	return schedule, nil
+}
+
+// dayMatches follows cron in matching either day field when both are
+// restricted, and only the restricted one otherwise
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after t the schedule fires at, or the zero
+// time if it never does within five years. Wall clock times skipped by a
+// daylight saving change never fire, and those repeated by one fire once
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = s.forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location))
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = s.forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location))
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			// Stepping in absolute time, as the next wall clock hour may not
+			// exist on the day the clocks go forward
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		if repeated := t.Add(-time.Hour); repeated.Hour() == t.Hour() && repeated.Minute() == t.Minute() {
+			// The second pass through an hour the clocks went back over
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// forward returns next, unless a daylight saving change resolved it to a
+// time which isn't after t, in which case the start of the next hour
+func (s *CronSchedule) forward(t time.Time, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+}
+
+// Prev returns the last time before t the schedule fired at, or the zero time
+// if it didn't within five years
+func (s *CronSchedule) Prev(t time.Time) time.Time {
+	for span := time.Hour; span <= 5*366*24*time.Hour; span *= 2 {
+		var prev time.Time
+		for next := s.Next(t.Add(-span)); !next.IsZero() && next.Before(t); next = s.Next(next) {
+			prev = next
+		}
+		if !prev.IsZero() {
+			return prev
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s is not available: %v", name, err)
+	}
+	return location
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"0 1 * * MON", true},
+		{"*/15 * * * *", true},
+		{"0 9-17/4 * * 1-5", true},
+		{"5/15 0 1,15 JAN-MAR SUN", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{"@hourly", true},
+		{"0 1 * *", false},
+		{"60 * * * *", false},
+		{"0 24 * * *", false},
+		{"0 0 0 * *", false},
+		{"0 0 * 13 *", false},
+		{"0 0 * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"x * * * *", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseCron(test.expression, time.UTC)
+		if test.valid && err != nil {
+			t.Errorf("parseCron(%q) failed: %v", test.expression, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("parseCron(%q) should have failed", test.expression)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		expression string
+		location   *time.Location
+		after      string
+		want       []string
+	}{
+		{"0 1 * * MON", time.UTC, "2026-10-14T00:00:00Z", []string{
+			"2026-10-19T01:00:00Z", "2026-10-26T01:00:00Z",
+		}},
+		{"0 9-17/4 * * *", time.UTC, "2026-10-14T10:00:00Z", []string{
+			"2026-10-14T13:00:00Z", "2026-10-14T17:00:00Z", "2026-10-15T09:00:00Z",
+		}},
+		{"0 0 31 * *", time.UTC, "2026-01-31T00:00:00Z", []string{
+			"2026-03-31T00:00:00Z", "2026-05-31T00:00:00Z",
+		}},
+		{"0 0 29 2 *", time.UTC, "2026-01-01T00:00:00Z", []string{
+			"2028-02-29T00:00:00Z",
+		}},
+		// Either day field matches when both are restricted
+		{"0 0 13 * FRI", time.UTC, "2026-11-10T00:00:00Z", []string{
+			"2026-11-13T00:00:00Z", "2026-11-20T00:00:00Z", "2026-11-27T00:00:00Z", "2026-12-04T00:00:00Z",
+		}},
+		{"0 1 * * MON", newYork, "2026-10-14T00:00:00Z", []string{
+			"2026-10-19T05:00:00Z", "2026-10-26T05:00:00Z", "2026-11-02T06:00:00Z",
+		}},
+		// The clocks go forward from 02:00 to 03:00 on 2026-03-08
+		{"0 * * * *", newYork, "2026-03-08T05:30:00Z", []string{
+			"2026-03-08T06:00:00Z", "2026-03-08T07:00:00Z", "2026-03-08T08:00:00Z",
+		}},
+		{"30 2 * * *", newYork, "2026-03-07T00:00:00Z", []string{
+			"2026-03-07T07:30:00Z", "2026-03-09T06:30:00Z",
+		}},
+		{"0 3 * * *", newYork, "2026-03-07T12:00:00Z", []string{
+			"2026-03-08T07:00:00Z", "2026-03-09T07:00:00Z",
+		}},
+		// The clocks go back from 02:00 to 01:00 on 2026-11-01
+		{"30 1 * * *", newYork, "2026-10-31T12:00:00Z", []string{
+			"2026-11-01T05:30:00Z", "2026-11-02T06:30:00Z",
+		}},
+		{"0 * * * *", newYork, "2026-11-01T04:30:00Z", []string{
+			"2026-11-01T05:00:00Z", "2026-11-01T07:00:00Z", "2026-11-01T08:00:00Z",
+		}},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.expression, test.location)
+		if err != nil {
+			t.Fatalf("parseCron(%q) failed: %v", test.expression, err)
+		}
+
+		after, _ := time.Parse(time.RFC3339, test.after)
+		for _, want := range test.want {
+			next := schedule.Next(after)
+			if got := next.UTC().Format(time.RFC3339); got != want {
+				t.Errorf("%q in %s after %s: got %s, want %s", test.expression, test.location, after.UTC().Format(time.RFC3339), got, want)
+				break
+			}
+			after = next
+		}
+	}
+}
+
+func TestCronNextNeverFires(t *testing.T) {
+	schedule, err := parseCron("0 0 30 2 *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("got %s, want the zero time", next)
+	}
+}
+
+func TestCronPrev(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		expression string
+		location   *time.Location
+		before     string
+		want       string
+	}{
+		{"0 9-17/4 * * *", time.UTC, "2026-10-14T09:00:00Z", "2026-10-13T17:00:00Z"},
+		{"0 9-17/4 * * *", time.UTC, "2026-10-14T13:00:00Z", "2026-10-14T09:00:00Z"},
+		{"0,10,45 * * * *", time.UTC, "2026-10-14T10:10:00Z", "2026-10-14T10:00:00Z"},
+		{"0 1 * * MON", newYork, "2026-11-02T06:00:00Z", "2026-10-26T05:00:00Z"},
+		{"@monthly", time.UTC, "2026-03-01T00:00:00Z", "2026-02-01T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.expression, test.location)
+		if err != nil {
+			t.Fatalf("parseCron(%q) failed: %v", test.expression, err)
+		}
+
+		before, _ := time.Parse(time.RFC3339, test.before)
+		if got := schedule.Prev(before).UTC().Format(time.RFC3339); got != test.want {
+			t.Errorf("%q before %s: got %s, want %s", test.expression, test.before, got, test.want)
+		}
+	}
+}
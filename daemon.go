@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SchedulerRun records a scheduled job which ran to completion, so missed
+// runs can be caught up after a restart
+type SchedulerRun struct {
+	Job         string
+	ScheduledAt time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+}
+
+// daemonJob is a job run by the daemon on its own schedule. run is given the
+// time the run was scheduled for and the one before it. last is when the
+// job last ran, or the daemon's start if it never did
+type daemonJob struct {
+	name     string
+	schedule *CronSchedule
+	run      func(scheduled time.Time, previous time.Time)
+	last     time.Time
+	ranOnce  bool
+}
+
+func getLastRun(collection *mongo.Collection, job string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var run SchedulerRun
+	err := collection.FindOne(ctx, bson.M{"job": job}, options.FindOne().SetSort(bson.M{"scheduledat": -1})).Decode(&run)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return run.ScheduledAt, err
+}
+
+func recordRun(collection *mongo.Collection, run SchedulerRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, run)
+	return err
+}
+
+// collectJob collects the usage of every network over the window ending at
+// the scheduled time. Without SCHEDULE_WINDOW the window runs from the
+// previous scheduled time, so consecutive runs cover every minute once.
+// Usage is printed as JSON lines, as the daemon's output goes to logs
+func collectJob(settings Settings) func(time.Time, time.Time) {
+	report, _ := newReportWriter(os.Stdout, outputJSON)
+
+	return func(scheduled time.Time, previous time.Time) {
+		// Schedules are in SCHEDULE_TIMEZONE, the sources expect UTC
+		scheduled = scheduled.UTC()
+		from := previous.UTC()
+		if settings.ScheduleWindow > 0 {
+			from = scheduled.Add(-settings.ScheduleWindow)
+		}
+
+		for _, networkSettings := range loadAllNetworkSettings() {
+			networkSettings.From = from
+			networkSettings.To = scheduled
+			networkSettings.Duration = scheduled.Sub(from)
+			networkSettings.Chaos = settings.Chaos
+
+			// Usage spilled while Mongo was down goes in before the run's own, so
+			// periods are stored in the order they were collected
+			flushed, kept, err := flushNetworkSpill(networkSettings)
+			if err != nil {
+				log.Printf("WARNING: %d spilled periods of network %s left, Mongo still refuses them: %v", kept, networkSettings.Network, err)
+			} else if flushed > 0 {
+				log.Printf("Flushed %d spilled periods of network %s", flushed, networkSettings.Network)
+			}
+
+			collectNetwork(networkSettings, report)
+		}
+	}
+}
+
+func pruneJob(scheduled time.Time, previous time.Time) {
+	for _, settings := range loadAllNetworkSettings() {
+		pruneNetwork(settings, false)
+	}
+}
+
+// daemonCommand runs collection, pruning if PRUNE_SCHEDULE is set,
+// downsampling if DOWNSAMPLE_SCHEDULE is set, and commitment checks if
+// COMMITMENTS_SCHEDULE is set, on their cron schedules until stopped.
+// Member metrics with a schedule of their own, like DNS queries daily while
+// usage is collected hourly, run as jobs of their own. Runs missed while
+// the daemon was down are caught up on start, up to SCHEDULE_CATCH_UP of
+// them per job. Each run starts up to SCHEDULE_JITTER late, and runs due
+// during SCHEDULE_BLACKOUTS wait for them to end, still covering the window
+// they were scheduled for. Errors which stop a run exit the daemon, and as
+// the run wasn't recorded it is caught up once the daemon is restarted.
+// Usage spilled to MONGO_SPILL_FILE while Mongo was down is flushed before
+// each collection
+func daemonCommand(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	chaos := chaosFlags(flags)
+	flags.Parse(args)
+
+	if err := checkChaos(*chaos); err != nil {
+		fatal(err)
+	}
+
+	settings := loadProcessSettings()
+	settings.Chaos = *chaos
+
+	// Each run reads the settings again, but a network missing what
+	// collection needs is better found before the first one
+	for _, networkSettings := range loadAllNetworkSettings() {
+		checkCollectionSettings(networkSettings)
+	}
+
+	location, err := time.LoadLocation(settings.ScheduleTimezone)
+	if err != nil {
+		fatal(err)
+	}
+
+	blackouts, err := parseBlackouts(settings.ScheduleBlackouts)
+	if err != nil {
+		fatal(err)
+	}
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	jobs := []*daemonJob{}
+
+	collectSchedule, err := parseCron(settings.Schedule, location)
+	if err != nil {
+		fatal(err)
+	}
+	jobs = append(jobs, &daemonJob{name: "collect", schedule: collectSchedule, run: collectJob(settings)})
+
+	scheduledMetrics, err := metricJobs(settings, location)
+	if err != nil {
+		fatal(err)
+	}
+	jobs = append(jobs, scheduledMetrics...)
+
+	if settings.PruneSchedule != "" {
+		pruneSchedule, err := parseCron(settings.PruneSchedule, location)
+		if err != nil {
+			fatal(err)
+		}
+		jobs = append(jobs, &daemonJob{name: "prune", schedule: pruneSchedule, run: pruneJob})
+	}
+
+	if settings.DownsampleSchedule != "" {
+		downsampleSchedule, err := parseCron(settings.DownsampleSchedule, location)
+		if err != nil {
+			fatal(err)
+		}
+		jobs = append(jobs, &daemonJob{name: "downsample", schedule: downsampleSchedule, run: downsampleJob})
+	}
+
+	if settings.CommitmentsSchedule != "" {
+		commitmentsSchedule, err := parseCron(settings.CommitmentsSchedule, location)
+		if err != nil {
+			fatal(err)
+		}
+		jobs = append(jobs, &daemonJob{name: "commitments", schedule: commitmentsSchedule, run: commitmentsJob})
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	runs := db.Collection(settings.MongoSchedulerCollection)
+
+	now := time.Now()
+	for _, job := range jobs {
+		if job.last, err = getLastRun(runs, job.name); err != nil {
+			fatal(err)
+		}
+
+		if job.last.IsZero() {
+			// Nothing to catch up on for a job which never ran
+			job.last = now
+			continue
+		}
+		job.ranOnce = true
+
+		// Skip the oldest missed runs beyond the catch up limit
+		missed := []time.Time{}
+		for t := job.schedule.Next(job.last); !t.IsZero() && !t.After(now); t = job.schedule.Next(t) {
+			missed = append(missed, t)
+		}
+		if len(missed) > settings.ScheduleCatchUp {
+			skipped := len(missed) - settings.ScheduleCatchUp
+			log.Printf("Skipping %d missed %s runs, catching up on the last %d", skipped, job.name, settings.ScheduleCatchUp)
+			job.last = missed[skipped-1]
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		// Run the job due first, catching up on missed runs immediately
+		var due *daemonJob
+		var dueAt time.Time
+		for _, job := range jobs {
+			next := job.schedule.Next(job.last)
+			if next.IsZero() {
+				continue
+			}
+			if due == nil || next.Before(dueAt) {
+				due, dueAt = job, next
+			}
+		}
+		if due == nil {
+			fatal("no scheduled job will ever run again")
+		}
+
+		startAt := dueAt
+		if settings.ScheduleJitter > 0 {
+			startAt = startAt.Add(time.Duration(jitter.Int63n(int64(settings.ScheduleJitter))))
+		}
+		if now := time.Now(); startAt.Before(now) {
+			startAt = now
+		}
+		startAt = afterBlackouts(startAt, blackouts, location)
+
+		if wait := time.Until(startAt); wait > 0 {
+			log.Printf("Next %s run at %s", due.name, startAt.Format(time.RFC3339))
+			select {
+			case <-time.After(wait):
+			case <-signals:
+				return
+			}
+		}
+
+		previous := due.last
+		if !due.ranOnce {
+			previous = due.schedule.Prev(dueAt)
+		}
+
+		started := time.Now()
+		log.Printf("Running %s scheduled at %s", due.name, dueAt.Format(time.RFC3339))
+		due.run(dueAt, previous)
+
+		err := recordRun(runs, SchedulerRun{Job: due.name, ScheduledAt: dueAt, StartedAt: started, FinishedAt: time.Now()})
+		if err != nil {
+			fatal(fmt.Sprintf("recording %s run: %v", due.name, err))
+		}
+		due.last = dueAt
+		due.ranOnce = true
+
+		select {
+		case <-signals:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// dashboardRuns is how many scheduler runs the dashboard shows
+const dashboardRuns = 20
+
+// DashboardSummary is what the dashboard shows of a network over a window
+type DashboardSummary struct {
+	Network string
+	From    time.Time
+	To      time.Time
+	Up      float64
+	Down    float64
+	Total   float64
+	Members []MemberSummary
+	Runs    []SchedulerRun
+	// Annotations are the notes about the network and members in the window
+	Annotations []Annotation
+}
+
+// MemberSummary is a member's usage over the window, and per day for its
+// history chart
+type MemberSummary struct {
+	MemberID string `json:",omitempty"`
+	Name     string
+	Up       float64
+	Down     float64
+	Total    float64
+	Failed   int
+	Days     []DayUsage
+}
+
+// DayUsage is a member's usage on one day, by the start of its periods
+type DayUsage struct {
+	Day   string
+	Total float64
+}
+
+// summarizeDashboard adds up the usage periods of a window per member and
+// per day. Overlapping periods are counted once, as the audit does
+func summarizeDashboard(network string, periods []BandwidthUsagePeriod, from time.Time, to time.Time) DashboardSummary {
+	summary := DashboardSummary{Network: network, From: from, To: to, Members: []MemberSummary{}}
+
+	members := map[string]*MemberSummary{}
+	byMember := map[string][]BandwidthUsagePeriod{}
+	keys := []string{}
+	for _, period := range periods {
+		key := period.MemberID
+		if key == "" {
+			key = period.Name
+		}
+		member, ok := members[key]
+		if !ok {
+			member = &MemberSummary{MemberID: period.MemberID, Days: []DayUsage{}}
+			members[key] = member
+			keys = append(keys, key)
+		}
+		// Periods are read oldest first, so this is the latest name
+		member.Name = period.Name
+
+		if period.Status == usageStatusFailed {
+			member.Failed++
+			continue
+		}
+		byMember[key] = append(byMember[key], period)
+	}
+
+	for _, key := range keys {
+		member := members[key]
+		memberPeriods := byMember[key]
+
+		sum := sumMemberUsage(memberPeriods)
+		member.Up, member.Down, member.Total = sum.Up, sum.Down, sum.Total
+
+		byDay := map[string][]BandwidthUsagePeriod{}
+		for _, period := range memberPeriods {
+			day := period.From.UTC().Format("2006-01-02")
+			byDay[day] = append(byDay[day], period)
+		}
+		for day, dayPeriods := range byDay {
+			member.Days = append(member.Days, DayUsage{Day: day, Total: sumMemberUsage(dayPeriods).Total})
+		}
+		sort.Slice(member.Days, func(i, j int) bool { return member.Days[i].Day < member.Days[j].Day })
+
+		summary.Up += member.Up
+		summary.Down += member.Down
+		summary.Total += member.Total
+		summary.Members = append(summary.Members, *member)
+	}
+
+	sort.SliceStable(summary.Members, func(i, j int) bool {
+		if summary.Members[i].Total == summary.Members[j].Total {
+			return strings.ToLower(summary.Members[i].Name) < strings.ToLower(summary.Members[j].Name)
+		}
+		return summary.Members[i].Total > summary.Members[j].Total
+	})
+
+	return summary
+}
+
+// getRecentRuns reads the latest runs of the daemon's jobs, newest first
+func getRecentRuns(collection *mongo.Collection, limit int64) ([]SchedulerRun, error) {
+	runs := []SchedulerRun{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"scheduledat": -1}).SetLimit(limit))
+	if err != nil {
+		return runs, err
+	}
+	err = cursor.All(ctx, &runs)
+	return runs, err
+}
+
+// handleDashboard serves the dashboard page. It holds no data itself, the
+// page asks for a token and reads the summary with it
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/dashboard" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "the dashboard requires GET")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write([]byte(dashboardHTML))
+}
+
+// summarize reads the network's dashboard summary over the last days
+func (t *Tenant) summarize(days int) (DashboardSummary, error) {
+	to := time.Now()
+	from := to.Add(-time.Duration(days) * 24 * time.Hour)
+
+	periods, err := getUsagePeriods(t.reads, t.settings.Network, "", "", from, to)
+	if err != nil {
+		return DashboardSummary{}, err
+	}
+
+	summary := summarizeDashboard(t.settings.Network, periods, from, to)
+
+	summary.Annotations, err = getAnnotations(t.reads.Database().Collection(t.settings.MongoAnnotationsCollection), t.settings.Network, "", from, to)
+	if err != nil {
+		log.Printf("Error reading annotations: %v", err)
+	}
+
+	return summary, nil
+}
+
+// summaryDays reads the days a summary covers, 30 if not given
+func summaryDays(value string) (int, bool) {
+	if value == "" {
+		return 30, true
+	}
+	days, err := strconv.Atoi(value)
+	return days, err == nil && days > 0
+}
+
+// cachedSummary is summarize through the tenant's result cache
+func (t *Tenant) cachedSummary(days int) (DashboardSummary, error) {
+	cached, err := t.results.Get("summary:"+strconv.Itoa(days), func() (interface{}, error) {
+		return t.summarize(days)
+	})
+	if err != nil {
+		return DashboardSummary{}, err
+	}
+	return cached.(DashboardSummary), nil
+}
+
+// handleSummary returns the mesh totals, the members' usage per day and the
+// latest scheduler runs for the dashboard
+func (s *Server) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "the summary requires GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, _, ok := s.authorize(w, r, query.Get("network"), roleViewer)
+	if !ok {
+		return
+	}
+
+	days, ok := summaryDays(query.Get("days"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "days must be a positive number")
+		return
+	}
+
+	// The summary is cached, the runs are few and change on their own
+	summary, err := tenant.cachedSummary(days)
+	if err != nil {
+		log.Printf("Error reading usage: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "usage could not be read")
+		return
+	}
+
+	summary.Runs = []SchedulerRun{}
+	if s.runs != nil {
+		runs, err := getRecentRuns(s.runs, dashboardRuns)
+		if err != nil {
+			log.Printf("Error reading scheduler runs: %v", err)
+		}
+		summary.Runs = runs
+	}
+
+	writeJSON(w, summary)
+}
@@ -0,0 +1,263 @@
+package main
+
+// dashboardHTML is the whole dashboard, so serve mode needs no files beside
+// the binary. Its script keeps the token in the browser's local storage and
+// draws the charts as SVG without any library
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Mesh usage</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; color: #222; background: #f6f6f4; }
+header { background: #23395b; color: #fff; padding: 0.8em 1.2em; display: flex; gap: 1em; align-items: center; flex-wrap: wrap; }
+header h1 { font-size: 1.2em; margin: 0 auto 0 0; }
+header input, header select, header button { font: inherit; padding: 0.2em 0.4em; }
+main { padding: 1em 1.2em; max-width: 70em; }
+.totals { display: flex; gap: 1em; flex-wrap: wrap; }
+.total { background: #fff; border-radius: 4px; padding: 0.8em 1.2em; min-width: 9em; }
+.total b { display: block; font-size: 1.6em; }
+section { background: #fff; border-radius: 4px; padding: 0.8em 1.2em; margin-top: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #eee; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+svg rect { fill: #4a7fb5; }
+svg rect.note { fill: #d08a1e; }
+svg rect.maintenance { fill: #e4e4e0; }
+.failed { color: #b22; }
+#error { color: #b22; }
+</style>
+</head>
+<body>
+<header>
+<h1>Mesh usage</h1>
+<label>Network <input id="network" size="10" placeholder="default"></label>
+<label>Token <input id="token" type="password" size="24"></label>
+<label>Days <select id="days"><option>7</option><option selected>30</option><option>90</option></select></label>
+<label>Statements for <input id="month" type="month"></label>
+<button id="load">Load</button>
+</header>
+<main>
+<p id="error"></p>
+<div class="totals">
+<div class="total">Members<b id="members">-</b></div>
+<div class="total">Up (GB)<b id="up">-</b></div>
+<div class="total">Down (GB)<b id="down">-</b></div>
+<div class="total">Total (GB)<b id="total">-</b></div>
+</div>
+<section>
+<h2>Members</h2>
+<table>
+<thead><tr><th>Member</th><th>Up</th><th>Down</th><th>Total</th><th>Failed</th><th>Daily history</th><th>Statement</th></tr></thead>
+<tbody id="usage"></tbody>
+</table>
+</section>
+<section>
+<h2>Notes</h2>
+<table>
+<thead><tr><th>Member</th><th>From</th><th>To</th><th>Note</th><th>By</th></tr></thead>
+<tbody id="notes"></tbody>
+</table>
+</section>
+<section>
+<h2>Scheduler runs</h2>
+<table>
+<thead><tr><th>Job</th><th>Scheduled</th><th>Started</th><th>Took</th></tr></thead>
+<tbody id="runs"></tbody>
+</table>
+</section>
+</main>
+<script>
+(function () {
+  var $ = function (id) { return document.getElementById(id); };
+  var svgNS = "http://www.w3.org/2000/svg";
+
+  $("network").value = localStorage.getItem("network") || "";
+  $("token").value = localStorage.getItem("token") || "";
+  $("month").value = new Date().toISOString().slice(0, 7);
+
+  function gb(n) { return n.toFixed(2); }
+
+  function cell(row, text, className) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    if (className) { td.className = className; }
+    row.appendChild(td);
+    return td;
+  }
+
+  // chart draws a member's daily totals as bars, scaled to its busiest day,
+  // marking the days notes about the member start on and shading the days
+  // of maintenance windows
+  function chart(days, from, count, notes) {
+    var width = 3 * count, height = 24;
+    var svg = document.createElementNS(svgNS, "svg");
+    svg.setAttribute("width", width);
+    svg.setAttribute("height", height);
+    notes.forEach(function (n) {
+      if (!n.Maintenance) { return; }
+      var first = Math.max(0, Math.floor((Date.parse(n.From) - from) / 86400000));
+      var last = Math.min(count, Math.ceil((Date.parse(n.To) - from) / 86400000));
+      if (last <= first) { return; }
+      var shade = document.createElementNS(svgNS, "rect");
+      shade.setAttribute("class", "maintenance");
+      shade.setAttribute("x", first * 3);
+      shade.setAttribute("y", 0);
+      shade.setAttribute("width", (last - first) * 3);
+      shade.setAttribute("height", height);
+      var title = document.createElementNS(svgNS, "title");
+      title.textContent = "Maintenance: " + n.Text;
+      shade.appendChild(title);
+      svg.appendChild(shade);
+    });
+    var max = 0;
+    days.forEach(function (d) { max = Math.max(max, d.Total); });
+    days.forEach(function (d) {
+      var index = Math.floor((Date.parse(d.Day + "T00:00:00Z") - from) / 86400000);
+      if (index < 0 || index >= count || max === 0) { return; }
+      var h = Math.max(1, Math.round(d.Total / max * height));
+      var bar = document.createElementNS(svgNS, "rect");
+      bar.setAttribute("x", index * 3);
+      bar.setAttribute("y", height - h);
+      bar.setAttribute("width", 2);
+      bar.setAttribute("height", h);
+      var title = document.createElementNS(svgNS, "title");
+      title.textContent = d.Day + ": " + gb(d.Total) + " GB";
+      bar.appendChild(title);
+      svg.appendChild(bar);
+    });
+    notes.forEach(function (n) {
+      if (n.Maintenance) { return; }
+      var index = Math.floor((Date.parse(n.From || n.CreatedAt) - from) / 86400000);
+      if (index < 0 || index >= count) { return; }
+      var mark = document.createElementNS(svgNS, "rect");
+      mark.setAttribute("class", "note");
+      mark.setAttribute("x", index * 3);
+      mark.setAttribute("y", 0);
+      mark.setAttribute("width", 2);
+      mark.setAttribute("height", 3);
+      var title = document.createElementNS(svgNS, "title");
+      title.textContent = n.Text;
+      mark.appendChild(title);
+      svg.appendChild(mark);
+    });
+    return svg;
+  }
+
+  // statement downloads a member's monthly statement, which needs the
+  // token, so can't be a plain link
+  function statement(memberID, format) {
+    var params = "?member=" + encodeURIComponent(memberID) + "&month=" + encodeURIComponent($("month").value) + "&format=" + format;
+    if ($("network").value) { params += "&network=" + encodeURIComponent($("network").value); }
+
+    fetch("/api/v1/statement" + params, { headers: { "Authorization": "Bearer " + $("token").value } })
+      .then(function (response) {
+        if (!response.ok) {
+          return response.json().then(function (body) { throw new Error(body.error || response.statusText); });
+        }
+        return response.blob();
+      })
+      .then(function (blob) {
+        var link = document.createElement("a");
+        link.href = URL.createObjectURL(blob);
+        link.download = "statement-" + memberID + "-" + $("month").value + "." + format;
+        link.click();
+        setTimeout(function () { URL.revokeObjectURL(link.href); }, 1000);
+      })
+      .catch(function (err) { $("error").textContent = err.message; });
+  }
+
+  function statementLink(td, memberID, format) {
+    var link = document.createElement("a");
+    link.href = "#";
+    link.textContent = format.toUpperCase();
+    link.addEventListener("click", function (event) {
+      event.preventDefault();
+      statement(memberID, format);
+    });
+    td.appendChild(link);
+    td.appendChild(document.createTextNode(" "));
+  }
+
+  function render(summary) {
+    $("members").textContent = summary.Members.length;
+    $("up").textContent = gb(summary.Up);
+    $("down").textContent = gb(summary.Down);
+    $("total").textContent = gb(summary.Total);
+
+    var from = Date.parse(summary.From.slice(0, 10) + "T00:00:00Z");
+    var count = Math.ceil((Date.parse(summary.To) - from) / 86400000);
+
+    var names = {};
+    summary.Members.forEach(function (m) { if (m.MemberID) { names[m.MemberID] = m.Name; } });
+
+    var usage = $("usage");
+    usage.textContent = "";
+    summary.Members.forEach(function (m) {
+      var row = document.createElement("tr");
+      cell(row, m.Name);
+      cell(row, gb(m.Up), "number");
+      cell(row, gb(m.Down), "number");
+      cell(row, gb(m.Total), "number");
+      cell(row, m.Failed || "", m.Failed ? "number failed" : "number");
+      var notes = summary.Annotations.filter(function (n) { return !n.MemberID || n.MemberID === m.MemberID; });
+      cell(row, "").appendChild(chart(m.Days, from, count, notes));
+      var links = cell(row, "");
+      if (m.MemberID) {
+        statementLink(links, m.MemberID, "html");
+        statementLink(links, m.MemberID, "csv");
+      }
+      usage.appendChild(row);
+    });
+
+    var notes = $("notes");
+    notes.textContent = "";
+    summary.Annotations.forEach(function (n) {
+      var row = document.createElement("tr");
+      cell(row, n.MemberID ? (names[n.MemberID] || n.MemberID) : "Whole network");
+      cell(row, n.From ? new Date(n.From).toLocaleDateString() : "");
+      cell(row, n.To ? new Date(n.To).toLocaleDateString() : "");
+      cell(row, n.Maintenance ? "Maintenance: " + n.Text : n.Text);
+      cell(row, n.Author);
+      notes.appendChild(row);
+    });
+
+    var runs = $("runs");
+    runs.textContent = "";
+    summary.Runs.forEach(function (r) {
+      var row = document.createElement("tr");
+      cell(row, r.Job);
+      cell(row, new Date(r.ScheduledAt).toLocaleString());
+      cell(row, new Date(r.StartedAt).toLocaleString());
+      cell(row, Math.round((Date.parse(r.FinishedAt) - Date.parse(r.StartedAt)) / 1000) + "s", "number");
+      runs.appendChild(row);
+    });
+  }
+
+  function load() {
+    localStorage.setItem("network", $("network").value);
+    localStorage.setItem("token", $("token").value);
+    $("error").textContent = "";
+
+    var params = "?days=" + encodeURIComponent($("days").value);
+    if ($("network").value) { params += "&network=" + encodeURIComponent($("network").value); }
+
+    fetch("/api/v1/summary" + params, { headers: { "Authorization": "Bearer " + $("token").value } })
+      .then(function (response) {
+        return response.json().then(function (body) {
+          if (!response.ok) { throw new Error(body.error || response.statusText); }
+          return body;
+        });
+      })
+      .then(render)
+      .catch(function (err) { $("error").textContent = err.message; });
+  }
+
+  $("load").addEventListener("click", load);
+  if ($("token").value) { load(); }
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarizeDashboard(t *testing.T) {
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	period := func(memberID string, name string, from int, to int, usage BandwidthUsagePeriod) BandwidthUsagePeriod {
+		usage.MemberID = memberID
+		usage.Name = name
+		usage.From = day.Add(time.Duration(from) * time.Hour)
+		usage.To = day.Add(time.Duration(to) * time.Hour)
+		return usage
+	}
+
+	summary := summarizeDashboard("casa", []BandwidthUsagePeriod{
+		period("rec1", "Alice", 0, 24, usage(1, 2)),
+		// The same day stored again by a longer run is counted once
+		period("rec1", "Alice", 0, 48, usage(4, 4)),
+		period("rec1", "Alice Smith", 48, 72, usage(1, 1)),
+		period("", "Bob", 0, 24, usage(10, 10)),
+		period("", "Bob", 24, 48, failedUsage()),
+		period("rec3", "Carol", 0, 24, noUsage()),
+	}, day, day.Add(72*time.Hour))
+
+	if summary.Network != "casa" || summary.Up != 15 || summary.Down != 15 || summary.Total != 30 {
+		t.Errorf("got totals %+v", summary)
+	}
+	if len(summary.Members) != 3 {
+		t.Fatalf("got members %+v", summary.Members)
+	}
+
+	bob, alice, carol := summary.Members[0], summary.Members[1], summary.Members[2]
+	if bob.Name != "Bob" || bob.Total != 20 || bob.Failed != 1 || len(bob.Days) != 1 {
+		t.Errorf("got Bob %+v", bob)
+	}
+	if alice.MemberID != "rec1" || alice.Name != "Alice Smith" || alice.Total != 10 {
+		t.Errorf("got Alice %+v", alice)
+	}
+	if len(alice.Days) != 2 || alice.Days[0] != (DayUsage{"2026-10-01", 8}) || alice.Days[1] != (DayUsage{"2026-10-03", 2}) {
+		t.Errorf("got Alice's days %+v", alice.Days)
+	}
+	if carol.Name != "Carol" || carol.Total != 0 || len(carol.Days) != 1 {
+		t.Errorf("got Carol %+v", carol)
+	}
+}
+
+func TestDashboardRoutes(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens}}, nil)
+	routes := server.routes()
+
+	tests := []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/", "", http.StatusOK},
+		{"/dashboard", "", http.StatusOK},
+		{"/missing", "", http.StatusNotFound},
+		{"/api/v1/summary", "", http.StatusUnauthorized},
+		{"/api/v1/summary", "mine", http.StatusForbidden},
+		{"/api/v1/summary?days=0", "view", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.path, w.Code, test.status)
+		}
+		if test.status == http.StatusOK && !strings.Contains(w.Body.String(), "/api/v1/summary") {
+			t.Errorf("%s: the dashboard isn't served", test.path)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoDuplicateKey is the error code Mongo returns when an insert collides
+// with an existing _id or unique index
+const mongoDuplicateKey = 11000
+
+func isDuplicateKeyError(err error) bool {
+	if e, ok := err.(mongo.WriteException); ok {
+		for _, writeError := range e.WriteErrors {
+			if writeError.Code == mongoDuplicateKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sampleID is the idempotency key of a sample. It only depends on what the
+// sample covers, so an agent resending it after a failed push reuses it
+func sampleID(sample UsageSample) string {
+	hash := sha256.Sum256([]byte(sample.Agent + "|" + sample.Interface + "|" + sample.WGKey + "|" +
+		strconv.FormatInt(sample.From.UnixNano(), 10) + "|" +
+		strconv.FormatInt(sample.To.UnixNano(), 10)))
+	return hex.EncodeToString(hash[:16])
+}
+
+// ingestedSample is the ID of a sample already ingested. The key, as
+// stored, is kept so forget can find a member's
+type ingestedSample struct {
+	ID     string `bson:"_id"`
+	WGKey  string
+	SeenAt time.Time
+}
+
+type ingestWatermark struct {
+	ID string `bson:"_id"`
+	To time.Time
+}
+
+// SampleDeduplicator keeps retried or overlapping pushes from being counted
+// twice. Every accepted sample ID is remembered for a while, and for each
+// agent, interface and key we keep the end of the latest window ingested so far
+type SampleDeduplicator struct {
+	samples    *mongo.Collection
+	watermarks *mongo.Collection
+}
+
+func newSampleDeduplicator(settings Settings, db *mongo.Database) (*SampleDeduplicator, error) {
+	d := &SampleDeduplicator{
+		samples:    db.Collection(settings.IngestSamplesCollection),
+		watermarks: db.Collection(settings.IngestWatermarksCollection),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Sample IDs only need to outlive an agent's retries
+	_, err := d.samples.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"seenat": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(settings.IngestDedupTTL / time.Second)),
+	})
+
+	return d, err
+}
+
+// watermarkID is the ID of the watermark of a sample's agent, interface and
+// key, with the key as stored
+func watermarkID(sample UsageSample) string {
+	return sample.Network + "|" + sample.Agent + "|" + sample.Interface + "|" + encryptName(sample.Network, sample.WGKey)
+}
+
+// ingestedID scopes a sample's idempotency key to its network
+func ingestedID(sample UsageSample) string {
+	return sample.Network + "|" + sample.ID
+}
+
+// Resolve returns the part of the sample which hasn't been ingested yet, and
+// false if there is none. A sample partly overlapping what was already
+// ingested is trimmed to start at the watermark, with its bytes prorated
+func (d *SampleDeduplicator) Resolve(sample UsageSample) (UsageSample, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if sample.ID == "" {
+		sample.ID = sampleID(sample)
+	}
+
+	count, err := d.samples.CountDocuments(ctx, bson.M{"_id": ingestedID(sample)})
+	if err != nil {
+		return sample, false, err
+	}
+	if count > 0 {
+		return sample, false, nil
+	}
+
+	var watermark ingestWatermark
+	err = d.watermarks.FindOne(ctx, bson.M{"_id": watermarkID(sample)}).Decode(&watermark)
+	if err == mongo.ErrNoDocuments {
+		return sample, true, nil
+	}
+	if err != nil {
+		return sample, false, err
+	}
+
+	if !sample.To.After(watermark.To) {
+		return sample, false, nil
+	}
+
+	if sample.From.Before(watermark.To) {
+		kept := float64(sample.To.Sub(watermark.To)) / float64(sample.To.Sub(sample.From))
+		sample.Up = uint64(float64(sample.Up) * kept)
+		sample.Down = uint64(float64(sample.Down) * kept)
+		sample.From = watermark.To
+	}
+
+	return sample, true, nil
+}
+
+// Commit records a sample as ingested once it has been saved
+func (d *SampleDeduplicator) Commit(sample UsageSample) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := d.samples.InsertOne(ctx, ingestedSample{ID: ingestedID(sample), WGKey: encryptName(sample.Network, sample.WGKey), SeenAt: time.Now()})
+	if err != nil && !isDuplicateKeyError(err) {
+		return err
+	}
+
+	// Only ever move the watermark forward
+	_, err = d.watermarks.UpdateOne(ctx,
+		bson.M{"_id": watermarkID(sample), "to": bson.M{"$lt": sample.To}},
+		bson.M{"$set": bson.M{"to": sample.To}})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.watermarks.InsertOne(ctx, ingestWatermark{ID: watermarkID(sample), To: sample.To})
+	if err != nil && !isDuplicateKeyError(err) {
+		return err
+	}
+
+	return nil
+}
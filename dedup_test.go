@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSampleKeysPerInterface(t *testing.T) {
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	// A peer on both exit interfaces is read at the same tick on each
+	first := UsageSample{Network: "casa", Agent: "exit1", Interface: "wg_exit", WGKey: "key1", From: now, To: now.Add(time.Minute)}
+	second := first
+	second.Interface = "wg_exit_v2"
+
+	if sampleID(first) == sampleID(second) {
+		t.Error("samples of two interfaces share an ID")
+	}
+	if watermarkID(first) == watermarkID(second) {
+		t.Error("samples of two interfaces share a watermark")
+	}
+
+	// Resending the same sample must reuse its ID
+	if sampleID(first) != sampleID(first) {
+		t.Error("sample ID isn't stable")
+	}
+
+	other := first
+	other.Network = "hq"
+	if ingestedID(first) == ingestedID(other) {
+		t.Error("samples of two networks share an ingested ID")
+	}
+}
+
+func TestUsageKeyPerInterface(t *testing.T) {
+	bwup := BandwidthUsagePeriod{Network: "casa", MemberID: "rec1", Interface: "wg_exit"}
+	if key := usageKey(bwup); key["interface"] != "wg_exit" {
+		t.Errorf("got key %v", key)
+	}
+
+	bwup.Interface = ""
+	if _, ok := usageKey(bwup)["interface"]; !ok {
+		t.Error("collected usage matches usage pushed from any interface")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// commandDoc documents a command for the shell completions and man pages
+// written by gen-docs
+type commandDoc struct {
+	Usage   string
+	Summary string
+	Flags   []commandFlag
+}
+
+// commandFlag is a flag of a command and its usage, as the command defines
+// it
+type commandFlag struct {
+	Name  string
+	Usage string
+}
+
+// outputFlag is the flag of the commands printing reports
+var outputFlag = commandFlag{"output", "output format: table, json, csv or quiet"}
+
+// publicFlag is the flag of the commands printing aggregates which can be
+// published
+var publicFlag = commandFlag{"public", "leave out small groups, round and add noise with the PUBLIC_ settings, for publishing"}
+
+// collectDoc documents collection, which runs when no command is given
+var collectDoc = commandDoc{
+	Usage:   "[-output format] [-quiet] [-record dir] [-replay dir] duration [end_time]",
+	Summary: "collect the usage of every member over the window and store it",
+	Flags: []commandFlag{
+		outputFlag,
+		{"quiet", "print neither the usage nor the summary"},
+		{"replay", "directory of recorded Airtable and Graylog responses to collect from, offline and storing nothing"},
+		{"record", "directory to save sanitized copies of the Airtable and Graylog responses to, for -replay"},
+	},
+}
+
+// commandDocs document the commands by name. Every command needs one, with
+// the flags the command defines, which the tests check against the source
+var commandDocs = map[string]commandDoc{
+	"netflow": {Usage: "netflow", Summary: "listen for flow exports from the exit routers and count traffic per peer"},
+	"snmp":    {Usage: "snmp", Summary: "poll the exit router interfaces for exit level usage"},
+	"abuse": {Usage: "abuse [-all] duration [end_time]", Summary: "rank members by the abuse heuristics they trip over the window", Flags: []commandFlag{
+		outputFlag,
+		{"all", "list members which trip no heuristic too"},
+	}},
+	"audit":       {Usage: "audit duration [end_time]", Summary: "compare the stored member usage against the exit totals", Flags: []commandFlag{outputFlag}},
+	"commitments": {Usage: "commitments [-month 2026-09]", Summary: "report usage against the transit commitments of the month", Flags: []commandFlag{outputFlag, {"month", "month to report, like 2026-09, this month if empty"}}},
+	"forecast": {Usage: "forecast [-method linear|seasonal] [-history days] [-days days]", Summary: "forecast the usage of every member and mesh over the coming days", Flags: []commandFlag{
+		outputFlag,
+		{"method", "forecasting method: linear or seasonal"},
+		{"history", "days of history to forecast from"},
+		{"days", "days to forecast"},
+	}},
+	"uptime":  {Usage: "uptime duration [end_time]", Summary: "report the uptime of every member against SLA_UPTIME_TARGET", Flags: []commandFlag{outputFlag}},
+	"agent":   {Usage: "agent", Summary: "push the WireGuard counters of an exit node to the central collector"},
+	"serve":   {Usage: "serve", Summary: "run the HTTP API and dashboard"},
+	"link":    {Usage: "link <member record id> [validity]", Summary: "print a signed link to a member's usage"},
+	"prune":   {Usage: "prune [-dry-run]", Summary: "roll up and delete data older than RETENTION_PERIOD", Flags: []commandFlag{{"dry-run", "list what would be pruned without deleting anything"}}},
+	"dump":    {Usage: "dump <archive.jsonl.gz>", Summary: "write every collection to a gzipped JSONL archive"},
+	"restore": {Usage: "restore <archive.jsonl.gz>", Summary: "load an archive written by dump"},
+	"alias":   {Usage: "alias <member record id> [name...]", Summary: "merge usage stored under other names under a member's ID"},
+	"annotate": {Usage: "annotate add|list|delete ...", Summary: "add, list or delete annotations and maintenance windows", Flags: []commandFlag{
+		{"member", "Airtable record ID of the member, the whole network if empty"},
+		{"from", "start of the period, like 2026-03-12"},
+		{"to", "end of the period, like 2026-03-13"},
+		{"author", "who is adding the annotation"},
+		{"maintenance", "the annotation is a maintenance window, left out of uptime"},
+		outputFlag,
+	}},
+	"backfill": {Usage: "backfill [-period length] [-concurrency n] [-rate n] [-dry-run] duration [end_time]", Summary: "collect the usage missing from a window, a period at a time", Flags: []commandFlag{
+		{"period", "length of the periods to collect"},
+		{"concurrency", "periods collected at once"},
+		{"rate", "periods started per second at most, 0 for no limit"},
+		{"dry-run", "only report the missing periods"},
+	}},
+	"daemon":      {Usage: "daemon", Summary: "run collection and the scheduled jobs on their schedules"},
+	"migrate-ids": {Usage: "migrate-ids [-dry-run] [-untagged network]", Summary: "give usage stored by name the record ID of its member", Flags: []commandFlag{{"dry-run", "report the mapping without changing anything"}, {"untagged", "network the documents stored without one belong to"}}},
+	"migrate-db":  {Usage: "migrate-db [-status]", Summary: "apply the pending Postgres migrations", Flags: []commandFlag{{"status", "list the migrations and whether they are applied, without applying any"}}},
+	"mutations": {Usage: "mutations [-kind kind] duration [end_time]", Summary: "list the changes made to the stored data over the window", Flags: []commandFlag{
+		outputFlag,
+		{"kind", "only list mutations of this kind: insert, overwrite, merge, prune, alias, tag, restore, correct, compact, downsample, encrypt or forget"},
+	}},
+	"crm-sync": {Usage: "crm-sync duration [end_time]", Summary: "write each member's usage over the window to their CRM record"},
+	"correct": {Usage: "correct -member id -period from/to -reason text [-up GB] [-down GB] [-total GB]", Summary: "correct the usage stored for a member's period by hand", Flags: []commandFlag{
+		{"member", "Airtable record ID of the member"},
+		{"name", "name of the member, for usage stored without a record ID"},
+		{"period", "period to correct, like 2026-09-01T00:00:00Z/2026-09-02T00:00:00Z"},
+		{"reason", "why the usage is corrected"},
+		{"up", "corrected upload in GB"},
+		{"down", "corrected download in GB"},
+		{"total", "corrected total in GB"},
+	}},
+	"keygen": {Usage: "keygen", Summary: "print a new key pair for SIGNING_KEY"},
+	"verify": {Usage: "verify [-key key] [-archive path] [-strict] [duration [end_time]]", Summary: "check the signatures of stored or dumped usage", Flags: []commandFlag{
+		{"key", "base64 public key to verify with, derived from SIGNING_KEY if empty"},
+		{"archive", "dump archive to verify, the database if empty"},
+		{"strict", "fail on unsigned periods too"},
+	}},
+	"settlement": {Usage: "settlement export -peer <peer> duration [end_time] | reconcile <ours.json> <theirs.json>", Summary: "export or reconcile the traffic exchanged with a peer network", Flags: []commandFlag{
+		{"peer", "peer network, as named in PEERING_POINTS"},
+		{"interval", "length of each period of the export"},
+		outputFlag,
+		{"key", "the peer's base64 public key, to check their export is signed by them"},
+	}},
+	"groups": {Usage: "groups [-by kind] [-public] duration [end_time]", Summary: "report the usage of each group of members over the window", Flags: []commandFlag{
+		{"by", "kind of tag to group by, like neighborhood for tags like neighborhood:Centro, or empty for every tag"},
+		outputFlag,
+		publicFlag,
+	}},
+	"sites":          {Usage: "sites [-public] duration [end_time]", Summary: "report the usage of each site and its growth", Flags: []commandFlag{outputFlag, publicFlag}},
+	"geojson":        {Usage: "geojson [-by member|site] [-public] duration [end_time]", Summary: "print the usage of members or sites as GeoJSON", Flags: []commandFlag{{"by", "features to export: member or site"}, publicFlag}},
+	"report":         {Usage: "report -template path duration [end_time]", Summary: "render a report template against the usage over the window", Flags: []commandFlag{{"template", "Go template to render, text or, ending in .html, HTML"}}},
+	"sql":            {Usage: "sql <query>", Summary: "run an SQL query against the usage kept in SQLITE_PATH", Flags: []commandFlag{outputFlag}},
+	"watch":          {Usage: "watch [-reset]", Summary: "forward changes to the stored usage to WATCH_SINKS", Flags: []commandFlag{{"reset", "start from the current changes, ignoring where the last watch got to"}}},
+	"downsample":     {Usage: "downsample [-dry-run]", Summary: "turn old hourly NetFlow histograms daily", Flags: []commandFlag{{"dry-run", "count the histograms to downsample without changing them"}}},
+	"sms":            {Usage: "sms [-kind summary|warning] [-dry-run] duration [end_time]", Summary: "text members a summary of their usage, or a warning", Flags: []commandFlag{{"kind", "message to send: summary or warning"}, {"dry-run", "print the messages instead of sending them"}}},
+	"rebuild-totals": {Usage: "rebuild-totals", Summary: "recompute the totals from the rollups and stored usage"},
+	"flush":          {Usage: "flush", Summary: "write the usage spilled during a Mongo outage to Mongo"},
+	"airtable-auth":  {Usage: "airtable-auth [-check]", Summary: "authorize reading the members base and check its scopes", Flags: []commandFlag{{"check", "only check the scopes of the current token"}}},
+	"pause": {Usage: "pause <member record id> [reason] | -list [-all] [member record id]", Summary: "pause collection for a member, or list the pauses", Flags: []commandFlag{
+		{"list", "list the pauses rather than adding one"},
+		{"all", "with -list, list resumed pauses too"},
+		{"author", "who is pausing the member"},
+		outputFlag,
+	}},
+	"resume": {Usage: "resume <member record id>", Summary: "resume collection for a paused member"},
+	"balance": {Usage: "balance [-top-up GB] [member record id] [note]", Summary: "list prepaid balances, or add a member's top-up", Flags: []commandFlag{
+		{"top-up", "GB bought by the member, to add to their balance"},
+		{"author", "who is adding the top-up"},
+		outputFlag,
+	}},
+	"lookup": {Usage: "lookup <key> duration [end_time]", Summary: "query the usage of a key without storing it", Flags: []commandFlag{outputFlag}},
+	"tui":    {Usage: "tui", Summary: "browse the members and their usage in the terminal"},
+	"doctor": {Usage: "doctor [-output format]", Summary: "test Graylog, Airtable and Mongo and print how to fix what fails", Flags: []commandFlag{outputFlag}},
+	"copy-mongo": {Usage: "copy-mongo [-collections list] [-cutover] [-output format]", Summary: "copy the database to MONGO_DUAL_WRITE_URL, for moving to another cluster", Flags: []commandFlag{
+		{"collections", "comma separated collections to copy, all of them if empty"},
+		{"cutover", "check the clusters match after copying and allow MONGO_CUTOVER, with the collector stopped"},
+		outputFlag,
+	}},
+	"encrypt-names": {Usage: "encrypt-names [-output format]", Summary: "encrypt the member names, keys and addresses stored before PII_KEY was set", Flags: []commandFlag{outputFlag}},
+	"forget": {Usage: "forget -member id [-address ips] [-delete-usage] [-dry-run] [-output format]", Summary: "delete or anonymize everything stored about a member", Flags: []commandFlag{
+		{"member", "Airtable record ID of the member"},
+		{"address", "comma separated mesh IPs of the member, for their netflow counters"},
+		{"delete-usage", "delete the member's usage rather than anonymizing it"},
+		{"dry-run", "count the documents to forget without changing them"},
+		outputFlag,
+	}},
+	"gen-docs": {Usage: "gen-docs [-dir path]", Summary: "write the shell completions and man pages", Flags: []commandFlag{{"dir", "directory to write the completions and man pages to"}}},
+}
+
+// commandNames are the documented commands, sorted
+func commandNames() []string {
+	names := []string{}
+	for name := range commandDocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flagNames are the flags of a command written as given
+func flagNames(flags []commandFlag) string {
+	names := []string{}
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// writeBashCompletion writes the bash completion of the commands and their
+// flags
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# bash completion for stat-collector, written by stat-collector gen-docs")
+	fmt.Fprintln(w, "_stat_collector() {")
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" flags`)
+	fmt.Fprintln(w, `	if [ "$COMP_CWORD" -eq 1 ] && [[ "$cur" != -* ]]; then`)
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commandNames(), " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, `	case "${COMP_WORDS[1]}" in`)
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "\t%s) flags=%q ;;\n", name, flagNames(commandDocs[name].Flags))
+	}
+	fmt.Fprintf(w, "\t*) flags=%q ;;\n", flagNames(collectDoc.Flags))
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, `	if [[ "$cur" == -* ]]; then`)
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -W "$flags" -- "$cur"))`)
+	fmt.Fprintln(w, "\telse")
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -f -- "$cur"))`)
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _stat_collector stat-collector")
+}
+
+// zshQuote quotes text in single quotes for zsh
+func zshQuote(text string) string {
+	return "'" + strings.Replace(text, "'", `'\''`, -1) + "'"
+}
+
+// writeZshCompletion writes the zsh completion of the commands and their
+// flags
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintln(w, "#compdef stat-collector")
+	fmt.Fprintln(w, "# zsh completion for stat-collector, written by stat-collector gen-docs")
+	fmt.Fprintln(w, "_stat_collector() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "\t\t%s\n", zshQuote(name+":"+commandDocs[name].Summary))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )); then")
+	fmt.Fprintln(w, "\t\t_describe command commands")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	zshFlags := func(flags []commandFlag) string {
+		specs := []string{}
+		for _, f := range flags {
+			// Brackets would end the description early
+			usage := strings.NewReplacer("[", `\[`, "]", `\]`).Replace(f.Usage)
+			specs = append(specs, zshQuote("-"+f.Name+"["+usage+"]"))
+		}
+		return strings.Join(append(specs, "'*:file:_files'"), " ")
+	}
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "\t%s) _arguments %s ;;\n", name, zshFlags(commandDocs[name].Flags))
+	}
+	fmt.Fprintf(w, "\t*) _arguments %s ;;\n", zshFlags(collectDoc.Flags))
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, `_stat_collector "$@"`)
+}
+
+// writeFishCompletion writes the fish completion of the commands and their
+// flags
+func writeFishCompletion(w io.Writer) {
+	quote := func(text string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(text) + "'"
+	}
+
+	fmt.Fprintln(w, "# fish completion for stat-collector, written by stat-collector gen-docs")
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "complete -c stat-collector -n __fish_use_subcommand -a %s -d %s\n", name, quote(commandDocs[name].Summary))
+	}
+	for _, f := range collectDoc.Flags {
+		fmt.Fprintf(w, "complete -c stat-collector -n __fish_use_subcommand -o %s -d %s\n", f.Name, quote(f.Usage))
+	}
+	for _, name := range commandNames() {
+		for _, f := range commandDocs[name].Flags {
+			fmt.Fprintf(w, "complete -c stat-collector -n '__fish_seen_subcommand_from %s' -o %s -d %s\n", name, f.Name, quote(f.Usage))
+		}
+	}
+}
+
+// roff escapes text for a man page line
+func roff(text string) string {
+	text = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(text)
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "'") {
+		text = `\&` + text
+	}
+	return text
+}
+
+// writeManFlags writes the OPTIONS section of a man page
+func writeManFlags(w io.Writer, flags []commandFlag) {
+	if len(flags) == 0 {
+		return
+	}
+	fmt.Fprintln(w, ".SH OPTIONS")
+	for _, f := range flags {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", roff("-"+f.Name), roff(f.Usage))
+	}
+}
+
+// writeManPage writes the stat-collector(1) man page, of collection and
+// the list of commands
+func writeManPage(w io.Writer) {
+	fmt.Fprintln(w, `.TH STAT\-COLLECTOR 1 "" "stat-collector" "User Commands"`)
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintln(w, `stat\-collector \- collect the bandwidth usage of mesh members`)
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintf(w, ".B stat\\-collector\n%s\n.br\n.B stat\\-collector\n\\fIcommand\\fR [\\fIargs\\fR]\n", roff(collectDoc.Usage))
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintf(w, "Without a command, %s. The window is the duration, like 168h, up to end_time, like 2006\\-01\\-2T15:04:05, or now.\n", roff(collectDoc.Summary))
+	fmt.Fprintln(w, "Settings are read from the environment and a .env file, as listed in .env example.")
+	fmt.Fprintln(w, roff("Each can also be given as a flag before the command, the key in lower case with dashes like -mongo-url=mongodb://localhost, taking precedence over the environment, .env and NETWORKS_FILE. Secrets, like passwords, tokens and keys, can't be given as flags."))
+	writeManFlags(w, collectDoc.Flags)
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s, see \\fBstat\\-collector\\-%s\\fR(1)\n", roff(name), roff(commandDocs[name].Summary), roff(name))
+	}
+}
+
+// writeCommandManPage writes the stat-collector-<name>(1) man page of a
+// command
+func writeCommandManPage(w io.Writer, name string) {
+	doc := commandDocs[name]
+	fmt.Fprintf(w, ".TH STAT\\-COLLECTOR\\-%s 1 \"\" \"stat-collector\" \"User Commands\"\n", roff(strings.ToUpper(name)))
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintf(w, "stat\\-collector\\-%s \\- %s\n", roff(name), roff(doc.Summary))
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintf(w, ".B stat\\-collector\n%s\n", roff(doc.Usage))
+	writeManFlags(w, doc.Flags)
+	fmt.Fprintln(w, ".SH SEE ALSO")
+	fmt.Fprintln(w, `\fBstat\-collector\fR(1)`)
+}
+
+// writeDocFile writes a file of the docs with the writer given
+func writeDocFile(path string, write func(w io.Writer)) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	write(file)
+	return file.Close()
+}
+
+// genDocsCommand writes the bash, zsh and fish completions, and the man
+// pages of collection and each command, from commandDocs
+func genDocsCommand(args []string) {
+	flags := flag.NewFlagSet("gen-docs", flag.ExitOnError)
+	dir := flags.String("dir", "docs", "directory to write the completions and man pages to")
+	flags.Parse(args)
+
+	files := map[string]func(w io.Writer){
+		filepath.Join(*dir, "completions", "stat-collector.bash"): writeBashCompletion,
+		filepath.Join(*dir, "completions", "_stat-collector"):     writeZshCompletion,
+		filepath.Join(*dir, "completions", "stat-collector.fish"): writeFishCompletion,
+		filepath.Join(*dir, "man", "stat-collector.1"):            writeManPage,
+	}
+	for _, name := range commandNames() {
+		name := name
+		files[filepath.Join(*dir, "man", "stat-collector-"+name+".1")] = func(w io.Writer) { writeCommandManPage(w, name) }
+	}
+
+	for path, write := range files {
+		if err := writeDocFile(path, write); err != nil {
+			fatal(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d files to %s\n", len(files), *dir)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sourceFlags reads the flags each command defines from the source, by the
+// name of the flag set they are defined on
+func sourceFlags(t *testing.T) map[string][]commandFlag {
+	files := token.NewFileSet()
+	packages, err := parser.ParseDir(files, ".", func(info os.FileInfo) bool { return !strings.HasSuffix(info.Name(), "_test.go") }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := map[string][]commandFlag{}
+	for _, file := range packages["main"].Files {
+		for _, decl := range file.Decls {
+			function, ok := decl.(*ast.FuncDecl)
+			if !ok || function.Body == nil {
+				continue
+			}
+
+			command := ""
+			ast.Inspect(function.Body, func(node ast.Node) bool {
+				call, ok := node.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				selector, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				receiver, ok := selector.X.(*ast.Ident)
+				if !ok {
+					return true
+				}
+
+				literals := []string{}
+				for _, arg := range call.Args {
+					if literal, ok := arg.(*ast.BasicLit); ok && literal.Kind == token.STRING {
+						value, _ := strconv.Unquote(literal.Value)
+						literals = append(literals, value)
+					}
+					// Flag sets of subcommands are named like "annotate "+args[0]
+					if binary, ok := arg.(*ast.BinaryExpr); ok {
+						if literal, ok := binary.X.(*ast.BasicLit); ok && literal.Kind == token.STRING {
+							value, _ := strconv.Unquote(literal.Value)
+							literals = append(literals, value)
+						}
+					}
+				}
+
+				switch {
+				case receiver.Name == "flag" && selector.Sel.Name == "NewFlagSet" && len(literals) > 0:
+					command = strings.Fields(literals[0])[0]
+				case receiver.Name == "flags" && command != "" && len(literals) >= 2:
+					flags[command] = append(flags[command], commandFlag{literals[0], literals[len(literals)-1]})
+				}
+				return true
+			})
+		}
+	}
+	return flags
+}
+
+func TestCommandDocs(t *testing.T) {
+	for name := range commands {
+		if _, ok := commandDocs[name]; !ok {
+			t.Errorf("command %s isn't documented", name)
+		}
+	}
+	for name, doc := range commandDocs {
+		if _, ok := commands[name]; !ok {
+			t.Errorf("%s is documented but isn't a command", name)
+		}
+		if doc.Summary == "" || !strings.HasPrefix(doc.Usage, name) {
+			t.Errorf("%s: got usage %q and summary %q", name, doc.Usage, doc.Summary)
+		}
+	}
+
+	sorted := func(flags []commandFlag) []commandFlag {
+		sorted := append([]commandFlag{}, flags...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		return sorted
+	}
+	defined := sourceFlags(t)
+	documented := map[string][]commandFlag{"collect": collectDoc.Flags}
+	for name, doc := range commandDocs {
+		if len(doc.Flags) > 0 {
+			documented[name] = doc.Flags
+		}
+	}
+	for name := range defined {
+		if _, ok := documented[name]; !ok {
+			documented[name] = nil
+		}
+	}
+	for name, flags := range documented {
+		got, want := sorted(flags), sorted(defined[name])
+		if strings.Join(flagStrings(got), "\n") != strings.Join(flagStrings(want), "\n") {
+			t.Errorf("%s: documented flags %v, but the command defines %v", name, got, want)
+		}
+	}
+}
+
+func flagStrings(flags []commandFlag) []string {
+	lines := []string{}
+	for _, f := range flags {
+		lines = append(lines, f.Name+": "+f.Usage)
+	}
+	return lines
+}
+
+func TestGenDocs(t *testing.T) {
+	bash := &bytes.Buffer{}
+	writeBashCompletion(bash)
+	if !strings.Contains(bash.String(), `pause) flags="-list -all -author -output" ;;`) || !strings.Contains(bash.String(), `*) flags="-output -quiet -replay -record" ;;`) {
+		t.Errorf("got bash completion:\n%s", bash)
+	}
+
+	zsh := &bytes.Buffer{}
+	writeZshCompletion(zsh)
+	if !strings.Contains(zsh.String(), `'link:print a signed link to a member'\''s usage'`) || !strings.Contains(zsh.String(), `'-top-up[GB bought by the member, to add to their balance]'`) {
+		t.Errorf("got zsh completion:\n%s", zsh)
+	}
+
+	fish := &bytes.Buffer{}
+	writeFishCompletion(fish)
+	if !strings.Contains(fish.String(), `complete -c stat-collector -n '__fish_seen_subcommand_from backfill' -o dry-run -d 'only report the missing periods'`) {
+		t.Errorf("got fish completion:\n%s", fish)
+	}
+
+	man := &bytes.Buffer{}
+	writeCommandManPage(man, "prune")
+	if !strings.Contains(man.String(), ".TH STAT\\-COLLECTOR\\-PRUNE 1") || !strings.Contains(man.String(), ".B \\-dry\\-run\nlist what would be pruned") {
+		t.Errorf("got man page:\n%s", man)
+	}
+	if roff(".env example") != `\&.env example` || roff(`C:\`) != `C:\e` {
+		t.Error("expected lines escaped for roff")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fabioberger/airtable-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Results of a doctor check
+const (
+	doctorPass = "pass"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorCollection is the scratch collection the write check writes to,
+// away from the collections watched and read for usage
+const doctorCollection = "stat_collector_doctor"
+
+// doctorCheck tests one thing a dependency must do for collection to work.
+// run returns what it found, and hint suggests a fix for its error
+type doctorCheck struct {
+	dependency string
+	name       string
+	run        func() (string, error)
+	hint       func(err error) string
+}
+
+// DoctorResult is the outcome of a doctor check
+type DoctorResult struct {
+	Network    string
+	Dependency string
+	Check      string
+	Result     string
+	Detail     string
+	Hint       string `json:",omitempty"`
+}
+
+func (r DoctorResult) reportColumns() []string {
+	return []string{"NETWORK", "DEPENDENCY", "CHECK", "RESULT", "DETAIL", "HINT"}
+}
+
+func (r DoctorResult) reportValues(number func(*float64) string) []string {
+	return []string{r.Network, r.Dependency, r.Check, r.Result, r.Detail, r.Hint}
+}
+
+// runDoctorChecks runs the checks in order. Once a check of a dependency
+// fails the rest of its checks are skipped, as they would fail the same way
+func runDoctorChecks(network string, checks []doctorCheck) []DoctorResult {
+	results := []DoctorResult{}
+	failed := map[string]bool{}
+	for _, check := range checks {
+		result := DoctorResult{Network: network, Dependency: check.dependency, Check: check.name}
+		if failed[check.dependency] {
+			result.Result = doctorSkip
+			result.Detail = "an earlier check of " + check.dependency + " failed"
+			results = append(results, result)
+			continue
+		}
+
+		detail, err := check.run()
+		if err != nil {
+			failed[check.dependency] = true
+			result.Result = doctorFail
+			result.Detail = err.Error()
+			result.Hint = check.hint(err)
+		} else {
+			result.Result = doctorPass
+			result.Detail = detail
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// reachHint is the hint for a dependency which couldn't be connected to
+func reachHint(key string) string {
+	return "check " + key + " and that the collector can reach it: DNS, firewall or VPN"
+}
+
+// graylogHint suggests a fix for a failed Graylog request by its kind
+func graylogHint(err error) string {
+	graylogErr, ok := err.(GraylogError)
+	if !ok {
+		return reachHint("GRAYLOG_URL")
+	}
+	switch graylogErr.Kind {
+	case graylogErrorAuth:
+		return "check GRAYLOG_USER and GRAYLOG_PASS, and that GRAYLOG_URL is the API, like https://graylog.example.org/"
+	case graylogErrorNotFound:
+		return "check GRAYLOG_URL points at the Graylog API, like https://graylog.example.org/"
+	case graylogErrorTimeout:
+		return "Graylog is too slow to answer, check its load and QUERY_CHUNK"
+	case graylogErrorMalformed:
+		return "check GRAYLOG_CANARY_QUERY is a valid Graylog query"
+	}
+	return "check the Graylog server's logs"
+}
+
+// airtableHint suggests a fix for a failed Airtable request by its status
+func airtableHint(err error) string {
+	airtableErr, ok := err.(airtable.Error)
+	if !ok {
+		if strings.Contains(err.Error(), "AIRTABLE_") {
+			return "set the Airtable credentials, or MEMBERS_CSV to read the members from a file"
+		}
+		return reachHint("api.airtable.com")
+	}
+	switch airtableErr.StatusCode {
+	case 401:
+		return "check AIRTABLE_API_KEY, or run airtable-auth again for an OAuth grant"
+	case 403:
+		return "the token needs the scopes " + strings.Join(airtableScopes, ", ") + " and access to AIRTABLE_BASE_ID"
+	case 404:
+		return "check AIRTABLE_BASE_ID and AIRTABLE_TABLE_NAME"
+	}
+	return "check Airtable's status page"
+}
+
+// doctorChecks are the checks of the dependencies the settings collect with
+func doctorChecks(settings Settings) []doctorCheck {
+	checks := []doctorCheck{{
+		dependency: "settings",
+		name:       "collection settings set",
+		run: func() (string, error) {
+			if problems := collectionProblems(settings); len(problems) > 0 {
+				return "", fmt.Errorf("%s", strings.Join(problems, "; "))
+			}
+			return "everything collection needs is set", nil
+		},
+		hint: func(err error) string { return "set them in the environment, .env or NETWORKS_FILE" },
+	}}
+
+	if settings.MembersCSV != "" {
+		checks = append(checks, doctorCheck{
+			dependency: "members",
+			name:       "read MEMBERS_CSV",
+			run: func() (string, error) {
+				members, err := readMeshMembers(settings)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%d members", len(members)), nil
+			},
+			hint: func(err error) string { return "check MEMBERS_CSV is a readable CSV file with a header row" },
+		})
+	} else {
+		checks = append(checks, doctorCheck{
+			dependency: "airtable",
+			name:       "list 1 record",
+			run: func() (string, error) {
+				client, err := newAirtableClient(settings)
+				if err != nil {
+					return "", err
+				}
+				records := []airtableRecord{}
+				if err := client.ListRecords(settings.AirtableTableName, &records, airtable.ListParameters{MaxRecords: 1}); err != nil {
+					return "", err
+				}
+				if len(records) == 0 {
+					return "", fmt.Errorf("table %s has no records", settings.AirtableTableName)
+				}
+				return "read record " + records[0].ID, nil
+			},
+			hint: airtableHint,
+		})
+	}
+
+	if settings.StatSource == "" || settings.StatSource == statSourceGraylog {
+		checks = append(checks, doctorCheck{
+			dependency: "graylog",
+			name:       "log in",
+			run: func() (string, error) {
+				if settings.GraylogURL == "" {
+					return "", fmt.Errorf("GRAYLOG_URL is not set")
+				}
+				if _, err := getGraylog(settings, "api/system"); err != nil {
+					return "", err
+				}
+				return "logged in as " + settings.GraylogUser, nil
+			},
+			hint: graylogHint,
+		}, doctorCheck{
+			dependency: "graylog",
+			name:       "sample query",
+			run: func() (string, error) {
+				to := time.Now().UTC()
+				count, err := countGraylogMessages(settings, settings.GraylogCanaryQuery, "", to.Add(-time.Hour), to)
+				if err != nil {
+					return "", err
+				}
+				if count == 0 {
+					return "", fmt.Errorf("no messages matched %s in the last hour", settings.GraylogCanaryQuery)
+				}
+				return fmt.Sprintf("%d messages in the last hour", count), nil
+			},
+			hint: func(err error) string {
+				if _, ok := err.(GraylogError); ok {
+					return graylogHint(err)
+				}
+				return "check the exits are shipping their logs to Graylog"
+			},
+		})
+	}
+
+	if settings.MongoURL != "" {
+		checks = append(checks, doctorCheck{
+			dependency: "mongo",
+			name:       "ping",
+			run: func() (string, error) {
+				database, err := getMongoDatabase(settings)
+				if err != nil {
+					return "", err
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if err := database.Client().Ping(ctx, readpref.Primary()); err != nil {
+					return "", err
+				}
+				return "reached the primary", nil
+			},
+			hint: func(err error) string {
+				return "check MONGO_URL, and that mongod is running and the collector can reach it: DNS, firewall or VPN"
+			},
+		}, doctorCheck{
+			dependency: "mongo",
+			name:       "write and delete",
+			run: func() (string, error) {
+				database, err := getMongoDatabase(settings)
+				if err != nil {
+					return "", err
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				collection := database.Collection(doctorCollection)
+				id := fmt.Sprintf("doctor-%s-%d", hostname(), time.Now().UnixNano())
+				if _, err := collection.InsertOne(ctx, bson.M{"_id": id, "Doctor": true}); err != nil {
+					return "", err
+				}
+				if _, err := collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+					return "", fmt.Errorf("wrote but couldn't delete %s, remove it by hand: %v", id, err)
+				}
+				return "wrote and deleted a document in " + settings.MongoDatabase + "." + doctorCollection, nil
+			},
+			hint: func(err error) string {
+				return "the user of MONGO_URL needs the readWrite role on MONGO_DATABASE"
+			},
+		})
+	}
+
+	return checks
+}
+
+// doctorCommand tests each dependency collection needs and prints whether
+// each check passed, with a hint to fix those which didn't, for
+// troubleshooting a deployment in the field
+func doctorCommand(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	failed := 0
+	for _, settings := range loadAllNetworkSettings() {
+		for _, result := range runDoctorChecks(settings.Network, doctorChecks(settings)) {
+			if result.Result == doctorFail {
+				failed++
+			}
+			report.Write(result)
+		}
+	}
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+
+	if failed > 0 {
+		fatal(fmt.Sprintf("%d checks failed", failed))
+	}
+}
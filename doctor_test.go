@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fabioberger/airtable-go"
+)
+
+func TestRunDoctorChecks(t *testing.T) {
+	pass := func() (string, error) { return "fine", nil }
+	fail := func() (string, error) { return "", fmt.Errorf("refused") }
+	hint := func(err error) string { return "fix " + err.Error() }
+
+	results := runDoctorChecks("casa", []doctorCheck{
+		{"graylog", "log in", fail, hint},
+		{"graylog", "sample query", pass, hint},
+		{"mongo", "ping", pass, hint},
+	})
+
+	want := []DoctorResult{
+		{Network: "casa", Dependency: "graylog", Check: "log in", Result: doctorFail, Detail: "refused", Hint: "fix refused"},
+		{Network: "casa", Dependency: "graylog", Check: "sample query", Result: doctorSkip, Detail: "an earlier check of graylog failed"},
+		{Network: "casa", Dependency: "mongo", Check: "ping", Result: doctorPass, Detail: "fine"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %+v", results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("got %+v, want %+v", results[i], want[i])
+		}
+	}
+}
+
+func TestDoctorGraylogChecks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "collector" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"type": "ApiError", "message": "not authorized"}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/system":
+			fmt.Fprint(w, `{"version": "5.0.0"}`)
+		case "/api/search/universal/absolute":
+			fmt.Fprint(w, `{"total_results": 42}`)
+		}
+	}))
+	defer server.Close()
+
+	graylogResults := func(settings Settings) []DoctorResult {
+		checks := []doctorCheck{}
+		for _, check := range doctorChecks(settings) {
+			if check.dependency == "graylog" {
+				checks = append(checks, check)
+			}
+		}
+		return runDoctorChecks("casa", checks)
+	}
+
+	settings, _ := readSettings("casa", settingsEnv{"GRAYLOG_URL": server.URL + "/", "GRAYLOG_USER": "collector", "GRAYLOG_PASS": "secret"})
+	results := graylogResults(settings)
+	if len(results) != 2 || results[0].Result != doctorPass || results[1].Detail != "42 messages in the last hour" {
+		t.Errorf("got %+v", results)
+	}
+
+	settings.GraylogPass = "wrong"
+	results = graylogResults(settings)
+	if results[0].Result != doctorFail || results[0].Hint != graylogHint(GraylogError{Kind: graylogErrorAuth}) || results[1].Result != doctorSkip {
+		t.Errorf("got %+v with a wrong password", results)
+	}
+}
+
+func TestDoctorHints(t *testing.T) {
+	if hint := airtableHint(airtable.Error{StatusCode: 404}); hint != "check AIRTABLE_BASE_ID and AIRTABLE_TABLE_NAME" {
+		t.Errorf("got %q for a missing table", hint)
+	}
+	if hint := airtableHint(fmt.Errorf("dial tcp: lookup api.airtable.com: no such host")); hint != reachHint("api.airtable.com") {
+		t.Errorf("got %q for an unreachable Airtable", hint)
+	}
+	if hint := graylogHint(fmt.Errorf("connection refused")); hint != reachHint("GRAYLOG_URL") {
+		t.Errorf("got %q for an unreachable Graylog", hint)
+	}
+
+	// Members from a CSV file skip Airtable, and without MONGO_URL there is
+	// no Mongo to check
+	settings, _ := readSettings("casa", settingsEnv{"MEMBERS_CSV": "testdata/fixtures/members.csv", "STAT_SOURCE": statSourceLoki})
+	dependencies := []string{}
+	for _, check := range doctorChecks(settings) {
+		dependencies = append(dependencies, check.dependency)
+	}
+	if fmt.Sprint(dependencies) != "[settings members]" {
+		t.Errorf("got checks of %v", dependencies)
+	}
+}
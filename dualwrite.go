@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Moving to another Mongo cluster without stopping collection goes:
+//
+//   1. set MONGO_DUAL_WRITE_URL to the new cluster, so usage is written to both
+//   2. run copy-mongo to copy what is already stored, and again to catch up
+//   3. stop the collector, run copy-mongo -cutover, which copies what else
+//      was written and checks the clusters match, then set MONGO_CUTOVER and
+//      start it, so everything reads and writes the new cluster, usage still
+//      being written to the old one in case of going back
+//   4. unset both, and MONGO_URL to the new cluster, once it is settled
+//
+// Only usage periods are written to both. Totals, rollups, mutations, the
+// member registry, balances, annotations and pauses are written to MONGO_URL
+// alone, and neither are deletes like prune and forget, so the clusters
+// differ until copy-mongo catches the copy up, deleting what was deleted.
+// MONGO_CUTOVER is refused until copy-mongo -cutover found them the same.
+// MONGO_READ_URL, if set, is still read from after cutting over
+
+// copyMongoBatch is how many documents copy-mongo writes at once
+const copyMongoBatch = 1000
+
+// mongoCutoverCollection holds, on the cluster cut over to, the check by
+// copy-mongo -cutover that it matched the old one
+const mongoCutoverCollection = "mongo_cutover"
+
+// MongoCutoverCheck is the document copy-mongo -cutover records, by
+// database, once the clusters matched
+type MongoCutoverCheck struct {
+	Database    string `bson:"_id"`
+	Collections int
+	CheckedAt   time.Time
+}
+
+// checkedCutovers are the databases found checked for cutting over, so
+// each connection doesn't look again
+var (
+	checkedCutovers   = map[string]bool{}
+	checkedCutoversMu sync.Mutex
+)
+
+// checkCutover refuses to use a cluster cut over to before copy-mongo
+// -cutover checked it has everything the old one has
+func checkCutover(settings Settings, db *mongo.Database) error {
+	key := settings.MongoURL + "\n" + settings.MongoDatabase
+	checkedCutoversMu.Lock()
+	defer checkedCutoversMu.Unlock()
+	if checkedCutovers[key] {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var check MongoCutoverCheck
+	err := db.Collection(mongoCutoverCollection).FindOne(ctx, bson.M{"_id": settings.MongoDatabase}).Decode(&check)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("MONGO_CUTOVER is set, but the clusters weren't checked to match: unset it, stop the collector and run copy-mongo -cutover first")
+	}
+	if err != nil {
+		return err
+	}
+	checkedCutovers[key] = true
+	return nil
+}
+
+// DualWriteStore writes usage to its store, then mirrors the stored document
+// to the other cluster. The mirror failing only logs a warning, the run
+// going on, since copy-mongo copies what it missed. Nothing else is
+// mirrored
+type DualWriteStore struct {
+	store  UsageStore
+	mirror func(bwup BandwidthUsagePeriod) error
+}
+
+func (s DualWriteStore) Insert(bwup BandwidthUsagePeriod) error {
+	if err := s.store.Insert(bwup); err != nil {
+		return err
+	}
+	if err := s.mirror(bwup); err != nil {
+		log.Printf("WARNING: usage of %s from %s wasn't written to MONGO_DUAL_WRITE_URL, run copy-mongo to catch it up: %v", bwup.Name, bwup.From.Format(time.RFC3339), err)
+	}
+	return nil
+}
+
+// mirrorUsage copies the document stored for a period from one collection
+// to the other, keeping its ID so copy-mongo doesn't copy it twice
+func mirrorUsage(from *mongo.Collection, to *mongo.Collection) func(bwup BandwidthUsagePeriod) error {
+	return func(bwup BandwidthUsagePeriod) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var document bson.M
+		if err := from.FindOne(ctx, usageKey(bwup)).Decode(&document); err != nil {
+			return err
+		}
+		_, err := to.ReplaceOne(ctx, bson.M{"_id": document["_id"]}, document, options.Replace().SetUpsert(true))
+		return err
+	}
+}
+
+// dualWriteDatabase connects to the database of MONGO_DUAL_WRITE_URL
+func dualWriteDatabase(settings Settings) (*mongo.Database, error) {
+	settings.MongoURL = settings.MongoDualWriteURL
+	// After cutting over it is the old cluster, which is never checked
+	settings.MongoCutover = false
+	return getMongoDatabase(settings)
+}
+
+// MongoCopy is a line of the copy-mongo report
+type MongoCopy struct {
+	Network    string
+	Collection string
+	Copied     int64
+	Deleted    int64
+	Indexes    int
+	Source     int64
+	Target     int64
+}
+
+func (c MongoCopy) reportColumns() []string {
+	return []string{"NETWORK", "COLLECTION", "COPIED", "DELETED", "INDEXES", "SOURCE", "TARGET"}
+}
+
+func (c MongoCopy) reportValues(number func(*float64) string) []string {
+	return []string{c.Network, c.Collection, fmt.Sprint(c.Copied), fmt.Sprint(c.Deleted), fmt.Sprint(c.Indexes), fmt.Sprint(c.Source), fmt.Sprint(c.Target)}
+}
+
+// copyIndexes creates the indexes of a collection on the copy, returning
+// how many. Those already there are left as they are
+func copyIndexes(ctx context.Context, from *mongo.Collection, to *mongo.Collection) (int, error) {
+	cursor, err := from.Indexes().List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	models := []mongo.IndexModel{}
+	for cursor.Next(ctx) {
+		var index struct {
+			Name                    string `bson:"name"`
+			Key                     bson.D `bson:"key"`
+			Unique                  bool   `bson:"unique"`
+			Sparse                  bool   `bson:"sparse"`
+			ExpireAfterSeconds      *int32 `bson:"expireAfterSeconds"`
+			PartialFilterExpression bson.D `bson:"partialFilterExpression"`
+		}
+		if err := cursor.Decode(&index); err != nil {
+			return 0, err
+		}
+		if index.Name == "_id_" {
+			continue
+		}
+
+		indexOptions := options.Index().SetName(index.Name).SetUnique(index.Unique).SetSparse(index.Sparse)
+		if index.ExpireAfterSeconds != nil {
+			indexOptions.SetExpireAfterSeconds(*index.ExpireAfterSeconds)
+		}
+		if index.PartialFilterExpression != nil {
+			indexOptions.SetPartialFilterExpression(index.PartialFilterExpression)
+		}
+		models = append(models, mongo.IndexModel{Keys: index.Key, Options: indexOptions})
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(models) == 0 {
+		return 0, nil
+	}
+	_, err = to.Indexes().CreateMany(ctx, models)
+	return len(models), err
+}
+
+// copyCollection replaces the documents of the copy with those of the
+// collection by ID, so copying again only catches up
+func copyCollection(ctx context.Context, from *mongo.Collection, to *mongo.Collection) (int64, error) {
+	cursor, err := from.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var copied int64
+	batch := []mongo.WriteModel{}
+	write := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := to.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+		copied += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var document bson.Raw
+		if err := cursor.Decode(&document); err != nil {
+			return copied, err
+		}
+		id := document.Lookup("_id")
+		batch = append(batch, mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: id}}).SetReplacement(document).SetUpsert(true))
+		if len(batch) == copyMongoBatch {
+			if err := write(); err != nil {
+				return copied, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return copied, err
+	}
+	return copied, write()
+}
+
+// deleteMissing deletes the documents of the copy which the collection no
+// longer has, like those pruned or forgotten since the last copy
+func deleteMissing(ctx context.Context, from *mongo.Collection, to *mongo.Collection) (int64, error) {
+	cursor, err := to.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var deleted int64
+	ids := []interface{}{}
+	check := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		kept, err := from.Distinct(ctx, "_id", bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		found := map[string]bool{}
+		for _, id := range kept {
+			found[fmt.Sprintf("%T %v", id, id)] = true
+		}
+		missing := []interface{}{}
+		for _, id := range ids {
+			if !found[fmt.Sprintf("%T %v", id, id)] {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) > 0 {
+			result, err := to.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": missing}})
+			if err != nil {
+				return err
+			}
+			deleted += result.DeletedCount
+		}
+		ids = ids[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var document struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.Decode(&document); err != nil {
+			return deleted, err
+		}
+		ids = append(ids, document.ID)
+		if len(ids) == copyMongoBatch {
+			if err := check(); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return deleted, err
+	}
+	return deleted, check()
+}
+
+// copyMongoCommand copies the collections of MONGO_DATABASE from MONGO_URL
+// to MONGO_DUAL_WRITE_URL, with their indexes, deleting from the copy what
+// was deleted, for moving to another cluster. After cutting over it copies
+// back, from the new cluster to the old. With -cutover, run while the
+// collector is stopped, it then checks every collection matches and allows
+// MONGO_CUTOVER
+func copyMongoCommand(args []string) {
+	flags := flag.NewFlagSet("copy-mongo", flag.ExitOnError)
+	only := flags.String("collections", "", "comma separated collections to copy, all of them if empty")
+	cutover := flags.Bool("cutover", false, "check the clusters match after copying and allow MONGO_CUTOVER, with the collector stopped")
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	if *cutover && *only != "" {
+		fatal("-cutover checks every collection, so can't be used with -collections")
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Networks sharing a database are copied once
+	copied := map[string]bool{}
+	for _, settings := range loadAllNetworkSettings() {
+		if settings.MongoDualWriteURL == "" {
+			fatal(fmt.Sprintf("network %s has no MONGO_DUAL_WRITE_URL to copy to", settings.Network))
+		}
+		key := strings.Join([]string{settings.MongoURL, settings.MongoDualWriteURL, settings.MongoDatabase}, "\n")
+		if copied[key] {
+			continue
+		}
+		copied[key] = true
+
+		from, err := getMongoDatabase(settings)
+		if err != nil {
+			fatal(err)
+		}
+		to, err := dualWriteDatabase(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		ctx := context.Background()
+		collections := splitList(*only)
+		if len(collections) == 0 {
+			if collections, err = from.ListCollectionNames(ctx, bson.M{}); err != nil {
+				fatal(err)
+			}
+		}
+
+		different := []string{}
+		checked := 0
+		for _, name := range collections {
+			if strings.HasPrefix(name, "system.") || name == mongoCutoverCollection {
+				continue
+			}
+			result := MongoCopy{Network: settings.Network, Collection: name}
+			if result.Indexes, err = copyIndexes(ctx, from.Collection(name), to.Collection(name)); err != nil {
+				fatal(fmt.Errorf("copying the indexes of %s: %v", name, err))
+			}
+			if result.Copied, err = copyCollection(ctx, from.Collection(name), to.Collection(name)); err != nil {
+				fatal(fmt.Errorf("copying %s, %d documents in: %v", name, result.Copied, err))
+			}
+			if result.Deleted, err = deleteMissing(ctx, from.Collection(name), to.Collection(name)); err != nil {
+				fatal(fmt.Errorf("deleting from the copy of %s what was deleted: %v", name, err))
+			}
+			if result.Source, err = from.Collection(name).CountDocuments(ctx, bson.M{}); err != nil {
+				fatal(err)
+			}
+			if result.Target, err = to.Collection(name).CountDocuments(ctx, bson.M{}); err != nil {
+				fatal(err)
+			}
+			if result.Source != result.Target {
+				different = append(different, name)
+			}
+			checked++
+			report.Write(result)
+		}
+
+		// A copy only catching up doesn't say the clusters match, as the
+		// collector may have written since
+		cutovers := to.Collection(mongoCutoverCollection)
+		if !*cutover {
+			if _, err := cutovers.DeleteOne(ctx, bson.M{"_id": settings.MongoDatabase}); err != nil {
+				fatal(err)
+			}
+			continue
+		}
+		if len(different) > 0 {
+			fatal(fmt.Sprintf("not allowing MONGO_CUTOVER, %s %s still different, stop the collector and run copy-mongo -cutover again", joinAnd(different), isOrAre(len(different))))
+		}
+		check := MongoCutoverCheck{Database: settings.MongoDatabase, Collections: checked, CheckedAt: time.Now().UTC()}
+		if _, err := cutovers.ReplaceOne(ctx, bson.M{"_id": check.Database}, check, options.Replace().SetUpsert(true)); err != nil {
+			fatal(err)
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDualWriteStore(t *testing.T) {
+	primary := &flakyStore{failures: 1}
+	mirrored := []string{}
+	store := DualWriteStore{store: primary, mirror: func(bwup BandwidthUsagePeriod) error {
+		mirrored = append(mirrored, bwup.Name)
+		if bwup.Name == "Bob" {
+			return fmt.Errorf("new cluster is down")
+		}
+		return nil
+	}}
+
+	// A period the store refuses isn't mirrored
+	if err := store.Insert(spilledPeriod("casa", "Alice")); err == nil {
+		t.Error("the store's error should be returned")
+	}
+	// The mirror failing doesn't fail the run
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := store.Insert(spilledPeriod("casa", name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if len(primary.inserted) != 2 || fmt.Sprint(mirrored) != "[Alice Bob]" {
+		t.Errorf("got %d stored and %v mirrored", len(primary.inserted), mirrored)
+	}
+}
+
+func TestMongoCutover(t *testing.T) {
+	env := settingsEnv{"MONGO_URL": "mongodb://old:27017", "MONGO_DUAL_WRITE_URL": "mongodb://new:27017"}
+	settings, problems := readSettings("casa", env)
+	if settings.MongoURL != "mongodb://old:27017" || settings.MongoDualWriteURL != "mongodb://new:27017" || len(problems) != 0 {
+		t.Errorf("got %s and %s before cutting over, with problems %v", settings.MongoURL, settings.MongoDualWriteURL, problems)
+	}
+
+	env["MONGO_CUTOVER"] = "true"
+	settings, problems = readSettings("casa", env)
+	if settings.MongoURL != "mongodb://new:27017" || settings.MongoDualWriteURL != "mongodb://old:27017" || len(problems) != 0 {
+		t.Errorf("got %s and %s after cutting over, with problems %v", settings.MongoURL, settings.MongoDualWriteURL, problems)
+	}
+
+	if _, problems := readSettings("casa", settingsEnv{"MONGO_URL": "mongodb://old:27017", "MONGO_CUTOVER": "true"}); len(problems) != 1 {
+		t.Errorf("cutting over to nothing should be a problem, got %v", problems)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// dumpFormat identifies the archives written by dump
+const dumpFormat = "stat-collector-dump/1"
+
+// restoreBatchSize is how many documents restore inserts at once
+const restoreBatchSize = 1000
+
+// DumpHeader is the first line of a dump archive
+type DumpHeader struct {
+	Format      string
+	Database    string
+	Collections []string
+	DumpedAt    time.Time
+	Host        string
+}
+
+// DumpLine is a document of a dump archive, in canonical extended JSON so
+// dates and object IDs survive the round trip
+type DumpLine struct {
+	Collection string
+	Document   json.RawMessage
+}
+
+// dumpCollections are the collections the collector writes to, without
+// duplicates in case several settings share a collection
+func dumpCollections(settings Settings) []string {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, name := range []string{
+		settings.MongoCollection,
+		settings.MongoMembersCollection,
+		settings.MongoMemberChangesCollection,
+		settings.MongoExitUsageCollection,
+		settings.MongoAuditCollection,
+		settings.MongoAliasCollection,
+		settings.MongoAnnotationsCollection,
+		settings.MongoMutationsCollection,
+		settings.MongoCorrectionsCollection,
+		settings.MongoWatchCollection,
+		settings.MongoMetricsCollection,
+		settings.MongoMemberMetricsCollection,
+		settings.MongoPausesCollection,
+		settings.MongoBalancesCollection,
+		settings.MongoPublicStatsCollection,
+		settings.MongoRollupCollection,
+		settings.MongoTotalsCollection,
+		settings.SNMPCollection,
+		settings.NetflowCollection,
+		settings.NetflowHistogramCollection,
+		settings.IngestSamplesCollection,
+		settings.IngestWatermarksCollection,
+		settings.MongoSchedulerCollection,
+	} {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func dumpCollection(encoder *json.Encoder, collection *mongo.Collection) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		document, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return count, err
+		}
+		if err := encoder.Encode(DumpLine{Collection: collection.Name(), Document: document}); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, cursor.Err()
+}
+
+// dumpCommand writes every collection the collector uses to a gzipped JSONL
+// archive, one document per line after a header line
+func dumpCommand(args []string) {
+	settings := loadProcessSettings()
+
+	if len(args) == 0 {
+		fatal("usage: stat-collector dump <archive.jsonl.gz>")
+	}
+
+	db, err := getReadDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	encoder := json.NewEncoder(gz)
+
+	collections := dumpCollections(settings)
+	err = encoder.Encode(DumpHeader{
+		Format:      dumpFormat,
+		Database:    settings.MongoDatabase,
+		Collections: collections,
+		DumpedAt:    time.Now(),
+		Host:        hostname(),
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, name := range collections {
+		count, err := dumpCollection(encoder, db.Collection(name))
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("Dumped %d documents from %s", count, name)
+	}
+
+	if err := gz.Close(); err != nil {
+		fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		fatal(err)
+	}
+}
+
+// insertIgnoringDuplicates inserts documents, skipping those whose _id is
+// already there so a restore can be resumed or rerun
+func insertIgnoringDuplicates(collection *mongo.Collection, documents []interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	result, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if e, ok := err.(mongo.BulkWriteException); ok && e.WriteConcernError == nil {
+		for _, writeError := range e.WriteErrors {
+			if writeError.Code != mongoDuplicateKey {
+				return 0, err
+			}
+		}
+		return len(documents) - len(e.WriteErrors), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(result.InsertedIDs), nil
+}
+
+// openDumpArchive opens an archive written by dump and reads its header,
+// leaving the decoder at its first document
+func openDumpArchive(path string) (*os.File, *json.Decoder, DumpHeader, error) {
+	var header DumpHeader
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, header, err
+	}
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, header, err
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(gz))
+	if err := decoder.Decode(&header); err != nil {
+		file.Close()
+		return nil, nil, header, err
+	}
+	if header.Format != dumpFormat {
+		file.Close()
+		return nil, nil, header, fmt.Errorf("%s is not a dump archive, or of an unsupported format %q", path, header.Format)
+	}
+
+	return file, decoder, header, nil
+}
+
+// restoreCommand loads an archive written by dump back into the configured
+// database. Documents which already exist are left alone
+func restoreCommand(args []string) {
+	settings := loadProcessSettings()
+
+	if len(args) == 0 {
+		fatal("usage: stat-collector restore <archive.jsonl.gz>")
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	file, decoder, header, err := openDumpArchive(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	defer file.Close()
+	log.Printf("Restoring %s dumped from %s on %s", header.Database, header.Host, header.DumpedAt.Format(time.RFC3339))
+
+	batches := map[string][]interface{}{}
+	restored := map[string]int{}
+
+	flush := func(name string) {
+		count, err := insertIgnoringDuplicates(db.Collection(name), batches[name])
+		if err != nil {
+			fatal(err)
+		}
+		restored[name] += count
+
+		documents := []bson.Raw{}
+		for _, document := range batches[name] {
+			raw, err := bson.Marshal(document)
+			if err != nil {
+				fatal(err)
+			}
+			documents = append(documents, raw)
+		}
+		err = recordMutation(context.Background(), db.Collection(settings.MongoMutationsCollection), Mutation{
+			Kind:       mutationRestore,
+			Collection: name,
+			Network:    settings.Network,
+			Filter:     filterJSON(bson.M{"archive": args[0]}),
+			Documents:  count,
+			After:      hashDocuments(documents),
+		})
+		if err != nil {
+			fatal(err)
+		}
+		batches[name] = nil
+	}
+
+	for decoder.More() {
+		var line DumpLine
+		if err := decoder.Decode(&line); err != nil {
+			fatal(err)
+		}
+
+		var document bson.D
+		if err := bson.UnmarshalExtJSON(line.Document, true, &document); err != nil {
+			fatal(err)
+		}
+
+		batches[line.Collection] = append(batches[line.Collection], document)
+		if len(batches[line.Collection]) >= restoreBatchSize {
+			flush(line.Collection)
+		}
+	}
+
+	for name, batch := range batches {
+		if len(batch) > 0 {
+			flush(name)
+		}
+	}
+
+	for _, name := range header.Collections {
+		log.Printf("Restored %d documents into %s", restored[name], name)
+	}
+}
@@ -0,0 +1,169 @@
+//go:build e2e
+// +build e2e
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The end-to-end tests run the whole collection loop against a real Mongo
+// and the Graylog fixtures. They are built with the e2e tag, run them with
+// make e2e. Mongo is started in Docker, unless E2E_MONGO_URL points at one
+
+// e2eMongoImage is the Mongo the tests start when E2E_MONGO_URL isn't set
+const e2eMongoImage = "mongo:4.4"
+
+// startMongo returns the URL of a Mongo to test against, and a function
+// removing it once the tests are done
+func startMongo(t *testing.T) (string, func()) {
+	t.Helper()
+
+	if url := os.Getenv("E2E_MONGO_URL"); url != "" {
+		return url, func() {}
+	}
+
+	docker := func(args ...string) string {
+		var stderr bytes.Buffer
+		cmd := exec.Command("docker", args...)
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("docker %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	container := docker("run", "--detach", "--rm", "--publish", "127.0.0.1::27017", e2eMongoImage)
+	stop := func() { exec.Command("docker", "rm", "--force", container).Run() }
+
+	// docker port prints the address Mongo was published on, like
+	// 127.0.0.1:32768
+	address := strings.Split(docker("port", container, "27017/tcp"), "\n")[0]
+	url := "mongodb://" + address
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+		if err == nil {
+			err = client.Ping(ctx, nil)
+			client.Disconnect(ctx)
+		}
+		cancel()
+
+		if err == nil {
+			return url, stop
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("mongo didn't start: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// e2eSettings are the settings of a run collecting a day of the fixture
+// members' usage into a database of its own
+func e2eSettings(mongoURL string, graylogURL string) Settings {
+	settings, _ := readSettings("casa", settingsEnv{
+		"MONGO_URL":        mongoURL,
+		"MONGO_DATABASE":   fmt.Sprintf("stat_collector_e2e_%d", time.Now().UnixNano()),
+		"MONGO_COLLECTION": "usage",
+		"MEMBERS_CSV":      "testdata/fixtures/members.csv",
+		"GRAYLOG_URL":      graylogURL + "/",
+		"USAGE_STORES":     usageStoreMongo,
+	})
+	settings.To = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	settings.Duration = 24 * time.Hour
+	settings.From = settings.To.Add(-settings.Duration)
+	return settings
+}
+
+func TestE2ECollect(t *testing.T) {
+	mongoURL, stop := startMongo(t)
+	defer stop()
+
+	graylog := newGraylogFixtureServer(t)
+	defer graylog.Close()
+
+	settings := e2eSettings(mongoURL, graylog.URL)
+	collection, err := getBWUPCollection(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collection.Database().Drop(context.Background())
+
+	report, err := newReportWriter(&bytes.Buffer{}, outputJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run over the same window finds the usage saved already
+	for run := 0; run < 2; run++ {
+		if collected := collectNetwork(settings, report); len(collected) != 3 {
+			t.Fatalf("run %d: collected %d periods, want one per member", run+1, len(collected))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"network": "casa"}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := []BandwidthUsagePeriod{}
+	if err := cursor.All(ctx, &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved) != 3 {
+		t.Fatalf("saved %d periods, want one per member", len(saved))
+	}
+	statuses := map[string]string{}
+	for _, bwup := range saved {
+		statuses[bwup.Name] = bwup.Status
+		if !bwup.From.Equal(settings.From) || !bwup.To.Equal(settings.To) {
+			t.Errorf("%s: saved %v to %v, want the run's window", bwup.Name, bwup.From, bwup.To)
+		}
+	}
+	want := map[string]string{"Alice Example": usageStatusOK, "Bob Example": usageStatusNoData, "Carol Example": usageStatusFailed}
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Errorf("%s: got status %q, want %q", name, statuses[name], status)
+		}
+	}
+	if alice := saved[0]; alice.Up == nil || *alice.Up != 1.5 || alice.Down == nil || *alice.Down != 12.25 {
+		t.Errorf("Alice Example: got %v up and %v down, want 1.5 and 12.25", alice.Up, alice.Down)
+	}
+
+	// The registry is recorded on the first run
+	changes, err := collection.Database().Collection(settings.MongoMemberChangesCollection).CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes != 3 {
+		t.Errorf("recorded %d member changes, want the 3 members added", changes)
+	}
+
+	// Each run saves its metrics
+	runs, err := collection.Database().Collection(settings.MongoMetricsCollection).CountDocuments(ctx, bson.M{"network": "casa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Errorf("saved the metrics of %d runs, want 2", runs)
+	}
+}
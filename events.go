@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event buses, selected with EVENT_BUS
+const (
+	eventBusNATS  = "nats"
+	eventBusKafka = "kafka"
+)
+
+// Kinds of alerts
+const (
+	alertUsageWarning      = "usage-warning"
+	alertPreflight         = "preflight-failed"
+	alertAuditFlagged      = "audit-flagged"
+	alertCommitmentOverage = "commitment-overage"
+	alertUsageAnomaly      = "usage-anomaly"
+	alertHookFailed        = "hook-failed"
+	alertBalanceLow        = "balance-low"
+)
+
+// Alert is something operators should look at, published to
+// EVENT_ALERTS_TOPIC for other services to act on
+type Alert struct {
+	Network  string
+	Kind     string
+	Message  string
+	MemberID string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	At       time.Time
+}
+
+// EventPublisher publishes events to a topic of an event bus
+type EventPublisher interface {
+	Publish(topic string, key string, event interface{}) error
+}
+
+// newEventPublisher connects to the EVENT_BUS, or returns nil if there is none
+func newEventPublisher(settings Settings) (EventPublisher, error) {
+	switch settings.EventBus {
+	case "":
+		return nil, nil
+	case eventBusNATS:
+		return newNATSPublisher(settings.EventBusURL)
+	case eventBusKafka:
+		return newKafkaRESTPublisher(settings.EventBusURL)
+	}
+	return nil, fmt.Errorf("invalid EVENT_BUS %q, expected %s or %s", settings.EventBus, eventBusNATS, eventBusKafka)
+}
+
+// NATSPublisher publishes to NATS subjects over its text protocol. The
+// connection is opened on the first publish and reopened after an error
+type NATSPublisher struct {
+	address string
+	user    *url.Userinfo
+	mutex   sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func newNATSPublisher(address string) (*NATSPublisher, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("EVENT_BUS_URL must be like nats://host:4222: %v", err)
+	}
+	return &NATSPublisher{address: u.Host, user: u.User}, nil
+}
+
+// readOp reads a line of the protocol, skipping the server's pings
+func (p *NATSPublisher) readOp() (string, error) {
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+
+		if line == "PING" {
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			return "", fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		return line, nil
+	}
+}
+
+func (p *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.reader = bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if info, err := p.readOp(); err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("nats: expected INFO from the server, got %q: %v", info, err)
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "stat-collector", "lang": "go"}
+	if p.user != nil {
+		options["user"] = p.user.Username()
+		if pass, ok := p.user.Password(); ok {
+			options["pass"] = pass
+		} else {
+			options["auth_token"] = p.user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Publish sends the event and waits for the answer to a PING, so errors
+// from the server, like a refused subject, are reported
+func (p *NATSPublisher) Publish(topic string, key string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	p.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	message := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", topic, len(payload), payload)
+	_, err = p.conn.Write([]byte(message))
+	if err == nil {
+		var op string
+		if op, err = p.readOp(); err == nil && op != "PONG" {
+			err = fmt.Errorf("nats: expected PONG, got %q", op)
+		}
+	}
+
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// KafkaRESTPublisher publishes to Kafka topics through a REST proxy, which
+// saves carrying a client for the Kafka protocol
+type KafkaRESTPublisher struct {
+	url    string
+	client http.Client
+}
+
+func newKafkaRESTPublisher(address string) (*KafkaRESTPublisher, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("EVENT_BUS_URL must be the URL of a Kafka REST proxy: %v", err)
+	}
+	return &KafkaRESTPublisher{url: strings.TrimSuffix(address, "/"), client: http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (p *KafkaRESTPublisher) Publish(topic string, key string, event interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": key, "value": event}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyText, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("kafka REST proxy returned %s: %s", resp.Status, bytes.TrimSpace(bodyText))
+	}
+	return nil
+}
+
+// EventStore publishes usage periods to EVENT_USAGE_TOPIC. Listed last in
+// USAGE_STORES, it only sees the periods the other stores took
+type EventStore struct {
+	bus   EventPublisher
+	topic string
+}
+
+func newEventStore(settings Settings) (EventStore, error) {
+	bus, err := newEventPublisher(settings)
+	if err != nil {
+		return EventStore{}, err
+	}
+	if bus == nil {
+		return EventStore{}, fmt.Errorf("the events usage store needs EVENT_BUS")
+	}
+	return EventStore{bus: bus, topic: settings.EventUsageTopic}, nil
+}
+
+func (s EventStore) Insert(bwup BandwidthUsagePeriod) error {
+	key := bwup.MemberID
+	if key == "" {
+		key = bwup.Name
+	}
+	return s.bus.Publish(s.topic, bwup.Network+"/"+key, bwup)
+}
+
+// publishAlert sends an alert to the event bus, if there is one. A bus
+// which is down only costs the alert, so failures are logged
+func publishAlert(settings Settings, alert Alert) {
+	bus, err := newEventPublisher(settings)
+	if err == nil && bus == nil {
+		return
+	}
+
+	alert.Network = settings.Network
+	alert.At = time.Now()
+	if err == nil {
+		err = bus.Publish(settings.EventAlertsTopic, settings.Network+"/"+alert.Kind, alert)
+	}
+	if err != nil {
+		log.Printf("Error publishing %s alert: %v", alert.Kind, err)
+	}
+}
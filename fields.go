@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// memberFieldKeys are the settings naming each member field in a base with
+// its own column names, like FIELD_WGKEY="Wireguard Public Key", and the
+// Airtable field, or members CSV column, read if they are unset
+var memberFieldKeys = []struct {
+	key   string
+	field string
+}{
+	{"FIELD_NAME", "Name"},
+	{"FIELD_WGKEY", "WG Key"},
+	{"FIELD_MESHIP", "Mesh IP"},
+	{"FIELD_UPSTREAM", "Upstream"},
+	{"FIELD_CRMID", "CRM ID"},
+	{"FIELD_PHONE", "Phone"},
+	{"FIELD_SMSOPTIN", "SMS Opt In"},
+	{"FIELD_LANGUAGE", "Language"},
+	{"FIELD_PLANMBPS", "Plan Mbps"},
+	{"FIELD_TAGS", "Tags"},
+	{"FIELD_SITE", "Site"},
+	{"FIELD_LATITUDE", "Latitude"},
+	{"FIELD_LONGITUDE", "Longitude"},
+	{"FIELD_ROUTERMAC", "Router MAC"},
+	{"FIELD_STATICIP", "Static IP"},
+	{"FIELD_HOSTNAME", "Hostname"},
+	{"FIELD_OVERRIDES", "Overrides"},
+	{"FIELD_PREPAIDGB", "Prepaid GB"},
+	{"FIELD_TRACKINGOPTOUT", "Tracking Opt Out"},
+}
+
+// readMemberFields reads the FIELD_ settings into the column of the base
+// holding each field which it names differently
+func readMemberFields(env settingsEnv) map[string]string {
+	fields := map[string]string{}
+	for _, field := range memberFieldKeys {
+		if column := strings.TrimSpace(env.get(field.key)); column != "" && column != field.field {
+			fields[field.field] = column
+		}
+	}
+	return fields
+}
+
+// memberColumn is the column of the base holding a member field
+func memberColumn(fields map[string]string, field string) string {
+	if column, ok := fields[field]; ok {
+		return column
+	}
+	return field
+}
+
+// airtableRecord is a record of the members table as the base names its
+// fields
+type airtableRecord struct {
+	ID     string
+	Fields map[string]json.RawMessage
+}
+
+// decodeMembers reads the members from the records of their table, after
+// renaming the fields the base names differently. A column which has the
+// name of a field read from another column is left out, so it can't take
+// its place
+func decodeMembers(records []airtableRecord, fields map[string]string) ([]MeshMember, error) {
+	renamed := make([]airtableRecord, len(records))
+	for i, record := range records {
+		renamed[i] = airtableRecord{ID: record.ID, Fields: map[string]json.RawMessage{}}
+		for name, value := range record.Fields {
+			if _, ok := fields[name]; !ok {
+				renamed[i].Fields[name] = value
+			}
+		}
+		for field, column := range fields {
+			if value, ok := record.Fields[column]; ok {
+				renamed[i].Fields[field] = value
+			}
+		}
+	}
+
+	encoded, err := json.Marshal(renamed)
+	if err != nil {
+		return nil, err
+	}
+	members := []MeshMember{}
+	err = json.Unmarshal(encoded, &members)
+	return members, err
+}
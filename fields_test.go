@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestReadMemberFields(t *testing.T) {
+	fields := readMemberFields(settingsEnv{
+		"FIELD_WGKEY":    " Wireguard Public Key ",
+		"FIELD_NAME":     "Name",
+		"FIELD_PLANMBPS": "",
+		"FIELD_SITE":     "Tower",
+	})
+	if len(fields) != 2 || fields["WG Key"] != "Wireguard Public Key" || fields["Site"] != "Tower" {
+		t.Errorf("got %v", fields)
+	}
+	if column := memberColumn(fields, "Name"); column != "Name" {
+		t.Errorf("got column %q for Name", column)
+	}
+	if column := memberColumn(fields, "WG Key"); column != "Wireguard Public Key" {
+		t.Errorf("got column %q for WG Key", column)
+	}
+}
+
+func TestDecodeMembers(t *testing.T) {
+	records := []airtableRecord{{
+		ID: "rec1",
+		Fields: map[string]json.RawMessage{
+			"Name":                 json.RawMessage(`"Alice"`),
+			"Wireguard Public Key": json.RawMessage(`"key1"`),
+			"WG Key":               json.RawMessage(`"stale"`),
+			"Speed":                json.RawMessage(`25`),
+		},
+	}, {
+		ID: "rec2",
+		Fields: map[string]json.RawMessage{
+			"Name":   json.RawMessage(`"Bob"`),
+			"WG Key": json.RawMessage(`"stale"`),
+		},
+	}}
+
+	members, err := decodeMembers(records, map[string]string{"WG Key": "Wireguard Public Key", "Plan Mbps": "Speed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].ID != "rec1" || members[0].Fields.Name != "Alice" || members[0].Fields.WGKey != "key1" || members[0].Fields.PlanMbps != 25 {
+		t.Errorf("got %+v", members)
+	}
+	// Bob's key would be in the renamed column, which he doesn't have
+	if members[1].Fields.WGKey != "" {
+		t.Errorf("got key %q from the column with the field's name", members[1].Fields.WGKey)
+	}
+
+	unmapped, err := decodeMembers(records, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unmapped[0].Fields.WGKey != "stale" {
+		t.Errorf("got %+v, want the field's own column read", unmapped[0])
+	}
+
+	bad := []airtableRecord{{ID: "rec3", Fields: map[string]json.RawMessage{"Speed": json.RawMessage(`"fast"`)}}}
+	if _, err := decodeMembers(bad, map[string]string{"Plan Mbps": "Speed"}); err == nil {
+		t.Error("should have failed")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Golden files hold the expected output of the report formats, so changes to
+// them show up as diffs. Run go test -update to rewrite them
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// checkGolden compares output against testdata/golden/name
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run go test -update if the change is intended\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// loadFixture decodes testdata/fixtures/name into value
+func loadFixture(t *testing.T, name string, value interface{}) {
+	t.Helper()
+
+	contents, err := ioutil.ReadFile(filepath.Join("testdata", "fixtures", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(contents, value); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+// fixtureMembers returns the synthetic members of the fixtures
+func fixtureMembers(t *testing.T) []MeshMember {
+	t.Helper()
+
+	members := []MeshMember{}
+	loadFixture(t, "members.json", &members)
+	return members
+}
+
+// graylogFixture is a canned answer to a Graylog stats query
+type graylogFixture struct {
+	Query  string
+	Status int
+	Body   string
+}
+
+// newGraylogFixtureServer answers Graylog stats queries with the responses
+// in testdata/fixtures/graylog.json, and queries without one as not found
+func newGraylogFixtureServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	fixtures := []graylogFixture{}
+	loadFixture(t, "graylog.json", &fixtures)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		for _, fixture := range fixtures {
+			if fixture.Query == query {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(fixture.Status)
+				w.Write([]byte(fixture.Body))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"type": "ApiError", "message": "no fixture for this query"}`))
+	}))
+}
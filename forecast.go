@@ -0,0 +1,272 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Forecasting methods, chosen with -method or the method param
+const (
+	forecastLinear   = "linear"
+	forecastSeasonal = "seasonal"
+)
+
+// forecastSeason is the length of the cycle the seasonal method repeats,
+// as usage follows the week
+const forecastSeason = 7
+
+// meshForecastName names the forecast of the whole mesh
+const meshForecastName = "all members"
+
+// Forecast is the usage expected of a member, or of the whole mesh when
+// MemberID and Name are empty, on each of the days after From
+type Forecast struct {
+	Network  string
+	MemberID string `json:",omitempty"`
+	Name     string
+	Method   string
+	From     time.Time
+	To       time.Time
+	Days     []DayUsage
+	Total    float64
+}
+
+// dailySeries lays out the usage of days over the count days from from,
+// days without usage counting zero
+func dailySeries(days []DayUsage, from time.Time, count int) []float64 {
+	series := make([]float64, count)
+	for _, day := range days {
+		t, err := time.Parse("2006-01-02", day.Day)
+		if err != nil {
+			continue
+		}
+		if i := int(t.Sub(from) / (24 * time.Hour)); i >= 0 && i < count {
+			series[i] += day.Total
+		}
+	}
+	return series
+}
+
+// forecastSeries extends a daily series by horizon days. The linear method
+// fits a least squares line, the seasonal one repeats the last week
+func forecastSeries(series []float64, horizon int, method string) ([]float64, error) {
+	forecast := make([]float64, horizon)
+	n := len(series)
+
+	switch method {
+	case forecastLinear:
+		if n == 0 {
+			return forecast, nil
+		}
+
+		var sumX, sumY, sumXY, sumXX float64
+		for x, y := range series {
+			sumX += float64(x)
+			sumY += y
+			sumXY += float64(x) * y
+			sumXX += float64(x) * float64(x)
+		}
+		slope := 0.0
+		if denominator := float64(n)*sumXX - sumX*sumX; denominator != 0 {
+			slope = (float64(n)*sumXY - sumX*sumY) / denominator
+		}
+		intercept := (sumY - slope*sumX) / float64(n)
+
+		for i := range forecast {
+			// Usage can't go below nothing however steep the decline
+			if y := intercept + slope*float64(n+i); y > 0 {
+				forecast[i] = y
+			}
+		}
+		return forecast, nil
+
+	case forecastSeasonal:
+		if n < forecastSeason {
+			return nil, fmt.Errorf("the seasonal forecast needs at least %d days of history", forecastSeason)
+		}
+		for i := range forecast {
+			forecast[i] = series[n-forecastSeason+i%forecastSeason]
+		}
+		return forecast, nil
+	}
+
+	return nil, fmt.Errorf("invalid forecast method %q, expected linear or seasonal", method)
+}
+
+// forecastUsage forecasts the usage of each member and of the whole mesh
+// over the horizon days after to, from their daily usage in the history
+// days before it. The mesh's forecast comes first
+func forecastUsage(network string, periods []BandwidthUsagePeriod, to time.Time, history int, horizon int, method string) ([]Forecast, error) {
+	to = to.UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -history)
+	end := to.AddDate(0, 0, horizon)
+
+	summary := summarizeDashboard(network, periods, from, to)
+
+	newForecast := func(memberID string, name string, series []float64) (Forecast, error) {
+		values, err := forecastSeries(series, horizon, method)
+		if err != nil {
+			return Forecast{}, err
+		}
+
+		forecast := Forecast{Network: network, MemberID: memberID, Name: name, Method: method, From: to, To: end, Days: []DayUsage{}}
+		for i, value := range values {
+			forecast.Days = append(forecast.Days, DayUsage{Day: to.AddDate(0, 0, i).Format("2006-01-02"), Total: value})
+			forecast.Total += value
+		}
+		return forecast, nil
+	}
+
+	mesh := make([]float64, history)
+	forecasts := []Forecast{}
+	for _, member := range summary.Members {
+		series := dailySeries(member.Days, from, history)
+		for i, value := range series {
+			mesh[i] += value
+		}
+
+		forecast, err := newForecast(member.MemberID, member.Name, series)
+		if err != nil {
+			return nil, err
+		}
+		forecasts = append(forecasts, forecast)
+	}
+
+	forecast, err := newForecast("", meshForecastName, mesh)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Forecast{forecast}, forecasts...), nil
+}
+
+func (f Forecast) reportColumns() []string {
+	return []string{"NETWORK", "MEMBER", "METHOD", "FROM", "TO", "FORECAST (GB)"}
+}
+
+func (f Forecast) reportValues(number func(*float64) string) []string {
+	return []string{
+		f.Network,
+		f.Name,
+		f.Method,
+		f.From.Format("2006-01-02"),
+		f.To.Format("2006-01-02"),
+		number(&f.Total),
+	}
+}
+
+// forecastCommand forecasts the usage of every member and mesh over the
+// coming days, from their usage over the days before
+func forecastCommand(args []string) {
+	flags := flag.NewFlagSet("forecast", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	method := flags.String("method", forecastLinear, "forecasting method: linear or seasonal")
+	history := flags.Int("history", 56, "days of history to forecast from")
+	horizon := flags.Int("days", 30, "days to forecast")
+	flags.Parse(args)
+
+	if *history <= 0 || *horizon <= 0 {
+		fatal("-history and -days must be positive")
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	now := time.Now()
+	for _, settings := range loadAllNetworkSettings() {
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, "", "", now.AddDate(0, 0, -*history-1), now)
+		if err != nil {
+			fatal(err)
+		}
+
+		forecasts, err := forecastUsage(settings.Network, periods, now, *history, *horizon, *method)
+		if err != nil {
+			fatal(err)
+		}
+		for _, forecast := range forecasts {
+			if err := report.Write(forecast); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// handleForecast returns the forecasts of a network. Members only get their
+// own, viewers every member's and the mesh's, or one member's with member
+func (s *Server) handleForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "forecasts require GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), roleMember)
+	if !ok {
+		return
+	}
+
+	memberID := query.Get("member")
+	if !token.Allows(roleViewer) {
+		memberID = token.MemberID
+	}
+
+	method := query.Get("method")
+	if method == "" {
+		method = forecastLinear
+	}
+
+	days := map[string]int{"history": 56, "days": 30}
+	for param := range days {
+		if query.Get(param) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(param))
+		if err != nil || n <= 0 || n > 366 {
+			writeJSONError(w, http.StatusBadRequest, param+" must be a number of days up to 366")
+			return
+		}
+		days[param] = n
+	}
+
+	now := time.Now()
+	periods, err := getUsagePeriods(tenant.reads, tenant.settings.Network, "", "", now.AddDate(0, 0, -days["history"]-1), now)
+	if err != nil {
+		log.Printf("Error reading usage: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "error reading usage")
+		return
+	}
+
+	forecasts, err := forecastUsage(tenant.settings.Network, periods, now, days["history"], days["days"], method)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if memberID != "" {
+		found := []Forecast{}
+		for _, forecast := range forecasts {
+			if forecast.MemberID == memberID {
+				found = append(found, forecast)
+			}
+		}
+		forecasts = found
+	}
+
+	writeJSON(w, forecasts)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestForecastSeries(t *testing.T) {
+	week := []float64{1, 2, 3, 4, 5, 6, 7}
+
+	tests := []struct {
+		name     string
+		series   []float64
+		horizon  int
+		method   string
+		forecast []float64
+		valid    bool
+	}{
+		{"linear trend", []float64{1, 2, 3, 4}, 3, forecastLinear, []float64{5, 6, 7}, true},
+		{"flat", []float64{2, 2, 2}, 2, forecastLinear, []float64{2, 2}, true},
+		{"single day", []float64{4}, 2, forecastLinear, []float64{4, 4}, true},
+		{"decline stops at zero", []float64{6, 4, 2}, 3, forecastLinear, []float64{0, 0, 0}, true},
+		{"no history", []float64{}, 2, forecastLinear, []float64{0, 0}, true},
+		{"seasonal", append([]float64{9, 9}, week...), 9, forecastSeasonal, []float64{1, 2, 3, 4, 5, 6, 7, 1, 2}, true},
+		{"seasonal without a week", []float64{1, 2, 3}, 2, forecastSeasonal, nil, false},
+		{"unknown method", week, 2, "arima", nil, false},
+	}
+
+	for _, test := range tests {
+		forecast, err := forecastSeries(test.series, test.horizon, test.method)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(forecast, test.forecast) {
+			t.Errorf("%s: got %v, want %v", test.name, forecast, test.forecast)
+		}
+	}
+}
+
+func TestForecastUsage(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	day := func(daysAgo int, memberID string, name string, gb float64) BandwidthUsagePeriod {
+		period := usage(gb, 0)
+		period.MemberID = memberID
+		period.Name = name
+		period.From = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -daysAgo)
+		period.To = period.From.Add(24 * time.Hour)
+		return period
+	}
+
+	periods := []BandwidthUsagePeriod{
+		day(3, "rec1", "Alice", 1),
+		day(2, "rec1", "Alice", 2),
+		day(1, "rec1", "Alice", 3),
+		day(3, "", "Bob", 2),
+		day(2, "", "Bob", 2),
+		day(1, "", "Bob", 2),
+		// Today isn't over, so isn't history yet
+		day(0, "rec1", "Alice", 100),
+	}
+
+	forecasts, err := forecastUsage("casa", periods, now, 3, 2, forecastLinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forecasts) != 3 {
+		t.Fatalf("got forecasts %+v", forecasts)
+	}
+
+	mesh, alice, bob := forecasts[0], forecasts[1], forecasts[2]
+	if mesh.Name != meshForecastName || mesh.MemberID != "" || !mesh.From.Equal(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got mesh forecast %+v", mesh)
+	}
+	if alice.MemberID != "rec1" || alice.Total != 9 || alice.Days[0] != (DayUsage{"2026-10-16", 4}) || alice.Days[1] != (DayUsage{"2026-10-17", 5}) {
+		t.Errorf("got Alice's forecast %+v", alice)
+	}
+	if mesh.Days[0].Total != 6 || mesh.Days[1].Total != 7 {
+		t.Errorf("got mesh forecast %+v", mesh.Days)
+	}
+	if bob.Name != "Bob" || bob.Total != 4 {
+		t.Errorf("got Bob's forecast %+v", bob)
+	}
+}
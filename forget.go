@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Actions forget takes on a collection
+const (
+	forgetDelete    = "deleted"
+	forgetAnonymize = "anonymized"
+)
+
+// ForgetResult is a line of the forget report, what was done to the
+// member's documents in a collection
+type ForgetResult struct {
+	Network    string
+	Collection string
+	// Mirror is set for the collections of MONGO_DUAL_WRITE_URL
+	Mirror    bool `json:",omitempty"`
+	Action    string
+	Documents int64
+}
+
+func (r ForgetResult) reportColumns() []string {
+	return []string{"NETWORK", "COLLECTION", "ACTION", "DOCUMENTS"}
+}
+
+func (r ForgetResult) reportValues(number func(*float64) string) []string {
+	collection := r.Collection
+	if r.Mirror {
+		collection += " (mirror)"
+	}
+	return []string{r.Network, collection, r.Action, fmt.Sprint(r.Documents)}
+}
+
+// forgottenMember is what a member's documents can be found by: their
+// record ID, the names and WireGuard keys they were stored under and the
+// mesh addresses their flows were counted under
+type forgottenMember struct {
+	ID        string
+	Names     []string
+	Keys      []string
+	Addresses []string
+}
+
+// forgetTarget is the member's documents in a collection, and the update
+// anonymizing them, nil for deleting them
+type forgetTarget struct {
+	collection string
+	filter     bson.M
+	anonymize  bson.M
+}
+
+// sortedKeys are the keys of a set, sorted
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// findForgottenMember finds the names and keys a member was stored under,
+// from the member cache, their changes and their usage, for the documents
+// stored without a member ID. Usage pushed for a key before it was
+// registered is stored under the key, so keys are names too
+func findForgottenMember(ctx context.Context, db *mongo.Database, settings Settings, memberID string, addresses []string) (forgottenMember, error) {
+	member := forgottenMember{ID: memberID, Addresses: addresses}
+	seen := map[string]bool{}
+	keys := map[string]bool{}
+	add := func(name string) {
+		if name != "" {
+			seen[name] = true
+		}
+	}
+	addKey := func(key string) {
+		if key != "" {
+			keys[key] = true
+			seen[key] = true
+		}
+	}
+
+	var cached CachedMember
+	err := db.Collection(settings.MongoMembersCollection).FindOne(ctx, bson.M{"_id": memberID}).Decode(&cached)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return member, err
+	}
+	add(cached.Name)
+	addKey(cached.WGKey)
+
+	changes := []MemberChange{}
+	cursor, err := db.Collection(settings.MongoMemberChangesCollection).Find(ctx, bson.M{"network": networkMatch(settings.Network), "memberid": memberID})
+	if err != nil {
+		return member, err
+	}
+	if err := cursor.All(ctx, &changes); err != nil {
+		return member, err
+	}
+	for _, change := range changes {
+		add(change.Name)
+		add(change.PreviousName)
+		addKey(change.WGKey)
+		addKey(change.PreviousWGKey)
+	}
+
+	stored, err := db.Collection(settings.MongoCollection).Distinct(ctx, "name", bson.M{"network": networkMatch(settings.Network), "memberid": memberID})
+	if err != nil {
+		return member, err
+	}
+	for _, value := range stored {
+		if name, ok := value.(string); ok {
+			name, err := decryptName(settings.Network, name)
+			if err != nil {
+				return member, err
+			}
+			add(name)
+		}
+	}
+
+	member.Names = sortedKeys(seen)
+	member.Keys = sortedKeys(keys)
+	return member, nil
+}
+
+// storedValues are names or keys both in the clear and encrypted, as
+// stored before and after PII_KEY was set
+func storedValues(network string, values []string) []string {
+	stored := append([]string{}, values...)
+	for _, value := range values {
+		if encrypted := encryptName(network, value); encrypted != value {
+			stored = append(stored, encrypted)
+		}
+	}
+	return stored
+}
+
+// forgetTargets are the collections holding a member's data. Usage is
+// anonymized under a pseudonym, keeping the network's totals right, unless
+// deleteUsage. The rest is deleted
+func forgetTargets(settings Settings, member forgottenMember, pseudonym string, deleteUsage bool) []forgetTarget {
+	stored := storedValues(settings.Network, member.Names)
+	keys := storedValues(settings.Network, member.Keys)
+	addresses := storedValues(settings.Network, member.Addresses)
+
+	network := networkMatch(settings.Network)
+	byMember := bson.M{"network": network, "memberid": member.ID}
+	byMemberOrName := bson.M{"network": network, "$or": []bson.M{
+		{"memberid": member.ID},
+		{"memberid": bson.M{"$exists": false}, "name": bson.M{"$in": stored}},
+	}}
+	byAddress := bson.M{"network": network, "address": bson.M{"$in": addresses}}
+
+	// Ingest documents have the network and key in their ID. Watermark IDs
+	// end with the key
+	inIngest := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(settings.Network+"|")}
+	quotedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		quotedKeys[i] = regexp.QuoteMeta(key)
+	}
+	byWatermarkKey := bson.M{"_id": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(settings.Network+"|") + ".*\\|(" + strings.Join(quotedKeys, "|") + ")$"}}
+
+	usageUpdate := bson.M{"$set": bson.M{"memberid": pseudonym, "name": pseudonym}, "$unset": bson.M{"signature": ""}}
+	correctionUpdate := bson.M{
+		"$set":   bson.M{"memberid": pseudonym, "name": pseudonym, "original.memberid": pseudonym, "original.name": pseudonym},
+		"$unset": bson.M{"original.signature": "", "original.labels": ""},
+	}
+	if deleteUsage {
+		usageUpdate, correctionUpdate = nil, nil
+	}
+
+	targets := []forgetTarget{
+		{settings.MongoCollection, byMemberOrName, usageUpdate},
+		{settings.MongoRollupCollection, byMemberOrName, usageUpdate},
+		{settings.MongoTotalsCollection, byMemberOrName, usageUpdate},
+		{settings.MongoCorrectionsCollection, byMemberOrName, correctionUpdate},
+		{settings.MongoMemberMetricsCollection, byMemberOrName, nil},
+		{settings.MongoMembersCollection, bson.M{"network": network, "_id": member.ID}, nil},
+		{settings.MongoMemberChangesCollection, byMember, nil},
+		{settings.MongoAliasCollection, bson.M{"network": network, "$or": []bson.M{{"memberid": member.ID}, {"name": bson.M{"$in": stored}}}}, nil},
+		{settings.MongoAnnotationsCollection, byMember, nil},
+		{settings.MongoPausesCollection, byMember, nil},
+		{settings.MongoBalancesCollection, byMember, nil},
+	}
+	if len(keys) > 0 {
+		targets = append(targets,
+			forgetTarget{settings.IngestSamplesCollection, bson.M{"_id": inIngest, "wgkey": bson.M{"$in": keys}}, nil},
+			forgetTarget{settings.IngestWatermarksCollection, byWatermarkKey, nil},
+		)
+	}
+	if len(addresses) > 0 {
+		targets = append(targets,
+			forgetTarget{settings.NetflowCollection, byAddress, nil},
+			forgetTarget{settings.NetflowHistogramCollection, byAddress, nil},
+		)
+	}
+
+	kept := []forgetTarget{}
+	for _, target := range targets {
+		if target.collection != "" {
+			kept = append(kept, target)
+		}
+	}
+	return kept
+}
+
+// forgetDocuments deletes or anonymizes the member's documents in a
+// collection, recording it in mutations under the pseudonym rather than
+// the filter, which would keep the member ID
+func forgetDocuments(ctx context.Context, db *mongo.Database, mutations *mongo.Collection, network string, pseudonym string, target forgetTarget, dryRun bool) (ForgetResult, error) {
+	collection := db.Collection(target.collection)
+	result := ForgetResult{Network: network, Collection: target.collection, Action: forgetDelete}
+	if target.anonymize != nil {
+		result.Action = forgetAnonymize
+	}
+
+	if dryRun {
+		count, err := collection.CountDocuments(ctx, target.filter)
+		result.Action = "would be " + result.Action
+		result.Documents = count
+		return result, err
+	}
+
+	ids, before, err := snapshotDocuments(ctx, collection, target.filter)
+	if err != nil || len(ids) == 0 {
+		return result, err
+	}
+
+	after := ""
+	if target.anonymize != nil {
+		updated, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, target.anonymize)
+		if err != nil {
+			return result, err
+		}
+		result.Documents = updated.ModifiedCount
+		if _, after, err = snapshotDocuments(ctx, collection, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return result, err
+		}
+	} else {
+		deleted, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return result, err
+		}
+		result.Documents = deleted.DeletedCount
+	}
+
+	return result, recordMutation(ctx, mutations, Mutation{
+		Kind:       mutationForget,
+		Collection: target.collection,
+		Network:    network,
+		Filter:     filterJSON(bson.M{"forgotten": pseudonym}),
+		Documents:  len(ids),
+		Before:     before,
+		After:      after,
+	})
+}
+
+// actorPattern matches any of the identifiers as a whole argument of a
+// command line, or the value of a -flag=value one, so a short name doesn't
+// match inside another word
+func actorPattern(identifiers []string) string {
+	quoted := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		quoted[i] = regexp.QuoteMeta(identifier)
+	}
+	return `(^|[\s(=])(` + strings.Join(quoted, "|") + `)($|[\s)])`
+}
+
+// replaceActorTokens replaces the identifiers actorPattern matches. Adjacent
+// ones share the space between them, so it is repeated until none are left
+func replaceActorTokens(matcher *regexp.Regexp, actor string, replacement string) string {
+	for {
+		replaced := matcher.ReplaceAllString(actor, "${1}"+strings.Replace(replacement, "$", "$$", -1)+"${3}")
+		if replaced == actor {
+			return replaced
+		}
+		actor = replaced
+	}
+}
+
+// forgetMutations replaces the member ID, names, keys and addresses in the
+// filters and command lines the mutations of a network recorded with the
+// pseudonym. The mutations are otherwise kept as they are, as proof of what
+// changed
+func forgetMutations(ctx context.Context, mutations *mongo.Collection, network string, member forgottenMember, pseudonym string, dryRun bool) (ForgetResult, error) {
+	result := ForgetResult{Network: network, Collection: mutations.Name(), Action: forgetAnonymize}
+	if dryRun {
+		result.Action = "would be " + forgetAnonymize
+	}
+
+	identifiers := []string{member.ID}
+	identifiers = append(identifiers, storedValues(network, member.Names)...)
+	identifiers = append(identifiers, storedValues(network, member.Addresses)...)
+	// Filters are JSON, so the identifiers are matched as its strings there
+	inFilter := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		inFilter[i] = regexp.QuoteMeta(jsonString(identifier))
+	}
+	filterPattern := strings.Join(inFilter, "|")
+	inActor := actorPattern(identifiers)
+
+	cursor, err := mutations.Find(ctx, bson.M{"network": network, "$or": []bson.M{
+		{"filter": primitive.Regex{Pattern: filterPattern}},
+		{"actor": primitive.Regex{Pattern: inActor}},
+	}})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+
+	filterMatcher := regexp.MustCompile(filterPattern)
+	actorMatcher := regexp.MustCompile(inActor)
+	for cursor.Next(ctx) {
+		var mutation struct {
+			ID     primitive.ObjectID `bson:"_id"`
+			Filter string
+			Actor  string
+		}
+		if err := cursor.Decode(&mutation); err != nil {
+			return result, err
+		}
+		result.Documents++
+		if dryRun {
+			continue
+		}
+		update := bson.M{
+			"filter": filterMatcher.ReplaceAllLiteralString(mutation.Filter, jsonString(pseudonym)),
+			"actor":  replaceActorTokens(actorMatcher, mutation.Actor, pseudonym),
+		}
+		if _, err := mutations.UpdateOne(ctx, bson.M{"_id": mutation.ID}, bson.M{"$set": update}); err != nil {
+			return result, err
+		}
+	}
+	return result, cursor.Err()
+}
+
+// jsonString is a string as JSON encodes it
+func jsonString(value string) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// forgetMember forgets the member in a database, the primary or the
+// MONGO_DUAL_WRITE_URL mirror, writing what was done to the report
+func forgetMember(ctx context.Context, db *mongo.Database, settings Settings, member forgottenMember, pseudonym string, deleteUsage bool, dryRun bool, mirror bool, report *ReportWriter) error {
+	mutations := db.Collection(settings.MongoMutationsCollection)
+	for _, target := range forgetTargets(settings, member, pseudonym, deleteUsage) {
+		result, err := forgetDocuments(ctx, db, mutations, settings.Network, pseudonym, target, dryRun)
+		if err != nil {
+			return fmt.Errorf("forgetting the member in %s: %v", target.collection, err)
+		}
+		result.Mirror = mirror
+		report.Write(result)
+	}
+
+	result, err := forgetMutations(ctx, mutations, settings.Network, member, pseudonym, dryRun)
+	if err != nil {
+		return fmt.Errorf("forgetting the member in %s: %v", settings.MongoMutationsCollection, err)
+	}
+	result.Mirror = mirror
+	report.Write(result)
+	return nil
+}
+
+// forgetCommand deletes or anonymizes everything stored about a member, in
+// every network and in the MONGO_DUAL_WRITE_URL mirror, for data removal
+// requests. The member should be removed from Airtable first, or the next
+// collection stores them again. Their mesh addresses aren't kept anywhere
+// else, so are given with -address for their flows to be forgotten
+func forgetCommand(args []string) {
+	flags := flag.NewFlagSet("forget", flag.ExitOnError)
+	memberID := flags.String("member", "", "Airtable record ID of the member")
+	addresses := flags.String("address", "", "comma separated mesh IPs of the member, for their netflow counters")
+	deleteUsage := flags.Bool("delete-usage", false, "delete the member's usage rather than anonymizing it")
+	dryRun := flags.Bool("dry-run", false, "count the documents to forget without changing them")
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	if *memberID == "" {
+		fatal("-member is required")
+	}
+	// Addresses are matched as netflow stores them
+	meshIPs := []string{}
+	for _, address := range splitList(*addresses) {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			fatal(fmt.Sprintf("invalid -address %q, expected an IP", address))
+		}
+		meshIPs = append(meshIPs, ip.String())
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	// The pseudonym is random, so the anonymized usage can't be traced back
+	// to the member
+	pseudonym := "forgotten-" + newRecordID()
+
+	for _, settings := range loadAllNetworkSettings() {
+		for _, store := range settings.UsageStores {
+			if store != usageStoreMongo {
+				log.Printf("WARNING: forget only covers Mongo, remove the member from the %s usage store of %s by hand", store, settings.Network)
+			}
+		}
+
+		if settings.StatSource == statSourceNetflow && *addresses == "" {
+			log.Printf("WARNING: %s counts netflow by mesh IP, give the member's with -address to forget their flows", settings.Network)
+		}
+
+		db, err := getMongoDatabase(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		member, err := findForgottenMember(ctx, db, settings, *memberID, meshIPs)
+		if err != nil {
+			fatal(err)
+		}
+		if err := forgetMember(ctx, db, settings, member, pseudonym, *deleteUsage, *dryRun, false, report); err != nil {
+			fatal(err)
+		}
+
+		// The mirror gets usage written to it as the primary does, and has
+		// the rest of the primary's documents once copy-mongo has run
+		if settings.MongoDualWriteURL != "" {
+			mirror, err := dualWriteDatabase(settings)
+			if err != nil {
+				fatal(err)
+			}
+			if err := forgetMember(ctx, mirror, settings, member, pseudonym, *deleteUsage, *dryRun, true, report); err != nil {
+				fatal(fmt.Errorf("on the MONGO_DUAL_WRITE_URL mirror: %v", err))
+			}
+		}
+		cancel()
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
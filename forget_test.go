@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestForgetTargets(t *testing.T) {
+	defer withPIIKey(t, "casa", strings.Repeat("k", 32))()
+
+	settings, _ := readSettings("casa", settingsEnv{"MONGO_COLLECTION": "usage"})
+	member := forgottenMember{ID: "rec1", Names: []string{"Ana", "wgkey-ana"}, Keys: []string{"wgkey-ana"}, Addresses: []string{"10.0.0.2"}}
+	targets := forgetTargets(settings, member, "forgotten-1", false)
+
+	actions := map[string]bool{}
+	for _, target := range targets {
+		actions[target.collection] = target.anonymize != nil
+	}
+	// Usage is anonymized to keep the totals, everything else about the
+	// member is deleted
+	for collection, anonymized := range map[string]bool{
+		"usage":              true,
+		"usage_monthly":      true,
+		"usage_corrections":  true,
+		"members":            false,
+		"member_changes":     false,
+		"annotations":        false,
+		"member_pauses":      false,
+		"member_balances":    false,
+		"ingested_samples":   false,
+		"ingest_watermarks":  false,
+		"netflow_counters":   false,
+		"netflow_histograms": false,
+	} {
+		if got, ok := actions[collection]; !ok || got != anonymized {
+			t.Errorf("%s: got anonymized %v, present %v", collection, got, ok)
+		}
+	}
+	// MONGO_TOTALS_COLLECTION isn't set
+	if len(targets) != 14 {
+		t.Errorf("got %d targets", len(targets))
+	}
+
+	// Usage stored by name is matched whether it was encrypted or not
+	names := fmt.Sprint(targets[0].filter["$or"].([]bson.M)[1]["name"])
+	if !strings.Contains(names, "Ana") || !strings.Contains(names, encryptName("casa", "Ana")) {
+		t.Errorf("got names %s", names)
+	}
+
+	// Netflow is matched by address and ingestion by key, as stored
+	for _, target := range targets {
+		switch target.collection {
+		case "netflow_counters":
+			if addresses := fmt.Sprint(target.filter["address"]); !strings.Contains(addresses, encryptName("casa", "10.0.0.2")) {
+				t.Errorf("got addresses %s", addresses)
+			}
+		case "ingest_watermarks":
+			pattern := target.filter["_id"].(primitive.Regex).Pattern
+			matcher := regexp.MustCompile(pattern)
+			if !matcher.MatchString(watermarkID(UsageSample{Network: "casa", Agent: "gw", Interface: "wg0", WGKey: "wgkey-ana"})) || matcher.MatchString("casa|gw|wg0|wgkey-anabel") {
+				t.Errorf("watermarks matched by %s", pattern)
+			}
+		}
+	}
+
+	for _, target := range forgetTargets(settings, member, "forgotten-1", true) {
+		if target.anonymize != nil {
+			t.Errorf("%s should be deleted with -delete-usage", target.collection)
+		}
+	}
+
+	// Without keys or addresses there is nothing to match ingestion and
+	// netflow by
+	if targets := forgetTargets(settings, forgottenMember{ID: "rec1"}, "forgotten-1", false); len(targets) != 10 {
+		t.Errorf("got %d targets", len(targets))
+	}
+}
+
+func TestReplaceActorTokens(t *testing.T) {
+	matcher := regexp.MustCompile(actorPattern([]string{"Ana", "rec1"}))
+	for actor, want := range map[string]string{
+		"ops@host (stat-collector forget -member rec1)":              "ops@host (stat-collector forget -member forgotten-1)",
+		"ops@host (stat-collector alias -name Ana -member rec1)":     "ops@host (stat-collector alias -name forgotten-1 -member forgotten-1)",
+		"ops@host (stat-collector correct -name=Ana rec1 rec1)":      "ops@host (stat-collector correct -name=forgotten-1 forgotten-1 forgotten-1)",
+		"ana@host (stat-collector alias -name Anabel -member rec10)": "ana@host (stat-collector alias -name Anabel -member rec10)",
+	} {
+		if got := replaceActorTokens(matcher, actor, "forgotten-1"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestJSONString(t *testing.T) {
+	filter := filterJSON(bson.M{"memberid": `rec<1>"`})
+	if !strings.Contains(filter, jsonString(`rec<1>"`)) {
+		t.Errorf("%s doesn't contain %s", filter, jsonString(`rec<1>"`))
+	}
+}
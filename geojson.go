@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Kinds of features geojson exports, selected with -by
+const (
+	geoJSONByMember = "member"
+	geoJSONBySite   = "site"
+)
+
+// GeoJSONCollection is a GeoJSON FeatureCollection, as map tools like uMap
+// and Leaflet load
+type GeoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// GeoJSONFeature is a point with the usage there as its properties
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONPoint is a location, longitude first as GeoJSON has it
+type GeoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+func geoJSONFeature(latitude float64, longitude float64, properties map[string]interface{}) GeoJSONFeature {
+	return GeoJSONFeature{
+		Type:       "Feature",
+		Geometry:   GeoJSONPoint{Type: "Point", Coordinates: [2]float64{longitude, latitude}},
+		Properties: properties,
+	}
+}
+
+// memberFeatures places the usage of each member with a location. Members
+// without one can't be placed and are counted in skipped
+func memberFeatures(summary DashboardSummary, members []MeshMember) (features []GeoJSONFeature, skipped int) {
+	byID := map[string]MemberSummary{}
+	byName := map[string]MemberSummary{}
+	for _, usage := range summary.Members {
+		if usage.MemberID != "" {
+			byID[usage.MemberID] = usage
+		} else {
+			byName[usage.Name] = usage
+		}
+	}
+
+	features = []GeoJSONFeature{}
+	for _, member := range members {
+		if member.Fields.Latitude == nil || member.Fields.Longitude == nil {
+			skipped++
+			continue
+		}
+
+		usage, ok := byID[member.ID]
+		if !ok {
+			usage = byName[member.Fields.Name]
+		}
+		features = append(features, geoJSONFeature(*member.Fields.Latitude, *member.Fields.Longitude, map[string]interface{}{
+			"network":  summary.Network,
+			"member":   member.ID,
+			"name":     member.Fields.Name,
+			"site":     memberSite(member),
+			"from":     summary.From.UTC().Format(time.RFC3339),
+			"to":       summary.To.UTC().Format(time.RFC3339),
+			"planMbps": member.Fields.PlanMbps,
+			"up":       usage.Up,
+			"down":     usage.Down,
+			"total":    usage.Total,
+		}))
+	}
+	return features, skipped
+}
+
+// siteFeatures places the usage of each site whose members have a location
+// at their middle. Sites without one are counted in skipped
+func siteFeatures(sites []SiteUsage) (features []GeoJSONFeature, skipped int) {
+	features = []GeoJSONFeature{}
+	for _, site := range sites {
+		if site.Latitude == nil || site.Longitude == nil {
+			skipped++
+			continue
+		}
+
+		properties := map[string]interface{}{
+			"network":  site.Network,
+			"site":     site.Site,
+			"from":     site.From.UTC().Format(time.RFC3339),
+			"to":       site.To.UTC().Format(time.RFC3339),
+			"members":  site.Members,
+			"planMbps": site.PlanMbps,
+			"up":       site.Up,
+			"down":     site.Down,
+			"total":    site.Total,
+			"previous": site.Previous,
+		}
+		if site.Growth != nil {
+			properties["growth"] = *site.Growth
+		}
+		features = append(features, geoJSONFeature(*site.Latitude, *site.Longitude, properties))
+	}
+	return features, skipped
+}
+
+// geojsonCommand prints the usage over the window of each member, or with
+// -by site of each site, with a location as a GeoJSON FeatureCollection,
+// for network maps
+func geojsonCommand(args []string) {
+	flags := flag.NewFlagSet("geojson", flag.ExitOnError)
+	by := flags.String("by", geoJSONByMember, "features to export: member or site")
+	public := flags.Bool("public", false, "leave out small groups, round and add noise with the PUBLIC_ settings, for publishing")
+	flags.Parse(args)
+
+	if *by != geoJSONByMember && *by != geoJSONBySite {
+		fatal(fmt.Errorf("unknown -by %q, expected %s or %s", *by, geoJSONByMember, geoJSONBySite))
+	}
+	if *public && *by != geoJSONBySite {
+		fatal("-public needs -by site, as the features of members locate them")
+	}
+
+	from, to, duration := parseWindow(flags.Args())
+
+	collection := GeoJSONCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, settings := range loadAllNetworkSettings() {
+		members, err := getMeshMembers(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		var features []GeoJSONFeature
+		var skipped int
+		if *by == geoJSONBySite {
+			sites, err := getSiteUsage(bwupCollection, settings.Network, members, from, to, duration)
+			if err != nil {
+				fatal(err)
+			}
+			if *public {
+				sites = publicSites(newPublicNoise(settings), sites)
+			}
+			features, skipped = siteFeatures(sites)
+		} else {
+			periods, err := getUsagePeriods(bwupCollection, settings.Network, "", "", from, to)
+			if err != nil {
+				fatal(err)
+			}
+			features, skipped = memberFeatures(summarizeDashboard(settings.Network, periods, from, to), members)
+		}
+
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Left out %d %ss of network %s without a location\n", skipped, *by, settings.Network)
+		}
+		collection.Features = append(collection.Features, features...)
+	}
+
+	if err := printJSON(os.Stdout, collection); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMemberFeatures(t *testing.T) {
+	member := func(id string, name string, location ...float64) MeshMember {
+		member := MeshMember{ID: id}
+		member.Fields.Name = name
+		if len(location) == 2 {
+			member.Fields.Latitude, member.Fields.Longitude = &location[0], &location[1]
+		}
+		return member
+	}
+	members := []MeshMember{
+		member("rec1", "Alice", 9.93, -84.08),
+		member("rec2", "Bob", 9.94, -84.09),
+		member("rec3", "Carol"),
+	}
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	summary := DashboardSummary{Network: "casa", From: from, To: from.AddDate(0, 1, 0), Members: []MemberSummary{
+		{MemberID: "rec1", Name: "Alice", Up: 1, Down: 2, Total: 3},
+		{MemberID: "rec3", Name: "Carol", Total: 7},
+	}}
+
+	features, skipped := memberFeatures(summary, members)
+	if skipped != 1 {
+		t.Errorf("got %d skipped, want Carol", skipped)
+	}
+	if len(features) != 2 {
+		t.Fatalf("got features %+v", features)
+	}
+
+	alice, bob := features[0], features[1]
+	if alice.Geometry.Coordinates != [2]float64{-84.08, 9.93} {
+		t.Errorf("got Alice at %v, want longitude first", alice.Geometry.Coordinates)
+	}
+	if alice.Properties["name"] != "Alice" || alice.Properties["total"] != 3.0 || alice.Properties["from"] != "2026-10-01T00:00:00Z" {
+		t.Errorf("got Alice %+v", alice.Properties)
+	}
+	// Members who used nothing are still placed
+	if bob.Properties["name"] != "Bob" || bob.Properties["total"] != 0.0 {
+		t.Errorf("got Bob %+v", bob.Properties)
+	}
+}
+
+func TestSiteFeatures(t *testing.T) {
+	latitude, longitude, growth := 9.93, -84.08, 25.0
+	features, skipped := siteFeatures([]SiteUsage{
+		{Network: "casa", Site: "Tower", Latitude: &latitude, Longitude: &longitude, Members: 2, Total: 40, Growth: &growth},
+		{Network: "casa", Site: "Ridge", Total: 5},
+	})
+	if skipped != 1 || len(features) != 1 {
+		t.Fatalf("got %d skipped and features %+v", skipped, features)
+	}
+	if features[0].Properties["site"] != "Tower" || features[0].Properties["growth"] != 25.0 || features[0].Properties["members"] != 2 {
+		t.Errorf("got Tower %+v", features[0].Properties)
+	}
+}
+
+func TestGeoJSONFormat(t *testing.T) {
+	collection := GeoJSONCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{
+		geoJSONFeature(9.93, -84.08, map[string]interface{}{"site": "Tower"}),
+	}}
+
+	var buffer bytes.Buffer
+	if err := printJSON(&buffer, collection); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	feature := decoded["features"].([]interface{})[0].(map[string]interface{})
+	geometry := feature["geometry"].(map[string]interface{})
+	if decoded["type"] != "FeatureCollection" || feature["type"] != "Feature" || geometry["type"] != "Point" {
+		t.Errorf("got %s", buffer.String())
+	}
+	if coordinates := geometry["coordinates"].([]interface{}); coordinates[0] != -84.08 || coordinates[1] != 9.93 {
+		t.Errorf("got coordinates %v", coordinates)
+	}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraylogSource sums the byte counts logged by exits into Graylog
+type GraylogSource struct {
+	settings Settings
+}
+
+func (s GraylogSource) Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error) {
+	sum, _, err := s.SumWithCount(member, direction, from, to)
+	return sum, err
+}
+
+func (s GraylogSource) SumWithCount(member MeshMember, direction string, from time.Time, to time.Time) (*float64, int64, error) {
+	key, err := memberIdentity(s.settings, member)
+	if err != nil {
+		return nil, 0, err
+	}
+	return callGraylog(member.Override.graylogSettings(s.settings), direction, key, from, to)
+}
+
+// callGraylog returns the member's usage in GB and the number of messages it
+// was summed from
+func callGraylog(settings Settings, direction string, wgKey string, from time.Time, to time.Time) (*float64, int64, error) {
+	query, field, err := buildGraylogQuery(settings, direction, wgKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	queries := []string{query}
+	if len(settings.GraylogInterfaces) > 0 {
+		// Some routers log each WG interface on its own line, so we query
+		// every configured interface separately and add the results together
+		queries = []string{}
+		for _, iface := range settings.GraylogInterfaces {
+			queries = append(queries, "("+query+`) AND "`+iface+`"`)
+		}
+	}
+
+	var total *float64
+	var count int64
+	for _, query := range queries {
+		stats, err := queryGraylogStats(settings, query, field, from, to)
+		if err != nil {
+			return nil, 0, err
+		}
+		total = addSums(total, stats.SumGb())
+		count += *stats.Count
+	}
+
+	return total, count, nil
+}
+
+// Kinds of Graylog failures
+const (
+	graylogErrorAuth      = "auth"
+	graylogErrorNotFound  = "not-found"
+	graylogErrorTimeout   = "timeout"
+	graylogErrorServer    = "server"
+	graylogErrorMalformed = "malformed"
+)
+
+// GraylogError is a failed Graylog query, classified by Kind so that
+// operators can tell a bad password from a broken URL or an overloaded server
+type GraylogError struct {
+	Kind    string
+	Status  int
+	Message string
+}
+
+func (e GraylogError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("graylog %s error (HTTP %d): %s", e.Kind, e.Status, e.Message)
+	}
+	return fmt.Sprintf("graylog %s error: %s", e.Kind, e.Message)
+}
+
+// GraylogStats is the part of a stats response we rely on. Count is a
+// pointer so a response without it is caught as malformed
+type GraylogStats struct {
+	Count *int64   `json:"count"`
+	Sum   *float64 `json:"sum"`
+}
+
+// classifyGraylogResponse checks a stats response is a JSON success, turning
+// anything else into a GraylogError
+func classifyGraylogResponse(resp *http.Response, body []byte) error {
+	trimmed := bytes.TrimSpace(body)
+
+	// Graylog's web interface answers API paths it doesn't know with its
+	// login page, which means the URL or the credentials are wrong
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || bytes.HasPrefix(trimmed, []byte("<")) {
+		return GraylogError{Kind: graylogErrorAuth, Status: resp.StatusCode, Message: "got an HTML page instead of JSON, check GRAYLOG_URL points at the API and the credentials"}
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Error payloads look like {"type": "ApiError", "message": "..."}
+	var apiError struct {
+		Message string `json:"message"`
+	}
+	message := string(trimmed)
+	if json.Unmarshal(trimmed, &apiError) == nil && apiError.Message != "" {
+		message = apiError.Message
+	}
+
+	kind := graylogErrorServer
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		kind = graylogErrorAuth
+	case resp.StatusCode == http.StatusNotFound:
+		kind = graylogErrorNotFound
+	case resp.StatusCode == http.StatusGatewayTimeout || resp.StatusCode == http.StatusRequestTimeout:
+		kind = graylogErrorTimeout
+	case resp.StatusCode == http.StatusBadRequest:
+		kind = graylogErrorMalformed
+	}
+
+	return GraylogError{Kind: kind, Status: resp.StatusCode, Message: message}
+}
+
+// SumGb returns the sum in GB, or nil if no messages had the field
+func (s GraylogStats) SumGb() *float64 {
+	if s.Sum == nil {
+		return nil
+	}
+	sum := bytesToGb(*s.Sum)
+	return &sum
+}
+
+// How sums which aren't finite numbers are taken, set by GRAYLOG_NON_FINITE
+const (
+	nonFiniteNull  = "null"
+	nonFiniteZero  = "zero"
+	nonFiniteError = "error"
+)
+
+// graylogNumber decodes the numbers of a stats response, which depending on
+// the Graylog version are JSON numbers, strings holding a number, or the
+// strings and bare words NaN and Infinity
+type graylogNumber struct {
+	value float64
+}
+
+func (n *graylogNumber) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = strings.TrimSpace(unquoted)
+	}
+
+	switch text {
+	case "NaN":
+		n.value = math.NaN()
+		return nil
+	case "Infinity", "+Infinity":
+		n.value = math.Inf(1)
+		return nil
+	case "-Infinity":
+		n.value = math.Inf(-1)
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("%s is not a number", data)
+	}
+	n.value = value
+	return nil
+}
+
+// quoteNonFinite quotes the bare NaN and Infinity words some Graylog
+// versions write, which aren't valid JSON, leaving strings alone
+func quoteNonFinite(body []byte) []byte {
+	quoted := make([]byte, 0, len(body))
+	inString, escaped := false, false
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			quoted = append(quoted, c)
+			continue
+		}
+
+		if c == '"' {
+			inString = true
+			quoted = append(quoted, c)
+			continue
+		}
+
+		matched := false
+		for _, word := range []string{"NaN", "Infinity", "-Infinity", "+Infinity"} {
+			if bytes.HasPrefix(body[i:], []byte(word)) {
+				quoted = append(quoted, '"')
+				quoted = append(quoted, word...)
+				quoted = append(quoted, '"')
+				i += len(word) - 1
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			quoted = append(quoted, c)
+		}
+	}
+
+	return quoted
+}
+
+// parseGraylogStats decodes and validates a successful stats response.
+// Graylog reports the sum of no messages as NaN, which is taken as no sum.
+// Other sums which are NaN or infinite are dropped, zeroed or refused as
+// nonFinite says
+func parseGraylogStats(body []byte, nonFinite string) (GraylogStats, error) {
+	var stats GraylogStats
+
+	var response struct {
+		Count *graylogNumber `json:"count"`
+		Sum   *graylogNumber `json:"sum"`
+	}
+	if err := json.Unmarshal(quoteNonFinite(body), &response); err != nil {
+		return stats, GraylogError{Kind: graylogErrorMalformed, Message: err.Error()}
+	}
+
+	return newGraylogStats(response.Count, response.Sum, nonFinite)
+}
+
+// newGraylogStats validates the count and sum of a stats response, or of
+// one term of a terms stats response
+func newGraylogStats(responseCount *graylogNumber, responseSum *graylogNumber, nonFinite string) (GraylogStats, error) {
+	var stats GraylogStats
+
+	if responseCount == nil {
+		return stats, GraylogError{Kind: graylogErrorMalformed, Message: "stats response has no count"}
+	}
+	count := responseCount.value
+	if count != math.Trunc(count) || math.IsInf(count, 0) || count > math.MaxInt64 {
+		return stats, GraylogError{Kind: graylogErrorMalformed, Message: fmt.Sprintf("stats response has a count %v which isn't a whole number", count)}
+	}
+	if count < 0 {
+		return stats, GraylogError{Kind: graylogErrorMalformed, Message: fmt.Sprintf("stats response has a negative count %v", count)}
+	}
+	wholeCount := int64(count)
+	stats.Count = &wholeCount
+
+	if responseSum == nil {
+		return stats, nil
+	}
+	sum := responseSum.value
+	if !math.IsNaN(sum) && !math.IsInf(sum, 0) {
+		stats.Sum = &sum
+		return stats, nil
+	}
+	if wholeCount == 0 && math.IsNaN(sum) {
+		return stats, nil
+	}
+
+	switch nonFinite {
+	case nonFiniteNull, "":
+		return stats, nil
+	case nonFiniteZero:
+		zero := 0.0
+		stats.Sum = &zero
+		return stats, nil
+	case nonFiniteError:
+		return stats, GraylogError{Kind: graylogErrorMalformed, Message: fmt.Sprintf("stats response has a sum of %v over %d messages", sum, wholeCount)}
+	}
+	return stats, fmt.Errorf("invalid GRAYLOG_NON_FINITE %q, expected null, zero or error", nonFinite)
+}
+
+// queryGraylogStats runs a stats query over the window
+func queryGraylogStats(settings Settings, query string, field string, from time.Time, to time.Time) (GraylogStats, error) {
+	params := url.Values{
+		"field": []string{field},
+		"query": []string{query},
+	}
+
+	bodyText, err := getGraylogSearch(settings, "stats", params, from, to)
+	if err != nil {
+		return GraylogStats{}, err
+	}
+
+	return parseGraylogStats(bodyText, settings.GraylogNonFinite)
+}
+
+// getGraylogSearch runs an absolute search API call over the window,
+// returning the body of a successful response
+func getGraylogSearch(settings Settings, path string, params url.Values, from time.Time, to time.Time) ([]byte, error) {
+	params.Set("from", from.UTC().Format("2006-01-2T15:04:05.000Z"))
+	params.Set("to", to.UTC().Format("2006-01-2T15:04:05.000Z"))
+	if settings.GraylogStream != "" {
+		params.Set("filter", "streams:"+settings.GraylogStream)
+	}
+
+	return getGraylog(settings, "api/search/universal/absolute/"+path+"?"+params.Encode())
+}
+
+// getGraylog makes an API request to Graylog, returning the body of a
+// successful response, and counts it in the run's metrics
+func getGraylog(settings Settings, path string) ([]byte, error) {
+	body, err := requestGraylog(settings, path)
+	settings.Metrics.RecordRequest(len(body), err)
+	return body, err
+}
+
+func requestGraylog(settings Settings, path string) ([]byte, error) {
+	settings.Chaos.slowDown()
+	if err := settings.Chaos.graylogFailure(); err != nil {
+		return nil, err
+	}
+
+	graylogClient := http.Client{
+		Timeout:   time.Second * 60,
+		Transport: upstreamTransport(settings, http.DefaultTransport),
+	}
+
+	url := strings.Replace(settings.GraylogURL+path, "+", "%20", -1)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(settings.GraylogUser, settings.GraylogPass)
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := graylogClient.Do(req)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, GraylogError{Kind: graylogErrorTimeout, Message: err.Error()}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := classifyGraylogResponse(resp, bodyText); err != nil {
+		return nil, err
+	}
+
+	return bodyText, nil
+}
+
+// graylogTermsBatch is the most keys a terms stats query asks for, keeping
+// its URL short enough for the proxies in front of Graylog
+const graylogTermsBatch = 100
+
+// parseGraylogTerms decodes a terms stats response into the stats of each
+// key. Keys without messages aren't in the response
+func parseGraylogTerms(body []byte, nonFinite string) (map[string]GraylogStats, error) {
+	var response struct {
+		Terms *[]struct {
+			Key   string         `json:"key_field"`
+			Count *graylogNumber `json:"count"`
+			Total *graylogNumber `json:"total"`
+		} `json:"terms"`
+	}
+	if err := json.Unmarshal(quoteNonFinite(body), &response); err != nil {
+		return nil, GraylogError{Kind: graylogErrorMalformed, Message: err.Error()}
+	}
+	if response.Terms == nil {
+		return nil, GraylogError{Kind: graylogErrorMalformed, Message: "terms stats response has no terms"}
+	}
+
+	terms := map[string]GraylogStats{}
+	for _, term := range *response.Terms {
+		stats, err := newGraylogStats(term.Count, term.Total, nonFinite)
+		if err != nil {
+			return nil, err
+		}
+		terms[term.Key] = stats
+	}
+	return terms, nil
+}
+
+// queryGraylogTerms runs a terms stats query over the window, summing the
+// field for each value of the key field among the keys
+func queryGraylogTerms(settings Settings, query string, keyField string, field string, size int, from time.Time, to time.Time) (map[string]GraylogStats, error) {
+	params := url.Values{
+		"key_field":   []string{keyField},
+		"value_field": []string{field},
+		"order":       []string{"total:desc"},
+		"size":        []string{strconv.Itoa(size)},
+		"query":       []string{query},
+	}
+
+	bodyText, err := getGraylogSearch(settings, "termsstats", params, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseGraylogTerms(bodyText, settings.GraylogNonFinite)
+}
+
+// CanSumAll checks grouped queries can be made: the gelf query mode gives
+// keys their own field to group on, and a small terms stats query probes
+// the Graylog server has the API
+func (s GraylogSource) CanSumAll() error {
+	if s.settings.GraylogQueryMode != queryModeGELF {
+		return fmt.Errorf("grouped queries need GRAYLOG_QUERY_MODE=gelf, where keys have their own field")
+	}
+
+	to := time.Now()
+	_, err := queryGraylogTerms(s.settings, "_exists_:"+s.settings.GraylogKeyField, s.settings.GraylogKeyField, s.settings.GraylogUpField, 1, to.Add(-time.Minute), to)
+	if err != nil {
+		return fmt.Errorf("the Graylog server didn't answer a terms stats query: %v", err)
+	}
+	return nil
+}
+
+// SumAll sums the usage of every member in one direction with terms stats
+// queries grouped by GRAYLOG_KEY_FIELD, a query per hundred members and
+// interface rather than one per member. Keys need their own field for this,
+// so only the gelf query mode supports it
+func (s GraylogSource) SumAll(members []MeshMember, direction string, from time.Time, to time.Time) ([]MemberSum, error) {
+	if s.settings.GraylogQueryMode != queryModeGELF {
+		return nil, fmt.Errorf("grouped queries need GRAYLOG_QUERY_MODE=gelf, where keys have their own field")
+	}
+	if direction != "up" && direction != "down" {
+		return nil, fmt.Errorf("invalid direction argument %q", direction)
+	}
+	field := s.settings.GraylogDownField
+	if direction == "up" {
+		field = s.settings.GraylogUpField
+	}
+
+	// Members without an identity are left for batchedSource to fail
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, member := range members {
+		key, err := memberIdentity(s.settings, member)
+		if err == nil && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	totals := map[string]MemberSum{}
+	for start := 0; start < len(keys); start += graylogTermsBatch {
+		end := start + graylogTermsBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		quoted := []string{}
+		for _, key := range batch {
+			quoted = append(quoted, `"`+escapeLucenePhrase(key)+`"`)
+		}
+		query := s.settings.GraylogKeyField + ":(" + strings.Join(quoted, " OR ") + ")"
+
+		queries := []string{query}
+		if len(s.settings.GraylogInterfaces) > 0 {
+			queries = []string{}
+			for _, iface := range s.settings.GraylogInterfaces {
+				queries = append(queries, "("+query+`) AND "`+iface+`"`)
+			}
+		}
+
+		for _, query := range queries {
+			terms, err := queryGraylogTerms(s.settings, query, s.settings.GraylogKeyField, field, len(batch), from, to)
+			if err != nil {
+				return nil, err
+			}
+			for key, stats := range terms {
+				total := totals[key]
+				total.Sum = addSums(total.Sum, stats.SumGb())
+				total.Count += *stats.Count
+				totals[key] = total
+			}
+		}
+	}
+
+	sums := make([]MemberSum, len(members))
+	for i, member := range members {
+		if key, err := memberIdentity(s.settings, member); err == nil {
+			sums[i] = totals[key]
+		}
+	}
+	return sums, nil
+}
+
+// queryGraylogSum returns the sum of the field over the window in GB, or nil
+// if no messages matched
+func queryGraylogSum(settings Settings, query string, field string, from time.Time, to time.Time) (*float64, error) {
+	stats, err := queryGraylogStats(settings, query, field, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats.SumGb(), nil
+}
+
+func (s GraylogSource) ExitSum(direction string, from time.Time, to time.Time) (*float64, error) {
+	query, field, err := buildGraylogExitQuery(s.settings, direction)
+	if err != nil {
+		return nil, err
+	}
+
+	return queryGraylogSum(s.settings, query, field, from, to)
+}
+
+// CountMessages runs the canary query over the window and returns how many
+// messages matched it
+func (s GraylogSource) CountMessages(from time.Time, to time.Time) (int64, error) {
+	filter := ""
+	if s.settings.GraylogCanaryStream != "" {
+		filter = "streams:" + s.settings.GraylogCanaryStream
+	}
+	return countGraylogMessages(s.settings, s.settings.GraylogCanaryQuery, filter, from, to)
+}
+
+// countGraylogMessages returns how many messages matched the query over the
+// window, within filter if set
+func countGraylogMessages(settings Settings, query string, filter string, from time.Time, to time.Time) (int64, error) {
+	params := url.Values{
+		"query":  []string{query},
+		"from":   []string{from.UTC().Format("2006-01-2T15:04:05.000Z")},
+		"to":     []string{to.UTC().Format("2006-01-2T15:04:05.000Z")},
+		"limit":  []string{"1"},
+		"fields": []string{"timestamp"},
+	}
+	if filter != "" {
+		params.Set("filter", filter)
+	}
+
+	bodyText, err := getGraylog(settings, "api/search/universal/absolute?"+params.Encode())
+	if err != nil {
+		return 0, err
+	}
+
+	var searchRes struct {
+		TotalResults *int64 `json:"total_results"`
+	}
+	if err := json.Unmarshal(bodyText, &searchRes); err != nil {
+		return 0, GraylogError{Kind: graylogErrorMalformed, Message: err.Error()}
+	}
+	if searchRes.TotalResults == nil {
+		return 0, GraylogError{Kind: graylogErrorMalformed, Message: "search response has no total_results"}
+	}
+
+	return *searchRes.TotalResults, nil
+}
+
+// parseGraylogSavedSearch reads the query of a saved search, which looks
+// like {"id": "...", "title": "...", "query": {"query": "..."}}
+func parseGraylogSavedSearch(body []byte) (string, error) {
+	var response struct {
+		Query *struct {
+			Query *string `json:"query"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", GraylogError{Kind: graylogErrorMalformed, Message: fmt.Sprintf("saved search: %v", err)}
+	}
+	if response.Query == nil || response.Query.Query == nil || strings.TrimSpace(*response.Query.Query) == "" {
+		return "", GraylogError{Kind: graylogErrorMalformed, Message: "saved search has no query"}
+	}
+	return *response.Query.Query, nil
+}
+
+// resolveSavedSearches turns the saved search mode into the structured
+// mode, with the queries of the saved searches GRAYLOG_UP_SEARCH and
+// GRAYLOG_DOWN_SEARCH as the query templates, so queries can be tuned in
+// Graylog rather than in the settings. Other modes are left as they are
+func resolveSavedSearches(settings Settings) (Settings, error) {
+	if settings.GraylogQueryMode != queryModeSaved {
+		return settings, nil
+	}
+
+	searches := []struct {
+		id    string
+		query *string
+	}{
+		{settings.GraylogUpSearch, &settings.GraylogUpQuery},
+		{settings.GraylogDownSearch, &settings.GraylogDownQuery},
+	}
+	for _, search := range searches {
+		id := search.id
+		if id == "" {
+			return settings, fmt.Errorf("GRAYLOG_QUERY_MODE %s needs GRAYLOG_UP_SEARCH and GRAYLOG_DOWN_SEARCH", queryModeSaved)
+		}
+
+		body, err := getGraylog(settings, "api/search/saved/"+url.PathEscape(id))
+		if err != nil {
+			return settings, fmt.Errorf("saved search %s: %v", id, err)
+		}
+		query, err := parseGraylogSavedSearch(body)
+		if err != nil {
+			return settings, fmt.Errorf("saved search %s: %v", id, err)
+		}
+		if !strings.Contains(query, "{key}") {
+			return settings, fmt.Errorf("saved search %s: query %q has no {key} for the member's key", id, query)
+		}
+		*search.query = query
+	}
+
+	settings.GraylogQueryMode = queryModeStructured
+	return settings, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// untaggedGroup collects the members without a tag of the kind grouped by,
+// so the groups of a kind add up to the whole network
+const untaggedGroup = "untagged"
+
+// GroupUsage is the usage of a group of members over a window, like a
+// neighborhood, a relay site or a plan tier. Members with several tags of
+// the kind grouped by count towards each of their groups
+type GroupUsage struct {
+	Network string
+	By      string `json:",omitempty"`
+	Group   string
+	From    time.Time
+	To      time.Time
+	Members int
+	Up      float64
+	Down    float64
+	Total   float64
+	Failed  int
+}
+
+// memberGroups returns the groups a member's tags put it in. Tags are
+// read as kind:value, and grouping by a kind gives the values of the tags
+// of that kind, so "neighborhood:Centro" is in group "Centro" by
+// neighborhood. Grouping by no kind gives every tag whole
+func memberGroups(tags []string, by string) []string {
+	groups := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		group := strings.TrimSpace(tag)
+		if by != "" {
+			parts := strings.SplitN(group, ":", 2)
+			if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), by) {
+				continue
+			}
+			group = strings.TrimSpace(parts[1])
+		}
+		if group == "" || seen[group] {
+			continue
+		}
+		seen[group] = true
+		groups = append(groups, group)
+	}
+	if len(groups) == 0 {
+		groups = append(groups, untaggedGroup)
+	}
+	return groups
+}
+
+// groupUsage adds up the usage of the members of each group, largest
+// first. Members are looked up by ID, or by name for usage without one
+func groupUsage(summary DashboardSummary, members []MeshMember, by string) []GroupUsage {
+	byID := map[string]MeshMember{}
+	byName := map[string]MeshMember{}
+	for _, member := range members {
+		byID[member.ID] = member
+		byName[member.Fields.Name] = member
+	}
+
+	groups := map[string]*GroupUsage{}
+	for _, usage := range summary.Members {
+		member, ok := byID[usage.MemberID]
+		if !ok || usage.MemberID == "" {
+			member = byName[usage.Name]
+		}
+
+		for _, name := range memberGroups(member.Fields.Tags, by) {
+			group, ok := groups[name]
+			if !ok {
+				group = &GroupUsage{Network: summary.Network, By: by, Group: name, From: summary.From, To: summary.To}
+				groups[name] = group
+			}
+			group.Members++
+			group.Up += usage.Up
+			group.Down += usage.Down
+			group.Total += usage.Total
+			group.Failed += usage.Failed
+		}
+	}
+
+	all := []GroupUsage{}
+	for _, group := range groups {
+		all = append(all, *group)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Total == all[j].Total {
+			return strings.ToLower(all[i].Group) < strings.ToLower(all[j].Group)
+		}
+		return all[i].Total > all[j].Total
+	})
+	return all
+}
+
+func (g GroupUsage) reportColumns() []string {
+	return []string{"NETWORK", "BY", "GROUP", "FROM", "TO", "MEMBERS", "UP (GB)", "DOWN (GB)", "TOTAL (GB)", "FAILED"}
+}
+
+func (g GroupUsage) reportValues(number func(*float64) string) []string {
+	return []string{
+		g.Network,
+		g.By,
+		g.Group,
+		g.From.UTC().Format(time.RFC3339),
+		g.To.UTC().Format(time.RFC3339),
+		strconv.Itoa(g.Members),
+		number(&g.Up),
+		number(&g.Down),
+		number(&g.Total),
+		strconv.Itoa(g.Failed),
+	}
+}
+
+// handleGroups returns the usage of each group of members over the last
+// days, grouped by the kind of tag in by
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "groups require GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, _, ok := s.authorize(w, r, query.Get("network"), roleViewer)
+	if !ok {
+		return
+	}
+
+	days, ok := summaryDays(query.Get("days"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "days must be a positive number")
+		return
+	}
+
+	summary, err := tenant.cachedSummary(days)
+	if err != nil {
+		log.Printf("Error reading usage: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "usage could not be read")
+		return
+	}
+
+	members, err := tenant.members.Members()
+	if err != nil {
+		log.Printf("Error refreshing members: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "members could not be read")
+		return
+	}
+
+	writeJSON(w, groupUsage(summary, members, query.Get("by")))
+}
+
+// groupsCommand reports the usage of each group of members over the
+// window, grouped by the kind of tag given with -by, like -by neighborhood
+func groupsCommand(args []string) {
+	flags := flag.NewFlagSet("groups", flag.ExitOnError)
+	by := flags.String("by", "", "kind of tag to group by, like neighborhood for tags like neighborhood:Centro, or empty for every tag")
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	public := flags.Bool("public", false, "leave out small groups, round and add noise with the PUBLIC_ settings, for publishing")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		members, err := getMeshMembers(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, "", "", from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		summary := summarizeDashboard(settings.Network, periods, from, to)
+		groups := groupUsage(summary, members, *by)
+		if *public {
+			groups = publicGroups(newPublicNoise(settings), groups)
+		}
+		for _, group := range groups {
+			if err := report.Write(group); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
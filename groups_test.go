@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMemberGroups(t *testing.T) {
+	tags := []string{"neighborhood:Centro", "site:Water Tower", "Site: Ridge", "plan:50", "founding", "neighborhood:Centro"}
+
+	tests := []struct {
+		by     string
+		groups []string
+	}{
+		{"neighborhood", []string{"Centro"}},
+		{"site", []string{"Water Tower", "Ridge"}},
+		{"plan", []string{"50"}},
+		{"relay", []string{untaggedGroup}},
+		{"", []string{"neighborhood:Centro", "site:Water Tower", "Site: Ridge", "plan:50", "founding"}},
+	}
+
+	for _, test := range tests {
+		if groups := memberGroups(tags, test.by); !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("by %q: got %v, want %v", test.by, groups, test.groups)
+		}
+	}
+
+	if groups := memberGroups(nil, ""); !reflect.DeepEqual(groups, []string{untaggedGroup}) {
+		t.Errorf("no tags: got %v", groups)
+	}
+}
+
+func TestGroupUsage(t *testing.T) {
+	member := func(id string, name string, tags ...string) MeshMember {
+		member := MeshMember{ID: id}
+		member.Fields.Name = name
+		member.Fields.Tags = tags
+		return member
+	}
+	members := []MeshMember{
+		member("rec1", "Alice", "neighborhood:Centro"),
+		member("rec2", "Bob", "neighborhood:Centro", "neighborhood:Norte"),
+		member("rec3", "Carol", "neighborhood:Norte"),
+		member("rec4", "Dan"),
+	}
+
+	summary := DashboardSummary{Network: "casa", Members: []MemberSummary{
+		{MemberID: "rec1", Name: "Alice", Up: 1, Down: 2, Total: 3},
+		{MemberID: "rec2", Name: "Bob", Up: 10, Down: 10, Total: 20},
+		// Usage without an ID is matched by name
+		{Name: "Carol", Up: 2, Down: 2, Total: 4, Failed: 1},
+		{MemberID: "rec4", Name: "Dan", Total: 1},
+		{MemberID: "rec9", Name: "Gone", Total: 2},
+	}}
+
+	groups := groupUsage(summary, members, "neighborhood")
+
+	got := map[string]GroupUsage{}
+	order := []string{}
+	for _, group := range groups {
+		got[group.Group] = group
+		order = append(order, group.Group)
+	}
+
+	if !reflect.DeepEqual(order, []string{"Norte", "Centro", untaggedGroup}) {
+		t.Errorf("got groups %v", order)
+	}
+	if centro := got["Centro"]; centro.Members != 2 || centro.Up != 11 || centro.Down != 12 || centro.Total != 23 {
+		t.Errorf("got Centro %+v", centro)
+	}
+	if norte := got["Norte"]; norte.Members != 2 || norte.Total != 24 || norte.Failed != 1 {
+		t.Errorf("got Norte %+v", norte)
+	}
+	if untagged := got[untaggedGroup]; untagged.Members != 2 || untagged.Total != 3 {
+		t.Errorf("got untagged %+v", untagged)
+	}
+	if got["Centro"].Network != "casa" || got["Centro"].By != "neighborhood" {
+		t.Errorf("got Centro %+v", got["Centro"])
+	}
+}
+
+func TestGroupRoutes(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens}}, nil)
+	routes := server.routes()
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"GET", "/api/v1/groups", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/groups", "mine", http.StatusForbidden},
+		{"GET", "/api/v1/groups?days=-1", "view", http.StatusBadRequest},
+		{"POST", "/api/v1/groups", "view", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, w.Code, test.status)
+		}
+	}
+}
+
+func TestSummaryDays(t *testing.T) {
+	tests := []struct {
+		value string
+		days  int
+		valid bool
+	}{
+		{"", 30, true},
+		{"7", 7, true},
+		{"0", 0, false},
+		{"-3", 0, false},
+		{"week", 0, false},
+	}
+
+	for _, test := range tests {
+		days, ok := summaryDays(test.value)
+		if ok != test.valid {
+			t.Errorf("%q: got valid %v, want %v", test.value, ok, test.valid)
+			continue
+		}
+		if ok && days != test.days {
+			t.Errorf("%q: got %d days, want %d", test.value, days, test.days)
+		}
+	}
+}
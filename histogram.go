@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NetflowHistogram is a day of a peer's NetFlow counters in one direction,
+// kept in NETFLOW_HISTOGRAM_COLLECTION once the day is over rather than a
+// document per hour. Buckets holds the byte counts of each hour, or with a
+// day Resolution the day's alone, packed by encodeBuckets, and Bytes their
+// sum. CompactBatches lists the batches of hourly counters already added,
+// so none is ever added twice
+type NetflowHistogram struct {
+	Network        string
+	Address        string
+	Direction      string
+	Day            time.Time
+	Resolution     string `json:",omitempty" bson:",omitempty"`
+	Buckets        []byte
+	Bytes          int64
+	CompactBatches []primitive.ObjectID `json:"-" bson:",omitempty"`
+}
+
+// histogramBuckets is the number of hourly buckets of a day's histogram
+const histogramBuckets = 24
+
+// Resolutions of histograms. Histograms are hourly until downsampled
+const (
+	resolutionHour = ""
+	resolutionDay  = "day"
+)
+
+// bucketCounts decodes a histogram's buckets and returns them with the
+// length of time each covers
+func (h NetflowHistogram) bucketCounts() ([]int64, time.Duration, error) {
+	switch h.Resolution {
+	case resolutionHour:
+		counts, err := decodeBuckets(h.Buckets, histogramBuckets)
+		return counts, time.Hour, err
+	case resolutionDay:
+		counts, err := decodeBuckets(h.Buckets, 1)
+		return counts, 24 * time.Hour, err
+	}
+	return nil, 0, fmt.Errorf("unknown histogram resolution %q", h.Resolution)
+}
+
+// encodeBuckets packs byte counts as the varint of each count's difference
+// from the previous one. Hours of a day carry similar traffic, so most
+// differences take a byte or two instead of eight
+func encodeBuckets(counts []int64) []byte {
+	encoded := make([]byte, 0, len(counts)*2)
+	buffer := make([]byte, binary.MaxVarintLen64)
+
+	var previous int64
+	for _, count := range counts {
+		n := binary.PutVarint(buffer, count-previous)
+		encoded = append(encoded, buffer[:n]...)
+		previous = count
+	}
+	return encoded
+}
+
+// decodeBuckets unpacks the byte counts packed by encodeBuckets, which must
+// be exactly buckets of them
+func decodeBuckets(encoded []byte, buckets int) ([]int64, error) {
+	counts := make([]int64, 0, buckets)
+
+	var previous int64
+	for len(encoded) > 0 {
+		delta, n := binary.Varint(encoded)
+		if n <= 0 {
+			return nil, fmt.Errorf("corrupt histogram buckets")
+		}
+		encoded = encoded[n:]
+		previous += delta
+		counts = append(counts, previous)
+	}
+
+	if len(counts) != buckets {
+		return nil, fmt.Errorf("histogram has %d buckets, expected %d", len(counts), buckets)
+	}
+	return counts, nil
+}
+
+// sumHistogram adds up the bytes of the histogram's buckets starting within
+// the window, as the hourly counters are matched. Windows over downsampled
+// days are so rounded to whole days
+func sumHistogram(histogram NetflowHistogram, from time.Time, to time.Time) (int64, error) {
+	counts, width, err := histogram.bucketCounts()
+	if err != nil {
+		return 0, err
+	}
+
+	var sum int64
+	for i, count := range counts {
+		start := histogram.Day.Add(time.Duration(i) * width)
+		if !start.Before(from) && start.Before(to) {
+			sum += count
+		}
+	}
+	return sum, nil
+}
+
+// netflowCounter is an hourly NetFlow counter as the netflow command keeps
+// them
+type netflowCounter struct {
+	Hour  time.Time
+	Bytes int64
+}
+
+// histogramCounts adds hourly counters into the buckets of their day
+func histogramCounts(day time.Time, counters []netflowCounter) []int64 {
+	counts := make([]int64, histogramBuckets)
+	for _, counter := range counters {
+		i := int(counter.Hour.Sub(day) / time.Hour)
+		if i >= 0 && i < histogramBuckets {
+			counts[i] += counter.Bytes
+		}
+	}
+	return counts
+}
+
+// netflowDay is the hourly counters of a peer's day in one direction. Batch
+// is set on counters a previous compaction marked but didn't get to delete
+type netflowDay struct {
+	ID struct {
+		Address   string
+		Direction string
+		Day       string
+		Batch     *primitive.ObjectID
+	} `bson:"_id"`
+	IDs []primitive.ObjectID
+}
+
+// getNetflowDays groups the hourly counters of a network before the cutoff
+// by peer, direction, day and compaction batch
+func getNetflowDays(collection *mongo.Collection, network string, cutoff time.Time) ([]netflowDay, error) {
+	days := []netflowDay{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"network": networkMatch(network), "hour": bson.M{"$lt": cutoff}}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"address":   "$address",
+				"direction": "$direction",
+				"day":       bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$hour"}},
+				"batch":     "$compactbatch",
+			},
+			"ids": bson.M{"$push": "$_id"},
+		}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return days, err
+	}
+	err = cursor.All(ctx, &days)
+	return days, err
+}
+
+// compactNetflowDay adds a day of hourly counters to its histogram, then
+// deletes them, recording both in mutations. Counters flushed for a day
+// already compacted are added to the existing histogram.
+//
+// As prunes do, the counters are first marked with a batch, which the
+// histogram records once added, so an interrupted compaction only deletes
+// them on the next run
+func compactNetflowDay(counters *mongo.Collection, histograms *mongo.Collection, mutations *mongo.Collection, network string, day netflowDay) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	start, err := time.Parse("2006-01-02", day.ID.Day)
+	if err != nil {
+		return err
+	}
+
+	batch := primitive.NewObjectID()
+	if day.ID.Batch != nil {
+		batch = *day.ID.Batch
+	} else {
+		_, err := counters.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$in": day.IDs}, "compactbatch": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"compactbatch": batch}})
+		if err != nil {
+			return err
+		}
+	}
+
+	compacted := bson.M{"compactbatch": batch}
+	batchCounters := []netflowCounter{}
+	cursor, err := counters.Find(ctx, compacted)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &batchCounters); err != nil {
+		return err
+	}
+	counts := histogramCounts(start, batchCounters)
+
+	// The day's histogram starts out empty, so adding to it is recorded
+	filter := bson.M{"network": network, "address": day.ID.Address, "direction": day.ID.Direction, "day": start}
+	_, err = histograms.UpdateOne(ctx, filter, bson.M{
+		"$setOnInsert": bson.M{"buckets": encodeBuckets(make([]int64, histogramBuckets)), "bytes": 0},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	var histogram NetflowHistogram
+	if err := histograms.FindOne(ctx, filter).Decode(&histogram); err != nil {
+		return err
+	}
+
+	added := false
+	for _, existing := range histogram.CompactBatches {
+		added = added || existing == batch
+	}
+	if !added {
+		existing, _, err := histogram.bucketCounts()
+		if err != nil {
+			return err
+		}
+		if histogram.Resolution == resolutionDay {
+			// Late counters of a downsampled day only add to its total
+			for _, count := range counts {
+				existing[0] += count
+			}
+			counts = existing
+		} else {
+			for i := range counts {
+				counts[i] += existing[i]
+			}
+		}
+
+		var bytes int64
+		for _, count := range counts {
+			bytes += count
+		}
+
+		// Only adds the batch if it isn't in the histogram yet
+		filter["compactbatches"] = bson.M{"$ne": batch}
+		err = mutateDocuments(ctx, mutations, histograms, mutationCompact, network, filter, func() error {
+			_, err := histograms.UpdateOne(ctx, filter, bson.M{
+				"$set":  bson.M{"buckets": encodeBuckets(counts), "bytes": bytes},
+				"$push": bson.M{"compactbatches": batch},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return mutateDocuments(ctx, mutations, counters, mutationCompact, network, compacted, func() error {
+		_, err := counters.DeleteMany(ctx, compacted)
+		return err
+	})
+}
+
+// compactNetflow packs the hourly counters of every day before the current
+// one into daily histograms
+func compactNetflow(settings Settings, db *mongo.Database, now time.Time) error {
+	cutoff := now.UTC().Truncate(24 * time.Hour)
+	counters := db.Collection(settings.NetflowCollection)
+
+	days, err := getNetflowDays(counters, settings.Network, cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, day := range days {
+		err := compactNetflowDay(counters, db.Collection(settings.NetflowHistogramCollection), db.Collection(settings.MongoMutationsCollection), settings.Network, day)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(days) > 0 {
+		log.Printf("Compacted %d days of NetFlow counters into histograms", len(days))
+	}
+	return nil
+}
+
+// sumNetflowHistograms adds up a peer's histogram hours in the window,
+// returning whether any of them had traffic, as only hours with traffic
+// have hourly counters
+func sumNetflowHistograms(ctx context.Context, histograms *mongo.Collection, network string, address string, direction string, from time.Time, to time.Time) (int64, bool, error) {
+	cursor, err := histograms.Find(ctx, bson.M{
+		"network":   networkMatch(network),
+		"address":   encryptName(network, address),
+		"direction": direction,
+		"day":       bson.M{"$gt": from.Add(-24 * time.Hour), "$lt": to},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	all := []NetflowHistogram{}
+	if err := cursor.All(ctx, &all); err != nil {
+		return 0, false, err
+	}
+
+	var sum int64
+	for _, histogram := range all {
+		bytes, err := sumHistogram(histogram, from, to)
+		if err != nil {
+			return 0, false, fmt.Errorf("histogram of %s on %s: %v", address, histogram.Day.Format("2006-01-02"), err)
+		}
+		sum += bytes
+	}
+	return sum, sum > 0, nil
+}
+
+// downsampleHistogram turns an hourly histogram into a daily one, keeping
+// its total exactly. Histograms whose buckets don't add up to their total
+// are refused rather than losing track of the difference
+func downsampleHistogram(histogram NetflowHistogram) (NetflowHistogram, error) {
+	counts, _, err := histogram.bucketCounts()
+	if err != nil {
+		return histogram, err
+	}
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total != histogram.Bytes {
+		return histogram, fmt.Errorf("histogram of %s on %s has buckets adding up to %d bytes, not its %d", histogram.Address, histogram.Day.Format("2006-01-02"), total, histogram.Bytes)
+	}
+
+	histogram.Resolution = resolutionDay
+	histogram.Buckets = encodeBuckets([]int64{total})
+	return histogram, nil
+}
+
+// downsampleCutoff is the start of the month histograms are kept hourly
+// from, so only whole months are downsampled
+func downsampleCutoff(now time.Time, months int) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()-time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// downsampleNetflow turns the hourly histograms of a network older than
+// NETFLOW_HOURLY_MONTHS into daily ones, a day at a time, recording each
+// day in mutations. With dryRun it only counts them
+func downsampleNetflow(settings Settings, db *mongo.Database, now time.Time, dryRun bool) (int, error) {
+	if settings.NetflowHourlyMonths <= 0 {
+		return 0, nil
+	}
+	histograms := db.Collection(settings.NetflowHistogramCollection)
+	mutations := db.Collection(settings.MongoMutationsCollection)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	hourly := bson.M{
+		"network":    networkMatch(settings.Network),
+		"day":        bson.M{"$lt": downsampleCutoff(now, settings.NetflowHourlyMonths)},
+		"resolution": bson.M{"$exists": false},
+	}
+	days, err := histograms.Distinct(ctx, "day", hourly)
+	if err != nil {
+		return 0, err
+	}
+
+	downsampled := 0
+	for _, day := range days {
+		filter := bson.M{"network": hourly["network"], "day": day, "resolution": hourly["resolution"]}
+
+		all := []struct {
+			ID               primitive.ObjectID `bson:"_id"`
+			NetflowHistogram `bson:",inline"`
+		}{}
+		cursor, err := histograms.Find(ctx, filter)
+		if err != nil {
+			return downsampled, err
+		}
+		if err := cursor.All(ctx, &all); err != nil {
+			return downsampled, err
+		}
+
+		if dryRun {
+			downsampled += len(all)
+			continue
+		}
+
+		err = mutateDocuments(ctx, mutations, histograms, mutationDownsample, settings.Network, filter, func() error {
+			for _, histogram := range all {
+				daily, err := downsampleHistogram(histogram.NetflowHistogram)
+				if err != nil {
+					return err
+				}
+				_, err = histograms.UpdateOne(ctx,
+					bson.M{"_id": histogram.ID, "resolution": bson.M{"$exists": false}},
+					bson.M{"$set": bson.M{"resolution": daily.Resolution, "buckets": daily.Buckets}})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return downsampled, err
+		}
+		downsampled += len(all)
+	}
+
+	return downsampled, nil
+}
+
+// downsampleNetwork downsamples a network's histograms, logging how many
+func downsampleNetwork(settings Settings, dryRun bool) {
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	count, err := downsampleNetflow(settings, db, time.Now(), dryRun)
+	if err != nil {
+		fatal(err)
+	}
+
+	verb := "Downsampled"
+	if dryRun {
+		verb = "Would downsample"
+	}
+	log.Printf("%s %d NetFlow histograms of network %s to daily", verb, count, settings.Network)
+}
+
+func downsampleJob(scheduled time.Time, previous time.Time) {
+	for _, settings := range loadAllNetworkSettings() {
+		downsampleNetwork(settings, false)
+	}
+}
+
+// downsampleCommand turns the NetFlow histograms of every network older
+// than NETFLOW_HOURLY_MONTHS from hourly to daily, keeping their totals.
+// With --dry-run it only counts them
+func downsampleCommand(args []string) {
+	flags := flag.NewFlagSet("downsample", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "count the histograms to downsample without changing them")
+	flags.Parse(args)
+
+	for _, settings := range loadAllNetworkSettings() {
+		downsampleNetwork(settings, *dryRun)
+	}
+}
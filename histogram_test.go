@@ -0,0 +1,211 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeBuckets(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int64
+	}{
+		{"empty day", make([]int64, histogramBuckets)},
+		{"steady", []int64{5e9, 5.1e9, 4.9e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9, 5e9}},
+		{"bursts", []int64{0, 0, 0, 9e12, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7e11, 0}},
+	}
+
+	for _, test := range tests {
+		encoded := encodeBuckets(test.counts)
+		decoded, err := decodeBuckets(encoded, histogramBuckets)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.counts) {
+			t.Errorf("%s: got %v, want %v", test.name, decoded, test.counts)
+		}
+		if len(encoded) >= 8*histogramBuckets {
+			t.Errorf("%s: %d bytes encoded, no smaller than the %d of the counts", test.name, len(encoded), 8*histogramBuckets)
+		}
+	}
+
+	if encoded := encodeBuckets(make([]int64, histogramBuckets)); len(encoded) != histogramBuckets {
+		t.Errorf("an empty day takes %d bytes, want one per hour", len(encoded))
+	}
+}
+
+func TestDecodeBucketsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"too few buckets", encodeBuckets([]int64{1, 2, 3})},
+		{"too many buckets", encodeBuckets(make([]int64, histogramBuckets+1))},
+		{"truncated varint", append(encodeBuckets(make([]int64, histogramBuckets-1)), 0x80)},
+		{"nothing", nil},
+	}
+
+	for _, test := range tests {
+		if _, err := decodeBuckets(test.encoded, histogramBuckets); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
+
+func TestHistogramCounts(t *testing.T) {
+	day := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	counts := histogramCounts(day, []netflowCounter{
+		{Hour: day, Bytes: 10},
+		{Hour: day.Add(5 * time.Hour), Bytes: 20},
+		// Flushed twice in the same hour
+		{Hour: day.Add(5 * time.Hour), Bytes: 5},
+		{Hour: day.Add(23 * time.Hour), Bytes: 30},
+		// Another day's counter is left out
+		{Hour: day.Add(24 * time.Hour), Bytes: 99},
+	})
+
+	want := make([]int64, histogramBuckets)
+	want[0], want[5], want[23] = 10, 25, 30
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got %v, want %v", counts, want)
+	}
+}
+
+func TestSumHistogram(t *testing.T) {
+	day := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	counts := make([]int64, histogramBuckets)
+	for i := range counts {
+		counts[i] = int64(i + 1)
+	}
+	histogram := NetflowHistogram{Day: day, Buckets: encodeBuckets(counts)}
+
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		sum  int64
+	}{
+		{"whole day", day, day.Add(24 * time.Hour), 300},
+		{"one hour", day.Add(2 * time.Hour), day.Add(3 * time.Hour), 3},
+		{"morning", day, day.Add(6 * time.Hour), 21},
+		{"from the day before", day.Add(-5 * time.Hour), day.Add(2 * time.Hour), 3},
+		{"into the next day", day.Add(22 * time.Hour), day.Add(30 * time.Hour), 47},
+		{"another day", day.Add(24 * time.Hour), day.Add(48 * time.Hour), 0},
+	}
+
+	for _, test := range tests {
+		sum, err := sumHistogram(histogram, test.from, test.to)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if sum != test.sum {
+			t.Errorf("%s: got %d, want %d", test.name, sum, test.sum)
+		}
+	}
+
+	histogram.Buckets = histogram.Buckets[:3]
+	if _, err := sumHistogram(histogram, day, day.Add(time.Hour)); err == nil {
+		t.Error("corrupt histogram: should have failed")
+	}
+}
+
+func TestDownsampleHistogram(t *testing.T) {
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	counts := make([]int64, histogramBuckets)
+	for i := range counts {
+		counts[i] = int64(i+1) * 1e9
+	}
+
+	tests := []struct {
+		name      string
+		histogram NetflowHistogram
+		valid     bool
+	}{
+		{"hourly", NetflowHistogram{Day: day, Buckets: encodeBuckets(counts), Bytes: 300e9}, true},
+		{"empty day", NetflowHistogram{Day: day, Buckets: encodeBuckets(make([]int64, histogramBuckets))}, true},
+		{"total off", NetflowHistogram{Day: day, Buckets: encodeBuckets(counts), Bytes: 299e9}, false},
+		{"corrupt", NetflowHistogram{Day: day, Buckets: encodeBuckets(counts)[:3], Bytes: 300e9}, false},
+	}
+
+	for _, test := range tests {
+		daily, err := downsampleHistogram(test.histogram)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+
+		if daily.Resolution != resolutionDay {
+			t.Errorf("%s: got resolution %q, want %q", test.name, daily.Resolution, resolutionDay)
+		}
+		whole, err := sumHistogram(daily, day, day.Add(24*time.Hour))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if whole != test.histogram.Bytes || daily.Bytes != test.histogram.Bytes {
+			t.Errorf("%s: got %d bytes summed and %d recorded, want %d", test.name, whole, daily.Bytes, test.histogram.Bytes)
+		}
+		if len(daily.Buckets) >= len(test.histogram.Buckets) && test.histogram.Bytes > 0 {
+			t.Errorf("%s: %d bytes of buckets, no smaller than the hourly %d", test.name, len(daily.Buckets), len(test.histogram.Buckets))
+		}
+	}
+}
+
+func TestSumDailyHistogram(t *testing.T) {
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	histogram := NetflowHistogram{Day: day, Resolution: resolutionDay, Buckets: encodeBuckets([]int64{300}), Bytes: 300}
+
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		sum  int64
+	}{
+		{"whole day", day, day.Add(24 * time.Hour), 300},
+		{"month", day.AddDate(0, 0, -10), day.AddDate(0, 0, 20), 300},
+		// Like an hourly bucket, the day counts towards the window its start
+		// falls in
+		{"one hour", day.Add(2 * time.Hour), day.Add(3 * time.Hour), 0},
+		{"from the day before", day.Add(-5 * time.Hour), day.Add(2 * time.Hour), 300},
+		{"another day", day.Add(24 * time.Hour), day.Add(48 * time.Hour), 0},
+	}
+
+	for _, test := range tests {
+		sum, err := sumHistogram(histogram, test.from, test.to)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if sum != test.sum {
+			t.Errorf("%s: got %d, want %d", test.name, sum, test.sum)
+		}
+	}
+}
+
+func TestDownsampleCutoff(t *testing.T) {
+	tests := []struct {
+		now    time.Time
+		months int
+		cutoff time.Time
+	}{
+		{time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC), 6, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC), 6, time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), 1, time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 16, 1, 0, 0, 0, time.FixedZone("UTC+3", 3*3600)), 0, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if cutoff := downsampleCutoff(test.now, test.months); !cutoff.Equal(test.cutoff) {
+			t.Errorf("%v less %d months: got %v, want %v", test.now, test.months, cutoff, test.cutoff)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Points of a collection run hooks are called at
+const (
+	hookPreRun    = "pre-run"
+	hookPerRecord = "per-record"
+	hookPostRun   = "post-run"
+)
+
+// HookEvent is what a hook gets on stdin, as a line of JSON. Usage is set
+// for per-record hooks, Summary for post-run hooks
+type HookEvent struct {
+	Hook    string
+	Network string
+	From    time.Time
+	To      time.Time
+	Members int                   `json:",omitempty"`
+	Usage   *BandwidthUsagePeriod `json:",omitempty"`
+	Summary *RunSummary           `json:",omitempty"`
+}
+
+// hookCommand returns the command configured for a hook, empty if none
+func hookCommand(settings Settings, hook string) string {
+	switch hook {
+	case hookPreRun:
+		return settings.HookPreRun
+	case hookPerRecord:
+		return settings.HookPerRecord
+	case hookPostRun:
+		return settings.HookPostRun
+	}
+	return ""
+}
+
+// runHook runs the executable configured for a hook, if any, with the event
+// on stdin and HOOK_TIMEOUT to finish. The command is split on spaces, not
+// run by a shell, so scripts needing one should be given as a file. Its
+// output is logged
+func runHook(settings Settings, event HookEvent) error {
+	command := strings.Fields(hookCommand(settings, event.Hook))
+	if len(command) == 0 {
+		return nil
+	}
+
+	var stdin bytes.Buffer
+	if err := printJSON(&stdin, event); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.HookTimeout)
+	defer cancel()
+
+	// The output goes to a file rather than a pipe, which children the hook
+	// leaves running would hold open past the timeout
+	outputFile, err := ioutil.TempFile("", "stat-collector-hook")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputFile.Name())
+	defer outputFile.Close()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = &stdin
+	cmd.Stdout = outputFile
+	cmd.Stderr = outputFile
+	cmd.Env = append(os.Environ(), "STAT_COLLECTOR_HOOK="+event.Hook, "STAT_COLLECTOR_NETWORK="+event.Network)
+
+	err = cmd.Run()
+	if output, readErr := ioutil.ReadFile(outputFile.Name()); readErr == nil && len(bytes.TrimSpace(output)) > 0 {
+		log.Printf("%s hook: %s", event.Hook, bytes.TrimSpace(output))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook %s timed out after %s", event.Hook, command[0], settings.HookTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %s: %v", event.Hook, command[0], err)
+	}
+	return nil
+}
+
+// reportHookFailure logs and alerts about a failed per-record or post-run
+// hook, which doesn't stop the usage already collected from being kept
+func reportHookFailure(settings Settings, err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("WARNING: %v", err)
+	publishAlert(settings, Alert{Kind: alertHookFailed, Message: err.Error()})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeHook writes an executable shell script into dir
+func writeHook(t *testing.T, dir string, name string, script string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	received := filepath.Join(dir, "received.json")
+	record := writeHook(t, dir, "record.sh", `echo "$STAT_COLLECTOR_HOOK $STAT_COLLECTOR_NETWORK" > `+received+`.env; cat > `+received+"\n")
+
+	settings := Settings{Network: "casa", HookTimeout: 5 * time.Second, HookPerRecord: record}
+	bwup := usage(1, 2)
+	bwup.Name = "Alice"
+	if err := runHook(settings, HookEvent{Hook: hookPerRecord, Network: "casa", Usage: &bwup}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := HookEvent{}
+	if err := json.Unmarshal(contents, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Hook != hookPerRecord || event.Usage == nil || event.Usage.Name != "Alice" || *event.Usage.Total != 3 {
+		t.Errorf("got %s", contents)
+	}
+	env, err := ioutil.ReadFile(received + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(env) != "per-record casa\n" {
+		t.Errorf("got environment %q", env)
+	}
+
+	// Hooks which aren't configured do nothing
+	if err := runHook(settings, HookEvent{Hook: hookPreRun, Network: "casa"}); err != nil {
+		t.Errorf("no pre-run hook: %v", err)
+	}
+}
+
+func TestRunHookErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		command string
+	}{
+		{"failing", writeHook(t, dir, "fail.sh", "echo portal is down; exit 3\n")},
+		{"slow", writeHook(t, dir, "slow.sh", "sleep 5\n")},
+		{"missing", filepath.Join(dir, "missing.sh")},
+	}
+
+	for _, test := range tests {
+		settings := Settings{Network: "casa", HookTimeout: 200 * time.Millisecond, HookPostRun: test.command}
+		if err := runHook(settings, HookEvent{Hook: hookPostRun, Network: "casa", Summary: &RunSummary{}}); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
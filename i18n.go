@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultLanguage is used for members without a language, or with one there
+// is no catalog for
+const defaultLanguage = "en"
+
+// messageCatalogs holds the text shown to members in each language, keyed by
+// message. Messages missing from a language fall back to English
+var messageCatalogs = map[string]map[string]string{
+	"en": {
+		"link.malformed":       "malformed link token",
+		"link.invalid":         "invalid link signature",
+		"link.expired":         "link expired on %s",
+		"usage.method":         "usage requires GET",
+		"usage.invalid_param":  "invalid %s: %v",
+		"usage.unknown_member": "unknown member %s",
+		"usage.read_error":     "error reading usage",
+		"sms.summary":          `Hi {{.Name}}, you used {{printf "%.1f" .Total}} GB from {{date .From}} to {{date .To}}.`,
+		"sms.warning":          `Hi {{.Name}}, you used {{printf "%.1f" .Total}} GB since {{date .From}}, over the {{printf "%.0f" .Threshold}} GB limit.`,
+		"statement.title":      "Usage statement",
+		"statement.member":     "Member",
+		"statement.month":      "Month",
+		"statement.day":        "Day",
+		"statement.pruned":     "Earlier usage, summarized",
+		"statement.up":         "Up (GB)",
+		"statement.down":       "Down (GB)",
+		"statement.total":      "Total (GB)",
+		"statement.failed":     "The usage of %d periods could not be collected and is missing.",
+		"statement.notes":      "Notes",
+		"statement.corrected":  "The usage of %d periods was corrected by hand.",
+		"date":                 "{month} {day}",
+		"months":               "Jan,Feb,Mar,Apr,May,Jun,Jul,Aug,Sep,Oct,Nov,Dec",
+	},
+	"es": {
+		"link.malformed":       "enlace mal formado",
+		"link.invalid":         "firma del enlace inválida",
+		"link.expired":         "el enlace venció el %s",
+		"usage.method":         "el uso requiere GET",
+		"usage.invalid_param":  "%s inválido: %v",
+		"usage.unknown_member": "miembro desconocido %s",
+		"usage.read_error":     "error al leer el uso",
+		"sms.summary":          `Hola {{.Name}}, usaste {{printf "%.1f" .Total}} GB del {{date .From}} al {{date .To}}.`,
+		"sms.warning":          `Hola {{.Name}}, usaste {{printf "%.1f" .Total}} GB desde el {{date .From}}, más del límite de {{printf "%.0f" .Threshold}} GB.`,
+		"statement.title":      "Estado de uso",
+		"statement.member":     "Miembro",
+		"statement.month":      "Mes",
+		"statement.day":        "Día",
+		"statement.pruned":     "Uso anterior, resumido",
+		"statement.up":         "Subida (GB)",
+		"statement.down":       "Bajada (GB)",
+		"statement.total":      "Total (GB)",
+		"statement.failed":     "No se pudo recolectar el uso de %d periodos y falta.",
+		"statement.notes":      "Notas",
+		"statement.corrected":  "El uso de %d periodos fue corregido a mano.",
+		"date":                 "{day} de {month}",
+		"months":               "ene,feb,mar,abr,may,jun,jul,ago,sep,oct,nov,dic",
+	},
+}
+
+// languageNames maps the names a language may be written as in Airtable to
+// its code
+var languageNames = map[string]string{
+	"english": "en",
+	"inglés":  "en",
+	"ingles":  "en",
+	"spanish": "es",
+	"español": "es",
+	"espanol": "es",
+}
+
+// loadMessageCatalogs adds the catalogs in dir, one JSON file per language
+// named like es.json, over the built in ones
+func loadMessageCatalogs(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		messages := map[string]string{}
+		if err := json.Unmarshal(contents, &messages); err != nil {
+			return fmt.Errorf("message catalog %s is not valid: %v", file, err)
+		}
+
+		language := strings.TrimSuffix(filepath.Base(file), ".json")
+		if messageCatalogs[language] == nil {
+			messageCatalogs[language] = map[string]string{}
+		}
+		for key, text := range messages {
+			messageCatalogs[language][key] = text
+		}
+	}
+	return nil
+}
+
+// normalizeLanguage turns a language name, code or tag like es-MX into the
+// code of a catalog, or "" if there is none for it
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if code, ok := languageNames[language]; ok {
+		return code
+	}
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+	if _, ok := messageCatalogs[language]; ok {
+		return language
+	}
+	return ""
+}
+
+// acceptedLanguage picks the first language of an Accept-Language header
+// there is a catalog for
+func acceptedLanguage(header string) string {
+	for _, tag := range strings.Split(header, ",") {
+		if i := strings.Index(tag, ";"); i >= 0 {
+			tag = tag[:i]
+		}
+		if language := normalizeLanguage(tag); language != "" {
+			return language
+		}
+	}
+	return ""
+}
+
+// memberLanguage is the language a member is addressed in
+func memberLanguage(settings Settings, member MeshMember) string {
+	if language := normalizeLanguage(member.Fields.Language); language != "" {
+		return language
+	}
+	if language := normalizeLanguage(settings.DefaultLanguage); language != "" {
+		return language
+	}
+	return defaultLanguage
+}
+
+// catalogMessage returns the text of a message in the language, in English
+// if the language's catalog doesn't have it
+func catalogMessage(language string, key string) string {
+	if text, ok := messageCatalogs[language][key]; ok {
+		return text
+	}
+	return messageCatalogs[defaultLanguage][key]
+}
+
+// translate formats a message in the language
+func translate(language string, key string, args ...interface{}) string {
+	return fmt.Sprintf(catalogMessage(language, key), args...)
+}
+
+// monthName is the short name of a month in the language
+func monthName(language string, t time.Time) string {
+	months := strings.Split(catalogMessage(language, "months"), ",")
+	if len(months) == 12 {
+		return months[t.Month()-1]
+	}
+	return t.Month().String()
+}
+
+// formatDate writes a day of the year in the language
+func formatDate(language string, t time.Time) string {
+	return strings.NewReplacer("{month}", monthName(language, t), "{day}", fmt.Sprint(t.Day()), "{year}", fmt.Sprint(t.Year())).Replace(catalogMessage(language, "date"))
+}
+
+// formatMonth writes a month and its year in the language
+func formatMonth(language string, t time.Time) string {
+	return fmt.Sprintf("%s %d", monthName(language, t), t.Year())
+}
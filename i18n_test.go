@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	tests := map[string]string{
+		"es":      "es",
+		"es-MX":   "es",
+		"ES_co":   "es",
+		"Español": "es",
+		"English": "en",
+		" en ":    "en",
+		"fr":      "",
+		"":        "",
+	}
+
+	for language, want := range tests {
+		if got := normalizeLanguage(language); got != want {
+			t.Errorf("%q: got %q, want %q", language, got, want)
+		}
+	}
+}
+
+func TestAcceptedLanguage(t *testing.T) {
+	tests := map[string]string{
+		"es-MX,es;q=0.9,en;q=0.8": "es",
+		"fr-FR,fr;q=0.9,en;q=0.5": "en",
+		"de":                      "",
+		"":                        "",
+	}
+
+	for header, want := range tests {
+		if got := acceptedLanguage(header); got != want {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestMemberLanguage(t *testing.T) {
+	member := MeshMember{}
+	if got := memberLanguage(Settings{DefaultLanguage: "es"}, member); got != "es" {
+		t.Errorf("got %q without a member language, want the default", got)
+	}
+
+	member.Fields.Language = "English"
+	if got := memberLanguage(Settings{DefaultLanguage: "es"}, member); got != "en" {
+		t.Errorf("got %q, want the member's language", got)
+	}
+
+	member.Fields.Language = "Klingon"
+	if got := memberLanguage(Settings{}, member); got != defaultLanguage {
+		t.Errorf("got %q for a language without a catalog", got)
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	day := time.Date(2026, 8, 9, 0, 0, 0, 0, time.UTC)
+	if got := formatDate("en", day); got != "Aug 9" {
+		t.Errorf("got %q in English", got)
+	}
+	if got := formatDate("es", day); got != "9 de ago" {
+		t.Errorf("got %q in Spanish", got)
+	}
+}
+
+func TestSpanishSMS(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	member := smsMember("recA", "Ana", "+525512345678", true)
+	member.Fields.Language = "es"
+
+	messages, err := planSMS(smsTestSettings(), smsWarning, []MeshMember{member}, map[string]SMSMessage{
+		"recA": {Name: "Ana", From: from, To: from.AddDate(0, 1, 0), Total: 61, Threshold: 50},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hola Ana, usaste 61.0 GB desde el 1 de sep, más del límite de 50 GB."; messages["+525512345678"] != want {
+		t.Errorf("got %q, want %q", messages["+525512345678"], want)
+	}
+}
+
+func TestLoadMessageCatalogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Restore the built in catalogs for the other tests
+	saved := map[string]map[string]string{}
+	for language, messages := range messageCatalogs {
+		saved[language] = map[string]string{}
+		for key, text := range messages {
+			saved[language][key] = text
+		}
+	}
+	defer func() { messageCatalogs = saved }()
+
+	ioutil.WriteFile(filepath.Join(dir, "pt.json"), []byte(`{"usage.read_error": "erro ao ler o uso"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "es.json"), []byte(`{"link.invalid": "enlace inválido"}`), 0644)
+	if err := loadMessageCatalogs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := translate("pt", "usage.read_error"); got != "erro ao ler o uso" {
+		t.Errorf("got %q from a new catalog", got)
+	}
+	if got := translate("pt", "usage.method"); got != "usage requires GET" {
+		t.Errorf("got %q for a message missing from a catalog, want English", got)
+	}
+	if got := translate("es", "link.invalid"); got != "enlace inválido" {
+		t.Errorf("got %q from an overridden message", got)
+	}
+	if normalizeLanguage("pt-BR") != "pt" {
+		t.Error("a loaded catalog's language isn't recognized")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte(`[`), 0644)
+	if err := loadMessageCatalogs(dir); err == nil {
+		t.Error("an invalid catalog should fail")
+	}
+}
+
+func TestLinkErrorMessage(t *testing.T) {
+	err := verifyMemberLink("secret", memberLink{Expires: time.Unix(0, 0)}, "payload", linkSignature("secret", "payload"), time.Now())
+	if err == nil || err.Error() != "link expired on "+time.Unix(0, 0).Format(time.RFC3339) {
+		t.Fatalf("got %v", err)
+	}
+	if got := linkErrorMessage(err, "es"); got != "el enlace venció el "+time.Unix(0, 0).Format(time.RFC3339) {
+		t.Errorf("got %q in Spanish", got)
+	}
+}
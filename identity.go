@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Member fields traffic can be attributed by, selected with MEMBER_IDENTITY.
+// Not every network logs WireGuard keys, some only see routers by MAC,
+// static IP or hostname
+const (
+	memberIdentityWGKey     = "wg-key"
+	memberIdentityRouterMAC = "router-mac"
+	memberIdentityStaticIP  = "static-ip"
+	memberIdentityHostname  = "hostname"
+	memberIdentityMeshIP    = "mesh-ip"
+)
+
+// memberIdentityFields are, for each identity, the Airtable field holding
+// it and the Graylog field it is logged in by default
+var memberIdentityFields = map[string]struct {
+	column   string
+	keyField string
+}{
+	memberIdentityWGKey:     {"WG Key", "wg_key"},
+	memberIdentityRouterMAC: {"Router MAC", "router_mac"},
+	memberIdentityStaticIP:  {"Static IP", "static_ip"},
+	memberIdentityHostname:  {"Hostname", "hostname"},
+	memberIdentityMeshIP:    {"Mesh IP", "mesh_ip"},
+}
+
+// validMemberIdentity tells whether the identity is known, "" being the
+// default wg-key
+func validMemberIdentity(identity string) bool {
+	_, ok := memberIdentityFields[identity]
+	return identity == "" || ok
+}
+
+// identityKeyField is the default GRAYLOG_KEY_FIELD of an identity
+func identityKeyField(identity string) string {
+	if fields, ok := memberIdentityFields[identity]; ok {
+		return fields.keyField
+	}
+	return memberIdentityFields[memberIdentityWGKey].keyField
+}
+
+// identityColumn is the Airtable field, and members CSV column, of an
+// identity
+func identityColumn(identity string) string {
+	if fields, ok := memberIdentityFields[identity]; ok {
+		return fields.column
+	}
+	return memberIdentityFields[memberIdentityWGKey].column
+}
+
+// identityValue returns the member's value of an identity
+func identityValue(identity string, member MeshMember) string {
+	switch identity {
+	case memberIdentityRouterMAC:
+		return strings.TrimSpace(member.Fields.RouterMAC)
+	case memberIdentityStaticIP:
+		return strings.TrimSpace(member.Fields.StaticIP)
+	case memberIdentityHostname:
+		return strings.TrimSpace(member.Fields.Hostname)
+	case memberIdentityMeshIP:
+		return strings.TrimSpace(member.Fields.MeshIP)
+	}
+	return strings.TrimSpace(member.Fields.WGKey)
+}
+
+// memberIdentity returns what the member's traffic is logged under, the
+// key the queries look for. A member without one can't be queried, as an
+// empty key would match everyone's traffic
+func memberIdentity(settings Settings, member MeshMember) (string, error) {
+	return identityKey(settings.MemberIdentity, member)
+}
+
+// setIdentityValue sets the member's value of an identity
+func setIdentityValue(identity string, member *MeshMember, value string) {
+	switch identity {
+	case memberIdentityRouterMAC:
+		member.Fields.RouterMAC = value
+	case memberIdentityStaticIP:
+		member.Fields.StaticIP = value
+	case memberIdentityHostname:
+		member.Fields.Hostname = value
+	case memberIdentityMeshIP:
+		member.Fields.MeshIP = value
+	default:
+		member.Fields.WGKey = value
+	}
+}
+
+// identityKey returns the member's value of an identity, failing if they
+// have none
+func identityKey(identity string, member MeshMember) (string, error) {
+	if identity == "" {
+		identity = memberIdentityWGKey
+	}
+
+	value := identityValue(identity, member)
+	if value == "" {
+		return "", fmt.Errorf("%s has no %s to attribute traffic by", strings.TrimSpace(member.Fields.Name), identityColumn(identity))
+	}
+	return value, nil
+}
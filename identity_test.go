@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemberIdentity(t *testing.T) {
+	member := MeshMember{}
+	member.Fields.Name = "Alice"
+	member.Fields.WGKey = "aliceKey+/="
+	member.Fields.RouterMAC = " AA:BB:CC:DD:EE:FF "
+	member.Fields.StaticIP = "10.0.0.12"
+	member.Fields.MeshIP = "fd00::12"
+
+	tests := []struct {
+		identity string
+		key      string
+		valid    bool
+	}{
+		{"", "aliceKey+/=", true},
+		{memberIdentityWGKey, "aliceKey+/=", true},
+		{memberIdentityRouterMAC, "AA:BB:CC:DD:EE:FF", true},
+		{memberIdentityStaticIP, "10.0.0.12", true},
+		{memberIdentityMeshIP, "fd00::12", true},
+		// An empty key would match everyone's traffic
+		{memberIdentityHostname, "", false},
+	}
+
+	for _, test := range tests {
+		key, err := memberIdentity(Settings{MemberIdentity: test.identity}, member)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.identity, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.identity)
+			}
+			continue
+		}
+		if key != test.key {
+			t.Errorf("%s: got %q, want %q", test.identity, key, test.key)
+		}
+	}
+
+	if validMemberIdentity("mac") {
+		t.Error("mac: should have failed")
+	}
+}
+
+func TestMemberIdentityKeyField(t *testing.T) {
+	tests := []struct {
+		env      settingsEnv
+		keyField string
+	}{
+		{settingsEnv{}, "wg_key"},
+		{settingsEnv{"MEMBER_IDENTITY": memberIdentityStaticIP}, "static_ip"},
+		{settingsEnv{"MEMBER_IDENTITY": memberIdentityHostname, "GRAYLOG_KEY_FIELD": "source"}, "source"},
+	}
+
+	for _, test := range tests {
+		if settings, _ := readSettings("casa", test.env); settings.GraylogKeyField != test.keyField {
+			t.Errorf("%v: got key field %q, want %q", test.env, settings.GraylogKeyField, test.keyField)
+		}
+	}
+}
+
+func TestGraylogSourceIdentity(t *testing.T) {
+	queries := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"count": 1, "sum": 1000000000}`))
+	}))
+	defer server.Close()
+
+	settings, _ := readSettings("casa", settingsEnv{"MEMBER_IDENTITY": memberIdentityRouterMAC, "GRAYLOG_QUERY_MODE": queryModeGELF})
+	settings.GraylogURL = server.URL + "/"
+	source, err := newStatSource(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member := MeshMember{}
+	member.Fields.Name = "Carol"
+	member.Fields.RouterMAC = "aa:bb:cc:dd:ee:ff"
+	to := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	if _, err := source.Sum(member, "up", to.Add(-time.Hour), to); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 || queries[0] != `router_mac:"aa:bb:cc:dd:ee:ff"` {
+		t.Errorf("got queries %q", queries)
+	}
+
+	// Members without a MAC fail rather than match everyone
+	member.Fields.RouterMAC = ""
+	if _, err := source.Sum(member, "up", to.Add(-time.Hour), to); err == nil {
+		t.Error("no MAC: should have failed")
+	}
+	if len(queries) != 1 {
+		t.Errorf("got %d queries, want none for the member without a MAC", len(queries))
+	}
+
+	settings.MemberIdentity = "mac"
+	if _, err := newStatSource(settings); err == nil {
+		t.Error("unknown identity: should have failed")
+	}
+}
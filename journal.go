@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalEntry is a line of the journal: a period about to be written to
+// the sinks, or the mark that the one with the ID was written
+type journalEntry struct {
+	ID    string
+	Usage *BandwidthUsagePeriod `json:",omitempty"`
+	Done  bool                  `json:",omitempty"`
+}
+
+// JournalStore journals each period to JOURNAL_FILE before writing it to
+// the sinks, and marks it done once they all took it. Periods left without
+// the mark by a crash or a failed write are written again when the next
+// store of their network is opened, so every sink gets every period at
+// least once, the duplicate policy deciding about the ones it got already
+type JournalStore struct {
+	store UsageStore
+	path  string
+	// prefix makes the IDs of the process's entries unique in the journal
+	prefix string
+
+	mutex sync.Mutex
+	count int
+}
+
+// newJournalStore journals the periods written to store, first writing the
+// network's periods the journal holds which were never marked done
+func newJournalStore(settings Settings, store UsageStore) (*JournalStore, error) {
+	replayed, err := replayJournal(settings.JournalFile, settings.Network, store)
+	if replayed > 0 {
+		log.Printf("Replayed %d journaled periods of network %s", replayed, settings.Network)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replaying %s: %v", settings.JournalFile, err)
+	}
+
+	return &JournalStore{
+		store:  store,
+		path:   settings.JournalFile,
+		prefix: fmt.Sprintf("%d-%d", time.Now().UnixNano(), os.Getpid()),
+	}, nil
+}
+
+func (s *JournalStore) Insert(bwup BandwidthUsagePeriod) error {
+	s.mutex.Lock()
+	s.count++
+	id := fmt.Sprintf("%s-%d", s.prefix, s.count)
+	s.mutex.Unlock()
+
+	if err := appendJournal(s.path, journalEntry{ID: id, Usage: &bwup}, true); err != nil {
+		return fmt.Errorf("journaling the usage of %s: %v", bwup.Name, err)
+	}
+
+	if err := s.store.Insert(bwup); err != nil {
+		return err
+	}
+
+	// A mark lost in a crash only writes the period again
+	if err := appendJournal(s.path, journalEntry{ID: id, Done: true}, false); err != nil {
+		log.Printf("WARNING: marking the usage of %s journaled: %v", bwup.Name, err)
+	}
+	return nil
+}
+
+// appendJournal appends an entry to the journal, syncing it to disk if sync
+// is set
+func appendJournal(path string, entry journalEntry, sync bool) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// replayJournal writes the network's periods which were never marked done
+// to the store, and compacts the journal to the periods left: other
+// networks', and the network's ones from the first the store refused on, as
+// it is likely still down
+func replayJournal(path string, network string, store UsageStore) (int, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	file, err := lockFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	entries := []journalEntry{}
+	done := map[string]bool{}
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// The last line may have been cut short by the crash
+			log.Printf("WARNING: skipping a corrupt line of %s: %v", path, err)
+			continue
+		}
+		if entry.Done {
+			done[entry.ID] = true
+			continue
+		}
+		if entry.Usage != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	var keep bytes.Buffer
+	replayed := 0
+	var insertErr error
+	for _, entry := range entries {
+		if done[entry.ID] {
+			continue
+		}
+		if entry.Usage.Network == network && insertErr == nil {
+			insertErr = store.Insert(*entry.Usage)
+			if _, ok := insertErr.(DuplicateError); ok {
+				log.Printf("Dropping journaled usage: %v", insertErr)
+				insertErr = nil
+			}
+			if insertErr == nil {
+				replayed++
+				continue
+			}
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return replayed, err
+		}
+		keep.Write(line)
+		keep.WriteByte('\n')
+	}
+
+	if err := replaceFile(path, keep.Bytes()); err != nil {
+		return replayed, err
+	}
+	return replayed, insertErr
+}
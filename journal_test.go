@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJournalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+	settings := Settings{Network: "casa", JournalFile: path}
+
+	sinks := &flakyStore{}
+	journal, err := newJournalStore(settings, sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Insert(spilledPeriod("casa", "Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sink refusing Bob's period stops the run before it is marked done
+	sinks.failures = 1
+	if err := journal.Insert(spilledPeriod("casa", "Bob")); err == nil {
+		t.Fatal("should have failed")
+	}
+	if err := (&JournalStore{store: &flakyStore{failures: 1}, path: path, prefix: "other"}).Insert(spilledPeriod("vecinos", "Dave")); err == nil {
+		t.Fatal("should have failed")
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(contents), "\n"); lines != 4 {
+		t.Errorf("got %d journal lines, want Alice's period and mark and the two failed periods", lines)
+	}
+
+	// The next run's store writes Bob's period again, and only his
+	next := &flakyStore{}
+	if _, err := newJournalStore(settings, next); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.inserted) != 1 || next.inserted[0].Name != "Bob" || *next.inserted[0].Total != 3 {
+		t.Errorf("got %+v replayed, want Bob's period", next.inserted)
+	}
+	if _, err := newJournalStore(settings, next); err != nil || len(next.inserted) != 1 {
+		t.Errorf("got %d replayed and error %v, want nothing replayed twice", len(next.inserted)-1, err)
+	}
+
+	// Until its network's store is opened, Dave's period is kept
+	vecinos := &flakyStore{}
+	if _, err := newJournalStore(Settings{Network: "vecinos", JournalFile: path}, vecinos); err != nil {
+		t.Fatal(err)
+	}
+	if len(vecinos.inserted) != 1 || vecinos.inserted[0].Name != "Dave" {
+		t.Errorf("got %+v replayed, want Dave's period", vecinos.inserted)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the replayed journal removed, got %v", err)
+	}
+}
+
+func TestReplayJournalFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+
+	for i, name := range []string{"Alice", "Bob"} {
+		period := spilledPeriod("casa", name)
+		if err := appendJournal(path, journalEntry{ID: string(rune('a' + i)), Usage: &period}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Cut short by the crash
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"ID":"c","Usage":{"Netw`)
+	file.Close()
+
+	// Still down: the store's refusal keeps both
+	down := &flakyStore{failures: 1}
+	if _, err := newJournalStore(Settings{Network: "casa", JournalFile: path}, down); err == nil {
+		t.Error("store down: should have failed")
+	}
+
+	up := &flakyStore{}
+	replayed, err := replayJournal(path, "casa", up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 2 || up.inserted[0].Name != "Alice" || up.inserted[1].Name != "Bob" {
+		t.Errorf("got %d replayed: %+v", replayed, up.inserted)
+	}
+
+	if replayed, err := replayJournal(filepath.Join(dir, "missing.jsonl"), "casa", up); err != nil || replayed != 0 {
+		t.Errorf("no journal: got %d replayed and error %v", replayed, err)
+	}
+}
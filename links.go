@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memberLink is what a signed self-service link grants: reading the usage of
+// one member of a network until it expires
+type memberLink struct {
+	Network  string
+	MemberID string
+	Expires  time.Time
+}
+
+func linkSignature(secret string, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signMemberLink encodes the link as "<payload>.<signature>", both base64url
+func signMemberLink(secret string, link memberLink) string {
+	payload := strings.Join([]string{link.Network, link.MemberID, strconv.FormatInt(link.Expires.Unix(), 10)}, "|")
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(linkSignature(secret, payload))
+}
+
+// LinkError is a link which can't be used, with the catalog key of the
+// message telling members why
+type LinkError struct {
+	Key  string
+	Args []interface{}
+}
+
+func (e LinkError) Error() string {
+	return translate(defaultLanguage, e.Key, e.Args...)
+}
+
+// Message tells why the link can't be used in the language
+func (e LinkError) Message(language string) string {
+	return translate(language, e.Key, e.Args...)
+}
+
+// parseMemberLink decodes a link token without checking it, so the secret of
+// the network it names can be looked up
+func parseMemberLink(token string) (memberLink, string, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return memberLink{}, "", nil, LinkError{Key: "link.malformed"}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return memberLink{}, "", nil, LinkError{Key: "link.malformed"}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return memberLink{}, "", nil, LinkError{Key: "link.malformed"}
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return memberLink{}, "", nil, LinkError{Key: "link.malformed"}
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return memberLink{}, "", nil, LinkError{Key: "link.malformed"}
+	}
+
+	link := memberLink{Network: fields[0], MemberID: fields[1], Expires: time.Unix(expires, 0)}
+	return link, string(payload), signature, nil
+}
+
+// verifyMemberLink checks a parsed link was signed with the secret and
+// hasn't expired
+func verifyMemberLink(secret string, link memberLink, payload string, signature []byte, now time.Time) error {
+	if secret == "" || !hmac.Equal(signature, linkSignature(secret, payload)) {
+		return LinkError{Key: "link.invalid"}
+	}
+	if now.After(link.Expires) {
+		return LinkError{Key: "link.expired", Args: []interface{}{link.Expires.Format(time.RFC3339)}}
+	}
+	return nil
+}
+
+// linkCommand prints a signed link to a member's usage, valid for
+// LINK_VALIDITY or the given duration
+func linkCommand(args []string) {
+	settings := loadSettings()
+
+	if len(args) == 0 {
+		fatal("usage: stat-collector link <member record id> [validity]")
+	}
+	if settings.LinkSecret == "" {
+		fatal("LINK_SECRET must be set to sign links")
+	}
+
+	validity := settings.LinkValidity
+	if len(args) > 1 {
+		var err error
+		if validity, err = time.ParseDuration(args[1]); err != nil {
+			fatal(err)
+		}
+	}
+
+	token := signMemberLink(settings.LinkSecret, memberLink{
+		Network:  settings.Network,
+		MemberID: args[0],
+		Expires:  time.Now().Add(validity),
+	})
+
+	fmt.Println(strings.TrimSuffix(settings.LinkBaseURL, "/") + "/api/v1/self?token=" + url.QueryEscape(token))
+}
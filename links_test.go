@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemberLinks(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	link := memberLink{Network: "casa", MemberID: "rec1", Expires: now.Add(time.Hour)}
+	token := signMemberLink("secret", link)
+
+	// Swaps the signature of a token for another's
+	resign := func(token string, other string) string {
+		return strings.Split(token, ".")[0] + "." + strings.Split(other, ".")[1]
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+		now    time.Time
+		parsed bool
+		valid  bool
+	}{
+		{"valid", token, "secret", now, true, true},
+		{"expired", token, "secret", now.Add(2 * time.Hour), true, false},
+		{"other secret", token, "other", now, true, false},
+		{"no secret configured", token, "", now, true, false},
+		{"other member", resign(signMemberLink("secret", memberLink{Network: "casa", MemberID: "rec2", Expires: link.Expires}), token), "secret", now, true, false},
+		{"extended", resign(signMemberLink("secret", memberLink{Network: "casa", MemberID: "rec1", Expires: now.Add(48 * time.Hour)}), token), "secret", now, true, false},
+		{"no signature", strings.Split(token, ".")[0], "secret", now, false, false},
+		{"extra part", token + ".x", "secret", now, false, false},
+		{"not base64", "!!." + strings.Split(token, ".")[1], "secret", now, false, false},
+		{"empty", "", "secret", now, false, false},
+	}
+
+	for _, test := range tests {
+		parsed, payload, signature, err := parseMemberLink(test.token)
+		if (err == nil) != test.parsed {
+			t.Errorf("%s: parsing returned %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		err = verifyMemberLink(test.secret, parsed, payload, signature, test.now)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: verifying returned %v", test.name, err)
+		}
+		if test.valid && (parsed.Network != link.Network || parsed.MemberID != link.MemberID || !parsed.Expires.Equal(link.Expires)) {
+			t.Errorf("%s: got link %+v, want %+v", test.name, parsed, link)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LokiSource sums byte counts from exit logs shipped to Grafana Loki, using
+// a LogQL metric query evaluated at the end of the window
+type LokiSource struct {
+	settings Settings
+}
+
+func (s LokiSource) Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error) {
+	key, err := memberIdentity(s.settings, member)
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildLokiQuery(s.settings, direction, key, to.Sub(from))
+	if err != nil {
+		return nil, err
+	}
+
+	return queryLokiSum(s.settings, query, to)
+}
+
+// buildLokiQuery fills in the configured LogQL template. {key} is replaced
+// with the member's key and {range} with the length of the window
+func buildLokiQuery(settings Settings, direction string, wgKey string, window time.Duration) (string, error) {
+	var template string
+
+	if direction == "up" {
+		template = settings.LokiUpQuery
+	} else if direction == "down" {
+		template = settings.LokiDownQuery
+	} else {
+		return "", fmt.Errorf("invalid direction argument %q", direction)
+	}
+
+	// LogQL range selectors don't accept fractional durations
+	rangeString := strconv.FormatInt(int64(window/time.Second), 10) + "s"
+
+	query := strings.Replace(template, "{key}", escapeLucenePhrase(wgKey), -1)
+	return strings.Replace(query, "{range}", rangeString, -1), nil
+}
+
+func queryLokiSum(settings Settings, query string, at time.Time) (*float64, error) {
+	lokiClient := http.Client{
+		Timeout: time.Second * 60,
+	}
+
+	params := url.Values{
+		"query": []string{query},
+		"time":  []string{strconv.FormatInt(at.UnixNano(), 10)},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, settings.LokiURL+"loki/api/v1/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.LokiUser != "" {
+		req.SetBasicAuth(settings.LokiUser, settings.LokiPass)
+	}
+	if settings.LokiOrgID != "" {
+		req.Header.Add("X-Scope-OrgID", settings.LokiOrgID)
+	}
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := lokiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("loki returned %s: %s", resp.Status, bodyText)
+	}
+
+	// An instant vector query returns one sample per series, each a
+	// [timestamp, "value"] pair
+	type LokiRes struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Value []interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+
+	var lokiRes LokiRes
+	if err := json.Unmarshal(bodyText, &lokiRes); err != nil {
+		return nil, err
+	}
+
+	if lokiRes.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("loki query returned a %q result, expected a vector", lokiRes.Data.ResultType)
+	}
+
+	// Loki omits series without samples, so an empty result means no usage
+	var total *float64
+	for _, series := range lokiRes.Data.Result {
+		if len(series.Value) != 2 {
+			continue
+		}
+		valueString, ok := series.Value[1].(string)
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(valueString, 64)
+		if err != nil {
+			return nil, err
+		}
+		sum := bytesToGb(value)
+		total = addSums(total, &sum)
+	}
+
+	return total, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// lookupMaxWindow is the longest window looked up at once, as lookups query
+// the stat source while the caller waits
+const lookupMaxWindow = 31 * 24 * time.Hour
+
+// lookupMember is the member whose traffic is logged under key: the
+// registered one, so that their overrides apply, or else an unregistered
+// member named after the key
+func lookupMember(settings Settings, members []MeshMember, key string) MeshMember {
+	for _, member := range members {
+		if identityValue(settings.MemberIdentity, member) == key {
+			return member
+		}
+	}
+
+	member := MeshMember{}
+	member.Fields.Name = key
+	setIdentityValue(settings.MemberIdentity, &member, key)
+	return member
+}
+
+// checkLookupWindow refuses windows which can't be looked up
+func checkLookupWindow(from time.Time, to time.Time) error {
+	if !to.After(from) {
+		return fmt.Errorf("the window must end after it starts")
+	}
+	if to.Sub(from) > lookupMaxWindow {
+		return fmt.Errorf("the window can't be longer than %s", lookupMaxWindow)
+	}
+	return nil
+}
+
+// lookupUsage queries a member's usage over a window without storing it,
+// for support staff looking into a complaint. Unlike collection it doesn't
+// alert about the usage's warnings
+func lookupUsage(settings Settings, member MeshMember, from time.Time, to time.Time) (BandwidthUsagePeriod, error) {
+	if err := checkLookupWindow(from, to); err != nil {
+		return BandwidthUsagePeriod{}, err
+	}
+
+	settings = windowSettings(settings, timeWindow{From: from, To: to})
+	source, err := newStatSource(settings)
+	if err != nil {
+		return BandwidthUsagePeriod{}, err
+	}
+
+	up, down, total, counts, err := getBandwidthSums(settings, source, member)
+	if err != nil {
+		return BandwidthUsagePeriod{}, err
+	}
+
+	bwup := BandwidthUsagePeriod{
+		Network:  settings.Network,
+		MemberID: member.ID,
+		Name:     strings.TrimSpace(member.Fields.Name),
+		From:     from,
+		To:       to,
+		Duration: to.Sub(from),
+		Up:       up,
+		Down:     down,
+		Total:    total,
+		Status:   usageStatusOK,
+		Counts:   counts,
+	}
+	if total == nil {
+		bwup.Status = usageStatusNoData
+	}
+	bwup.Warnings = checkMessageCounts(settings, bwup)
+	return bwup, nil
+}
+
+// lookupCommand prints the usage logged under a WireGuard key, or the
+// member identity in use, over the window given, without storing it
+func lookupCommand(args []string) {
+	flags := flag.NewFlagSet("lookup", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fatal("usage: stat-collector lookup <key> duration [end_time]")
+	}
+	from, to, _ := parseWindow(flags.Args()[1:])
+
+	settings := loadSettings()
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	bwup, err := lookupUsage(settings, lookupMember(settings, members, flags.Arg(0)), from, to)
+	if err != nil {
+		fatal(err)
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+	report.Write(bwup)
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// handleLookup answers viewers with the usage logged under the key param
+// between from and to, the last day by default, queried from the stat
+// source rather than read from what was stored
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "lookups require GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), roleViewer)
+	if !ok {
+		return
+	}
+
+	key := strings.TrimSpace(query.Get("key"))
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "a lookup needs a key")
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	for param, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if query.Get(param) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, param+" must be an RFC 3339 time")
+			return
+		}
+		*value = parsed
+	}
+	if err := checkLookupWindow(from, to); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	members, err := tenant.members.Members()
+	if err != nil {
+		log.Printf("Error refreshing members: %v", err)
+	}
+
+	log.Printf("Looking up the usage of %s from %s to %s for the %s role", key, from, to, token.Role)
+	bwup, err := lookupUsage(tenant.settings, lookupMember(tenant.settings, members, key), from, to)
+	if err != nil {
+		log.Printf("Error looking up usage: %v", err)
+		writeJSONError(w, http.StatusBadGateway, "error looking up usage: "+err.Error())
+		return
+	}
+	writeJSON(w, bwup)
+}
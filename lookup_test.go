@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLookupUsage(t *testing.T) {
+	queries := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		fmt.Fprint(w, `{"count": 1, "sum": 2000000000}`)
+	}))
+	defer server.Close()
+
+	settings := Settings{Network: "casa", GraylogURL: server.URL + "/", GraylogQueryMode: queryModePhrase}
+	registered := MeshMember{ID: "rec1"}
+	registered.Fields.Name = "Alice"
+	registered.Fields.WGKey = "key1"
+	members := []MeshMember{registered}
+
+	if member := lookupMember(settings, members, "key1"); member.ID != "rec1" {
+		t.Errorf("got %+v, want Alice", member)
+	}
+	unknown := lookupMember(settings, members, "key9")
+	if unknown.ID != "" || unknown.Fields.Name != "key9" || unknown.Fields.WGKey != "key9" {
+		t.Errorf("got %+v, want an unregistered member", unknown)
+	}
+	if member := lookupMember(Settings{MemberIdentity: memberIdentityRouterMAC}, members, "aa:bb"); member.Fields.RouterMAC != "aa:bb" {
+		t.Errorf("got %+v, want the key as router MAC", member)
+	}
+
+	from := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	bwup, err := lookupUsage(settings, unknown, from, from.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bwup.Status != usageStatusOK || *bwup.Total != 4 || bwup.Name != "key9" || len(queries) != 2 {
+		t.Errorf("got %+v after queries %v", bwup, queries)
+	}
+
+	for _, to := range []time.Time{from, from.Add(-time.Hour), from.Add(40 * 24 * time.Hour)} {
+		if _, err := lookupUsage(settings, unknown, from, to); err == nil {
+			t.Errorf("window to %s: should have failed", to)
+		}
+	}
+}
+
+func TestLookupRoutes(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens}}, nil)
+	routes := server.routes()
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"GET", "/api/v1/lookup?key=key1", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/lookup?key=key1", "mine", http.StatusForbidden},
+		{"POST", "/api/v1/lookup?key=key1", "view", http.StatusMethodNotAllowed},
+		{"GET", "/api/v1/lookup", "view", http.StatusBadRequest},
+		{"GET", "/api/v1/lookup?key=key1&from=2026-10-01T00:00:00Z&to=2026-12-01T00:00:00Z", "view", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s %s: got status %d, want %d", test.method, test.path, test.token, w.Code, test.status)
+		}
+	}
+}
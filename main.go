@@ -1,56 +1,109 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/fabioberger/airtable-go"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-type Settings struct {
-	AirtableAPIKey    string
-	AirtableBaseID    string
-	AirtableTableName string
-	GraylogURL        string
-	GraylogUser       string
-	GraylogPass       string
-	From              time.Time
-	To                time.Time
-	Duration          time.Duration
-	MongoDatabase     string
-	MongoCollection   string
-	MongoURL          string
-}
-
 type MeshMember struct {
 	ID     string
 	Fields struct {
 		Name     string
 		WGKey    string `json:"WG Key"`
+		MeshIP   string `json:"Mesh IP"`
 		Upstream []string
+		CRMID    string `json:"CRM ID"`
+		Phone    string
+		SMSOptIn bool `json:"SMS Opt In"`
+		Language string
+		PlanMbps float64 `json:"Plan Mbps"`
+		// Tags are the member's groups, from a multi-select column, like
+		// "neighborhood:Centro" or "site:Water Tower"
+		Tags []string
+		// Site is the tower or relay site serving the member, Latitude and
+		// Longitude where the member is, all optional
+		Site      string
+		Latitude  *float64
+		Longitude *float64
+
+		// RouterMAC, StaticIP and Hostname identify members on networks
+		// whose logs don't have WireGuard keys, see MEMBER_IDENTITY
+		RouterMAC string `json:"Router MAC"`
+		StaticIP  string `json:"Static IP"`
+		Hostname  string
+
+		// Overrides is the JSON of the member's MemberOverride, if any
+		Overrides string
+
+		// PrepaidGB is the GB a prepaid member bought, which their usage is
+		// charged against along with their top-ups
+		PrepaidGB *float64 `json:"Prepaid GB"`
+
+		// TrackingOptOut is checked for members who opted out of detailed
+		// tracking, see CONSENT_OPT_OUT
+		TrackingOptOut bool `json:"Tracking Opt Out"`
 	}
+	// Override is read from Overrides or MEMBER_OVERRIDES_FILE
+	Override *MemberOverride `json:",omitempty"`
 }
 
+// Usage statuses. A period with no data was checked and had no traffic, one
+// which failed couldn't be checked and must not be billed as free
+const (
+	usageStatusOK     = "ok"
+	usageStatusNoData = "no-data"
+	usageStatusFailed = "failed"
+)
+
+// BandwidthUsagePeriod is the usage of a member over a window. MemberID is
+// the member's Airtable record ID, which unlike Name doesn't change when the
+// member is renamed
 type BandwidthUsagePeriod struct {
+	Network  string
+	MemberID string `json:",omitempty" bson:",omitempty"`
 	Name     string
-	From     time.Time
-	To       time.Time
-	Duration time.Duration
-	Up       *float64
-	Down     *float64
-	Total    *float64
+	// Interface is set on usage pushed by agents, which push the usage of
+	// a member on each interface separately
+	Interface string `json:",omitempty" bson:",omitempty"`
+	From      time.Time
+	To        time.Time
+	Duration  time.Duration
+	Up        *float64
+	Down      *float64
+	Total     *float64
+	Status    string
+	Error     string         `json:",omitempty" bson:",omitempty"`
+	Counts    *MessageCounts `json:",omitempty" bson:",omitempty"`
+	Warnings  []string       `json:",omitempty" bson:",omitempty"`
+	Anomaly   *UsageAnomaly  `json:",omitempty" bson:",omitempty"`
+	// CorrectionID is set on periods corrected by hand, to the correction
+	// keeping the original
+	CorrectionID string `json:",omitempty" bson:",omitempty"`
+	// Signature is the base64 ed25519 signature of the period with
+	// SIGNING_KEY, if set
+	Signature string `json:",omitempty" bson:",omitempty"`
+	// Labels are the member's metadata added by the enrich transform
+	Labels map[string]string `json:",omitempty" bson:",omitempty"`
+	// Metrics are the named metrics of the metrics section of
+	// PIPELINE_FILE, collected along with the usage
+	Metrics map[string]*float64 `json:",omitempty" bson:",omitempty"`
+}
+
+// MessageCounts are the numbers of log messages the sums of a usage period
+// were made from, for sources which can count them
+type MessageCounts struct {
+	Up   int64
+	Down int64
 }
 
 // init is invoked before main()
@@ -80,100 +133,152 @@ func fatal(err interface{}) {
    log.Fatal("FATAL ERROR: " + message)
 }
 
-func callGraylog(settings Settings, direction string, wgKey string) *float64 {
-	graylogClient := http.Client{
-		Timeout: time.Second * 60,
+// getMeshMembers reads the members with their overrides
+func getMeshMembers(settings Settings) ([]MeshMember, error) {
+	members, err := readMeshMembers(settings)
+	if err != nil {
+		return nil, err
+	}
+	return applyMemberOverrides(settings, members)
+}
+
+func readMeshMembers(settings Settings) ([]MeshMember, error) {
+	if settings.MembersCSV != "" {
+		file, err := os.Open(settings.MembersCSV)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readMembersCSV(file, settings.MemberIdentity, settings.MemberFields)
 	}
 
-	var directionString string
+	// Get mesh members from airtable
+	records := []airtableRecord{}
 
-	if direction == "up" {
-		directionString = "uploaded to exit"
-	} else if direction == "down" {
-		directionString = "downloaded from exit"
-	} else {
-		fatal("invalid direction argument")
+	client, err := newAirtableClient(settings)
+	if err != nil {
+		return []MeshMember{}, err
 	}
 
-	params := url.Values{
-		"field": []string{"bytes"},
-		"query": []string{`"` + wgKey + `" AND "` + directionString + `"`},
-		"from":  []string{settings.From.Format("2006-01-2T15:04:05.000Z")},
-		"to":    []string{settings.To.Format("2006-01-2T15:04:05.000Z")},
+	if err := client.ListRecords(settings.AirtableTableName, &records); err != nil {
+		return []MeshMember{}, err
 	}
 
-	url := strings.Replace(settings.GraylogURL+"api/search/universal/absolute/stats?"+params.Encode(), "+", "%20", -1)
+	return decodeMembers(records, settings.MemberFields)
+}
+
+func getMongoDatabase(settings Settings) (*mongo.Database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI(settings.MongoURL))
 	if err != nil {
-		fatal(err)
+		return nil, err
 	}
 
-	req.SetBasicAuth(settings.GraylogUser, settings.GraylogPass)
-	req.Header.Add("Accept", "application/json")
+	db := mongoClient.Database(settings.MongoDatabase)
+	if settings.MongoCutover {
+		if err := checkCutover(settings, db); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
 
-	resp, err := graylogClient.Do(req)
+func getBWUPCollection(settings Settings) (*mongo.Collection, error) {
+	db, err := getMongoDatabase(settings)
 	if err != nil {
-		fatal(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	bodyText, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fatal(err)
+	return db.Collection(settings.MongoCollection), nil
+}
+
+// getReadDatabase connects to the database for reports and API reads, at
+// MONGO_READ_URL if set, such as an analytics node, with
+// MONGO_READ_PREFERENCE if set, like secondaryPreferred. Heavy reads then
+// don't contend with collection writes. Nothing is written through it
+func getReadDatabase(settings Settings) (*mongo.Database, error) {
+	url := settings.MongoURL
+	if settings.MongoReadURL != "" {
+		url = settings.MongoReadURL
 	}
+	clientOptions := options.Client().ApplyURI(url)
 
-	type GraylogRes struct {
-		Sum *float64 `json:"sum"`
+	if settings.MongoReadPreference != "" {
+		mode, err := readpref.ModeFromString(settings.MongoReadPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MONGO_READ_PREFERENCE %q, expected primary, primaryPreferred, secondary, secondaryPreferred or nearest", settings.MongoReadPreference)
+		}
+		readPreference, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetReadPreference(readPreference)
 	}
 
-	bodyText = bytes.Replace(bodyText, []byte(`"NaN"`), []byte(`null`), -1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	var graylogRes GraylogRes
-	err = json.Unmarshal(bodyText, &graylogRes)
+	mongoClient, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		fmt.Println("error:", err)
+		return nil, err
 	}
 
-	if graylogRes.Sum != nil {
-		sum := bytesToGb(*graylogRes.Sum)
-		return &sum
-	} else {
-		return nil
-	}
+	return mongoClient.Database(settings.MongoDatabase), nil
 }
 
-func getMeshMembers(settings Settings) ([]MeshMember, error) {
-	// Get mesh members from airtable
-	meshMembers := []MeshMember{}
-
-	client, err := airtable.New(settings.AirtableAPIKey, settings.AirtableBaseID)
+func getReadBWUPCollection(settings Settings) (*mongo.Collection, error) {
+	db, err := getReadDatabase(settings)
 	if err != nil {
-		return meshMembers, err
-	}
-
-	if err := client.ListRecords(settings.AirtableTableName, &meshMembers); err != nil {
-		return meshMembers, err
+		return nil, err
 	}
 
-	return meshMembers, nil
+	return db.Collection(settings.MongoCollection), nil
 }
 
-func getBWUPCollection(settings Settings) (*mongo.Collection, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// sumDirection queries the source for one direction, with the message count
+// if the source can count them. Windows longer than QUERY_CHUNK are queried
+// a chunk at a time and the results added up
+func sumDirection(settings Settings, source StatSource, member MeshMember, direction string) (*float64, int64, bool, error) {
+	var total *float64
+	var count int64
+
+	counter, counted := source.(CountingSource)
+	for _, window := range queryChunks(settings.From, settings.To, settings.QueryChunk) {
+		var sum *float64
+		var chunkCount int64
+		var err error
+
+		if counted {
+			sum, chunkCount, err = counter.SumWithCount(member, direction, window.From, window.To)
+		} else {
+			sum, err = source.Sum(member, direction, window.From, window.To)
+		}
+		if err != nil {
+			return nil, 0, counted, err
+		}
 
-	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI(settings.MongoURL))
-	if err != nil {
-		return nil, err
+		total = addSums(total, sum)
+		count += chunkCount
 	}
 
-	return mongoClient.Database(settings.MongoDatabase).Collection(settings.MongoCollection), nil
+	return total, count, counted, nil
 }
 
-func getBandwidthSums(settings Settings, member MeshMember) (sumUploaded *float64, sumDownloaded *float64, total *float64) {
-	sumDownloaded = callGraylog(settings, "down", member.Fields.WGKey)
-	sumUploaded = callGraylog(settings, "up", member.Fields.WGKey)
+func getBandwidthSums(settings Settings, source StatSource, member MeshMember) (sumUploaded *float64, sumDownloaded *float64, total *float64, counts *MessageCounts, err error) {
+	sumDownloaded, downCount, counted, err := sumDirection(settings, source, member, "down")
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	sumUploaded, upCount, _, err := sumDirection(settings, source, member, "up")
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	if counted {
+		counts = &MessageCounts{Up: upCount, Down: downCount}
+	}
 
 	// We are using a nil pointer on these bandwidth sums as a very janky "Maybe" enum
 	userIsActive := false
@@ -194,24 +299,96 @@ func getBandwidthSums(settings Settings, member MeshMember) (sumUploaded *float6
 		total = &sumTotal
 	}
 
-	return sumUploaded, sumDownloaded, total
+	return sumUploaded, sumDownloaded, total, counts, nil
+}
+
+// commands are the subcommands which can be given as the first argument.
+// Anything else is treated as the arguments to a collection run
+var commands = map[string]func(args []string){
+	"netflow":        netflowCommand,
+	"snmp":           snmpCommand,
+	"abuse":          abuseCommand,
+	"audit":          auditCommand,
+	"commitments":    commitmentsCommand,
+	"forecast":       forecastCommand,
+	"uptime":         uptimeCommand,
+	"agent":          agentCommand,
+	"serve":          serveCommand,
+	"link":           linkCommand,
+	"prune":          pruneCommand,
+	"dump":           dumpCommand,
+	"restore":        restoreCommand,
+	"alias":          aliasCommand,
+	"annotate":       annotateCommand,
+	"backfill":       backfillCommand,
+	"daemon":         daemonCommand,
+	"migrate-ids":    migrateIDsCommand,
+	"migrate-db":     migrateDBCommand,
+	"mutations":      mutationsCommand,
+	"crm-sync":       crmSyncCommand,
+	"correct":        correctCommand,
+	"keygen":         keygenCommand,
+	"verify":         verifyCommand,
+	"settlement":     settlementCommand,
+	"groups":         groupsCommand,
+	"sites":          sitesCommand,
+	"geojson":        geojsonCommand,
+	"report":         reportCommand,
+	"sql":            sqlCommand,
+	"watch":          watchCommand,
+	"downsample":     downsampleCommand,
+	"sms":            smsCommand,
+	"rebuild-totals": rebuildTotalsCommand,
+	"flush":          flushCommand,
+	"airtable-auth":  airtableAuthCommand,
+	"pause":          pauseCommand,
+	"resume":         resumeCommand,
+	"balance":        balanceCommand,
+	"lookup":         lookupCommand,
+	"tui":            tuiCommand,
+	"gen-docs":       genDocsCommand,
+	"doctor":         doctorCommand,
+	"copy-mongo":     copyMongoCommand,
+	"encrypt-names":  encryptNamesCommand,
+	"forget":         forgetCommand,
 }
 
 func main() {
-	// Configure settings
-	duration, err := time.ParseDuration(os.Args[1])
+	args, err := parseSettingFlags(os.Args[1:])
+	if err != nil {
+		fatal(err)
+	}
 
-	var to time.Time
-	if len(os.Args) == 2 {
-		to = time.Now()
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			command(args[1:])
+			return
+		}
+	}
+
+	collect(args)
+}
+
+// parseWindow reads the duration [end_time] arguments shared by every command
+// working on a window of time, exiting with the usage if they are malformed
+func parseWindow(args []string) (from time.Time, to time.Time, duration time.Duration) {
+	var err error
+	if len(args) == 0 {
+		err = fmt.Errorf("no duration supplied")
 	} else {
-		to, err = time.Parse("2006-01-2T15:04:05", os.Args[2]+"T00:00:00")
+		duration, err = time.ParseDuration(args[0])
 	}
 
-	from := to.Add(-duration)
+	if len(args) < 2 {
+		to = time.Now()
+	} else if err == nil {
+		to, err = time.Parse("2006-01-2T15:04:05", args[1]+"T00:00:00")
+	}
+
+	from = to.Add(-duration)
 
 	if err != nil {
-		errString := `Usage: $ stat-collector duration [end_time]
+		errString := `Usage: $ stat-collector [-output table|json|csv|quiet] [-quiet] [-record dir] [-replay dir] duration [end_time]
 		
 		duration must be formatted like 168h
 		
@@ -226,60 +403,298 @@ func main() {
 		fatal(errString)
 	}
 
-	settings := Settings{
-		AirtableAPIKey:    os.Getenv("AIRTABLE_API_KEY"),
-		AirtableBaseID:    os.Getenv("AIRTABLE_BASE_ID"),
-		AirtableTableName: os.Getenv("AIRTABLE_TABLE_NAME"),
-		GraylogURL:        os.Getenv("GRAYLOG_URL"),
-		GraylogUser:       os.Getenv("GRAYLOG_USER"),
-		GraylogPass:       os.Getenv("GRAYLOG_PASS"),
-		From:              from,
-		To:                to,
-		Duration:          duration,
-		MongoDatabase:     os.Getenv("MONGO_DATABASE"),
-		MongoCollection:   os.Getenv("MONGO_COLLECTION"),
-		MongoURL:          os.Getenv("MONGO_URL"),
+	return from, to, duration
+}
+
+// collect queries the usage of every mesh member over the window given in
+// args and saves it, printing it in the format chosen with -output and then
+// a summary of the run. -quiet prints neither, for cron. -record saves the
+// responses of the run, which -replay runs offline against, over the
+// recorded window by default
+func collect(args []string) {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	quiet := flags.Bool("quiet", false, "print neither the usage nor the summary")
+	replay := flags.String("replay", "", "directory of recorded Airtable and Graylog responses to collect from, offline and storing nothing")
+	record := flags.String("record", "", "directory to save sanitized copies of the Airtable and Graylog responses to, for -replay")
+	chaos := chaosFlags(flags)
+	flags.Parse(args)
+
+	if err := checkChaos(*chaos); err != nil {
+		fatal(err)
+	}
+	if *replay != "" && *record != "" {
+		fatal("-replay and -record can't be used together")
 	}
 
-	fmt.Println(settings)
+	if *quiet {
+		*output = outputQuiet
+	}
 
-	meshMembers, err := getMeshMembers(settings)
+	report, err := newReportWriter(os.Stdout, *output)
 	if err != nil {
 		fatal(err)
 	}
 
-	bwupCollection, err := getBWUPCollection(settings)
+	// Configure settings
+	var from, to time.Time
+	var duration time.Duration
+	if *replay != "" && len(flags.Args()) == 0 {
+		window, err := readReplayWindow(*replay)
+		if err != nil {
+			fatal(err)
+		}
+		from, to, duration = window.From, window.To, window.Duration
+	} else {
+		from, to, duration = parseWindow(flags.Args())
+	}
+	if *record != "" {
+		if err := startRecording(*record, replayWindow{From: from, To: to, Duration: duration}); err != nil {
+			fatal(err)
+		}
+	}
+
+	// Every network is checked before any is collected, rather than failing
+	// part way through the run
+	networks := loadAllNetworkSettings()
+	for i, settings := range networks {
+		settings.From = from
+		settings.To = to
+		settings.Duration = duration
+		settings.Chaos = *chaos
+		settings.Record = *record
+		if *replay != "" {
+			var err error
+			if settings, err = replaySettings(settings, *replay); err != nil {
+				fatal(err)
+			}
+		}
+		checkCollectionSettings(settings)
+		networks[i] = settings
+	}
+
+	summary := &RunSummary{}
+	for _, settings := range networks {
+		for _, bwup := range collectNetwork(settings, report) {
+			summary.Add(bwup)
+		}
+	}
+
+	// The summary goes to stderr to keep the output parseable
+	if !*quiet {
+		summary.Print(os.Stderr, useColor(os.Stderr))
+	}
+}
+
+// collectNetwork queries and saves the usage of every member of one network,
+// returning it
+func collectNetwork(settings Settings, report *ReportWriter) []BandwidthUsagePeriod {
+	log.Printf("Collecting with settings %+v", settings.Redacted())
+
+	metrics := newRunMetrics(settings)
+	settings.Metrics = metrics
+
+	membersStart := time.Now()
+	meshMembers, err := getMeshMembers(settings)
 	if err != nil {
 		fatal(err)
 	}
+	metrics.Time(&metrics.MembersDuration, membersStart)
 
-	// Loop which calls graylog, processes data, and saves and prints it
-	for _, member := range meshMembers {
-		sumUploaded, sumDownloaded, total := getBandwidthSums(settings, member)
-
-		// Save bandwidth usage in mongo
-		if total != nil {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			bwup := BandwidthUsagePeriod{
-				Name:     strings.TrimSpace(member.Fields.Name),
-				From:     settings.From,
-				To:       settings.To,
-				Duration: settings.Duration,
-				Up:       sumUploaded,
-				Down:     sumDownloaded,
-				Total:    total,
-			}
+	// Without MONGO_URL, usage only goes to stores which don't need Mongo,
+	// like sqlite, and what is kept in Mongo alongside it is skipped
+	var bwupCollection *mongo.Collection
+	if settings.MongoURL != "" {
+		bwupCollection, err = getBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
 
-			jsonBwup, _ := json.Marshal(bwup)
+		// Audit registry churn before collecting usage
+		changes, err := recordMemberChanges(settings, bwupCollection.Database(), meshMembers)
+		if err != nil {
+			fatal(err)
+		}
 
-			fmt.Println(string(jsonBwup))
+		if err := aliasRenamedMembers(settings, bwupCollection.Database(), changes); err != nil {
+			fatal(err)
+		}
 
-			_, err = bwupCollection.InsertOne(ctx, bwup)
-			if err != nil {
+		metrics.Members = len(meshMembers)
+		saveRunMetrics(settings, bwupCollection.Database(), metrics)
+
+		// Exit level usage is kept to cross-check the sum of member usage
+		if len(settings.SNMPTargets) > 0 {
+			if _, err := recordExitUsage(settings, bwupCollection.Database()); err != nil {
 				fatal(err)
 			}
 		}
 	}
+
+	meshMembers = collectedMembers(meshMembers)
+	if bwupCollection != nil {
+		pauses, err := getMemberPauses(bwupCollection.Database().Collection(settings.MongoPausesCollection), settings.Network, "", true)
+		if err != nil {
+			fatal(err)
+		}
+		meshMembers, metrics.Paused = unpausedMembers(meshMembers, pauses)
+	}
+
+	source, err := newStatSource(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	store, err := newUsageStore(settings, bwupCollection)
+	if err != nil {
+		fatal(err)
+	}
+	if bwupCollection != nil {
+		balances, err := newBalanceStore(settings, bwupCollection.Database(), meshMembers)
+		if err != nil {
+			fatal(err)
+		}
+		store = MultiStore{store, balances}
+	}
+
+	transforms, err := newTransforms(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	metricDefinitions, err := readMetricDefinitions(settings)
+	if err != nil {
+		fatal(err)
+	}
+	metricDefinitions = unscheduledMetrics(metricDefinitions)
+
+	if !validAnomalyMethod(settings.AnomalyMethod) {
+		fatal(fmt.Sprintf("invalid ANOMALY_METHOD %q, expected zscore or mad", settings.AnomalyMethod))
+	}
+
+	// Don't record the whole mesh as inactive because the logs didn't arrive
+	if err := preflight(settings, source); err != nil {
+		publishAlert(settings, Alert{Kind: alertPreflight, Message: err.Error()})
+		if settings.PreflightAction != preflightWarn {
+			fatal(err)
+		}
+		log.Printf("WARNING: %v", err)
+	}
+
+	// A failing pre-run hook stops the run, so it can hold collection back
+	if err := runHook(settings, HookEvent{Hook: hookPreRun, Network: settings.Network, From: settings.From, To: settings.To, Members: len(meshMembers)}); err != nil {
+		fatal(err)
+	}
+
+	// With grouped queries every member is summed up front
+	batchStart := time.Now()
+	source, err = batchSums(settings, source, meshMembers)
+	if err != nil {
+		fatal(err)
+	}
+	metrics.Time(&metrics.QueryDuration, batchStart)
+
+	// Loop which calls the stat source, processes data, and saves and prints it
+	collected := make([]BandwidthUsagePeriod, 0, len(meshMembers))
+	for _, member := range meshMembers {
+		queryStart := time.Now()
+		memberUsage := collectMember(settings, source, member)
+		collectMemberMetrics(settings, metricDefinitions, member, &memberUsage)
+		metrics.Time(&metrics.QueryDuration, queryStart)
+
+		bwup, err := applyTransforms(transforms, memberUsage, member)
+		if err != nil {
+			fatal(err)
+		}
+		bwup, keep := applyConsent(settings, bwup, member)
+		if !keep {
+			continue
+		}
+		if bwupCollection != nil {
+			flagAnomaly(settings, bwupCollection, &bwup)
+		}
+		collected = append(collected, bwup)
+
+		if err := report.Write(bwup); err != nil {
+			fatal(err)
+		}
+
+		// Save bandwidth usage in the configured stores
+		storeStart := time.Now()
+		if err := store.Insert(bwup); err != nil {
+			fatal(err)
+		}
+		metrics.Time(&metrics.StoreDuration, storeStart)
+
+		reportHookFailure(settings, runHook(settings, HookEvent{Hook: hookPerRecord, Network: settings.Network, From: bwup.From, To: bwup.To, Usage: &bwup}))
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+
+	summary := &RunSummary{}
+	for _, bwup := range collected {
+		summary.Add(bwup)
+	}
+
+	metrics.Finish(summary)
+	if bwupCollection != nil {
+		saveRunMetrics(settings, bwupCollection.Database(), metrics)
+	}
+	reportHookFailure(settings, runHook(settings, HookEvent{Hook: hookPostRun, Network: settings.Network, From: settings.From, To: settings.To, Members: len(meshMembers), Summary: summary}))
+
+	// The website keeps showing the last feed, so a run isn't failed for it
+	if settings.PublicStats || len(settings.PublicFeed) > 0 || len(settings.AtomFeed) > 0 {
+		if err := publishPublicFeed(settings, collected, bwupCollection); err != nil {
+			log.Printf("WARNING: the public stats feed of %s wasn't published: %v", settings.Network, err)
+		}
+	}
+
+	return collected
+}
+
+// collectMember queries a member's usage over the settings' window
+func collectMember(settings Settings, source StatSource, member MeshMember) BandwidthUsagePeriod {
+	sumUploaded, sumDownloaded, total, counts, err := getBandwidthSums(settings, source, member)
+
+	bwup := BandwidthUsagePeriod{
+		Network:  settings.Network,
+		MemberID: member.ID,
+		Name:     strings.TrimSpace(member.Fields.Name),
+		From:     settings.From,
+		To:       settings.To,
+		Duration: settings.Duration,
+		Up:       sumUploaded,
+		Down:     sumDownloaded,
+		Total:    total,
+		Status:   usageStatusOK,
+		Counts:   counts,
+	}
+
+	// Alerts and logs come before applyConsent, so they don't say who a
+	// member who opted out of tracking is
+	alert := Alert{Kind: alertUsageWarning, MemberID: bwup.MemberID, Name: bwup.Name}
+	if member.Fields.TrackingOptOut {
+		alert.MemberID, alert.Name = "", optedOutName
+	}
+
+	// Inactive members and failed queries are saved too, so that the
+	// difference between them is never lost
+	if err != nil {
+		log.Printf("Error querying usage of %s: %v", alert.Name, err)
+		bwup.Status = usageStatusFailed
+		bwup.Error = err.Error()
+	} else if total == nil {
+		bwup.Status = usageStatusNoData
+	}
+
+	bwup.Warnings = checkMessageCounts(settings, bwup)
+	for _, warning := range bwup.Warnings {
+		log.Printf("WARNING: usage of %s: %s", alert.Name, warning)
+		alert.Message = warning
+		publishAlert(settings, alert)
+	}
+
+	return bwup
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Aggregates of a member metric
+const (
+	metricAggregateSum   = "sum"
+	metricAggregateCount = "count"
+)
+
+// Metrics collected from settings rather than PIPELINE_FILE
+const (
+	// metricDNSQueries counts the messages of GRAYLOG_DNS_QUERY
+	metricDNSQueries = "dns_queries"
+	// metricConnections counts the messages of GRAYLOG_CONNECTIONS_QUERY,
+	// a conntrack or exit firewall log line per connection opened
+	metricConnections = "connections"
+)
+
+// metricNamePattern keeps metric names usable as column and field names
+var metricNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// MetricDefinition is a named metric collected for each member along with
+// their usage, like connection counts or DNS queries, declared in the
+// metrics section of PIPELINE_FILE. Query is a Graylog query where {key} is
+// the member's identity, MEMBER_IDENTITY unless Identity is set, as logs
+// like a resolver's know members by another field. A count metric counts
+// the messages matching it, a sum metric adds up Field over them,
+// multiplied by Scale if set. A metric with a Schedule, a cron expression in
+// SCHEDULE_TIMEZONE, isn't collected with usage but by the daemon on its
+// own schedule, see metricJob
+type MetricDefinition struct {
+	Name      string  `yaml:"name"`
+	Query     string  `yaml:"query"`
+	Identity  string  `yaml:"identity"`
+	Aggregate string  `yaml:"aggregate"`
+	Field     string  `yaml:"field"`
+	Scale     float64 `yaml:"scale"`
+	Schedule  string  `yaml:"schedule"`
+}
+
+// checkMetricDefinitions validates the metrics of a pipeline
+func checkMetricDefinitions(definitions []MetricDefinition) error {
+	seen := map[string]bool{}
+	for _, definition := range definitions {
+		if !metricNamePattern.MatchString(definition.Name) {
+			return fmt.Errorf("invalid metric name %q, expected lowercase letters, digits and underscores", definition.Name)
+		}
+		if seen[definition.Name] {
+			return fmt.Errorf("metric %s is defined twice", definition.Name)
+		}
+		seen[definition.Name] = true
+
+		// Without the key every member would get everyone's metric
+		if !strings.Contains(definition.Query, "{key}") {
+			return fmt.Errorf("metric %s: the query must match the member's {key}", definition.Name)
+		}
+		if !validMemberIdentity(definition.Identity) {
+			return fmt.Errorf("metric %s: invalid identity %q, expected wg-key, router-mac, static-ip, hostname or mesh-ip", definition.Name, definition.Identity)
+		}
+
+		switch definition.Aggregate {
+		case metricAggregateCount:
+		case metricAggregateSum:
+			if definition.Field == "" {
+				return fmt.Errorf("metric %s: a sum needs the field to add up", definition.Name)
+			}
+		default:
+			return fmt.Errorf("metric %s: invalid aggregate %q, expected sum or count", definition.Name, definition.Aggregate)
+		}
+
+		if definition.Schedule != "" {
+			if _, err := parseCron(definition.Schedule, time.UTC); err != nil {
+				return fmt.Errorf("metric %s: invalid schedule: %v", definition.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readMetricDefinitions reads the metrics of the network's PIPELINE_FILE,
+// along with the DNS queries of GRAYLOG_DNS_QUERY and the connections of
+// GRAYLOG_CONNECTIONS_QUERY if set, which are queried from Graylog
+func readMetricDefinitions(settings Settings) ([]MetricDefinition, error) {
+	config, err := readPipelineConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := config.Metrics
+	counts := []struct {
+		key        string
+		definition MetricDefinition
+	}{
+		{"GRAYLOG_DNS_QUERY", MetricDefinition{Name: metricDNSQueries, Query: settings.GraylogDNSQuery, Identity: settings.GraylogDNSIdentity, Schedule: settings.GraylogDNSSchedule}},
+		{"GRAYLOG_CONNECTIONS_QUERY", MetricDefinition{Name: metricConnections, Query: settings.GraylogConnectionsQuery, Identity: settings.GraylogConnectionsIdentity, Schedule: settings.GraylogConnectionsSchedule}},
+	}
+	for _, count := range counts {
+		if count.definition.Query == "" {
+			continue
+		}
+		count.definition.Aggregate = metricAggregateCount
+		definitions = append(definitions, count.definition)
+		if err := checkMetricDefinitions(definitions); err != nil {
+			return nil, fmt.Errorf("%s: %v", count.key, err)
+		}
+	}
+
+	if len(definitions) > 0 && settings.StatSource != "" && settings.StatSource != statSourceGraylog {
+		return nil, fmt.Errorf("metrics are queried from Graylog, they can't be collected with STAT_SOURCE=%s", settings.StatSource)
+	}
+	return definitions, nil
+}
+
+// unscheduledMetrics returns the metrics collected with usage, leaving out
+// the ones with a schedule of their own
+func unscheduledMetrics(definitions []MetricDefinition) []MetricDefinition {
+	unscheduled := []MetricDefinition{}
+	for _, definition := range definitions {
+		if definition.Schedule == "" {
+			unscheduled = append(unscheduled, definition)
+		}
+	}
+	return unscheduled
+}
+
+// queryMetric returns a metric of the member over the settings' window, a
+// query per chunk. Sums are nil if no messages matched, counts are 0
+func queryMetric(settings Settings, definition MetricDefinition, key string) (*float64, error) {
+	query := strings.Replace(definition.Query, "{key}", escapeLucenePhrase(key), -1)
+
+	var value *float64
+	for _, window := range queryChunks(settings.From, settings.To, settings.QueryChunk) {
+		var chunk *float64
+		if definition.Aggregate == metricAggregateCount {
+			count, err := countGraylogMessages(settings, query, "", window.From, window.To)
+			if err != nil {
+				return nil, err
+			}
+			counted := float64(count)
+			chunk = &counted
+		} else {
+			stats, err := queryGraylogStats(settings, query, definition.Field, window.From, window.To)
+			if err != nil {
+				return nil, err
+			}
+			if stats.Sum != nil {
+				sum := *stats.Sum
+				if definition.Scale != 0 {
+					sum *= definition.Scale
+				}
+				chunk = &sum
+			}
+		}
+		value = addSums(value, chunk)
+	}
+	return value, nil
+}
+
+// memberMetric queries a metric of the member by the metric's identity
+func memberMetric(settings Settings, definition MetricDefinition, member MeshMember) (*float64, error) {
+	identity := definition.Identity
+	if identity == "" {
+		identity = settings.MemberIdentity
+	}
+
+	key, err := identityKey(identity, member)
+	if err != nil {
+		return nil, err
+	}
+	return queryMetric(settings, definition, key)
+}
+
+// collectMemberMetrics adds the member's metrics to their usage period. A
+// metric which can't be queried is left out with a warning, as it doesn't
+// make the usage itself wrong
+func collectMemberMetrics(settings Settings, definitions []MetricDefinition, member MeshMember, bwup *BandwidthUsagePeriod) {
+	if len(definitions) == 0 {
+		return
+	}
+
+	bwup.Metrics = map[string]*float64{}
+	for _, definition := range definitions {
+		value, err := memberMetric(settings, definition, member)
+		if err != nil {
+			warning := fmt.Sprintf("metric %s failed: %v", definition.Name, err)
+			log.Printf("WARNING: usage of %s: %s", bwup.Name, warning)
+			bwup.Warnings = append(bwup.Warnings, warning)
+			continue
+		}
+		bwup.Metrics[definition.Name] = value
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetricDefinitions(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"count and sum", `
+metrics:
+  - name: connections
+    query: 'wg_key:"{key}" AND event:handshake'
+    aggregate: count
+  - name: dns_megabytes
+    query: 'client:"{key}" AND dns'
+    aggregate: sum
+    field: response_bytes
+    scale: 0.000001
+`, true},
+		{"no key", "metrics:\n  - name: connections\n    query: event:handshake\n    aggregate: count\n", false},
+		{"sum without field", "metrics:\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: sum\n", false},
+		{"unknown aggregate", "metrics:\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: average\n", false},
+		{"bad name", "metrics:\n  - name: DNS Queries\n    query: '\"{key}\"'\n    aggregate: count\n", false},
+		{"twice", "metrics:\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: count\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: count\n", false},
+		{"scheduled", "metrics:\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: count\n    schedule: '@daily'\n", true},
+		{"bad schedule", "metrics:\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: count\n    schedule: every day\n", false},
+	}
+
+	for _, test := range tests {
+		_, err := parsePipelineConfig([]byte(test.config))
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
+
+func TestReadMetricDefinitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pipeline.yaml")
+	if err := ioutil.WriteFile(path, []byte("metrics:\n  - name: dns\n    query: '\"{key}\"'\n    aggregate: count\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	definitions, err := readMetricDefinitions(Settings{PipelineFile: path, StatSource: statSourceGraylog})
+	if err != nil || len(definitions) != 1 {
+		t.Errorf("got %v, %v", definitions, err)
+	}
+	if _, err := readMetricDefinitions(Settings{PipelineFile: path, StatSource: statSourceLoki}); err == nil {
+		t.Error("loki: should have failed")
+	}
+
+	// DNS queries come from the resolver logs, which know members by IP
+	definitions, err = readMetricDefinitions(Settings{PipelineFile: path, GraylogDNSQuery: `client:"{key}"`, GraylogDNSIdentity: memberIdentityMeshIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MetricDefinition{Name: metricDNSQueries, Query: `client:"{key}"`, Identity: memberIdentityMeshIP, Aggregate: metricAggregateCount}
+	if len(definitions) != 2 || definitions[1] != want {
+		t.Errorf("got %+v, want the DNS queries after the pipeline's metrics", definitions)
+	}
+	if _, err := readMetricDefinitions(Settings{GraylogDNSQuery: "dns"}); err == nil {
+		t.Error("DNS query without a key: should have failed")
+	}
+
+	definitions, err = readMetricDefinitions(Settings{PipelineFile: path, GraylogDNSQuery: `client:"{key}"`, GraylogConnectionsQuery: `conntrack AND src:"{key}"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = MetricDefinition{Name: metricConnections, Query: `conntrack AND src:"{key}"`, Aggregate: metricAggregateCount}
+	if len(definitions) != 3 || definitions[2] != want {
+		t.Errorf("got %+v, want the connections after the DNS queries", definitions)
+	}
+	if _, err := readMetricDefinitions(Settings{GraylogConnectionsQuery: `src:"{key}"`, GraylogConnectionsIdentity: "ip"}); err == nil {
+		t.Error("connections by an unknown identity: should have failed")
+	}
+}
+
+func TestCollectMemberMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(query, `"fd00::a"`):
+			w.Write([]byte(`{"total_results": 7}`))
+		case !strings.Contains(query, `"aliceKey"`):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type": "ApiError", "message": "key not in the query"}`))
+		case strings.HasSuffix(r.URL.Path, "/stats") && r.URL.Query().Get("field") == "response_bytes":
+			w.Write([]byte(`{"count": 4, "sum": 3000000}`))
+		case strings.HasSuffix(r.URL.Path, "/stats"):
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"type": "ApiError", "message": "field not numeric"}`))
+		default:
+			w.Write([]byte(`{"total_results": 42}`))
+		}
+	}))
+	defer server.Close()
+
+	settings := Settings{GraylogURL: server.URL + "/", QueryChunk: 24 * time.Hour}
+	settings.To = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	settings.From = settings.To.Add(-48 * time.Hour)
+
+	member := MeshMember{}
+	member.Fields.Name = "Alice"
+	member.Fields.WGKey = "aliceKey"
+	member.Fields.MeshIP = "fd00::a"
+
+	bwup := usage(1, 2)
+	collectMemberMetrics(settings, []MetricDefinition{
+		{Name: "connections", Query: `wg_key:"{key}" AND event:handshake`, Aggregate: metricAggregateCount},
+		{Name: "dns_megabytes", Query: `client:"{key}"`, Aggregate: metricAggregateSum, Field: "response_bytes", Scale: 0.000001},
+		{Name: "latency", Query: `client:"{key}"`, Aggregate: metricAggregateSum, Field: "latency_ms"},
+		{Name: metricDNSQueries, Query: `client:"{key}"`, Identity: memberIdentityMeshIP, Aggregate: metricAggregateCount},
+	}, member, &bwup)
+
+	// Each of the two days is a query
+	if value := bwup.Metrics["connections"]; value == nil || *value != 84 {
+		t.Errorf("connections: got %v, want 84", value)
+	}
+	if value := bwup.Metrics["dns_megabytes"]; value == nil || *value != 6 {
+		t.Errorf("dns_megabytes: got %v, want 6", value)
+	}
+	if value := bwup.Metrics[metricDNSQueries]; value == nil || *value != 14 {
+		t.Errorf("dns_queries: got %v, want 14 counted by Mesh IP", value)
+	}
+	if _, ok := bwup.Metrics["latency"]; ok || len(bwup.Warnings) != 1 {
+		t.Errorf("latency: got metrics %v and warnings %v, want it left out with a warning", bwup.Metrics, bwup.Warnings)
+	}
+}
+
+func TestUnscheduledMetrics(t *testing.T) {
+	definitions := []MetricDefinition{
+		{Name: "connections", Query: `"{key}"`, Aggregate: metricAggregateCount},
+		{Name: metricDNSQueries, Query: `"{key}"`, Aggregate: metricAggregateCount, Schedule: "@daily"},
+		{Name: "heartbeats", Query: `"{key}"`, Aggregate: metricAggregateCount, Schedule: "*/5 * * * *"},
+	}
+
+	unscheduled := unscheduledMetrics(definitions)
+	if len(unscheduled) != 1 || unscheduled[0].Name != "connections" {
+		t.Errorf("got %+v, want only the connections collected with usage", unscheduled)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// metricsErrorOther counts the API errors which aren't a GraylogError
+const metricsErrorOther = "other"
+
+// RunMetrics are the operational metrics of a network's collection run,
+// saved to MONGO_METRICS_COLLECTION so the collector's health can be
+// trended over months rather than read from the logs of each run. Requests
+// count the calls made to the Graylog API. A run without FinishedAt is
+// still going
+type RunMetrics struct {
+	ID         primitive.ObjectID `bson:"_id" json:"-"`
+	Network    string
+	From       time.Time
+	To         time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// Durations of the run and of its steps
+	Duration        time.Duration
+	MembersDuration time.Duration
+	QueryDuration   time.Duration
+	StoreDuration   time.Duration
+
+	Members  int
+	Failed   int
+	Requests int64
+	// BytesFetched is the size of the successful API responses
+	BytesFetched int64
+	// Errors counts failed requests by kind, like timeout or server
+	Errors    map[string]int64 `bson:",omitempty"`
+	ErrorRate float64
+	// Paused are the IDs of the members not collected as they were paused
+	Paused []string `bson:",omitempty" json:",omitempty"`
+
+	mutex sync.Mutex
+}
+
+func newRunMetrics(settings Settings) *RunMetrics {
+	return &RunMetrics{ID: primitive.NewObjectID(), Network: settings.Network, From: settings.From, To: settings.To, StartedAt: time.Now()}
+}
+
+// RecordRequest counts an API request, of which the body was read if it
+// succeeded. Metrics may be nil, for calls made outside collection runs
+func (m *RunMetrics) RecordRequest(bytes int, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.Requests++
+	m.BytesFetched += int64(bytes)
+	if err != nil {
+		kind := metricsErrorOther
+		if e, ok := err.(GraylogError); ok {
+			kind = e.Kind
+		}
+		if m.Errors == nil {
+			m.Errors = map[string]int64{}
+		}
+		m.Errors[kind]++
+	}
+}
+
+// Time adds the time since start to the duration of a step
+func (m *RunMetrics) Time(step *time.Duration, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	*step += time.Since(start)
+}
+
+// Finish closes the metrics at the end of the run
+func (m *RunMetrics) Finish(summary *RunSummary) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.FinishedAt = time.Now()
+	m.Duration = m.FinishedAt.Sub(m.StartedAt)
+	m.Members = summary.Members
+	m.Failed = summary.Failed
+
+	m.ErrorRate = 0
+	if m.Requests > 0 {
+		failed := int64(0)
+		for _, count := range m.Errors {
+			failed += count
+		}
+		m.ErrorRate = float64(failed) / float64(m.Requests)
+	}
+}
+
+// saveRunMetrics saves the metrics of a run as it starts, so it can be
+// followed, and again once it finished. The run's usage is saved apart, so
+// failing to save them only costs the metrics
+func saveRunMetrics(settings Settings, db *mongo.Database, metrics *RunMetrics) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	collection := db.Collection(settings.MongoMetricsCollection)
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "network", Value: 1}, {Key: "startedat", Value: 1}}}); err != nil {
+		log.Printf("Error saving the run's metrics: %v", err)
+		return
+	}
+	if _, err := collection.ReplaceOne(ctx, bson.M{"_id": metrics.ID}, metrics, options.Replace().SetUpsert(true)); err != nil {
+		log.Printf("Error saving the run's metrics: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRunMetrics(t *testing.T) {
+	metrics := newRunMetrics(Settings{Network: "casa"})
+	metrics.RecordRequest(120, nil)
+	metrics.RecordRequest(80, nil)
+	metrics.RecordRequest(0, GraylogError{Kind: graylogErrorTimeout})
+	metrics.RecordRequest(0, fmt.Errorf("connection refused"))
+
+	step := time.Duration(0)
+	metrics.Time(&step, time.Now().Add(-time.Second))
+	metrics.Finish(&RunSummary{Members: 3, Failed: 1})
+
+	if metrics.Requests != 4 || metrics.BytesFetched != 200 {
+		t.Errorf("got %d requests of %d bytes, want 4 of 200", metrics.Requests, metrics.BytesFetched)
+	}
+	if metrics.Errors[graylogErrorTimeout] != 1 || metrics.Errors[metricsErrorOther] != 1 {
+		t.Errorf("got errors %v", metrics.Errors)
+	}
+	if metrics.ErrorRate != 0.5 {
+		t.Errorf("got error rate %v, want 0.5", metrics.ErrorRate)
+	}
+	if metrics.Members != 3 || metrics.Failed != 1 {
+		t.Errorf("got %d members and %d failed, want the summary's", metrics.Members, metrics.Failed)
+	}
+	if step < time.Second {
+		t.Errorf("timed %v, want at least a second", step)
+	}
+
+	// Runs without requests have no error rate
+	idle := newRunMetrics(Settings{Network: "casa"})
+	idle.Finish(&RunSummary{})
+	if idle.ErrorRate != 0 {
+		t.Errorf("idle run: got error rate %v", idle.ErrorRate)
+	}
+
+	// Calls made outside a run aren't counted
+	var none *RunMetrics
+	none.RecordRequest(10, nil)
+	none.Time(&step, time.Now())
+}
+
+func TestGraylogRequestMetrics(t *testing.T) {
+	server := newGraylogFixtureServer(t)
+	defer server.Close()
+
+	settings := Settings{GraylogURL: server.URL + "/", Metrics: newRunMetrics(Settings{Network: "casa"})}
+	for _, query := range []string{`"aliceKey+/=" AND "uploaded to exit"`, `"carolKey" AND "downloaded from exit"`} {
+		getGraylog(settings, "api/search/universal/absolute/stats?"+url.Values{"query": []string{query}}.Encode())
+	}
+
+	metrics := settings.Metrics
+	if metrics.Requests != 2 || metrics.Errors[graylogErrorTimeout] != 1 || metrics.BytesFetched == 0 {
+		t.Errorf("got %d requests, %d bytes and errors %v", metrics.Requests, metrics.BytesFetched, metrics.Errors)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemberMetricSample is a member's metric over a window of its own
+// schedule, saved to MONGO_MEMBER_METRICS_COLLECTION as it doesn't line up
+// with the usage periods. Value is nil if it couldn't be queried, with the
+// reason in Error
+type MemberMetricSample struct {
+	Network  string
+	MemberID string `json:",omitempty"`
+	Name     string
+	Metric   string
+	From     time.Time
+	To       time.Time
+	Value    *float64
+	Error    string `json:",omitempty" bson:",omitempty"`
+}
+
+func (s MemberMetricSample) reportColumns() []string {
+	return []string{"NETWORK", "MEMBER", "NAME", "METRIC", "FROM", "TO", "VALUE", "ERROR"}
+}
+
+func (s MemberMetricSample) reportValues(number func(*float64) string) []string {
+	return []string{
+		s.Network,
+		s.MemberID,
+		s.Name,
+		s.Metric,
+		s.From.UTC().Format(time.RFC3339),
+		s.To.UTC().Format(time.RFC3339),
+		number(s.Value),
+		s.Error,
+	}
+}
+
+// collectMetricSamples queries a metric of each member over the settings'
+// window. A member whose metric can't be queried gets a sample with the
+// error, like a failed usage period. Members who opted out of tracking get
+// what CONSENT_OPT_OUT allows
+func collectMetricSamples(settings Settings, definition MetricDefinition, members []MeshMember) []MemberMetricSample {
+	samples := make([]MemberMetricSample, 0, len(members))
+	for _, member := range members {
+		sample := MemberMetricSample{
+			Network:  settings.Network,
+			MemberID: member.ID,
+			Name:     member.Fields.Name,
+			Metric:   definition.Name,
+			From:     settings.From,
+			To:       settings.To,
+		}
+
+		value, err := memberMetric(settings, definition, member)
+		if err != nil {
+			name := sample.Name
+			if member.Fields.TrackingOptOut {
+				name = optedOutName
+			}
+			log.Printf("WARNING: metric %s of %s failed: %v", definition.Name, name, err)
+			sample.Error = err.Error()
+		}
+		sample.Value = value
+
+		sample, keep := applyMetricConsent(settings, sample, member)
+		if !keep {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func saveMetricSamples(collection *mongo.Collection, samples []MemberMetricSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "network", Value: 1}, {Key: "metric", Value: 1}, {Key: "from", Value: 1}}}); err != nil {
+		return err
+	}
+
+	documents := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		documents[i] = sample
+	}
+	_, err := collection.InsertMany(ctx, documents)
+	return err
+}
+
+// getMetricSamples returns the network's samples of the scheduled metrics
+// which fall within the window
+func getMetricSamples(collection *mongo.Collection, network string, from time.Time, to time.Time) ([]MemberMetricSample, error) {
+	samples := []MemberMetricSample{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"network": networkMatch(network), "from": bson.M{"$gte": from}, "to": bson.M{"$lte": to}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"from": 1}))
+	if err != nil {
+		return samples, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var sample MemberMetricSample
+		if err := cursor.Decode(&sample); err != nil {
+			return samples, err
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, cursor.Err()
+}
+
+// metricJob collects a network's scheduled metric over the window from the
+// previous scheduled time, with the members and settings read afresh each
+// run like collectJob. Samples are printed as JSON lines
+func metricJob(settings Settings, network string, metric string) func(time.Time, time.Time) {
+	report, _ := newReportWriter(os.Stdout, outputJSON)
+
+	return func(scheduled time.Time, previous time.Time) {
+		networkSettings := loadNetworkSettings(network)
+		networkSettings.From = previous.UTC()
+		networkSettings.To = scheduled.UTC()
+		networkSettings.Duration = scheduled.Sub(previous)
+		networkSettings.Chaos = settings.Chaos
+
+		definitions, err := readMetricDefinitions(networkSettings)
+		if err != nil {
+			fatal(err)
+		}
+		var definition *MetricDefinition
+		for i := range definitions {
+			if definitions[i].Name == metric && definitions[i].Schedule != "" {
+				definition = &definitions[i]
+			}
+		}
+		// The daemon picks up metrics added or removed on its restart
+		if definition == nil {
+			log.Printf("WARNING: metric %s of network %s is no longer scheduled, skipping it", metric, network)
+			return
+		}
+
+		members, err := getMeshMembers(networkSettings)
+		if err != nil {
+			fatal(err)
+		}
+		members = collectedMembers(members)
+
+		samples := collectMetricSamples(networkSettings, *definition, members)
+		for _, sample := range samples {
+			if err := report.Write(sample); err != nil {
+				fatal(err)
+			}
+		}
+		if err := report.Flush(); err != nil {
+			fatal(err)
+		}
+
+		db, err := getMongoDatabase(networkSettings)
+		if err != nil {
+			fatal(err)
+		}
+		if err := saveMetricSamples(db.Collection(networkSettings.MongoMemberMetricsCollection), samples); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// metricJobs returns a daemon job for each scheduled metric of every
+// network, named after the network and metric so each keeps its own runs
+func metricJobs(settings Settings, location *time.Location) ([]*daemonJob, error) {
+	jobs := []*daemonJob{}
+	for _, networkSettings := range loadAllNetworkSettings() {
+		definitions, err := readMetricDefinitions(networkSettings)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", networkSettings.Network, err)
+		}
+
+		for _, definition := range definitions {
+			if definition.Schedule == "" {
+				continue
+			}
+			schedule, err := parseCron(definition.Schedule, location)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: metric %s: %v", networkSettings.Network, definition.Name, err)
+			}
+			jobs = append(jobs, &daemonJob{
+				name:     fmt.Sprintf("metric %s/%s", networkSettings.Network, definition.Name),
+				schedule: schedule,
+				run:      metricJob(settings, networkSettings.Network, definition.Name),
+			})
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectMetricSamples(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.URL.Query().Get("query"), `"fd00::a"`) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"type": "ApiError", "message": "index unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"total_results": 1200}`))
+	}))
+	defer server.Close()
+
+	settings := Settings{Network: "casa", GraylogURL: server.URL + "/", QueryChunk: 24 * time.Hour}
+	settings.To = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	settings.From = settings.To.Add(-24 * time.Hour)
+
+	alice := MeshMember{ID: "rec1"}
+	alice.Fields.Name = "Alice"
+	alice.Fields.MeshIP = "fd00::a"
+	bob := MeshMember{ID: "rec2"}
+	bob.Fields.Name = "Bob"
+	bob.Fields.MeshIP = "fd00::b"
+
+	definition := MetricDefinition{Name: metricDNSQueries, Query: `client:"{key}"`, Identity: memberIdentityMeshIP, Aggregate: metricAggregateCount, Schedule: "@daily"}
+	samples := collectMetricSamples(settings, definition, []MeshMember{alice, bob})
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples, want one per member", len(samples))
+	}
+
+	sample := samples[0]
+	if sample.Network != "casa" || sample.MemberID != "rec1" || sample.Metric != metricDNSQueries || !sample.From.Equal(settings.From) || !sample.To.Equal(settings.To) {
+		t.Errorf("got %+v, want Alice's DNS queries over the window", sample)
+	}
+	if sample.Value == nil || *sample.Value != 1200 || sample.Error != "" {
+		t.Errorf("got value %v and error %q, want 1200", sample.Value, sample.Error)
+	}
+	if failed := samples[1]; failed.Value != nil || failed.Error == "" {
+		t.Errorf("got %+v, want Bob's failed query recorded", failed)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NameMapping is a line of the migration report: the member ID usage stored
+// under a name was, or could not be, matched to
+type NameMapping struct {
+	Network   string
+	Name      string
+	Documents int
+	MemberID  string `json:",omitempty"`
+	MatchedBy string `json:",omitempty"`
+	Problem   string `json:",omitempty"`
+}
+
+// normalizeName folds case and whitespace so trivially edited names match
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// nameIndex maps names to the member IDs they were seen with, both as given
+// and normalized
+type nameIndex struct {
+	exact      map[string]map[string]bool
+	normalized map[string]map[string]bool
+}
+
+func newNameIndex() nameIndex {
+	return nameIndex{exact: map[string]map[string]bool{}, normalized: map[string]map[string]bool{}}
+}
+
+func (i nameIndex) add(name string, memberID string) {
+	addID(i.exact, strings.TrimSpace(name), memberID)
+	addID(i.normalized, normalizeName(name), memberID)
+}
+
+func addID(index map[string]map[string]bool, key string, memberID string) {
+	if index[key] == nil {
+		index[key] = map[string]bool{}
+	}
+	index[key][memberID] = true
+}
+
+// match finds the single member ID a name belongs to, preferring exact
+// matches. Names seen with several IDs are reported as ambiguous
+func (i nameIndex) match(name string) (string, string) {
+	for _, candidates := range []map[string]bool{i.exact[strings.TrimSpace(name)], i.normalized[normalizeName(name)]} {
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			for id := range candidates {
+				return id, ""
+			}
+		default:
+			ids := []string{}
+			for id := range candidates {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			return "", "ambiguous, matches " + strings.Join(ids, ", ")
+		}
+	}
+	return "", "no member with this name"
+}
+
+// buildNameIndexes gathers the names members are known by, from the most to
+// the least reliable source: aliases, current Airtable names, the cached
+// member list and the names recorded in registry changes
+func buildNameIndexes(settings Settings, db *mongo.Database, members []MeshMember, network interface{}) ([]string, map[string]nameIndex, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	sources := []string{"alias", "airtable", "cache", "history"}
+	indexes := map[string]nameIndex{}
+	for _, source := range sources {
+		indexes[source] = newNameIndex()
+	}
+
+	for _, member := range members {
+		indexes["airtable"].add(member.Fields.Name, member.ID)
+	}
+
+	filter := bson.M{"network": network}
+
+	aliases := []MemberAlias{}
+	cursor, err := db.Collection(settings.MongoAliasCollection).Find(ctx, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cursor.All(ctx, &aliases); err != nil {
+		return nil, nil, err
+	}
+	for _, alias := range aliases {
+		indexes["alias"].add(alias.Name, alias.MemberID)
+	}
+
+	cached, err := getCachedMembers(ctx, db.Collection(settings.MongoMembersCollection), settings.Network)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, member := range cached {
+		indexes["cache"].add(member.Name, member.ID)
+	}
+
+	changes := []MemberChange{}
+	cursor, err = db.Collection(settings.MongoMemberChangesCollection).Find(ctx, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cursor.All(ctx, &changes); err != nil {
+		return nil, nil, err
+	}
+	for _, change := range changes {
+		indexes["history"].add(change.Name, change.MemberID)
+		if change.PreviousName != "" {
+			indexes["history"].add(change.PreviousName, change.MemberID)
+		}
+	}
+
+	return sources, indexes, nil
+}
+
+// getUnkeyedNames counts the documents stored without a member ID under each
+// name, in the usage and rollup collections
+func getUnkeyedNames(settings Settings, db *mongo.Database, network interface{}) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	counts := map[string]int{}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"network": network, "memberid": bson.M{"$exists": false}}},
+		{"$group": bson.M{"_id": "$name", "count": bson.M{"$sum": 1}}},
+	}
+
+	for _, name := range []string{settings.MongoCollection, settings.MongoRollupCollection} {
+		cursor, err := db.Collection(name).Aggregate(ctx, pipeline)
+		if err != nil {
+			return counts, err
+		}
+
+		var groups []struct {
+			Name  string `bson:"_id"`
+			Count int
+		}
+		if err := cursor.All(ctx, &groups); err != nil {
+			return counts, err
+		}
+		for _, group := range groups {
+			name, err := decryptName(settings.Network, group.Name)
+			if err != nil {
+				return counts, err
+			}
+			counts[name] += group.Count
+		}
+	}
+
+	return counts, nil
+}
+
+// untaggedMatch matches the documents of a network, along with those stored
+// before networks were configured when they belong to it
+func untaggedMatch(network string, ownsUntagged bool) interface{} {
+	if ownsUntagged {
+		return bson.M{"$in": bson.A{network, nil}}
+	}
+	return networkMatch(network)
+}
+
+// tagUntagged gives the documents stored before networks were configured
+// the network they belong to, so they match its filters from then on
+func tagUntagged(settings Settings, db *mongo.Database) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	filter := bson.M{"network": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"network": settings.Network}}
+
+	var updated int64
+	for _, name := range []string{settings.MongoCollection, settings.MongoRollupCollection, settings.MongoMemberChangesCollection} {
+		collection := db.Collection(name)
+		err := mutateDocuments(ctx, db.Collection(settings.MongoMutationsCollection), collection, mutationTag, settings.Network, filter, func() error {
+			result, err := collection.UpdateMany(ctx, filter, update)
+			if err == nil {
+				updated += result.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			return updated, err
+		}
+	}
+
+	return updated, nil
+}
+
+// migrateIDsCommand gives every document stored by name alone the record ID
+// of its member, keeping the name for display. Names are matched against the
+// sources in buildNameIndexes, and each name's outcome is reported so the
+// unmatched ones can be fixed with the alias command. Documents stored before
+// networks were configured are given the network named by -untagged
+func migrateIDsCommand(args []string) {
+	flags := flag.NewFlagSet("migrate-ids", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report the mapping without changing anything")
+	untagged := flags.String("untagged", defaultNetwork, "network the documents stored without one belong to")
+	flags.Parse(args)
+
+	for _, settings := range loadAllNetworkSettings() {
+		migrateNetworkIDs(settings, *dryRun, settings.Network == *untagged)
+	}
+}
+
+func migrateNetworkIDs(settings Settings, dryRun bool, ownsUntagged bool) {
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	network := untaggedMatch(settings.Network, ownsUntagged)
+
+	sources, indexes, err := buildNameIndexes(settings, db, members, network)
+	if err != nil {
+		fatal(err)
+	}
+
+	counts, err := getUnkeyedNames(settings, db, network)
+	if err != nil {
+		fatal(err)
+	}
+
+	if ownsUntagged && !dryRun {
+		tagged, err := tagUntagged(settings, db)
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("Gave %d documents stored without a network the network %s", tagged, settings.Network)
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unmatched := 0
+	for _, name := range names {
+		mapping := NameMapping{Network: settings.Network, Name: name, Documents: counts[name]}
+
+		for _, source := range sources {
+			memberID, problem := indexes[source].match(name)
+			if memberID != "" {
+				mapping.MemberID = memberID
+				mapping.MatchedBy = source
+				mapping.Problem = ""
+				break
+			}
+			// A more reliable source being ambiguous overrides the others
+			mapping.Problem = problem
+			if strings.HasPrefix(problem, "ambiguous") {
+				break
+			}
+		}
+
+		printJSON(os.Stdout, mapping)
+
+		if mapping.MemberID == "" {
+			unmatched++
+			continue
+		}
+		if dryRun {
+			continue
+		}
+
+		_, err := applyAlias(settings, db, MemberAlias{
+			Network:   settings.Network,
+			Name:      name,
+			MemberID:  mapping.MemberID,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	log.Printf("Matched %d of %d names in network %s, %d need an alias", len(names)-unmatched, len(names), settings.Network, unmatched)
+}
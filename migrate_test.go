@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNormalizeName(t *testing.T) {
+	if got, want := normalizeName("  Alice \t SMITH "), "alice smith"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNameIndexMatch(t *testing.T) {
+	index := newNameIndex()
+	index.add("Alice Smith", "recA")
+	index.add("alice  smith", "recB")
+	index.add("Bob", "recC")
+	index.add(" Carol ", "recD")
+
+	tests := []struct {
+		name     string
+		memberID string
+		problem  bool
+	}{
+		{"Alice Smith", "recA", false},
+		{"alice  smith", "recB", false},
+		{"ALICE SMITH", "", true},
+		{"bob", "recC", false},
+		{"Carol", "recD", false},
+		{"Dave", "", true},
+	}
+
+	for _, test := range tests {
+		memberID, problem := index.match(test.name)
+		if memberID != test.memberID || (problem != "") != test.problem {
+			t.Errorf("%q: got %q (%s), want %q", test.name, memberID, problem, test.memberID)
+		}
+	}
+}
+
+func TestUntaggedMatch(t *testing.T) {
+	want := bson.M{"$in": bson.A{"casa", nil}}
+	if got := untaggedMatch("casa", true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v for the network owning untagged documents, want %v", got, want)
+	}
+	if got := untaggedMatch("casa", false); got != "casa" {
+		t.Errorf("got %v for another network", got)
+	}
+}
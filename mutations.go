@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of mutations of stored data
+const (
+	mutationInsert     = "insert"
+	mutationOverwrite  = "overwrite"
+	mutationMerge      = "merge"
+	mutationPrune      = "prune"
+	mutationAlias      = "alias"
+	mutationTag        = "tag"
+	mutationRestore    = "restore"
+	mutationCorrect    = "correct"
+	mutationCompact    = "compact"
+	mutationDownsample = "downsample"
+	mutationEncrypt    = "encrypt"
+	mutationForget     = "forget"
+)
+
+// Mutation records a change to stored data in MONGO_MUTATIONS_COLLECTION,
+// which is only ever appended to, so billing disputes can be settled with
+// proof of what changed. Before and After are SHA-256 hashes of the
+// documents changed as they were and became, empty when there were none.
+// Raw SNMP and NetFlow samples are too many to hash when pruned, so only
+// their count is recorded
+type Mutation struct {
+	Kind       string
+	Collection string
+	Network    string
+	// Filter is the filter, as JSON, that matched the documents changed
+	Filter    string
+	Documents int
+	Before    string
+	After     string
+	Actor     string
+	At        time.Time
+}
+
+// mutationActor is who makes the process's mutations: the user, host and
+// command line running, with the passwords of URLs in it hidden
+func mutationActor() string {
+	command := []string{filepath.Base(os.Args[0])}
+	for _, arg := range os.Args[1:] {
+		if i := strings.Index(arg, "="); i >= 0 {
+			arg = arg[:i+1] + redactURL(arg[i+1:])
+		} else {
+			arg = redactURL(arg)
+		}
+		command = append(command, arg)
+	}
+	return os.Getenv("USER") + "@" + hostname() + " (" + strings.Join(command, " ") + ")"
+}
+
+// hashDocuments hashes documents in order, empty if there are none
+func hashDocuments(documents []bson.Raw) string {
+	if len(documents) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, document := range documents {
+		hash.Write(document)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashPeriod hashes a usage period as stored, empty if nil
+func hashPeriod(bwup *BandwidthUsagePeriod) string {
+	if bwup == nil {
+		return ""
+	}
+	document, err := bson.Marshal(bwup)
+	if err != nil {
+		return ""
+	}
+	return hashDocuments([]bson.Raw{document})
+}
+
+// filterJSON writes a filter for a mutation record
+func filterJSON(filter interface{}) string {
+	encoded, err := json.Marshal(filter)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// recordMutation appends a mutation, stamping who made it and when. Without
+// a mutations collection nothing is recorded
+func recordMutation(ctx context.Context, mutations *mongo.Collection, mutation Mutation) error {
+	if mutations == nil {
+		return nil
+	}
+	mutation.Actor = mutationActor()
+	mutation.At = time.Now().UTC()
+	_, err := mutations.InsertOne(ctx, mutation)
+	return err
+}
+
+// snapshotDocuments reads the documents matching a filter in _id order,
+// returning their IDs and hash
+func snapshotDocuments(ctx context.Context, collection *mongo.Collection, filter interface{}) ([]interface{}, string, error) {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	ids := []interface{}{}
+	documents := []bson.Raw{}
+	for cursor.Next(ctx) {
+		document := append(bson.Raw{}, cursor.Current...)
+		documents = append(documents, document)
+		ids = append(ids, document.Lookup("_id"))
+	}
+	return ids, hashDocuments(documents), cursor.Err()
+}
+
+// mutateDocuments applies a change to the documents matching a filter and
+// records it, hashing the documents before and after
+func mutateDocuments(ctx context.Context, mutations *mongo.Collection, collection *mongo.Collection, kind string, network string, filter bson.M, apply func() error) error {
+	if mutations == nil {
+		return apply()
+	}
+
+	ids, before, err := snapshotDocuments(ctx, collection, filter)
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, after, err := snapshotDocuments(ctx, collection, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+
+	return recordMutation(ctx, mutations, Mutation{
+		Kind:       kind,
+		Collection: collection.Name(),
+		Network:    network,
+		Filter:     filterJSON(filter),
+		Documents:  len(ids),
+		Before:     before,
+		After:      after,
+	})
+}
+
+// getMutations reads the mutations recorded in a window, oldest first,
+// only those of one kind if kind isn't empty
+func getMutations(collection *mongo.Collection, network string, kind string, from time.Time, to time.Time) ([]Mutation, error) {
+	all := []Mutation{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"at": bson.M{"$gte": from, "$lt": to}}
+	if network != "" {
+		filter["network"] = network
+	}
+	if kind != "" {
+		filter["kind"] = kind
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"at": 1}))
+	if err != nil {
+		return all, err
+	}
+	err = cursor.All(ctx, &all)
+	return all, err
+}
+
+func (m Mutation) reportColumns() []string {
+	return []string{"AT", "KIND", "COLLECTION", "NETWORK", "DOCUMENTS", "ACTOR", "BEFORE", "AFTER", "FILTER"}
+}
+
+func (m Mutation) reportValues(number func(*float64) string) []string {
+	return []string{
+		m.At.Format(time.RFC3339),
+		m.Kind,
+		m.Collection,
+		m.Network,
+		strconv.Itoa(m.Documents),
+		m.Actor,
+		m.Before,
+		m.After,
+		m.Filter,
+	}
+}
+
+// mutationsCommand lists the mutations of every network's data recorded in
+// the window, only those of a kind with -kind
+func mutationsCommand(args []string) {
+	flags := flag.NewFlagSet("mutations", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	kind := flags.String("kind", "", "only list mutations of this kind: insert, overwrite, merge, prune, alias, tag, restore, correct, compact, downsample, encrypt or forget")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		db, err := getReadDatabase(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		mutations, err := getMutations(db.Collection(settings.MongoMutationsCollection), settings.Network, *kind, from, to)
+		if err != nil {
+			fatal(err)
+		}
+		for _, mutation := range mutations {
+			if err := report.Write(mutation); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
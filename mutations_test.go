@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPeriod(t *testing.T) {
+	bwup := usage(1, 2)
+	bwup.From = time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	bwup.To = bwup.From.Add(time.Hour)
+
+	same := usage(1, 2)
+	same.From, same.To = bwup.From, bwup.To
+
+	altered := usage(1, 2.5)
+	altered.From, altered.To = bwup.From, bwup.To
+
+	if hashPeriod(nil) != "" {
+		t.Errorf("expected no hash without a period")
+	}
+	if len(hashPeriod(&bwup)) != 64 {
+		t.Errorf("expected a SHA-256 hash, got %q", hashPeriod(&bwup))
+	}
+	if hashPeriod(&bwup) != hashPeriod(&same) {
+		t.Errorf("equal periods should hash the same")
+	}
+	if hashPeriod(&bwup) == hashPeriod(&altered) {
+		t.Errorf("altered usage should change the hash")
+	}
+}
+
+func TestFilterJSON(t *testing.T) {
+	bwup := usage(1, 2)
+	bwup.Network = "casa"
+	bwup.MemberID = "rec1"
+	bwup.From = time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	bwup.To = bwup.From.Add(time.Hour)
+
+	expected := `{"from":"2026-09-01T00:00:00Z","interface":{"$exists":false},"memberid":"rec1","network":"casa","to":"2026-09-01T01:00:00Z"}`
+	if filter := filterJSON(usageKey(bwup)); filter != expected {
+		t.Errorf("expected %s, got %s", expected, filter)
+	}
+}
+
+func TestMutationActorRedacted(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	os.Args = []string{"/usr/bin/stat-collector", "-mongo-url=mongodb://admin:hunter2@db", "prune", "mongodb://admin:hunter2@db"}
+	if actor := mutationActor(); strings.Contains(actor, "hunter2") || !strings.Contains(actor, "stat-collector -mongo-url=mongodb://admin:") {
+		t.Errorf("got actor %s", actor)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Information element IDs shared by NetFlow v9 and IPFIX
+const (
+	ieOctetDeltaCount          = 1
+	ieSourceIPv4Address        = 8
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	netflowVariableFieldLength = 65535
+)
+
+// Flow is the part of a flow record we need for per-peer accounting
+type Flow struct {
+	Source      net.IP
+	Destination net.IP
+	Bytes       uint64
+}
+
+type templateField struct {
+	ID     uint16
+	Length uint16
+}
+
+type templateKey struct {
+	Exporter   string
+	Domain     uint32
+	TemplateID uint16
+}
+
+// FlowDecoder turns NetFlow v5, NetFlow v9 and IPFIX packets into flows. v9
+// and IPFIX data can only be decoded once the exporter has sent the template
+// describing it, so templates are remembered per exporter
+type FlowDecoder struct {
+	templates map[templateKey][]templateField
+}
+
+func newFlowDecoder() *FlowDecoder {
+	return &FlowDecoder{templates: map[templateKey][]templateField{}}
+}
+
+// Decode returns the flows in a packet along with the time it was exported
+func (d *FlowDecoder) Decode(exporter string, packet []byte) ([]Flow, time.Time, error) {
+	if len(packet) < 2 {
+		return nil, time.Time{}, fmt.Errorf("packet too short")
+	}
+
+	switch version := binary.BigEndian.Uint16(packet); version {
+	case 5:
+		return decodeNetflowV5(packet)
+	case 9:
+		return d.decodeNetflowV9(exporter, packet)
+	case 10:
+		return d.decodeIPFIX(exporter, packet)
+	default:
+		return nil, time.Time{}, fmt.Errorf("unsupported flow export version %d", version)
+	}
+}
+
+func decodeNetflowV5(packet []byte) ([]Flow, time.Time, error) {
+	const headerLength = 24
+	const recordLength = 48
+
+	if len(packet) < headerLength {
+		return nil, time.Time{}, fmt.Errorf("netflow v5 header too short")
+	}
+
+	count := int(binary.BigEndian.Uint16(packet[2:]))
+	exported := time.Unix(int64(binary.BigEndian.Uint32(packet[8:])), 0)
+
+	if len(packet) < headerLength+count*recordLength {
+		return nil, exported, fmt.Errorf("netflow v5 packet truncated")
+	}
+
+	flows := make([]Flow, 0, count)
+	for i := 0; i < count; i++ {
+		record := packet[headerLength+i*recordLength:]
+		flows = append(flows, Flow{
+			Source:      net.IP(append([]byte{}, record[0:4]...)),
+			Destination: net.IP(append([]byte{}, record[4:8]...)),
+			Bytes:       uint64(binary.BigEndian.Uint32(record[20:])),
+		})
+	}
+
+	return flows, exported, nil
+}
+
+func (d *FlowDecoder) decodeNetflowV9(exporter string, packet []byte) ([]Flow, time.Time, error) {
+	const headerLength = 20
+
+	if len(packet) < headerLength {
+		return nil, time.Time{}, fmt.Errorf("netflow v9 header too short")
+	}
+
+	exported := time.Unix(int64(binary.BigEndian.Uint32(packet[8:])), 0)
+	domain := binary.BigEndian.Uint32(packet[16:])
+
+	// In v9 set ID 0 carries templates and 1 carries options templates
+	flows, err := d.decodeSets(exporter, domain, packet[headerLength:], 0, 1, false)
+	return flows, exported, err
+}
+
+func (d *FlowDecoder) decodeIPFIX(exporter string, packet []byte) ([]Flow, time.Time, error) {
+	const headerLength = 16
+
+	if len(packet) < headerLength {
+		return nil, time.Time{}, fmt.Errorf("ipfix header too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	if length > len(packet) || length < headerLength {
+		return nil, time.Time{}, fmt.Errorf("ipfix message truncated")
+	}
+
+	exported := time.Unix(int64(binary.BigEndian.Uint32(packet[4:])), 0)
+	domain := binary.BigEndian.Uint32(packet[12:])
+
+	// In IPFIX set ID 2 carries templates and 3 carries options templates
+	flows, err := d.decodeSets(exporter, domain, packet[headerLength:length], 2, 3, true)
+	return flows, exported, err
+}
+
+func (d *FlowDecoder) decodeSets(exporter string, domain uint32, sets []byte, templateSetID uint16, optionsSetID uint16, ipfix bool) ([]Flow, error) {
+	flows := []Flow{}
+
+	for len(sets) >= 4 {
+		setID := binary.BigEndian.Uint16(sets)
+		setLength := int(binary.BigEndian.Uint16(sets[2:]))
+		if setLength < 4 || setLength > len(sets) {
+			return flows, fmt.Errorf("flow set truncated")
+		}
+		body := sets[4:setLength]
+		sets = sets[setLength:]
+
+		switch {
+		case setID == templateSetID:
+			if err := d.readTemplates(exporter, domain, body, ipfix); err != nil {
+				return flows, err
+			}
+		case setID == optionsSetID:
+			// Options records describe the exporter rather than traffic
+		case setID >= 256:
+			fields, ok := d.templates[templateKey{exporter, domain, setID}]
+			if !ok {
+				// We haven't seen this template yet, exporters resend
+				// them periodically so later packets will decode
+				continue
+			}
+			flows = append(flows, decodeDataRecords(body, fields)...)
+		}
+	}
+
+	return flows, nil
+}
+
+func (d *FlowDecoder) readTemplates(exporter string, domain uint32, body []byte, ipfix bool) error {
+	for len(body) >= 4 {
+		templateID := binary.BigEndian.Uint16(body)
+		fieldCount := int(binary.BigEndian.Uint16(body[2:]))
+		body = body[4:]
+
+		fields := make([]templateField, 0, fieldCount)
+		for i := 0; i < fieldCount; i++ {
+			if len(body) < 4 {
+				return fmt.Errorf("template truncated")
+			}
+			field := templateField{
+				ID:     binary.BigEndian.Uint16(body),
+				Length: binary.BigEndian.Uint16(body[2:]),
+			}
+			body = body[4:]
+
+			// IPFIX enterprise specific elements carry an enterprise
+			// number which we skip, none of them are of interest
+			if ipfix && field.ID&0x8000 != 0 {
+				if len(body) < 4 {
+					return fmt.Errorf("template truncated")
+				}
+				body = body[4:]
+				field.ID = 0
+			}
+
+			fields = append(fields, field)
+		}
+
+		d.templates[templateKey{exporter, domain, templateID}] = fields
+	}
+
+	return nil
+}
+
+func decodeDataRecords(body []byte, fields []templateField) []Flow {
+	flows := []Flow{}
+
+	for len(body) > 0 {
+		var flow Flow
+		offset := 0
+
+		for _, field := range fields {
+			length := int(field.Length)
+			if field.Length == netflowVariableFieldLength {
+				if offset >= len(body) {
+					return flows
+				}
+				length = int(body[offset])
+				offset++
+				if length == 255 {
+					if offset+2 > len(body) {
+						return flows
+					}
+					length = int(binary.BigEndian.Uint16(body[offset:]))
+					offset += 2
+				}
+			}
+
+			if offset+length > len(body) {
+				// What's left is padding
+				return flows
+			}
+			value := body[offset : offset+length]
+			offset += length
+
+			switch field.ID {
+			case ieOctetDeltaCount:
+				flow.Bytes = readUint(value)
+			case ieSourceIPv4Address, ieSourceIPv6Address:
+				flow.Source = net.IP(append([]byte{}, value...))
+			case ieDestinationIPv4Address, ieDestinationIPv6Address:
+				flow.Destination = net.IP(append([]byte{}, value...))
+			}
+		}
+
+		if offset == 0 {
+			return flows
+		}
+		body = body[offset:]
+		flows = append(flows, flow)
+	}
+
+	return flows
+}
+
+// readUint decodes a big endian unsigned integer of up to 8 bytes, since
+// exporters are free to use reduced size encoding for counters
+func readUint(value []byte) uint64 {
+	var n uint64
+	for _, b := range value {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// NetflowCounter is the number of bytes sent to or from one peer address
+// during one hour
+type NetflowCounter struct {
+	Network   string
+	Address   string
+	Direction string
+	Hour      time.Time
+	Bytes     uint64
+}
+
+type counterKey struct {
+	Address   string
+	Direction string
+	Hour      int64
+}
+
+// FlowAccumulator sums flows into per-peer hourly counters between flushes
+type FlowAccumulator struct {
+	network      string
+	mutex        sync.Mutex
+	prefixes     []*net.IPNet
+	samplingRate uint64
+	counters     map[counterKey]uint64
+}
+
+func (a *FlowAccumulator) isPeer(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *FlowAccumulator) Add(flows []Flow, exported time.Time) {
+	hour := exported.Truncate(time.Hour).Unix()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, flow := range flows {
+		bytes := flow.Bytes * a.samplingRate
+
+		// Traffic from a peer was uploaded by them, traffic to a peer was
+		// downloaded by them
+		if a.isPeer(flow.Source) {
+			a.counters[counterKey{flow.Source.String(), "up", hour}] += bytes
+		}
+		if a.isPeer(flow.Destination) {
+			a.counters[counterKey{flow.Destination.String(), "down", hour}] += bytes
+		}
+	}
+}
+
+// Flush adds the accumulated counters onto the stored ones and resets them
+func (a *FlowAccumulator) Flush(collection *mongo.Collection) error {
+	a.mutex.Lock()
+	counters := a.counters
+	a.counters = map[counterKey]uint64{}
+	a.mutex.Unlock()
+
+	if len(counters) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(counters))
+	for key, bytes := range counters {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"network": a.network, "address": encryptName(a.network, key.Address), "direction": key.Direction, "hour": time.Unix(key.Hour, 0)}).
+			SetUpdate(bson.M{"$inc": bson.M{"bytes": int64(bytes)}}).
+			SetUpsert(true))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		// Put the counters back so they go out with the next flush
+		a.mutex.Lock()
+		for key, bytes := range counters {
+			a.counters[key] += bytes
+		}
+		a.mutex.Unlock()
+	}
+	return err
+}
+
+func parsePrefixes(cidrs []string) ([]*net.IPNet, error) {
+	prefixes := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// netflowCommand listens for flow exports from the exit routers and keeps
+// hourly per-peer byte counters in Mongo for the netflow stat source
+func netflowCommand(args []string) {
+	settings := loadSettings()
+
+	prefixes, err := parsePrefixes(settings.NetflowPeerPrefixes)
+	if err != nil {
+		fatal(err)
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	collection := db.Collection(settings.NetflowCollection)
+
+	conn, err := net.ListenPacket("udp", settings.NetflowListen)
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close()
+
+	log.Printf("Listening for flow exports on %s", conn.LocalAddr())
+
+	accumulator := &FlowAccumulator{
+		network:      settings.Network,
+		prefixes:     prefixes,
+		samplingRate: settings.NetflowSamplingRate,
+		counters:     map[counterKey]uint64{},
+	}
+
+	go func() {
+		decoder := newFlowDecoder()
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				log.Printf("Error reading flow export: %v", err)
+				continue
+			}
+
+			flows, exported, err := decoder.Decode(addr.String(), buffer[:n])
+			if err != nil {
+				log.Printf("Error decoding flow export from %s: %v", addr, err)
+			}
+			accumulator.Add(flows, exported)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(settings.NetflowFlushInterval)
+	defer ticker.Stop()
+
+	// Past days' counters are compacted into histograms once a day is over
+	var compactedAt time.Time
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := accumulator.Flush(collection); err != nil {
+				log.Printf("Error saving flow counters: %v", err)
+			}
+			if time.Since(compactedAt) >= time.Hour {
+				if err := compactNetflow(settings, db, time.Now()); err != nil {
+					log.Printf("Error compacting flow counters: %v", err)
+				}
+				compactedAt = time.Now()
+			}
+		case <-signals:
+			if err := accumulator.Flush(collection); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+}
+
+// NetflowSource sums the hourly counters kept by the netflow command for the
+// member's mesh IP, and the histograms past days' counters are compacted
+// into. Counters are hourly, so the window is effectively rounded to whole
+// hours
+type NetflowSource struct {
+	network    string
+	collection *mongo.Collection
+	histograms *mongo.Collection
+}
+
+func (s NetflowSource) Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error) {
+	ip := net.ParseIP(member.Fields.MeshIP)
+	if ip == nil {
+		// Without an address there is no way to attribute flows
+		return nil, fmt.Errorf("member %s has no valid mesh IP to attribute flows to", member.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			"network":   networkMatch(s.network),
+			"address":   encryptName(s.network, ip.String()),
+			"direction": direction,
+			"hour":      bson.M{"$gte": from, "$lt": to},
+		}},
+		{"$group": bson.M{"_id": nil, "bytes": bson.M{"$sum": "$bytes"}}},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var result struct {
+		Bytes int64
+	}
+	counted := cursor.Next(ctx)
+	if counted {
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+	} else if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.histograms != nil {
+		bytes, found, err := sumNetflowHistograms(ctx, s.histograms, s.network, ip.String(), direction, from, to)
+		if err != nil {
+			return nil, err
+		}
+		result.Bytes += bytes
+		counted = counted || found
+	}
+
+	if !counted {
+		return nil, nil
+	}
+	sum := bytesToGb(float64(result.Bytes))
+	return &sum, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func be16(n int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	return b
+}
+
+func be32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func join(parts ...[]byte) []byte {
+	packet := []byte{}
+	for _, part := range parts {
+		packet = append(packet, part...)
+	}
+	return packet
+}
+
+// flowSet wraps a body in a set header, its length counting the header
+func flowSet(id int, body []byte) []byte {
+	return join(be16(id), be16(len(body)+4), body)
+}
+
+func netflowV5Packet(count int, records ...[]byte) []byte {
+	header := join(be16(5), be16(count), be32(0), be32(1700000000), make([]byte, 12))
+	return join(append([][]byte{header}, records...)...)
+}
+
+func netflowV5Record(src string, dst string, bytes uint32) []byte {
+	record := make([]byte, 48)
+	copy(record[0:], net.ParseIP(src).To4())
+	copy(record[4:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint32(record[20:], bytes)
+	return record
+}
+
+func netflowV9Packet(sets ...[]byte) []byte {
+	header := join(be16(9), be16(len(sets)), be32(0), be32(1700000000), be32(1), be32(7))
+	return join(append([][]byte{header}, sets...)...)
+}
+
+func ipfixPacket(sets ...[]byte) []byte {
+	body := join(sets...)
+	return join(be16(10), be16(16+len(body)), be32(1700000000), be32(1), be32(7), body)
+}
+
+// ipv4Template describes records of source, destination and byte count
+func ipv4Template(id int, bytesLength int) []byte {
+	return join(be16(id), be16(3),
+		be16(ieSourceIPv4Address), be16(4),
+		be16(ieDestinationIPv4Address), be16(4),
+		be16(ieOctetDeltaCount), be16(bytesLength))
+}
+
+func ipv4Record(src string, dst string, bytes []byte) []byte {
+	return join(net.ParseIP(src).To4(), net.ParseIP(dst).To4(), bytes)
+}
+
+func checkFlows(t *testing.T, name string, got []Flow, want []Flow) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d flows, want %d: %+v", name, len(got), len(want), got)
+		return
+	}
+	for i := range want {
+		if !got[i].Source.Equal(want[i].Source) || !got[i].Destination.Equal(want[i].Destination) || got[i].Bytes != want[i].Bytes {
+			t.Errorf("%s: flow %d is %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func flow(src string, dst string, bytes uint64) Flow {
+	return Flow{Source: net.ParseIP(src), Destination: net.ParseIP(dst), Bytes: bytes}
+}
+
+func TestDecodeNetflowV5(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		flows  []Flow
+		valid  bool
+	}{
+		{"empty", []byte{}, nil, false},
+		{"version only", be16(5), nil, false},
+		{"unknown version", join(be16(7), make([]byte, 22)), nil, false},
+		{"no records", netflowV5Packet(0), []Flow{}, true},
+		{"two records", netflowV5Packet(2,
+			netflowV5Record("10.0.0.1", "1.1.1.1", 100),
+			netflowV5Record("8.8.8.8", "10.0.0.2", 4000000000)),
+			[]Flow{flow("10.0.0.1", "1.1.1.1", 100), flow("8.8.8.8", "10.0.0.2", 4000000000)}, true},
+		{"count beyond records", netflowV5Packet(3, netflowV5Record("10.0.0.1", "1.1.1.1", 1)), nil, false},
+		{"truncated record", netflowV5Packet(1, netflowV5Record("10.0.0.1", "1.1.1.1", 1)[:47]), nil, false},
+		{"huge count", netflowV5Packet(65535, netflowV5Record("10.0.0.1", "1.1.1.1", 1)), nil, false},
+	}
+
+	for _, test := range tests {
+		flows, _, err := newFlowDecoder().Decode("exporter", test.packet)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		checkFlows(t, test.name, flows, test.flows)
+	}
+}
+
+func TestDecodeNetflowV9(t *testing.T) {
+	template := flowSet(0, ipv4Template(256, 4))
+	data := flowSet(256, join(
+		ipv4Record("10.0.0.1", "1.1.1.1", be32(1500)),
+		ipv4Record("1.1.1.1", "10.0.0.1", be32(60)),
+		[]byte{0, 0, 0}, // padding to a 4 byte boundary
+	))
+	want := []Flow{flow("10.0.0.1", "1.1.1.1", 1500), flow("1.1.1.1", "10.0.0.1", 60)}
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		flows   []Flow
+		valid   bool
+	}{
+		{"header too short", [][]byte{netflowV9Packet()[:19]}, nil, false},
+		{"template and data", [][]byte{netflowV9Packet(template, data)}, want, true},
+		{"template in an earlier packet", [][]byte{netflowV9Packet(template), netflowV9Packet(data)}, want, true},
+		{"data before its template", [][]byte{netflowV9Packet(data)}, []Flow{}, true},
+		{"options template ignored", [][]byte{netflowV9Packet(flowSet(1, make([]byte, 8)), template, data)}, want, true},
+		{"set longer than packet", [][]byte{netflowV9Packet(template, data[:len(data)-8])}, nil, false},
+		{"set shorter than its header", [][]byte{netflowV9Packet(join(be16(256), be16(2)))}, nil, false},
+		{"truncated template", [][]byte{netflowV9Packet(flowSet(0, ipv4Template(256, 4)[:10]))}, nil, false},
+		{"reduced size counter", [][]byte{netflowV9Packet(
+			flowSet(0, ipv4Template(257, 2)),
+			flowSet(257, ipv4Record("10.0.0.1", "1.1.1.1", be16(512))),
+		)}, []Flow{flow("10.0.0.1", "1.1.1.1", 512)}, true},
+		{"8 byte counter", [][]byte{netflowV9Packet(
+			flowSet(0, ipv4Template(258, 8)),
+			flowSet(258, ipv4Record("10.0.0.1", "1.1.1.1", join(be32(1), be32(0)))),
+		)}, []Flow{flow("10.0.0.1", "1.1.1.1", 1<<32)}, true},
+		{"record cut short", [][]byte{netflowV9Packet(template,
+			flowSet(256, ipv4Record("10.0.0.1", "1.1.1.1", be32(1500))[:10]),
+		)}, []Flow{}, true},
+	}
+
+	for _, test := range tests {
+		decoder := newFlowDecoder()
+
+		var flows []Flow
+		var err error
+		for _, packet := range test.packets {
+			var packetFlows []Flow
+			packetFlows, _, err = decoder.Decode("exporter", packet)
+			flows = append(flows, packetFlows...)
+		}
+
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		if flows == nil {
+			flows = []Flow{}
+		}
+		checkFlows(t, test.name, flows, test.flows)
+	}
+}
+
+func TestDecodeNetflowV9TemplatesPerExporter(t *testing.T) {
+	decoder := newFlowDecoder()
+
+	if _, _, err := decoder.Decode("a", netflowV9Packet(flowSet(0, ipv4Template(256, 4)))); err != nil {
+		t.Fatal(err)
+	}
+
+	data := netflowV9Packet(flowSet(256, ipv4Record("10.0.0.1", "1.1.1.1", be32(1))))
+	flows, _, err := decoder.Decode("b", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 0 {
+		t.Errorf("another exporter's template was used: %+v", flows)
+	}
+}
+
+func TestDecodeIPFIX(t *testing.T) {
+	// Source and destination, then a variable length field and an
+	// enterprise specific one which are both skipped, then the byte count
+	template := flowSet(2, join(be16(300), be16(5),
+		be16(ieSourceIPv6Address), be16(16),
+		be16(ieDestinationIPv6Address), be16(16),
+		be16(82), be16(netflowVariableFieldLength),
+		be16(0x8000|1), be16(2), be32(29305),
+		be16(ieOctetDeltaCount), be16(8),
+	))
+
+	record := func(name []byte, bytes uint32) []byte {
+		return join(net.ParseIP("fd00::1"), net.ParseIP("2001:db8::1"), name, be16(0), be32(0), be32(bytes))
+	}
+	long := make([]byte, 300)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		flows  []Flow
+		valid  bool
+	}{
+		{"header too short", ipfixPacket()[:15], nil, false},
+		{"length beyond packet", join(be16(10), be16(64), make([]byte, 14)), nil, false},
+		{"length shorter than header", join(be16(10), be16(8), make([]byte, 14)), nil, false},
+		{"short variable length", ipfixPacket(template, flowSet(300, join(
+			record(join([]byte{3}, []byte("wg0")), 1200),
+			record([]byte{0}, 80),
+		))), []Flow{flow("fd00::1", "2001:db8::1", 1200), flow("fd00::1", "2001:db8::1", 80)}, true},
+		{"long variable length", ipfixPacket(template, flowSet(300,
+			record(join([]byte{255}, be16(len(long)), long), 99),
+		)), []Flow{flow("fd00::1", "2001:db8::1", 99)}, true},
+		{"variable length beyond record", ipfixPacket(template, flowSet(300,
+			join(net.ParseIP("fd00::1"), net.ParseIP("2001:db8::1"), []byte{200}, []byte("wg0")),
+		)), []Flow{}, true},
+		{"truncated long length", ipfixPacket(template, flowSet(300,
+			join(net.ParseIP("fd00::1"), net.ParseIP("2001:db8::1"), []byte{255, 1}),
+		)), []Flow{}, true},
+		{"truncated enterprise number", ipfixPacket(flowSet(2, join(be16(301), be16(1), be16(0x8001), be16(4), be16(0)))), nil, false},
+	}
+
+	for _, test := range tests {
+		flows, _, err := newFlowDecoder().Decode("exporter", test.packet)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		checkFlows(t, test.name, flows, test.flows)
+	}
+}
+
+func TestDecodeDataRecordsEmptyTemplate(t *testing.T) {
+	// A template whose fields take no space must not loop forever
+	flows := decodeDataRecords(make([]byte, 16), []templateField{{ID: ieOctetDeltaCount, Length: 0}})
+	if len(flows) != 0 {
+		t.Errorf("got %+v, want no flows", flows)
+	}
+	if flows := decodeDataRecords(make([]byte, 16), nil); len(flows) != 0 {
+		t.Errorf("got %+v, want no flows", flows)
+	}
+}
+
+func TestFlowAccumulator(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accumulator := &FlowAccumulator{prefixes: prefixes, samplingRate: 10, counters: map[counterKey]uint64{}}
+	accumulator.Add([]Flow{
+		flow("10.0.0.1", "1.1.1.1", 100),
+		flow("1.1.1.1", "10.0.0.1", 5),
+		flow("10.0.0.1", "10.0.0.2", 1),
+		flow("1.1.1.1", "8.8.8.8", 1000),
+		{Bytes: 7},
+	}, time.Unix(1700000000, 0))
+
+	hour := time.Unix(1700000000, 0).Truncate(time.Hour).Unix()
+	want := map[counterKey]uint64{
+		{"10.0.0.1", "up", hour}:   1010,
+		{"10.0.0.1", "down", hour}: 50,
+		{"10.0.0.2", "down", hour}: 10,
+	}
+	if len(accumulator.counters) != len(want) {
+		t.Errorf("got counters %+v, want %+v", accumulator.counters, want)
+	}
+	for key, bytes := range want {
+		if accumulator.counters[key] != bytes {
+			t.Errorf("%+v: got %d, want %d", key, accumulator.counters[key], bytes)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MemberOverride changes how a member is collected, set with a JSON object
+// in the member's Overrides column, or under the member's record ID in
+// MEMBER_OVERRIDES_FILE, whose entry takes the place of the column's
+type MemberOverride struct {
+	// Exclude leaves the member out of collection
+	Exclude bool `json:"exclude,omitempty" yaml:"exclude"`
+	// UpQuery and DownQuery are Graylog query templates like
+	// GRAYLOG_UP_QUERY, which the member is queried with as in the
+	// structured query mode
+	UpQuery   string `json:"up_query,omitempty" yaml:"up_query"`
+	DownQuery string `json:"down_query,omitempty" yaml:"down_query"`
+	// Stream is the Graylog stream the member's usage is queried in, in
+	// place of GRAYLOG_STREAM
+	Stream string `json:"stream,omitempty" yaml:"stream"`
+	// PlanMbps takes the place of the member's plan
+	PlanMbps *float64 `json:"plan_mbps,omitempty" yaml:"plan_mbps"`
+}
+
+// queried is true of overrides changing the member's Graylog queries, which
+// can't be grouped with other members'
+func (o *MemberOverride) queried() bool {
+	return o != nil && (o.UpQuery != "" || o.DownQuery != "" || o.Stream != "")
+}
+
+// graylogSettings are the settings the member's Graylog queries are built
+// with
+func (o *MemberOverride) graylogSettings(settings Settings) Settings {
+	if o == nil {
+		return settings
+	}
+	if o.UpQuery != "" || o.DownQuery != "" {
+		settings.GraylogQueryMode = queryModeStructured
+		if o.UpQuery != "" {
+			settings.GraylogUpQuery = o.UpQuery
+		}
+		if o.DownQuery != "" {
+			settings.GraylogDownQuery = o.DownQuery
+		}
+	}
+	if o.Stream != "" {
+		settings.GraylogStream = o.Stream
+	}
+	return settings
+}
+
+// check refuses query templates without the member's key, which would sum
+// every member's usage
+func (o MemberOverride) check() error {
+	for _, template := range []string{o.UpQuery, o.DownQuery} {
+		if template != "" && !strings.Contains(template, "{key}") {
+			return fmt.Errorf("query %q has no {key}", template)
+		}
+	}
+	return nil
+}
+
+// parseMemberOverride reads the JSON of an Overrides column, refusing
+// unknown keys so that typos don't silently leave a member collected
+func parseMemberOverride(column string) (*MemberOverride, error) {
+	if strings.TrimSpace(column) == "" {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(column))
+	decoder.DisallowUnknownFields()
+	override := &MemberOverride{}
+	if err := decoder.Decode(override); err != nil {
+		return nil, err
+	}
+	return override, override.check()
+}
+
+// readMemberOverrides reads MEMBER_OVERRIDES_FILE, a YAML mapping of
+// member record IDs to their overrides, none if it isn't set
+func readMemberOverrides(settings Settings) (map[string]MemberOverride, error) {
+	overrides := map[string]MemberOverride{}
+	if settings.MemberOverridesFile == "" {
+		return overrides, nil
+	}
+
+	contents, err := ioutil.ReadFile(settings.MemberOverridesFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(bytes.TrimSpace(contents), &overrides); err != nil {
+		return nil, fmt.Errorf("%s is not valid: %v", settings.MemberOverridesFile, err)
+	}
+	for id, override := range overrides {
+		if err := override.check(); err != nil {
+			return nil, fmt.Errorf("%s: member %s: %v", settings.MemberOverridesFile, id, err)
+		}
+	}
+	return overrides, nil
+}
+
+// applyMemberOverrides sets each member's override, and the plan it
+// overrides
+func applyMemberOverrides(settings Settings, members []MeshMember) ([]MeshMember, error) {
+	overrides, err := readMemberOverrides(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, member := range members {
+		if override, ok := overrides[member.ID]; ok {
+			members[i].Override = &override
+		} else if members[i].Override, err = parseMemberOverride(member.Fields.Overrides); err != nil {
+			return nil, fmt.Errorf("the overrides of %s are not valid: %v", member.Fields.Name, err)
+		}
+
+		if override := members[i].Override; override != nil && override.PlanMbps != nil {
+			members[i].Fields.PlanMbps = *override.PlanMbps
+		}
+	}
+	return members, nil
+}
+
+// collectedMembers leaves out the members excluded from collection
+func collectedMembers(members []MeshMember) []MeshMember {
+	collected := make([]MeshMember, 0, len(members))
+	for _, member := range members {
+		if member.Override != nil && member.Override.Exclude {
+			log.Printf("Not collecting %s, excluded by their overrides", member.Fields.Name)
+			continue
+		}
+		collected = append(collected, member)
+	}
+	return collected
+}
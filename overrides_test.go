@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMemberOverride(t *testing.T) {
+	override, err := parseMemberOverride(`{"stream": "abc123", "plan_mbps": 50, "up_query": "src:\"{key}\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if override.Stream != "abc123" || *override.PlanMbps != 50 || !override.queried() || override.Exclude {
+		t.Errorf("got %+v", override)
+	}
+
+	if override, err := parseMemberOverride("  "); err != nil || override != nil {
+		t.Errorf("empty: got %+v and error %v", override, err)
+	}
+
+	for _, column := range []string{`{"exclude": yes}`, `{"exlude": true}`, `{"down_query": "direction:down"}`} {
+		if _, err := parseMemberOverride(column); err == nil {
+			t.Errorf("%s: should have failed", column)
+		}
+	}
+
+	var none *MemberOverride
+	if none.queried() || (&MemberOverride{Exclude: true}).queried() {
+		t.Error("expected no overridden queries")
+	}
+}
+
+func TestApplyMemberOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overrides.yaml")
+	if err := ioutil.WriteFile(path, []byte("rec2:\n  exclude: true\nrec3:\n  plan_mbps: 100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings := Settings{MemberOverridesFile: path}
+
+	members := []MeshMember{{ID: "rec1"}, {ID: "rec2"}, {ID: "rec3"}, {ID: "rec4"}}
+	members[0].Fields.Overrides = `{"stream": "abc123"}`
+	members[1].Fields.Name = "Bob"
+	members[2].Fields.PlanMbps = 25
+	// The file's entry takes the place of the column's
+	members[2].Fields.Overrides = `{"exclude": true}`
+
+	members, err = applyMemberOverrides(settings, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members[0].Override == nil || members[0].Override.Stream != "abc123" {
+		t.Errorf("got %+v, want the column's override", members[0].Override)
+	}
+	if members[2].Fields.PlanMbps != 100 || members[2].Override.Exclude {
+		t.Errorf("got %+v with plan %v, want the file's override", members[2].Override, members[2].Fields.PlanMbps)
+	}
+	if members[3].Override != nil {
+		t.Errorf("got %+v, want no override", members[3].Override)
+	}
+
+	collected := collectedMembers(members)
+	if len(collected) != 3 || collected[1].ID != "rec3" {
+		t.Errorf("got %+v, want Bob left out", collected)
+	}
+
+	bad := []MeshMember{{ID: "rec5"}}
+	bad[0].Fields.Overrides = `{"stream": 5}`
+	if _, err := applyMemberOverrides(Settings{}, bad); err == nil {
+		t.Error("bad column: should have failed")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("rec1:\n  strem: abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyMemberOverrides(settings, []MeshMember{{ID: "rec1"}}); err == nil {
+		t.Error("bad file: should have failed")
+	}
+}
+
+func TestGraylogOverride(t *testing.T) {
+	type request struct{ query, filter string }
+	requests := []request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, request{r.URL.Query().Get("query"), r.URL.Query().Get("filter")})
+		fmt.Fprint(w, `{"count": 1, "sum": 1000000000}`)
+	}))
+	defer server.Close()
+
+	source := GraylogSource{settings: Settings{GraylogURL: server.URL + "/", GraylogQueryMode: queryModePhrase, GraylogStream: "main"}}
+	member := MeshMember{ID: "rec1"}
+	member.Fields.WGKey = "key1"
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, _, err := source.SumWithCount(member, "up", from, from.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	member.Override = &MemberOverride{UpQuery: `peer:"{key}" AND up`, Stream: "other"}
+	if _, _, err := source.SumWithCount(member, "up", from, from.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []request{
+		{`"key1" AND "uploaded to exit"`, "streams:main"},
+		{`peer:"key1" AND up`, "streams:other"},
+	}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", requests, want)
+	}
+}
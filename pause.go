@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemberPause stops collecting a member's usage, during a billing dispute
+// say, from PausedAt until ResumedAt. Pauses are kept once resumed, so the
+// gap they left in the member's usage can be explained, and backfills
+// don't fill it in
+type MemberPause struct {
+	ID        string `bson:"_id"`
+	Network   string
+	MemberID  string
+	Reason    string
+	Author    string
+	PausedAt  time.Time
+	ResumedAt *time.Time `json:",omitempty"`
+}
+
+// overlaps checks the member was paused during some of the window
+func (p MemberPause) overlaps(from time.Time, to time.Time) bool {
+	if !p.PausedAt.Before(to) {
+		return false
+	}
+	return p.ResumedAt == nil || p.ResumedAt.After(from)
+}
+
+// PausedError refuses to pause a member paused already
+type PausedError struct {
+	MemberID string
+}
+
+func (e PausedError) Error() string {
+	return fmt.Sprintf("member %s is paused already", e.MemberID)
+}
+
+// pauseMember stores a new pause of a member, refusing to pause a member
+// twice
+func pauseMember(collection *mongo.Collection, pause MemberPause) (MemberPause, error) {
+	if pause.MemberID == "" {
+		return pause, fmt.Errorf("a pause needs a member")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := collection.FindOne(ctx, bson.M{"network": pause.Network, "memberid": pause.MemberID, "resumedat": nil}).Err()
+	if err == nil {
+		return pause, PausedError{MemberID: pause.MemberID}
+	}
+	if err != mongo.ErrNoDocuments {
+		return pause, err
+	}
+
+	pause.ID = newRecordID()
+	pause.Reason = strings.TrimSpace(pause.Reason)
+	pause.PausedAt = time.Now().UTC()
+	pause.ResumedAt = nil
+	_, err = collection.InsertOne(ctx, pause)
+	return pause, err
+}
+
+// resumeMember ends the pause of a member, reporting whether it was paused
+func resumeMember(collection *mongo.Collection, network string, memberID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"network": network, "memberid": memberID, "resumedat": nil},
+		bson.M{"$set": bson.M{"resumedat": time.Now().UTC()}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// getMemberPauses reads the pauses of a network, those of the member if
+// memberID isn't empty, and only the current ones if current is set
+func getMemberPauses(collection *mongo.Collection, network string, memberID string, current bool) ([]MemberPause, error) {
+	pauses := []MemberPause{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"network": network}
+	if memberID != "" {
+		filter["memberid"] = memberID
+	}
+	if current {
+		filter["resumedat"] = nil
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "pausedat", Value: 1}}))
+	if err != nil {
+		return pauses, err
+	}
+	err = cursor.All(ctx, &pauses)
+	return pauses, err
+}
+
+// unpausedMembers leaves out the members paused, returning the IDs of
+// those left out
+func unpausedMembers(members []MeshMember, pauses []MemberPause) ([]MeshMember, []string) {
+	paused := map[string]bool{}
+	for _, pause := range pauses {
+		if pause.ResumedAt == nil {
+			paused[pause.MemberID] = true
+		}
+	}
+
+	unpaused := make([]MeshMember, 0, len(members))
+	left := []string{}
+	for _, member := range members {
+		if paused[member.ID] {
+			log.Printf("Not collecting %s, paused", member.Fields.Name)
+			left = append(left, member.ID)
+			continue
+		}
+		unpaused = append(unpaused, member)
+	}
+	return unpaused, left
+}
+
+// unpausedTasks leaves out the backfill tasks of members paused during
+// their window
+func unpausedTasks(tasks []backfillTask, pauses []MemberPause) []backfillTask {
+	unpaused := make([]backfillTask, 0, len(tasks))
+	for _, task := range tasks {
+		paused := false
+		for _, pause := range pauses {
+			if pause.MemberID == task.Member.ID && pause.overlaps(task.Window.From, task.Window.To) {
+				paused = true
+				break
+			}
+		}
+		if !paused {
+			unpaused = append(unpaused, task)
+		}
+	}
+	return unpaused
+}
+
+func (p MemberPause) reportColumns() []string {
+	return []string{"ID", "NETWORK", "MEMBER", "PAUSED", "RESUMED", "AUTHOR", "REASON"}
+}
+
+func (p MemberPause) reportValues(number func(*float64) string) []string {
+	resumed := ""
+	if p.ResumedAt != nil {
+		resumed = p.ResumedAt.UTC().Format(time.RFC3339)
+	}
+	return []string{p.ID, p.Network, p.MemberID, p.PausedAt.UTC().Format(time.RFC3339), resumed, p.Author, p.Reason}
+}
+
+// pauseCommand pauses collection for a member, or with -list lists the
+// network's pauses, the current ones unless -all is given
+func pauseCommand(args []string) {
+	flags := flag.NewFlagSet("pause", flag.ExitOnError)
+	list := flags.Bool("list", false, "list the pauses rather than adding one")
+	all := flags.Bool("all", false, "with -list, list resumed pauses too")
+	author := flags.String("author", os.Getenv("USER"), "who is pausing the member")
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	settings := loadSettings()
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	collection := db.Collection(settings.MongoPausesCollection)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *list {
+		pauses, err := getMemberPauses(collection, settings.Network, flags.Arg(0), !*all)
+		if err != nil {
+			fatal(err)
+		}
+		for _, pause := range pauses {
+			report.Write(pause)
+		}
+	} else {
+		if flags.NArg() == 0 {
+			fatal("usage: stat-collector pause <member record id> [reason]")
+		}
+		pause, err := pauseMember(collection, MemberPause{
+			Network:  settings.Network,
+			MemberID: flags.Arg(0),
+			Reason:   strings.Join(flags.Args()[1:], " "),
+			Author:   *author,
+		})
+		if err != nil {
+			fatal(err)
+		}
+		report.Write(pause)
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
+
+// resumeCommand resumes collection for a paused member
+func resumeCommand(args []string) {
+	if len(args) != 1 {
+		fatal("usage: stat-collector resume <member record id>")
+	}
+
+	settings := loadSettings()
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	resumed, err := resumeMember(db.Collection(settings.MongoPausesCollection), settings.Network, args[0])
+	if err != nil {
+		fatal(err)
+	}
+	if !resumed {
+		fatal(fmt.Sprintf("member %s isn't paused", args[0]))
+	}
+	fmt.Fprintf(os.Stderr, "Resumed collecting member %s\n", args[0])
+}
+
+// handlePauses lists a network's pauses to viewers, those of the member
+// param if given, and only the current ones with current=true. Operators
+// pause a member with POST and resume it with DELETE and member
+func (s *Server) handlePauses(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	role := roleOperator
+	if r.Method == http.MethodGet {
+		role = roleViewer
+	}
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), role)
+	if !ok {
+		return
+	}
+	collection := tenant.usage.Database().Collection(tenant.settings.MongoPausesCollection)
+
+	switch r.Method {
+	case http.MethodGet:
+		collection = tenant.reads.Database().Collection(tenant.settings.MongoPausesCollection)
+		pauses, err := getMemberPauses(collection, tenant.settings.Network, query.Get("member"), query.Get("current") == "true")
+		if err != nil {
+			log.Printf("Error reading pauses: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error reading pauses")
+			return
+		}
+		writeJSON(w, pauses)
+
+	case http.MethodPost:
+		var pause MemberPause
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&pause); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid pause: "+err.Error())
+			return
+		}
+		pause.Network = tenant.settings.Network
+		if pause.Author == "" {
+			pause.Author = token.Role
+		}
+		if pause.MemberID == "" {
+			writeJSONError(w, http.StatusBadRequest, "a pause needs a MemberID")
+			return
+		}
+
+		pause, err := pauseMember(collection, pause)
+		if _, ok := err.(PausedError); ok {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error pausing member: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error pausing member")
+			return
+		}
+		writeJSON(w, pause)
+
+	case http.MethodDelete:
+		resumed, err := resumeMember(collection, tenant.settings.Network, query.Get("member"))
+		if err != nil {
+			log.Printf("Error resuming member: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "error resuming member")
+			return
+		}
+		if !resumed {
+			writeJSONError(w, http.StatusNotFound, "that member isn't paused")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "pauses require GET, POST or DELETE")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnpausedMembers(t *testing.T) {
+	resumed := time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)
+	pauses := []MemberPause{
+		{MemberID: "rec2", PausedAt: resumed.AddDate(0, 0, -5)},
+		{MemberID: "rec3", PausedAt: resumed.AddDate(0, 0, -5), ResumedAt: &resumed},
+	}
+	members := []MeshMember{{ID: "rec1"}, {ID: "rec2"}, {ID: "rec3"}}
+
+	unpaused, paused := unpausedMembers(members, pauses)
+	if len(unpaused) != 2 || unpaused[0].ID != "rec1" || unpaused[1].ID != "rec3" {
+		t.Errorf("got %+v, want the resumed member collected", unpaused)
+	}
+	if len(paused) != 1 || paused[0] != "rec2" {
+		t.Errorf("got %v paused", paused)
+	}
+}
+
+func TestUnpausedTasks(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	resumed := day(5)
+	pauses := []MemberPause{
+		{MemberID: "rec1", PausedAt: day(3), ResumedAt: &resumed},
+		{MemberID: "rec2", PausedAt: day(6).Add(12 * time.Hour)},
+	}
+
+	tasks := []backfillTask{}
+	for _, id := range []string{"rec1", "rec2"} {
+		for d := 2; d <= 6; d++ {
+			tasks = append(tasks, backfillTask{Member: MeshMember{ID: id}, Window: timeWindow{From: day(d), To: day(d + 1)}})
+		}
+	}
+
+	left := map[string][]int{}
+	for _, task := range unpausedTasks(tasks, pauses) {
+		left[task.Member.ID] = append(left[task.Member.ID], task.Window.From.Day())
+	}
+	// rec1 was paused on the 3rd and 4th, rec2 from halfway through the 6th
+	if len(left["rec1"]) != 3 || left["rec1"][0] != 2 || left["rec1"][1] != 5 || len(left["rec2"]) != 4 {
+		t.Errorf("got %v left to backfill", left)
+	}
+}
+
+func TestPauseRoutes(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens}}, nil)
+	routes := server.routes()
+
+	tests := []struct {
+		method string
+		token  string
+		status int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "mine", http.StatusForbidden},
+		{"POST", "view", http.StatusForbidden},
+		{"DELETE", "view", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/pauses?member=rec1", strings.NewReader(`{"MemberID": "rec1", "Reason": "billing dispute"}`))
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.token, w.Code, test.status)
+		}
+	}
+}
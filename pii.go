@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// piiPrefix marks a member name or key stored encrypted with PII_KEY
+const piiPrefix = "pii:v1:"
+
+// piiCiphers are the keys member names are encrypted with, by network. The
+// key of the environment is under the empty network, for networks without
+// their own
+var (
+	piiCiphers   = map[string]*piiCipher{}
+	piiCiphersMu sync.RWMutex
+)
+
+// piiCipher encrypts member names with AES-GCM. The nonce is derived from
+// the name, so a name always encrypts the same: usage can still be looked
+// up and grouped by name, only revealing which documents share one
+type piiCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// newPIICipher derives separate keys for encrypting and for making nonces
+// from a 32 byte key
+func newPIICipher(key []byte) (*piiCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid PII_KEY, expected 32 bytes, got %d", len(key))
+	}
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("stat-collector pii encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &piiCipher{aead: aead, nonceKey: derive("stat-collector pii nonce")}, nil
+}
+
+func (c *piiCipher) encrypt(value string) string {
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), nil)
+	return piiPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (c *piiCipher) decrypt(value string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, piiPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted name %q", value)
+	}
+	nonce := sealed[:c.aead.NonceSize()]
+	plain, err := c.aead.Open(nil, nonce, sealed[len(nonce):], nil)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt a member name, is PII_KEY the key it was stored with? %v", err)
+	}
+	return string(plain), nil
+}
+
+// parsePIIKey reads PII_KEY, a base64 32 byte key, nil if empty
+func parsePIIKey(value string) (*piiCipher, error) {
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PII_KEY, expected base64: %v", err)
+	}
+	return newPIICipher(key)
+}
+
+// fetchPIIKey runs PII_KEY_COMMAND, which prints the base64 key, like a
+// KMS decrypting the data key kept next to the collector
+func fetchPIIKey(command string) (*piiCipher, error) {
+	fields := strings.Fields(command)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("PII_KEY_COMMAND %s: %v %s", fields[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	c, err := parsePIIKey(string(bytes.TrimSpace(output)))
+	if err != nil {
+		return nil, fmt.Errorf("PII_KEY_COMMAND %s: %v", fields[0], err)
+	}
+	if c == nil {
+		return nil, fmt.Errorf("PII_KEY_COMMAND %s printed no key", fields[0])
+	}
+	return c, nil
+}
+
+// usePIIKey makes the key of the settings the one member names of their
+// network are encrypted and decrypted with. Runs without a key store names
+// in the clear and read encrypted names as they are stored
+func usePIIKey(settings Settings) error {
+	var c *piiCipher
+	var err error
+	if settings.PIIKeyCommand != "" {
+		c, err = fetchPIIKey(settings.PIIKeyCommand)
+	} else {
+		c, err = parsePIIKey(settings.PIIKey)
+	}
+	if err != nil || c == nil {
+		return err
+	}
+
+	piiCiphersMu.Lock()
+	defer piiCiphersMu.Unlock()
+	piiCiphers[settings.Network] = c
+	return nil
+}
+
+// networkPIICipher is the key of a network, nil if it has none
+func networkPIICipher(network string) *piiCipher {
+	piiCiphersMu.RLock()
+	defer piiCiphersMu.RUnlock()
+	if c, ok := piiCiphers[network]; ok {
+		return c
+	}
+	return piiCiphers[""]
+}
+
+// encryptName is the name as stored for a network, for matching stored
+// documents by name. WireGuard keys and mesh addresses identify a member as
+// much as their name does, so they are stored encrypted the same
+func encryptName(network string, name string) string {
+	c := networkPIICipher(network)
+	if c == nil || name == "" || strings.HasPrefix(name, piiPrefix) {
+		return name
+	}
+	return c.encrypt(name)
+}
+
+// decryptName is the name of a member read back from a network's documents
+func decryptName(network string, name string) (string, error) {
+	c := networkPIICipher(network)
+	if c == nil || !strings.HasPrefix(name, piiPrefix) {
+		return name, nil
+	}
+	return c.decrypt(name)
+}
+
+// decryptNames decrypts the names and keys read back from a network's
+// document in place
+func decryptNames(network string, values ...*string) error {
+	for _, value := range values {
+		plain, err := decryptName(network, *value)
+		if err != nil {
+			return err
+		}
+		*value = plain
+	}
+	return nil
+}
+
+// MarshalBSON stores the period with its name encrypted
+func (bwup BandwidthUsagePeriod) MarshalBSON() ([]byte, error) {
+	type stored BandwidthUsagePeriod
+	bwup.Name = encryptName(bwup.Network, bwup.Name)
+	return bson.Marshal(stored(bwup))
+}
+
+// UnmarshalBSON reads a stored period, decrypting its name
+func (bwup *BandwidthUsagePeriod) UnmarshalBSON(data []byte) error {
+	type stored BandwidthUsagePeriod
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	name, err := decryptName(document.Network, document.Name)
+	if err != nil {
+		return err
+	}
+	document.Name = name
+	*bwup = BandwidthUsagePeriod(document)
+	return nil
+}
+
+// UnmarshalBSON reads a rollup, decrypting its name. Rollups are written
+// with the names of the usage they are made from, already encrypted
+func (rollup *UsageRollup) UnmarshalBSON(data []byte) error {
+	type stored UsageRollup
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	name, err := decryptName(document.Network, document.Name)
+	if err != nil {
+		return err
+	}
+	document.Name = name
+	*rollup = UsageRollup(document)
+	return nil
+}
+
+// MarshalBSON stores a member's totals with their name encrypted
+func (totals UsageTotals) MarshalBSON() ([]byte, error) {
+	type stored UsageTotals
+	totals.Name = encryptName(totals.Network, totals.Name)
+	return bson.Marshal(stored(totals))
+}
+
+// UnmarshalBSON reads a member's totals, decrypting their name
+func (totals *UsageTotals) UnmarshalBSON(data []byte) error {
+	type stored UsageTotals
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	name, err := decryptName(document.Network, document.Name)
+	if err != nil {
+		return err
+	}
+	document.Name = name
+	*totals = UsageTotals(document)
+	return nil
+}
+
+// MarshalBSON caches a member with their name and key encrypted
+func (member CachedMember) MarshalBSON() ([]byte, error) {
+	type stored CachedMember
+	member.Name = encryptName(member.Network, member.Name)
+	member.WGKey = encryptName(member.Network, member.WGKey)
+	return bson.Marshal(stored(member))
+}
+
+// UnmarshalBSON reads a cached member, decrypting their name and key
+func (member *CachedMember) UnmarshalBSON(data []byte) error {
+	type stored CachedMember
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if err := decryptNames(document.Network, &document.Name, &document.WGKey); err != nil {
+		return err
+	}
+	*member = CachedMember(document)
+	return nil
+}
+
+// MarshalBSON stores a member change with the names and keys encrypted
+func (change MemberChange) MarshalBSON() ([]byte, error) {
+	type stored MemberChange
+	for _, value := range []*string{&change.Name, &change.WGKey, &change.PreviousName, &change.PreviousWGKey} {
+		*value = encryptName(change.Network, *value)
+	}
+	return bson.Marshal(stored(change))
+}
+
+// UnmarshalBSON reads a member change, decrypting the names and keys
+func (change *MemberChange) UnmarshalBSON(data []byte) error {
+	type stored MemberChange
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if err := decryptNames(document.Network, &document.Name, &document.WGKey, &document.PreviousName, &document.PreviousWGKey); err != nil {
+		return err
+	}
+	*change = MemberChange(document)
+	return nil
+}
+
+// MarshalBSON stores an alias with its name encrypted, as the usage it
+// matches is
+func (alias MemberAlias) MarshalBSON() ([]byte, error) {
+	type stored MemberAlias
+	alias.Name = encryptName(alias.Network, alias.Name)
+	return bson.Marshal(stored(alias))
+}
+
+// UnmarshalBSON reads an alias, decrypting its name
+func (alias *MemberAlias) UnmarshalBSON(data []byte) error {
+	type stored MemberAlias
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if err := decryptNames(document.Network, &document.Name); err != nil {
+		return err
+	}
+	*alias = MemberAlias(document)
+	return nil
+}
+
+// MarshalBSON stores a correction with its name encrypted. The original
+// period encrypts its own
+func (correction UsageCorrection) MarshalBSON() ([]byte, error) {
+	type stored UsageCorrection
+	correction.Name = encryptName(correction.Network, correction.Name)
+	return bson.Marshal(stored(correction))
+}
+
+// UnmarshalBSON reads a correction, decrypting its name
+func (correction *UsageCorrection) UnmarshalBSON(data []byte) error {
+	type stored UsageCorrection
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if err := decryptNames(document.Network, &document.Name); err != nil {
+		return err
+	}
+	*correction = UsageCorrection(document)
+	return nil
+}
+
+// MarshalBSON stores a metric sample with the member's name encrypted
+func (s MemberMetricSample) MarshalBSON() ([]byte, error) {
+	type stored MemberMetricSample
+	s.Name = encryptName(s.Network, s.Name)
+	return bson.Marshal(stored(s))
+}
+
+// UnmarshalBSON reads a metric sample, decrypting the member's name
+func (s *MemberMetricSample) UnmarshalBSON(data []byte) error {
+	type stored MemberMetricSample
+	var document stored
+	if err := bson.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if err := decryptNames(document.Network, &document.Name); err != nil {
+		return err
+	}
+	*s = MemberMetricSample(document)
+	return nil
+}
+
+// NameEncryption is a line of the encrypt-names report
+type NameEncryption struct {
+	Network    string
+	Collection string
+	Field      string
+	Values     int
+	Documents  int64
+}
+
+func (e NameEncryption) reportColumns() []string {
+	return []string{"NETWORK", "COLLECTION", "FIELD", "VALUES", "DOCUMENTS"}
+}
+
+func (e NameEncryption) reportValues(number func(*float64) string) []string {
+	return []string{e.Network, e.Collection, e.Field, fmt.Sprint(e.Values), fmt.Sprint(e.Documents)}
+}
+
+// encryptedField is a field of a collection holding a member name or key
+type encryptedField struct {
+	collection string
+	field      string
+}
+
+// encryptedFields are the fields encrypt-names encrypts. The ingest
+// watermarks have the key in their ID instead, see encryptWatermarks
+func encryptedFields(settings Settings) []encryptedField {
+	fields := []encryptedField{
+		{settings.MongoCollection, "name"},
+		{settings.MongoRollupCollection, "name"},
+		{settings.MongoTotalsCollection, "name"},
+		{settings.MongoMembersCollection, "name"},
+		{settings.MongoMembersCollection, "wgkey"},
+		{settings.MongoMemberChangesCollection, "name"},
+		{settings.MongoMemberChangesCollection, "wgkey"},
+		{settings.MongoMemberChangesCollection, "previousname"},
+		{settings.MongoMemberChangesCollection, "previouswgkey"},
+		{settings.MongoAliasCollection, "name"},
+		{settings.MongoCorrectionsCollection, "name"},
+		{settings.MongoCorrectionsCollection, "original.name"},
+		{settings.MongoMemberMetricsCollection, "name"},
+		{settings.NetflowCollection, "address"},
+		{settings.NetflowHistogramCollection, "address"},
+	}
+
+	kept := []encryptedField{}
+	for _, field := range fields {
+		if field.collection != "" {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// encryptStoredNames encrypts a field of a network's documents stored in
+// the clear, one value at a time, recording each in mutations. Mutations
+// are filtered by document ID, as the value would be kept in the clear in
+// their filter
+func encryptStoredNames(ctx context.Context, collection *mongo.Collection, mutations *mongo.Collection, network string, field string) (NameEncryption, error) {
+	result := NameEncryption{Network: network, Collection: collection.Name(), Field: field}
+
+	clear := bson.M{"network": networkMatch(network), field: bson.M{"$not": primitive.Regex{Pattern: "^" + piiPrefix}}}
+	values, err := collection.Distinct(ctx, field, clear)
+	if err != nil {
+		return result, err
+	}
+
+	for _, value := range values {
+		plain, ok := value.(string)
+		if !ok || plain == "" {
+			continue
+		}
+		ids, err := collection.Distinct(ctx, "_id", bson.M{"network": networkMatch(network), field: plain})
+		if err != nil {
+			return result, err
+		}
+		filter := bson.M{"_id": bson.M{"$in": ids}}
+		err = mutateDocuments(ctx, mutations, collection, mutationEncrypt, network, filter, func() error {
+			updated, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{field: encryptName(network, plain)}})
+			if err == nil {
+				result.Documents += updated.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Values++
+	}
+	return result, nil
+}
+
+// encryptWatermarks encrypts the keys in the IDs of a network's ingest
+// watermarks. An ID can't be changed, so each is saved again under the
+// encrypted one, keeping the later end if both exist, then deleted
+func encryptWatermarks(ctx context.Context, collection *mongo.Collection, mutations *mongo.Collection, network string) (NameEncryption, error) {
+	result := NameEncryption{Network: network, Collection: collection.Name(), Field: "_id"}
+
+	watermarks := []ingestWatermark{}
+	cursor, err := collection.Find(ctx, bson.M{"_id": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(network+"|")}})
+	if err != nil {
+		return result, err
+	}
+	if err := cursor.All(ctx, &watermarks); err != nil {
+		return result, err
+	}
+
+	ids := []string{}
+	renamed := map[string]string{}
+	for _, watermark := range watermarks {
+		split := strings.LastIndex(watermark.ID, "|")
+		key := watermark.ID[split+1:]
+		if key == "" || strings.HasPrefix(key, piiPrefix) {
+			continue
+		}
+		ids = append(ids, watermark.ID)
+		renamed[watermark.ID] = watermark.ID[:split+1] + encryptName(network, key)
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	err = mutateDocuments(ctx, mutations, collection, mutationEncrypt, network, filter, func() error {
+		for _, watermark := range watermarks {
+			encrypted, ok := renamed[watermark.ID]
+			if !ok {
+				continue
+			}
+			_, err := collection.UpdateOne(ctx, bson.M{"_id": encrypted}, bson.M{"$max": bson.M{"to": watermark.To}}, options.Update().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+			if _, err := collection.DeleteOne(ctx, bson.M{"_id": watermark.ID}); err != nil {
+				return err
+			}
+			result.Values++
+			result.Documents++
+		}
+		return nil
+	})
+	return result, err
+}
+
+// encryptNamesCommand encrypts the member names, WireGuard keys and mesh
+// addresses stored before PII_KEY was set, so they are looked up the same
+// as those stored since
+func encryptNamesCommand(args []string) {
+	flags := flag.NewFlagSet("encrypt-names", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, settings := range loadAllNetworkSettings() {
+		if networkPIICipher(settings.Network) == nil {
+			fatal(fmt.Sprintf("network %s has no PII_KEY or PII_KEY_COMMAND to encrypt with", settings.Network))
+		}
+
+		bwupCollection, err := getBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+		db := bwupCollection.Database()
+		mutations := db.Collection(settings.MongoMutationsCollection)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		for _, field := range encryptedFields(settings) {
+			result, err := encryptStoredNames(ctx, db.Collection(field.collection), mutations, settings.Network, field.field)
+			if err != nil {
+				fatal(fmt.Errorf("encrypting the %s in %s, %d documents in: %v", field.field, field.collection, result.Documents, err))
+			}
+			report.Write(result)
+		}
+		if settings.IngestWatermarksCollection != "" {
+			result, err := encryptWatermarks(ctx, db.Collection(settings.IngestWatermarksCollection), mutations, settings.Network)
+			if err != nil {
+				fatal(fmt.Errorf("encrypting the keys in %s, %d documents in: %v", settings.IngestWatermarksCollection, result.Documents, err))
+			}
+			report.Write(result)
+		}
+		cancel()
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
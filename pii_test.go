@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// withPIIKey encrypts the names of a network with a key for the test
+func withPIIKey(t *testing.T, network string, key string) func() {
+	if err := usePIIKey(Settings{Network: network, PIIKey: base64.StdEncoding.EncodeToString([]byte(key))}); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		piiCiphersMu.Lock()
+		delete(piiCiphers, network)
+		piiCiphersMu.Unlock()
+	}
+}
+
+func TestStoredNamesEncrypted(t *testing.T) {
+	defer withPIIKey(t, "casa", strings.Repeat("k", 32))()
+
+	period := spilledPeriod("casa", "Alice")
+	document, err := bson.Marshal(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored bson.M
+	if err := bson.Unmarshal(document, &stored); err != nil {
+		t.Fatal(err)
+	}
+	name, _ := stored["name"].(string)
+	if !strings.HasPrefix(name, piiPrefix) || strings.Contains(string(document), "Alice") {
+		t.Fatalf("the name is stored as %q", name)
+	}
+	// The same name encrypts the same, so usage can be looked up by it
+	if usageKey(period)["name"] != name || encryptName("casa", "Alice") != name || encryptName("casa", "Bob") == name {
+		t.Errorf("got key %v for %s", usageKey(period), name)
+	}
+
+	var read BandwidthUsagePeriod
+	if err := bson.Unmarshal(document, &read); err != nil {
+		t.Fatal(err)
+	}
+	if read.Name != "Alice" {
+		t.Errorf("read back name %q", read.Name)
+	}
+
+	// Networks without a key store names in the clear
+	if name := encryptName("other", "Alice"); name != "Alice" {
+		t.Errorf("got %q for a network without a key", name)
+	}
+}
+
+func TestMemberDocumentsEncrypted(t *testing.T) {
+	defer withPIIKey(t, "casa", strings.Repeat("k", 32))()
+
+	for _, document := range []interface{}{
+		CachedMember{ID: "rec1", Network: "casa", Name: "Alice", WGKey: "wgkey-alice"},
+		MemberChange{Network: "casa", Kind: "modified", MemberID: "rec1", Name: "Alice", WGKey: "wgkey-alice", PreviousName: "Al", PreviousWGKey: "wgkey-al"},
+		bson.M{"$set": MemberAlias{Network: "casa", Name: "Alice", MemberID: "rec1"}},
+		UsageCorrection{ID: "c1", Network: "casa", Name: "Alice", Original: spilledPeriod("casa", "Alice")},
+		MemberMetricSample{Network: "casa", MemberID: "rec1", Name: "Alice", Metric: "latency"},
+	} {
+		contents, err := bson.Marshal(document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(contents), "Al") || strings.Contains(string(contents), "wgkey-") {
+			t.Errorf("%T is stored with a name or key in the clear", document)
+		}
+	}
+
+	contents, _ := bson.Marshal(MemberChange{Network: "casa", Kind: "added", MemberID: "rec1", Name: "Alice", WGKey: "wgkey-alice"})
+	var change MemberChange
+	if err := bson.Unmarshal(contents, &change); err != nil || change.Name != "Alice" || change.WGKey != "wgkey-alice" || change.PreviousName != "" {
+		t.Errorf("read back %+v, %v", change, err)
+	}
+	var stored bson.M
+	bson.Unmarshal(contents, &stored)
+	if _, ok := stored["previousname"]; ok {
+		t.Error("an empty previous name should be left out")
+	}
+
+	contents, _ = bson.Marshal(CachedMember{ID: "rec1", Network: "casa", Name: "Alice", WGKey: "wgkey-alice"})
+	var member CachedMember
+	if err := bson.Unmarshal(contents, &member); err != nil || member.Name != "Alice" || member.WGKey != "wgkey-alice" {
+		t.Errorf("read back %+v, %v", member, err)
+	}
+
+	// Watermarks are looked up by the key as stored
+	if id := watermarkID(UsageSample{Network: "casa", Agent: "gw", Interface: "wg0", WGKey: "wgkey-alice"}); id != "casa|gw|wg0|"+encryptName("casa", "wgkey-alice") {
+		t.Errorf("got watermark ID %s", id)
+	}
+}
+
+func TestEncryptedFields(t *testing.T) {
+	settings, _ := readSettings("casa", settingsEnv{})
+	collections := map[string]bool{}
+	for _, field := range encryptedFields(settings) {
+		collections[field.collection] = true
+	}
+	for _, name := range []string{settings.MongoMembersCollection, settings.MongoMemberChangesCollection, settings.MongoAliasCollection, settings.MongoCorrectionsCollection, settings.MongoMemberMetricsCollection, settings.NetflowCollection, settings.NetflowHistogramCollection} {
+		if !collections[name] {
+			t.Errorf("encrypt-names leaves %s in the clear", name)
+		}
+	}
+}
+
+func TestDecryptNameWithoutKey(t *testing.T) {
+	restore := withPIIKey(t, "casa", strings.Repeat("k", 32))
+	encrypted := encryptName("casa", "Alice")
+	restore()
+
+	// Runs without the key read the name as stored
+	if name, err := decryptName("casa", encrypted); name != encrypted || err != nil {
+		t.Errorf("got %q, %v without a key", name, err)
+	}
+
+	defer withPIIKey(t, "casa", strings.Repeat("x", 32))()
+	if _, err := decryptName("casa", encrypted); err == nil {
+		t.Error("decrypting with another key should fail")
+	}
+}
+
+func TestPIIKeySettings(t *testing.T) {
+	settings, _ := readSettings("casa", settingsEnv{"PII_KEY": base64.StdEncoding.EncodeToString([]byte("short")), "PII_KEY_COMMAND": "vault read pii"})
+	problems := strings.Join(validateSettings(settings), "\n")
+	for _, want := range []string{"invalid PII_KEY, expected 32 bytes, got 5", "PII_KEY and PII_KEY_COMMAND can't both be set"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("expected %q in the problems:\n%s", want, problems)
+		}
+	}
+	if settings.Redacted().PIIKey != redacted {
+		t.Error("PII_KEY should be redacted")
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	if _, err := fetchPIIKey("echo " + key); err != nil {
+		t.Errorf("reading the key from a command: %v", err)
+	}
+	if _, err := fetchPIIKey("true"); err == nil || !strings.Contains(err.Error(), "printed no key") {
+		t.Errorf("got %v for a command printing nothing", err)
+	}
+}
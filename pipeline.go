@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Transform changes a collected usage period before it is stored, like
+// converting its units or labelling it with the member's metadata
+type Transform interface {
+	Apply(bwup BandwidthUsagePeriod, member MeshMember) (BandwidthUsagePeriod, error)
+}
+
+// transformFactory builds a transform from the options of its entry in
+// PIPELINE_FILE
+type transformFactory func(settings Settings, options map[string]string) (Transform, error)
+
+// sinkFactory builds a usage store from the options of its entry in
+// PIPELINE_FILE, or from no options when named in USAGE_STORES
+type sinkFactory func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error)
+
+// The components pipelines are made of, by the type naming them. Site
+// specific processing is added by registering a component in a file of its
+// own, rather than by changing the collection loop
+var (
+	transformFactories = map[string]transformFactory{}
+	sinkFactories      = map[string]sinkFactory{}
+)
+
+func registerTransform(name string, factory transformFactory) {
+	if _, ok := transformFactories[name]; ok {
+		panic("transform " + name + " is registered twice")
+	}
+	transformFactories[name] = factory
+}
+
+func registerSink(name string, factory sinkFactory) {
+	if _, ok := sinkFactories[name]; ok {
+		panic("sink " + name + " is registered twice")
+	}
+	sinkFactories[name] = factory
+}
+
+func init() {
+	registerSink(usageStoreMongo, newMongoSink)
+	registerSink(usageStoreClickHouse, func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+		return newClickHouseStore(settings)
+	})
+	registerSink(usageStoreEvents, func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+		return newEventStore(settings)
+	})
+	registerSink(usageStoreSQLite, func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+		return newSQLiteStore(settings)
+	})
+	registerSink(usageStorePostgres, func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+		return newPostgresStore(settings)
+	})
+	registerSink(usageStoreBigQuery, func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+		return newBigQueryStore(settings)
+	})
+	registerSink(usageStoreWebhook, func(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+		return newWebhookStore(settings, options)
+	})
+
+	registerTransform("scale", newScaleTransform)
+	registerTransform("threshold", newThresholdTransform)
+	registerTransform("enrich", newEnrichTransform)
+}
+
+// PipelineComponent is an entry of PIPELINE_FILE, a registered component
+// and its options
+type PipelineComponent struct {
+	Type    string            `yaml:"type"`
+	Options map[string]string `yaml:"options"`
+}
+
+// PipelineConfig is the processing PIPELINE_FILE sets up for a network:
+// the metrics collected for each member besides their usage, the
+// transforms collected usage goes through, in order, and the sinks it is
+// stored in, which take the place of USAGE_STORES if any are listed
+type PipelineConfig struct {
+	Metrics    []MetricDefinition  `yaml:"metrics"`
+	Transforms []PipelineComponent `yaml:"transforms"`
+	Sinks      []PipelineComponent `yaml:"sinks"`
+}
+
+// parsePipelineConfig reads a pipeline, refusing unknown keys and
+// components so that typos don't silently skip a step
+func parsePipelineConfig(contents []byte) (PipelineConfig, error) {
+	config := PipelineConfig{}
+	if err := yaml.UnmarshalStrict(contents, &config); err != nil {
+		return config, err
+	}
+
+	for _, transform := range config.Transforms {
+		if _, ok := transformFactories[transform.Type]; !ok {
+			return config, fmt.Errorf("unknown transform %q, expected %s", transform.Type, transformNames())
+		}
+	}
+	for _, sink := range config.Sinks {
+		if _, ok := sinkFactories[sink.Type]; !ok {
+			return config, fmt.Errorf("unknown sink %q, expected %s", sink.Type, sinkNames())
+		}
+	}
+	if err := checkMetricDefinitions(config.Metrics); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func transformNames() string {
+	names := []string{}
+	for name := range transformFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func sinkNames() string {
+	names := []string{}
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// readPipelineConfig reads the network's PIPELINE_FILE, an empty pipeline
+// if it isn't set
+func readPipelineConfig(settings Settings) (PipelineConfig, error) {
+	if settings.PipelineFile == "" {
+		return PipelineConfig{}, nil
+	}
+
+	contents, err := ioutil.ReadFile(settings.PipelineFile)
+	if err != nil {
+		return PipelineConfig{}, err
+	}
+	config, err := parsePipelineConfig(contents)
+	if err != nil {
+		return config, fmt.Errorf("PIPELINE_FILE is not valid: %v", err)
+	}
+	return config, nil
+}
+
+// newTransforms builds the transforms of the network's pipeline
+func newTransforms(settings Settings) ([]Transform, error) {
+	config, err := readPipelineConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	transforms := []Transform{}
+	for _, component := range config.Transforms {
+		transform, err := transformFactories[component.Type](settings, component.Options)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s: %v", component.Type, err)
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms, nil
+}
+
+// applyTransforms runs a period through the transforms in order
+func applyTransforms(transforms []Transform, bwup BandwidthUsagePeriod, member MeshMember) (BandwidthUsagePeriod, error) {
+	for _, transform := range transforms {
+		var err error
+		if bwup, err = transform.Apply(bwup, member); err != nil {
+			return bwup, err
+		}
+	}
+	return bwup, nil
+}
+
+// floatOption reads a number option, fallback if it isn't set
+func floatOption(options map[string]string, name string, fallback float64) (float64, error) {
+	value, ok := options[name]
+	if !ok {
+		return fallback, nil
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got %q", name, value)
+	}
+	return n, nil
+}
+
+// checkOptions refuses options a component doesn't know
+func checkOptions(options map[string]string, known ...string) error {
+	for name := range options {
+		found := false
+		for _, option := range known {
+			found = found || name == option
+		}
+		if !found {
+			return fmt.Errorf("unknown option %q, expected %s", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// ScaleTransform multiplies usage by Factor, for converting units, like GB
+// to GiB with 0.931323, or making up for sampled logs
+type ScaleTransform struct {
+	Factor float64
+}
+
+func newScaleTransform(settings Settings, options map[string]string) (Transform, error) {
+	if err := checkOptions(options, "factor"); err != nil {
+		return nil, err
+	}
+	factor, err := floatOption(options, "factor", 0)
+	if err != nil {
+		return nil, err
+	}
+	if factor <= 0 {
+		return nil, fmt.Errorf("factor must be a positive number")
+	}
+	return ScaleTransform{Factor: factor}, nil
+}
+
+func (t ScaleTransform) Apply(bwup BandwidthUsagePeriod, member MeshMember) (BandwidthUsagePeriod, error) {
+	scale := func(value *float64) *float64 {
+		if value == nil {
+			return nil
+		}
+		scaled := *value * t.Factor
+		return &scaled
+	}
+	bwup.Up = scale(bwup.Up)
+	bwup.Down = scale(bwup.Down)
+	bwup.Total = scale(bwup.Total)
+	return bwup, nil
+}
+
+// ThresholdTransform counts usage below BelowGb as no data, for
+// keepalives and other noise, and warns about usage above AboveGb. Either
+// is off at 0
+type ThresholdTransform struct {
+	BelowGb float64
+	AboveGb float64
+}
+
+func newThresholdTransform(settings Settings, options map[string]string) (Transform, error) {
+	if err := checkOptions(options, "below_gb", "above_gb"); err != nil {
+		return nil, err
+	}
+	below, err := floatOption(options, "below_gb", 0)
+	if err != nil {
+		return nil, err
+	}
+	above, err := floatOption(options, "above_gb", 0)
+	if err != nil {
+		return nil, err
+	}
+	if below < 0 || above < 0 || (above > 0 && above <= below) {
+		return nil, fmt.Errorf("below_gb and above_gb must not be negative, and above_gb must be above below_gb")
+	}
+	return ThresholdTransform{BelowGb: below, AboveGb: above}, nil
+}
+
+func (t ThresholdTransform) Apply(bwup BandwidthUsagePeriod, member MeshMember) (BandwidthUsagePeriod, error) {
+	if bwup.Status != usageStatusOK || bwup.Total == nil {
+		return bwup, nil
+	}
+
+	if *bwup.Total < t.BelowGb {
+		bwup.Up, bwup.Down, bwup.Total = nil, nil, nil
+		bwup.Status = usageStatusNoData
+		return bwup, nil
+	}
+	if t.AboveGb > 0 && *bwup.Total > t.AboveGb {
+		bwup.Warnings = append(bwup.Warnings, fmt.Sprintf("used %.3f GB, above the %.3f GB threshold", *bwup.Total, t.AboveGb))
+	}
+	return bwup, nil
+}
+
+// memberLabels are the member fields the enrich transform can label usage
+// with
+var memberLabels = map[string]func(member MeshMember) string{
+	"site":     func(member MeshMember) string { return memberSite(member) },
+	"tags":     func(member MeshMember) string { return strings.Join(member.Fields.Tags, ",") },
+	"plan":     func(member MeshMember) string { return strconv.FormatFloat(member.Fields.PlanMbps, 'f', -1, 64) },
+	"language": func(member MeshMember) string { return member.Fields.Language },
+	"crm":      func(member MeshMember) string { return member.Fields.CRMID },
+}
+
+// EnrichTransform labels usage with the member's metadata, so stores and
+// event consumers have it without looking the member up
+type EnrichTransform struct {
+	Labels []string
+}
+
+func newEnrichTransform(settings Settings, options map[string]string) (Transform, error) {
+	if err := checkOptions(options, "labels"); err != nil {
+		return nil, err
+	}
+
+	labels := splitList(options["labels"])
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("labels must list the member fields to label usage with")
+	}
+	known := []string{}
+	for label := range memberLabels {
+		known = append(known, label)
+	}
+	sort.Strings(known)
+	for _, label := range labels {
+		if _, ok := memberLabels[label]; !ok {
+			return nil, fmt.Errorf("unknown label %q, expected %s", label, strings.Join(known, ", "))
+		}
+	}
+	return EnrichTransform{Labels: labels}, nil
+}
+
+func (t EnrichTransform) Apply(bwup BandwidthUsagePeriod, member MeshMember) (BandwidthUsagePeriod, error) {
+	labels := map[string]string{}
+	for label, value := range bwup.Labels {
+		labels[label] = value
+	}
+	for _, label := range t.Labels {
+		if value := memberLabels[label](member); value != "" {
+			labels[label] = value
+		}
+	}
+	if len(labels) > 0 {
+		bwup.Labels = labels
+	}
+	return bwup, nil
+}
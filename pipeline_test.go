@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePipelineConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"transforms and sinks", `
+transforms:
+  - type: scale
+    options:
+      factor: 0.931323
+  - type: enrich
+    options:
+      labels: site, plan
+sinks:
+  - type: mongo
+  - type: events
+`, true},
+		{"empty", ``, true},
+		{"unknown transform", "transforms:\n  - type: rename\n", false},
+		{"unknown sink", "sinks:\n  - type: kafka\n", false},
+		{"unknown key", "transform:\n  - type: scale\n", false},
+		{"not YAML", "transforms: [", false},
+	}
+
+	for _, test := range tests {
+		_, err := parsePipelineConfig([]byte(test.config))
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+
+	config, err := parsePipelineConfig([]byte("transforms:\n  - type: scale\n    options:\n      factor: 8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PipelineConfig{Transforms: []PipelineComponent{{Type: "scale", Options: map[string]string{"factor": "8"}}}}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("got %+v, want %+v", config, want)
+	}
+}
+
+func TestTransformOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform string
+		options   map[string]string
+		valid     bool
+	}{
+		{"scale", "scale", map[string]string{"factor": "0.5"}, true},
+		{"scale without factor", "scale", nil, false},
+		{"negative scale", "scale", map[string]string{"factor": "-1"}, false},
+		{"scale by words", "scale", map[string]string{"factor": "half"}, false},
+		{"threshold", "threshold", map[string]string{"below_gb": "0.001", "above_gb": "500"}, true},
+		{"inverted threshold", "threshold", map[string]string{"below_gb": "10", "above_gb": "5"}, false},
+		{"threshold typo", "threshold", map[string]string{"below": "1"}, false},
+		{"enrich", "enrich", map[string]string{"labels": "site,tags"}, true},
+		{"enrich nothing", "enrich", nil, false},
+		{"enrich unknown", "enrich", map[string]string{"labels": "phone"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := transformFactories[test.transform](Settings{}, test.options)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
+
+func TestApplyTransforms(t *testing.T) {
+	member := MeshMember{ID: "rec1"}
+	member.Fields.Name = "Alice"
+	member.Fields.Site = "Tower"
+	member.Fields.PlanMbps = 50
+
+	transforms := []Transform{
+		ScaleTransform{Factor: 2},
+		ThresholdTransform{BelowGb: 1, AboveGb: 100},
+		EnrichTransform{Labels: []string{"site", "plan", "tags"}},
+	}
+
+	tests := []struct {
+		name     string
+		usage    BandwidthUsagePeriod
+		total    *float64
+		status   string
+		warnings int
+	}{
+		{"scaled", usage(10, 20), floatPointer(60), usageStatusOK, 0},
+		{"noise", usage(0.1, 0.2), nil, usageStatusNoData, 0},
+		{"above threshold", usage(40, 20), floatPointer(120), usageStatusOK, 1},
+		{"no data", noUsage(), nil, usageStatusNoData, 0},
+		{"failed", failedUsage(), nil, usageStatusFailed, 0},
+	}
+
+	for _, test := range tests {
+		bwup, err := applyTransforms(transforms, test.usage, member)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(bwup.Total, test.total) || bwup.Status != test.status || len(bwup.Warnings) != test.warnings {
+			t.Errorf("%s: got total %v, status %s and warnings %v", test.name, bwup.Total, bwup.Status, bwup.Warnings)
+		}
+		if want := map[string]string{"site": "Tower", "plan": "50"}; !reflect.DeepEqual(bwup.Labels, want) {
+			t.Errorf("%s: got labels %v, want %v", test.name, bwup.Labels, want)
+		}
+	}
+}
+
+func TestUsageStoreSinks(t *testing.T) {
+	if _, err := newUsageStore(Settings{DuplicatePolicy: duplicatePolicySkip, UsageStores: []string{"kafka"}}, nil); err == nil {
+		t.Error("unknown store: should have failed")
+	}
+	if _, err := newUsageStore(Settings{DuplicatePolicy: duplicatePolicySkip}, nil); err == nil {
+		t.Error("no stores: should have failed")
+	}
+	if _, err := newUsageStore(Settings{DuplicatePolicy: duplicatePolicySkip, PipelineFile: "testdata/missing.yaml"}, nil); err == nil {
+		t.Error("missing pipeline: should have failed")
+	}
+}
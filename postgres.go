@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	// Registers the postgres database/sql driver
+	_ "github.com/lib/pq"
+)
+
+// postgresMigration is a numbered change to the Postgres schema. Migrations
+// are applied in order, each once, and recorded in schema_migrations.
+// Applied migrations must never be edited, changes go in a new one
+type postgresMigration struct {
+	Version int
+	Name    string
+	Up      string
+}
+
+var postgresMigrations = []postgresMigration{
+	{1, "create usage_periods", `
+CREATE TABLE usage_periods (
+	id BIGSERIAL PRIMARY KEY,
+	network TEXT NOT NULL,
+	member_id TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	interface TEXT NOT NULL DEFAULT '',
+	from_time TIMESTAMPTZ NOT NULL,
+	to_time TIMESTAMPTZ NOT NULL,
+	duration_seconds BIGINT NOT NULL,
+	up DOUBLE PRECISION,
+	down DOUBLE PRECISION,
+	total DOUBLE PRECISION,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT ''
+)`},
+	{2, "index usage_periods", `
+CREATE UNIQUE INDEX usage_periods_window ON usage_periods
+	(network, (CASE WHEN member_id <> '' THEN member_id ELSE 'name:' || name END), interface, from_time, to_time);
+CREATE INDEX usage_periods_network_from ON usage_periods (network, from_time)`},
+	{3, "create monthly_usage", `
+CREATE VIEW monthly_usage AS
+	SELECT network, member_id, max(name) AS name, date_trunc('month', from_time AT TIME ZONE 'UTC') AS month,
+		count(*) AS periods, sum(up) AS up, sum(down) AS down, sum(total) AS total
+	FROM usage_periods WHERE status <> 'failed'
+	GROUP BY network, member_id, CASE WHEN member_id <> '' THEN '' ELSE name END, month`},
+}
+
+// postgresMigrationLock is the advisory lock held while migrating, so
+// collectors starting together don't apply a migration twice
+const postgresMigrationLock = 7412903
+
+// pendingMigrations returns the migrations not applied yet, in order
+func pendingMigrations(migrations []postgresMigration, applied map[int]bool) []postgresMigration {
+	pending := []postgresMigration{}
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// checkMigrations checks migrations are numbered 1, 2, 3 and so on
+func checkMigrations(migrations []postgresMigration) error {
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return fmt.Errorf("migration %q is numbered %d, expected %d", migration.Name, migration.Version, i+1)
+		}
+	}
+	return nil
+}
+
+// appliedMigrations reads the versions recorded in schema_migrations
+func appliedMigrations(db *sql.DB) (map[int]bool, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// migratePostgres applies the pending migrations, each in its own
+// transaction, returning those applied
+func migratePostgres(db *sql.DB) ([]postgresMigration, error) {
+	if err := checkMigrations(postgresMigrations); err != nil {
+		return nil, err
+	}
+
+	done, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []postgresMigration{}
+	for _, migration := range pendingMigrations(postgresMigrations, done) {
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+
+		// Checked under the lock, in case another collector got there first
+		var done bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, migration.Version).Scan(&done); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if done {
+			tx.Rollback()
+			continue
+		}
+
+		if _, err := tx.Exec(migration.Up); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d %s: %v", migration.Version, migration.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// openPostgres connects to POSTGRES_URL. The schema is left alone, see
+// migratePostgres
+func openPostgres(settings Settings) (*sql.DB, error) {
+	if settings.PostgresURL == "" {
+		return nil, fmt.Errorf("the postgres store needs POSTGRES_URL")
+	}
+
+	db, err := sql.Open("postgres", settings.PostgresURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// PostgresStore saves usage periods into the usage_periods table, which
+// POSTGRES_AUTO_MIGRATE creates and keeps up to date when the store starts
+type PostgresStore struct {
+	db     *sql.DB
+	policy string
+}
+
+func newPostgresStore(settings Settings) (PostgresStore, error) {
+	db, err := openPostgres(settings)
+	if err != nil {
+		return PostgresStore{}, err
+	}
+
+	if settings.PostgresAutoMigrate {
+		applied, err := migratePostgres(db)
+		if err != nil {
+			db.Close()
+			return PostgresStore{}, err
+		}
+		for _, migration := range applied {
+			log.Printf("Applied Postgres migration %d %s", migration.Version, migration.Name)
+		}
+	}
+
+	return PostgresStore{db: db, policy: settings.DuplicatePolicy}, nil
+}
+
+// windowCondition matches the stored rows of the usage period's member and
+// window, with the arguments to bind
+func (s PostgresStore) windowCondition(bwup BandwidthUsagePeriod) (string, []interface{}) {
+	member, key := "member_id = '' AND name = $2", bwup.Name
+	if bwup.MemberID != "" {
+		member, key = "member_id = $2", bwup.MemberID
+	}
+	return "network = $1 AND " + member + " AND interface = $3 AND from_time = $4 AND to_time = $5",
+		[]interface{}{bwup.Network, key, bwup.Interface, bwup.From.UTC(), bwup.To.UTC()}
+}
+
+// Insert applies the duplicate policy before inserting, replacing a stored
+// period in the same transaction
+func (s PostgresStore) Insert(bwup BandwidthUsagePeriod) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	condition, args := s.windowCondition(bwup)
+
+	existing := bwup
+	var up, down, total sql.NullFloat64
+	err = tx.QueryRow("SELECT up, down, total, status FROM usage_periods WHERE "+condition+" FOR UPDATE", args...).Scan(&up, &down, &total, &existing.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil {
+		existing.Up, existing.Down, existing.Total = nullableFloat(up), nullableFloat(down), nullableFloat(total)
+		replacement, err := resolveDuplicate(s.policy, existing, bwup)
+		if err != nil || replacement == nil {
+			return err
+		}
+		bwup = *replacement
+		if _, err := tx.Exec("DELETE FROM usage_periods WHERE "+condition, args...); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO usage_periods (network, member_id, name, interface, from_time, to_time, duration_seconds, up, down, total, status, error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		bwup.Network, bwup.MemberID, bwup.Name, bwup.Interface, bwup.From.UTC(), bwup.To.UTC(), int64(bwup.Duration/time.Second),
+		bwup.Up, bwup.Down, bwup.Total, bwup.Status, bwup.Error)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDBCommand applies the pending Postgres migrations of every network
+// with a POSTGRES_URL, or with -status lists which are applied
+func migrateDBCommand(args []string) {
+	flags := flag.NewFlagSet("migrate-db", flag.ExitOnError)
+	status := flags.Bool("status", false, "list the migrations and whether they are applied, without applying any")
+	flags.Parse(args)
+
+	// Networks sharing a database are migrated once
+	migrated := map[string]bool{}
+	for _, settings := range loadAllNetworkSettings() {
+		if settings.PostgresURL == "" || migrated[settings.PostgresURL] {
+			continue
+		}
+		migrated[settings.PostgresURL] = true
+
+		db, err := openPostgres(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		if *status {
+			applied, err := appliedMigrations(db)
+			if err != nil {
+				fatal(err)
+			}
+			for _, migration := range postgresMigrations {
+				state := "pending"
+				if applied[migration.Version] {
+					state = "applied"
+				}
+				fmt.Printf("%d\t%s\t%s\n", migration.Version, migration.Name, state)
+			}
+		} else {
+			applied, err := migratePostgres(db)
+			if err != nil {
+				fatal(err)
+			}
+			log.Printf("Applied %d Postgres migrations for network %s", len(applied), settings.Network)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPostgresMigrations(t *testing.T) {
+	if err := checkMigrations(postgresMigrations); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, migration := range postgresMigrations {
+		if names[migration.Name] {
+			t.Errorf("migration name %q is used twice", migration.Name)
+		}
+		names[migration.Name] = true
+		if strings.TrimSpace(migration.Up) == "" {
+			t.Errorf("migration %d does nothing", migration.Version)
+		}
+	}
+}
+
+func TestCheckMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []int
+		valid    bool
+	}{
+		{"in order", []int{1, 2, 3}, true},
+		{"none", nil, true},
+		{"gap", []int{1, 3}, false},
+		{"out of order", []int{2, 1}, false},
+		{"repeated", []int{1, 1}, false},
+	}
+
+	for _, test := range tests {
+		migrations := []postgresMigration{}
+		for _, version := range test.versions {
+			migrations = append(migrations, postgresMigration{Version: version, Name: "m", Up: "SELECT 1"})
+		}
+		err := checkMigrations(migrations)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []postgresMigration{{Version: 1, Name: "a"}, {Version: 2, Name: "b"}, {Version: 3, Name: "c"}}
+
+	tests := []struct {
+		name    string
+		applied map[int]bool
+		pending []int
+	}{
+		{"new database", map[int]bool{}, []int{1, 2, 3}},
+		{"partly migrated", map[int]bool{1: true}, []int{2, 3}},
+		{"up to date", map[int]bool{1: true, 2: true, 3: true}, []int{}},
+		// A migration from a newer collector is left alone
+		{"ahead", map[int]bool{1: true, 2: true, 3: true, 4: true}, []int{}},
+	}
+
+	for _, test := range tests {
+		pending := []int{}
+		for _, migration := range pendingMigrations(migrations, test.applied) {
+			pending = append(pending, migration.Version)
+		}
+		if !reflect.DeepEqual(pending, test.pending) {
+			t.Errorf("%s: got %v, want %v", test.name, pending, test.pending)
+		}
+	}
+}
+
+func TestPostgresWindowCondition(t *testing.T) {
+	bwup := usage(1, 2)
+	bwup.Network = "casa"
+
+	condition, args := PostgresStore{}.windowCondition(bwup)
+	if !strings.Contains(condition, "member_id = '' AND name = $2") || args[1] != "Alice" {
+		t.Errorf("without an ID: got %s with %v", condition, args)
+	}
+
+	bwup.MemberID = "rec1"
+	condition, args = PostgresStore{}.windowCondition(bwup)
+	if !strings.Contains(condition, "member_id = $2") || strings.Contains(condition, "name") || args[1] != "rec1" {
+		t.Errorf("with an ID: got %s with %v", condition, args)
+	}
+
+	if _, err := newPostgresStore(Settings{}); err == nil {
+		t.Error("no POSTGRES_URL: should have failed")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// What to do when the preflight check fails, selected with PREFLIGHT_ACTION
+const (
+	preflightAbort = "abort"
+	preflightWarn  = "warn"
+)
+
+// preflight checks the stat source saw at least PREFLIGHT_MIN_MESSAGES
+// messages during the window before any usage is queried. Sources without a
+// canary query, or a floor of 0, skip the check
+func preflight(settings Settings, source StatSource) error {
+	if settings.PreflightMinMessages <= 0 {
+		return nil
+	}
+
+	canary, ok := source.(CanarySource)
+	if !ok {
+		log.Printf("Stat source %s has no canary query, skipping the preflight check", settings.StatSource)
+		return nil
+	}
+
+	var count int64
+	for _, window := range queryChunks(settings.From, settings.To, settings.QueryChunk) {
+		chunkCount, err := canary.CountMessages(window.From, window.To)
+		if err != nil {
+			return fmt.Errorf("preflight query failed: %v", err)
+		}
+		count += chunkCount
+	}
+
+	if count < int64(settings.PreflightMinMessages) {
+		return fmt.Errorf("only %d messages logged between %s and %s, below the floor of %d, the log pipeline may have been down",
+			count, settings.From, settings.To, settings.PreflightMinMessages)
+	}
+
+	log.Printf("Preflight: %d messages logged during the window", count)
+	return nil
+}
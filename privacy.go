@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// publicNoise makes aggregates safe to publish, so the usage of a member
+// can't be told from them: groups of fewer than PUBLIC_MIN_MEMBERS are left
+// out, and the rest get Laplace noise of PUBLIC_NOISE_EPSILON and are
+// rounded to PUBLIC_ROUND_GB. Each number published spends epsilon, so
+// publishing the same window again or more numbers of it gives away more
+type publicNoise struct {
+	epsilon       float64
+	sensitivityGB float64
+	roundGB       float64
+	minMembers    int
+	// uniform returns a random number in [0, 1)
+	uniform func() float64
+}
+
+func newPublicNoise(settings Settings) publicNoise {
+	return publicNoise{
+		epsilon:       settings.PublicNoiseEpsilon,
+		sensitivityGB: settings.PublicNoiseSensitivityGB,
+		roundGB:       settings.PublicRoundGB,
+		minMembers:    settings.PublicMinMembers,
+		uniform:       secureUniform,
+	}
+}
+
+// secureUniform is a random number in [0, 1) from crypto/rand, as noise
+// which could be predicted could be taken off again
+func secureUniform() float64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// laplace draws noise from the Laplace distribution of a scale
+func (n publicNoise) laplace(scale float64) float64 {
+	u := n.uniform() - 0.5
+	sign := 1.0
+	if u < 0 {
+		sign = -1
+	}
+	return -scale * sign * math.Log(1-2*math.Abs(u))
+}
+
+// keep checks a group has enough members to be published
+func (n publicNoise) keep(members int) bool {
+	return members >= n.minMembers
+}
+
+// gb publishes a sum of usage. A member adds at most PUBLIC_NOISE_SENSITIVITY_GB
+// to it as far as the noise is concerned
+func (n publicNoise) gb(value float64) float64 {
+	if n.epsilon > 0 {
+		value += n.laplace(n.sensitivityGB / n.epsilon)
+	}
+	if n.roundGB > 0 {
+		value = math.Round(value/n.roundGB) * n.roundGB
+	}
+	return math.Max(value, 0)
+}
+
+// count publishes a count of members, which a member changes by one
+func (n publicNoise) count(value int) int {
+	v := float64(value)
+	if n.epsilon > 0 {
+		v += n.laplace(1 / n.epsilon)
+	}
+	return int(math.Max(math.Round(v), 0))
+}
+
+// publicGroups is the usage of the groups safe to publish
+func publicGroups(noise publicNoise, groups []GroupUsage) []GroupUsage {
+	public := []GroupUsage{}
+	for _, group := range groups {
+		if !noise.keep(group.Members) {
+			continue
+		}
+		group.Members = noise.count(group.Members)
+		group.Failed = noise.count(group.Failed)
+		group.Up = noise.gb(group.Up)
+		group.Down = noise.gb(group.Down)
+		// Noised on its own, the total wouldn't add up, and would be another
+		// sample of the same usage
+		group.Total = group.Up + group.Down
+		public = append(public, group)
+	}
+	return public
+}
+
+// publicSites is the usage of the sites safe to publish. Sites named after
+// the location of their members rather than a tower are left out, as are
+// the plans, and locations are blurred to about a kilometer
+func publicSites(noise publicNoise, sites []SiteUsage) []SiteUsage {
+	public := []SiteUsage{}
+	for _, site := range sites {
+		var latitude, longitude float64
+		if n, _ := fmt.Sscanf(site.Site, "%f,%f", &latitude, &longitude); n == 2 || !noise.keep(site.Members) {
+			continue
+		}
+
+		site.Members = noise.count(site.Members)
+		site.Up = noise.gb(site.Up)
+		site.Down = noise.gb(site.Down)
+		site.Total = site.Up + site.Down
+		site.Previous = noise.gb(site.Previous)
+		site.Growth = nil
+		if site.Previous > 0 {
+			growth := (site.Total - site.Previous) / site.Previous * 100
+			site.Growth = &growth
+		}
+		site.PlanMbps = 0
+		if site.Latitude != nil && site.Longitude != nil {
+			latitude, longitude := math.Round(*site.Latitude*100)/100, math.Round(*site.Longitude*100)/100
+			site.Latitude, site.Longitude = &latitude, &longitude
+		}
+		public = append(public, site)
+	}
+	return public
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPublicGroups(t *testing.T) {
+	noise := publicNoise{roundGB: 5, minMembers: 3}
+	groups := publicGroups(noise, []GroupUsage{
+		{Group: "Centro", Members: 12, Up: 41.2, Down: 130.9, Total: 172.1, Failed: 1},
+		{Group: "Cerro", Members: 2, Up: 3, Down: 9, Total: 12},
+	})
+
+	// Without noise the groups are only rounded, and the small one left out
+	if len(groups) != 1 || groups[0].Members != 12 || groups[0].Up != 40 || groups[0].Down != 130 || groups[0].Total != 170 {
+		t.Errorf("got %+v", groups)
+	}
+
+	// With noise the total still adds up
+	noise = publicNoise{epsilon: 1, sensitivityGB: 10, roundGB: 1, minMembers: 3, uniform: secureUniform}
+	group := publicGroups(noise, []GroupUsage{{Group: "Centro", Members: 12, Up: 41.2, Down: 130.9, Total: 172.1}})[0]
+	if group.Total != group.Up+group.Down {
+		t.Errorf("got %+v", group)
+	}
+}
+
+func TestPublicNoise(t *testing.T) {
+	draws := []float64{0.25, 0.75, 0.5}
+	noise := publicNoise{epsilon: 1, sensitivityGB: 10, uniform: func() float64 {
+		u := draws[0]
+		draws = draws[1:]
+		return u
+	}}
+
+	// Laplace noise of scale 10 at the quartiles is -10 ln 2 and 10 ln 2
+	if got, want := noise.gb(100), 100-10*math.Ln2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %g, want %g", got, want)
+	}
+	if got, want := noise.gb(100), 100+10*math.Ln2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %g, want %g", got, want)
+	}
+	if got := noise.count(7); got != 7 {
+		t.Errorf("got %d at the median", got)
+	}
+
+	// Noise never makes usage negative
+	noise.uniform = func() float64 { return 0.01 }
+	if got := noise.gb(1); got != 0 {
+		t.Errorf("got %g", got)
+	}
+
+	if u := secureUniform(); u < 0 || u >= 1 {
+		t.Errorf("got %g", u)
+	}
+}
+
+func TestPublicSites(t *testing.T) {
+	latitude, longitude := 4.71234, -74.07219
+	sites := publicSites(publicNoise{minMembers: 2}, []SiteUsage{
+		{Site: "Water Tower", Members: 8, Up: 30, Down: 60, Total: 90, Previous: 60, PlanMbps: 400, Latitude: &latitude, Longitude: &longitude},
+		{Site: "4.712,-74.072", Members: 9, Total: 10},
+		{Site: "Ridge", Members: 1, Total: 10},
+	})
+
+	if len(sites) != 1 || sites[0].Site != "Water Tower" || sites[0].PlanMbps != 0 || *sites[0].Latitude != 4.71 || *sites[0].Longitude != -74.07 || *sites[0].Growth != 50 {
+		t.Errorf("got %+v", sites)
+	}
+}
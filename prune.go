@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UsageRollup is the usage of a member over a calendar month, kept once the
+// month's usage periods are pruned. PruneBatches lists the batches of
+// periods already added, so none is ever added twice
+type UsageRollup struct {
+	Network      string
+	MemberID     string `json:",omitempty" bson:",omitempty"`
+	Name         string
+	Month        time.Time
+	Periods      int
+	Up           float64
+	Down         float64
+	Total        float64
+	PruneBatches []primitive.ObjectID `json:"-" bson:",omitempty"`
+}
+
+// monthlyUsage is a member's usage periods over a month. Batch is set on
+// periods a previous prune marked but didn't get to delete
+type monthlyUsage struct {
+	ID struct {
+		MemberID string
+		Name     string
+		Year     int
+		Month    int
+		Batch    *primitive.ObjectID
+	} `bson:"_id"`
+	Name    string
+	IDs     []primitive.ObjectID
+	Periods int
+	Up      float64
+	Down    float64
+	Total   float64
+}
+
+// pruneCutoff is the start of the month the retention period ends in, so
+// only whole months are ever pruned and rolled up
+func pruneCutoff(now time.Time, retention time.Duration) time.Time {
+	cutoff := now.Add(-retention).UTC()
+	return time.Date(cutoff.Year(), cutoff.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// getMonthlyUsage groups the usage periods of a network which ended before
+// the cutoff by member, month and prune batch. Members are grouped by ID,
+// keeping their latest name, or by name for usage stored without an ID
+func getMonthlyUsage(collection *mongo.Collection, network string, cutoff time.Time) ([]monthlyUsage, error) {
+	months := []monthlyUsage{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"network": networkMatch(network), "to": bson.M{"$lte": cutoff}}},
+		{"$sort": bson.M{"from": 1}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"memberid": "$memberid",
+				"name":     bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{"$memberid", nil}}, "", "$name"}},
+				"year":     bson.M{"$year": "$from"},
+				"month":    bson.M{"$month": "$from"},
+				"batch":    "$prunebatch",
+			},
+			"name":    bson.M{"$last": "$name"},
+			"ids":     bson.M{"$push": "$_id"},
+			"periods": bson.M{"$sum": 1},
+			"up":      bson.M{"$sum": "$up"},
+			"down":    bson.M{"$sum": "$down"},
+			"total":   bson.M{"$sum": "$total"},
+		}},
+		{"$sort": bson.M{"_id.year": 1, "_id.month": 1}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return months, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var month monthlyUsage
+		if err := cursor.Decode(&month); err != nil {
+			return months, err
+		}
+		months = append(months, month)
+	}
+
+	return months, cursor.Err()
+}
+
+// sumPruneBatch adds up the usage periods marked with a prune batch
+func sumPruneBatch(usage *mongo.Collection, batch primitive.ObjectID) (monthlyUsage, error) {
+	var sum monthlyUsage
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := usage.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"prunebatch": batch}},
+		{"$group": bson.M{
+			"_id":     nil,
+			"periods": bson.M{"$sum": 1},
+			"up":      bson.M{"$sum": "$up"},
+			"down":    bson.M{"$sum": "$down"},
+			"total":   bson.M{"$sum": "$total"},
+		}},
+	})
+	if err != nil {
+		return sum, err
+	}
+	defer cursor.Close(ctx)
+
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&sum); err != nil {
+			return sum, err
+		}
+	}
+	return sum, cursor.Err()
+}
+
+// rollUpMonth adds a month of usage to its rollup, then deletes the periods
+// it was made from, recording both in mutations. Periods added to an already
+// pruned month later on are added to the existing rollup.
+//
+// The periods are first marked with a batch, which the rollup records once
+// it is added. A prune interrupted before deleting them finds the batch
+// already in the rollup on the next run, and only deletes them
+func rollUpMonth(usage *mongo.Collection, rollups *mongo.Collection, mutations *mongo.Collection, rollup UsageRollup, month monthlyUsage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	batch := primitive.NewObjectID()
+	if month.ID.Batch != nil {
+		batch = *month.ID.Batch
+	} else {
+		_, err := usage.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$in": month.IDs}, "prunebatch": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"prunebatch": batch}})
+		if err != nil {
+			return err
+		}
+	}
+
+	sum, err := sumPruneBatch(usage, batch)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"network": rollup.Network, "month": rollup.Month}
+	if rollup.MemberID != "" {
+		filter["memberid"] = rollup.MemberID
+	} else {
+		filter["name"] = rollup.Name
+	}
+
+	_, err = rollups.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"name": rollup.Name}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	// Only adds the batch if it isn't in the rollup yet
+	filter["prunebatches"] = bson.M{"$ne": batch}
+	err = mutateDocuments(ctx, mutations, rollups, mutationPrune, rollup.Network, filter, func() error {
+		_, err := rollups.UpdateOne(ctx, filter, bson.M{
+			"$inc":  bson.M{"periods": sum.Periods, "up": sum.Up, "down": sum.Down, "total": sum.Total},
+			"$push": bson.M{"prunebatches": batch},
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	pruned := bson.M{"prunebatch": batch}
+	return mutateDocuments(ctx, mutations, usage, mutationPrune, rollup.Network, pruned, func() error {
+		_, err := usage.DeleteMany(ctx, pruned)
+		return err
+	})
+}
+
+// pruneRawCollection deletes, or with dryRun only counts, the documents of a
+// network whose time field is before the cutoff, recording how many went in
+// mutations
+func pruneRawCollection(collection *mongo.Collection, mutations *mongo.Collection, network string, field string, cutoff time.Time, dryRun bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	filter := bson.M{"network": networkMatch(network), field: bson.M{"$lt": cutoff}}
+	if dryRun {
+		return collection.CountDocuments(ctx, filter)
+	}
+
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if result.DeletedCount == 0 {
+		return 0, nil
+	}
+
+	err = recordMutation(ctx, mutations, Mutation{
+		Kind:       mutationPrune,
+		Collection: collection.Name(),
+		Network:    network,
+		Filter:     filterJSON(filter),
+		Documents:  int(result.DeletedCount),
+	})
+	return result.DeletedCount, err
+}
+
+// pruneCommand deletes usage periods, SNMP samples, NetFlow counters and
+// samples of scheduled metrics older than RETENTION_PERIOD for every
+// network, rolling usage periods up by member and month first. With
+// --dry-run it only lists what would go
+func pruneCommand(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list what would be pruned without deleting anything")
+	flags.Parse(args)
+
+	for _, settings := range loadAllNetworkSettings() {
+		pruneNetwork(settings, *dryRun)
+	}
+}
+
+func pruneNetwork(settings Settings, dryRun bool) {
+	if settings.RetentionPeriod <= 0 {
+		log.Printf("No retention period for network %s, keeping everything", settings.Network)
+		return
+	}
+
+	cutoff := pruneCutoff(time.Now(), settings.RetentionPeriod)
+
+	bwupCollection, err := getBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+	db := bwupCollection.Database()
+	rollupCollection := db.Collection(settings.MongoRollupCollection)
+	mutations := db.Collection(settings.MongoMutationsCollection)
+
+	months, err := getMonthlyUsage(bwupCollection, settings.Network, cutoff)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, month := range months {
+		rollup := UsageRollup{
+			Network:  settings.Network,
+			MemberID: month.ID.MemberID,
+			Name:     month.Name,
+			Month:    time.Date(month.ID.Year, time.Month(month.ID.Month), 1, 0, 0, 0, 0, time.UTC),
+			Periods:  month.Periods,
+			Up:       month.Up,
+			Down:     month.Down,
+			Total:    month.Total,
+		}
+
+		printJSON(os.Stdout, rollup)
+
+		if dryRun {
+			continue
+		}
+		if err := rollUpMonth(bwupCollection, rollupCollection, mutations, rollup, month); err != nil {
+			fatal(err)
+		}
+	}
+
+	verb := "Pruned"
+	if dryRun {
+		verb = "Would prune"
+	}
+
+	raw := []struct {
+		collection string
+		field      string
+	}{
+		{settings.SNMPCollection, "time"},
+		{settings.NetflowCollection, "hour"},
+		{settings.NetflowHistogramCollection, "day"},
+		{settings.MongoMemberMetricsCollection, "from"},
+	}
+	for _, r := range raw {
+		count, err := pruneRawCollection(db.Collection(r.collection), mutations, settings.Network, r.field, cutoff, dryRun)
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("%s %d documents from %s before %s", verb, count, r.collection, cutoff.Format("2006-01-02"))
+	}
+
+	log.Printf("%s %d member months of usage periods before %s", verb, len(months), cutoff.Format("2006-01-02"))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneCutoff(t *testing.T) {
+	tests := []struct {
+		now       time.Time
+		retention time.Duration
+		want      time.Time
+	}{
+		{time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), 365 * 24 * time.Hour, time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 1, 0, 30, 0, 0, time.UTC), time.Hour, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC), time.Hour, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// Months are in UTC whatever the local time zone
+		{time.Date(2026, 3, 31, 22, 0, 0, 0, time.FixedZone("UTC-5", -5*3600)), 0, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if got := pruneCutoff(test.now, test.retention); !got.Equal(test.want) {
+			t.Errorf("%s minus %s: got %s, want %s", test.now, test.retention, got, test.want)
+		}
+	}
+}
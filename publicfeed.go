@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PublicStats is the network's stats for the community website, safe to
+// publish: counts and sums go through publicNoise, and nothing is said
+// about a member
+type PublicStats struct {
+	Network       string
+	From          time.Time
+	To            time.Time
+	GeneratedAt   time.Time
+	ActiveMembers int
+	TotalGB       float64
+	// Growth is in percent over the window before, nil without usage in it
+	MemberGrowth *float64
+	UsageGrowth  *float64
+}
+
+// activeUsage is the number of members with usage in the periods, and
+// their total usage in GB
+func activeUsage(network string, periods []BandwidthUsagePeriod, from time.Time, to time.Time) (int, float64) {
+	summary := summarizeDashboard(network, periods, from, to)
+	active := 0
+	for _, member := range summary.Members {
+		if member.Total > 0 {
+			active++
+		}
+	}
+	return active, summary.Total
+}
+
+// growth is the change from previous to current in percent
+func growth(current float64, previous float64) *float64 {
+	if previous <= 0 {
+		return nil
+	}
+	percent := (current - previous) / previous * 100
+	return &percent
+}
+
+// publicStats sums the usage collected over the window, with its growth
+// over the stats published for the window before, if any. ok is false when
+// there are too few active members to publish
+func publicStats(noise publicNoise, network string, current []BandwidthUsagePeriod, previous *PublicStats, from time.Time, to time.Time) (stats PublicStats, ok bool) {
+	members, total := activeUsage(network, current, from, to)
+	if !noise.keep(members) {
+		return PublicStats{}, false
+	}
+	stats = PublicStats{
+		Network:       network,
+		From:          from,
+		To:            to,
+		GeneratedAt:   time.Now().UTC(),
+		ActiveMembers: noise.count(members),
+		TotalGB:       noise.gb(total),
+	}
+
+	// Growth compares numbers already published. Drawing noise for the
+	// window before again would publish another sample of it each run, and
+	// their average would give its true value away
+	if previous != nil {
+		stats.MemberGrowth = growth(float64(stats.ActiveMembers), float64(previous.ActiveMembers))
+		stats.UsageGrowth = growth(stats.TotalGB, previous.TotalGB)
+	}
+	return stats, true
+}
+
+// getPublishedStats reads the stats published for a window, nil if there
+// are none
+func getPublishedStats(collection *mongo.Collection, network string, from time.Time, to time.Time) (*PublicStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var stats PublicStats
+	err := collection.FindOne(ctx, bson.M{"network": network, "from": from, "to": to}).Decode(&stats)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// publishPublicFeed publishes the stats of a run: they are recorded in
+// Mongo for the Atom feed, then written to each PUBLIC_FEED destination as
+// JSON and to each ATOM_FEED destination as the feed of the latest weeks. A
+// destination is a file, s3://bucket/key or an http(s) URL the stats are
+// POSTed to, with {network} replaced by the network. Without Mongo growth
+// is left out and the feed only has the run. A window collected again
+// publishes the stats recorded for it, rather than new noise
+func publishPublicFeed(settings Settings, collected []BandwidthUsagePeriod, bwupCollection *mongo.Collection) error {
+	var statsCollection *mongo.Collection
+	var published, previous *PublicStats
+	if bwupCollection != nil {
+		var err error
+		statsCollection = bwupCollection.Database().Collection(settings.MongoPublicStatsCollection)
+		if published, err = getPublishedStats(statsCollection, settings.Network, settings.From, settings.To); err != nil {
+			return err
+		}
+		window := settings.To.Sub(settings.From)
+		if previous, err = getPublishedStats(statsCollection, settings.Network, settings.From.Add(-window), settings.From); err != nil {
+			return err
+		}
+	}
+
+	var stats PublicStats
+	if published != nil {
+		stats = *published
+	} else {
+		var ok bool
+		stats, ok = publicStats(newPublicNoise(settings), settings.Network, collected, previous, settings.From, settings.To)
+		if !ok {
+			log.Printf("Not publishing the public stats of %s, fewer than %d members were active", settings.Network, settings.PublicMinMembers)
+			return nil
+		}
+		if statsCollection != nil {
+			if err := savePublicStats(statsCollection, stats); err != nil {
+				return err
+			}
+		}
+	}
+
+	feed := []PublicStats{stats}
+	if statsCollection != nil && len(settings.AtomFeed) > 0 {
+		var err error
+		if feed, err = getPublicStats(statsCollection, settings.Network, atomFeedSince(settings, time.Now())); err != nil {
+			return err
+		}
+	}
+
+	contents, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, destination := range settings.PublicFeed {
+		destination = strings.Replace(destination, "{network}", settings.Network, -1)
+		if err := publishFeed(settings, destination, contents, "application/json"); err != nil {
+			return fmt.Errorf("publishing to %s: %v", redactURL(destination), err)
+		}
+	}
+
+	if len(settings.AtomFeed) == 0 {
+		return nil
+	}
+	atom, err := marshalAtomFeed(newAtomFeed(settings, feed))
+	if err != nil {
+		return err
+	}
+	for _, destination := range settings.AtomFeed {
+		destination = strings.Replace(destination, "{network}", settings.Network, -1)
+		if err := publishFeed(settings, destination, atom, "application/atom+xml"); err != nil {
+			return fmt.Errorf("publishing to %s: %v", redactURL(destination), err)
+		}
+	}
+	return nil
+}
+
+// publishFeed writes a feed to a file, S3 or an http(s) URL
+func publishFeed(settings Settings, destination string, contents []byte, contentType string) error {
+	switch {
+	case strings.HasPrefix(destination, "s3://"):
+		object, err := parseS3URL(destination)
+		if err != nil {
+			return err
+		}
+		return putS3Object(settings, object, contents, contentType)
+
+	case strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://"):
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		request, err := http.NewRequest(http.MethodPost, destination, bytes.NewReader(contents))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", contentType)
+		response, err := http.DefaultClient.Do(request.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			body, _ := ioutil.ReadAll(response.Body)
+			return fmt.Errorf("%s %s", response.Status, strings.TrimSpace(string(body)))
+		}
+		return nil
+
+	default:
+		// Written whole and renamed into place, so the website never reads
+		// half a file
+		temporary := destination + ".tmp"
+		if err := ioutil.WriteFile(temporary, contents, 0644); err != nil {
+			return err
+		}
+		return os.Rename(temporary, destination)
+	}
+}
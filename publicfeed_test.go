@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// activePeriods is usage of members, each using total GB from a time
+func activePeriods(members int, total float64, from time.Time) []BandwidthUsagePeriod {
+	periods := []BandwidthUsagePeriod{}
+	for i := 0; i < members; i++ {
+		period := usage(0, total/float64(members))
+		period.MemberID = fmt.Sprintf("rec%d", i)
+		period.From = from
+		period.To = from.Add(time.Hour)
+		periods = append(periods, period)
+	}
+	return periods
+}
+
+func TestPublicStats(t *testing.T) {
+	from := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	noise := publicNoise{roundGB: 1, minMembers: 3}
+
+	// Growth is over what was published for the window before
+	current := append(activePeriods(6, 120, from), noUsage())
+	previous := &PublicStats{ActiveMembers: 4, TotalGB: 100}
+	stats, ok := publicStats(noise, "casa", current, previous, from, to)
+	if !ok || stats.ActiveMembers != 6 || stats.TotalGB != 120 || *stats.MemberGrowth != 50 || *stats.UsageGrowth != 20 {
+		t.Errorf("got %+v", stats)
+	}
+
+	// Nothing was published for the window before to say how it grew
+	stats, ok = publicStats(noise, "casa", current, nil, from, to)
+	if !ok || stats.MemberGrowth != nil || stats.UsageGrowth != nil {
+		t.Errorf("got %+v", stats)
+	}
+
+	if _, ok := publicStats(noise, "casa", activePeriods(2, 10, from), nil, from, to); ok {
+		t.Error("stats of 2 members shouldn't be published")
+	}
+}
+
+func TestPublishPublicFeed(t *testing.T) {
+	var posted PublicStats
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	settings, _ := readSettings("casa", settingsEnv{"PUBLIC_FEED": filepath.Join(dir, "{network}.json") + "," + server.URL})
+	settings.From = time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+	settings.To = settings.From.Add(time.Hour)
+	if err := publishPublicFeed(settings, activePeriods(5, 50, settings.From), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "casa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written PublicStats
+	if err := json.Unmarshal(contents, &written); err != nil || written.ActiveMembers != 5 || posted.TotalGB != 50 {
+		t.Errorf("wrote %s, posted %+v", contents, posted)
+	}
+}
+
+func TestPublicFeedSettings(t *testing.T) {
+	settings, _ := readSettings("casa", settingsEnv{"PUBLIC_FEED": "s3://stats, ftp://host/stats.json", "AWS_SECRET_ACCESS_KEY": "secret"})
+	problems := strings.Join(validateSettings(settings), "\n")
+	for _, want := range []string{"expected an S3 object like s3://bucket/key", "needs AWS_ACCESS_KEY_ID", "PUBLIC_FEED and ATOM_FEED scheme must be one of https, http"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("expected %q in the problems:\n%s", want, problems)
+		}
+	}
+	if settings.Redacted().AWSSecretAccessKey != redacted {
+		t.Error("AWS_SECRET_ACCESS_KEY should be redacted")
+	}
+}
+
+func TestAWSSigningKey(t *testing.T) {
+	// The example of the AWS signature version 4 documentation
+	key := awsSigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if got := hex.EncodeToString(key); got != "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestPutS3Object(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	settings := Settings{AWSAccessKeyID: "AKID", AWSSecretAccessKey: "secret", AWSRegion: "us-east-1", S3Endpoint: server.URL}
+	if err := putS3Object(settings, s3Object{Bucket: "site", Key: "stats/casa feed.json"}, []byte("{}"), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	if request.Method != http.MethodPut || request.URL.EscapedPath() != "/site/stats/casa%20feed.json" || string(body) != "{}" {
+		t.Errorf("got %s %s %s", request.Method, request.URL.EscapedPath(), body)
+	}
+	if auth := request.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+		t.Errorf("got Authorization %s", auth)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graylog query modes, selected with GRAYLOG_QUERY_MODE
+const (
+	queryModePhrase     = "phrase"
+	queryModeRegex      = "regex"
+	queryModeStructured = "structured"
+	queryModeGELF       = "gelf"
+	// queryModeSaved reads the structured query templates from Graylog
+	// saved searches when the source is created
+	queryModeSaved = "saved"
+)
+
+// Graylog query strategies, selected with GRAYLOG_QUERY_STRATEGY: a stats
+// query per member and direction, terms stats queries grouping every member
+// by key, or whichever suits the deployment
+const (
+	queryStrategyAuto   = "auto"
+	queryStrategyMember = "member"
+	queryStrategyTerms  = "terms"
+)
+
+// bytesField is the message field holding the byte count in the text based
+// query modes
+const bytesField = "bytes"
+
+// luceneRegexReserved are the characters that must be escaped inside a
+// Lucene regular expression literal
+const luceneRegexReserved = `.?+*|{}[]()"\#@&<>~/`
+
+func escapeLuceneRegex(value string) string {
+	var escaped strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(luceneRegexReserved, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+func escapeLucenePhrase(value string) string {
+	return strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1)
+}
+
+// buildGraylogQuery returns the search query matching the log lines for one
+// direction of a member's traffic, and the field whose values must be summed
+func buildGraylogQuery(settings Settings, direction string, wgKey string) (query string, field string, err error) {
+	if direction != "up" && direction != "down" {
+		return "", "", fmt.Errorf("invalid direction argument %q", direction)
+	}
+
+	switch settings.GraylogQueryMode {
+	case "", queryModePhrase:
+		directionString := "downloaded from exit"
+		if direction == "up" {
+			directionString = "uploaded to exit"
+		}
+		return `"` + wgKey + `" AND "` + directionString + `"`, bytesField, nil
+
+	case queryModeRegex:
+		pattern := settings.GraylogDownPattern
+		if direction == "up" {
+			pattern = settings.GraylogUpPattern
+		}
+		pattern = strings.Replace(pattern, "{key}", escapeLuceneRegex(wgKey), -1)
+		return settings.GraylogPatternField + ":/" + pattern + "/", bytesField, nil
+
+	case queryModeStructured:
+		template := settings.GraylogDownQuery
+		if direction == "up" {
+			template = settings.GraylogUpQuery
+		}
+		return strings.Replace(template, "{key}", escapeLucenePhrase(wgKey), -1), bytesField, nil
+
+	case queryModeGELF:
+		// Structured GELF messages carry the byte counts for each direction
+		// in their own fields, so we only need to match the member's key
+		field := settings.GraylogDownField
+		if direction == "up" {
+			field = settings.GraylogUpField
+		}
+		return settings.GraylogKeyField + `:"` + escapeLucenePhrase(wgKey) + `"`, field, nil
+	}
+
+	return "", "", fmt.Errorf("invalid GRAYLOG_QUERY_MODE %q", settings.GraylogQueryMode)
+}
+
+// buildGraylogExitQuery returns a query matching the log lines of every
+// member together, for the given direction
+func buildGraylogExitQuery(settings Settings, direction string) (query string, field string, err error) {
+	// Check the direction and mode, and get the field to sum
+	if _, field, err = buildGraylogQuery(settings, direction, ""); err != nil {
+		return "", "", err
+	}
+
+	switch settings.GraylogQueryMode {
+	case queryModeRegex:
+		// An empty key leaves a pattern matching every member
+		return buildGraylogQuery(settings, direction, "")
+
+	case queryModeStructured:
+		template := settings.GraylogDownQuery
+		if direction == "up" {
+			template = settings.GraylogUpQuery
+		}
+		template = strings.Replace(template, `"{key}"`, "*", -1)
+		return strings.Replace(template, "{key}", "*", -1), field, nil
+
+	case queryModeGELF:
+		return "_exists_:" + settings.GraylogKeyField, field, nil
+	}
+
+	directionString := "downloaded from exit"
+	if direction == "up" {
+		directionString = "uploaded to exit"
+	}
+	return `"` + directionString + `"`, field, nil
+}
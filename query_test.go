@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func testQuerySettings(mode string) Settings {
+	return Settings{
+		GraylogQueryMode:    mode,
+		GraylogUpPattern:    ".*{key}.*uploaded to exit.*",
+		GraylogDownPattern:  ".*{key}.*downloaded from exit.*",
+		GraylogPatternField: "message",
+		GraylogUpQuery:      `wg_key:"{key}" AND direction:up`,
+		GraylogDownQuery:    `wg_key:"{key}" AND direction:down`,
+		GraylogKeyField:     "wg_key",
+		GraylogUpField:      "bytes_up",
+		GraylogDownField:    "bytes_down",
+	}
+}
+
+func TestBuildGraylogQuery(t *testing.T) {
+	// WireGuard keys are base64, so contain regex reserved characters
+	key := "ab+c/d=="
+
+	tests := []struct {
+		mode      string
+		direction string
+		query     string
+		field     string
+	}{
+		{"", "up", `"ab+c/d==" AND "uploaded to exit"`, "bytes"},
+		{queryModePhrase, "down", `"ab+c/d==" AND "downloaded from exit"`, "bytes"},
+		{queryModeRegex, "up", `message:/.*ab\+c\/d==.*uploaded to exit.*/`, "bytes"},
+		{queryModeRegex, "down", `message:/.*ab\+c\/d==.*downloaded from exit.*/`, "bytes"},
+		{queryModeStructured, "up", `wg_key:"ab+c/d==" AND direction:up`, "bytes"},
+		{queryModeGELF, "up", `wg_key:"ab+c/d=="`, "bytes_up"},
+		{queryModeGELF, "down", `wg_key:"ab+c/d=="`, "bytes_down"},
+	}
+
+	for _, test := range tests {
+		query, field, err := buildGraylogQuery(testQuerySettings(test.mode), test.direction, key)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.mode, test.direction, err)
+			continue
+		}
+		if query != test.query || field != test.field {
+			t.Errorf("%s %s: got %s on %s, want %s on %s", test.mode, test.direction, query, field, test.query, test.field)
+		}
+	}
+}
+
+func TestBuildGraylogQueryErrors(t *testing.T) {
+	if _, _, err := buildGraylogQuery(testQuerySettings(queryModePhrase), "sideways", "key"); err == nil {
+		t.Error("an invalid direction should fail")
+	}
+	if _, _, err := buildGraylogQuery(testQuerySettings("lucene"), "up", "key"); err == nil {
+		t.Error("an invalid mode should fail")
+	}
+}
+
+func TestEscapeLucenePhrase(t *testing.T) {
+	if got, want := escapeLucenePhrase(`a"b\c`), `a\"b\\c`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
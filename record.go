@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recordTransport saves a sanitized copy of each Airtable and Graylog
+// response to a replay directory, for the -replay mode and for tests.
+// Responses asking to retry later aren't saved, as they would be replayed
+// forever
+type recordTransport struct {
+	dir string
+	// phoneColumn is the members' phone numbers field, replaced by fake ones
+	phoneColumn string
+	base        http.RoundTripper
+}
+
+func (t recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return resp, nil
+	}
+	recorded := recordedResponse{
+		Method:      req.Method,
+		URL:         req.URL.RequestURI(),
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        string(sanitizeRecording(body, t.phoneColumn)),
+	}
+	if err := saveRecording(t.dir, req, recorded); err != nil {
+		log.Printf("WARNING: recording the response to %s: %v", requestKey(req.Method, req.URL), err)
+	}
+	return resp, nil
+}
+
+// saveRecording saves the response to a request in a replay directory
+func saveRecording(dir string, req *http.Request, recorded recordedResponse) error {
+	contents, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(recordingPath(dir, req.Method, req.URL), append(contents, '\n'), 0600)
+}
+
+// sanitizeRecording strips what a recording mustn't hold from a response
+// body: the values of fields named like secrets, and members' phone
+// numbers, replaced by fake ones still telling members apart. Names and
+// keys are kept, as the recorded queries are made with them. Bodies which
+// aren't JSON are kept as they are
+func sanitizeRecording(body []byte, phoneColumn string) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+
+	sanitized, err := json.Marshal(sanitizeValue(value, phoneColumn))
+	if err != nil {
+		return body
+	}
+	return sanitized
+}
+
+func sanitizeValue(value interface{}, phoneColumn string) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			switch {
+			case secretField(key):
+				value[key] = redacted
+			case key == phoneColumn:
+				if phone, ok := field.(string); ok && phone != "" {
+					value[key] = fakePhone(phone)
+				}
+			default:
+				value[key] = sanitizeValue(field, phoneColumn)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = sanitizeValue(item, phoneColumn)
+		}
+	}
+	return value
+}
+
+// secretField is true of the fields named like they hold secrets
+func secretField(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range []string{"password", "secret", "token", "api_key", "apikey"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakePhone is a fictional number standing in for a phone number, the same
+// for the same number
+func fakePhone(phone string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(phone))
+	return fmt.Sprintf("+1555%07d", hash.Sum32()%10000000)
+}
+
+// startRecording creates a replay directory, saving the window of the run
+// recorded in it
+func startRecording(dir string, window replayWindow) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(window, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, replayWindowFile), append(contents, '\n'), 0600)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/members":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"records": [{"id": "rec1", "fields": {"Name": "Alice", "Cell": "+50588887777", "Access Token": "hunter2"}}]}`)
+		case "/busy":
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	window := replayWindow{From: time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC), To: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), Duration: 24 * time.Hour}
+	if err := startRecording(dir, window); err != nil {
+		t.Fatal(err)
+	}
+
+	recording := &http.Client{Transport: upstreamTransport(Settings{Record: dir, MemberFields: map[string]string{"Phone": "Cell"}}, http.DefaultTransport)}
+	for _, path := range []string{"/members?view=all", "/missing", "/busy"} {
+		resp, err := recording.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if path == "/members?view=all" && !strings.Contains(string(body), "+50588887777") {
+			t.Errorf("got %s, want the response passed on unsanitized", body)
+		}
+	}
+
+	replaying := &http.Client{Transport: upstreamTransport(Settings{Replay: dir}, http.DefaultTransport)}
+	resp, err := replaying.Get("http://airtable.invalid/members?view=all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s %v", resp.Status, resp.Header)
+	}
+	if strings.Contains(string(body), "+50588887777") || strings.Contains(string(body), "hunter2") || !strings.Contains(string(body), "Alice") {
+		t.Errorf("got %s, want the phone number and token replaced", body)
+	}
+
+	if resp, err := replaying.Get("http://graylog.invalid/missing"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v, want the recorded failure", err)
+	}
+	if _, err := replaying.Get("http://graylog.invalid/busy"); err == nil {
+		t.Error("rate limited: should have failed as unrecorded")
+	}
+
+	recorded, err := readReplayWindow(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recorded.From.Equal(window.From) || !recorded.To.Equal(window.To) || recorded.Duration != window.Duration {
+		t.Errorf("got window %+v", recorded)
+	}
+}
+
+func TestSanitizeRecording(t *testing.T) {
+	sanitized := string(sanitizeRecording([]byte(`{"records": [{"fields": {"Phone": "+50511112222", "Plan Mbps": 25}}, {"fields": {"Phone": "+50533334444"}}], "password": "x"}`), "Phone"))
+	if strings.Contains(sanitized, "+505") || strings.Contains(sanitized, `"x"`) || !strings.Contains(sanitized, `"Plan Mbps":25`) {
+		t.Errorf("got %s", sanitized)
+	}
+	if fakePhone("+50511112222") == fakePhone("+50533334444") || fakePhone("+50511112222") != fakePhone("+50511112222") {
+		t.Error("expected fake numbers telling members apart")
+	}
+
+	// Graylog's non-finite numbers aren't JSON
+	body := `{"count": 3, "total": NaN}`
+	if sanitized := string(sanitizeRecording([]byte(body), "Phone")); sanitized != body {
+		t.Errorf("got %s, want it kept as is", sanitized)
+	}
+}
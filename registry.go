@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CachedMember is the copy of a mesh member kept between runs so that
+// registry changes can be detected
+type CachedMember struct {
+	ID      string `bson:"_id"`
+	Network string
+	Name    string
+	WGKey   string
+}
+
+// MemberChange records a single difference between two member lists
+type MemberChange struct {
+	Network       string
+	Kind          string
+	MemberID      string
+	Name          string
+	WGKey         string
+	PreviousName  string `json:",omitempty" bson:",omitempty"`
+	PreviousWGKey string `json:",omitempty" bson:",omitempty"`
+	DetectedAt    time.Time
+}
+
+// cacheMember is the member as cached. Only the ID of members who opted out
+// of tracking is kept, enough to tell when they are added or removed
+func cacheMember(network string, member MeshMember) CachedMember {
+	if member.Fields.TrackingOptOut {
+		return CachedMember{ID: member.ID, Network: network}
+	}
+	return CachedMember{
+		ID:      member.ID,
+		Network: network,
+		Name:    strings.TrimSpace(member.Fields.Name),
+		WGKey:   member.Fields.WGKey,
+	}
+}
+
+// diffMembers compares the previously cached member list against the current
+// one, keyed by Airtable record ID
+func diffMembers(previous []CachedMember, current []CachedMember, now time.Time) []MemberChange {
+	changes := []MemberChange{}
+
+	previousByID := make(map[string]CachedMember, len(previous))
+	for _, member := range previous {
+		previousByID[member.ID] = member
+	}
+
+	currentIDs := make(map[string]bool, len(current))
+	for _, member := range current {
+		currentIDs[member.ID] = true
+
+		old, ok := previousByID[member.ID]
+		if !ok {
+			changes = append(changes, MemberChange{
+				Kind:       "added",
+				MemberID:   member.ID,
+				Name:       member.Name,
+				WGKey:      member.WGKey,
+				DetectedAt: now,
+			})
+			continue
+		}
+
+		if old.Name != member.Name || old.WGKey != member.WGKey {
+			change := MemberChange{
+				Kind:       "modified",
+				MemberID:   member.ID,
+				Name:       member.Name,
+				WGKey:      member.WGKey,
+				DetectedAt: now,
+			}
+			if old.Name != member.Name {
+				change.PreviousName = old.Name
+			}
+			if old.WGKey != member.WGKey {
+				change.PreviousWGKey = old.WGKey
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	for _, member := range previous {
+		if !currentIDs[member.ID] {
+			changes = append(changes, MemberChange{
+				Kind:       "removed",
+				MemberID:   member.ID,
+				Name:       member.Name,
+				WGKey:      member.WGKey,
+				DetectedAt: now,
+			})
+		}
+	}
+
+	return changes
+}
+
+func getCachedMembers(ctx context.Context, collection *mongo.Collection, network string) ([]CachedMember, error) {
+	cachedMembers := []CachedMember{}
+
+	cursor, err := collection.Find(ctx, bson.M{"network": networkMatch(network)})
+	if err != nil {
+		return cachedMembers, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var member CachedMember
+		if err := cursor.Decode(&member); err != nil {
+			return cachedMembers, err
+		}
+		cachedMembers = append(cachedMembers, member)
+	}
+
+	return cachedMembers, cursor.Err()
+}
+
+// recordMemberChanges diffs the current member list against the cached one,
+// logs and stores every change, then updates the cache to the current list.
+// An empty list is refused, as Airtable returning no members is far more
+// likely a problem on its side than every member leaving
+func recordMemberChanges(settings Settings, db *mongo.Database, meshMembers []MeshMember) ([]MemberChange, error) {
+	if len(meshMembers) == 0 {
+		return nil, errors.New("refusing to record an empty member list")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cacheCollection := db.Collection(settings.MongoMembersCollection)
+	changesCollection := db.Collection(settings.MongoMemberChangesCollection)
+
+	previous, err := getCachedMembers(ctx, cacheCollection, settings.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make([]CachedMember, 0, len(meshMembers))
+	optedOut := map[string]bool{}
+	for _, member := range meshMembers {
+		current = append(current, cacheMember(settings.Network, member))
+		optedOut[member.ID] = member.Fields.TrackingOptOut
+	}
+
+	changes := consentChanges(diffMembers(previous, current, time.Now()), optedOut)
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	changeDocs := make([]interface{}, 0, len(changes))
+	removed := []string{}
+	for _, change := range changes {
+		change.Network = settings.Network
+		log.Printf("Member %s: %s (%s)", change.Kind, change.Name, change.MemberID)
+		changeDocs = append(changeDocs, change)
+		if change.Kind == "removed" {
+			removed = append(removed, change.MemberID)
+		}
+	}
+
+	if _, err := changesCollection.InsertMany(ctx, changeDocs); err != nil {
+		return changes, err
+	}
+
+	// Members are updated one by one rather than the cache being replaced,
+	// so a failure part way leaves the cache usable for the next run
+	for _, member := range current {
+		_, err := cacheCollection.ReplaceOne(ctx, bson.M{"_id": member.ID}, member, options.Replace().SetUpsert(true))
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	if len(removed) > 0 {
+		filter := bson.M{"network": networkMatch(settings.Network), "_id": bson.M{"$in": removed}}
+		if _, err := cacheCollection.DeleteMany(ctx, filter); err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// MemberCache keeps the member list in memory for long running commands,
+// refreshing it from Airtable once it is older than the configured TTL
+type MemberCache struct {
+	settings  Settings
+	mutex     sync.Mutex
+	members   []MeshMember
+	byKey     map[string]MeshMember
+	byID      map[string]MeshMember
+	fetchedAt time.Time
+}
+
+func newMemberCache(settings Settings) *MemberCache {
+	return &MemberCache{settings: settings, byKey: map[string]MeshMember{}, byID: map[string]MeshMember{}}
+}
+
+func (c *MemberCache) refreshLocked() error {
+	if time.Since(c.fetchedAt) < c.settings.MemberCacheTTL {
+		return nil
+	}
+
+	members, err := getMeshMembers(c.settings)
+	if err != nil {
+		return err
+	}
+
+	byKey := make(map[string]MeshMember, len(members))
+	byID := make(map[string]MeshMember, len(members))
+	for _, member := range members {
+		byKey[member.Fields.WGKey] = member
+		byID[member.ID] = member
+	}
+
+	c.members = members
+	c.byKey = byKey
+	c.byID = byID
+	c.fetchedAt = time.Now()
+	return nil
+}
+
+// Members returns the current member list
+func (c *MemberCache) Members() ([]MeshMember, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.refreshLocked()
+	return c.members, err
+}
+
+// ByWGKey looks up the member a WireGuard key belongs to
+func (c *MemberCache) ByWGKey(wgKey string) (MeshMember, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.refreshLocked()
+	member, ok := c.byKey[wgKey]
+	return member, ok, err
+}
+
+// ByID looks up a member by Airtable record ID
+func (c *MemberCache) ByID(id string) (MeshMember, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.refreshLocked()
+	member, ok := c.byID[id]
+	return member, ok, err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffMembers(t *testing.T) {
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	alice := CachedMember{ID: "rec1", Name: "Alice", WGKey: "key1"}
+	bob := CachedMember{ID: "rec2", Name: "Bob", WGKey: "key2"}
+
+	tests := []struct {
+		name     string
+		previous []CachedMember
+		current  []CachedMember
+		want     []MemberChange
+	}{
+		{"unchanged", []CachedMember{alice, bob}, []CachedMember{bob, alice}, []MemberChange{}},
+		{"first run", nil, []CachedMember{alice}, []MemberChange{
+			{Kind: "added", MemberID: "rec1", Name: "Alice", WGKey: "key1", DetectedAt: now},
+		}},
+		{"removed", []CachedMember{alice, bob}, []CachedMember{alice}, []MemberChange{
+			{Kind: "removed", MemberID: "rec2", Name: "Bob", WGKey: "key2", DetectedAt: now},
+		}},
+		{"renamed", []CachedMember{alice}, []CachedMember{{ID: "rec1", Name: "Alice B", WGKey: "key1"}}, []MemberChange{
+			{Kind: "modified", MemberID: "rec1", Name: "Alice B", WGKey: "key1", PreviousName: "Alice", DetectedAt: now},
+		}},
+		{"rekeyed", []CachedMember{alice}, []CachedMember{{ID: "rec1", Name: "Alice", WGKey: "key3"}}, []MemberChange{
+			{Kind: "modified", MemberID: "rec1", Name: "Alice", WGKey: "key3", PreviousWGKey: "key1", DetectedAt: now},
+		}},
+		// A record replaced by a new one under the same name is a removal
+		// and an addition, not a rename
+		{"recreated", []CachedMember{alice}, []CachedMember{{ID: "rec3", Name: "Alice", WGKey: "key1"}}, []MemberChange{
+			{Kind: "added", MemberID: "rec3", Name: "Alice", WGKey: "key1", DetectedAt: now},
+			{Kind: "removed", MemberID: "rec1", Name: "Alice", WGKey: "key1", DetectedAt: now},
+		}},
+	}
+
+	for _, test := range tests {
+		got := diffMembers(test.previous, test.current, now)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordedResponse is an Airtable or Graylog response as saved in a replay
+// directory, a JSON file per request
+type recordedResponse struct {
+	Method string
+	// URL is the path and query requested, without the host, so a
+	// recording replays whatever the services are configured as
+	URL         string
+	Status      int
+	ContentType string `json:",omitempty"`
+	Body        string
+}
+
+// replayWindow is the window of the recorded run, in the run.json file of a
+// replay directory, replayed unless another is given
+type replayWindow struct {
+	From     time.Time
+	To       time.Time
+	Duration time.Duration
+}
+
+// replayWindowFile is the name of the window's file in a replay directory
+const replayWindowFile = "run.json"
+
+// requestKey identifies a request in a recording: its method, path and
+// query, with the query parameters sorted so their order doesn't matter
+func requestKey(method string, u *url.URL) string {
+	key := u.Path
+	if query, err := url.ParseQuery(u.RawQuery); err == nil && len(query) > 0 {
+		key += "?" + query.Encode()
+	} else if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return method + " " + key
+}
+
+// recordingPath is the file holding the response to a request in a replay
+// directory
+func recordingPath(dir string, method string, u *url.URL) string {
+	sum := sha256.Sum256([]byte(requestKey(method, u)))
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sum[:8]))
+}
+
+// replayTransport answers requests with the responses recorded in a
+// directory, failing those it has none for, so nothing goes upstream
+type replayTransport struct {
+	dir string
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	contents, err := ioutil.ReadFile(recordingPath(t.dir, req.Method, req.URL))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no response to %s recorded in %s", requestKey(req.Method, req.URL), t.dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded recordedResponse
+	if err := json.Unmarshal(contents, &recorded); err != nil {
+		return nil, fmt.Errorf("recorded response to %s is corrupt: %v", requestKey(req.Method, req.URL), err)
+	}
+
+	header := http.Header{}
+	if recorded.ContentType != "" {
+		header.Set("Content-Type", recorded.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(recorded.Body))),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// upstreamTransport is the transport of Airtable and Graylog requests: base,
+// recording its responses in a recorded run, or in a replayed run the
+// recorded responses
+func upstreamTransport(settings Settings, base http.RoundTripper) http.RoundTripper {
+	if settings.Replay != "" {
+		return replayTransport{dir: settings.Replay}
+	}
+	if settings.Record != "" {
+		return recordTransport{dir: settings.Record, phoneColumn: memberColumn(settings.MemberFields, "Phone"), base: base}
+	}
+	return base
+}
+
+// readReplayWindow reads the window of the run recorded in a directory
+func readReplayWindow(dir string) (replayWindow, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, replayWindowFile))
+	if err != nil {
+		return replayWindow{}, fmt.Errorf("no window given, and none recorded: %v", err)
+	}
+
+	var window replayWindow
+	if err := json.Unmarshal(contents, &window); err != nil {
+		return replayWindow{}, fmt.Errorf("%s is corrupt: %v", replayWindowFile, err)
+	}
+	if window.Duration == 0 {
+		window.Duration = window.To.Sub(window.From)
+	}
+	return window, nil
+}
+
+// replaySettings sets a network's settings up to replay the responses
+// recorded in dir. The run is offline: members are read from the recorded
+// Airtable responses, or MEMBERS_CSV, usage from the recorded Graylog ones,
+// and it is printed but not stored
+func replaySettings(settings Settings, dir string) (Settings, error) {
+	if settings.StatSource != "" && settings.StatSource != statSourceGraylog {
+		return settings, fmt.Errorf("only the %s stat source can be replayed, not %s", statSourceGraylog, settings.StatSource)
+	}
+
+	settings.Replay = dir
+	settings.MongoURL = ""
+	settings.JournalFile = ""
+	return settings, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordFixture saves the response to a request in a replay directory
+func recordFixture(t *testing.T, dir string, method string, rawURL string, status int, body string) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveRecording(dir, req, recordedResponse{Method: method, URL: req.URL.RequestURI(), Status: status, ContentType: "application/json", Body: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	a, _ := url.Parse("http://graylog:9000/api/search?query=x&from=1&to=2")
+	b, _ := url.Parse("http://other/api/search?to=2&query=x&from=1")
+	if requestKey("GET", a) != requestKey("GET", b) {
+		t.Errorf("got %q and %q, want the host and parameter order ignored", requestKey("GET", a), requestKey("GET", b))
+	}
+	if requestKey("GET", a) == requestKey("POST", a) {
+		t.Error("expected the method in the key")
+	}
+	if recordingPath("dir", "GET", a) == recordingPath("dir", "GET", b.ResolveReference(&url.URL{RawQuery: "query=y"})) {
+		t.Error("expected requests with another query recorded apart")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recordFixture(t, dir, "GET", "https://api.airtable.com/v0/appABCDEFGHIJKLMN/Members?offset=", http.StatusOK,
+		`{"records": [{"id": "rec1", "fields": {"Name": "Alice", "WG Key": "key1"}}]}`)
+	recordFixture(t, dir, "GET", "http://graylog/api/system", http.StatusOK, `{"version": "4.0"}`)
+	recordFixture(t, dir, "GET", "http://graylog/api/broken", http.StatusInternalServerError, `{"message": "down"}`)
+
+	settings, err := replaySettings(Settings{MongoURL: "mongodb://mongo", JournalFile: "journal.jsonl", AirtableBaseID: "appABCDEFGHIJKLMN", AirtableTableName: "Members", GraylogURL: "http://graylog.invalid/"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.MongoURL != "" || settings.JournalFile != "" {
+		t.Errorf("got %+v, want nothing stored", settings)
+	}
+
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].ID != "rec1" || members[0].Fields.WGKey != "key1" {
+		t.Errorf("got members %+v", members)
+	}
+
+	body, err := requestGraylog(settings, "api/system")
+	if err != nil || string(body) != `{"version": "4.0"}` {
+		t.Errorf("got %s and error %v", body, err)
+	}
+	if _, err := requestGraylog(settings, "api/broken"); err == nil {
+		t.Error("recorded failure: should have failed")
+	}
+	if _, err := requestGraylog(settings, "api/unrecorded"); err == nil {
+		t.Error("unrecorded: should have failed")
+	}
+
+	store, err := newUsageStore(settings, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(usage(1, 2)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := replaySettings(Settings{StatSource: statSourceLoki}, dir); err == nil {
+		t.Error("loki: should have failed")
+	}
+}
+
+func TestReadReplayWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := readReplayWindow(dir); err == nil {
+		t.Error("no window: should have failed")
+	}
+
+	to := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	contents, _ := json.Marshal(replayWindow{From: to.Add(-24 * time.Hour), To: to})
+	if err := ioutil.WriteFile(filepath.Join(dir, replayWindowFile), contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	window, err := readReplayWindow(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !window.To.Equal(to) || window.Duration != 24*time.Hour {
+		t.Errorf("got window %+v", window)
+	}
+}
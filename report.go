@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats of the commands printing reports, selected with -output
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputCSV   = "csv"
+	outputQuiet = "quiet"
+)
+
+// printJSON writes a value as a line of JSON, the format commands print
+// their results in
+func printJSON(w io.Writer, value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(line))
+	return err
+}
+
+// defaultOutput prints a table for people at a terminal and JSON lines for
+// everything else, like pipes and cron
+func defaultOutput() string {
+	if isTerminal(os.Stdout) {
+		return outputTable
+	}
+	return outputJSON
+}
+
+// reportRow is a result which can also be printed as a row of a table or CSV
+type reportRow interface {
+	reportColumns() []string
+	reportValues(number func(*float64) string) []string
+}
+
+// ReportWriter prints results in one of the output formats. Tables are
+// aligned over all the rows written, so are only printed by Flush
+type ReportWriter struct {
+	format  string
+	w       io.Writer
+	table   *tabwriter.Writer
+	csv     *csv.Writer
+	columns bool
+}
+
+func newReportWriter(w io.Writer, format string) (*ReportWriter, error) {
+	report := &ReportWriter{format: format, w: w}
+
+	switch format {
+	case outputTable:
+		report.table = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	case outputCSV:
+		report.csv = csv.NewWriter(w)
+	case outputJSON, outputQuiet:
+	default:
+		return nil, fmt.Errorf("unknown output %q, expected %s, %s, %s or %s", format, outputTable, outputJSON, outputCSV, outputQuiet)
+	}
+
+	return report, nil
+}
+
+// tableNumber rounds numbers for reading, marking missing ones with a dash
+func tableNumber(n *float64) string {
+	if n == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*n, 'f', 3, 64)
+}
+
+// csvNumber keeps numbers exact, leaving missing ones empty
+func csvNumber(n *float64) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*n, 'f', -1, 64)
+}
+
+func (r *ReportWriter) Write(row reportRow) error {
+	switch r.format {
+	case outputJSON:
+		return printJSON(r.w, row)
+	case outputTable:
+		if !r.columns {
+			r.columns = true
+			if _, err := fmt.Fprintln(r.table, strings.Join(row.reportColumns(), "\t")); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintln(r.table, strings.Join(row.reportValues(tableNumber), "\t"))
+		return err
+	case outputCSV:
+		if !r.columns {
+			r.columns = true
+			if err := r.csv.Write(row.reportColumns()); err != nil {
+				return err
+			}
+		}
+		return r.csv.Write(row.reportValues(csvNumber))
+	}
+	return nil
+}
+
+// Flush prints what is buffered, starting a new table or CSV header for the
+// rows written after
+func (r *ReportWriter) Flush() error {
+	r.columns = false
+
+	switch r.format {
+	case outputTable:
+		return r.table.Flush()
+	case outputCSV:
+		r.csv.Flush()
+		return r.csv.Error()
+	}
+	return nil
+}
+
+func (bwup BandwidthUsagePeriod) reportColumns() []string {
+	return []string{"NETWORK", "MEMBER", "NAME", "FROM", "TO", "UP (GB)", "DOWN (GB)", "TOTAL (GB)", "STATUS", "ERROR"}
+}
+
+func (bwup BandwidthUsagePeriod) reportValues(number func(*float64) string) []string {
+	return []string{
+		bwup.Network,
+		bwup.MemberID,
+		bwup.Name,
+		bwup.From.UTC().Format(time.RFC3339),
+		bwup.To.UTC().Format(time.RFC3339),
+		number(bwup.Up),
+		number(bwup.Down),
+		number(bwup.Total),
+		bwup.Status,
+		bwup.Error,
+	}
+}
+
+func (a UsageAudit) reportColumns() []string {
+	return []string{"NETWORK", "REFERENCE", "FROM", "TO", "MEMBERS", "MEMBER TOTAL (GB)", "EXIT TOTAL (GB)", "UNATTRIBUTED (GB)", "UNATTRIBUTED (%)", "FLAGGED"}
+}
+
+func (a UsageAudit) reportValues(number func(*float64) string) []string {
+	return []string{
+		a.Network,
+		a.Reference,
+		a.From.UTC().Format(time.RFC3339),
+		a.To.UTC().Format(time.RFC3339),
+		strconv.Itoa(a.Members),
+		number(&a.MemberTotal),
+		number(&a.ExitTotal),
+		number(&a.Unattributed),
+		number(&a.UnattributedPercent),
+		strconv.FormatBool(a.Flagged),
+	}
+}
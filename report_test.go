@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestUsageReportGolden(t *testing.T) {
+	server := newGraylogFixtureServer(t)
+	defer server.Close()
+
+	settings := testQuerySettings(queryModePhrase)
+	settings.Network = "casa"
+	settings.GraylogURL = server.URL + "/"
+	settings.MaxBytesPerMessage = 10000000000
+	settings.To = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	settings.Duration = 24 * time.Hour
+	settings.From = settings.To.Add(-settings.Duration)
+
+	source := GraylogSource{settings: settings}
+
+	var output bytes.Buffer
+	for _, member := range fixtureMembers(t) {
+		if err := printJSON(&output, collectMember(settings, source, member)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkGolden(t, "usage.jsonl", output.Bytes())
+}
+
+func TestAuditReportGolden(t *testing.T) {
+	settings := Settings{
+		Network:        "casa",
+		From:           time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+		To:             time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+		AuditThreshold: 10,
+	}
+
+	var output bytes.Buffer
+	for _, audit := range []UsageAudit{
+		newUsageAudit(settings, "snmp", memberUsageSum{Members: 3, Total: 13.75}, 14.5),
+		newUsageAudit(settings, statSourceGraylog, memberUsageSum{Members: 3, Total: 13.75}, 20),
+	} {
+		audit.AuditedAt = settings.To
+		if err := printJSON(&output, audit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkGolden(t, "audit.jsonl", output.Bytes())
+}
+
+func TestNameMappingReportGolden(t *testing.T) {
+	index := newNameIndex()
+	for _, member := range fixtureMembers(t) {
+		index.add(member.Fields.Name, member.ID)
+	}
+
+	var output bytes.Buffer
+	for _, name := range []string{"Alice Example", "bob example", "Dave"} {
+		mapping := NameMapping{Network: "casa", Name: name, Documents: 30}
+		if memberID, problem := index.match(name); memberID != "" {
+			mapping.MemberID, mapping.MatchedBy = memberID, "airtable"
+		} else {
+			mapping.Problem = problem
+		}
+		if err := printJSON(&output, mapping); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkGolden(t, "name-mappings.jsonl", output.Bytes())
+}
+
+func TestReportWriterFormats(t *testing.T) {
+	server := newGraylogFixtureServer(t)
+	defer server.Close()
+
+	settings := testQuerySettings(queryModePhrase)
+	settings.Network = "casa"
+	settings.GraylogURL = server.URL + "/"
+	settings.To = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	settings.Duration = 24 * time.Hour
+	settings.From = settings.To.Add(-settings.Duration)
+
+	periods := []BandwidthUsagePeriod{}
+	for _, member := range fixtureMembers(t) {
+		periods = append(periods, collectMember(settings, GraylogSource{settings: settings}, member))
+	}
+
+	for _, format := range []string{outputTable, outputCSV, outputQuiet} {
+		var output bytes.Buffer
+		report, err := newReportWriter(&output, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bwup := range periods {
+			if err := report.Write(bwup); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := report.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		checkGolden(t, "usage."+format, output.Bytes())
+	}
+
+	if _, err := newReportWriter(&bytes.Buffer{}, "yaml"); err == nil {
+		t.Error("an unknown output should fail")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// s3Object is an object to write, named like s3://bucket/key
+type s3Object struct {
+	Bucket string
+	Key    string
+}
+
+// parseS3URL reads an s3://bucket/key URL
+func parseS3URL(value string) (s3Object, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return s3Object{}, fmt.Errorf("expected an S3 object like s3://bucket/key, got %q", value)
+	}
+	return s3Object{Bucket: u.Host, Key: strings.TrimPrefix(u.Path, "/")}, nil
+}
+
+// awsURIEncode encodes a path segment the way signature version 4 expects,
+// everything but the unreserved characters
+func awsURIEncode(segment string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(segment) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsSigningKey derives the key a day's requests to a service are signed
+// with from the secret access key
+func awsSigningKey(secret string, day string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// putS3Object writes an object with a signature version 4 request, to AWS
+// or, with S3_ENDPOINT, to S3 compatible storage addressed by path
+func putS3Object(settings Settings, object s3Object, contents []byte, contentType string) error {
+	keyPath := []string{}
+	for _, segment := range strings.Split(object.Key, "/") {
+		keyPath = append(keyPath, awsURIEncode(segment))
+	}
+
+	endpoint := "https://" + object.Bucket + ".s3." + settings.AWSRegion + ".amazonaws.com"
+	path := "/" + strings.Join(keyPath, "/")
+	if settings.S3Endpoint != "" {
+		endpoint = strings.TrimSuffix(settings.S3Endpoint, "/")
+		path = "/" + awsURIEncode(object.Bucket) + path
+	}
+
+	request, err := http.NewRequest(http.MethodPut, endpoint+path, bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	day := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	payloadHash := sha256.Sum256(contents)
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	request.Header.Set("X-Amz-Date", stamp)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		path,
+		"",
+		"content-type:" + contentType,
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:" + hex.EncodeToString(payloadHash[:]),
+		"x-amz-date:" + stamp,
+		"",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + settings.AWSRegion + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(settings.AWSSecretAccessKey, day, settings.AWSRegion, "s3"), stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", settings.AWSAccessKeyID, scope, signedHeaders, signature))
+
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("writing s3://%s/%s: %s %s", object.Bucket, object.Key, response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
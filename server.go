@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxIngestBodySize bounds the size of a single push
+const maxIngestBodySize = 10 << 20
+
+// Tenant is a network served by the server, with its own settings, tokens,
+// stores and members
+type Tenant struct {
+	settings Settings
+	tokens   []APIToken
+	usage    *mongo.Collection
+	store    UsageStore
+	members  *MemberCache
+	results  *ResultCache
+	// reads is the usage collection on the read database, for API reads
+	reads *mongo.Collection
+	// events streams usage and runs as they are saved
+	events *EventStream
+}
+
+func newTenant(settings Settings) (*Tenant, error) {
+	// Pushed samples are retried until Mongo takes them, not spilled or
+	// journaled
+	settings.MongoSpillFile = ""
+	settings.JournalFile = ""
+
+	tokens, err := parseAPITokens(settings.APITokens)
+	if err != nil {
+		return nil, err
+	}
+
+	bwupCollection, err := getBWUPCollection(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newUsageStore(settings, bwupCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	reads, err := getReadBWUPCollection(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tenant{
+		settings: settings,
+		tokens:   tokens,
+		usage:    bwupCollection,
+		reads:    reads,
+		store:    store,
+		members:  newMemberCache(settings),
+		results:  newResultCache(settings.ResultCacheTTL),
+		events:   newEventStream(settings.Network, bwupCollection, bwupCollection.Database().Collection(settings.MongoMetricsCollection)),
+	}, nil
+}
+
+// Server is the long running HTTP side of the collector. settings are the
+// process wide settings, each tenant has its own
+type Server struct {
+	settings Settings
+	tenants  map[string]*Tenant
+	dedup    *SampleDeduplicator
+	ingest   chan []UsageSample
+	// runs are the daemon's scheduler runs shown on the dashboard, if any
+	runs *mongo.Collection
+}
+
+func newServer(settings Settings, tenants map[string]*Tenant, dedup *SampleDeduplicator) *Server {
+	return &Server{
+		settings: settings,
+		tenants:  tenants,
+		dedup:    dedup,
+		ingest:   make(chan []UsageSample, settings.IngestBufferSize),
+	}
+}
+
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/ingest", s.handleIngest)
+	mux.HandleFunc("/api/v1/usage", s.handleUsage)
+	mux.HandleFunc("/api/v1/totals", s.handleTotals)
+	mux.HandleFunc("/api/v1/forecast", s.handleForecast)
+	mux.HandleFunc("/api/v1/self", s.handleSelf)
+	mux.HandleFunc("/api/v1/self/statement", s.handleSelfStatement)
+	mux.HandleFunc("/api/v1/summary", s.handleSummary)
+	mux.HandleFunc("/api/v1/groups", s.handleGroups)
+	mux.HandleFunc("/api/v1/statement", s.handleStatement)
+	mux.HandleFunc("/api/v1/annotations", s.handleAnnotations)
+	mux.HandleFunc("/api/v1/pauses", s.handlePauses)
+	mux.HandleFunc("/api/v1/balances", s.handleBalances)
+	mux.HandleFunc("/api/v1/lookup", s.handleLookup)
+	mux.HandleFunc("/api/v1/events", s.handleEvents)
+	mux.HandleFunc("/feed.atom", s.handlePublicFeed)
+	mux.HandleFunc("/", s.handleDashboard)
+	return mux
+}
+
+// tenant returns the tenant for a network, the default one if it is empty
+func (s *Server) tenant(network string) (*Tenant, bool) {
+	if network == "" {
+		network = s.settings.Network
+	}
+	tenant, ok := s.tenants[network]
+	return tenant, ok
+}
+
+// authorize finds the network's tenant and checks the request carries one
+// of its tokens with at least the required role, writing the error response
+// if not. Tokens are scoped by listing them in a network's API_TOKENS
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, network string, role string) (*Tenant, APIToken, bool) {
+	// Unknown networks get the same answer as bad tokens, so tokens can't be
+	// used to discover which networks are served
+	tenant, ok := s.tenant(network)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "missing or invalid token")
+		return nil, APIToken{}, false
+	}
+
+	token, ok := authenticate(r, tenant.tokens)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "missing or invalid token")
+		return nil, APIToken{}, false
+	}
+
+	if !token.Allows(role) {
+		writeJSONError(w, http.StatusForbidden, "the "+token.Role+" role can't do this")
+		return nil, APIToken{}, false
+	}
+
+	return tenant, token, true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// handleIngest accepts samples pushed by agents. They are queued for the
+// writer, and the push is refused while the queue is full so the agent keeps
+// them and retries
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "ingestion requires POST")
+		return
+	}
+
+	var request IngestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngestBodySize)).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "malformed body: "+err.Error())
+		return
+	}
+
+	tenant, _, ok := s.authorize(w, r, request.Network, roleOperator)
+	if !ok {
+		return
+	}
+
+	for i, sample := range request.Samples {
+		if sample.WGKey == "" || !sample.To.After(sample.From) {
+			writeJSONError(w, http.StatusBadRequest, "samples need a WG key and a window ending after it starts")
+			return
+		}
+		request.Samples[i].Network = tenant.settings.Network
+	}
+
+	select {
+	case s.ingest <- request.Samples:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeJSONError(w, http.StatusServiceUnavailable, "ingestion buffer full, retry later")
+	}
+}
+
+// handleUsage returns the stored usage periods of a network. Viewers can
+// narrow it to one member with the member parameter, member tokens only ever
+// see their own member's usage
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "usage requires GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), roleMember)
+	if !ok {
+		return
+	}
+
+	memberID := query.Get("member")
+	if !token.Allows(roleViewer) {
+		memberID = token.MemberID
+	}
+
+	tenant.writeUsage(w, r, memberID, defaultLanguage)
+}
+
+// handleSelf returns a member's usage to the holder of a signed link, so
+// members can check their consumption from an email without an account
+func (s *Server) handleSelf(w http.ResponseWriter, r *http.Request) {
+	tenant, link, language, ok := s.selfLink(w, r)
+	if !ok {
+		return
+	}
+
+	tenant.writeUsage(w, r, link.MemberID, language)
+}
+
+// selfLink verifies the signed link of a self-service request, writing the
+// error response if it isn't valid. Errors are in the lang parameter's
+// language, or the browser's, and once the link is verified in the member's
+// own
+func (s *Server) selfLink(w http.ResponseWriter, r *http.Request) (*Tenant, memberLink, string, bool) {
+	language := normalizeLanguage(r.URL.Query().Get("lang"))
+	if language == "" {
+		language = acceptedLanguage(r.Header.Get("Accept-Language"))
+	}
+	if language == "" {
+		language = defaultLanguage
+	}
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, translate(language, "usage.method"))
+		return nil, memberLink{}, "", false
+	}
+
+	link, payload, signature, err := parseMemberLink(r.URL.Query().Get("token"))
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, linkErrorMessage(err, language))
+		return nil, memberLink{}, "", false
+	}
+
+	tenant, ok := s.tenants[link.Network]
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, translate(language, "link.invalid"))
+		return nil, memberLink{}, "", false
+	}
+
+	if err := verifyMemberLink(tenant.settings.LinkSecret, link, payload, signature, time.Now()); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, linkErrorMessage(err, language))
+		return nil, memberLink{}, "", false
+	}
+
+	if r.URL.Query().Get("lang") == "" {
+		if member, ok, _ := tenant.members.ByID(link.MemberID); ok {
+			language = memberLanguage(tenant.settings, member)
+		}
+	}
+
+	return tenant, link, language, true
+}
+
+// linkErrorMessage tells members why their link can't be used
+func linkErrorMessage(err error, language string) string {
+	if linkErr, ok := err.(LinkError); ok {
+		return linkErr.Message(language)
+	}
+	return err.Error()
+}
+
+// writeUsage responds with the usage periods between the from and to query
+// parameters, by default over the last 30 days, of one member or of every
+// member if memberID is empty. Errors are given in the language
+func (t *Tenant) writeUsage(w http.ResponseWriter, r *http.Request, memberID string, language string) {
+	query := r.URL.Query()
+
+	to := time.Now()
+	from := to.Add(-30 * 24 * time.Hour)
+	for param, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if query.Get(param) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, translate(language, "usage.invalid_param", param, err))
+			return
+		}
+		*value = parsed
+	}
+
+	name := ""
+	if memberID != "" {
+		// Usage stored before member IDs can only be found by name
+		member, ok, err := t.members.ByID(memberID)
+		if err != nil {
+			log.Printf("Error refreshing members: %v", err)
+		}
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, translate(language, "usage.unknown_member", memberID))
+			return
+		}
+		name = strings.TrimSpace(member.Fields.Name)
+	}
+
+	periods, err := getUsagePeriods(t.reads, t.settings.Network, memberID, name, from, to)
+	if err != nil {
+		log.Printf("Error reading usage: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, translate(language, "usage.read_error"))
+		return
+	}
+
+	writeJSON(w, periods)
+}
+
+// sampleToUsagePeriod converts a pushed sample into a usage period for the
+// member owning its key, with their consent applied. It returns false if
+// nothing of the sample may be stored
+func (t *Tenant) sampleToUsagePeriod(sample UsageSample) (BandwidthUsagePeriod, bool) {
+	name := sample.WGKey
+	memberID := ""
+
+	member, ok, err := t.members.ByWGKey(sample.WGKey)
+	if err != nil {
+		log.Printf("Error refreshing members: %v", err)
+	}
+	if ok {
+		name = strings.TrimSpace(member.Fields.Name)
+		memberID = member.ID
+	} else {
+		log.Printf("Pushed sample from %s for unregistered key %s", sample.Agent, sample.WGKey)
+	}
+
+	up := bytesToGb(float64(sample.Up))
+	down := bytesToGb(float64(sample.Down))
+	total := up + down
+
+	bwup := BandwidthUsagePeriod{
+		Network:   t.settings.Network,
+		MemberID:  memberID,
+		Name:      name,
+		Interface: sample.Interface,
+		From:      sample.From,
+		To:        sample.To,
+		Duration:  sample.To.Sub(sample.From),
+		Up:        &up,
+		Down:      &down,
+		Total:     &total,
+		Status:    usageStatusOK,
+	}
+	if !ok {
+		return bwup, true
+	}
+
+	bwup, keep := applyConsent(t.settings, bwup, member)
+	// Each interface of a peer has its own counters, so their periods are
+	// kept apart under the pseudonym too
+	bwup.Interface = sample.Interface
+	return bwup, keep
+}
+
+// retry keeps calling fn until it succeeds, pausing between attempts
+func (s *Server) retry(description string, fn func() error) {
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		log.Printf("Error %s, retrying: %v", description, err)
+		time.Sleep(s.settings.IngestRetryInterval)
+	}
+}
+
+// writeSamples persists queued samples until the queue is closed. Samples
+// which fail to save are retried after a pause rather than dropped, unless
+// the duplicate policy refuses them, and samples which were already ingested
+// are skipped
+func (s *Server) writeSamples(done chan struct{}) {
+	defer close(done)
+
+	for samples := range s.ingest {
+		for _, sample := range samples {
+			var resolved UsageSample
+			var fresh bool
+			s.retry("checking for duplicate samples", func() (err error) {
+				resolved, fresh, err = s.dedup.Resolve(sample)
+				return err
+			})
+			if !fresh {
+				continue
+			}
+
+			tenant := s.tenants[resolved.Network]
+			bwup, keep := tenant.sampleToUsagePeriod(resolved)
+			s.retry("saving pushed sample", func() error {
+				if !keep {
+					return nil
+				}
+				err := tenant.store.Insert(bwup)
+				if _, ok := err.(DuplicateError); ok {
+					// DUPLICATE_POLICY is error, retrying would stall ingestion
+					log.Printf("Dropping pushed sample: %v", err)
+					return nil
+				}
+				return err
+			})
+			tenant.results.Invalidate()
+			s.retry("recording ingested sample", func() error {
+				return s.dedup.Commit(resolved)
+			})
+		}
+	}
+}
+
+// serveCommand runs the collector's HTTP server until stopped
+func serveCommand(args []string) {
+	settings := loadProcessSettings()
+
+	if err := loadMessageCatalogs(settings.MessageCatalogs); err != nil {
+		fatal(err)
+	}
+
+	tenants := map[string]*Tenant{}
+	for _, networkSettings := range loadAllNetworkSettings() {
+		if len(networkSettings.APITokens) == 0 {
+			fatal(fmt.Sprintf("API_TOKENS must list at least one token for network %q", networkSettings.Network))
+		}
+
+		tenant, err := newTenant(networkSettings)
+		if err != nil {
+			fatal(err)
+		}
+		tenants[networkSettings.Network] = tenant
+	}
+
+	// Ingestion bookkeeping is shared by every network, in the database
+	// configured in the environment
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	dedup, err := newSampleDeduplicator(settings, db)
+	if err != nil {
+		fatal(err)
+	}
+
+	server := newServer(settings, tenants, dedup)
+	server.runs = db.Collection(settings.MongoSchedulerCollection)
+
+	written := make(chan struct{})
+	go server.writeSamples(written)
+
+	httpServer := &http.Server{
+		Addr:    settings.ServeListen,
+		Handler: server.routes(),
+	}
+	// Event streams don't end on their own, so Shutdown would wait for them
+	httpServer.RegisterOnShutdown(func() {
+		for _, tenant := range tenants {
+			tenant.events.Close()
+		}
+	})
+
+	go func() {
+		log.Printf("Listening on %s", settings.ServeListen)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
+
+	// Persist whatever was accepted before exiting
+	close(server.ingest)
+	<-written
+}
@@ -0,0 +1,902 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Settings struct {
+	Network  string
+	From     time.Time
+	To       time.Time
+	Duration time.Duration
+	// Chaos is set by the hidden -chaos- flags, not the environment
+	Chaos ChaosSettings
+	// Replay is the directory of recorded responses set by -replay, and
+	// Record the one responses are recorded to set by -record
+	Replay string
+	Record string
+	// Metrics are those of the collection run in progress, if any
+	Metrics *RunMetrics
+
+	StatSource        string
+	QueryChunk        time.Duration
+	AirtableAPIKey    string
+	AirtableBaseID    string
+	AirtableTableName string
+	MembersCSV        string
+	MemberIdentity    string
+	// MemberFields are the columns of the base holding the member fields
+	// it names differently, see memberFieldKeys
+	MemberFields      map[string]string
+	GraylogURL        string
+	GraylogUser       string
+	GraylogPass       string
+	GraylogInterfaces []string
+
+	// AirtableOAuthClientID, if set, reads the members with the OAuth grant
+	// saved in AirtableTokenFile rather than AirtableAPIKey
+	AirtableOAuthClientID     string
+	AirtableOAuthClientSecret string
+	AirtableOAuthRedirectURL  string
+	AirtableTokenFile         string
+
+	// MemberOverridesFile maps member record IDs to their MemberOverride
+	MemberOverridesFile string
+
+	GraylogQueryMode    string
+	GraylogUpPattern    string
+	GraylogDownPattern  string
+	GraylogPatternField string
+	GraylogUpQuery      string
+	GraylogDownQuery    string
+	GraylogUpSearch     string
+	GraylogDownSearch   string
+	GraylogKeyField     string
+	GraylogUpField      string
+	GraylogDownField    string
+	GraylogNonFinite    string
+	// GraylogStream is the stream usage is queried in, all of them if empty
+	GraylogStream string
+
+	GraylogQueryStrategy   string
+	GraylogTermsMinMembers int
+
+	LokiURL       string
+	LokiUser      string
+	LokiPass      string
+	LokiOrgID     string
+	LokiUpQuery   string
+	LokiDownQuery string
+
+	ClickHouseURL        string
+	ClickHouseUser       string
+	ClickHousePass       string
+	ClickHouseDatabase   string
+	ClickHouseTable      string
+	ClickHouseFlowsQuery string
+
+	SQLitePath string
+
+	PostgresURL         string
+	PostgresAutoMigrate bool
+
+	BigQueryURL         string
+	BigQueryProject     string
+	BigQueryDataset     string
+	BigQueryTable       string
+	BigQueryCredentials string
+
+	NetflowListen              string
+	NetflowCollection          string
+	NetflowHistogramCollection string
+	NetflowHourlyMonths        int
+	NetflowPeerPrefixes        []string
+	NetflowSamplingRate        uint64
+	NetflowFlushInterval       time.Duration
+
+	SNMPTargets      []string
+	SNMPCommunity    string
+	SNMPPollInterval time.Duration
+	SNMPCollection   string
+
+	TransitCommitments []string
+
+	PeeringPoints       []string
+	SettlementTolerance float64
+
+	AuditThreshold     float64
+	MaxBytesPerMessage float64
+
+	AnomalyMethod    string
+	AnomalyThreshold float64
+	AnomalyHistory   int
+
+	AbuseUploadRatio      float64
+	AbusePlanMbps         float64
+	AbuseSaturation       float64
+	AbuseSaturatedHours   time.Duration
+	AbuseActiveHours      float64
+	AbuseDNSPerHour       float64
+	AbuseConnectionsPerGB float64
+
+	Schedule                 string
+	ScheduleTimezone         string
+	ScheduleWindow           time.Duration
+	ScheduleCatchUp          int
+	ScheduleJitter           time.Duration
+	ScheduleBlackouts        []string
+	PruneSchedule            string
+	DownsampleSchedule       string
+	CommitmentsSchedule      string
+	MongoSchedulerCollection string
+
+	BackfillPeriod      time.Duration
+	BackfillConcurrency int
+	BackfillRate        float64
+
+	PreflightMinMessages       int
+	PreflightAction            string
+	GraylogCanaryQuery         string
+	GraylogCanaryStream        string
+	GraylogDNSQuery            string
+	GraylogDNSIdentity         string
+	GraylogDNSSchedule         string
+	GraylogConnectionsQuery    string
+	GraylogConnectionsIdentity string
+	GraylogConnectionsSchedule string
+
+	HookPreRun    string
+	HookPerRecord string
+	HookPostRun   string
+	HookTimeout   time.Duration
+
+	ServeListen         string
+	APITokens           []string
+	IngestBufferSize    int
+	IngestRetryInterval time.Duration
+	MemberCacheTTL      time.Duration
+	ResultCacheTTL      time.Duration
+	IngestDedupTTL      time.Duration
+
+	IngestSamplesCollection    string
+	IngestWatermarksCollection string
+
+	LinkSecret   string
+	LinkBaseURL  string
+	LinkValidity time.Duration
+
+	AgentName       string
+	AgentInterfaces []string
+	AgentInterval   time.Duration
+	AgentPushURL    string
+	AgentToken      string
+
+	MongoDatabase   string
+	MongoCollection string
+	MongoURL        string
+
+	MongoReadURL        string
+	MongoReadPreference string
+
+	// MongoDualWriteURL is a cluster being migrated to, usage being written
+	// to it too. MongoCutover swaps it with MongoURL, moving everything else
+	// to it while usage is still written to the old one, once copy-mongo
+	// -cutover checked the clusters match
+	MongoDualWriteURL string
+	MongoCutover      bool
+
+	UsageStores     []string
+	DuplicatePolicy string
+	MongoSpillFile  string
+	JournalFile     string
+	PipelineFile    string
+	WatchSinks      []string
+	WebhookURL      string
+
+	EventBus         string
+	EventBusURL      string
+	EventUsageTopic  string
+	EventAlertsTopic string
+
+	CRMProvider string
+	CRMURL      string
+	CRMDatabase string
+	CRMUser     string
+	CRMToken    string
+
+	TwilioURL           string
+	TwilioAccountSID    string
+	TwilioAuthToken     string
+	TwilioFrom          string
+	SMSSummaryTemplate  string
+	SMSWarningTemplate  string
+	SMSWarningThreshold float64
+
+	SLAUptimeTarget float64
+
+	// BalanceLowGB is the balance left under which prepaid members are
+	// alerted about
+	BalanceLowGB float64
+
+	DefaultLanguage string
+	MessageCatalogs string
+
+	RetentionPeriod       time.Duration
+	MongoRollupCollection string
+	MongoTotalsCollection string
+
+	MongoMembersCollection       string
+	MongoMemberChangesCollection string
+	MongoExitUsageCollection     string
+	MongoAuditCollection         string
+	MongoAliasCollection         string
+	MongoAnnotationsCollection   string
+	MongoMutationsCollection     string
+	MongoCorrectionsCollection   string
+	MongoWatchCollection         string
+	MongoMetricsCollection       string
+	MongoMemberMetricsCollection string
+	MongoPausesCollection        string
+	MongoBalancesCollection      string
+
+	SigningKey string
+
+	// PIIKey is the base64 32 byte key member names, WireGuard keys and
+	// mesh addresses are stored encrypted with. PIIKeyCommand prints it instead, fetching it from a KMS
+	PIIKey        string
+	PIIKeyCommand string
+
+	// ConsentOptOut is what is stored of the usage and metrics of members
+	// who opted out of detailed tracking: pseudonymize or exclude. Either
+	// way the member cache and changes only keep their ID. PseudonymSecret
+	// keys their pseudonyms, without which their usage is excluded
+	ConsentOptOut   string
+	PseudonymSecret string
+
+	// Aggregates published with -public leave out groups of fewer than
+	// PublicMinMembers, are rounded to PublicRoundGB and, if
+	// PublicNoiseEpsilon is set, get noise for a member's usage of up to
+	// PublicNoiseSensitivityGB
+	PublicNoiseEpsilon       float64
+	PublicNoiseSensitivityGB float64
+	PublicRoundGB            float64
+	PublicMinMembers         int
+
+	// PublicFeed are where each run publishes the network's public stats:
+	// files, s3://bucket/key objects or http(s) URLs. S3 objects are written
+	// with the AWS keys, to S3Endpoint for S3 compatible storage
+	PublicFeed         []string
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSRegion          string
+	S3Endpoint         string
+
+	// PublicStats records the public stats of each run, for the Atom feed
+	// serve mode serves. AtomFeed are where each run writes the feed of the
+	// latest AtomFeedWeeks weeks, like PublicFeed
+	PublicStats                bool
+	AtomFeed                   []string
+	AtomFeedWeeks              int
+	MongoPublicStatsCollection string
+}
+
+// redacted replaces secrets in settings which are printed
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the settings safe to print, without passwords,
+// keys or tokens
+func (s Settings) Redacted() Settings {
+	for _, secret := range []*string{&s.AirtableAPIKey, &s.AirtableOAuthClientSecret, &s.GraylogPass, &s.LokiPass, &s.ClickHousePass, &s.LinkSecret, &s.AgentToken, &s.CRMToken, &s.TwilioAuthToken, &s.SigningKey, &s.PIIKey, &s.PseudonymSecret, &s.AWSSecretAccessKey} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+
+	tokens := make([]string, len(s.APITokens))
+	for i := range tokens {
+		tokens[i] = redacted
+	}
+	s.APITokens = tokens
+
+	s.MongoURL = redactURL(s.MongoURL)
+	s.MongoReadURL = redactURL(s.MongoReadURL)
+	s.MongoDualWriteURL = redactURL(s.MongoDualWriteURL)
+	s.PostgresURL = redactURL(s.PostgresURL)
+	s.EventBusURL = redactURL(s.EventBusURL)
+
+	return s
+}
+
+// redactURL hides the password of a URL. A user alone can be a token, so is
+// hidden too
+func redactURL(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	} else {
+		u.User = url.User(redacted)
+	}
+	return u.String()
+}
+
+// defaultNetwork names the network when no NETWORK is configured
+const defaultNetwork = "default"
+
+// settingsEnv looks settings up in a network's overrides before falling back
+// to the environment
+type settingsEnv map[string]string
+
+// get returns the value of the setting key, or "" if it is unset
+func (e settingsEnv) get(key string) string {
+	if v, ok := settingFlags[key]; ok {
+		return v
+	}
+	if v, ok := e[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// getDefault returns the value of the setting key, or def if it is unset
+func (e settingsEnv) getDefault(key string, def string) string {
+	if v := e.get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// settingFlags are the settings given as flags before the command, by key.
+// They take precedence over the environment, .env and NETWORKS_FILE, so a
+// one-off run can point somewhere else without editing them
+var settingFlags = map[string]string{}
+
+// settingFlagName is the flag of a setting, its key in lower case with
+// dashes, like -mongo-url for MONGO_URL
+func settingFlagName(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+// settingKeys are the keys of every setting, as readSettings reads them
+func settingKeys() []string {
+	env := &settingsReader{settingsEnv: settingsEnv{}}
+	readSettingsWith("", env)
+
+	keys := []string{"NETWORK", "NETWORKS_FILE"}
+	for _, field := range memberFieldKeys {
+		keys = append(keys, field.key)
+	}
+	keys = append(keys, env.keys...)
+
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// secretSettingKeys are the settings which can't be given as flags, as
+// command lines show in ps and are recorded as the actor of mutations
+var secretSettingKeys = map[string]bool{
+	"AIRTABLE_API_KEY":             true,
+	"AIRTABLE_OAUTH_CLIENT_SECRET": true,
+	"GRAYLOG_PASS":                 true,
+	"LOKI_PASS":                    true,
+	"CLICKHOUSE_PASS":              true,
+	"LINK_SECRET":                  true,
+	"AGENT_TOKEN":                  true,
+	"API_TOKENS":                   true,
+	"CRM_TOKEN":                    true,
+	"TWILIO_AUTH_TOKEN":            true,
+	"SIGNING_KEY":                  true,
+	"PII_KEY":                      true,
+	"PSEUDONYM_SECRET":             true,
+	"AWS_SECRET_ACCESS_KEY":        true,
+}
+
+// parseSettingFlags reads the setting flags at the start of args, like
+// -mongo-url=mongodb://localhost or -network casa, into settingFlags. It
+// stops at the first argument which isn't one, returning it and the rest.
+// Secrets are refused, they go in the environment or .env
+func parseSettingFlags(args []string) ([]string, error) {
+	keys := map[string]string{}
+	for _, key := range settingKeys() {
+		keys[settingFlagName(key)] = key
+	}
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name := strings.TrimLeft(args[0], "-")
+		value, hasValue := "", false
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value, hasValue = name[:i], name[i+1:], true
+		}
+
+		key, ok := keys[name]
+		if !ok {
+			break
+		}
+		if secretSettingKeys[key] {
+			return nil, fmt.Errorf("-%s is a secret, set %s in the environment or .env instead, as command lines show in ps and in the mutations recorded", name, key)
+		}
+		if !hasValue {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("flag -%s needs a value, like -%s=value", name, name)
+			}
+			value = args[1]
+			args = args[1:]
+		}
+		settingFlags[key] = value
+		args = args[1:]
+	}
+	return args, nil
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// settingsReader reads typed settings from a settingsEnv, noting each
+// malformed value and carrying on with its default, so every problem can be
+// reported at once. The keys read are kept, for settingKeys
+type settingsReader struct {
+	settingsEnv
+	problems []string
+	keys     []string
+}
+
+func (e *settingsReader) get(key string) string {
+	e.keys = append(e.keys, key)
+	return e.settingsEnv.get(key)
+}
+
+func (e *settingsReader) getDefault(key string, def string) string {
+	if v := e.get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// invalid notes the value of the setting key is malformed
+func (e *settingsReader) invalid(key string, expected string) {
+	e.problems = append(e.problems, fmt.Sprintf("%s must be %s, got %q", key, expected, e.get(key)))
+}
+
+// getDuration parses the setting key as a duration, or returns def if it is unset
+func (e *settingsReader) getDuration(key string, def time.Duration) time.Duration {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.invalid(key, "formatted like 1m")
+		return def
+	}
+	return d
+}
+
+// getInt parses the setting key as an integer, or returns def if it is unset
+func (e *settingsReader) getInt(key string, def int) int {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		e.invalid(key, "a whole number")
+		return def
+	}
+	return i
+}
+
+// getFloat parses the setting key as a number, or returns def if it is unset
+func (e *settingsReader) getFloat(key string, def float64) float64 {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.invalid(key, "a number")
+		return def
+	}
+	return f
+}
+
+// getBool parses the setting key as true or false, or returns def if it is
+// unset
+func (e *settingsReader) getBool(key string, def bool) bool {
+	v := e.get(key)
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.invalid(key, "true or false")
+		return def
+	}
+	return b
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "agent"
+	}
+	return name
+}
+
+// loadNetworkOverrides reads NETWORKS_FILE, a JSON object mapping the name of
+// each network served to the settings it overrides, keyed like the
+// environment
+func loadNetworkOverrides() map[string]map[string]string {
+	networks := map[string]map[string]string{}
+
+	path := settingsEnv{}.get("NETWORKS_FILE")
+	if path == "" {
+		return networks
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	if err := json.Unmarshal(contents, &networks); err != nil {
+		fatal(fmt.Sprintf("NETWORKS_FILE is not valid: %v", err))
+	}
+
+	return networks
+}
+
+// loadAllNetworkSettings returns the settings of every network served, or of
+// just the one named by NETWORK if it is set
+func loadAllNetworkSettings() []Settings {
+	if (settingsEnv{}).get("NETWORK") != "" {
+		return []Settings{loadSettings()}
+	}
+
+	networks := loadNetworkOverrides()
+	if len(networks) == 0 {
+		return []Settings{loadSettings()}
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	all := make([]Settings, 0, len(names))
+	for _, name := range names {
+		all = append(all, loadNetworkSettings(name))
+	}
+	return all
+}
+
+// loadSettings reads the settings of the network named by NETWORK
+func loadSettings() Settings {
+	return loadNetworkSettings(settingsEnv{}.getDefault("NETWORK", defaultNetwork))
+}
+
+// loadProcessSettings reads the settings shared by every network served from
+// the environment alone, for the commands working across networks. They
+// belong to no network, so don't need one to be in NETWORKS_FILE
+func loadProcessSettings() Settings {
+	settings, problems := readSettings("", settingsEnv{})
+	checkSettings(settings, problems)
+	if err := usePIIKey(settings); err != nil {
+		fatal(err)
+	}
+	return settings
+}
+
+// loadNetworkSettings reads the settings of a network from its overrides and
+// the environment. The collection window is left for the caller to fill in
+func loadNetworkSettings(network string) Settings {
+	networks := loadNetworkOverrides()
+	overrides, ok := networks[network]
+	if !ok && len(networks) > 0 {
+		fatal(fmt.Sprintf("network %q is not in NETWORKS_FILE", network))
+	}
+
+	settings, problems := readSettings(network, settingsEnv(overrides))
+
+	// Tokens give access to a tenant, so each network must have its own
+	// rather than sharing those of the environment
+	if len(networks) > 0 {
+		settings.APITokens = splitList(overrides["API_TOKENS"])
+	}
+
+	checkSettings(settings, problems)
+	if err := usePIIKey(settings); err != nil {
+		fatal(err)
+	}
+	return settings
+}
+
+// readSettings reads the settings of a network, with the problems of the
+// values which couldn't be parsed
+func readSettings(network string, overrides settingsEnv) (Settings, []string) {
+	env := &settingsReader{settingsEnv: overrides}
+	settings := readSettingsWith(network, env)
+
+	// Once cut over the new cluster is the one in use, and the old one is
+	// written to in case of going back
+	if settings.MongoCutover {
+		if settings.MongoDualWriteURL == "" {
+			env.problems = append(env.problems, "MONGO_CUTOVER needs MONGO_DUAL_WRITE_URL, the cluster to cut over to")
+		}
+		settings.MongoURL, settings.MongoDualWriteURL = settings.MongoDualWriteURL, settings.MongoURL
+	}
+	return settings, env.problems
+}
+
+func readSettingsWith(network string, env *settingsReader) Settings {
+	// Keys are logged in a field named after the identity unless told otherwise
+	identity := env.getDefault("MEMBER_IDENTITY", memberIdentityWGKey)
+
+	return Settings{
+		Network: network,
+
+		StatSource:        env.getDefault("STAT_SOURCE", statSourceGraylog),
+		QueryChunk:        env.getDuration("QUERY_CHUNK", 24*time.Hour),
+		AirtableAPIKey:    env.get("AIRTABLE_API_KEY"),
+		AirtableBaseID:    env.get("AIRTABLE_BASE_ID"),
+		AirtableTableName: env.get("AIRTABLE_TABLE_NAME"),
+		MembersCSV:        env.get("MEMBERS_CSV"),
+		MemberIdentity:    identity,
+		MemberFields:      readMemberFields(env.settingsEnv),
+		GraylogURL:        env.get("GRAYLOG_URL"),
+		GraylogUser:       env.get("GRAYLOG_USER"),
+		GraylogPass:       env.get("GRAYLOG_PASS"),
+		GraylogInterfaces: splitList(env.get("GRAYLOG_INTERFACES")),
+
+		AirtableOAuthClientID:     env.get("AIRTABLE_OAUTH_CLIENT_ID"),
+		AirtableOAuthClientSecret: env.get("AIRTABLE_OAUTH_CLIENT_SECRET"),
+		AirtableOAuthRedirectURL:  env.getDefault("AIRTABLE_OAUTH_REDIRECT_URL", "http://localhost:8089/airtable/callback"),
+		AirtableTokenFile:         env.getDefault("AIRTABLE_TOKEN_FILE", "airtable-token.json"),
+
+		MemberOverridesFile: env.get("MEMBER_OVERRIDES_FILE"),
+
+		GraylogQueryMode:    env.getDefault("GRAYLOG_QUERY_MODE", queryModePhrase),
+		GraylogUpPattern:    env.getDefault("GRAYLOG_UP_PATTERN", ".*{key}.*uploaded to exit.*"),
+		GraylogDownPattern:  env.getDefault("GRAYLOG_DOWN_PATTERN", ".*{key}.*downloaded from exit.*"),
+		GraylogPatternField: env.getDefault("GRAYLOG_PATTERN_FIELD", "message"),
+		GraylogUpQuery:      env.getDefault("GRAYLOG_UP_QUERY", `wg_key:"{key}" AND direction:up`),
+		GraylogDownQuery:    env.getDefault("GRAYLOG_DOWN_QUERY", `wg_key:"{key}" AND direction:down`),
+		GraylogUpSearch:     env.get("GRAYLOG_UP_SEARCH"),
+		GraylogDownSearch:   env.get("GRAYLOG_DOWN_SEARCH"),
+		GraylogKeyField:     env.getDefault("GRAYLOG_KEY_FIELD", identityKeyField(identity)),
+		GraylogUpField:      env.getDefault("GRAYLOG_UP_FIELD", "bytes_up"),
+		GraylogDownField:    env.getDefault("GRAYLOG_DOWN_FIELD", "bytes_down"),
+		GraylogNonFinite:    env.getDefault("GRAYLOG_NON_FINITE", nonFiniteNull),
+		GraylogStream:       env.get("GRAYLOG_STREAM"),
+
+		GraylogQueryStrategy:   env.getDefault("GRAYLOG_QUERY_STRATEGY", queryStrategyAuto),
+		GraylogTermsMinMembers: env.getInt("GRAYLOG_TERMS_MIN_MEMBERS", 50),
+
+		LokiURL:       env.get("LOKI_URL"),
+		LokiUser:      env.get("LOKI_USER"),
+		LokiPass:      env.get("LOKI_PASS"),
+		LokiOrgID:     env.get("LOKI_ORG_ID"),
+		LokiUpQuery:   env.getDefault("LOKI_UP_QUERY", `sum by (wg_key) (sum_over_time({job="exit"} | json | wg_key="{key}" | unwrap bytes_up [{range}]))`),
+		LokiDownQuery: env.getDefault("LOKI_DOWN_QUERY", `sum by (wg_key) (sum_over_time({job="exit"} | json | wg_key="{key}" | unwrap bytes_down [{range}]))`),
+
+		ClickHouseURL:        env.get("CLICKHOUSE_URL"),
+		ClickHouseUser:       env.get("CLICKHOUSE_USER"),
+		ClickHousePass:       env.get("CLICKHOUSE_PASS"),
+		ClickHouseDatabase:   env.get("CLICKHOUSE_DATABASE"),
+		ClickHouseTable:      env.getDefault("CLICKHOUSE_TABLE", "usage_periods"),
+		ClickHouseFlowsQuery: env.getDefault("CLICKHOUSE_FLOWS_QUERY", "SELECT sumOrNull(bytes) FROM flows WHERE wg_key = {key:String} AND direction = {direction:String} AND timestamp >= toDateTime({from:UInt32}) AND timestamp < toDateTime({to:UInt32})"),
+
+		SQLitePath: env.get("SQLITE_PATH"),
+
+		PostgresURL:         env.get("POSTGRES_URL"),
+		PostgresAutoMigrate: env.getBool("POSTGRES_AUTO_MIGRATE", true),
+
+		BigQueryURL:         env.getDefault("BIGQUERY_URL", "https://bigquery.googleapis.com/bigquery/v2/"),
+		BigQueryProject:     env.get("BIGQUERY_PROJECT"),
+		BigQueryDataset:     env.get("BIGQUERY_DATASET"),
+		BigQueryTable:       env.getDefault("BIGQUERY_TABLE", "usage_periods"),
+		BigQueryCredentials: env.get("BIGQUERY_CREDENTIALS"),
+
+		NetflowListen:              env.getDefault("NETFLOW_LISTEN", ":2055"),
+		NetflowCollection:          env.getDefault("NETFLOW_COLLECTION", "netflow_counters"),
+		NetflowHistogramCollection: env.getDefault("NETFLOW_HISTOGRAM_COLLECTION", "netflow_histograms"),
+		NetflowHourlyMonths:        env.getInt("NETFLOW_HOURLY_MONTHS", 6),
+		NetflowPeerPrefixes:        splitList(env.getDefault("NETFLOW_PEER_PREFIXES", "fd00::/8")),
+		NetflowSamplingRate:        uint64(env.getInt("NETFLOW_SAMPLING_RATE", 1)),
+		NetflowFlushInterval:       env.getDuration("NETFLOW_FLUSH_INTERVAL", time.Minute),
+
+		SNMPTargets:      splitList(env.get("SNMP_TARGETS")),
+		SNMPCommunity:    env.getDefault("SNMP_COMMUNITY", "public"),
+		SNMPPollInterval: env.getDuration("SNMP_POLL_INTERVAL", 5*time.Minute),
+		SNMPCollection:   env.getDefault("SNMP_COLLECTION", "snmp_samples"),
+
+		TransitCommitments: splitList(env.get("TRANSIT_COMMITMENTS")),
+
+		PeeringPoints:       splitList(env.get("PEERING_POINTS")),
+		SettlementTolerance: env.getFloat("SETTLEMENT_TOLERANCE", 1),
+
+		AuditThreshold:     env.getFloat("AUDIT_THRESHOLD", 10),
+		MaxBytesPerMessage: env.getFloat("MAX_BYTES_PER_MESSAGE", 10000000000),
+
+		AnomalyMethod:    env.get("ANOMALY_METHOD"),
+		AnomalyThreshold: env.getFloat("ANOMALY_THRESHOLD", 3.5),
+		AnomalyHistory:   env.getInt("ANOMALY_HISTORY", 30),
+
+		AbuseUploadRatio:      env.getFloat("ABUSE_UPLOAD_RATIO", 2),
+		AbusePlanMbps:         env.getFloat("ABUSE_PLAN_MBPS", 0),
+		AbuseSaturation:       env.getFloat("ABUSE_SATURATION", 0.9),
+		AbuseSaturatedHours:   env.getDuration("ABUSE_SATURATED_HOURS", 6*time.Hour),
+		AbuseActiveHours:      env.getFloat("ABUSE_ACTIVE_HOURS", 95),
+		AbuseDNSPerHour:       env.getFloat("ABUSE_DNS_PER_HOUR", 3000),
+		AbuseConnectionsPerGB: env.getFloat("ABUSE_CONNECTIONS_PER_GB", 20000),
+
+		Schedule:                 env.getDefault("SCHEDULE", "@hourly"),
+		ScheduleTimezone:         env.getDefault("SCHEDULE_TIMEZONE", "UTC"),
+		ScheduleWindow:           env.getDuration("SCHEDULE_WINDOW", 0),
+		ScheduleCatchUp:          env.getInt("SCHEDULE_CATCH_UP", 24),
+		ScheduleJitter:           env.getDuration("SCHEDULE_JITTER", 0),
+		ScheduleBlackouts:        splitList(env.get("SCHEDULE_BLACKOUTS")),
+		PruneSchedule:            env.get("PRUNE_SCHEDULE"),
+		DownsampleSchedule:       env.get("DOWNSAMPLE_SCHEDULE"),
+		CommitmentsSchedule:      env.get("COMMITMENTS_SCHEDULE"),
+		MongoSchedulerCollection: env.getDefault("MONGO_SCHEDULER_COLLECTION", "scheduler_runs"),
+
+		BackfillPeriod:      env.getDuration("BACKFILL_PERIOD", 24*time.Hour),
+		BackfillConcurrency: env.getInt("BACKFILL_CONCURRENCY", 4),
+		BackfillRate:        env.getFloat("BACKFILL_RATE", 2),
+
+		PreflightMinMessages:       env.getInt("PREFLIGHT_MIN_MESSAGES", 0),
+		PreflightAction:            env.getDefault("PREFLIGHT_ACTION", preflightAbort),
+		GraylogCanaryQuery:         env.getDefault("GRAYLOG_CANARY_QUERY", "*"),
+		GraylogCanaryStream:        env.get("GRAYLOG_CANARY_STREAM"),
+		GraylogDNSQuery:            env.get("GRAYLOG_DNS_QUERY"),
+		GraylogDNSIdentity:         env.getDefault("GRAYLOG_DNS_IDENTITY", memberIdentityMeshIP),
+		GraylogDNSSchedule:         env.get("GRAYLOG_DNS_SCHEDULE"),
+		GraylogConnectionsQuery:    env.get("GRAYLOG_CONNECTIONS_QUERY"),
+		GraylogConnectionsIdentity: env.get("GRAYLOG_CONNECTIONS_IDENTITY"),
+		GraylogConnectionsSchedule: env.get("GRAYLOG_CONNECTIONS_SCHEDULE"),
+
+		HookPreRun:    env.get("HOOK_PRE_RUN"),
+		HookPerRecord: env.get("HOOK_PER_RECORD"),
+		HookPostRun:   env.get("HOOK_POST_RUN"),
+		HookTimeout:   env.getDuration("HOOK_TIMEOUT", 30*time.Second),
+
+		ServeListen:         env.getDefault("SERVE_LISTEN", ":8080"),
+		APITokens:           splitList(env.get("API_TOKENS")),
+		IngestBufferSize:    env.getInt("INGEST_BUFFER_SIZE", 1000),
+		IngestRetryInterval: env.getDuration("INGEST_RETRY_INTERVAL", 10*time.Second),
+		MemberCacheTTL:      env.getDuration("MEMBER_CACHE_TTL", 10*time.Minute),
+		ResultCacheTTL:      env.getDuration("RESULT_CACHE_TTL", time.Minute),
+		IngestDedupTTL:      env.getDuration("INGEST_DEDUP_TTL", 7*24*time.Hour),
+
+		IngestSamplesCollection:    env.getDefault("INGEST_SAMPLES_COLLECTION", "ingested_samples"),
+		IngestWatermarksCollection: env.getDefault("INGEST_WATERMARKS_COLLECTION", "ingest_watermarks"),
+
+		LinkSecret:   env.get("LINK_SECRET"),
+		LinkBaseURL:  env.getDefault("LINK_BASE_URL", "http://localhost:8080"),
+		LinkValidity: env.getDuration("LINK_VALIDITY", 30*24*time.Hour),
+
+		AgentName:       env.getDefault("AGENT_NAME", hostname()),
+		AgentInterfaces: splitList(env.getDefault("AGENT_INTERFACES", "wg_exit")),
+		AgentInterval:   env.getDuration("AGENT_INTERVAL", time.Minute),
+		AgentPushURL:    env.get("AGENT_PUSH_URL"),
+		AgentToken:      env.get("AGENT_TOKEN"),
+
+		MongoDatabase:   env.get("MONGO_DATABASE"),
+		MongoCollection: env.get("MONGO_COLLECTION"),
+		MongoURL:        env.get("MONGO_URL"),
+
+		MongoReadURL:        env.get("MONGO_READ_URL"),
+		MongoReadPreference: env.get("MONGO_READ_PREFERENCE"),
+
+		MongoDualWriteURL: env.get("MONGO_DUAL_WRITE_URL"),
+		MongoCutover:      env.getBool("MONGO_CUTOVER", false),
+
+		UsageStores:     splitList(env.getDefault("USAGE_STORES", usageStoreMongo)),
+		DuplicatePolicy: env.getDefault("DUPLICATE_POLICY", duplicatePolicySkip),
+		MongoSpillFile:  env.getDefault("MONGO_SPILL_FILE", "mongo-spill.jsonl"),
+		JournalFile:     env.get("JOURNAL_FILE"),
+		PipelineFile:    env.get("PIPELINE_FILE"),
+		WatchSinks:      splitList(env.get("WATCH_SINKS")),
+		WebhookURL:      env.get("WEBHOOK_URL"),
+
+		EventBus:         env.get("EVENT_BUS"),
+		EventBusURL:      env.get("EVENT_BUS_URL"),
+		EventUsageTopic:  env.getDefault("EVENT_USAGE_TOPIC", "stat-collector.usage"),
+		EventAlertsTopic: env.getDefault("EVENT_ALERTS_TOPIC", "stat-collector.alerts"),
+
+		CRMProvider: env.get("CRM_PROVIDER"),
+		CRMURL:      env.get("CRM_URL"),
+		CRMDatabase: env.get("CRM_DATABASE"),
+		CRMUser:     env.get("CRM_USER"),
+		CRMToken:    env.get("CRM_TOKEN"),
+
+		TwilioURL:           env.getDefault("TWILIO_URL", "https://api.twilio.com"),
+		TwilioAccountSID:    env.get("TWILIO_ACCOUNT_SID"),
+		TwilioAuthToken:     env.get("TWILIO_AUTH_TOKEN"),
+		TwilioFrom:          env.get("TWILIO_FROM"),
+		SMSSummaryTemplate:  env.get("SMS_SUMMARY_TEMPLATE"),
+		SMSWarningTemplate:  env.get("SMS_WARNING_TEMPLATE"),
+		SMSWarningThreshold: env.getFloat("SMS_WARNING_THRESHOLD", 100),
+
+		SLAUptimeTarget: env.getFloat("SLA_UPTIME_TARGET", 99),
+
+		BalanceLowGB: env.getFloat("BALANCE_LOW_GB", 1),
+
+		DefaultLanguage: env.getDefault("DEFAULT_LANGUAGE", defaultLanguage),
+		MessageCatalogs: env.get("MESSAGE_CATALOGS"),
+
+		RetentionPeriod:       env.getDuration("RETENTION_PERIOD", 365*24*time.Hour),
+		MongoRollupCollection: env.getDefault("MONGO_ROLLUP_COLLECTION", "usage_monthly"),
+		MongoTotalsCollection: env.get("MONGO_TOTALS_COLLECTION"),
+
+		MongoMembersCollection:       env.getDefault("MONGO_MEMBERS_COLLECTION", "members"),
+		MongoMemberChangesCollection: env.getDefault("MONGO_MEMBER_CHANGES_COLLECTION", "member_changes"),
+		MongoExitUsageCollection:     env.getDefault("MONGO_EXIT_USAGE_COLLECTION", "exit_usage"),
+		MongoAuditCollection:         env.getDefault("MONGO_AUDIT_COLLECTION", "usage_audits"),
+		MongoAliasCollection:         env.getDefault("MONGO_ALIAS_COLLECTION", "member_aliases"),
+		MongoAnnotationsCollection:   env.getDefault("MONGO_ANNOTATIONS_COLLECTION", "annotations"),
+		MongoMutationsCollection:     env.getDefault("MONGO_MUTATIONS_COLLECTION", "usage_mutations"),
+		MongoCorrectionsCollection:   env.getDefault("MONGO_CORRECTIONS_COLLECTION", "usage_corrections"),
+		MongoWatchCollection:         env.getDefault("MONGO_WATCH_COLLECTION", "watch_resume_tokens"),
+		MongoMetricsCollection:       env.getDefault("MONGO_METRICS_COLLECTION", "collector_metrics"),
+		MongoMemberMetricsCollection: env.getDefault("MONGO_MEMBER_METRICS_COLLECTION", "member_metrics"),
+		MongoPausesCollection:        env.getDefault("MONGO_PAUSES_COLLECTION", "member_pauses"),
+		MongoBalancesCollection:      env.getDefault("MONGO_BALANCES_COLLECTION", "member_balances"),
+
+		SigningKey: env.get("SIGNING_KEY"),
+
+		PIIKey:        env.get("PII_KEY"),
+		PIIKeyCommand: env.get("PII_KEY_COMMAND"),
+
+		ConsentOptOut:   env.getDefault("CONSENT_OPT_OUT", consentPseudonymize),
+		PseudonymSecret: env.get("PSEUDONYM_SECRET"),
+
+		PublicNoiseEpsilon:       env.getFloat("PUBLIC_NOISE_EPSILON", 0),
+		PublicNoiseSensitivityGB: env.getFloat("PUBLIC_NOISE_SENSITIVITY_GB", 50),
+		PublicRoundGB:            env.getFloat("PUBLIC_ROUND_GB", 1),
+		PublicMinMembers:         env.getInt("PUBLIC_MIN_MEMBERS", 5),
+
+		PublicFeed:         splitList(env.get("PUBLIC_FEED")),
+		AWSAccessKeyID:     env.get("AWS_ACCESS_KEY_ID"),
+		AWSSecretAccessKey: env.get("AWS_SECRET_ACCESS_KEY"),
+		AWSRegion:          env.getDefault("AWS_REGION", "us-east-1"),
+		S3Endpoint:         env.get("S3_ENDPOINT"),
+
+		PublicStats:                env.getBool("PUBLIC_STATS", false),
+		AtomFeed:                   splitList(env.get("ATOM_FEED")),
+		AtomFeedWeeks:              env.getInt("ATOM_FEED_WEEKS", 12),
+		MongoPublicStatsCollection: env.getDefault("MONGO_PUBLIC_STATS_COLLECTION", "public_stats"),
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// settlementFormat identifies settlement exports, so peers running other
+// versions know what they are reading
+const settlementFormat = "stat-collector-settlement/1"
+
+// SettlementExport is the traffic a network exchanged with a peer network
+// at their peering point, as measured on its side, for settling bandwidth
+// between them. Sent is traffic to the peer and Received traffic from it,
+// in GB. Each side exports its own, and the two are reconciled against each
+// other: one side's Sent should be the other's Received. With SIGNING_KEY
+// set the export is signed, over its JSON without the signature
+type SettlementExport struct {
+	Format     string
+	Network    string
+	Peer       string
+	From       time.Time
+	To         time.Time
+	Targets    []string
+	Sent       float64
+	Received   float64
+	Periods    []SettlementPeriod
+	ExportedAt time.Time
+	PublicKey  string `json:",omitempty"`
+	Signature  string `json:",omitempty"`
+}
+
+// SettlementPeriod is the traffic exchanged over one period of an export.
+// Sent and Received are nil when the peering point wasn't sampled enough to
+// measure the period
+type SettlementPeriod struct {
+	From     time.Time
+	To       time.Time
+	Sent     *float64
+	Received *float64
+}
+
+// parsePeeringPoints reads PEERING_POINTS entries written like
+// neighbor-coop=uplink1+uplink2, naming a peer network and the SNMP targets
+// of the links to it
+func parsePeeringPoints(entries []string) (map[string][]string, error) {
+	points := map[string][]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid PEERING_POINTS entry %q, expected peer=target[+target]", entry)
+		}
+		points[parts[0]] = strings.Split(parts[1], "+")
+	}
+	return points, nil
+}
+
+// buildSettlement measures the traffic exchanged with a peer over each
+// interval of the window on the peering point's targets
+func buildSettlement(snmpCollection *mongo.Collection, network string, peer string, targets []string, from time.Time, to time.Time, interval time.Duration) (SettlementExport, error) {
+	export := SettlementExport{
+		Format:     settlementFormat,
+		Network:    network,
+		Peer:       peer,
+		From:       from,
+		To:         to,
+		Targets:    targets,
+		Periods:    []SettlementPeriod{},
+		ExportedAt: time.Now().UTC(),
+	}
+
+	for start := from; start.Before(to); start = start.Add(interval) {
+		end := start.Add(interval)
+		if end.After(to) {
+			end = to
+		}
+
+		period := SettlementPeriod{From: start, To: end}
+		var sent, received float64
+		measured := true
+		for _, target := range targets {
+			usage, err := getExitUsage(snmpCollection, network, target, start, end)
+			if err != nil {
+				return export, err
+			}
+			if usage.Total == nil {
+				measured = false
+				break
+			}
+			// The peering point's outgoing traffic is what is sent to the peer
+			sent += *usage.Up
+			received += *usage.Down
+		}
+		if measured {
+			period.Sent, period.Received = &sent, &received
+			export.Sent += sent
+			export.Received += received
+		}
+
+		export.Periods = append(export.Periods, period)
+	}
+
+	return export, nil
+}
+
+// settlementPayload is the bytes an export's signature is made over
+func settlementPayload(export SettlementExport) ([]byte, error) {
+	export.Signature = ""
+	return json.Marshal(export)
+}
+
+// signSettlement signs an export, leaving it unsigned without a key
+func signSettlement(key ed25519.PrivateKey, export *SettlementExport) error {
+	if key == nil {
+		return nil
+	}
+	export.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	payload, err := settlementPayload(*export)
+	if err != nil {
+		return err
+	}
+	export.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+// verifySettlement checks an export was signed by the key, which must be
+// known ahead rather than taken from the export
+func verifySettlement(key ed25519.PublicKey, export SettlementExport) error {
+	if export.Signature == "" {
+		return fmt.Errorf("the settlement export of %s isn't signed", export.Network)
+	}
+	signature, err := base64.StdEncoding.DecodeString(export.Signature)
+	if err != nil {
+		return fmt.Errorf("the signature of the settlement export of %s isn't base64", export.Network)
+	}
+	payload, err := settlementPayload(export)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, payload, signature) {
+		return fmt.Errorf("the settlement export of %s doesn't match its signature", export.Network)
+	}
+	return nil
+}
+
+// readSettlement reads an export written by a peer
+func readSettlement(path string) (SettlementExport, error) {
+	var export SettlementExport
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return export, err
+	}
+	if err := json.Unmarshal(body, &export); err != nil {
+		return export, fmt.Errorf("%s is not a settlement export: %v", path, err)
+	}
+	if export.Format != settlementFormat {
+		return export, fmt.Errorf("%s is not a settlement export, or of an unsupported format %q", path, export.Format)
+	}
+	return export, nil
+}
+
+// SettlementDifference compares one direction of a period between the two
+// sides' exports. Ours is what our side measured, Theirs what the peer
+// measured of the same traffic
+type SettlementDifference struct {
+	From              time.Time
+	To                time.Time
+	Direction         string
+	Ours              *float64
+	Theirs            *float64
+	Difference        *float64
+	DifferencePercent *float64
+	Flagged           bool
+}
+
+// reconcileSettlements matches the periods of both sides' exports, our
+// sent traffic against their received traffic and the other way around.
+// Differences beyond the tolerance, in percent, and periods only one side
+// measured are flagged
+func reconcileSettlements(ours SettlementExport, theirs SettlementExport, tolerance float64) ([]SettlementDifference, error) {
+	if ours.Peer != theirs.Network || theirs.Peer != ours.Network {
+		return nil, fmt.Errorf("the exports aren't of the same peering: %s to %s, and %s to %s", ours.Network, ours.Peer, theirs.Network, theirs.Peer)
+	}
+
+	byStart := map[int64]SettlementPeriod{}
+	for _, period := range theirs.Periods {
+		byStart[period.From.Unix()] = period
+	}
+
+	compare := func(period SettlementPeriod, direction string, ours *float64, theirs *float64) SettlementDifference {
+		difference := SettlementDifference{From: period.From, To: period.To, Direction: direction, Ours: ours, Theirs: theirs}
+		if ours == nil || theirs == nil {
+			difference.Flagged = true
+			return difference
+		}
+
+		delta := *ours - *theirs
+		difference.Difference = &delta
+		if largest := math.Max(*ours, *theirs); largest > 0 {
+			percent := math.Abs(delta) / largest * 100
+			difference.DifferencePercent = &percent
+			difference.Flagged = percent > tolerance
+		}
+		return difference
+	}
+
+	differences := []SettlementDifference{}
+	for _, period := range ours.Periods {
+		theirPeriod, ok := byStart[period.From.Unix()]
+		if !ok || !theirPeriod.To.Equal(period.To) {
+			theirPeriod = SettlementPeriod{}
+		}
+		differences = append(differences,
+			compare(period, "sent", period.Sent, theirPeriod.Received),
+			compare(period, "received", period.Received, theirPeriod.Sent))
+	}
+
+	return differences, nil
+}
+
+func (d SettlementDifference) reportColumns() []string {
+	return []string{"FROM", "TO", "DIRECTION", "OURS (GB)", "THEIRS (GB)", "DIFFERENCE (GB)", "DIFFERENCE (%)", "FLAGGED"}
+}
+
+func (d SettlementDifference) reportValues(number func(*float64) string) []string {
+	return []string{
+		d.From.UTC().Format(time.RFC3339),
+		d.To.UTC().Format(time.RFC3339),
+		d.Direction,
+		number(d.Ours),
+		number(d.Theirs),
+		number(d.Difference),
+		number(d.DifferencePercent),
+		strconv.FormatBool(d.Flagged),
+	}
+}
+
+// settlementCommand exports the traffic exchanged with a peer network, or
+// reconciles our export against the peer's
+func settlementCommand(args []string) {
+	usage := "usage: stat-collector settlement export -peer <peer> duration [end_time] | reconcile <ours.json> <theirs.json>"
+	if len(args) == 0 {
+		fatal(usage)
+	}
+
+	switch args[0] {
+	case "export":
+		settlementExportCommand(args[1:])
+	case "reconcile":
+		settlementReconcileCommand(args[1:])
+	default:
+		fatal(usage)
+	}
+}
+
+// settlementExportCommand writes the export of the traffic exchanged with a
+// peer over the window to stdout, per -interval
+func settlementExportCommand(args []string) {
+	flags := flag.NewFlagSet("settlement export", flag.ExitOnError)
+	peer := flags.String("peer", "", "peer network, as named in PEERING_POINTS")
+	interval := flags.Duration("interval", 24*time.Hour, "length of each period of the export")
+	flags.Parse(args)
+
+	if *interval <= 0 {
+		fatal("-interval must be positive")
+	}
+
+	settings := loadSettings()
+	points, err := parsePeeringPoints(settings.PeeringPoints)
+	if err != nil {
+		fatal(err)
+	}
+	targets, ok := points[*peer]
+	if !ok {
+		fatal(fmt.Sprintf("no peering point for %q in PEERING_POINTS", *peer))
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	db, err := getReadDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	export, err := buildSettlement(db.Collection(settings.SNMPCollection), settings.Network, *peer, targets, from.UTC(), to.UTC(), *interval)
+	if err != nil {
+		fatal(err)
+	}
+
+	key, err := parseSigningKey(settings.SigningKey)
+	if err != nil {
+		fatal(err)
+	}
+	if err := signSettlement(key, &export); err != nil {
+		fatal(err)
+	}
+
+	printJSON(os.Stdout, export)
+}
+
+// settlementReconcileCommand reports the differences between our export
+// and the peer's, checking the peer's signature with -key
+func settlementReconcileCommand(args []string) {
+	flags := flag.NewFlagSet("settlement reconcile", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	keyFlag := flags.String("key", "", "the peer's base64 public key, to check their export is signed by them")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fatal("usage: stat-collector settlement reconcile <ours.json> <theirs.json>")
+	}
+
+	ours, err := readSettlement(flags.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	theirs, err := readSettlement(flags.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+
+	if *keyFlag != "" {
+		key, err := parsePublicKey(*keyFlag)
+		if err != nil {
+			fatal(err)
+		}
+		if err := verifySettlement(key, theirs); err != nil {
+			fatal(err)
+		}
+	}
+
+	differences, err := reconcileSettlements(ours, theirs, loadProcessSettings().SettlementTolerance)
+	if err != nil {
+		fatal(err)
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+	flagged := 0
+	for _, difference := range differences {
+		if difference.Flagged {
+			flagged++
+		}
+		if err := report.Write(difference); err != nil {
+			fatal(err)
+		}
+	}
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s sent %.3f GB and received %.3f GB, %s received %.3f GB and sent %.3f GB, %d differences flagged\n",
+		ours.Network, ours.Sent, ours.Received, theirs.Network, theirs.Received, theirs.Sent, flagged)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePeeringPoints(t *testing.T) {
+	tests := []struct {
+		entry   string
+		targets []string
+		valid   bool
+	}{
+		{"neighbor-coop=uplink1", []string{"uplink1"}, true},
+		{"neighbor-coop=uplink1+uplink2", []string{"uplink1", "uplink2"}, true},
+		{"neighbor-coop", nil, false},
+		{"=uplink1", nil, false},
+		{"neighbor-coop=", nil, false},
+	}
+
+	for _, test := range tests {
+		points, err := parsePeeringPoints([]string{test.entry})
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.entry, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.entry)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(points["neighbor-coop"], test.targets) {
+			t.Errorf("%s: got %v, want %v", test.entry, points["neighbor-coop"], test.targets)
+		}
+	}
+}
+
+// settlementExport builds an export of daily periods, each given as sent
+// and received GB, or nil for a period that wasn't measured
+func settlementExport(network string, peer string, periods ...[]float64) SettlementExport {
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	export := SettlementExport{Format: settlementFormat, Network: network, Peer: peer, From: start}
+	for i, values := range periods {
+		period := SettlementPeriod{From: start.AddDate(0, 0, i), To: start.AddDate(0, 0, i+1)}
+		if values != nil {
+			sent, received := values[0], values[1]
+			period.Sent, period.Received = &sent, &received
+			export.Sent += sent
+			export.Received += received
+		}
+		export.Periods = append(export.Periods, period)
+	}
+	export.To = start.AddDate(0, 0, len(periods))
+	return export
+}
+
+func TestReconcileSettlements(t *testing.T) {
+	tests := []struct {
+		name    string
+		ours    SettlementExport
+		theirs  SettlementExport
+		flagged []bool
+		valid   bool
+	}{
+		{
+			"matching",
+			settlementExport("casa", "vecinos", []float64{10, 4}),
+			settlementExport("vecinos", "casa", []float64{4, 10}),
+			[]bool{false, false},
+			true,
+		},
+		{
+			"within tolerance",
+			settlementExport("casa", "vecinos", []float64{100, 40}),
+			settlementExport("vecinos", "casa", []float64{40.2, 99.5}),
+			[]bool{false, false},
+			true,
+		},
+		{
+			"sent beyond tolerance",
+			settlementExport("casa", "vecinos", []float64{100, 40}),
+			settlementExport("vecinos", "casa", []float64{40, 90}),
+			[]bool{true, false},
+			true,
+		},
+		{
+			"unmeasured on their side",
+			settlementExport("casa", "vecinos", []float64{10, 4}, []float64{10, 4}),
+			settlementExport("vecinos", "casa", []float64{4, 10}, nil),
+			[]bool{false, false, true, true},
+			true,
+		},
+		{
+			"missing from their export",
+			settlementExport("casa", "vecinos", []float64{10, 4}, []float64{10, 4}),
+			settlementExport("vecinos", "casa", []float64{4, 10}),
+			[]bool{false, false, true, true},
+			true,
+		},
+		{
+			"nothing exchanged",
+			settlementExport("casa", "vecinos", []float64{0, 0}),
+			settlementExport("vecinos", "casa", []float64{0, 0}),
+			[]bool{false, false},
+			true,
+		},
+		{
+			"another peering",
+			settlementExport("casa", "vecinos", []float64{10, 4}),
+			settlementExport("otros", "casa", []float64{4, 10}),
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		differences, err := reconcileSettlements(test.ours, test.theirs, 1)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+
+		flagged := []bool{}
+		for _, difference := range differences {
+			flagged = append(flagged, difference.Flagged)
+		}
+		if !reflect.DeepEqual(flagged, test.flagged) {
+			t.Errorf("%s: flagged %v, want %v", test.name, flagged, test.flagged)
+		}
+	}
+}
+
+func TestReconcileSettlementsDirections(t *testing.T) {
+	ours := settlementExport("casa", "vecinos", []float64{100, 40})
+	theirs := settlementExport("vecinos", "casa", []float64{38, 90})
+
+	differences, err := reconcileSettlements(ours, theirs, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(differences) != 2 {
+		t.Fatalf("got %d differences, want 2", len(differences))
+	}
+
+	sent, received := differences[0], differences[1]
+	if sent.Direction != "sent" || *sent.Ours != 100 || *sent.Theirs != 90 || *sent.Difference != 10 || *sent.DifferencePercent != 10 {
+		t.Errorf("sent: got %+v", sent)
+	}
+	if received.Direction != "received" || *received.Ours != 40 || *received.Theirs != 38 || *received.Difference != 2 || *received.DifferencePercent != 5 {
+		t.Errorf("received: got %+v", received)
+	}
+}
+
+func TestSignSettlement(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	public := key.Public().(ed25519.PublicKey)
+
+	export := settlementExport("vecinos", "casa", []float64{4, 10})
+	if err := verifySettlement(public, export); err == nil {
+		t.Error("unsigned: should have failed")
+	}
+
+	if err := signSettlement(key, &export); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySettlement(public, export); err != nil {
+		t.Errorf("signed: %v", err)
+	}
+
+	tampered := export
+	tampered.Sent = 3
+	if err := verifySettlement(public, tampered); err == nil {
+		t.Error("tampered: should have failed")
+	}
+
+	other := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 1))
+	if err := verifySettlement(other.Public().(ed25519.PublicKey), export); err == nil {
+		t.Error("other key: should have failed")
+	}
+}
+
+func TestReadSettlement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settlement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	export := settlementExport("vecinos", "casa", []float64{4, 10}, nil)
+	path := filepath.Join(dir, "vecinos.json")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := printJSON(file, export); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	read, err := readSettlement(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, export) {
+		t.Errorf("got %+v, want %+v", read, export)
+	}
+
+	other := filepath.Join(dir, "other.json")
+	if err := ioutil.WriteFile(other, []byte(`{"Format": "something-else/1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSettlement(other); err == nil {
+		t.Error("other format: should have failed")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// signedUsage is what a period's signature covers: the usage and what it
+// was measured on. Member IDs aren't covered, as aliases and migrations
+// give periods their member ID after they are stored
+type signedUsage struct {
+	Network      string
+	Name         string
+	Interface    string
+	From         time.Time
+	To           time.Time
+	Up           *float64
+	Down         *float64
+	Total        *float64
+	Status       string
+	CorrectionID string
+}
+
+// signingPayload is the bytes of a period a signature is made over. Times
+// are cut to the millisecond Mongo keeps, so periods read back verify
+func signingPayload(bwup BandwidthUsagePeriod) ([]byte, error) {
+	return bson.Marshal(signedUsage{
+		Network:      bwup.Network,
+		Name:         bwup.Name,
+		Interface:    bwup.Interface,
+		From:         bwup.From.UTC().Truncate(time.Millisecond),
+		To:           bwup.To.UTC().Truncate(time.Millisecond),
+		Up:           bwup.Up,
+		Down:         bwup.Down,
+		Total:        bwup.Total,
+		Status:       bwup.Status,
+		CorrectionID: bwup.CorrectionID,
+	})
+}
+
+// parseSigningKey reads SIGNING_KEY, a base64 ed25519 seed or private key,
+// nil if empty
+func parseSigningKey(value string) (ed25519.PrivateKey, error) {
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SIGNING_KEY, expected base64: %v", err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("invalid SIGNING_KEY, expected a %d byte seed or %d byte private key", ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// parsePublicKey reads a base64 ed25519 public key
+func parsePublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key, expected %d bytes of base64", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// signUsage sets a period's signature, leaving it unsigned without a key
+func signUsage(key ed25519.PrivateKey, bwup *BandwidthUsagePeriod) error {
+	if key == nil {
+		return nil
+	}
+	payload, err := signingPayload(*bwup)
+	if err != nil {
+		return err
+	}
+	bwup.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+// Outcomes of verifying a period
+const (
+	signatureValid    = "valid"
+	signatureInvalid  = "invalid"
+	signatureUnsigned = "unsigned"
+)
+
+// verifyUsage checks a period's signature against the public key
+func verifyUsage(key ed25519.PublicKey, bwup BandwidthUsagePeriod) string {
+	if bwup.Signature == "" {
+		return signatureUnsigned
+	}
+	signature, err := base64.StdEncoding.DecodeString(bwup.Signature)
+	if err != nil {
+		return signatureInvalid
+	}
+	payload, err := signingPayload(bwup)
+	if err != nil || !ed25519.Verify(key, payload, signature) {
+		return signatureInvalid
+	}
+	return signatureValid
+}
+
+// SignatureCheck counts the outcomes of verifying a set of periods
+type SignatureCheck struct {
+	Source   string
+	Valid    int
+	Invalid  int
+	Unsigned int
+}
+
+func (c *SignatureCheck) add(outcome string, bwup BandwidthUsagePeriod) {
+	switch outcome {
+	case signatureValid:
+		c.Valid++
+	case signatureUnsigned:
+		c.Unsigned++
+	default:
+		c.Invalid++
+		log.Printf("Invalid signature on the usage of %s from %s to %s", bwup.Name, bwup.From.Format(time.RFC3339), bwup.To.Format(time.RFC3339))
+	}
+}
+
+// keygenCommand prints a new ed25519 key pair for SIGNING_KEY, and the
+// public key to hand to whoever verifies the data
+func keygenCommand(args []string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("SIGNING_KEY=%s\n", base64.StdEncoding.EncodeToString(private.Seed()))
+	fmt.Printf("public key: %s\n", base64.StdEncoding.EncodeToString(public))
+}
+
+// verifyCommand checks the signatures of the usage periods in a dump
+// archive, or stored in the database over a window. The public key is given
+// with -key, or derived from SIGNING_KEY. It exits with an error if any
+// signature is invalid, or with -strict if any period is unsigned
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFlag := flags.String("key", "", "base64 public key to verify with, derived from SIGNING_KEY if empty")
+	archive := flags.String("archive", "", "dump archive to verify, the database if empty")
+	strict := flags.Bool("strict", false, "fail on unsigned periods too")
+	flags.Parse(args)
+
+	settings := loadProcessSettings()
+
+	var key ed25519.PublicKey
+	if *keyFlag != "" {
+		var err error
+		if key, err = parsePublicKey(*keyFlag); err != nil {
+			fatal(err)
+		}
+	} else {
+		private, err := parseSigningKey(settings.SigningKey)
+		if err != nil {
+			fatal(err)
+		}
+		if private == nil {
+			fatal("-key or SIGNING_KEY is required to verify")
+		}
+		key = private.Public().(ed25519.PublicKey)
+	}
+
+	var check SignatureCheck
+	if *archive != "" {
+		check = verifyArchive(settings, key, *archive)
+	} else {
+		check = verifyStored(settings, key, flags.Args())
+	}
+
+	printJSON(os.Stdout, check)
+	if check.Invalid > 0 || (*strict && check.Unsigned > 0) {
+		os.Exit(1)
+	}
+}
+
+// verifyArchive checks the periods of the usage collection in a dump archive
+func verifyArchive(settings Settings, key ed25519.PublicKey, path string) SignatureCheck {
+	check := SignatureCheck{Source: path}
+
+	file, decoder, _, err := openDumpArchive(path)
+	if err != nil {
+		fatal(err)
+	}
+	defer file.Close()
+
+	for decoder.More() {
+		var line DumpLine
+		if err := decoder.Decode(&line); err != nil {
+			fatal(err)
+		}
+		if line.Collection != settings.MongoCollection {
+			continue
+		}
+
+		var bwup BandwidthUsagePeriod
+		if err := bson.UnmarshalExtJSON(line.Document, true, &bwup); err != nil {
+			fatal(err)
+		}
+		check.add(verifyUsage(key, bwup), bwup)
+	}
+
+	return check
+}
+
+// verifyStored checks the periods of every network stored over a window
+func verifyStored(settings Settings, key ed25519.PublicKey, args []string) SignatureCheck {
+	from, to, _ := parseWindow(args)
+	check := SignatureCheck{Source: settings.MongoDatabase + "." + settings.MongoCollection}
+
+	db, err := getReadDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	cursor, err := db.Collection(settings.MongoCollection).Find(ctx,
+		bson.M{"from": bson.M{"$gte": from}, "to": bson.M{"$lte": to}},
+		options.Find().SetSort(bson.M{"from": 1}))
+	if err != nil {
+		fatal(err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var bwup BandwidthUsagePeriod
+		if err := cursor.Decode(&bwup); err != nil {
+			fatal(err)
+		}
+		check.add(verifyUsage(key, bwup), bwup)
+	}
+	if err := cursor.Err(); err != nil {
+		fatal(err)
+	}
+
+	return check
+}
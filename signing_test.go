@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseSigningKey(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	private := ed25519.NewKeyFromSeed(seed)
+
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"seed", base64.StdEncoding.EncodeToString(seed), true},
+		{"private key", base64.StdEncoding.EncodeToString(private), true},
+		{"short", base64.StdEncoding.EncodeToString(seed[:16]), false},
+		{"not base64", "not a key!", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseSigningKey(tt.value)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Equal(private) {
+				t.Errorf("got a different key")
+			}
+		})
+	}
+
+	if key, err := parseSigningKey(""); key != nil || err != nil {
+		t.Errorf("expected no key without SIGNING_KEY, got %v, %v", key, err)
+	}
+}
+
+func TestSignUsage(t *testing.T) {
+	key, err := parseSigningKey(base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := key.Public().(ed25519.PublicKey)
+
+	bwup := usage(1, 2)
+	bwup.Network = "casa"
+	bwup.MemberID = "rec1"
+	// Mongo keeps times to the millisecond
+	bwup.From = time.Date(2026, 9, 1, 0, 0, 0, 123456789, time.UTC)
+	bwup.To = bwup.From.Add(time.Hour)
+
+	if verifyUsage(public, bwup) != signatureUnsigned {
+		t.Errorf("expected the period unsigned")
+	}
+
+	if err := signUsage(nil, &bwup); err != nil || bwup.Signature != "" {
+		t.Errorf("expected no signature without a key")
+	}
+	if err := signUsage(key, &bwup); err != nil {
+		t.Fatal(err)
+	}
+	if outcome := verifyUsage(public, bwup); outcome != signatureValid {
+		t.Errorf("expected the signature valid, got %s", outcome)
+	}
+
+	document, err := bson.Marshal(bwup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored BandwidthUsagePeriod
+	if err := bson.Unmarshal(document, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if outcome := verifyUsage(public, stored); outcome != signatureValid {
+		t.Errorf("expected the signature valid once stored, got %s", outcome)
+	}
+
+	aliased := stored
+	aliased.MemberID = "rec2"
+	if outcome := verifyUsage(public, aliased); outcome != signatureValid {
+		t.Errorf("expected the signature to survive aliasing, got %s", outcome)
+	}
+
+	tampered := stored
+	total := *tampered.Total - 1
+	tampered.Total = &total
+	if outcome := verifyUsage(public, tampered); outcome != signatureInvalid {
+		t.Errorf("expected altered usage to be invalid, got %s", outcome)
+	}
+
+	other, _, _ := ed25519.GenerateKey(strings.NewReader(strings.Repeat("x", 64)))
+	if outcome := verifyUsage(other, stored); outcome != signatureInvalid {
+		t.Errorf("expected another key to be invalid, got %s", outcome)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// unknownSite collects the members with neither a site nor a location
+const unknownSite = "unknown"
+
+// SiteUsage is the usage of the members served by a tower or relay site
+// over a window, against the window before it, for capacity planning.
+// Latitude and Longitude are the middle of the site's members with a
+// location
+type SiteUsage struct {
+	Network   string
+	Site      string
+	Latitude  *float64 `json:",omitempty"`
+	Longitude *float64 `json:",omitempty"`
+	From      time.Time
+	To        time.Time
+	Members   int
+	Up        float64
+	Down      float64
+	Total     float64
+	// Previous is the site's total over the window before, and Growth the
+	// change from it in percent, nil if the site used nothing then
+	Previous float64
+	Growth   *float64
+	// PlanMbps adds up the plans of the site's members, what its radios
+	// are sold to carry
+	PlanMbps float64
+}
+
+// memberSite names the site of a member, its Site, or its location to
+// about 100m for members with only a location
+func memberSite(member MeshMember) string {
+	if site := strings.TrimSpace(member.Fields.Site); site != "" {
+		return site
+	}
+	if member.Fields.Latitude != nil && member.Fields.Longitude != nil {
+		return fmt.Sprintf("%.3f,%.3f", *member.Fields.Latitude, *member.Fields.Longitude)
+	}
+	return unknownSite
+}
+
+// siteUsage adds up the usage of each site's members in the summaries of
+// the current and previous windows, busiest first. Members are looked up
+// by ID, or by name for usage without one, and those gone from Airtable
+// count towards the unknown site
+func siteUsage(current DashboardSummary, previous DashboardSummary, members []MeshMember) []SiteUsage {
+	byID := map[string]MeshMember{}
+	byName := map[string]MeshMember{}
+	for _, member := range members {
+		byID[member.ID] = member
+		byName[member.Fields.Name] = member
+	}
+	lookup := func(usage MemberSummary) MeshMember {
+		if member, ok := byID[usage.MemberID]; ok && usage.MemberID != "" {
+			return member
+		}
+		return byName[usage.Name]
+	}
+
+	sites := map[string]*SiteUsage{}
+	site := func(name string) *SiteUsage {
+		usage, ok := sites[name]
+		if !ok {
+			usage = &SiteUsage{Network: current.Network, Site: name, From: current.From, To: current.To}
+			sites[name] = usage
+		}
+		return usage
+	}
+
+	// The members and locations are those of members in Airtable, whether
+	// or not they used anything
+	located := map[string]int{}
+	latitudes := map[string]float64{}
+	longitudes := map[string]float64{}
+	for _, member := range members {
+		name := memberSite(member)
+		usage := site(name)
+		usage.Members++
+		usage.PlanMbps += member.Fields.PlanMbps
+		if member.Fields.Latitude != nil && member.Fields.Longitude != nil {
+			located[name]++
+			latitudes[name] += *member.Fields.Latitude
+			longitudes[name] += *member.Fields.Longitude
+		}
+	}
+
+	for _, usage := range current.Members {
+		member := lookup(usage)
+		sum := site(memberSite(member))
+		if member.ID == "" && member.Fields.Name == "" {
+			sum.Members++
+		}
+		sum.Up += usage.Up
+		sum.Down += usage.Down
+		sum.Total += usage.Total
+	}
+	for _, usage := range previous.Members {
+		site(memberSite(lookup(usage))).Previous += usage.Total
+	}
+
+	all := []SiteUsage{}
+	for name, usage := range sites {
+		if n := located[name]; n > 0 {
+			latitude, longitude := latitudes[name]/float64(n), longitudes[name]/float64(n)
+			usage.Latitude, usage.Longitude = &latitude, &longitude
+		}
+		if usage.Previous > 0 {
+			growth := (usage.Total - usage.Previous) / usage.Previous * 100
+			usage.Growth = &growth
+		}
+		all = append(all, *usage)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Total == all[j].Total {
+			return strings.ToLower(all[i].Site) < strings.ToLower(all[j].Site)
+		}
+		return all[i].Total > all[j].Total
+	})
+	return all
+}
+
+// getSiteUsage reads the usage of each site over the window and the
+// window of the same length before it
+func getSiteUsage(collection *mongo.Collection, network string, members []MeshMember, from time.Time, to time.Time, duration time.Duration) ([]SiteUsage, error) {
+	currentPeriods, err := getUsagePeriods(collection, network, "", "", from, to)
+	if err != nil {
+		return nil, err
+	}
+	previousPeriods, err := getUsagePeriods(collection, network, "", "", from.Add(-duration), from)
+	if err != nil {
+		return nil, err
+	}
+
+	current := summarizeDashboard(network, currentPeriods, from, to)
+	previous := summarizeDashboard(network, previousPeriods, from.Add(-duration), from)
+	return siteUsage(current, previous, members), nil
+}
+
+func (s SiteUsage) reportColumns() []string {
+	return []string{"NETWORK", "SITE", "FROM", "TO", "MEMBERS", "PLANS (MBPS)", "UP (GB)", "DOWN (GB)", "TOTAL (GB)", "PREVIOUS (GB)", "GROWTH (%)"}
+}
+
+func (s SiteUsage) reportValues(number func(*float64) string) []string {
+	return []string{
+		s.Network,
+		s.Site,
+		s.From.UTC().Format(time.RFC3339),
+		s.To.UTC().Format(time.RFC3339),
+		strconv.Itoa(s.Members),
+		number(&s.PlanMbps),
+		number(&s.Up),
+		number(&s.Down),
+		number(&s.Total),
+		number(&s.Previous),
+		number(s.Growth),
+	}
+}
+
+// sitesCommand reports the usage of each site over the window and its
+// growth from the window of the same length before it
+func sitesCommand(args []string) {
+	flags := flag.NewFlagSet("sites", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	public := flags.Bool("public", false, "leave out small groups, round and add noise with the PUBLIC_ settings, for publishing")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, duration := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		members, err := getMeshMembers(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+		sites, err := getSiteUsage(bwupCollection, settings.Network, members, from, to, duration)
+		if err != nil {
+			fatal(err)
+		}
+		if *public {
+			sites = publicSites(newPublicNoise(settings), sites)
+		}
+		for _, site := range sites {
+			if err := report.Write(site); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMemberSite(t *testing.T) {
+	latitude, longitude := 9.93471, -84.08795
+
+	tests := []struct {
+		name      string
+		site      string
+		latitude  *float64
+		longitude *float64
+		want      string
+	}{
+		{"site", "Water Tower", nil, nil, "Water Tower"},
+		{"site and location", " Water Tower ", &latitude, &longitude, "Water Tower"},
+		{"location", "", &latitude, &longitude, "9.935,-84.088"},
+		{"latitude only", "", &latitude, nil, unknownSite},
+		{"nothing", "", nil, nil, unknownSite},
+	}
+
+	for _, test := range tests {
+		member := MeshMember{}
+		member.Fields.Site = test.site
+		member.Fields.Latitude = test.latitude
+		member.Fields.Longitude = test.longitude
+		if site := memberSite(member); site != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, site, test.want)
+		}
+	}
+}
+
+func TestSiteUsage(t *testing.T) {
+	member := func(id string, name string, site string, plan float64, location ...float64) MeshMember {
+		member := MeshMember{ID: id}
+		member.Fields.Name = name
+		member.Fields.Site = site
+		member.Fields.PlanMbps = plan
+		if len(location) == 2 {
+			member.Fields.Latitude, member.Fields.Longitude = &location[0], &location[1]
+		}
+		return member
+	}
+	members := []MeshMember{
+		member("rec1", "Alice", "Tower", 50, 10, -84),
+		member("rec2", "Bob", "Tower", 25, 12, -86),
+		member("rec3", "Carol", "Ridge", 50),
+		member("rec4", "Dan", "", 10),
+	}
+
+	current := DashboardSummary{Network: "casa", Members: []MemberSummary{
+		{MemberID: "rec1", Name: "Alice", Up: 10, Down: 20, Total: 30},
+		{Name: "Bob", Up: 5, Down: 5, Total: 10},
+		{MemberID: "rec3", Name: "Carol", Total: 5},
+		{MemberID: "rec9", Name: "Gone", Total: 1},
+	}}
+	previous := DashboardSummary{Network: "casa", Members: []MemberSummary{
+		{MemberID: "rec1", Name: "Alice", Total: 20},
+		{MemberID: "rec2", Name: "Bob", Total: 12},
+	}}
+
+	sites := siteUsage(current, previous, members)
+	if len(sites) != 3 {
+		t.Fatalf("got sites %+v", sites)
+	}
+
+	tower, ridge, unknown := sites[0], sites[1], sites[2]
+	if tower.Site != "Tower" || tower.Members != 2 || tower.PlanMbps != 75 || tower.Up != 15 || tower.Down != 25 || tower.Total != 40 || tower.Previous != 32 {
+		t.Errorf("got Tower %+v", tower)
+	}
+	if tower.Growth == nil || *tower.Growth != 25 {
+		t.Errorf("got Tower's growth %v, want 25", tower.Growth)
+	}
+	if tower.Latitude == nil || *tower.Latitude != 11 || *tower.Longitude != -85 {
+		t.Errorf("got Tower at %v, %v", tower.Latitude, tower.Longitude)
+	}
+	if ridge.Site != "Ridge" || ridge.Total != 5 || ridge.Growth != nil || ridge.Latitude != nil {
+		t.Errorf("got Ridge %+v", ridge)
+	}
+	// Dan has no site, and Gone isn't in Airtable anymore
+	if unknown.Site != unknownSite || unknown.Members != 2 || unknown.Total != 1 {
+		t.Errorf("got unknown %+v", unknown)
+	}
+}
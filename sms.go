@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Kinds of text messages sent to members
+const (
+	smsSummary = "summary"
+	smsWarning = "warning"
+)
+
+// e164 matches phone numbers in international format, the only one Twilio
+// accepts without guessing the country
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// SMSMessage is what the SMS templates are rendered with
+type SMSMessage struct {
+	Name      string
+	From      time.Time
+	To        time.Time
+	Up        float64
+	Down      float64
+	Total     float64
+	Threshold float64
+}
+
+// TwilioClient sends text messages with the Twilio messages API
+type TwilioClient struct {
+	url        string
+	accountSID string
+	authToken  string
+	from       string
+	client     http.Client
+}
+
+func newTwilioClient(settings Settings) (TwilioClient, error) {
+	if settings.TwilioAccountSID == "" || settings.TwilioAuthToken == "" || settings.TwilioFrom == "" {
+		return TwilioClient{}, fmt.Errorf("sending text messages needs TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM")
+	}
+
+	return TwilioClient{
+		url:        strings.TrimSuffix(settings.TwilioURL, "/"),
+		accountSID: settings.TwilioAccountSID,
+		authToken:  settings.TwilioAuthToken,
+		from:       settings.TwilioFrom,
+		client:     http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (c TwilioClient) Send(to string, body string) error {
+	form := url.Values{"To": []string{to}, "From": []string{c.from}, "Body": []string{body}}
+
+	req, err := http.NewRequest(http.MethodPost, c.url+"/2010-04-01/Accounts/"+c.accountSID+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.accountSID, c.authToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		bodyText, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("twilio returned %s: %s", resp.Status, bytes.TrimSpace(bodyText))
+	}
+	return nil
+}
+
+// renderSMS fills in a message template in the language, which dates are
+// written in with the date function
+func renderSMS(text string, language string, message SMSMessage) (string, error) {
+	functions := template.FuncMap{
+		"date": func(t time.Time) string {
+			return formatDate(language, t)
+		},
+	}
+
+	tmpl, err := template.New("sms").Funcs(functions).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, message); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(body.String()), nil
+}
+
+// planSMS renders the messages of the kind for the members who opted in,
+// keyed by phone number, in each member's language unless a template is
+// configured. Warnings only go to members over the threshold. Members
+// sharing a phone, like a household, get one text with all their messages
+func planSMS(settings Settings, kind string, members []MeshMember, usage map[string]SMSMessage) (map[string]string, error) {
+	text := settings.SMSSummaryTemplate
+	if kind == smsWarning {
+		text = settings.SMSWarningTemplate
+	}
+
+	messages := map[string]string{}
+	for _, member := range members {
+		phone := strings.Replace(strings.TrimSpace(member.Fields.Phone), " ", "", -1)
+		if !member.Fields.SMSOptIn || phone == "" {
+			continue
+		}
+		if !e164.MatchString(phone) {
+			log.Printf("Not texting %s, %q is not a phone number like +15551234567", member.Fields.Name, member.Fields.Phone)
+			continue
+		}
+
+		message, ok := usage[member.ID]
+		if !ok || (kind == smsWarning && message.Total < settings.SMSWarningThreshold) {
+			continue
+		}
+
+		language := memberLanguage(settings, member)
+		memberText := text
+		if memberText == "" {
+			memberText = catalogMessage(language, "sms."+kind)
+		}
+
+		body, err := renderSMS(memberText, language, message)
+		if err != nil {
+			return nil, err
+		}
+		if previous, ok := messages[phone]; ok {
+			log.Printf("Texting %s in one message with the other members sharing %s", member.Fields.Name, phone)
+			body = previous + "\n\n" + body
+		}
+		messages[phone] = body
+	}
+	return messages, nil
+}
+
+// smsCommand texts members who opted in a summary of their usage over the
+// window, or with -kind warning a warning if it went over
+// SMS_WARNING_THRESHOLD GB
+func smsCommand(args []string) {
+	flags := flag.NewFlagSet("sms", flag.ExitOnError)
+	kind := flags.String("kind", smsSummary, "message to send: summary or warning")
+	dryRun := flags.Bool("dry-run", false, "print the messages instead of sending them")
+	flags.Parse(args)
+
+	if *kind != smsSummary && *kind != smsWarning {
+		fatal(fmt.Sprintf("invalid -kind %q, expected %s or %s", *kind, smsSummary, smsWarning))
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	// Catalogs are shared by every network
+	if err := loadMessageCatalogs(loadProcessSettings().MessageCatalogs); err != nil {
+		fatal(err)
+	}
+
+	for _, settings := range loadAllNetworkSettings() {
+		smsNetwork(settings, *kind, from, to, *dryRun)
+	}
+}
+
+func smsNetwork(settings Settings, kind string, from time.Time, to time.Time, dryRun bool) {
+	var twilio TwilioClient
+	if !dryRun {
+		var err error
+		if twilio, err = newTwilioClient(settings); err != nil {
+			fatal(err)
+		}
+	}
+
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	bwupCollection, err := getReadBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	usage := map[string]SMSMessage{}
+	for _, member := range members {
+		if !member.Fields.SMSOptIn {
+			continue
+		}
+
+		name := strings.TrimSpace(member.Fields.Name)
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, member.ID, name, from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		// A member whose usage couldn't be collected isn't told they used nothing
+		update := memberActivity(periods, from, to)
+		if update.Activity == activityUnknown {
+			continue
+		}
+		usage[member.ID] = SMSMessage{Name: name, From: from, To: to, Up: update.Up, Down: update.Down, Total: update.Total, Threshold: settings.SMSWarningThreshold}
+	}
+
+	messages, err := planSMS(settings, kind, members, usage)
+	if err != nil {
+		fatal(err)
+	}
+
+	sent := 0
+	for phone, body := range messages {
+		if dryRun {
+			fmt.Printf("%s: %s\n", phone, body)
+			continue
+		}
+		if err := twilio.Send(phone, body); err != nil {
+			log.Printf("Error texting %s: %v", phone, err)
+			continue
+		}
+		sent++
+	}
+
+	log.Printf("Texted %d of %d %s messages for network %s", sent, len(messages), kind, settings.Network)
+}
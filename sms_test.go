@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func smsTestSettings() Settings {
+	settings, _ := readSettings("casa", settingsEnv{})
+	settings.SMSWarningThreshold = 50
+	return settings
+}
+
+func smsMember(id string, name string, phone string, optIn bool) MeshMember {
+	member := MeshMember{ID: id}
+	member.Fields.Name = name
+	member.Fields.Phone = phone
+	member.Fields.SMSOptIn = optIn
+	return member
+}
+
+func TestPlanSMS(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	members := []MeshMember{
+		smsMember("recA", "Alice", "+1 555 123 4567", true),
+		smsMember("recB", "Bob", "+15559876543", true),
+		smsMember("recC", "Carol", "+15550001111", false),
+		smsMember("recD", "Dave", "555-0000", true),
+		smsMember("recE", "Erin", "", true),
+		smsMember("recF", "Frank", "+15552223333", true),
+	}
+	usage := map[string]SMSMessage{
+		"recA": {Name: "Alice", From: from, To: to, Total: 72.25, Threshold: 50},
+		"recB": {Name: "Bob", From: from, To: to, Total: 3, Threshold: 50},
+		"recC": {Name: "Carol", From: from, To: to, Total: 90, Threshold: 50},
+		"recD": {Name: "Dave", From: from, To: to, Total: 90, Threshold: 50},
+		"recE": {Name: "Erin", From: from, To: to, Total: 90, Threshold: 50},
+	}
+
+	summaries, err := planSMS(smsTestSettings(), smsSummary, members, usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"+15551234567": "Hi Alice, you used 72.2 GB from Sep 1 to Oct 1.",
+		"+15559876543": "Hi Bob, you used 3.0 GB from Sep 1 to Oct 1.",
+	}
+	if len(summaries) != len(want) {
+		t.Errorf("got %v, want %v", summaries, want)
+	}
+	for phone, body := range want {
+		if summaries[phone] != body {
+			t.Errorf("%s: got %q, want %q", phone, summaries[phone], body)
+		}
+	}
+
+	warnings, err := planSMS(smsTestSettings(), smsWarning, members, usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings["+15551234567"] != "Hi Alice, you used 72.2 GB since Sep 1, over the 50 GB limit." {
+		t.Errorf("got warnings %v", warnings)
+	}
+
+	// Members sharing a phone get one text, neither message lost
+	shared, err := planSMS(smsTestSettings(), smsSummary, []MeshMember{members[0], smsMember("recG", "Grace", "+15551234567", true)}, map[string]SMSMessage{
+		"recA": usage["recA"],
+		"recG": {Name: "Grace", From: from, To: to, Total: 10, Threshold: 50},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hi Alice, you used 72.2 GB from Sep 1 to Oct 1.\n\nHi Grace, you used 10.0 GB from Sep 1 to Oct 1."; len(shared) != 1 || shared["+15551234567"] != want {
+		t.Errorf("got %q", shared)
+	}
+
+	settings := smsTestSettings()
+	settings.SMSSummaryTemplate = "{{.Missing}}"
+	if _, err := planSMS(settings, smsSummary, members, usage); err == nil {
+		t.Error("a template using a missing field should fail")
+	}
+}
+
+func TestTwilioClient(t *testing.T) {
+	var path, to, body, user string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		user, _, _ = r.BasicAuth()
+		r.ParseForm()
+		to, body = r.PostForm.Get("To"), r.PostForm.Get("Body")
+
+		if to == "+15550000000" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": 21211, "message": "The 'To' number is not a valid phone number."}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	settings := Settings{TwilioURL: server.URL, TwilioAccountSID: "AC123", TwilioAuthToken: "token", TwilioFrom: "+15557654321"}
+	twilio, err := newTwilioClient(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := twilio.Send("+15551234567", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/2010-04-01/Accounts/AC123/Messages.json" || user != "AC123" || to != "+15551234567" || body != "hello" {
+		t.Errorf("got %s as %s to %s: %s", path, user, to, body)
+	}
+
+	if err := twilio.Send("+15550000000", "hello"); err == nil {
+		t.Error("a refused message should fail")
+	}
+
+	if _, err := newTwilioClient(Settings{}); err == nil {
+		t.Error("a client without credentials should fail")
+	}
+}
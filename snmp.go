@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ASN.1 BER tags used by SNMPv2c
+const (
+	berInteger        = 0x02
+	berOctetString    = 0x04
+	berNull           = 0x05
+	berObjectID       = 0x06
+	berSequence       = 0x30
+	berCounter32      = 0x41
+	berGauge32        = 0x42
+	berCounter64      = 0x46
+	snmpGetRequest    = 0xa0
+	snmpGetResponse   = 0xa2
+	snmpNoSuchObject  = 0x80
+	snmpNoSuchInst    = 0x81
+	snmpEndOfMibView  = 0x82
+	snmpVersion2c     = 1
+	oidIfHCInOctets   = "1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCOutOctets  = "1.3.6.1.2.1.31.1.1.1.10"
+	snmpTimeout       = 5 * time.Second
+	snmpMaxPacketSize = 65535
+)
+
+// SNMPTarget is an interface on an exit or upstream router whose octet
+// counters are polled. It is configured as name=host:port/ifIndex
+type SNMPTarget struct {
+	Name    string
+	Address string
+	IfIndex int
+}
+
+func parseSNMPTargets(targets []string) ([]SNMPTarget, error) {
+	parsed := []SNMPTarget{}
+
+	for _, target := range targets {
+		parts := strings.SplitN(target, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid SNMP target %q, expected name=host:port/ifIndex", target)
+		}
+
+		slash := strings.LastIndex(parts[1], "/")
+		if slash == -1 {
+			return nil, fmt.Errorf("invalid SNMP target %q, expected name=host:port/ifIndex", target)
+		}
+
+		ifIndex, err := strconv.Atoi(parts[1][slash+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface index in SNMP target %q: %v", target, err)
+		}
+
+		address := parts[1][:slash]
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "161")
+		}
+
+		parsed = append(parsed, SNMPTarget{Name: parts[0], Address: address, IfIndex: ifIndex})
+	}
+
+	return parsed, nil
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	lengthBytes := []byte{}
+	for n > 0 {
+		lengthBytes = append([]byte{byte(n)}, lengthBytes...)
+		n >>= 8
+	}
+	return append([]byte{0x80 | byte(len(lengthBytes))}, lengthBytes...)
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	return append(append([]byte{tag}, berLength(len(value))...), value...)
+}
+
+func berInt(n int64) []byte {
+	value := []byte{byte(n)}
+	for n > 127 || n < -128 {
+		n >>= 8
+		value = append([]byte{byte(n)}, value...)
+	}
+	return berTLV(berInteger, value)
+}
+
+func berOID(oid string) ([]byte, error) {
+	arcs := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(arcs) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", oid)
+	}
+
+	numbers := make([]uint64, len(arcs))
+	for i, arc := range arcs {
+		n, err := strconv.ParseUint(arc, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q: %v", oid, err)
+		}
+		numbers[i] = n
+	}
+
+	// The first two arcs share a subidentifier, which only works out when
+	// the first is 0, 1 or 2 and the second below 40 unless the first is 2
+	if numbers[0] > 2 || (numbers[0] < 2 && numbers[1] >= 40) {
+		return nil, fmt.Errorf("invalid OID %q", oid)
+	}
+
+	value := []byte{}
+	for _, n := range append([]uint64{numbers[0]*40 + numbers[1]}, numbers[2:]...) {
+		encoded := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			encoded = append([]byte{byte(n&0x7f) | 0x80}, encoded...)
+		}
+		value = append(value, encoded...)
+	}
+
+	return berTLV(berObjectID, value), nil
+}
+
+// readTLV splits the first BER element off data
+func readTLV(data []byte) (tag byte, value []byte, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated SNMP packet")
+	}
+
+	tag = data[0]
+	length := int(data[1])
+	offset := 2
+
+	if length&0x80 != 0 {
+		lengthBytes := length & 0x7f
+		if lengthBytes == 0 || lengthBytes > 4 || len(data) < 2+lengthBytes {
+			return 0, nil, nil, fmt.Errorf("invalid length in SNMP packet")
+		}
+		length = 0
+		for _, b := range data[2 : 2+lengthBytes] {
+			length = length<<8 | int(b)
+		}
+		offset += lengthBytes
+	}
+
+	if len(data) < offset+length {
+		return 0, nil, nil, fmt.Errorf("truncated SNMP packet")
+	}
+
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// snmpGet fetches the given OIDs from an SNMPv2c agent and returns their
+// values, which must all be integers or counters
+func snmpGet(address string, community string, oids []string) ([]uint64, error) {
+	requestID := rand.Int31()
+
+	varbinds := []byte{}
+	for _, oid := range oids {
+		encoded, err := berOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		varbinds = append(varbinds, berTLV(berSequence, append(encoded, berTLV(berNull, nil)...))...)
+	}
+
+	pdu := append(berInt(int64(requestID)), berInt(0)...)
+	pdu = append(pdu, berInt(0)...)
+	pdu = append(pdu, berTLV(berSequence, varbinds)...)
+
+	message := append(berInt(snmpVersion2c), berTLV(berOctetString, []byte(community))...)
+	message = append(message, berTLV(snmpGetRequest, pdu)...)
+	packet := berTLV(berSequence, message)
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(snmpTimeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, snmpMaxPacketSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSNMPResponse(buffer[:n], requestID, len(oids))
+}
+
+func parseSNMPResponse(packet []byte, requestID int32, count int) ([]uint64, error) {
+	_, message, _, err := readTLV(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the version and community
+	for i := 0; i < 2; i++ {
+		if _, _, message, err = readTLV(message); err != nil {
+			return nil, err
+		}
+	}
+
+	tag, pdu, _, err := readTLV(message)
+	if err != nil {
+		return nil, err
+	}
+	if tag != snmpGetResponse {
+		return nil, fmt.Errorf("unexpected SNMP PDU type 0x%x", tag)
+	}
+
+	header := make([]uint64, 3)
+	for i := range header {
+		var value []byte
+		if _, value, pdu, err = readTLV(pdu); err != nil {
+			return nil, err
+		}
+		header[i] = readUint(value)
+	}
+
+	if int32(header[0]) != requestID {
+		return nil, fmt.Errorf("SNMP response is for another request")
+	}
+	if header[1] != 0 {
+		return nil, fmt.Errorf("SNMP agent returned error status %d for varbind %d", header[1], header[2])
+	}
+
+	_, varbinds, _, err := readTLV(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []uint64{}
+	for len(varbinds) > 0 {
+		var varbind []byte
+		if _, varbind, varbinds, err = readTLV(varbinds); err != nil {
+			return nil, err
+		}
+
+		_, _, valueTLV, err := readTLV(varbind)
+		if err != nil {
+			return nil, err
+		}
+
+		tag, value, _, err := readTLV(valueTLV)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case berInteger, berCounter32, berGauge32, berCounter64:
+			values = append(values, readUint(value))
+		case snmpNoSuchObject, snmpNoSuchInst, snmpEndOfMibView:
+			return nil, fmt.Errorf("SNMP agent has no such object")
+		default:
+			return nil, fmt.Errorf("unexpected SNMP value type 0x%x", tag)
+		}
+	}
+
+	if len(values) != count {
+		return nil, fmt.Errorf("SNMP agent returned %d values, expected %d", len(values), count)
+	}
+
+	return values, nil
+}
+
+// SNMPSample is a reading of an interface's octet counters
+type SNMPSample struct {
+	Network   string
+	Target    string
+	Time      time.Time
+	InOctets  uint64
+	OutOctets uint64
+}
+
+func pollSNMPTarget(settings Settings, target SNMPTarget) (SNMPSample, error) {
+	index := strconv.Itoa(target.IfIndex)
+
+	values, err := snmpGet(target.Address, settings.SNMPCommunity, []string{
+		oidIfHCInOctets + "." + index,
+		oidIfHCOutOctets + "." + index,
+	})
+	if err != nil {
+		return SNMPSample{}, err
+	}
+
+	return SNMPSample{
+		Network:   settings.Network,
+		Target:    target.Name,
+		Time:      time.Now(),
+		InOctets:  values[0],
+		OutOctets: values[1],
+	}, nil
+}
+
+// snmpCommand polls the configured router interfaces until stopped, saving
+// each reading so exit level usage can be computed for any window
+func snmpCommand(args []string) {
+	settings := loadSettings()
+
+	targets, err := parseSNMPTargets(settings.SNMPTargets)
+	if err != nil {
+		fatal(err)
+	}
+	if len(targets) == 0 {
+		fatal("SNMP_TARGETS must name at least one interface to poll")
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	collection := db.Collection(settings.SNMPCollection)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(settings.SNMPPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, target := range targets {
+			sample, err := pollSNMPTarget(settings, target)
+			if err != nil {
+				log.Printf("Error polling %s: %v", target.Name, err)
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, err = collection.InsertOne(ctx, sample)
+			cancel()
+			if err != nil {
+				log.Printf("Error saving sample for %s: %v", target.Name, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-signals:
+			return
+		}
+	}
+}
+
+// counterDelta is the increase between two readings of a counter. A drop
+// means the router restarted, in which case the new reading is all we know
+func counterDelta(previous uint64, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// ExitUsagePeriod is the traffic an exit or upstream interface carried over
+// a window. Octets into the upstream interface were downloaded by the mesh,
+// octets out of it were uploaded
+type ExitUsagePeriod struct {
+	Network  string
+	Name     string
+	From     time.Time
+	To       time.Time
+	Duration time.Duration
+	Up       *float64
+	Down     *float64
+	Total    *float64
+	Samples  int
+}
+
+// getExitUsage computes a target's usage from the samples taken during the
+// window. It returns nil sums if fewer than two samples were taken
+func getExitUsage(collection *mongo.Collection, network string, target string, from time.Time, to time.Time) (ExitUsagePeriod, error) {
+	usage := ExitUsagePeriod{Network: network, Name: target, From: from, To: to, Duration: to.Sub(from)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx,
+		bson.M{"network": networkMatch(network), "target": target, "time": bson.M{"$gte": from, "$lte": to}},
+		options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		return usage, err
+	}
+	defer cursor.Close(ctx)
+
+	var previous *SNMPSample
+	var in, out uint64
+	for cursor.Next(ctx) {
+		var sample SNMPSample
+		if err := cursor.Decode(&sample); err != nil {
+			return usage, err
+		}
+		usage.Samples++
+
+		if previous != nil {
+			in += counterDelta(previous.InOctets, sample.InOctets)
+			out += counterDelta(previous.OutOctets, sample.OutOctets)
+		}
+		previous = &sample
+	}
+	if err := cursor.Err(); err != nil {
+		return usage, err
+	}
+
+	if usage.Samples < 2 {
+		return usage, nil
+	}
+
+	down := bytesToGb(float64(in))
+	up := bytesToGb(float64(out))
+	total := up + down
+	usage.Up, usage.Down, usage.Total = &up, &down, &total
+
+	return usage, nil
+}
+
+// recordExitUsage stores the usage of every polled interface over the
+// settings window, for cross-checking against the sum of member usage
+func recordExitUsage(settings Settings, db *mongo.Database) ([]ExitUsagePeriod, error) {
+	targets, err := parseSNMPTargets(settings.SNMPTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := db.Collection(settings.SNMPCollection)
+	exitUsage := db.Collection(settings.MongoExitUsageCollection)
+
+	periods := []ExitUsagePeriod{}
+	for _, target := range targets {
+		usage, err := getExitUsage(samples, settings.Network, target.Name, settings.From, settings.To)
+		if err != nil {
+			return periods, err
+		}
+
+		if usage.Total == nil {
+			log.Printf("Not enough SNMP samples for %s to compute its usage", target.Name)
+			continue
+		}
+
+		printJSON(os.Stdout, usage)
+
+		// Re-running a window replaces its usage rather than adding to it
+		filter := bson.M{"network": networkMatch(usage.Network), "name": encryptName(usage.Network, usage.Name), "from": usage.From, "to": usage.To}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = exitUsage.ReplaceOne(ctx, filter, usage, options.Replace().SetUpsert(true))
+		cancel()
+		if err != nil {
+			return periods, err
+		}
+
+		periods = append(periods, usage)
+	}
+
+	return periods, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBerOID(t *testing.T) {
+	tests := []struct {
+		oid     string
+		encoded []byte
+		valid   bool
+	}{
+		{"1.3.6.1.2.1.31.1.1.1.6", []byte{0x06, 0x0a, 0x2b, 6, 1, 2, 1, 31, 1, 1, 1, 6}, true},
+		{".1.3.6.1.4.1.2021", []byte{0x06, 0x07, 0x2b, 6, 1, 4, 1, 0x8f, 0x65}, true},
+		{"2.999.3", []byte{0x06, 0x03, 0x88, 0x37, 3}, true},
+		{"1", nil, false},
+		{"1.3.x", nil, false},
+		{"1.3.-1", nil, false},
+		{"3.1", nil, false},
+		{"1.40", nil, false},
+		{"1.3.4294967296", nil, false},
+	}
+
+	for _, test := range tests {
+		encoded, err := berOID(test.oid)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.oid, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.oid)
+			}
+			continue
+		}
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("%s: got % x, want % x", test.oid, encoded, test.encoded)
+		}
+	}
+}
+
+func TestReadTLV(t *testing.T) {
+	long := make([]byte, 300)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		value []byte
+		rest  []byte
+		valid bool
+	}{
+		{"short form", []byte{0x04, 2, 'h', 'i', 9}, []byte("hi"), []byte{9}, true},
+		{"long form", append([]byte{0x04, 0x82, 0x01, 0x2c}, long...), long, []byte{}, true},
+		{"empty", []byte{}, nil, nil, false},
+		{"tag only", []byte{0x04}, nil, nil, false},
+		{"value truncated", []byte{0x04, 3, 'h', 'i'}, nil, nil, false},
+		{"length truncated", []byte{0x04, 0x82, 0x01}, nil, nil, false},
+		{"indefinite length", []byte{0x30, 0x80, 0, 0}, nil, nil, false},
+		{"oversized length", []byte{0x04, 0x85, 1, 0, 0, 0, 0}, nil, nil, false},
+		{"length beyond data", []byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}, nil, nil, false},
+	}
+
+	for _, test := range tests {
+		_, value, rest, err := readTLV(test.data)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		if !bytes.Equal(value, test.value) || !bytes.Equal(rest, test.rest) {
+			t.Errorf("%s: got % x and % x, want % x and % x", test.name, value, rest, test.value, test.rest)
+		}
+	}
+}
+
+// snmpResponse builds a GetResponse with the given request ID, error status
+// and encoded varbind values
+func snmpResponse(pduType byte, requestID int64, errorStatus int64, values ...[]byte) []byte {
+	varbinds := []byte{}
+	for _, value := range values {
+		oid, _ := berOID(oidIfHCInOctets + ".1")
+		varbinds = append(varbinds, berTLV(berSequence, append(oid, value...))...)
+	}
+
+	pdu := append(berInt(requestID), berInt(errorStatus)...)
+	pdu = append(pdu, berInt(0)...)
+	pdu = append(pdu, berTLV(berSequence, varbinds)...)
+
+	message := append(berInt(snmpVersion2c), berTLV(berOctetString, []byte("public"))...)
+	message = append(message, berTLV(pduType, pdu)...)
+	return berTLV(berSequence, message)
+}
+
+func TestParseSNMPResponse(t *testing.T) {
+	counter64 := berTLV(berCounter64, []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	counter32 := berTLV(berCounter32, []byte{0x01, 0x00})
+	valid := snmpResponse(snmpGetResponse, 1234, 0, counter64, counter32)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		count  int
+		values []uint64
+		valid  bool
+	}{
+		{"counters", valid, 2, []uint64{1<<64 - 1, 256}, true},
+		{"gauge and integer", snmpResponse(snmpGetResponse, 1234, 0, berTLV(berGauge32, []byte{7}), berInt(42)), 2, []uint64{7, 42}, true},
+		{"other request", snmpResponse(snmpGetResponse, 99, 0, counter64), 1, nil, false},
+		{"error status", snmpResponse(snmpGetResponse, 1234, 2, counter64), 1, nil, false},
+		{"not a response", snmpResponse(snmpGetRequest, 1234, 0, counter64), 1, nil, false},
+		{"no such object", snmpResponse(snmpGetResponse, 1234, 0, []byte{snmpNoSuchObject, 0}), 1, nil, false},
+		{"no such instance", snmpResponse(snmpGetResponse, 1234, 0, []byte{snmpNoSuchInst, 0}), 1, nil, false},
+		{"string value", snmpResponse(snmpGetResponse, 1234, 0, berTLV(berOctetString, []byte("eth0"))), 1, nil, false},
+		{"missing value", snmpResponse(snmpGetResponse, 1234, 0, counter64), 2, nil, false},
+		{"extra value", valid, 1, nil, false},
+		{"truncated", valid[:len(valid)-3], 2, nil, false},
+		{"empty", []byte{}, 1, nil, false},
+		{"garbage", []byte{0x30, 0x03, 0x02, 0x01}, 1, nil, false},
+	}
+
+	for _, test := range tests {
+		values, err := parseSNMPResponse(test.packet, 1234, test.count)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%s: got %v, want %v", test.name, values, test.values)
+		}
+	}
+}
+
+func TestParseSNMPResponseTruncations(t *testing.T) {
+	packet := snmpResponse(snmpGetResponse, 1234, 0, berTLV(berCounter64, []byte{1, 2, 3, 4}))
+
+	// No prefix of a response may panic or decode as a whole one
+	for n := 0; n < len(packet); n++ {
+		if _, err := parseSNMPResponse(packet[:n], 1234, 1); err == nil {
+			t.Errorf("a response truncated to %d bytes decoded", n)
+		}
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	if got := counterDelta(100, 250); got != 150 {
+		t.Errorf("got %d, want 150", got)
+	}
+	// A counter going backwards was reset, so counted from zero
+	if got := counterDelta(1000, 40); got != 40 {
+		t.Errorf("got %d after a reset, want 40", got)
+	}
+}
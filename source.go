@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Stat sources, selected with STAT_SOURCE
+const (
+	statSourceGraylog    = "graylog"
+	statSourceLoki       = "loki"
+	statSourceClickHouse = "clickhouse"
+	statSourceNetflow    = "netflow"
+)
+
+// StatSource looks up how much traffic a member sent or received
+type StatSource interface {
+	// Sum returns the gigabytes transferred by the member in the given
+	// direction ("up" or "down") between from and to, or nil if no traffic
+	// was found. An error means the source couldn't tell, which is not the
+	// same as no traffic
+	Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error)
+}
+
+// CountingSource is implemented by stat sources which can also count the
+// log messages a sum was made from, to catch log format drift
+type CountingSource interface {
+	SumWithCount(member MeshMember, direction string, from time.Time, to time.Time) (*float64, int64, error)
+}
+
+// CanarySource is implemented by stat sources which can count every message
+// of the window, to check the log pipeline was up before trusting it
+type CanarySource interface {
+	CountMessages(from time.Time, to time.Time) (int64, error)
+}
+
+// ExitTotalSource is implemented by stat sources which can also sum the
+// traffic of every peer of the exits together
+type ExitTotalSource interface {
+	ExitSum(direction string, from time.Time, to time.Time) (*float64, error)
+}
+
+// BatchSource is implemented by stat sources which can sum the traffic of
+// every member with a few grouped queries, rather than a query per member
+type BatchSource interface {
+	// SumAll returns the sum of each member, in the order of members
+	SumAll(members []MeshMember, direction string, from time.Time, to time.Time) ([]MemberSum, error)
+	// CanSumAll checks grouped queries are supported, saying why if not
+	CanSumAll() error
+}
+
+// MemberSum is a member's traffic in one direction as summed by a
+// BatchSource, nil if none was found, and the messages it was summed from
+type MemberSum struct {
+	Sum   *float64
+	Count int64
+}
+
+func newStatSource(settings Settings) (StatSource, error) {
+	if !validMemberIdentity(settings.MemberIdentity) {
+		return nil, fmt.Errorf("invalid MEMBER_IDENTITY %q, expected wg-key, router-mac, static-ip, hostname or mesh-ip", settings.MemberIdentity)
+	}
+
+	switch settings.StatSource {
+	case "", statSourceGraylog:
+		settings, err := resolveSavedSearches(settings)
+		if err != nil {
+			return nil, err
+		}
+		return GraylogSource{settings: settings}, nil
+	case statSourceLoki:
+		return LokiSource{settings: settings}, nil
+	case statSourceClickHouse:
+		return ClickHouseSource{settings: settings}, nil
+	case statSourceNetflow:
+		db, err := getMongoDatabase(settings)
+		if err != nil {
+			return nil, err
+		}
+		return NetflowSource{
+			network:    settings.Network,
+			collection: db.Collection(settings.NetflowCollection),
+			histograms: db.Collection(settings.NetflowHistogramCollection),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid STAT_SOURCE %q", settings.StatSource)
+}
+
+// batchedSource answers the queries of each member from the sums a
+// BatchSource made for every member, by direction and query chunk. Members
+// whose overrides change their queries are queried from source
+type batchedSource struct {
+	settings Settings
+	sums     map[string]MemberSum
+	source   StatSource
+}
+
+func batchedSumKey(wgKey string, direction string, from time.Time) string {
+	return wgKey + "|" + direction + "|" + from.UTC().Format(time.RFC3339Nano)
+}
+
+func (s batchedSource) Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error) {
+	sum, _, err := s.SumWithCount(member, direction, from, to)
+	return sum, err
+}
+
+func (s batchedSource) SumWithCount(member MeshMember, direction string, from time.Time, to time.Time) (*float64, int64, error) {
+	if member.Override.queried() {
+		if counter, ok := s.source.(CountingSource); ok {
+			return counter.SumWithCount(member, direction, from, to)
+		}
+		sum, err := s.source.Sum(member, direction, from, to)
+		return sum, 0, err
+	}
+
+	key, err := memberIdentity(s.settings, member)
+	if err != nil {
+		return nil, 0, err
+	}
+	sum, ok := s.sums[batchedSumKey(key, direction, from)]
+	if !ok {
+		return nil, 0, fmt.Errorf("no grouped %s sum of %s from %s", direction, member.Fields.Name, from.Format(time.RFC3339))
+	}
+	return sum.Sum, sum.Count, nil
+}
+
+// chooseQueryStrategy picks how members are queried. The auto strategy
+// groups members with terms queries once there are at least
+// GRAYLOG_TERMS_MIN_MEMBERS of them and the source can group them, and
+// queries each member otherwise, which is as quick for a few members and
+// works with every query mode and Graylog version
+func chooseQueryStrategy(settings Settings, source StatSource, members []MeshMember) (string, error) {
+	switch settings.GraylogQueryStrategy {
+	case queryStrategyMember, queryStrategyTerms:
+		return settings.GraylogQueryStrategy, nil
+	case "", queryStrategyAuto:
+	default:
+		return "", fmt.Errorf("invalid GRAYLOG_QUERY_STRATEGY %q, expected auto, member or terms", settings.GraylogQueryStrategy)
+	}
+
+	batcher, ok := source.(BatchSource)
+	if !ok || len(members) < settings.GraylogTermsMinMembers {
+		return queryStrategyMember, nil
+	}
+	if err := batcher.CanSumAll(); err != nil {
+		log.Printf("Querying each member, as grouped queries aren't available: %v", err)
+		return queryStrategyMember, nil
+	}
+	return queryStrategyTerms, nil
+}
+
+// batchSums sums every member's traffic over the settings' window with the
+// source's grouped queries, when the query strategy chosen is terms,
+// returning a source answering each member from the sums. Otherwise, or if
+// the grouped queries fail, members are queried one at a time from the
+// source as is
+func batchSums(settings Settings, source StatSource, members []MeshMember) (StatSource, error) {
+	strategy, err := chooseQueryStrategy(settings, source, members)
+	if err != nil {
+		return nil, err
+	}
+	batcher, ok := source.(BatchSource)
+	if strategy != queryStrategyTerms || !ok {
+		return source, nil
+	}
+
+	grouped := []MeshMember{}
+	for _, member := range members {
+		if !member.Override.queried() {
+			grouped = append(grouped, member)
+		}
+	}
+	log.Printf("Querying %d members with grouped terms queries", len(grouped))
+
+	batched := batchedSource{settings: settings, sums: map[string]MemberSum{}, source: source}
+	for _, window := range queryChunks(settings.From, settings.To, settings.QueryChunk) {
+		for _, direction := range []string{"up", "down"} {
+			sums, err := batcher.SumAll(grouped, direction, window.From, window.To)
+			if err != nil {
+				log.Printf("WARNING: grouped queries failed, querying each member instead: %v", err)
+				return source, nil
+			}
+			for i, member := range grouped {
+				if key, err := memberIdentity(settings, member); err == nil {
+					batched.sums[batchedSumKey(key, direction, window.From)] = sums[i]
+				}
+			}
+		}
+	}
+
+	return batched, nil
+}
+
+// checkMessageCounts looks for signs that the log format drifted away from
+// what the queries expect: messages without usage, or far more usage per
+// message than an exit could log
+func checkMessageCounts(settings Settings, bwup BandwidthUsagePeriod) []string {
+	if bwup.Counts == nil {
+		return nil
+	}
+
+	warnings := []string{}
+	for _, direction := range []struct {
+		name  string
+		sum   *float64
+		count int64
+	}{
+		{"up", bwup.Up, bwup.Counts.Up},
+		{"down", bwup.Down, bwup.Counts.Down},
+	} {
+		if direction.count == 0 {
+			continue
+		}
+
+		if direction.sum == nil || *direction.sum == 0 {
+			warnings = append(warnings, fmt.Sprintf("%d %s messages matched but summed to nothing", direction.count, direction.name))
+			continue
+		}
+
+		perMessage := *direction.sum * 1000000000 / float64(direction.count)
+		if perMessage > settings.MaxBytesPerMessage {
+			warnings = append(warnings, fmt.Sprintf("%.0f bytes per %s message, more than the %.0f expected at most", perMessage, direction.name, settings.MaxBytesPerMessage))
+		}
+	}
+
+	return warnings
+}
+
+// timeWindow is a part of a longer window
+type timeWindow struct {
+	From time.Time
+	To   time.Time
+}
+
+// splitWindow splits a window into consecutive chunks no longer than chunk,
+// the last one possibly shorter. A chunk of 0 leaves the window whole
+func splitWindow(from time.Time, to time.Time, chunk time.Duration) []timeWindow {
+	if chunk <= 0 || !to.After(from) {
+		return []timeWindow{{From: from, To: to}}
+	}
+
+	windows := []timeWindow{}
+	for start := from; start.Before(to); start = start.Add(chunk) {
+		end := start.Add(chunk)
+		if end.After(to) {
+			end = to
+		}
+		windows = append(windows, timeWindow{From: start, To: end})
+	}
+	return windows
+}
+
+// queryChunks splits a window into the chunks it is queried in. Sources
+// include both ends of a range, so every chunk but the last stops a
+// millisecond before the next one starts, counting each message once
+func queryChunks(from time.Time, to time.Time, chunk time.Duration) []timeWindow {
+	windows := splitWindow(from, to, chunk)
+	for i := 0; i < len(windows)-1; i++ {
+		windows[i].To = windows[i].To.Add(-time.Millisecond)
+	}
+	return windows
+}
+
+// exitSum adds up the exit totals of a window a chunk at a time
+func exitSum(settings Settings, source ExitTotalSource, direction string) (*float64, error) {
+	var total *float64
+	for _, window := range queryChunks(settings.From, settings.To, settings.QueryChunk) {
+		sum, err := source.ExitSum(direction, window.From, window.To)
+		if err != nil {
+			return nil, err
+		}
+		total = addSums(total, sum)
+	}
+	return total, nil
+}
+
+// addSums adds two optional sums, leaving the result nil only if both are nil
+func addSums(a *float64, b *float64) *float64 {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	sum := *a + *b
+	return &sum
+}
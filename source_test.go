@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSplitWindow(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+
+	tests := []struct {
+		name    string
+		from    time.Time
+		to      time.Time
+		chunk   time.Duration
+		windows []timeWindow
+	}{
+		{"no chunking", at(0), at(48), 0, []timeWindow{{at(0), at(48)}}},
+		{"even chunks", at(0), at(48), 24 * time.Hour, []timeWindow{{at(0), at(24)}, {at(24), at(48)}}},
+		{"shorter last chunk", at(0), at(30), 24 * time.Hour, []timeWindow{{at(0), at(24)}, {at(24), at(30)}}},
+		{"chunk longer than window", at(0), at(6), 24 * time.Hour, []timeWindow{{at(0), at(6)}}},
+		{"empty window", at(6), at(6), time.Hour, []timeWindow{{at(6), at(6)}}},
+	}
+
+	for _, test := range tests {
+		checkWindows(t, test.name, splitWindow(test.from, test.to, test.chunk), test.windows)
+	}
+}
+
+func TestQueryChunks(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	// No message on a boundary may be counted by two chunks
+	got := queryChunks(start, start.Add(60*time.Hour), day)
+	checkWindows(t, "chunked", got, []timeWindow{
+		{start, start.Add(day - time.Millisecond)},
+		{start.Add(day), start.Add(2*day - time.Millisecond)},
+		{start.Add(2 * day), start.Add(60 * time.Hour)},
+	})
+
+	// A window queried whole keeps its end
+	checkWindows(t, "whole", queryChunks(start, start.Add(day), 0), []timeWindow{{start, start.Add(day)}})
+}
+
+func checkWindows(t *testing.T, name string, got []timeWindow, want []timeWindow) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d windows, want %d: %+v", name, len(got), len(want), got)
+		return
+	}
+	for i := range want {
+		if !got[i].From.Equal(want[i].From) || !got[i].To.Equal(want[i].To) {
+			t.Errorf("%s: window %d is %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+// fakeBatchSource sums every member the same, failing if told to, and
+// can't group queries if unsupported
+type fakeBatchSource struct {
+	sum         float64
+	fails       bool
+	unsupported bool
+}
+
+func (s fakeBatchSource) CanSumAll() error {
+	if s.unsupported {
+		return fmt.Errorf("grouped queries unsupported")
+	}
+	return nil
+}
+
+func (s fakeBatchSource) Sum(member MeshMember, direction string, from time.Time, to time.Time) (*float64, error) {
+	return nil, nil
+}
+
+func (s fakeBatchSource) SumAll(members []MeshMember, direction string, from time.Time, to time.Time) ([]MemberSum, error) {
+	if s.fails {
+		return nil, fmt.Errorf("grouped query failed")
+	}
+	sums := []MemberSum{}
+	for range members {
+		sum := s.sum
+		sums = append(sums, MemberSum{Sum: &sum, Count: 1})
+	}
+	return sums, nil
+}
+
+func TestBatchSums(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	settings := Settings{From: from, To: from.Add(3 * time.Hour), QueryChunk: time.Hour, GraylogQueryStrategy: queryStrategyTerms}
+	member := MeshMember{ID: "rec1"}
+	member.Fields.WGKey = "key1"
+
+	source, err := batchSums(settings, fakeBatchSource{sum: 2}, []MeshMember{member})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := source.(batchedSource); !ok {
+		t.Fatalf("got a %T, want the batched sums", source)
+	}
+	up, down, total, counts, err := getBandwidthSums(settings, source, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three chunks of 2 GB in each direction
+	if *up != 6 || *down != 6 || *total != 12 || *counts != (MessageCounts{Up: 3, Down: 3}) {
+		t.Errorf("got %v up, %v down, %v total and %+v counts", *up, *down, *total, *counts)
+	}
+
+	source, err = batchSums(settings, fakeBatchSource{fails: true}, []MeshMember{member})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := source.(fakeBatchSource); !ok {
+		t.Errorf("failed: got a %T, want the source queried per member", source)
+	}
+
+	settings.GraylogQueryStrategy = queryStrategyMember
+	source, _ = batchSums(settings, fakeBatchSource{sum: 2}, []MeshMember{member})
+	if _, ok := source.(fakeBatchSource); !ok {
+		t.Errorf("member strategy: got a %T, want the source queried per member", source)
+	}
+
+	// Overridden queries can't be grouped, and are made for the member
+	settings.GraylogQueryStrategy = queryStrategyTerms
+	overridden := MeshMember{ID: "rec2", Override: &MemberOverride{Stream: "stream2"}}
+	overridden.Fields.WGKey = "key2"
+	source, _ = batchSums(settings, fakeBatchSource{sum: 2}, []MeshMember{member, overridden})
+	if up, _, total, _, err := getBandwidthSums(settings, source, overridden); err != nil || up != nil || total != nil {
+		t.Errorf("overridden: got %v up, %v total and error %v, want the source's nothing", up, total, err)
+	}
+}
+
+func TestChooseQueryStrategy(t *testing.T) {
+	members := make([]MeshMember, 10)
+
+	tests := []struct {
+		name     string
+		strategy string
+		source   StatSource
+		members  []MeshMember
+		chosen   string
+		valid    bool
+	}{
+		{"auto with many members", queryStrategyAuto, fakeBatchSource{}, members, queryStrategyTerms, true},
+		{"default with many members", "", fakeBatchSource{}, members, queryStrategyTerms, true},
+		{"auto with few members", queryStrategyAuto, fakeBatchSource{}, members[:9], queryStrategyMember, true},
+		{"auto unsupported", queryStrategyAuto, fakeBatchSource{unsupported: true}, members, queryStrategyMember, true},
+		{"auto without grouped queries", queryStrategyAuto, LokiSource{}, members, queryStrategyMember, true},
+		{"member override", queryStrategyMember, fakeBatchSource{}, members, queryStrategyMember, true},
+		{"terms override", queryStrategyTerms, fakeBatchSource{unsupported: true}, members[:1], queryStrategyTerms, true},
+		{"invalid", "grouped", fakeBatchSource{}, members, "", false},
+	}
+
+	for _, test := range tests {
+		settings := Settings{GraylogQueryStrategy: test.strategy, GraylogTermsMinMembers: 10}
+		chosen, err := chooseQueryStrategy(settings, test.source, test.members)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: should have failed", test.name)
+			}
+			continue
+		}
+		if chosen != test.chosen {
+			t.Errorf("%s: got %s, want %s", test.name, chosen, test.chosen)
+		}
+	}
+}
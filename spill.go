@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+)
+
+// SpillStore keeps the periods the mongo store couldn't take in
+// MONGO_SPILL_FILE, a JSON line per period, so a run carries on through a
+// Mongo outage rather than losing the queries made for them. They are
+// written to Mongo by the flush command, and by the daemon before each
+// collection. Periods the DUPLICATE_POLICY refuses aren't spilled
+type SpillStore struct {
+	store UsageStore
+	path  string
+}
+
+func (s SpillStore) Insert(bwup BandwidthUsagePeriod) error {
+	err := s.store.Insert(bwup)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(DuplicateError); ok {
+		return err
+	}
+
+	if spillErr := appendSpill(s.path, bwup); spillErr != nil {
+		return fmt.Errorf("%v, and spilling it failed: %v", err, spillErr)
+	}
+	log.Printf("WARNING: spilled the usage of %s to %s: %v", bwup.Name, s.path, err)
+	return nil
+}
+
+// lockFile opens a local file appended to, like the spill file, creating
+// it if needed, and locks it against other processes. Flushes replace the
+// file, so one locked after it was replaced is opened again
+func lockFile(path string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+func appendSpill(path string, bwup BandwidthUsagePeriod) error {
+	line, err := json.Marshal(bwup)
+	if err != nil {
+		return err
+	}
+
+	file, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// flushSpill inserts the network's spilled periods into the store, keeping
+// the ones it doesn't take yet in the file, along with other networks'. As
+// the store is likely still down after a failed insert, the rest are kept
+// without trying them. Periods the DUPLICATE_POLICY refuses are stored
+// already, and dropped
+func flushSpill(path string, network string, store UsageStore) (flushed int, kept int, err error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+
+	file, err := lockFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var keep bytes.Buffer
+	var insertErr error
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var bwup BandwidthUsagePeriod
+		if err := json.Unmarshal(line, &bwup); err != nil {
+			return 0, 0, fmt.Errorf("%s is corrupt: %v", path, err)
+		}
+		if bwup.Network != network || insertErr != nil {
+			keep.Write(line)
+			keep.WriteByte('\n')
+			if bwup.Network == network {
+				kept++
+			}
+			continue
+		}
+
+		insertErr = store.Insert(bwup)
+		if _, ok := insertErr.(DuplicateError); ok {
+			log.Printf("Dropping spilled usage: %v", insertErr)
+			insertErr = nil
+		}
+		if insertErr != nil {
+			keep.Write(line)
+			keep.WriteByte('\n')
+			kept++
+			continue
+		}
+		flushed++
+	}
+
+	if flushed > 0 {
+		if err := replaceFile(path, keep.Bytes()); err != nil {
+			return 0, 0, err
+		}
+	}
+	return flushed, kept, insertErr
+}
+
+// replaceFile replaces a locked file by what is left in it, removing it if
+// nothing is
+func replaceFile(path string, contents []byte) error {
+	if len(contents) == 0 {
+		return os.Remove(path)
+	}
+
+	temporary := path + ".tmp"
+	if err := ioutil.WriteFile(temporary, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// flushNetworkSpill writes the network's spilled periods to Mongo
+func flushNetworkSpill(settings Settings) (flushed int, kept int, err error) {
+	if settings.MongoSpillFile == "" || settings.MongoURL == "" {
+		return 0, 0, nil
+	}
+
+	bwupCollection, err := getBWUPCollection(settings)
+	if err != nil {
+		return 0, 0, err
+	}
+	store, err := newMongoSink(settings, bwupCollection, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if spill, ok := store.(SpillStore); ok {
+		store = spill.store
+	}
+
+	return flushSpill(settings.MongoSpillFile, settings.Network, store)
+}
+
+// flushCommand writes the usage spilled during a Mongo outage to Mongo, for
+// every network
+func flushCommand(args []string) {
+	for _, settings := range loadAllNetworkSettings() {
+		flushed, kept, err := flushNetworkSpill(settings)
+		if flushed > 0 || kept > 0 {
+			log.Printf("Flushed %d spilled periods of network %s, %d left", flushed, settings.Network, kept)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+}
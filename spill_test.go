@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// spilledPeriod is a period of a network for one member
+func spilledPeriod(network string, name string) BandwidthUsagePeriod {
+	period := usage(1, 2)
+	period.Network = network
+	period.Name = name
+	period.From = time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+	period.To = period.From.Add(time.Hour)
+	return period
+}
+
+// duplicateStore refuses every period as already stored
+type duplicateStore struct{}
+
+func (duplicateStore) Insert(bwup BandwidthUsagePeriod) error {
+	return DuplicateError{Name: bwup.Name, From: bwup.From, To: bwup.To}
+}
+
+func TestSpillStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mongo-spill.jsonl")
+
+	// Mongo goes down after Alice's usage
+	mongo := &flakyStore{}
+	store := SpillStore{store: mongo, path: path}
+	if err := store.Insert(spilledPeriod("casa", "Alice")); err != nil {
+		t.Fatal(err)
+	}
+	mongo.failures = 2
+	for _, name := range []string{"Bob", "Carol"} {
+		if err := store.Insert(spilledPeriod("casa", name)); err != nil {
+			t.Errorf("%s: %v, want it spilled", name, err)
+		}
+	}
+	if err := (SpillStore{store: &flakyStore{failures: 1}, path: path}).Insert(spilledPeriod("vecinos", "Dave")); err != nil {
+		t.Fatal(err)
+	}
+	if len(mongo.inserted) != 1 {
+		t.Fatalf("got %d inserted, want only Alice's", len(mongo.inserted))
+	}
+
+	if err := (SpillStore{store: duplicateStore{}, path: path}).Insert(spilledPeriod("casa", "Alice")); err == nil {
+		t.Error("duplicate: should have failed rather than be spilled")
+	}
+
+	// Still down: the first insert fails and the rest wait
+	mongo.failures = 1
+	flushed, kept, err := flushSpill(path, "casa", mongo)
+	if err == nil || flushed != 0 || kept != 2 {
+		t.Errorf("still down: got %d flushed, %d kept and error %v", flushed, kept, err)
+	}
+
+	flushed, kept, err = flushSpill(path, "casa", mongo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 2 || kept != 0 {
+		t.Errorf("got %d flushed and %d kept, want Bob and Carol flushed", flushed, kept)
+	}
+	if len(mongo.inserted) != 3 || mongo.inserted[1].Name != "Bob" || mongo.inserted[2].Name != "Carol" {
+		t.Errorf("got %+v inserted", mongo.inserted)
+	}
+	if !mongo.inserted[1].From.Equal(spilledPeriod("casa", "Bob").From) || *mongo.inserted[1].Total != 3 {
+		t.Errorf("got %+v, want the period as spilled", mongo.inserted[1])
+	}
+
+	// Other networks' periods are left for their own flush
+	other := &flakyStore{}
+	if flushed, _, err := flushSpill(path, "vecinos", other); err != nil || flushed != 1 || other.inserted[0].Name != "Dave" {
+		t.Errorf("other network: got %d flushed, error %v", flushed, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the emptied spill file removed, got %v", err)
+	}
+
+	if flushed, kept, err := flushSpill(path, "casa", mongo); err != nil || flushed != 0 || kept != 0 {
+		t.Errorf("nothing spilled: got %d flushed, %d kept and error %v", flushed, kept, err)
+	}
+}
+
+func TestFlushSpillDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mongo-spill.jsonl")
+
+	if err := appendSpill(path, spilledPeriod("casa", "Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored meanwhile, by a backfill say
+	flushed, kept, err := flushSpill(path, "casa", duplicateStore{})
+	if err != nil || flushed != 1 || kept != 0 {
+		t.Errorf("got %d flushed, %d kept and error %v, want the duplicate dropped", flushed, kept, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := flushSpill(path, "casa", &flakyStore{}); err == nil {
+		t.Error("corrupt: should have failed")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// Registers the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteTime is how times are kept in SQLite, in UTC, which its date and
+// time functions read
+const sqliteTime = "2006-01-02 15:04:05"
+
+// sqliteSchema creates the usage table, and a monthly_usage view for the
+// usual reports
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS usage (
+	network TEXT NOT NULL,
+	member_id TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	interface TEXT NOT NULL DEFAULT '',
+	"from" TEXT NOT NULL,
+	"to" TEXT NOT NULL,
+	duration INTEGER NOT NULL,
+	up REAL,
+	down REAL,
+	total REAL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS usage_window ON usage (network, "from", "to");
+CREATE VIEW IF NOT EXISTS monthly_usage AS
+	SELECT network, member_id, name, strftime('%Y-%m', "from") AS month, COUNT(*) AS periods,
+		SUM(up) AS up, SUM(down) AS down, SUM(total) AS total
+	FROM usage WHERE status != 'failed'
+	GROUP BY network, member_id, name, month;
+`
+
+// openSQLite opens SQLITE_PATH, creating the file and its schema if needed
+func openSQLite(settings Settings) (*sql.DB, error) {
+	if settings.SQLitePath == "" {
+		return nil, fmt.Errorf("the sqlite store needs SQLITE_PATH")
+	}
+
+	db, err := sql.Open("sqlite3", settings.SQLitePath+"?_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SQLiteStore saves usage periods into an SQLite file, for networks small
+// enough to run without Mongo
+type SQLiteStore struct {
+	db     *sql.DB
+	policy string
+}
+
+func newSQLiteStore(settings Settings) (SQLiteStore, error) {
+	db, err := openSQLite(settings)
+	if err != nil {
+		return SQLiteStore{}, err
+	}
+	return SQLiteStore{db: db, policy: settings.DuplicatePolicy}, nil
+}
+
+// windowCondition matches the stored rows of the usage period's member and
+// window, with the arguments to bind
+func (s SQLiteStore) windowCondition(bwup BandwidthUsagePeriod) (string, []interface{}) {
+	member, key := "member_id = '' AND name = ?", bwup.Name
+	if bwup.MemberID != "" {
+		member, key = "member_id = ?", bwup.MemberID
+	}
+	return `network = ? AND ` + member + ` AND interface = ? AND "from" = ? AND "to" = ?`,
+		[]interface{}{bwup.Network, key, bwup.Interface, bwup.From.UTC().Format(sqliteTime), bwup.To.UTC().Format(sqliteTime)}
+}
+
+// Insert applies the duplicate policy before inserting, replacing a stored
+// period in the same transaction
+func (s SQLiteStore) Insert(bwup BandwidthUsagePeriod) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	condition, args := s.windowCondition(bwup)
+
+	existing := bwup
+	var up, down, total sql.NullFloat64
+	err = tx.QueryRow("SELECT up, down, total, status FROM usage WHERE "+condition+" LIMIT 1", args...).Scan(&up, &down, &total, &existing.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil {
+		existing.Up, existing.Down, existing.Total = nullableFloat(up), nullableFloat(down), nullableFloat(total)
+		replacement, err := resolveDuplicate(s.policy, existing, bwup)
+		if err != nil || replacement == nil {
+			return err
+		}
+		bwup = *replacement
+		if _, err := tx.Exec("DELETE FROM usage WHERE "+condition, args...); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO usage (network, member_id, name, interface, "from", "to", duration, up, down, total, status, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		bwup.Network, bwup.MemberID, bwup.Name, bwup.Interface,
+		bwup.From.UTC().Format(sqliteTime), bwup.To.UTC().Format(sqliteTime), int64(bwup.Duration/time.Second),
+		bwup.Up, bwup.Down, bwup.Total, bwup.Status, bwup.Error)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func nullableFloat(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Float64
+}
+
+// readMembersCSV reads the member list from MEMBERS_CSV instead of
+// Airtable. The header names the columns like the Airtable fields, or as
+// the FIELD_ settings in fields say, of which Name and the column of the
+// member identity, like WG Key, are needed. Members without an ID column
+// are identified by it, and Tags are separated by semicolons
+func readMembersCSV(r io.Reader, identity string, fields map[string]string) ([]MeshMember, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("members CSV has no header")
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"Name", identityColumn(identity)} {
+		if _, ok := columns[memberColumn(fields, required)]; !ok {
+			return nil, fmt.Errorf("members CSV has no %q column", memberColumn(fields, required))
+		}
+	}
+
+	members := []MeshMember{}
+	for line, row := range rows[1:] {
+		value := func(name string) string {
+			if i, ok := columns[memberColumn(fields, name)]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		number := func(name string) (*float64, error) {
+			if value(name) == "" {
+				return nil, nil
+			}
+			n, err := strconv.ParseFloat(value(name), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s must be a number, got %q", line+2, memberColumn(fields, name), value(name))
+			}
+			return &n, nil
+		}
+
+		member := MeshMember{ID: value("ID")}
+		member.Fields.Name = value("Name")
+		member.Fields.WGKey = value("WG Key")
+		member.Fields.MeshIP = value("Mesh IP")
+		member.Fields.RouterMAC = value("Router MAC")
+		member.Fields.StaticIP = value("Static IP")
+		member.Fields.Hostname = value("Hostname")
+		member.Fields.CRMID = value("CRM ID")
+		member.Fields.Phone = value("Phone")
+		member.Fields.Language = value("Language")
+		member.Fields.Site = value("Site")
+		member.Fields.SMSOptIn, _ = strconv.ParseBool(value("SMS Opt In"))
+		member.Fields.TrackingOptOut, _ = strconv.ParseBool(value("Tracking Opt Out"))
+		member.Fields.Overrides = value("Overrides")
+		if member.ID == "" {
+			member.ID = identityValue(identity, member)
+		}
+		for _, tag := range strings.Split(value("Tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				member.Fields.Tags = append(member.Fields.Tags, tag)
+			}
+		}
+
+		plan, err := number("Plan Mbps")
+		if err != nil {
+			return nil, err
+		}
+		if plan != nil {
+			member.Fields.PlanMbps = *plan
+		}
+		if member.Fields.PrepaidGB, err = number("Prepaid GB"); err != nil {
+			return nil, err
+		}
+		if member.Fields.Latitude, err = number("Latitude"); err != nil {
+			return nil, err
+		}
+		if member.Fields.Longitude, err = number("Longitude"); err != nil {
+			return nil, err
+		}
+
+		if member.Fields.Name == "" || identityValue(identity, member) == "" {
+			return nil, fmt.Errorf("line %d: members need a Name and a %s", line+2, identityColumn(identity))
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// SQLRow is a row of the result of a query, printed with the query's
+// columns
+type SQLRow struct {
+	columns []string
+	values  []interface{}
+}
+
+func (r SQLRow) MarshalJSON() ([]byte, error) {
+	row := map[string]interface{}{}
+	for i, column := range r.columns {
+		row[column] = r.values[i]
+	}
+	return json.Marshal(row)
+}
+
+func (r SQLRow) reportColumns() []string {
+	return r.columns
+}
+
+func (r SQLRow) reportValues(number func(*float64) string) []string {
+	values := []string{}
+	for _, value := range r.values {
+		switch value := value.(type) {
+		case nil:
+			values = append(values, number(nil))
+		case float64:
+			values = append(values, number(&value))
+		case []byte:
+			values = append(values, string(value))
+		default:
+			values = append(values, fmt.Sprint(value))
+		}
+	}
+	return values
+}
+
+// querySQLite runs a query, returning its rows
+func querySQLite(db *sql.DB, query string) ([]SQLRow, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	all := []SQLRow{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		all = append(all, SQLRow{columns: columns, values: values})
+	}
+	return all, rows.Err()
+}
+
+// sqlCommand runs an SQL query against the usage kept in SQLITE_PATH, like
+// `sql "SELECT * FROM monthly_usage WHERE month = '2026-09'"`, printing its
+// rows as a report
+func sqlCommand(args []string) {
+	flags := flag.NewFlagSet("sql", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fatal("sql needs one query, like sql \"SELECT * FROM monthly_usage\"")
+	}
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Networks sharing a file are queried once, the query picks the network
+	queried := map[string]bool{}
+	for _, settings := range loadAllNetworkSettings() {
+		if queried[settings.SQLitePath] {
+			continue
+		}
+		queried[settings.SQLitePath] = true
+
+		db, err := openSQLite(settings)
+		if err != nil {
+			fatal(err)
+		}
+		rows, err := querySQLite(db, flags.Arg(0))
+		db.Close()
+		if err != nil {
+			fatal(err)
+		}
+		for _, row := range rows {
+			if err := report.Write(row); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSQLiteStore opens a store in a new file, removed by the returned
+// function
+func testSQLiteStore(t *testing.T, policy string) (SQLiteStore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newSQLiteStore(Settings{SQLitePath: filepath.Join(dir, "usage.db"), DuplicatePolicy: policy})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, cleanup := testSQLiteStore(t, duplicatePolicyMerge)
+	defer cleanup()
+
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	period := func(memberID string, day int, bwup BandwidthUsagePeriod) BandwidthUsagePeriod {
+		bwup.Network = "casa"
+		bwup.MemberID = memberID
+		bwup.From = from.AddDate(0, 0, day)
+		bwup.To = from.AddDate(0, 0, day+1)
+		bwup.Duration = 24 * time.Hour
+		return bwup
+	}
+
+	for _, bwup := range []BandwidthUsagePeriod{
+		period("rec1", 0, usage(1, 2)),
+		// Merged with the first, keeping the larger of each direction
+		period("rec1", 0, usage(3, 1)),
+		period("rec1", 1, usage(1, 1)),
+		period("rec1", 2, failedUsage()),
+		period("", 0, noUsage()),
+	} {
+		if err := store.Insert(bwup); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := querySQLite(store.db, `SELECT member_id, "from", up, down, total, status FROM usage ORDER BY member_id, "from"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := [][]string{}
+	for _, row := range rows {
+		got = append(got, row.reportValues(csvNumber))
+	}
+	want := [][]string{
+		{"", "2026-09-01 00:00:00", "", "", "", usageStatusNoData},
+		{"rec1", "2026-09-01 00:00:00", "3", "2", "5", usageStatusOK},
+		{"rec1", "2026-09-02 00:00:00", "1", "1", "2", usageStatusOK},
+		{"rec1", "2026-09-03 00:00:00", "", "", "", usageStatusFailed},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The monthly view leaves failed periods out
+	rows, err = querySQLite(store.db, `SELECT member_id, month, periods, total FROM monthly_usage WHERE member_id = 'rec1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || !reflect.DeepEqual(rows[0].reportValues(csvNumber), []string{"rec1", "2026-09", "2", "7"}) {
+		t.Errorf("got monthly usage %+v", rows)
+	}
+}
+
+func TestSQLiteStoreDuplicateError(t *testing.T) {
+	store, cleanup := testSQLiteStore(t, duplicatePolicyError)
+	defer cleanup()
+
+	bwup := usage(1, 2)
+	bwup.Network = "casa"
+	if err := store.Insert(bwup); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(bwup); err == nil {
+		t.Error("duplicate: should have failed")
+	}
+}
+
+func TestReadMembersCSV(t *testing.T) {
+	members, err := readMembersCSV(strings.NewReader(`ID,Name,WG Key,Plan Mbps,Tags,Site,Latitude,Longitude,SMS Opt In,Prepaid GB
+rec1,Alice,key1,50,neighborhood:Centro; plan:50,Tower,9.93,-84.08,true,20
+,Bob,key2,,,,,,,
+`), memberIdentityWGKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("got members %+v", members)
+	}
+
+	alice, bob := members[0], members[1]
+	if alice.ID != "rec1" || alice.Fields.Name != "Alice" || alice.Fields.WGKey != "key1" || alice.Fields.PlanMbps != 50 || !alice.Fields.SMSOptIn {
+		t.Errorf("got Alice %+v", alice)
+	}
+	if !reflect.DeepEqual(alice.Fields.Tags, []string{"neighborhood:Centro", "plan:50"}) || alice.Fields.Site != "Tower" || *alice.Fields.Latitude != 9.93 {
+		t.Errorf("got Alice's metadata %+v", alice.Fields)
+	}
+	if *alice.Fields.PrepaidGB != 20 {
+		t.Errorf("got Alice's prepaid %v GB", *alice.Fields.PrepaidGB)
+	}
+	if bob.ID != "key2" || bob.Fields.Latitude != nil || bob.Fields.Tags != nil || bob.Fields.PrepaidGB != nil {
+		t.Errorf("got Bob %+v", bob)
+	}
+
+	// Networks identifying members by router don't need WireGuard keys
+	routers, err := readMembersCSV(strings.NewReader("Name,Router MAC\nCarol,aa:bb:cc:dd:ee:ff\n"), memberIdentityRouterMAC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routers) != 1 || routers[0].ID != "aa:bb:cc:dd:ee:ff" || routers[0].Fields.RouterMAC != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("got routers %+v", routers)
+	}
+
+	// Columns named as the FIELD_ settings say
+	renamed, err := readMembersCSV(strings.NewReader("Member,Wireguard Public Key,Plan Mbps\nDave,key4,fast?\n"), memberIdentityWGKey, map[string]string{"Name": "Member", "WG Key": "Wireguard Public Key", "Plan Mbps": "Speed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renamed) != 1 || renamed[0].Fields.Name != "Dave" || renamed[0].Fields.WGKey != "key4" || renamed[0].Fields.PlanMbps != 0 {
+		t.Errorf("got renamed members %+v", renamed)
+	}
+	if _, err := readMembersCSV(strings.NewReader("Name,WG Key\nAlice,key1\n"), memberIdentityWGKey, map[string]string{"WG Key": "Wireguard Public Key"}); err == nil {
+		t.Error("renamed key column missing: should have failed")
+	}
+
+	tests := []struct {
+		name     string
+		csv      string
+		identity string
+	}{
+		{"no header", "", memberIdentityWGKey},
+		{"no key column", "Name\nAlice\n", memberIdentityWGKey},
+		{"no key", "Name,WG Key\nAlice,\n", memberIdentityWGKey},
+		{"bad plan", "Name,WG Key,Plan Mbps\nAlice,key1,fast\n", memberIdentityWGKey},
+		{"no hostname column", "Name,WG Key\nAlice,key1\n", memberIdentityHostname},
+	}
+	for _, test := range tests {
+		if _, err := readMembersCSV(strings.NewReader(test.csv), test.identity, nil); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Statement is a member's usage over a calendar month, line by line: one
+// for usage already pruned into the month's rollup, then one per day
+type Statement struct {
+	Network  string
+	MemberID string
+	Name     string
+	Month    time.Time
+	Lines    []StatementLine
+	Up       float64
+	Down     float64
+	Total    float64
+	// Failed is the number of periods whose usage couldn't be collected
+	Failed int
+	// Corrected is the number of periods whose usage was corrected by hand
+	Corrected int
+	// Annotations are the operators' notes about the member and month, only
+	// in statements for operators
+	Annotations []Annotation `json:",omitempty"`
+}
+
+// StatementLine is the usage of a day, or of the pruned part of the month
+type StatementLine struct {
+	From    time.Time
+	To      time.Time
+	Pruned  bool
+	Periods int
+	Up      float64
+	Down    float64
+	Total   float64
+}
+
+// parseMonth reads a month written as 2026-09, the current one if empty
+func parseMonth(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		now = now.UTC()
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Parse("2006-01", value)
+}
+
+// getRollups reads the rollups of a member for a month. Rollups made before
+// member IDs are matched on the member's current name instead
+func getRollups(collection *mongo.Collection, network string, memberID string, name string, month time.Time) ([]UsageRollup, error) {
+	rollups := []UsageRollup{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"network": networkMatch(network),
+		"month":   month,
+		"$or": []bson.M{
+			{"memberid": memberID},
+			{"memberid": bson.M{"$exists": false}, "name": encryptName(network, name)},
+		},
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return rollups, err
+	}
+	err = cursor.All(ctx, &rollups)
+	return rollups, err
+}
+
+// buildStatement composes a member's statement for a month from its
+// rollups and the periods still stored. Overlapping periods of a day are
+// counted once, as the audit does
+func buildStatement(network string, memberID string, name string, month time.Time, rollups []UsageRollup, periods []BandwidthUsagePeriod) Statement {
+	statement := Statement{Network: network, MemberID: memberID, Name: name, Month: month, Lines: []StatementLine{}}
+
+	for _, rollup := range rollups {
+		statement.Lines = append(statement.Lines, StatementLine{
+			From:    month,
+			To:      month.AddDate(0, 1, 0),
+			Pruned:  true,
+			Periods: rollup.Periods,
+			Up:      rollup.Up,
+			Down:    rollup.Down,
+			Total:   rollup.Total,
+		})
+	}
+
+	byDay := map[time.Time][]BandwidthUsagePeriod{}
+	for _, period := range periods {
+		if period.Status == usageStatusFailed {
+			statement.Failed++
+			continue
+		}
+		if period.CorrectionID != "" {
+			statement.Corrected++
+		}
+		day := period.From.UTC().Truncate(24 * time.Hour)
+		byDay[day] = append(byDay[day], period)
+	}
+
+	days := []StatementLine{}
+	for day, dayPeriods := range byDay {
+		sum := sumMemberUsage(dayPeriods)
+		days = append(days, StatementLine{
+			From:    day,
+			To:      day.Add(24 * time.Hour),
+			Periods: len(dayPeriods),
+			Up:      sum.Up,
+			Down:    sum.Down,
+			Total:   sum.Total,
+		})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].From.Before(days[j].From) })
+	statement.Lines = append(statement.Lines, days...)
+
+	for _, line := range statement.Lines {
+		statement.Up += line.Up
+		statement.Down += line.Down
+		statement.Total += line.Total
+	}
+
+	return statement
+}
+
+// writeStatementCSV writes a statement's lines, amounts in GB
+func writeStatementCSV(w io.Writer, statement Statement) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"Network", "MemberID", "Name", "From", "To", "Pruned", "Periods", "Up", "Down", "Total"})
+
+	number := func(n float64) string { return strconv.FormatFloat(n, 'f', -1, 64) }
+	for _, line := range statement.Lines {
+		writer.Write([]string{
+			statement.Network,
+			statement.MemberID,
+			statement.Name,
+			line.From.Format("2006-01-02"),
+			line.To.Format("2006-01-02"),
+			strconv.FormatBool(line.Pruned),
+			strconv.Itoa(line.Periods),
+			number(line.Up),
+			number(line.Down),
+			number(line.Total),
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"t":     func(key string, args ...interface{}) string { return "" },
+	"date":  func(t time.Time) string { return "" },
+	"month": func(t time.Time) string { return "" },
+	"gb":    func(n float64) string { return fmt.Sprintf("%.2f", n) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{t "statement.title"}} - {{.Name}} - {{month .Month}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+tfoot td { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{t "statement.title"}}</h1>
+<p>{{t "statement.member"}}: {{.Name}}<br>{{t "statement.month"}}: {{month .Month}}</p>
+<table>
+<thead><tr><th>{{t "statement.day"}}</th><th>{{t "statement.up"}}</th><th>{{t "statement.down"}}</th><th>{{t "statement.total"}}</th></tr></thead>
+<tbody>
+{{range .Lines}}<tr><td>{{if .Pruned}}{{t "statement.pruned"}}{{else}}{{date .From}}{{end}}</td><td class="number">{{gb .Up}}</td><td class="number">{{gb .Down}}</td><td class="number">{{gb .Total}}</td></tr>
+{{end}}</tbody>
+<tfoot><tr><td>{{t "statement.total"}}</td><td class="number">{{gb .Up}}</td><td class="number">{{gb .Down}}</td><td class="number">{{gb .Total}}</td></tr></tfoot>
+</table>
+{{if .Failed}}<p>{{t "statement.failed" .Failed}}</p>{{end}}
+{{if .Corrected}}<p>{{t "statement.corrected" .Corrected}}</p>{{end}}
+{{if .Annotations}}<h2>{{t "statement.notes"}}</h2>
+<ul>
+{{range .Annotations}}<li>{{if .From}}{{date .From}}{{if .To}} - {{date .To}}{{end}}: {{end}}{{.Text}}{{if .Author}} ({{.Author}}){{end}}</li>
+{{end}}</ul>{{end}}
+</body>
+</html>
+`))
+
+// writeStatementHTML writes a statement as a page in the language
+func writeStatementHTML(w io.Writer, statement Statement, language string) error {
+	page, err := statementTemplate.Clone()
+	if err != nil {
+		return err
+	}
+	page.Funcs(template.FuncMap{
+		"t":     func(key string, args ...interface{}) string { return translate(language, key, args...) },
+		"date":  func(t time.Time) string { return formatDate(language, t) },
+		"month": func(t time.Time) string { return formatMonth(language, t) },
+	})
+	return page.Execute(w, statement)
+}
+
+// handleStatement lets operators download the statement of any member
+func (s *Server) handleStatement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "statements require GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, _, ok := s.authorize(w, r, query.Get("network"), roleOperator)
+	if !ok {
+		return
+	}
+
+	if query.Get("member") == "" {
+		writeJSONError(w, http.StatusBadRequest, "member is required")
+		return
+	}
+
+	tenant.writeStatement(w, r, query.Get("member"), defaultLanguage, true)
+}
+
+// handleSelfStatement lets a member download their own statement with the
+// signed link they were sent
+func (s *Server) handleSelfStatement(w http.ResponseWriter, r *http.Request) {
+	tenant, link, language, ok := s.selfLink(w, r)
+	if !ok {
+		return
+	}
+
+	tenant.writeStatement(w, r, link.MemberID, language, false)
+}
+
+// writeStatement answers with a member's statement for the month given by
+// the month param, as HTML or as CSV with format=csv. Annotations are only
+// added for operators, as they may be about the member
+func (t *Tenant) writeStatement(w http.ResponseWriter, r *http.Request, memberID string, language string, annotations bool) {
+	query := r.URL.Query()
+
+	month, err := parseMonth(query.Get("month"), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, translate(language, "usage.invalid_param", "month", err))
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "html" && format != "csv" {
+		writeJSONError(w, http.StatusBadRequest, translate(language, "usage.invalid_param", "format", format))
+		return
+	}
+
+	member, ok, err := t.members.ByID(memberID)
+	if err != nil {
+		log.Printf("Error refreshing members: %v", err)
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, translate(language, "usage.unknown_member", memberID))
+		return
+	}
+	name := strings.TrimSpace(member.Fields.Name)
+
+	rollups, err := getRollups(t.reads.Database().Collection(t.settings.MongoRollupCollection), t.settings.Network, memberID, name, month)
+	if err != nil {
+		log.Printf("Error reading rollups: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, translate(language, "usage.read_error"))
+		return
+	}
+
+	periods, err := getUsagePeriods(t.reads, t.settings.Network, memberID, name, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		log.Printf("Error reading usage: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, translate(language, "usage.read_error"))
+		return
+	}
+
+	statement := buildStatement(t.settings.Network, memberID, name, month, rollups, periods)
+	if annotations {
+		statement.Annotations, err = getAnnotations(t.reads.Database().Collection(t.settings.MongoAnnotationsCollection), t.settings.Network, memberID, month, month.AddDate(0, 1, 0))
+		if err != nil {
+			log.Printf("Error reading annotations: %v", err)
+		}
+	}
+	filename := fmt.Sprintf("statement-%s-%s", memberID, month.Format("2006-01"))
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		err = writeStatementCSV(w, statement)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="`+filename+`.html"`)
+		err = writeStatementHTML(w, statement, language)
+	}
+	if err != nil {
+		log.Printf("Error writing statement: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMonth(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		month time.Time
+		valid bool
+	}{
+		{"", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2026-09", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2026-13", time.Time{}, false},
+		{"September", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		month, err := parseMonth(test.value, now)
+		if test.valid && err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: should have failed", test.value)
+			}
+			continue
+		}
+		if !month.Equal(test.month) {
+			t.Errorf("%q: got %v, want %v", test.value, month, test.month)
+		}
+	}
+}
+
+func testStatement() Statement {
+	month := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	period := func(from int, to int, usage BandwidthUsagePeriod) BandwidthUsagePeriod {
+		usage.MemberID = "rec1"
+		usage.From = month.Add(time.Duration(from) * time.Hour)
+		usage.To = month.Add(time.Duration(to) * time.Hour)
+		return usage
+	}
+
+	rollups := []UsageRollup{{Network: "casa", MemberID: "rec1", Name: "Alice", Month: month, Periods: 30, Up: 10, Down: 20, Total: 30}}
+	return buildStatement("casa", "rec1", "Alice", month, rollups, []BandwidthUsagePeriod{
+		period(48, 72, usage(1, 1)),
+		period(24, 36, usage(1, 2)),
+		// Stored again by an hourly run, inside the period above
+		period(24, 25, usage(0.5, 0.5)),
+		period(36, 48, usage(2, 2)),
+		period(72, 96, failedUsage()),
+	})
+}
+
+func TestBuildStatement(t *testing.T) {
+	statement := testStatement()
+
+	if statement.Up != 14 || statement.Down != 25 || statement.Total != 39 || statement.Failed != 1 {
+		t.Errorf("got totals %+v", statement)
+	}
+
+	want := []StatementLine{
+		{Pruned: true, Periods: 30, Up: 10, Down: 20, Total: 30},
+		{Periods: 3, Up: 3, Down: 4, Total: 7},
+		{Periods: 1, Up: 1, Down: 1, Total: 2},
+	}
+	if len(statement.Lines) != len(want) {
+		t.Fatalf("got lines %+v", statement.Lines)
+	}
+	for i, line := range statement.Lines {
+		line.From, line.To = time.Time{}, time.Time{}
+		if line != want[i] {
+			t.Errorf("line %d is %+v, want %+v", i, line, want[i])
+		}
+	}
+	if day := statement.Lines[1].From; !day.Equal(time.Date(2026, 9, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("the first day is %v", day)
+	}
+}
+
+func TestWriteStatement(t *testing.T) {
+	statement := testStatement()
+
+	var csv bytes.Buffer
+	if err := writeStatementCSV(&csv, statement); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 4 || lines[1] != "casa,rec1,Alice,2026-09-01,2026-10-01,true,30,10,20,30" || lines[2] != "casa,rec1,Alice,2026-09-02,2026-09-03,false,3,3,4,7" {
+		t.Errorf("got CSV\n%s", csv.String())
+	}
+
+	statement.Name = "<Alice>"
+	replaced := time.Date(2026, 9, 12, 0, 0, 0, 0, time.UTC)
+	statement.Annotations = []Annotation{{From: &replaced, Text: "router replaced", Author: "ops"}}
+	var html bytes.Buffer
+	if err := writeStatementHTML(&html, statement, "es"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Estado de uso", "sep 2026", "2 de sep", "Uso anterior, resumido", "39.00", "1 periodos", "&lt;Alice&gt;", "Notas", "12 de sep: router replaced (ops)"} {
+		if !strings.Contains(html.String(), want) {
+			t.Errorf("the statement doesn't contain %q:\n%s", want, html.String())
+		}
+	}
+}
+
+func TestStatementGolden(t *testing.T) {
+	statement := testStatement()
+	replaced := time.Date(2026, 9, 12, 0, 0, 0, 0, time.UTC)
+	statement.Annotations = []Annotation{{From: &replaced, Text: "router replaced", Author: "ops"}}
+
+	var csv bytes.Buffer
+	if err := writeStatementCSV(&csv, statement); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "statement.csv", csv.Bytes())
+
+	for _, language := range []string{"en", "es"} {
+		var html bytes.Buffer
+		if err := writeStatementHTML(&html, statement, language); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "statement."+language+".html", html.Bytes())
+	}
+}
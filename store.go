@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage stores, selected with USAGE_STORES
+const (
+	usageStoreMongo      = "mongo"
+	usageStoreClickHouse = "clickhouse"
+	usageStoreEvents     = "events"
+	usageStoreSQLite     = "sqlite"
+	usageStorePostgres   = "postgres"
+	usageStoreBigQuery   = "bigquery"
+	usageStoreWebhook    = "webhook"
+)
+
+// Duplicate policies, selected with DUPLICATE_POLICY, decide what happens
+// when a member's usage for a window is already stored
+const (
+	duplicatePolicySkip      = "skip"
+	duplicatePolicyOverwrite = "overwrite"
+	duplicatePolicyMerge     = "merge"
+	duplicatePolicyError     = "error"
+)
+
+// UsageStore persists bandwidth usage periods
+type UsageStore interface {
+	Insert(bwup BandwidthUsagePeriod) error
+}
+
+func validDuplicatePolicy(policy string) bool {
+	switch policy {
+	case duplicatePolicySkip, duplicatePolicyOverwrite, duplicatePolicyMerge, duplicatePolicyError:
+		return true
+	}
+	return false
+}
+
+func maxUsage(a *float64, b *float64) *float64 {
+	if a == nil || (b != nil && *b > *a) {
+		return b
+	}
+	return a
+}
+
+// mergeUsage keeps the larger of the stored and new values of each
+// direction, since a lower value is usually a run which missed some logs.
+// The total and status follow from the merged directions
+func mergeUsage(existing BandwidthUsagePeriod, bwup BandwidthUsagePeriod) BandwidthUsagePeriod {
+	bwup.Up = maxUsage(existing.Up, bwup.Up)
+	bwup.Down = maxUsage(existing.Down, bwup.Down)
+	bwup.Total = addSums(bwup.Up, bwup.Down)
+
+	bwup.Status = usageStatusOK
+	if bwup.Total == nil {
+		bwup.Status = usageStatusNoData
+	}
+	return bwup
+}
+
+// DuplicateError is returned under the error duplicate policy for usage
+// which is already stored. Trying again can't succeed
+type DuplicateError struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+func (e DuplicateError) Error() string {
+	return fmt.Sprintf("usage of %s from %s to %s is already stored", e.Name, e.From, e.To)
+}
+
+// resolveDuplicate applies the duplicate policy to a usage period whose
+// window is already stored, returning the period to replace it with or nil
+// to keep the stored one
+func resolveDuplicate(policy string, existing BandwidthUsagePeriod, bwup BandwidthUsagePeriod) (*BandwidthUsagePeriod, error) {
+	// A failed period only records that the window still needs collecting,
+	// so any new result replaces it, and a new failure never replaces a result
+	if existing.Status == usageStatusFailed {
+		return &bwup, nil
+	}
+	if bwup.Status == usageStatusFailed {
+		log.Printf("Usage of %s from %s to %s is already stored, keeping it over a failed query", bwup.Name, bwup.From, bwup.To)
+		return nil, nil
+	}
+	// Corrections are made by hand because the collected usage was wrong
+	if existing.CorrectionID != "" {
+		log.Printf("Usage of %s from %s to %s was corrected by hand, keeping the correction", bwup.Name, bwup.From, bwup.To)
+		return nil, nil
+	}
+
+	switch policy {
+	case duplicatePolicySkip:
+		log.Printf("Usage of %s from %s to %s is already stored, skipping", bwup.Name, bwup.From, bwup.To)
+		return nil, nil
+	case duplicatePolicyOverwrite:
+		return &bwup, nil
+	case duplicatePolicyMerge:
+		merged := mergeUsage(existing, bwup)
+		return &merged, nil
+	}
+	return nil, DuplicateError{Name: bwup.Name, From: bwup.From, To: bwup.To}
+}
+
+// MongoStore saves usage periods into the configured Mongo collection. With
+// a totals collection, members' totals are updated in the same transaction
+// as each period, which needs Mongo to run as a replica set. With a signing
+// key each period is signed as it is written
+type MongoStore struct {
+	collection *mongo.Collection
+	totals     *mongo.Collection
+	mutations  *mongo.Collection
+	signingKey ed25519.PrivateKey
+	policy     string
+}
+
+func (s MongoStore) Insert(bwup BandwidthUsagePeriod) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if s.totals == nil {
+		_, _, err := s.write(ctx, bwup)
+		return err
+	}
+
+	session, err := s.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		existing, written, err := s.write(sessCtx, bwup)
+		if err != nil || written == nil {
+			return nil, err
+		}
+		return nil, addToTotals(sessCtx, s.totals, existing, *written)
+	})
+	return err
+}
+
+// write stores a period under the duplicate policy, returning the period it
+// replaced if any, and what was written, nil if nothing was
+func (s MongoStore) write(ctx context.Context, bwup BandwidthUsagePeriod) (*BandwidthUsagePeriod, *BandwidthUsagePeriod, error) {
+	filter := usageKey(bwup)
+
+	var existing BandwidthUsagePeriod
+	err := s.collection.FindOne(ctx, filter).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		if err := signUsage(s.signingKey, &bwup); err != nil {
+			return nil, nil, err
+		}
+		if _, err = s.collection.InsertOne(ctx, bwup); err != nil {
+			return nil, nil, err
+		}
+		return nil, &bwup, s.recordWrite(ctx, mutationInsert, filter, nil, &bwup)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replacement, err := resolveDuplicate(s.policy, existing, bwup)
+	if replacement == nil {
+		return nil, nil, err
+	}
+
+	if err := signUsage(s.signingKey, replacement); err != nil {
+		return nil, nil, err
+	}
+	if _, err = s.collection.ReplaceOne(ctx, filter, replacement); err != nil {
+		return nil, nil, err
+	}
+
+	kind := mutationOverwrite
+	if s.policy == duplicatePolicyMerge && existing.Status != usageStatusFailed && bwup.Status != usageStatusFailed {
+		kind = mutationMerge
+	}
+	return &existing, replacement, s.recordWrite(ctx, kind, filter, &existing, replacement)
+}
+
+// recordWrite records the write of a period in the mutations collection
+func (s MongoStore) recordWrite(ctx context.Context, kind string, filter bson.M, existing *BandwidthUsagePeriod, written *BandwidthUsagePeriod) error {
+	return recordMutation(ctx, s.mutations, Mutation{
+		Kind:       kind,
+		Collection: s.collection.Name(),
+		Network:    written.Network,
+		Filter:     filterJSON(filter),
+		Documents:  1,
+		Before:     hashPeriod(existing),
+		After:      hashPeriod(written),
+	})
+}
+
+// MultiStore writes every usage period to each of its stores in turn
+type MultiStore []UsageStore
+
+func (s MultiStore) Insert(bwup BandwidthUsagePeriod) error {
+	for _, store := range s {
+		if err := store.Insert(bwup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkMatch matches the documents of a network in a filter. Documents
+// stored before there were networks have none, and belong to the default one
+func networkMatch(network string) interface{} {
+	if network == defaultNetwork {
+		return bson.M{"$in": bson.A{network, nil}}
+	}
+	return network
+}
+
+// usageKey is the filter matching the stored usage of a period's member and
+// window. Members are matched by ID, or by name for usage without one, and
+// usage pushed from different interfaces is kept apart
+func usageKey(bwup BandwidthUsagePeriod) bson.M {
+	key := bson.M{"network": networkMatch(bwup.Network), "from": bwup.From, "to": bwup.To}
+	if bwup.MemberID != "" {
+		key["memberid"] = bwup.MemberID
+	} else {
+		key["name"] = encryptName(bwup.Network, bwup.Name)
+	}
+	if bwup.Interface != "" {
+		key["interface"] = bwup.Interface
+	} else {
+		key["interface"] = bson.M{"$exists": false}
+	}
+	return key
+}
+
+// getUsagePeriods reads the usage periods of a network stored within a
+// window, only those of one member if memberID isn't empty. Usage stored
+// without a member ID is matched on the member's current name instead
+func getUsagePeriods(collection *mongo.Collection, network string, memberID string, name string, from time.Time, to time.Time) ([]BandwidthUsagePeriod, error) {
+	periods := []BandwidthUsagePeriod{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"network": networkMatch(network), "from": bson.M{"$gte": from}, "to": bson.M{"$lte": to}}
+	if memberID != "" {
+		filter["$or"] = []bson.M{
+			{"memberid": memberID},
+			{"memberid": bson.M{"$exists": false}, "name": encryptName(network, name)},
+		}
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"from": 1}))
+	if err != nil {
+		return periods, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var period BandwidthUsagePeriod
+		if err := cursor.Decode(&period); err != nil {
+			return periods, err
+		}
+		periods = append(periods, period)
+	}
+
+	return periods, cursor.Err()
+}
+
+func newUsageStore(settings Settings, bwupCollection *mongo.Collection) (UsageStore, error) {
+	stores := MultiStore{}
+
+	// A replayed run only prints the usage
+	if settings.Replay != "" {
+		return stores, nil
+	}
+
+	if !validDuplicatePolicy(settings.DuplicatePolicy) {
+		return nil, fmt.Errorf("invalid DUPLICATE_POLICY %q, expected skip, overwrite, merge or error", settings.DuplicatePolicy)
+	}
+
+	// The sinks of PIPELINE_FILE take the place of USAGE_STORES
+	config, err := readPipelineConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	sinks := config.Sinks
+	if len(sinks) == 0 {
+		for _, name := range settings.UsageStores {
+			if _, ok := sinkFactories[name]; !ok {
+				return nil, fmt.Errorf("invalid usage store %q in USAGE_STORES", name)
+			}
+			sinks = append(sinks, PipelineComponent{Type: name})
+		}
+	}
+
+	for _, sink := range sinks {
+		store, err := sinkFactories[sink.Type](settings, bwupCollection, sink.Options)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("USAGE_STORES must name at least one store")
+	}
+
+	if settings.JournalFile != "" {
+		journal, err := newJournalStore(settings, stores)
+		if err != nil {
+			return nil, err
+		}
+		return journal, nil
+	}
+	return stores, nil
+}
+
+func newMongoSink(settings Settings, bwupCollection *mongo.Collection, options map[string]string) (UsageStore, error) {
+	if bwupCollection == nil {
+		return nil, fmt.Errorf("the mongo store needs MONGO_URL")
+	}
+
+	signingKey, err := parseSigningKey(settings.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+
+	store := MongoStore{
+		collection: bwupCollection,
+		mutations:  bwupCollection.Database().Collection(settings.MongoMutationsCollection),
+		signingKey: signingKey,
+		policy:     settings.DuplicatePolicy,
+	}
+	if settings.MongoTotalsCollection != "" {
+		store.totals = bwupCollection.Database().Collection(settings.MongoTotalsCollection)
+	}
+
+	var sink UsageStore = store
+	if settings.Chaos.Enabled() {
+		sink = chaosStore{store: sink, chaos: settings.Chaos}
+	}
+	if settings.MongoSpillFile != "" {
+		sink = SpillStore{store: sink, path: settings.MongoSpillFile}
+	}
+	if settings.MongoDualWriteURL != "" {
+		db, err := dualWriteDatabase(settings)
+		if err != nil {
+			return nil, err
+		}
+		sink = DualWriteStore{store: sink, mirror: mirrorUsage(bwupCollection, db.Collection(bwupCollection.Name()))}
+	}
+	return sink, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+func usage(up float64, down float64) BandwidthUsagePeriod {
+	total := up + down
+	return BandwidthUsagePeriod{Name: "Alice", Up: &up, Down: &down, Total: &total, Status: usageStatusOK}
+}
+
+func noUsage() BandwidthUsagePeriod {
+	return BandwidthUsagePeriod{Name: "Alice", Status: usageStatusNoData}
+}
+
+func failedUsage() BandwidthUsagePeriod {
+	return BandwidthUsagePeriod{Name: "Alice", Status: usageStatusFailed, Error: "timeout"}
+}
+
+func sameUsage(a *BandwidthUsagePeriod, b *BandwidthUsagePeriod) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	same := func(x *float64, y *float64) bool {
+		return (x == nil && y == nil) || (x != nil && y != nil && *x == *y)
+	}
+	return same(a.Up, b.Up) && same(a.Down, b.Down) && same(a.Total, b.Total) && a.Status == b.Status
+}
+
+func TestResolveDuplicate(t *testing.T) {
+	ok := usage(1, 2)
+	other := usage(3, 1)
+	merged := usage(3, 2)
+	empty := noUsage()
+	failed := failedUsage()
+	corrected := usage(5, 5)
+	corrected.CorrectionID = "c1"
+
+	tests := []struct {
+		name     string
+		policy   string
+		existing BandwidthUsagePeriod
+		bwup     BandwidthUsagePeriod
+		want     *BandwidthUsagePeriod
+		err      bool
+	}{
+		{"skip", duplicatePolicySkip, ok, other, nil, false},
+		{"overwrite", duplicatePolicyOverwrite, ok, other, &other, false},
+		{"merge", duplicatePolicyMerge, ok, other, &merged, false},
+		{"error", duplicatePolicyError, ok, other, nil, true},
+		{"failed replaced", duplicatePolicySkip, failed, other, &other, false},
+		{"failed replaced under error", duplicatePolicyError, failed, other, &other, false},
+		{"failure never replaces", duplicatePolicyOverwrite, ok, failed, nil, false},
+		{"failure never errors", duplicatePolicyError, ok, failed, nil, false},
+		{"no data merged into usage", duplicatePolicyMerge, ok, empty, &ok, false},
+		{"usage merged into no data", duplicatePolicyMerge, empty, other, &other, false},
+		{"no data merged into no data", duplicatePolicyMerge, empty, empty, &empty, false},
+		{"corrections not overwritten", duplicatePolicyOverwrite, corrected, other, nil, false},
+		{"corrections not merged", duplicatePolicyMerge, corrected, other, nil, false},
+		{"corrections never error", duplicatePolicyError, corrected, other, nil, false},
+	}
+
+	for _, test := range tests {
+		got, err := resolveDuplicate(test.policy, test.existing, test.bwup)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if _, ok := err.(DuplicateError); err != nil && !ok {
+			t.Errorf("%s: got a %T, want a DuplicateError", test.name, err)
+		}
+		if !sameUsage(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeUsageOneDirection(t *testing.T) {
+	up := 5.0
+	existing := BandwidthUsagePeriod{Up: &up, Total: &up, Status: usageStatusOK}
+
+	down := 2.0
+	bwup := BandwidthUsagePeriod{Down: &down, Total: &down, Status: usageStatusOK}
+
+	merged := mergeUsage(existing, bwup)
+	if merged.Up == nil || merged.Down == nil || merged.Total == nil || *merged.Total != 7 {
+		t.Errorf("got %+v, want a total of 7", merged)
+	}
+}
+
+func TestValidDuplicatePolicy(t *testing.T) {
+	for _, policy := range []string{duplicatePolicySkip, duplicatePolicyOverwrite, duplicatePolicyMerge, duplicatePolicyError} {
+		if !validDuplicatePolicy(policy) {
+			t.Errorf("%s should be valid", policy)
+		}
+	}
+	if validDuplicatePolicy("append") {
+		t.Error("append should be invalid")
+	}
+}
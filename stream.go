@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of events streamed by /api/v1/events
+const (
+	streamEventUsage = "usage"
+	streamEventRun   = "run"
+)
+
+// streamKeepalive is how often an idle stream gets a comment, so proxies
+// don't close it
+const streamKeepalive = 15 * time.Second
+
+// streamClientBuffer is how many events a client can fall behind before it
+// is dropped. Clients reconnect on their own and read what they missed
+// from the API
+const streamClientBuffer = 256
+
+// StreamEvent is a change streamed to a dashboard: a usage period saved, or
+// a run's metrics saved as it starts and once it finished
+type StreamEvent struct {
+	Kind string
+	Data interface{}
+}
+
+// streamChange is the part of a change stream event the streams read
+type streamChange struct {
+	FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// EventStream fans a tenant's usage and run changes out to the clients
+// following them, from the change streams of its Mongo collections. Mongo
+// is only watched while a client is following
+type EventStream struct {
+	// watch tails the changes until ctx is done, handing each to publish
+	watch func(ctx context.Context, publish func(StreamEvent))
+
+	mutex   sync.Mutex
+	clients map[chan StreamEvent]bool
+	cancel  context.CancelFunc
+	closed  bool
+}
+
+func newEventStream(network string, usage *mongo.Collection, runs *mongo.Collection) *EventStream {
+	return &EventStream{
+		watch: func(ctx context.Context, publish func(StreamEvent)) {
+			go watchStream(ctx, usage, network, streamEventUsage, func(raw bson.Raw) (interface{}, error) {
+				var bwup BandwidthUsagePeriod
+				err := bson.Unmarshal(raw, &bwup)
+				return bwup, err
+			}, publish)
+			watchStream(ctx, runs, network, streamEventRun, func(raw bson.Raw) (interface{}, error) {
+				metrics := &RunMetrics{}
+				err := bson.Unmarshal(raw, metrics)
+				return metrics, err
+			}, publish)
+		},
+		clients: map[chan StreamEvent]bool{},
+	}
+}
+
+// Subscribe follows the stream, starting to watch Mongo for the first
+// client. The channel is closed if the client falls too far behind or the
+// stream is closed, and unsubscribe must be called once it is done
+func (s *EventStream) Subscribe() (events chan StreamEvent, unsubscribe func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events = make(chan StreamEvent, streamClientBuffer)
+	if s.closed {
+		close(events)
+		return events, func() {}
+	}
+
+	s.clients[events] = true
+	if s.cancel == nil {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		go s.watch(ctx, s.publish)
+	}
+
+	return events, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.drop(events)
+	}
+}
+
+// drop removes a client, and stops watching Mongo after the last one. The
+// mutex must be held
+func (s *EventStream) drop(events chan StreamEvent) {
+	if !s.clients[events] {
+		return
+	}
+	delete(s.clients, events)
+	close(events)
+
+	if len(s.clients) == 0 && s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+func (s *EventStream) publish(event StreamEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for events := range s.clients {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Dropping a %s event stream client which fell behind", event.Kind)
+			s.drop(events)
+		}
+	}
+}
+
+// Close ends every client's stream, as the server shuts down
+func (s *EventStream) Close() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for events := range s.clients {
+		s.drop(events)
+	}
+}
+
+// watchStream publishes the network's changes of a collection as events of
+// a kind until ctx is done. Errors, like Mongo stepping down, are retried
+// from where the stream got to
+func watchStream(ctx context.Context, collection *mongo.Collection, network string, kind string, decode func(bson.Raw) (interface{}, error), publish func(StreamEvent)) {
+	var resumeToken bson.Raw
+	delay := time.Second
+	for {
+		streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			streamOptions.SetResumeAfter(resumeToken)
+		}
+
+		stream, err := collection.Watch(ctx, watchPipeline(network), streamOptions)
+		if err == nil {
+			delay = time.Second
+			for stream.Next(ctx) {
+				resumeToken = stream.ResumeToken()
+
+				var change streamChange
+				if err := stream.Decode(&change); err != nil {
+					log.Printf("Error reading a change of %s: %v", collection.Name(), err)
+					continue
+				}
+				data, err := decode(change.FullDocument)
+				if err != nil {
+					log.Printf("Error reading a change of %s: %v", collection.Name(), err)
+					continue
+				}
+				publish(StreamEvent{Kind: kind, Data: data})
+			}
+			err = stream.Err()
+			stream.Close(context.Background())
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error watching %s, retrying in %v: %v", collection.Name(), delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxWatchRetryDelay {
+			delay = maxWatchRetryDelay
+		}
+	}
+}
+
+// writeStreamEvent writes an event in the server-sent events format
+func writeStreamEvent(w io.Writer, event StreamEvent) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Kind, data)
+	return err
+}
+
+// handleEvents streams the network's usage periods and run metrics to
+// viewers as server-sent events while they are saved, so a dashboard can
+// show collection as it goes. A run event without FinishedAt is a run
+// starting, with the number of members it is collecting
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "events require GET")
+		return
+	}
+
+	tenant, _, ok := s.authorize(w, r, r.URL.Query().Get("network"), roleViewer)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || tenant.events == nil {
+		writeJSONError(w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+
+	events, unsubscribe := tenant.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeStreamEvent(w, event); err != nil {
+				log.Printf("Error streaming a %s event: %v", event.Kind, err)
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
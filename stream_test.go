@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEventStream returns a stream which publishes what is sent on changes
+// while watched, and reports when watching stops on stopped
+func fakeEventStream() (*EventStream, chan StreamEvent, chan struct{}) {
+	changes := make(chan StreamEvent)
+	stopped := make(chan struct{}, 1)
+	stream := &EventStream{
+		watch: func(ctx context.Context, publish func(StreamEvent)) {
+			for {
+				select {
+				case <-ctx.Done():
+					stopped <- struct{}{}
+					return
+				case event := <-changes:
+					publish(event)
+				}
+			}
+		},
+		clients: map[chan StreamEvent]bool{},
+	}
+	return stream, changes, stopped
+}
+
+func TestEventStream(t *testing.T) {
+	stream, changes, stopped := fakeEventStream()
+
+	first, unsubscribeFirst := stream.Subscribe()
+	second, unsubscribeSecond := stream.Subscribe()
+
+	changes <- StreamEvent{Kind: streamEventUsage, Data: "Alice"}
+	for _, events := range []chan StreamEvent{first, second} {
+		if event := <-events; event.Kind != streamEventUsage || event.Data != "Alice" {
+			t.Errorf("got %+v, want Alice's usage", event)
+		}
+	}
+
+	unsubscribeFirst()
+	if _, ok := <-first; ok {
+		t.Error("expected the unsubscribed client's channel closed")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("stopped watching with a client left")
+	default:
+	}
+
+	unsubscribeSecond()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("still watching without clients")
+	}
+}
+
+func TestEventStreamSlowClient(t *testing.T) {
+	stream, _, _ := fakeEventStream()
+
+	slow, unsubscribe := stream.Subscribe()
+	defer unsubscribe()
+
+	for i := 0; i <= streamClientBuffer; i++ {
+		stream.publish(StreamEvent{Kind: streamEventUsage})
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != streamClientBuffer {
+		t.Errorf("got %d events, want the %d buffered before the client was dropped", received, streamClientBuffer)
+	}
+}
+
+func TestEventStreamClose(t *testing.T) {
+	stream, _, stopped := fakeEventStream()
+
+	events, unsubscribe := stream.Subscribe()
+	defer unsubscribe()
+
+	stream.Close()
+	if _, ok := <-events; ok {
+		t.Error("expected the client's channel closed")
+	}
+	<-stopped
+
+	late, _ := stream.Subscribe()
+	if _, ok := <-late; ok {
+		t.Error("expected clients of a closed stream to get nothing")
+	}
+}
+
+func TestWriteStreamEvent(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeStreamEvent(&buffer, StreamEvent{Kind: streamEventRun, Data: map[string]int{"Members": 12}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "event: run\ndata: {\"Members\":12}\n\n"; buffer.String() != want {
+		t.Errorf("got %q, want %q", buffer.String(), want)
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	tokens, err := parseAPITokens([]string{"viewer:view", "member:rec1:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, changes, _ := fakeEventStream()
+	server := newServer(Settings{Network: "casa"}, map[string]*Tenant{"casa": {tokens: tokens, events: stream}}, nil)
+	httpServer := httptest.NewServer(server.routes())
+	defer httpServer.Close()
+
+	get := func(token string) *http.Response {
+		r, err := http.NewRequest("GET", httpServer.URL+"/api/v1/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// Members only ever see their own usage, not the whole network's
+	member := get("mine")
+	member.Body.Close()
+	if member.StatusCode != http.StatusForbidden {
+		t.Errorf("member: got status %d, want %d", member.StatusCode, http.StatusForbidden)
+	}
+
+	response := get("view")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d and content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	bwup := usage(1, 2)
+	changes <- StreamEvent{Kind: streamEventUsage, Data: bwup}
+
+	lines := bufio.NewReader(response.Body)
+	event, err := lines.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := lines.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != "event: usage\n" || !strings.HasPrefix(data, "data: {") || !strings.Contains(data, `"Name":"Alice"`) {
+		t.Errorf("got %q and %q, want Alice's usage", event, data)
+	}
+}
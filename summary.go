@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ANSI escapes for the run summary
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorBold   = "\x1b[1m"
+	colorReset  = "\x1b[0m"
+)
+
+// isTerminal tells if the file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor tells if output to the file should be colored, which the
+// NO_COLOR convention turns off
+func useColor(f *os.File) bool {
+	return isTerminal(f) && os.Getenv("NO_COLOR") == ""
+}
+
+// RunSummary adds up the usage periods of a collection run for the summary
+// printed at its end
+type RunSummary struct {
+	Members  int
+	Active   int
+	Inactive int
+	Failed   int
+	Up       float64
+	Down     float64
+	Total    float64
+	Failures []string
+	// Anomalies describes the periods flagged as out of line
+	Anomalies []string
+}
+
+func (s *RunSummary) Add(bwup BandwidthUsagePeriod) {
+	s.Members++
+
+	switch bwup.Status {
+	case usageStatusFailed:
+		s.Failed++
+		s.Failures = append(s.Failures, fmt.Sprintf("%s: %s", bwup.Name, bwup.Error))
+		return
+	case usageStatusNoData:
+		s.Inactive++
+		return
+	}
+
+	if bwup.Anomaly != nil {
+		s.Anomalies = append(s.Anomalies, fmt.Sprintf("%s: %.1f deviations from the usual %.3f GB", bwup.Name, bwup.Anomaly.Score, bwup.Anomaly.Baseline))
+	}
+
+	s.Active++
+	if bwup.Up != nil {
+		s.Up += *bwup.Up
+	}
+	if bwup.Down != nil {
+		s.Down += *bwup.Down
+	}
+	if bwup.Total != nil {
+		s.Total += *bwup.Total
+	}
+}
+
+// Print writes the summary, coloring the failures red if color is set
+func (s *RunSummary) Print(w io.Writer, color bool) {
+	paint := func(code string, text string) string {
+		if !color {
+			return text
+		}
+		return code + text + colorReset
+	}
+
+	lines := []string{
+		paint(colorBold, "Collection summary"),
+		fmt.Sprintf("  Members:  %d (%d active, %d inactive)", s.Members, s.Active, s.Inactive),
+		fmt.Sprintf("  Usage:    %.3f GB up, %.3f GB down, %.3f GB total", s.Up, s.Down, s.Total),
+	}
+
+	if s.Failed == 0 {
+		lines = append(lines, paint(colorGreen, "  Failures: none"))
+	} else {
+		lines = append(lines, paint(colorRed, fmt.Sprintf("  Failures: %d", s.Failed)))
+		for _, failure := range s.Failures {
+			lines = append(lines, paint(colorRed, "    "+failure))
+		}
+	}
+
+	if len(s.Anomalies) > 0 {
+		lines = append(lines, paint(colorYellow, fmt.Sprintf("  Anomalies: %d", len(s.Anomalies))))
+		for _, anomaly := range s.Anomalies {
+			lines = append(lines, paint(colorYellow, "    "+anomaly))
+		}
+	}
+
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
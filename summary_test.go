@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunSummary(t *testing.T) {
+	summary := &RunSummary{}
+	summary.Add(usage(1.5, 12.25))
+	anomalous := usage(0.5, 0.75)
+	anomalous.Name = "Bob"
+	anomalous.Anomaly = &UsageAnomaly{Method: anomalyMAD, Score: 12.5, Baseline: 0.1, Threshold: 3.5}
+	summary.Add(anomalous)
+	summary.Add(noUsage())
+	summary.Add(failedUsage())
+
+	if summary.Members != 4 || summary.Active != 2 || summary.Inactive != 1 || summary.Failed != 1 || summary.Total != 15 {
+		t.Errorf("got %+v", summary)
+	}
+
+	var plain bytes.Buffer
+	summary.Print(&plain, false)
+	checkGolden(t, "summary.txt", plain.Bytes())
+
+	var colored bytes.Buffer
+	summary.Print(&colored, true)
+	if !strings.Contains(colored.String(), colorRed+"    Alice: timeout"+colorReset) {
+		t.Errorf("failures aren't red: %q", colored.String())
+	}
+	if !strings.Contains(colored.String(), colorYellow+"    Bob: 12.5 deviations from the usual 0.100 GB"+colorReset) {
+		t.Errorf("anomalies aren't yellow: %q", colored.String())
+	}
+	if strings.Contains(plain.String(), "\x1b[") {
+		t.Errorf("plain summary is colored: %q", plain.String())
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateReport is what report templates are rendered against: a
+// network's usage over the window, per member and as stored
+type TemplateReport struct {
+	Network     string
+	From        time.Time
+	To          time.Time
+	GeneratedAt time.Time
+	Up          float64
+	Down        float64
+	Total       float64
+	// Members is each member's usage over the window, busiest first
+	Members []MemberSummary
+	// Periods are the usage periods stored over the window, oldest first
+	Periods     []BandwidthUsagePeriod
+	Annotations []Annotation
+}
+
+// reportFunctions are the functions report templates can use besides the
+// builtin ones. groups reads the member list from Airtable the first time
+// it is called
+func reportFunctions(language string, report TemplateReport, members func() ([]MeshMember, error)) map[string]interface{} {
+	var loaded []MeshMember
+	return map[string]interface{}{
+		"date":  func(t time.Time) string { return formatDate(language, t) },
+		"month": func(t time.Time) string { return formatMonth(language, t) },
+		// gb writes usage with three decimals, or a dash if there is none
+		"gb": func(value interface{}) string {
+			switch value := value.(type) {
+			case float64:
+				return tableNumber(&value)
+			case *float64:
+				return tableNumber(value)
+			}
+			return "-"
+		},
+		"percent": func(part float64, whole float64) string {
+			if whole == 0 {
+				return "-"
+			}
+			return strconv.FormatFloat(part/whole*100, 'f', 1, 64) + "%"
+		},
+		"groups": func(by string) ([]GroupUsage, error) {
+			if loaded == nil {
+				all, err := members()
+				if err != nil {
+					return nil, err
+				}
+				loaded = all
+			}
+			summary := DashboardSummary{Network: report.Network, From: report.From, To: report.To, Members: report.Members}
+			return groupUsage(summary, loaded, by), nil
+		},
+	}
+}
+
+// isHTMLTemplate tells if a template is HTML by its extension, which
+// escapes what it writes for HTML
+func isHTMLTemplate(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// renderTemplateReport renders a report template, as HTML if html is set
+func renderTemplateReport(w io.Writer, text string, html bool, language string, report TemplateReport, members func() ([]MeshMember, error)) error {
+	functions := reportFunctions(language, report, members)
+
+	var output bytes.Buffer
+	if html {
+		tmpl, err := htmltemplate.New("report").Funcs(htmltemplate.FuncMap(functions)).Parse(text)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(&output, report); err != nil {
+			return err
+		}
+	} else {
+		tmpl, err := template.New("report").Funcs(template.FuncMap(functions)).Parse(text)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(&output, report); err != nil {
+			return err
+		}
+	}
+
+	// Nothing is written of a report which failed halfway
+	_, err := w.Write(output.Bytes())
+	return err
+}
+
+// reportCommand renders the template given with -template against the
+// usage of each network over the window, like
+// `report -template monthly.tmpl 720h`. Templates ending in .html are
+// rendered as HTML
+func reportCommand(args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	path := flags.String("template", "", "Go template to render, text or, ending in .html, HTML")
+	flags.Parse(args)
+
+	if *path == "" {
+		fatal("report needs a -template")
+	}
+	text, err := ioutil.ReadFile(*path)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, "", "", from, to)
+		if err != nil {
+			fatal(err)
+		}
+		annotations, err := getAnnotations(bwupCollection.Database().Collection(settings.MongoAnnotationsCollection), settings.Network, "", from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		summary := summarizeDashboard(settings.Network, periods, from, to)
+		report := TemplateReport{
+			Network:     settings.Network,
+			From:        from,
+			To:          to,
+			GeneratedAt: time.Now(),
+			Up:          summary.Up,
+			Down:        summary.Down,
+			Total:       summary.Total,
+			Members:     summary.Members,
+			Periods:     periods,
+			Annotations: annotations,
+		}
+
+		members := func() ([]MeshMember, error) { return getMeshMembers(settings) }
+		if err := renderTemplateReport(os.Stdout, string(text), isHTMLTemplate(*path), settings.DefaultLanguage, report, members); err != nil {
+			fatal(err)
+		}
+	}
+}
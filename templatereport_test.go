@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func templateReport() TemplateReport {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	return TemplateReport{
+		Network: "casa",
+		From:    from,
+		To:      from.AddDate(0, 1, 0),
+		Total:   30.5,
+		Members: []MemberSummary{
+			{MemberID: "rec1", Name: "Alice <admin>", Total: 20},
+			{MemberID: "rec2", Name: "Bob", Total: 10.5},
+		},
+	}
+}
+
+func TestRenderTemplateReport(t *testing.T) {
+	members := func() ([]MeshMember, error) {
+		alice, bob := MeshMember{ID: "rec1"}, MeshMember{ID: "rec2"}
+		alice.Fields.Tags = []string{"neighborhood:Centro"}
+		bob.Fields.Tags = []string{"neighborhood:Norte"}
+		return []MeshMember{alice, bob}, nil
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		html     bool
+		output   string
+	}{
+		{"totals", `{{.Network}} {{month .From}}: {{gb .Total}} GB`, false, "casa Sep 2026: 30.500 GB"},
+		{"members", `{{range .Members}}{{.Name}} {{percent .Total $.Total}}
+{{end}}`, false, "Alice <admin> 65.6%\nBob 34.4%\n"},
+		{"escaped", `{{range .Members}}<li>{{.Name}}</li>{{end}}`, true, "<li>Alice &lt;admin&gt;</li><li>Bob</li>"},
+		{"groups", `{{range groups "neighborhood"}}{{.Group}}={{gb .Total}} {{end}}`, false, "Centro=20.000 Norte=10.500 "},
+		{"missing usage", `{{gb .Up}} {{gb nil}}`, false, "0.000 -"},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		if err := renderTemplateReport(&output, test.template, test.html, defaultLanguage, templateReport(), members); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if output.String() != test.output {
+			t.Errorf("%s: got %q, want %q", test.name, output.String(), test.output)
+		}
+	}
+}
+
+func TestRenderTemplateReportErrors(t *testing.T) {
+	members := func() ([]MeshMember, error) { return nil, fmt.Errorf("airtable is down") }
+
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{"unparseable", `{{range .Members}}`},
+		{"unknown field", `{{.Nope}}`},
+		{"members failing", `before {{groups "site"}}`},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		if err := renderTemplateReport(&output, test.template, false, defaultLanguage, templateReport(), members); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+		if output.Len() > 0 {
+			t.Errorf("%s: wrote %q of a failed report", test.name, output.String())
+		}
+	}
+}
+
+func TestIsHTMLTemplate(t *testing.T) {
+	for path, html := range map[string]bool{"monthly.tmpl": false, "monthly.html": true, "reports/Monthly.HTM": true, "monthly.txt": false} {
+		if isHTMLTemplate(path) != html {
+			t.Errorf("%s: got %v, want %v", path, !html, html)
+		}
+	}
+}
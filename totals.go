@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UsageTotals is a member's cumulative usage since their first stored
+// period, kept up to date with every period stored when
+// MONGO_TOTALS_COLLECTION is set. Years holds the totals of each calendar
+// year, keyed like "2026", which periods count in by their start
+type UsageTotals struct {
+	Network  string
+	MemberID string `json:",omitempty" bson:",omitempty"`
+	Name     string
+	First    time.Time
+	Periods  int
+	Up       float64
+	Down     float64
+	Total    float64
+	Years    map[string]YearTotals
+	// YearToDate is filled in from Years when totals are read
+	YearToDate YearTotals `bson:"-"`
+}
+
+// YearTotals is a member's usage over a calendar year
+type YearTotals struct {
+	Up    float64
+	Down  float64
+	Total float64
+}
+
+// usageValue is a period's usage as counted in totals, where failed periods
+// and directions without data count nothing
+func usageValue(bwup *BandwidthUsagePeriod) (up float64, down float64, total float64) {
+	if bwup == nil || bwup.Status == usageStatusFailed {
+		return 0, 0, 0
+	}
+	if bwup.Up != nil {
+		up = *bwup.Up
+	}
+	if bwup.Down != nil {
+		down = *bwup.Down
+	}
+	if bwup.Total != nil {
+		total = *bwup.Total
+	}
+	return up, down, total
+}
+
+// totalsKey is the filter matching a member's totals, by ID or by name for
+// usage without one
+func totalsKey(bwup BandwidthUsagePeriod) bson.M {
+	key := bson.M{"network": bwup.Network}
+	if bwup.MemberID != "" {
+		key["memberid"] = bwup.MemberID
+	} else {
+		key["name"] = encryptName(bwup.Network, bwup.Name)
+		key["memberid"] = bson.M{"$exists": false}
+	}
+	return key
+}
+
+// addToTotals adds the change from the stored period existing, if any, to
+// its replacement to the member's totals
+func addToTotals(ctx context.Context, totals *mongo.Collection, existing *BandwidthUsagePeriod, replacement BandwidthUsagePeriod) error {
+	oldUp, oldDown, oldTotal := usageValue(existing)
+	up, down, total := usageValue(&replacement)
+
+	periods := 0
+	if existing == nil {
+		periods = 1
+	}
+
+	year := "years." + strconv.Itoa(replacement.From.UTC().Year())
+	update := bson.M{
+		"$set": bson.M{"network": replacement.Network, "name": encryptName(replacement.Network, replacement.Name)},
+		"$min": bson.M{"first": replacement.From},
+		"$inc": bson.M{
+			"periods":       periods,
+			"up":            up - oldUp,
+			"down":          down - oldDown,
+			"total":         total - oldTotal,
+			year + ".up":    up - oldUp,
+			year + ".down":  down - oldDown,
+			year + ".total": total - oldTotal,
+		},
+	}
+
+	_, err := totals.UpdateOne(ctx, totalsKey(replacement), update, options.Update().SetUpsert(true))
+	return err
+}
+
+// accumulateTotals adds up the totals of each member from their rollups and
+// the periods still stored
+func accumulateTotals(network string, rollups []UsageRollup, periods []BandwidthUsagePeriod) []UsageTotals {
+	byMember := map[string]*UsageTotals{}
+	keys := []string{}
+
+	member := func(memberID string, name string, first time.Time) *UsageTotals {
+		key := memberID + "|" + name
+		if memberID != "" {
+			key = memberID
+		}
+		totals, ok := byMember[key]
+		if !ok {
+			totals = &UsageTotals{Network: network, MemberID: memberID, Name: name, First: first, Years: map[string]YearTotals{}}
+			byMember[key] = totals
+			keys = append(keys, key)
+		}
+		if first.Before(totals.First) {
+			totals.First = first
+		}
+		return totals
+	}
+	add := func(totals *UsageTotals, year int, periods int, up float64, down float64, total float64) {
+		totals.Periods += periods
+		totals.Up += up
+		totals.Down += down
+		totals.Total += total
+
+		yearTotals := totals.Years[strconv.Itoa(year)]
+		yearTotals.Up += up
+		yearTotals.Down += down
+		yearTotals.Total += total
+		totals.Years[strconv.Itoa(year)] = yearTotals
+	}
+
+	for _, rollup := range rollups {
+		add(member(rollup.MemberID, rollup.Name, rollup.Month), rollup.Month.Year(), rollup.Periods, rollup.Up, rollup.Down, rollup.Total)
+	}
+	for i := range periods {
+		up, down, total := usageValue(&periods[i])
+		totals := member(periods[i].MemberID, periods[i].Name, periods[i].From)
+		totals.Name = periods[i].Name
+		add(totals, periods[i].From.UTC().Year(), 1, up, down, total)
+	}
+
+	sort.Strings(keys)
+	all := []UsageTotals{}
+	for _, key := range keys {
+		all = append(all, *byMember[key])
+	}
+	return all
+}
+
+// getUsageTotals reads the totals of a network, only those of one member if
+// memberID isn't empty
+func getUsageTotals(collection *mongo.Collection, network string, memberID string, now time.Time) ([]UsageTotals, error) {
+	all := []UsageTotals{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"network": network}
+	if memberID != "" {
+		filter["memberid"] = memberID
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return all, err
+	}
+	if err := cursor.All(ctx, &all); err != nil {
+		return all, err
+	}
+
+	year := strconv.Itoa(now.UTC().Year())
+	for i := range all {
+		all[i].YearToDate = all[i].Years[year]
+	}
+	return all, nil
+}
+
+// handleTotals returns members' usage since joining and this year. Members
+// only get their own, viewers anyone's or the whole network's
+func (s *Server) handleTotals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "totals require GET")
+		return
+	}
+
+	query := r.URL.Query()
+
+	tenant, token, ok := s.authorize(w, r, query.Get("network"), roleMember)
+	if !ok {
+		return
+	}
+
+	if tenant.settings.MongoTotalsCollection == "" {
+		writeJSONError(w, http.StatusNotFound, "totals aren't kept for this network, set MONGO_TOTALS_COLLECTION")
+		return
+	}
+
+	memberID := query.Get("member")
+	if !token.Allows(roleViewer) {
+		memberID = token.MemberID
+	}
+
+	totals, err := tenant.results.Get("totals:"+memberID, func() (interface{}, error) {
+		return getUsageTotals(tenant.reads.Database().Collection(tenant.settings.MongoTotalsCollection), tenant.settings.Network, memberID, time.Now())
+	})
+	if err != nil {
+		log.Printf("Error reading totals: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "error reading totals")
+		return
+	}
+
+	writeJSON(w, totals)
+}
+
+// rebuildTotalsCommand recomputes the totals of every network from its
+// rollups and stored periods, for networks which stored usage before
+// keeping totals
+func rebuildTotalsCommand(args []string) {
+	for _, settings := range loadAllNetworkSettings() {
+		if settings.MongoTotalsCollection == "" {
+			log.Printf("No MONGO_TOTALS_COLLECTION for network %s, skipping", settings.Network)
+			continue
+		}
+
+		bwupCollection, err := getBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+		db := bwupCollection.Database()
+
+		if err := rebuildTotals(settings, bwupCollection, db.Collection(settings.MongoRollupCollection), db.Collection(settings.MongoTotalsCollection)); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func rebuildTotals(settings Settings, usage *mongo.Collection, rollupCollection *mongo.Collection, totalsCollection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	network := bson.M{"network": networkMatch(settings.Network)}
+
+	rollups := []UsageRollup{}
+	cursor, err := rollupCollection.Find(ctx, network)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &rollups); err != nil {
+		return err
+	}
+
+	periods := []BandwidthUsagePeriod{}
+	cursor, err = usage.Find(ctx, network, options.Find().SetSort(bson.M{"from": 1}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &periods); err != nil {
+		return err
+	}
+
+	all := accumulateTotals(settings.Network, rollups, periods)
+
+	if _, err := totalsCollection.DeleteMany(ctx, bson.M{"network": settings.Network}); err != nil {
+		return err
+	}
+	for _, totals := range all {
+		if _, err := totalsCollection.InsertOne(ctx, totals); err != nil {
+			return err
+		}
+		printJSON(os.Stdout, totals)
+	}
+
+	fmt.Fprintf(os.Stderr, "Rebuilt the totals of %d members of network %s\n", len(all), settings.Network)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageValue(t *testing.T) {
+	if up, down, total := usageValue(nil); up != 0 || down != 0 || total != 0 {
+		t.Errorf("nothing stored counts %v %v %v", up, down, total)
+	}
+	failed := failedUsage()
+	if _, _, total := usageValue(&failed); total != 0 {
+		t.Errorf("a failed period counts %v", total)
+	}
+	none := noUsage()
+	if _, _, total := usageValue(&none); total != 0 {
+		t.Errorf("a period without data counts %v", total)
+	}
+	stored := usage(1, 2)
+	if up, down, total := usageValue(&stored); up != 1 || down != 2 || total != 3 {
+		t.Errorf("got %v %v %v", up, down, total)
+	}
+}
+
+func TestAccumulateTotals(t *testing.T) {
+	month := func(year int, month time.Month) time.Time { return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC) }
+	period := func(memberID string, name string, from time.Time, usage BandwidthUsagePeriod) BandwidthUsagePeriod {
+		usage.MemberID = memberID
+		usage.Name = name
+		usage.From = from
+		usage.To = from.Add(24 * time.Hour)
+		return usage
+	}
+
+	rollups := []UsageRollup{
+		{MemberID: "rec1", Name: "Alice", Month: month(2025, 11), Periods: 30, Up: 10, Down: 20, Total: 30},
+	}
+	periods := []BandwidthUsagePeriod{
+		period("rec1", "Alice", month(2026, 1), usage(1, 1)),
+		period("rec1", "Alice Smith", month(2026, 2), usage(2, 2)),
+		period("rec1", "Alice Smith", month(2026, 3), failedUsage()),
+		period("", "Bob", month(2026, 2), usage(5, 0)),
+	}
+
+	all := accumulateTotals("casa", rollups, periods)
+	if len(all) != 2 {
+		t.Fatalf("got totals %+v", all)
+	}
+
+	alice, bob := all[0], all[1]
+	if alice.Network != "casa" || alice.MemberID != "rec1" || alice.Name != "Alice Smith" || alice.Periods != 33 ||
+		alice.Up != 13 || alice.Down != 23 || alice.Total != 36 || !alice.First.Equal(month(2025, 11)) {
+		t.Errorf("got Alice %+v", alice)
+	}
+	if alice.Years["2025"] != (YearTotals{10, 20, 30}) || alice.Years["2026"] != (YearTotals{3, 3, 6}) {
+		t.Errorf("got Alice's years %+v", alice.Years)
+	}
+	if bob.MemberID != "" || bob.Name != "Bob" || bob.Total != 5 || bob.Years["2026"] != (YearTotals{5, 0, 5}) {
+		t.Errorf("got Bob %+v", bob)
+	}
+}
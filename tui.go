@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tuiDays is how many days of usage the TUI draws sparklines of
+const tuiDays = 14
+
+// tuiPageSize is how many members the TUI lists at once
+const tuiPageSize = 20
+
+// sparkBlocks are the bars of a sparkline, lowest to highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws the values as bars scaled to the highest, leaving a gap
+// for missing ones
+func sparkline(values []*float64) string {
+	var highest float64
+	for _, value := range values {
+		if value != nil && *value > highest {
+			highest = *value
+		}
+	}
+
+	line := make([]rune, len(values))
+	for i, value := range values {
+		switch {
+		case value == nil:
+			line[i] = ' '
+		case highest == 0:
+			line[i] = sparkBlocks[0]
+		default:
+			line[i] = sparkBlocks[int(*value/highest*float64(len(sparkBlocks)-1)+0.5)]
+		}
+	}
+	return string(line)
+}
+
+// dailyTotals adds up a member's usage on each of the days from from, nil
+// for days with none stored. Overlapping periods are counted once, as the
+// audit does
+func dailyTotals(periods []BandwidthUsagePeriod, from time.Time, days int) []*float64 {
+	byDay := make([][]BandwidthUsagePeriod, days)
+	for _, period := range periods {
+		day := int(period.From.Sub(from) / (24 * time.Hour))
+		if period.From.Before(from) || day >= days || period.Status == usageStatusFailed {
+			continue
+		}
+		byDay[day] = append(byDay[day], period)
+	}
+
+	totals := make([]*float64, days)
+	for day, periods := range byDay {
+		if len(periods) > 0 {
+			total := sumMemberUsage(periods).Total
+			totals[day] = &total
+		}
+	}
+	return totals
+}
+
+// TUI is a terminal UI for browsing the members and their stored usage, and
+// re-collecting a member, over SSH where the dashboard can't be reached.
+// It reads a command a line at a time, so it works in any terminal
+type TUI struct {
+	network string
+	members []MeshMember
+	// usage reads the usage stored over a window, of every member if
+	// memberID is empty
+	usage func(memberID string, name string, from time.Time, to time.Time) ([]BandwidthUsagePeriod, error)
+	// recollect collects and stores a member's usage over a window
+	recollect func(member MeshMember, window timeWindow) (BandwidthUsagePeriod, error)
+	now       func() time.Time
+	color     bool
+
+	in  *bufio.Scanner
+	out io.Writer
+
+	filter   string
+	page     int
+	selected *MeshMember
+	message  string
+}
+
+// visible are the members matching the filter, by name
+func (t *TUI) visible() []MeshMember {
+	members := []MeshMember{}
+	for _, member := range t.members {
+		text := strings.ToLower(member.Fields.Name + " " + member.ID + " " + member.Fields.WGKey + " " + member.Fields.Site)
+		if strings.Contains(text, strings.ToLower(t.filter)) {
+			members = append(members, member)
+		}
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return strings.ToLower(members[i].Fields.Name) < strings.ToLower(members[j].Fields.Name)
+	})
+	return members
+}
+
+// pages is the number of pages of visible members
+func (t *TUI) pages() int {
+	return (len(t.visible()) + tuiPageSize - 1) / tuiPageSize
+}
+
+// Run draws the TUI and handles commands until q or the end of input
+func (t *TUI) Run() error {
+	for {
+		t.draw()
+		if !t.in.Scan() {
+			return t.in.Err()
+		}
+		if !t.handle(strings.TrimSpace(t.in.Text())) {
+			return nil
+		}
+	}
+}
+
+// handle acts on a command, returning false to quit
+func (t *TUI) handle(command string) bool {
+	t.message = ""
+	if command == "q" {
+		return false
+	}
+
+	if t.selected != nil {
+		switch {
+		case command == "b":
+			t.selected = nil
+		case command == "c" || strings.HasPrefix(command, "c "):
+			t.recollectSelected(strings.TrimSpace(strings.TrimPrefix(command, "c")))
+		case command != "":
+			t.message = "unknown command " + command
+		}
+		return true
+	}
+
+	switch {
+	case command == "":
+	case command == "n":
+		if t.page+1 < t.pages() {
+			t.page++
+		}
+	case command == "p":
+		if t.page > 0 {
+			t.page--
+		}
+	case strings.HasPrefix(command, "/"):
+		t.filter = strings.TrimPrefix(command, "/")
+		t.page = 0
+	default:
+		number, err := strconv.Atoi(command)
+		visible := t.visible()
+		if err != nil || number < 1 || number > len(visible) {
+			t.message = "unknown command " + command
+			break
+		}
+		t.selected = &visible[number-1]
+	}
+	return true
+}
+
+// recollectSelected collects the selected member's usage again over the
+// duration up to the last whole hour, the last day if it is empty
+func (t *TUI) recollectSelected(duration string) {
+	length := 24 * time.Hour
+	if duration != "" {
+		var err error
+		if length, err = time.ParseDuration(duration); err != nil || length <= 0 {
+			t.message = fmt.Sprintf("invalid duration %q, expected one like 24h", duration)
+			return
+		}
+	}
+
+	to := t.now().Truncate(time.Hour)
+	bwup, err := t.recollect(*t.selected, timeWindow{From: to.Add(-length), To: to})
+	if err != nil {
+		t.message = "error re-collecting: " + err.Error()
+		return
+	}
+	t.message = fmt.Sprintf("re-collected %s from %s: %s", strings.TrimSpace(t.selected.Fields.Name), bwup.From.Format(time.RFC3339), tuiUsage(bwup))
+}
+
+// tuiUsage describes the total of a period
+func tuiUsage(bwup BandwidthUsagePeriod) string {
+	if bwup.Total == nil {
+		return bwup.Status
+	}
+	return fmt.Sprintf("%.3f GB", *bwup.Total)
+}
+
+func (t *TUI) paint(code string, text string) string {
+	if !t.color {
+		return text
+	}
+	return code + text + colorReset
+}
+
+// draw clears the terminal and draws the list or the selected member
+func (t *TUI) draw() {
+	fmt.Fprint(t.out, "\x1b[H\x1b[2J")
+
+	to := t.now().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	from := to.AddDate(0, 0, -tuiDays)
+	if t.selected != nil {
+		t.drawMember(from, to)
+	} else {
+		t.drawList(from, to)
+	}
+
+	if t.message != "" {
+		fmt.Fprintln(t.out, t.paint(colorYellow, t.message))
+	}
+	fmt.Fprint(t.out, "> ")
+}
+
+func (t *TUI) drawList(from time.Time, to time.Time) {
+	visible := t.visible()
+	pages := t.pages()
+	if pages == 0 {
+		pages = 1
+	}
+	fmt.Fprintln(t.out, t.paint(colorBold, fmt.Sprintf("%s: %d members, page %d of %d, the last %d days", t.network, len(visible), t.page+1, pages, tuiDays)))
+	if t.filter != "" {
+		fmt.Fprintf(t.out, "matching %q\n", t.filter)
+	}
+	fmt.Fprintln(t.out)
+
+	periods, err := t.usage("", "", from, to)
+	if err != nil {
+		t.message = "error reading usage: " + err.Error()
+	}
+	byMember := map[string][]BandwidthUsagePeriod{}
+	for _, period := range periods {
+		member := period.MemberID
+		if member == "" {
+			member = period.Name
+		}
+		byMember[member] = append(byMember[member], period)
+	}
+
+	start := t.page * tuiPageSize
+	for i := start; i < len(visible) && i < start+tuiPageSize; i++ {
+		member := visible[i]
+		usage := byMember[member.ID]
+		if len(usage) == 0 {
+			usage = byMember[member.Fields.Name]
+		}
+		totals := dailyTotals(usage, from, tuiDays)
+		var total float64
+		for _, day := range totals {
+			if day != nil {
+				total += *day
+			}
+		}
+		fmt.Fprintf(t.out, "%4d  %-28.28s %s %10.3f GB\n", i+1, strings.TrimSpace(member.Fields.Name), sparkline(totals), total)
+	}
+
+	fmt.Fprintln(t.out)
+	fmt.Fprintln(t.out, "number: open a member  /text: filter  n, p: next, previous page  q: quit")
+}
+
+func (t *TUI) drawMember(from time.Time, to time.Time) {
+	member := *t.selected
+	fmt.Fprintln(t.out, t.paint(colorBold, fmt.Sprintf("%s (%s)", strings.TrimSpace(member.Fields.Name), member.ID)))
+	fmt.Fprintf(t.out, "Key: %s  Site: %s  Plan: %g Mbps\n\n", member.Fields.WGKey, member.Fields.Site, member.Fields.PlanMbps)
+
+	periods, err := t.usage(member.ID, strings.TrimSpace(member.Fields.Name), from, to)
+	if err != nil {
+		t.message = "error reading usage: " + err.Error()
+	}
+	fmt.Fprintf(t.out, "The last %d days: %s\n\n", tuiDays, sparkline(dailyTotals(periods, from, tuiDays)))
+
+	// The latest periods, newest first
+	for i := len(periods) - 1; i >= 0 && i >= len(periods)-10; i-- {
+		period := periods[i]
+		line := fmt.Sprintf("  %s  %-8s %s", period.From.Format("2006-01-02 15:04"), period.Duration, tuiUsage(period))
+		if period.Status == usageStatusFailed {
+			line = t.paint(colorRed, line+" "+period.Error)
+		}
+		fmt.Fprintln(t.out, line)
+	}
+
+	fmt.Fprintln(t.out)
+	fmt.Fprintln(t.out, "c [duration]: re-collect the last day, or duration  b: back  q: quit")
+}
+
+// tuiCommand browses the network's members and stored usage in the terminal
+func tuiCommand(args []string) {
+	if len(args) != 0 {
+		fatal("usage: stat-collector tui")
+	}
+
+	settings := loadSettings()
+	members, err := getMeshMembers(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	reads, err := getReadBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+	bwupCollection, err := getBWUPCollection(settings)
+	if err != nil {
+		fatal(err)
+	}
+	balances, err := newBalanceStore(settings, bwupCollection.Database(), members)
+	if err != nil {
+		fatal(err)
+	}
+
+	tui := &TUI{
+		network: settings.Network,
+		members: members,
+		usage: func(memberID string, name string, from time.Time, to time.Time) ([]BandwidthUsagePeriod, error) {
+			return getUsagePeriods(reads, settings.Network, memberID, name, from, to)
+		},
+		recollect: func(member MeshMember, window timeWindow) (BandwidthUsagePeriod, error) {
+			windowed := windowSettings(settings, window)
+			source, err := newStatSource(windowed)
+			if err != nil {
+				return BandwidthUsagePeriod{}, err
+			}
+			store, err := newUsageStore(windowed, bwupCollection)
+			if err != nil {
+				return BandwidthUsagePeriod{}, err
+			}
+			bwup, keep := applyConsent(settings, collectMember(windowed, source, member), member)
+			if !keep {
+				return bwup, fmt.Errorf("%s opted out of tracking, their usage isn't stored", member.Fields.Name)
+			}
+			return bwup, MultiStore{store, balances}.Insert(bwup)
+		},
+		now:   time.Now,
+		color: useColor(os.Stdout),
+		in:    bufio.NewScanner(os.Stdin),
+		out:   os.Stdout,
+	}
+	if err := tui.Run(); err != nil {
+		fatal(err)
+	}
+}
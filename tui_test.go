@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSparkline(t *testing.T) {
+	one, four, eight := 1.0, 4.0, 8.0
+	if line := sparkline([]*float64{&one, nil, &four, &eight}); line != "▂ ▅█" {
+		t.Errorf("got %q", line)
+	}
+	zero := 0.0
+	if line := sparkline([]*float64{&zero, &zero}); line != "▁▁" {
+		t.Errorf("got %q for no usage", line)
+	}
+}
+
+func TestDailyTotals(t *testing.T) {
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	period := func(day int, hours int, total float64, status string) BandwidthUsagePeriod {
+		start := from.AddDate(0, 0, day)
+		return BandwidthUsagePeriod{From: start, To: start.Add(time.Duration(hours) * time.Hour), Total: &total, Status: status}
+	}
+
+	totals := dailyTotals([]BandwidthUsagePeriod{
+		period(-1, 24, 9, usageStatusOK),
+		period(0, 1, 1, usageStatusOK),
+		period(0, 24, 5, usageStatusOK),
+		period(2, 24, 3, usageStatusOK),
+		period(1, 24, 7, usageStatusFailed),
+		period(3, 24, 2, usageStatusOK),
+	}, from, 3)
+
+	if len(totals) != 3 || *totals[0] != 5 || totals[1] != nil || *totals[2] != 3 {
+		t.Errorf("got %v", totals)
+	}
+}
+
+func TestTUI(t *testing.T) {
+	now := time.Date(2026, 10, 16, 10, 30, 0, 0, time.UTC)
+	members := []MeshMember{{ID: "rec1"}, {ID: "rec2"}, {ID: "rec3"}}
+	members[0].Fields.Name = "Bob"
+	members[1].Fields.Name = "Alice"
+	members[2].Fields.Name = "Alicia"
+
+	total := 2.5
+	stored := []BandwidthUsagePeriod{{MemberID: "rec2", From: now.Add(-24 * time.Hour), To: now, Duration: 24 * time.Hour, Total: &total, Status: usageStatusOK}}
+
+	var recollected []timeWindow
+	out := &bytes.Buffer{}
+	tui := &TUI{
+		network: "casa",
+		members: members,
+		usage: func(memberID string, name string, from time.Time, to time.Time) ([]BandwidthUsagePeriod, error) {
+			return stored, nil
+		},
+		recollect: func(member MeshMember, window timeWindow) (BandwidthUsagePeriod, error) {
+			recollected = append(recollected, window)
+			return BandwidthUsagePeriod{MemberID: member.ID, From: window.From, To: window.To, Total: &total, Status: usageStatusOK}, nil
+		},
+		now: func() time.Time { return now },
+		in:  bufio.NewScanner(strings.NewReader("/ali\n1\nc 2h\nc soon\nb\n9\nq\nnever read\n")),
+		out: out,
+	}
+	if err := tui.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	screen := out.String()
+	for _, want := range []string{
+		"casa: 3 members",
+		"casa: 2 members, page 1 of 1",
+		"   1  Alice                        ",
+		"Alice (rec2)",
+		"re-collected Alice from 2026-10-16T08:00:00Z: 2.500 GB",
+		`invalid duration "soon"`,
+		"unknown command 9",
+	} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("expected %q in the screens:\n%s", want, screen)
+		}
+	}
+	if len(recollected) != 1 || !recollected[0].To.Equal(now.Truncate(time.Hour)) {
+		t.Errorf("got re-collected windows %+v", recollected)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MemberUptime is the share of a window a member's router was passing
+// traffic, in hours, against the SLA target. Hours in maintenance windows,
+// and hours whose usage couldn't be collected, are left out of both
+// Expected and Up
+type MemberUptime struct {
+	Network     string
+	MemberID    string `json:",omitempty"`
+	Name        string
+	From        time.Time
+	To          time.Time
+	Expected    int
+	Up          int
+	Maintenance int
+	Unknown     int
+	Uptime      float64
+	Target      float64
+	Breach      bool
+}
+
+// Hours of an uptime window, by what their periods tell
+const (
+	hourDown = iota
+	hourUnknown
+	hourUp
+	hourMaintenance
+)
+
+// computeUptime works out each member's uptime over the window hour by
+// hour. An hour is up if any period covering it had traffic, and down if
+// the periods covering it had none or none were stored. Hours overlapping a
+// maintenance window of the member or the whole network aren't counted
+func computeUptime(network string, periods []BandwidthUsagePeriod, from time.Time, to time.Time, maintenance []Annotation, target float64) []MemberUptime {
+	hours := int(to.Sub(from) / time.Hour)
+	if to.Sub(from)%time.Hour > 0 {
+		hours++
+	}
+	if hours < 0 {
+		hours = 0
+	}
+
+	// hourRange is the hours of the window a period from start to end covers
+	hourRange := func(start time.Time, end time.Time) (int, int) {
+		first := int(start.Sub(from) / time.Hour)
+		last := int((end.Sub(from) + time.Hour - 1) / time.Hour)
+		if first < 0 {
+			first = 0
+		}
+		if last > hours {
+			last = hours
+		}
+		return first, last
+	}
+
+	type memberHours struct {
+		uptime MemberUptime
+		hours  []int
+	}
+	byMember := map[string]*memberHours{}
+	keys := []string{}
+
+	for _, period := range periods {
+		key := period.MemberID
+		if key == "" {
+			key = period.Name
+		}
+		member, ok := byMember[key]
+		if !ok {
+			member = &memberHours{
+				uptime: MemberUptime{Network: network, MemberID: period.MemberID, From: from, To: to, Target: target},
+				hours:  make([]int, hours),
+			}
+			byMember[key] = member
+			keys = append(keys, key)
+		}
+		member.uptime.Name = period.Name
+
+		state := hourDown
+		switch {
+		case period.Status == usageStatusFailed:
+			state = hourUnknown
+		case period.Total != nil && *period.Total > 0:
+			state = hourUp
+		}
+
+		first, last := hourRange(period.From, period.To)
+		for i := first; i < last; i++ {
+			if state > member.hours[i] {
+				member.hours[i] = state
+			}
+		}
+	}
+
+	all := []MemberUptime{}
+	for _, key := range keys {
+		member := byMember[key]
+
+		for _, window := range maintenance {
+			if !window.Maintenance || window.From == nil || window.To == nil {
+				continue
+			}
+			if window.MemberID != "" && window.MemberID != member.uptime.MemberID {
+				continue
+			}
+			first, last := hourRange(*window.From, *window.To)
+			for i := first; i < last; i++ {
+				member.hours[i] = hourMaintenance
+			}
+		}
+
+		uptime := member.uptime
+		for _, state := range member.hours {
+			switch state {
+			case hourUp:
+				uptime.Up++
+				uptime.Expected++
+			case hourDown:
+				uptime.Expected++
+			case hourUnknown:
+				uptime.Unknown++
+			case hourMaintenance:
+				uptime.Maintenance++
+			}
+		}
+		if uptime.Expected > 0 {
+			uptime.Uptime = float64(uptime.Up) / float64(uptime.Expected) * 100
+			uptime.Breach = uptime.Uptime < target
+		}
+
+		all = append(all, uptime)
+	}
+
+	return all
+}
+
+func (u MemberUptime) reportColumns() []string {
+	return []string{"NETWORK", "NAME", "EXPECTED (H)", "UP (H)", "MAINTENANCE (H)", "UNKNOWN (H)", "UPTIME (%)", "TARGET (%)", "BREACH"}
+}
+
+func (u MemberUptime) reportValues(number func(*float64) string) []string {
+	return []string{
+		u.Network,
+		u.Name,
+		strconv.Itoa(u.Expected),
+		strconv.Itoa(u.Up),
+		strconv.Itoa(u.Maintenance),
+		strconv.Itoa(u.Unknown),
+		number(&u.Uptime),
+		number(&u.Target),
+		strconv.FormatBool(u.Breach),
+	}
+}
+
+// uptimeCommand reports the uptime of every member over the window against
+// SLA_UPTIME_TARGET, leaving out the network's maintenance windows
+func uptimeCommand(args []string) {
+	flags := flag.NewFlagSet("uptime", flag.ExitOnError)
+	output := flags.String("output", defaultOutput(), "output format: table, json, csv or quiet")
+	flags.Parse(args)
+
+	report, err := newReportWriter(os.Stdout, *output)
+	if err != nil {
+		fatal(err)
+	}
+
+	from, to, _ := parseWindow(flags.Args())
+
+	for _, settings := range loadAllNetworkSettings() {
+		bwupCollection, err := getReadBWUPCollection(settings)
+		if err != nil {
+			fatal(err)
+		}
+
+		periods, err := getUsagePeriods(bwupCollection, settings.Network, "", "", from, to)
+		if err != nil {
+			fatal(err)
+		}
+		annotations, err := getAnnotations(bwupCollection.Database().Collection(settings.MongoAnnotationsCollection), settings.Network, "", from, to)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, uptime := range computeUptime(settings.Network, periods, from, to, annotations, settings.SLAUptimeTarget) {
+			if err := report.Write(uptime); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	if err := report.Flush(); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeUptime(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	hour := func(memberID string, h int, bwup BandwidthUsagePeriod) BandwidthUsagePeriod {
+		bwup.MemberID = memberID
+		bwup.From = from.Add(time.Duration(h) * time.Hour)
+		bwup.To = bwup.From.Add(time.Hour)
+		return bwup
+	}
+
+	periods := []BandwidthUsagePeriod{}
+	for h := 0; h < 10; h++ {
+		switch {
+		case h < 6:
+			periods = append(periods, hour("rec1", h, usage(1, 2)))
+		case h == 6:
+			periods = append(periods, hour("rec1", h, failedUsage()))
+		case h == 7:
+			periods = append(periods, hour("rec1", h, noUsage()))
+		}
+		// Duplicate periods of an hour count once, as up if either had traffic
+		periods = append(periods, hour("rec2", h, noUsage()))
+		if h < 5 {
+			periods = append(periods, hour("rec2", h, usage(1, 1)))
+		}
+	}
+
+	at := func(h int) *time.Time {
+		t := from.Add(time.Duration(h) * time.Hour)
+		return &t
+	}
+	annotations := []Annotation{
+		{From: at(8), To: at(10), Text: "tower work", Maintenance: true},
+		{MemberID: "rec2", From: at(5), To: at(7), Text: "router swap", Maintenance: true},
+		{MemberID: "rec1", From: at(6), To: at(8), Text: "not maintenance"},
+	}
+
+	uptimes := computeUptime("casa", periods, from, to, annotations, 90)
+	if len(uptimes) != 2 {
+		t.Fatalf("expected 2 members, got %d", len(uptimes))
+	}
+
+	tests := []struct {
+		uptime      MemberUptime
+		expected    int
+		up          int
+		maintenance int
+		unknown     int
+		breach      bool
+	}{
+		// Up 6 hours, down 1, unknown 1 and 2 in maintenance
+		{uptimes[0], 7, 6, 2, 1, true},
+		// Up 5 hours, down 1, and 4 in maintenance
+		{uptimes[1], 6, 5, 4, 0, true},
+	}
+
+	for _, test := range tests {
+		u := test.uptime
+		if u.Expected != test.expected || u.Up != test.up || u.Maintenance != test.maintenance || u.Unknown != test.unknown || u.Breach != test.breach {
+			t.Errorf("%s: got %+v", u.MemberID, u)
+		}
+	}
+	if uptimes[0].Uptime < 85.71 || uptimes[0].Uptime > 85.72 {
+		t.Errorf("expected 85.71%% uptime, got %v", uptimes[0].Uptime)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// settingsChecker gathers the problems of a network's settings, each naming
+// the key to fix
+type settingsChecker struct {
+	problems []string
+}
+
+func (c *settingsChecker) add(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// oneOf checks the setting key is one of the choices, or empty if that is
+// allowed
+func (c *settingsChecker) oneOf(key string, value string, empty bool, choices ...string) {
+	if value == "" && empty {
+		return
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return
+		}
+	}
+	c.add("%s must be one of %s, got %q", key, strings.Join(choices, ", "), value)
+}
+
+// url checks the setting key, if set, is an absolute URL with one of the
+// schemes
+func (c *settingsChecker) url(key string, value string, schemes ...string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		c.add("%s must be a URL like %s://host/, got %q", key, schemes[0], redactURL(value))
+		return
+	}
+	c.oneOf(key+" scheme", u.Scheme, false, schemes...)
+}
+
+// positive checks a duration setting is above 0
+func (c *settingsChecker) positive(key string, value time.Duration) {
+	if value <= 0 {
+		c.add("%s must be a positive duration like 1h, got %s", key, value)
+	}
+}
+
+// notNegative checks a duration setting isn't below 0
+func (c *settingsChecker) notNegative(key string, value time.Duration) {
+	if value < 0 {
+		c.add("%s must not be negative, got %s", key, value)
+	}
+}
+
+// atLeast checks a whole number setting is min or more
+func (c *settingsChecker) atLeast(key string, value int64, min int64) {
+	if value < min {
+		c.add("%s must be at least %d, got %d", key, min, value)
+	}
+}
+
+// between checks a number setting is from min to max
+func (c *settingsChecker) between(key string, value float64, min float64, max float64) {
+	if value < min || value > max {
+		c.add("%s must be from %g to %g, got %g", key, min, max, value)
+	}
+}
+
+// required checks each of the keys is set, for the reason given
+func (c *settingsChecker) required(reason string, settings map[string]string) {
+	missing := []string{}
+	for key, value := range settings {
+		if value == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		c.add("%s needs %s, which %s not set", reason, joinAnd(missing), isOrAre(len(missing)))
+	}
+}
+
+// exclusive checks at most one of the keys is set
+func (c *settingsChecker) exclusive(reason string, settings map[string]string) {
+	set := []string{}
+	for key, value := range settings {
+		if value != "" {
+			set = append(set, key)
+		}
+	}
+	if len(set) > 1 {
+		sort.Strings(set)
+		c.add("%s can't both be set, %s", joinAnd(set), reason)
+	}
+}
+
+// joinAnd lists the keys like A, B and C
+func joinAnd(keys []string) string {
+	if len(keys) < 2 {
+		return strings.Join(keys, "")
+	}
+	return strings.Join(keys[:len(keys)-1], ", ") + " and " + keys[len(keys)-1]
+}
+
+func isOrAre(count int) string {
+	if count == 1 {
+		return "is"
+	}
+	return "are"
+}
+
+// validateSettings checks the settings every command reads are well formed:
+// URLs parse, durations and numbers are in bounds, choices are known, and
+// options which can't be combined aren't. Settings only some commands need
+// are checked by them, like collectionProblems
+func validateSettings(settings Settings) []string {
+	c := &settingsChecker{}
+
+	c.oneOf("STAT_SOURCE", settings.StatSource, true, statSourceGraylog, statSourceLoki, statSourceClickHouse, statSourceNetflow)
+	if !validMemberIdentity(settings.MemberIdentity) {
+		c.add("MEMBER_IDENTITY must be one of wg-key, router-mac, static-ip, hostname, mesh-ip, got %q", settings.MemberIdentity)
+	}
+	c.oneOf("GRAYLOG_QUERY_MODE", settings.GraylogQueryMode, false, queryModePhrase, queryModeRegex, queryModeStructured, queryModeGELF, queryModeSaved)
+	c.oneOf("GRAYLOG_QUERY_STRATEGY", settings.GraylogQueryStrategy, false, queryStrategyAuto, queryStrategyMember, queryStrategyTerms)
+	c.oneOf("GRAYLOG_NON_FINITE", settings.GraylogNonFinite, false, nonFiniteNull, nonFiniteZero, nonFiniteError)
+	c.oneOf("PREFLIGHT_ACTION", settings.PreflightAction, false, preflightAbort, preflightWarn)
+	c.oneOf("ANOMALY_METHOD", settings.AnomalyMethod, true, anomalyZScore, anomalyMAD)
+	c.oneOf("DUPLICATE_POLICY", settings.DuplicatePolicy, false, duplicatePolicySkip, duplicatePolicyOverwrite, duplicatePolicyMerge, duplicatePolicyError)
+	c.oneOf("EVENT_BUS", settings.EventBus, true, eventBusNATS, eventBusKafka)
+	c.oneOf("CRM_PROVIDER", settings.CRMProvider, true, crmHubSpot, crmOdoo)
+	c.oneOf("CONSENT_OPT_OUT", settings.ConsentOptOut, false, consentPseudonymize, consentExclude)
+	for _, name := range settings.UsageStores {
+		if _, ok := sinkFactories[name]; !ok {
+			c.add("USAGE_STORES must only name %s, got %q", sinkNames(), name)
+		}
+	}
+	if settings.MongoReadPreference != "" {
+		if _, err := readpref.ModeFromString(settings.MongoReadPreference); err != nil {
+			c.add("MONGO_READ_PREFERENCE must be one of primary, primaryPreferred, secondary, secondaryPreferred, nearest, got %q", settings.MongoReadPreference)
+		}
+	}
+
+	// Paths are added straight onto GRAYLOG_URL
+	c.url("GRAYLOG_URL", settings.GraylogURL, "https", "http")
+	if settings.GraylogURL != "" && !strings.HasSuffix(settings.GraylogURL, "/") {
+		c.add("GRAYLOG_URL must end with a slash, like https://graylog.example.org/")
+	}
+	c.url("LOKI_URL", settings.LokiURL, "https", "http")
+	c.url("CLICKHOUSE_URL", settings.ClickHouseURL, "https", "http")
+	c.url("BIGQUERY_URL", settings.BigQueryURL, "https", "http")
+	c.url("AIRTABLE_OAUTH_REDIRECT_URL", settings.AirtableOAuthRedirectURL, "https", "http")
+	c.url("LINK_BASE_URL", settings.LinkBaseURL, "https", "http")
+	c.url("AGENT_PUSH_URL", settings.AgentPushURL, "https", "http")
+	c.url("WEBHOOK_URL", settings.WebhookURL, "https", "http")
+	c.url("TWILIO_URL", settings.TwilioURL, "https", "http")
+	c.url("CRM_URL", settings.CRMURL, "https", "http")
+	c.url("MONGO_URL", settings.MongoURL, "mongodb", "mongodb+srv")
+	c.url("MONGO_READ_URL", settings.MongoReadURL, "mongodb", "mongodb+srv")
+	c.url("MONGO_DUAL_WRITE_URL", settings.MongoDualWriteURL, "mongodb", "mongodb+srv")
+	c.url("POSTGRES_URL", settings.PostgresURL, "postgres", "postgresql")
+
+	c.positive("QUERY_CHUNK", settings.QueryChunk)
+	c.positive("BACKFILL_PERIOD", settings.BackfillPeriod)
+	c.positive("NETFLOW_FLUSH_INTERVAL", settings.NetflowFlushInterval)
+	c.positive("SNMP_POLL_INTERVAL", settings.SNMPPollInterval)
+	c.positive("HOOK_TIMEOUT", settings.HookTimeout)
+	c.positive("INGEST_RETRY_INTERVAL", settings.IngestRetryInterval)
+	c.positive("LINK_VALIDITY", settings.LinkValidity)
+	c.positive("AGENT_INTERVAL", settings.AgentInterval)
+	c.positive("RETENTION_PERIOD", settings.RetentionPeriod)
+	c.notNegative("SCHEDULE_WINDOW", settings.ScheduleWindow)
+	c.notNegative("SCHEDULE_JITTER", settings.ScheduleJitter)
+	c.notNegative("MEMBER_CACHE_TTL", settings.MemberCacheTTL)
+	c.notNegative("RESULT_CACHE_TTL", settings.ResultCacheTTL)
+	c.notNegative("INGEST_DEDUP_TTL", settings.IngestDedupTTL)
+	c.notNegative("ABUSE_SATURATED_HOURS", settings.AbuseSaturatedHours)
+
+	c.atLeast("BACKFILL_CONCURRENCY", int64(settings.BackfillConcurrency), 1)
+	c.atLeast("INGEST_BUFFER_SIZE", int64(settings.IngestBufferSize), 1)
+	// Read as a whole number, so a negative rate wraps around
+	c.atLeast("NETFLOW_SAMPLING_RATE", int64(settings.NetflowSamplingRate), 1)
+	c.atLeast("NETFLOW_HOURLY_MONTHS", int64(settings.NetflowHourlyMonths), 0)
+	c.atLeast("GRAYLOG_TERMS_MIN_MEMBERS", int64(settings.GraylogTermsMinMembers), 0)
+	c.atLeast("SCHEDULE_CATCH_UP", int64(settings.ScheduleCatchUp), 0)
+	c.atLeast("PREFLIGHT_MIN_MESSAGES", int64(settings.PreflightMinMessages), 0)
+	c.atLeast("ANOMALY_HISTORY", int64(settings.AnomalyHistory), 0)
+	c.between("SLA_UPTIME_TARGET", settings.SLAUptimeTarget, 0, 100)
+	c.between("ABUSE_SATURATION", settings.AbuseSaturation, 0, 1)
+	c.atLeast("PUBLIC_MIN_MEMBERS", int64(settings.PublicMinMembers), 0)
+	c.atLeast("ATOM_FEED_WEEKS", int64(settings.AtomFeedWeeks), 1)
+	if settings.PublicStats || len(settings.AtomFeed) > 0 {
+		// The feed's ID is its URL
+		c.required("The Atom feed", map[string]string{"LINK_BASE_URL": settings.LinkBaseURL})
+	}
+	if settings.PublicNoiseEpsilon < 0 || settings.PublicRoundGB < 0 {
+		c.add("PUBLIC_NOISE_EPSILON and PUBLIC_ROUND_GB must not be negative, 0 to turn them off, got %g and %g", settings.PublicNoiseEpsilon, settings.PublicRoundGB)
+	}
+	if settings.PublicNoiseSensitivityGB <= 0 {
+		c.add("PUBLIC_NOISE_SENSITIVITY_GB must be positive, got %g", settings.PublicNoiseSensitivityGB)
+	}
+	for _, destination := range append(append([]string{}, settings.PublicFeed...), settings.AtomFeed...) {
+		if strings.HasPrefix(destination, "s3://") {
+			if _, err := parseS3URL(destination); err != nil {
+				c.add("PUBLIC_FEED and ATOM_FEED must be files, S3 objects or URLs: %v", err)
+			}
+			c.required("Publishing public stats to S3", map[string]string{"AWS_ACCESS_KEY_ID": settings.AWSAccessKeyID, "AWS_SECRET_ACCESS_KEY": settings.AWSSecretAccessKey})
+		} else if strings.Contains(destination, "://") {
+			c.url("PUBLIC_FEED and ATOM_FEED", destination, "https", "http")
+		}
+	}
+	c.url("S3_ENDPOINT", settings.S3Endpoint, "https", "http")
+	if settings.BackfillRate < 0 {
+		c.add("BACKFILL_RATE must not be negative, 0 for no limit, got %g", settings.BackfillRate)
+	}
+
+	if _, err := time.LoadLocation(settings.ScheduleTimezone); err != nil {
+		c.add("SCHEDULE_TIMEZONE must be a time zone like America/Bogota, got %q", settings.ScheduleTimezone)
+	}
+	if _, err := parseBlackouts(settings.ScheduleBlackouts); err != nil {
+		c.add("SCHEDULE_BLACKOUTS is invalid: %v", err)
+	}
+	if _, err := parseAPITokens(settings.APITokens); err != nil {
+		c.add("API_TOKENS is invalid: %v", err)
+	}
+	if _, err := parseSigningKey(settings.SigningKey); err != nil {
+		c.add("%v", err)
+	}
+	if _, err := parsePIIKey(settings.PIIKey); err != nil {
+		c.add("%v", err)
+	}
+
+	c.exclusive("members are read from the CSV file or from Airtable", map[string]string{
+		"MEMBERS_CSV":      settings.MembersCSV,
+		"AIRTABLE_API_KEY": settings.AirtableAPIKey,
+	})
+	c.exclusive("members are read from the CSV file or from Airtable", map[string]string{
+		"MEMBERS_CSV":              settings.MembersCSV,
+		"AIRTABLE_OAUTH_CLIENT_ID": settings.AirtableOAuthClientID,
+	})
+	c.exclusive("Airtable is read with an API key or an OAuth grant", map[string]string{
+		"AIRTABLE_API_KEY":         settings.AirtableAPIKey,
+		"AIRTABLE_OAUTH_CLIENT_ID": settings.AirtableOAuthClientID,
+	})
+	c.exclusive("the key member names are encrypted with is given or fetched", map[string]string{
+		"PII_KEY":         settings.PIIKey,
+		"PII_KEY_COMMAND": settings.PIIKeyCommand,
+	})
+
+	// Half a credential is a mistake, not an anonymous login
+	if settings.GraylogUser != "" || settings.GraylogPass != "" {
+		c.required("logging in to Graylog", map[string]string{"GRAYLOG_USER": settings.GraylogUser, "GRAYLOG_PASS": settings.GraylogPass})
+	}
+	if settings.LokiUser != "" || settings.LokiPass != "" {
+		c.required("logging in to Loki", map[string]string{"LOKI_USER": settings.LokiUser, "LOKI_PASS": settings.LokiPass})
+	}
+	if settings.GraylogQueryMode == queryModeSaved {
+		c.required("GRAYLOG_QUERY_MODE saved", map[string]string{"GRAYLOG_UP_SEARCH": settings.GraylogUpSearch, "GRAYLOG_DOWN_SEARCH": settings.GraylogDownSearch})
+	}
+
+	return c.problems
+}
+
+// collectionProblems checks the settings a collection run needs are set:
+// where the members are read from, the stat source and the usage stores
+func collectionProblems(settings Settings) []string {
+	c := &settingsChecker{}
+
+	if settings.MembersCSV == "" {
+		c.required("reading members from Airtable", map[string]string{"AIRTABLE_BASE_ID": settings.AirtableBaseID, "AIRTABLE_TABLE_NAME": settings.AirtableTableName})
+		if settings.Replay == "" && settings.AirtableAPIKey == "" && settings.AirtableOAuthClientID == "" {
+			c.add("reading members from Airtable needs AIRTABLE_API_KEY or AIRTABLE_OAUTH_CLIENT_ID, or MEMBERS_CSV to read them from a file instead")
+		}
+	}
+
+	// A replayed run reads the stat source's recorded responses and stores
+	// nothing
+	if settings.Replay != "" {
+		return c.problems
+	}
+
+	switch settings.StatSource {
+	case "", statSourceGraylog:
+		c.required("STAT_SOURCE graylog", map[string]string{"GRAYLOG_URL": settings.GraylogURL, "GRAYLOG_USER": settings.GraylogUser, "GRAYLOG_PASS": settings.GraylogPass})
+	case statSourceLoki:
+		c.required("STAT_SOURCE loki", map[string]string{"LOKI_URL": settings.LokiURL})
+	case statSourceClickHouse:
+		c.required("STAT_SOURCE clickhouse", map[string]string{"CLICKHOUSE_URL": settings.ClickHouseURL})
+	case statSourceNetflow:
+		c.required("STAT_SOURCE netflow", map[string]string{"MONGO_URL": settings.MongoURL, "MONGO_DATABASE": settings.MongoDatabase})
+	}
+
+	// The sinks of PIPELINE_FILE are checked as it is read
+	if settings.PipelineFile != "" {
+		return c.problems
+	}
+	for _, name := range settings.UsageStores {
+		switch name {
+		case usageStoreMongo:
+			c.required("the mongo usage store", map[string]string{"MONGO_URL": settings.MongoURL, "MONGO_DATABASE": settings.MongoDatabase, "MONGO_COLLECTION": settings.MongoCollection})
+		case usageStoreClickHouse:
+			c.required("the clickhouse usage store", map[string]string{"CLICKHOUSE_URL": settings.ClickHouseURL})
+		case usageStoreEvents:
+			c.required("the events usage store", map[string]string{"EVENT_BUS": settings.EventBus, "EVENT_BUS_URL": settings.EventBusURL})
+		case usageStoreSQLite:
+			c.required("the sqlite usage store", map[string]string{"SQLITE_PATH": settings.SQLitePath})
+		case usageStorePostgres:
+			c.required("the postgres usage store", map[string]string{"POSTGRES_URL": settings.PostgresURL})
+		case usageStoreBigQuery:
+			c.required("the bigquery usage store", map[string]string{"BIGQUERY_PROJECT": settings.BigQueryProject, "BIGQUERY_DATASET": settings.BigQueryDataset, "BIGQUERY_CREDENTIALS": settings.BigQueryCredentials})
+		case usageStoreWebhook:
+			c.required("the webhook usage store", map[string]string{"WEBHOOK_URL": settings.WebhookURL})
+		}
+	}
+
+	return c.problems
+}
+
+// settingsError lists the problems of a network's settings
+func settingsError(settings Settings, problems []string) error {
+	where := "the setting flags, the environment or .env"
+	if settings.Network != "" && settings.Network != defaultNetwork {
+		where = fmt.Sprintf("the setting flags, the environment, .env or network %s in NETWORKS_FILE", settings.Network)
+	}
+	return fmt.Errorf("%d invalid settings, fix them in %s:\n  %s", len(problems), where, strings.Join(problems, "\n  "))
+}
+
+// checkSettings exits listing every problem with the settings, those which
+// couldn't be parsed and those validateSettings finds, if there are any
+func checkSettings(settings Settings, problems []string) {
+	problems = append(problems, validateSettings(settings)...)
+	if len(problems) > 0 {
+		fatal(settingsError(settings, problems))
+	}
+}
+
+// checkCollectionSettings exits listing what a collection run of the
+// network is missing, before anything is queried
+func checkCollectionSettings(settings Settings) {
+	if problems := collectionProblems(settings); len(problems) > 0 {
+		fatal(settingsError(settings, problems))
+	}
+}
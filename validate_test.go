@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSettingsProblems(t *testing.T) {
+	settings, problems := readSettings("casa", settingsEnv{
+		"QUERY_CHUNK":               "daily",
+		"BACKFILL_CONCURRENCY":      "four",
+		"AUDIT_THRESHOLD":           "10%",
+		"POSTGRES_AUTO_MIGRATE":     "sometimes",
+		"INGEST_RETRY_INTERVAL":     "5s",
+		"GRAYLOG_TERMS_MIN_MEMBERS": "",
+	})
+
+	want := []string{
+		`QUERY_CHUNK must be formatted like 1m, got "daily"`,
+		`POSTGRES_AUTO_MIGRATE must be true or false, got "sometimes"`,
+		`AUDIT_THRESHOLD must be a number, got "10%"`,
+		`BACKFILL_CONCURRENCY must be a whole number, got "four"`,
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+	// Malformed values fall back to their defaults, so the others can still
+	// be checked
+	if settings.BackfillConcurrency != 4 || settings.IngestRetryInterval.Seconds() != 5 {
+		t.Errorf("got settings %+v", settings)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	valid, _ := readSettings("casa", settingsEnv{})
+	if problems := validateSettings(valid); len(problems) != 0 {
+		t.Errorf("the defaults have problems %q", problems)
+	}
+
+	settings, _ := readSettings("casa", settingsEnv{
+		"STAT_SOURCE":           "splunk",
+		"GRAYLOG_URL":           "https://graylog.example.org",
+		"MONGO_URL":             "http://localhost:27017",
+		"LOKI_URL":              "loki:3100",
+		"QUERY_CHUNK":           "0s",
+		"SCHEDULE_TIMEZONE":     "Mars/Olympus",
+		"USAGE_STORES":          "mongo,s3",
+		"MEMBERS_CSV":           "members.csv",
+		"AIRTABLE_API_KEY":      "key",
+		"GRAYLOG_USER":          "collector",
+		"NETFLOW_SAMPLING_RATE": "-1",
+	})
+	problems := strings.Join(validateSettings(settings), "\n")
+	for _, want := range []string{
+		`STAT_SOURCE must be one of graylog, loki, clickhouse, netflow, got "splunk"`,
+		"GRAYLOG_URL must end with a slash",
+		`MONGO_URL scheme must be one of mongodb, mongodb+srv, got "http"`,
+		`LOKI_URL must be a URL like https://host/, got "loki:3100"`,
+		"QUERY_CHUNK must be a positive duration like 1h, got 0s",
+		`SCHEDULE_TIMEZONE must be a time zone like America/Bogota, got "Mars/Olympus"`,
+		`got "s3"`,
+		"AIRTABLE_API_KEY and MEMBERS_CSV can't both be set",
+		"logging in to Graylog needs GRAYLOG_PASS, which is not set",
+		"NETFLOW_SAMPLING_RATE must be at least 1, got -1",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("expected %q in the problems:\n%s", want, problems)
+		}
+	}
+}
+
+func TestCollectionProblems(t *testing.T) {
+	settings, _ := readSettings("casa", settingsEnv{"USAGE_STORES": "mongo,sqlite"})
+	want := []string{
+		"reading members from Airtable needs AIRTABLE_BASE_ID and AIRTABLE_TABLE_NAME, which are not set",
+		"reading members from Airtable needs AIRTABLE_API_KEY or AIRTABLE_OAUTH_CLIENT_ID, or MEMBERS_CSV to read them from a file instead",
+		"STAT_SOURCE graylog needs GRAYLOG_PASS, GRAYLOG_URL and GRAYLOG_USER, which are not set",
+		"the mongo usage store needs MONGO_COLLECTION, MONGO_DATABASE and MONGO_URL, which are not set",
+		"the sqlite usage store needs SQLITE_PATH, which is not set",
+	}
+	if problems := collectionProblems(settings); !reflect.DeepEqual(problems, want) {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+
+	// A replayed run needs no credentials and stores nothing
+	settings.MembersCSV = "members.csv"
+	settings.Replay = "testdata/replay"
+	if problems := collectionProblems(settings); len(problems) != 0 {
+		t.Errorf("got problems %q replaying", problems)
+	}
+
+	settings, _ = readSettings("casa", settingsEnv{
+		"MEMBERS_CSV":      "members.csv",
+		"STAT_SOURCE":      statSourceLoki,
+		"LOKI_URL":         "http://loki:3100/",
+		"MONGO_URL":        "mongodb://localhost",
+		"MONGO_DATABASE":   "stats",
+		"MONGO_COLLECTION": "usage",
+	})
+	if problems := collectionProblems(settings); len(problems) != 0 {
+		t.Errorf("got problems %q", problems)
+	}
+}
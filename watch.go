@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxWatchRetryDelay caps the wait between attempts to forward a change the
+// sinks refused
+const maxWatchRetryDelay = time.Minute
+
+// watchResumeToken is where the watcher of a collection got to, so it picks
+// up there after a restart
+type watchResumeToken struct {
+	ID        string `bson:"_id"`
+	Token     bson.Raw
+	UpdatedAt time.Time
+}
+
+// usageChange is the part of a change stream event the watcher reads. The
+// full document is kept raw, as decoding it as a period would make one of
+// the null left by a period deleted before the update was looked up
+type usageChange struct {
+	OperationType string
+	FullDocument  bson.RawValue `bson:"fullDocument"`
+}
+
+// period is the period the change leaves, nil if there is none
+func (c usageChange) period() (*BandwidthUsagePeriod, error) {
+	if c.FullDocument.Type != bsontype.EmbeddedDocument {
+		return nil, nil
+	}
+	var bwup BandwidthUsagePeriod
+	if err := c.FullDocument.Unmarshal(&bwup); err != nil {
+		return nil, err
+	}
+	return &bwup, nil
+}
+
+// watchPipeline matches the changes of the network's usage which leave a
+// period to forward. Deletes have nothing to forward, like a period updated
+// and deleted before the update was looked up
+func watchPipeline(network string) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"operationType":        bson.M{"$in": bson.A{"insert", "update", "replace"}},
+			"fullDocument.network": networkMatch(network),
+		}}},
+	}
+}
+
+// newWatchSinks opens the WATCH_SINKS changes are forwarded to. The mongo
+// sink isn't allowed, it would write back to the watched collection
+func newWatchSinks(settings Settings) (MultiStore, error) {
+	if len(settings.WatchSinks) == 0 {
+		return nil, fmt.Errorf("WATCH_SINKS must list the sinks to forward changes to, like %s", sinkNames())
+	}
+
+	sinks := MultiStore{}
+	for _, name := range settings.WatchSinks {
+		if name == usageStoreMongo {
+			return nil, fmt.Errorf("invalid sink %q in WATCH_SINKS, it would write back to the watched collection", name)
+		}
+		factory, ok := sinkFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid sink %q in WATCH_SINKS, expected %s", name, sinkNames())
+		}
+		sink, err := factory(settings, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func getResumeToken(collection *mongo.Collection, id string) (bson.Raw, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var token watchResumeToken
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return token.Token, err
+}
+
+func saveResumeToken(collection *mongo.Collection, id string, token bson.Raw) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": id},
+		watchResumeToken{ID: id, Token: token, UpdatedAt: time.Now()},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// forwardChange inserts a changed period into the sinks, retrying until
+// they take it or ctx is done, so no change is skipped over
+func forwardChange(ctx context.Context, sinks UsageStore, bwup BandwidthUsagePeriod) error {
+	delay := time.Second
+	for {
+		err := sinks.Insert(bwup)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error forwarding the usage of %s from %v, retrying in %v: %v", bwup.Name, bwup.From, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxWatchRetryDelay {
+			delay = maxWatchRetryDelay
+		}
+	}
+}
+
+// watchCommand tails the change stream of the usage collection, forwarding
+// inserted and updated periods to WATCH_SINKS, like webhook, events on a
+// Kafka EVENT_BUS or bigquery, so they are kept in sync without exporting
+// everything again. Where it got to is saved after each
+// change, and it resumes from there unless -reset is given. Change streams
+// need Mongo to run as a replica set
+func watchCommand(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	reset := flags.Bool("reset", false, "start from the current changes, ignoring where the last watch got to")
+	flags.Parse(args)
+
+	settings := loadSettings()
+
+	sinks, err := newWatchSinks(settings)
+	if err != nil {
+		fatal(err)
+	}
+
+	db, err := getMongoDatabase(settings)
+	if err != nil {
+		fatal(err)
+	}
+	tokens := db.Collection(settings.MongoWatchCollection)
+	tokenID := settings.Network + "|" + settings.MongoCollection
+
+	streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if !*reset {
+		token, err := getResumeToken(tokens, tokenID)
+		if err != nil {
+			fatal(err)
+		}
+		if token != nil {
+			streamOptions.SetResumeAfter(token)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	stream, err := db.Collection(settings.MongoCollection).Watch(ctx, watchPipeline(settings.Network), streamOptions)
+	if err != nil {
+		fatal(err)
+	}
+	defer stream.Close(context.Background())
+
+	log.Printf("Watching %s for changes to forward to %v", settings.MongoCollection, settings.WatchSinks)
+	forwarded := 0
+	for stream.Next(ctx) {
+		var change usageChange
+		if err := stream.Decode(&change); err != nil {
+			fatal(err)
+		}
+		bwup, err := change.period()
+		if err != nil {
+			fatal(err)
+		}
+
+		if bwup != nil {
+			if err := forwardChange(ctx, sinks, *bwup); err != nil {
+				break
+			}
+			forwarded++
+		}
+
+		if err := saveResumeToken(tokens, tokenID, stream.ResumeToken()); err != nil {
+			log.Printf("Error saving where the watch got to: %v", err)
+		}
+	}
+
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		fatal(err)
+	}
+	log.Printf("Forwarded %d changes", forwarded)
+}
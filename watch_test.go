@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNewWatchSinks(t *testing.T) {
+	tests := []struct {
+		name  string
+		sinks []string
+		valid bool
+	}{
+		{"webhook", []string{usageStoreWebhook}, true},
+		{"none", nil, false},
+		{"back into mongo", []string{usageStoreMongo}, false},
+		{"unknown", []string{"kafka"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := newWatchSinks(Settings{WatchSinks: test.sinks, WebhookURL: "http://localhost:8080/usage"})
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
+
+func TestUsageChange(t *testing.T) {
+	bwup := usage(3, 12)
+	bwup.Network, bwup.Name = "casa", "Ana"
+
+	tests := []struct {
+		name  string
+		event bson.M
+		want  *BandwidthUsagePeriod
+	}{
+		{"insert", bson.M{"operationType": "insert", "fullDocument": bwup}, &bwup},
+		{"update looked up", bson.M{"operationType": "update", "fullDocument": bwup}, &bwup},
+		{"update of a deleted period", bson.M{"operationType": "update", "fullDocument": nil}, nil},
+	}
+
+	for _, test := range tests {
+		raw, err := bson.Marshal(test.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var change usageChange
+		if err := bson.Unmarshal(raw, &change); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		period, err := change.period()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if (period == nil) != (test.want == nil) {
+			t.Errorf("%s: got %v, want %v", test.name, period, test.want)
+			continue
+		}
+		if period != nil && (period.Name != "Ana" || *period.Down != 12) {
+			t.Errorf("%s: got %+v", test.name, period)
+		}
+	}
+}
+
+// flakyStore refuses the first failures inserts
+type flakyStore struct {
+	failures int
+	inserted []BandwidthUsagePeriod
+}
+
+func (s *flakyStore) Insert(bwup BandwidthUsagePeriod) error {
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("sink is down")
+	}
+	s.inserted = append(s.inserted, bwup)
+	return nil
+}
+
+func TestForwardChange(t *testing.T) {
+	store := &flakyStore{failures: 1}
+	if err := forwardChange(context.Background(), store, usage(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.inserted) != 1 {
+		t.Errorf("got %d inserted, want the change retried", len(store.inserted))
+	}
+
+	// Stopping the watch gives up on a sink which is down
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	store = &flakyStore{failures: 1000}
+	if err := forwardChange(ctx, store, usage(1, 2)); err == nil {
+		t.Error("should have failed")
+	}
+}
+
+func TestWebhookStore(t *testing.T) {
+	received := []BandwidthUsagePeriod{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var bwup BandwidthUsagePeriod
+		if err := json.NewDecoder(r.Body).Decode(&bwup); err != nil || bwup.Name == "" {
+			http.Error(w, "expected a usage period", http.StatusBadRequest)
+			return
+		}
+		received = append(received, bwup)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	store, err := newWebhookStore(Settings{WebhookURL: "http://localhost:1/unused"}, map[string]string{"url": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bwup := usage(3, 12)
+	bwup.Name = "Ana"
+	if err := store.Insert(bwup); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].Name != "Ana" {
+		t.Errorf("got %+v", received)
+	}
+
+	if err := store.Insert(BandwidthUsagePeriod{}); err == nil {
+		t.Error("refused: should have failed")
+	}
+	if _, err := newWebhookStore(Settings{}, nil); err == nil {
+		t.Error("no URL: should have failed")
+	}
+	if _, err := newWebhookStore(Settings{}, map[string]string{"address": server.URL}); err == nil {
+		t.Error("unknown option: should have failed")
+	}
+}
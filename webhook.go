@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// WebhookStore posts each usage period as JSON to WEBHOOK_URL, or the url
+// option of its PIPELINE_FILE entry, for services with no other way in
+type WebhookStore struct {
+	url    string
+	client http.Client
+}
+
+func newWebhookStore(settings Settings, options map[string]string) (WebhookStore, error) {
+	if err := checkOptions(options, "url"); err != nil {
+		return WebhookStore{}, err
+	}
+
+	url := settings.WebhookURL
+	if options["url"] != "" {
+		url = options["url"]
+	}
+	if url == "" {
+		return WebhookStore{}, fmt.Errorf("the webhook store needs WEBHOOK_URL or a url option")
+	}
+	return WebhookStore{url: url, client: http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (s WebhookStore) Insert(bwup BandwidthUsagePeriod) error {
+	body, err := json.Marshal(bwup)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	return nil
+}